@@ -0,0 +1,107 @@
+/**************************************************************************************************
+** API keys of the Immich CLI application.
+** API_KEY holds one key per user, separated by commas. API_URL is either a single server shared
+** by every key, or one server per key in the same order, so one container can serve several
+** Immich servers. A key listed twice for the same server runs once.
+**************************************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+)
+
+/**************************************************************************************************
+** apiTarget is an API key and the server it belongs to.
+**************************************************************************************************/
+type apiTarget struct {
+	Key string
+	URL string
+}
+
+/**************************************************************************************************
+** host returns the host of the server of the target, for the logs. The URL is returned as is
+** when it cannot be parsed.
+**
+** @return string - Host and port of the server
+**************************************************************************************************/
+func (t apiTarget) host() string {
+	if parsed, err := url.Parse(t.URL); err == nil && parsed.Host != "" {
+		return parsed.Host
+	}
+	return t.URL
+}
+
+/**************************************************************************************************
+** splitList splits a comma-separated list, trimming the values and dropping the empty ones.
+**
+** @param list - Comma-separated values
+** @return []string - The values, in order
+**************************************************************************************************/
+func splitList(list string) []string {
+	values := strings.Split(list, ",")
+	for i, value := range values {
+		values[i] = strings.TrimSpace(value)
+	}
+	return utils.RemoveEmptyStrings(values)
+}
+
+/**************************************************************************************************
+** parseAPITargets pairs the API keys with their server. A single URL is shared by every key,
+** several URLs must match the keys one to one. Keys listed twice for the same server are dropped.
+**
+** @param keys - Comma-separated API keys
+** @param urls - Comma-separated server URLs
+** @return []apiTarget - The targets to run, in order
+** @return []int - Positions (1-based) of the keys dropped as duplicates
+** @return error - An error if no key is set or the URLs do not match the keys
+**************************************************************************************************/
+func parseAPITargets(keys, urls string) ([]apiTarget, []int, error) {
+	keyList := splitList(keys)
+	if len(keyList) == 0 {
+		return nil, nil, fmt.Errorf("no API key(s) provided")
+	}
+	urlList := splitList(urls)
+	if len(urlList) > 1 && len(urlList) != len(keyList) {
+		return nil, nil, fmt.Errorf("API_URL lists %d servers but API_KEY lists %d keys, set one server for every key or a single server", len(urlList), len(keyList))
+	}
+
+	seen := make(map[apiTarget]bool, len(keyList))
+	targets := make([]apiTarget, 0, len(keyList))
+	var duplicates []int
+	for i, key := range keyList {
+		target := apiTarget{Key: key}
+		switch len(urlList) {
+		case 0:
+		case 1:
+			target.URL = urlList[0]
+		default:
+			target.URL = urlList[i]
+		}
+		if seen[target] {
+			duplicates = append(duplicates, i+1)
+			continue
+		}
+		seen[target] = true
+		targets = append(targets, target)
+	}
+	return targets, duplicates, nil
+}
+
+/**************************************************************************************************
+** apiTargets returns the targets of the configured API_KEY and API_URL, validated at startup.
+**
+** @return []apiTarget - The targets to run, in order
+** @return error - A configuration error if no key is set or the URLs do not match the keys
+**************************************************************************************************/
+func apiTargets() ([]apiTarget, error) {
+	targets, _, err := parseAPITargets(apiKey, apiURL)
+	if err != nil {
+		return nil, configError(err)
+	}
+	return targets, nil
+}
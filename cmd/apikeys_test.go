@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the API keys and their servers
+************************************************************************************************/
+
+func TestParseAPITargets(t *testing.T) {
+	tests := []struct {
+		name       string
+		keys       string
+		urls       string
+		targets    []apiTarget
+		duplicates []int
+		wantErr    string
+	}{
+		{
+			name:    "one server for every key",
+			keys:    " k1 , k2,",
+			urls:    "http://immich:2283/api",
+			targets: []apiTarget{{Key: "k1", URL: "http://immich:2283/api"}, {Key: "k2", URL: "http://immich:2283/api"}},
+		},
+		{
+			name:       "duplicate key",
+			keys:       "k1,k1 ,k2,k1",
+			urls:       "http://immich:2283/api",
+			targets:    []apiTarget{{Key: "k1", URL: "http://immich:2283/api"}, {Key: "k2", URL: "http://immich:2283/api"}},
+			duplicates: []int{2, 4},
+		},
+		{
+			name:    "one server per key",
+			keys:    "k1,k2",
+			urls:    "http://home:2283/api, https://photos.example.com/api",
+			targets: []apiTarget{{Key: "k1", URL: "http://home:2283/api"}, {Key: "k2", URL: "https://photos.example.com/api"}},
+		},
+		{
+			name:    "same key on two servers",
+			keys:    "k1,k1",
+			urls:    "http://home:2283/api,https://photos.example.com/api",
+			targets: []apiTarget{{Key: "k1", URL: "http://home:2283/api"}, {Key: "k1", URL: "https://photos.example.com/api"}},
+		},
+		{
+			name:    "servers not matching the keys",
+			keys:    "k1,k2,k3",
+			urls:    "http://home:2283/api,https://photos.example.com/api",
+			wantErr: "API_URL lists 2 servers but API_KEY lists 3 keys",
+		},
+		{
+			name:    "no key",
+			keys:    " , ",
+			urls:    "http://immich:2283/api",
+			wantErr: "no API key(s) provided",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets, duplicates, err := parseAPITargets(tt.keys, tt.urls)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.targets, targets)
+			assert.Equal(t, tt.duplicates, duplicates)
+		})
+	}
+}
+
+func TestAPITargetHost(t *testing.T) {
+	assert.Equal(t, "immich:2283", apiTarget{URL: "http://immich:2283/api"}.host())
+	assert.Equal(t, "photos.example.com", apiTarget{URL: "https://photos.example.com/api"}.host())
+	assert.Equal(t, "immich", apiTarget{URL: "immich"}.host(), "kept as is without a scheme")
+}
+
+func TestAPIURLListEnvVar(t *testing.T) {
+	resetGlobalConfig()
+	clearEnvironment()
+	defer resetGlobalConfig()
+	defer clearEnvironment()
+
+	os.Setenv("API_KEY", "k1,k2")
+	os.Setenv("API_URL", "http://home:2283/api,https://photos.example.com/api,http://third/api")
+	config := LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "API_URL lists 3 servers but API_KEY lists 2 keys")
+
+	resetGlobalConfig()
+	os.Setenv("API_KEY", "k1,k1")
+	os.Setenv("API_URL", "http://home:2283/api")
+	config = LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	targets, err := apiTargets()
+	require.NoError(t, err)
+	assert.Len(t, targets, 1)
+}
@@ -0,0 +1,144 @@
+/**************************************************************************************************
+** Explicit stacks for the Immich CLI application.
+** ASSETS_FROM_FILE names a file listing asset IDs, one per line or as a JSON array. The run then
+** skips the grouping and stacks exactly these assets together, the parent being picked by the
+** promote rules. Every listed asset is checked before anything is modified.
+**************************************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/stacker"
+	"github.com/majorfi/immich-stack/pkg/utils"
+)
+
+/**************************************************************************************************
+** loadAssetIDs reads the asset IDs of the file: a JSON array of strings, or one ID per line.
+** Blank lines are ignored and an ID listed twice is kept once.
+**
+** @param path - Path of the file
+** @return []string - The IDs, in the order of the file
+** @return error - An error if the file cannot be read or lists fewer than 2 assets
+**************************************************************************************************/
+func loadAssetIDs(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ASSETS_FROM_FILE: %w", err)
+	}
+
+	var listed []string
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &listed); err != nil {
+			return nil, fmt.Errorf("invalid ASSETS_FROM_FILE %s, expected a JSON array of asset IDs: %w", path, err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			listed = append(listed, scanner.Text())
+		}
+	}
+
+	seen := make(map[string]bool, len(listed))
+	ids := make([]string, 0, len(listed))
+	for _, id := range listed {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if len(ids) < 2 {
+		return nil, fmt.Errorf("ASSETS_FROM_FILE %s lists %d asset(s), a stack needs at least 2", path, len(ids))
+	}
+	return ids, nil
+}
+
+/**************************************************************************************************
+** fetchListedAssets fetches each listed asset and checks it belongs to the user of the API key,
+** as the assets of a partner can be read but not stacked. Every asset is checked before the
+** error is returned, so it names all the faulty IDs at once.
+**
+** @param client - Immich client of the user
+** @param ids - IDs of the listed assets
+** @return []utils.TAsset - The assets, in the order of the list
+** @return error - A configuration error for missing or foreign assets or a rejected API key,
+** a fatal error if Immich cannot be reached
+**************************************************************************************************/
+func fetchListedAssets(client immich.ImmichClient, ids []string) ([]utils.TAsset, error) {
+	user, err := client.GetCurrentUser()
+	if err != nil {
+		if immich.IsAuthError(err) {
+			return nil, configError(err)
+		}
+		return nil, fatalError(fmt.Errorf("error fetching the user: %w", err))
+	}
+
+	assets := make([]utils.TAsset, 0, len(ids))
+	var missing, foreign []string
+	for _, id := range ids {
+		// Immich answers 400 for an asset the user cannot read, as for an unknown ID
+		asset, err := client.FetchAsset(id)
+		var responseErr *immich.ResponseError
+		switch {
+		case errors.As(err, &responseErr) && (responseErr.StatusCode == http.StatusNotFound || responseErr.StatusCode == http.StatusBadRequest):
+			missing = append(missing, id)
+		case immich.IsAuthError(err):
+			return nil, configError(err)
+		case err != nil:
+			return nil, fatalError(err)
+		case asset.OwnerID != "" && asset.OwnerID != user.ID:
+			foreign = append(foreign, id)
+		default:
+			assets = append(assets, asset)
+		}
+	}
+
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "not found or not readable: "+strings.Join(missing, ", "))
+	}
+	if len(foreign) > 0 {
+		problems = append(problems, "owned by another user: "+strings.Join(foreign, ", "))
+	}
+	if len(problems) > 0 {
+		return nil, configError(fmt.Errorf("ASSETS_FROM_FILE lists assets that cannot be stacked, %s", strings.Join(problems, "; ")))
+	}
+	return assets, nil
+}
+
+/**************************************************************************************************
+** listedStack builds the stack of the listed assets, with their current stacks so the usual
+** checks of the run apply: an unchanged stack is skipped, and children already stacked are only
+** moved with REPLACE_STACKS.
+**
+** @param assets - The listed assets
+** @param existingStacks - Stacks fetched from Immich, by asset ID
+** @param options - Options of the stacker, for the promote rules
+** @return stacker.Stack - The stack, its key made of the sorted asset IDs
+** @return error - An error if the promote rules are invalid
+**************************************************************************************************/
+func listedStack(assets []utils.TAsset, existingStacks map[string]utils.TStack, options stacker.Options) (stacker.Stack, error) {
+	ids := make([]string, 0, len(assets))
+	members := make([]utils.TAsset, len(assets))
+	for i, asset := range assets {
+		if stack, ok := existingStacks[asset.ID]; ok {
+			asset.Stack = &stack
+		}
+		members[i] = asset
+		ids = append(ids, asset.ID)
+	}
+	sort.Strings(ids)
+	return stacker.New(options).StackAssets(members, "assets="+strings.Join(ids, ","))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the stacks of an explicit list of assets
+************************************************************************************************/
+
+func writeAssetsFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "ids.txt")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadAssetIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		ids     []string
+		wantErr string
+	}{
+		{name: "one per line", content: "a1\n\n  a2 \r\na3\na1\n", ids: []string{"a1", "a2", "a3"}},
+		{name: "JSON array", content: ` ["a1", "a2", " a2 "]`, ids: []string{"a1", "a2"}},
+		{name: "invalid JSON", content: `["a1", 2]`, wantErr: "expected a JSON array of asset IDs"},
+		{name: "single asset", content: "a1\na1\n", wantErr: "lists 1 asset(s), a stack needs at least 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids, err := loadAssetIDs(writeAssetsFile(t, tt.content))
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.ids, ids)
+		})
+	}
+
+	_, err := loadAssetIDs(filepath.Join(t.TempDir(), "missing.txt"))
+	assert.ErrorContains(t, err, "error reading ASSETS_FROM_FILE")
+}
+
+func TestAssetsFromFileRun(t *testing.T) {
+	newClient := func() *fakeClient {
+		stacked := utils.TStack{ID: "old", PrimaryAssetID: "3", Assets: []utils.TAsset{{ID: "3"}, {ID: "9"}}}
+		return &fakeClient{
+			stacks: map[string]utils.TStack{"3": stacked, "9": stacked},
+			assets: []utils.TAsset{
+				{ID: "1", OwnerID: "owner", OriginalFileName: "scan_front.tif", LocalDateTime: "2024-01-01T10:00:00Z"},
+				{ID: "2", OwnerID: "owner", OriginalFileName: "scan_front.jpg", LocalDateTime: "2023-06-01T10:00:00Z"},
+				{ID: "3", OwnerID: "owner", OriginalFileName: "back.jpg", LocalDateTime: "2020-01-01T10:00:00Z"},
+				{ID: "4", OwnerID: "partner", OriginalFileName: "other.jpg", LocalDateTime: "2020-01-01T10:00:00Z"},
+				{ID: "9", OwnerID: "owner", OriginalFileName: "unrelated.jpg", LocalDateTime: "2019-01-01T10:00:00Z"},
+			},
+		}
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	t.Run("stacks the listed assets", func(t *testing.T) {
+		defer teardownTest()
+		setupTest()
+		replaceStacks = true
+		assetsFromFile = writeAssetsFile(t, `["3", "1", "2"]`)
+
+		client := newClient()
+		require.NoError(t, runStackerOnce(client, logger, &runProgress{}, nil, nil, nil))
+		assert.Equal(t, [][]string{{"3", "2", "1"}}, client.created, "the promote rules order the members, whatever the criteria")
+		assert.Empty(t, client.deleted, "only the stacks of the children are replaced")
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		defer teardownTest()
+		setupTest()
+		dryRun = true
+		assetsFromFile = writeAssetsFile(t, "1\n2\n")
+
+		client := newClient()
+		require.NoError(t, runStackerOnce(client, logger, &runProgress{}, nil, nil, nil))
+		// The client skips the request itself in dry run mode
+		assert.Equal(t, [][]string{{"2", "1"}}, client.created)
+	})
+
+	t.Run("children already stacked", func(t *testing.T) {
+		defer teardownTest()
+		setupTest()
+		assetsFromFile = writeAssetsFile(t, "1\n9\n")
+
+		client := newClient()
+		require.NoError(t, runStackerOnce(client, logger, &runProgress{}, nil, nil, nil))
+		assert.Empty(t, client.created, "without REPLACE_STACKS the stacked child is left alone")
+	})
+
+	t.Run("missing and foreign assets abort before any change", func(t *testing.T) {
+		defer teardownTest()
+		setupTest()
+		assetsFromFile = writeAssetsFile(t, "1\nnope\n4\n")
+
+		client := newClient()
+		err := runStackerOnce(client, logger, &runProgress{}, nil, nil, nil)
+		assert.Equal(t, exitConfigError, exitCode(err))
+		assert.ErrorContains(t, err, "not found or not readable: nope; owned by another user: 4")
+		assert.Empty(t, client.created)
+		assert.Empty(t, client.deleted)
+	})
+}
+
+func TestAssetsFromFileEnvVarValidation(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("ASSETS_FROM_FILE", "ids.txt")
+	os.Setenv("RUN_MODE", "cron")
+	config := LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "ASSETS_FROM_FILE can only be used in 'once' run mode")
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("ASSETS_FROM_FILE", "ids.txt")
+	os.Setenv("RESET_STACKS", "true")
+	os.Setenv("CONFIRM_RESET_STACK", "I acknowledge all my current stacks will be deleted and new one will be created")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "ASSETS_FROM_FILE cannot be combined with RESET_STACKS")
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("ASSETS_FROM_FILE", " ids.txt ")
+	config = LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.Equal(t, "ids.txt", assetsFromFile)
+}
@@ -0,0 +1,282 @@
+/**************************************************************************************************
+** Audit log of the stack changes for the Immich CLI application.
+** With AUDIT_LOG, every stack the tool creates, deletes, merges or gives a new primary is appended
+** to the file as one JSON object per line, dry runs, resets and rejections included, so the
+** history of a stack can be traced across runs with the audit show command.
+**************************************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// auditMaxLine is the longest entry read back, a stack of thousands of assets included
+const auditMaxLine = 16 * 1024 * 1024
+
+// runAudit appends the stack changes to the audit log, nil unless AUDIT_LOG is set
+var runAudit *auditTrail
+
+// auditStackID is the stack whose history the audit show command prints, empty for every stack
+var auditStackID string
+
+// auditOutput is the output format of the audit show command: text or json
+var auditOutput string
+
+/**************************************************************************************************
+** auditEntry is one stack change of the audit log. StackID is empty for a stack created in a dry
+** run, Key for a change made outside of the grouping, such as a reset or a rejection.
+**************************************************************************************************/
+type auditEntry struct {
+	Time           string   `json:"time"` // RFC3339, UTC
+	Action         string   `json:"action"`
+	StackID        string   `json:"stackId,omitempty"`
+	ReplacedStacks []string `json:"replacedStacks,omitempty"`
+	AssetIDs       []string `json:"assetIds"`
+	Key            string   `json:"key,omitempty"`
+	Reason         string   `json:"reason,omitempty"`
+	Version        string   `json:"version"`
+	CriteriaHash   string   `json:"criteriaHash,omitempty"`
+	DryRun         bool     `json:"dryRun"`
+}
+
+/**************************************************************************************************
+** auditTrail appends the stack changes reported by the clients to the audit log, with the
+** grouping key of the stack being applied. A nil trail records nothing.
+**************************************************************************************************/
+type auditTrail struct {
+	mu       sync.Mutex
+	path     string
+	key      string
+	criteria string
+	logger   *logrus.Logger
+}
+
+/**************************************************************************************************
+** Creates the audit trail of the AUDIT_LOG setting.
+**
+** @param path - Path of the audit log
+** @param logger - Logger reporting the entries that cannot be written
+** @return *auditTrail - The trail, or nil when the path is empty
+**************************************************************************************************/
+func newAuditTrail(path string, logger *logrus.Logger) *auditTrail {
+	if path == "" {
+		return nil
+	}
+	return &auditTrail{path: path, criteria: criteriaHash(), logger: logger}
+}
+
+/**************************************************************************************************
+** Sets the grouping key recorded with the following changes, empty once the stack is applied.
+**
+** @param key - Grouping key of the stack being applied
+**************************************************************************************************/
+func (a *auditTrail) setKey(key string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.key = key
+}
+
+/**************************************************************************************************
+** Returns the stack hook of the clients appending each change to the audit log, or nil without
+** an audit log.
+**
+** @return func(immich.StackChange) - The stack hook
+**************************************************************************************************/
+func (a *auditTrail) hook() func(change immich.StackChange) {
+	if a == nil {
+		return nil
+	}
+	return a.record
+}
+
+/**************************************************************************************************
+** Appends a stack change to the audit log. An entry that cannot be written is logged and
+** dropped, the change itself is already made.
+**
+** @param change - The change reported by the client
+**************************************************************************************************/
+func (a *auditTrail) record(change immich.StackChange) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry := auditEntry{
+		Time:           time.Now().UTC().Format(time.RFC3339),
+		Action:         change.Action,
+		StackID:        change.StackID,
+		ReplacedStacks: change.ReplacedStacks,
+		AssetIDs:       nonNil(change.AssetIDs),
+		Key:            a.key,
+		Reason:         change.Reason,
+		Version:        version,
+		CriteriaHash:   a.criteria,
+		DryRun:         dryRun,
+	}
+	if err := a.append(entry); err != nil {
+		a.logger.Errorf("Error writing the audit log: %v", err)
+	}
+}
+
+/**************************************************************************************************
+** Writes an entry at the end of the audit log, creating the file and its directory.
+**
+** @param entry - The entry
+** @return error - An error if the file cannot be written
+**************************************************************************************************/
+func (a *auditTrail) append(entry auditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error encoding audit entry: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0755); err != nil {
+		return fmt.Errorf("error creating audit log directory: %w", err)
+	}
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening audit log %s: %w", a.path, err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing audit log %s: %w", a.path, err)
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** Reads the entries of the audit log concerning a stack: the ones of the stack itself, and the
+** ones that merged it into another or replaced it. A line that cannot be decoded, such as one
+** left half-written by a crash, is skipped.
+**
+** @param path - Path of the audit log
+** @param stackID - ID of the stack, empty for every entry
+** @return []auditEntry - The entries, oldest first
+** @return int - Number of lines skipped
+** @return error - An error if the file cannot be read
+**************************************************************************************************/
+func readAuditLog(path, stackID string) ([]auditEntry, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error opening audit log %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var entries []auditEntry
+	skipped := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), auditMaxLine)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var entry auditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			skipped++
+			continue
+		}
+		if stackID == "" || entry.StackID == stackID || utils.Contains(entry.ReplacedStacks, stackID) {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, skipped, fmt.Errorf("error reading audit log %s: %w", path, err)
+	}
+	return entries, skipped, nil
+}
+
+/**************************************************************************************************
+** Writes an entry of the audit log as one line of text.
+**
+** @param out - Writer of the line
+** @param entry - The entry
+**************************************************************************************************/
+func printAuditEntry(out io.Writer, entry auditEntry) {
+	stackID := entry.StackID
+	if stackID == "" {
+		stackID = "-"
+	}
+	details := []string{fmt.Sprintf("%d assets", len(entry.AssetIDs))}
+	if len(entry.AssetIDs) > 0 {
+		details = append(details, "parent "+entry.AssetIDs[0])
+	}
+	if len(entry.ReplacedStacks) > 0 {
+		details = append(details, "replaced "+strings.Join(entry.ReplacedStacks, ","))
+	}
+	if entry.Key != "" {
+		details = append(details, "key "+entry.Key)
+	}
+	if entry.Reason != "" {
+		details = append(details, entry.Reason)
+	}
+	details = append(details, "version "+entry.Version)
+	if entry.CriteriaHash != "" {
+		details = append(details, "criteria "+entry.CriteriaHash)
+	}
+	if entry.DryRun {
+		details = append(details, "dry run")
+	}
+	fmt.Fprintf(out, "%s  %-14s  %s  %s\n", entry.Time, entry.Action, stackID, strings.Join(details, ", "))
+}
+
+/**************************************************************************************************
+** Main execution logic for the audit show command. Prints the entries of the audit log about a
+** stack, or every entry without --stack. No API key is needed.
+**
+** @param cmd - Cobra command instance
+** @param args - Command line arguments
+** @return error - Categorized error mapped to the exit code by main, or nil
+**************************************************************************************************/
+func runAuditShow(cmd *cobra.Command, args []string) error {
+	if auditOutput == "json" {
+		stdoutDocument = true
+	}
+	logger, err := loadEnvWithoutAPIKey()
+	if err != nil {
+		return err
+	}
+	if auditOutput != "text" && auditOutput != "json" {
+		return configError(fmt.Errorf("invalid output format %q: must be text or json", auditOutput))
+	}
+	if auditLog == "" {
+		return configError(fmt.Errorf("no audit log, set AUDIT_LOG"))
+	}
+	entries, skipped, err := readAuditLog(auditLog, auditStackID)
+	if err != nil {
+		return configError(err)
+	}
+	if skipped > 0 {
+		logger.Warnf("⚠️  %d line(s) of the audit log could not be decoded and were skipped", skipped)
+	}
+	if len(entries) == 0 {
+		logger.Infof("No audit entry found")
+		return nil
+	}
+
+	out := cmd.OutOrStdout()
+	encoder := json.NewEncoder(out)
+	for _, entry := range entries {
+		if auditOutput == "json" {
+			if err := encoder.Encode(entry); err != nil {
+				return fatalError(err)
+			}
+			continue
+		}
+		printAuditEntry(out, entry)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditTrail(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+	replaceStacks = true
+	// The old stacks are most of the library, above MAX_DELETE_FRACTION
+	forceDelete = true
+	path := filepath.Join(t.TempDir(), "data", "audit.ndjson")
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	runAudit = newAuditTrail(path, logger)
+	defer func() { runAudit = nil }()
+
+	stacked := utils.TStack{ID: "old", PrimaryAssetID: "5", Assets: []utils.TAsset{{ID: "4"}, {ID: "5"}}}
+	client := &fakeClient{
+		stacks: map[string]utils.TStack{"4": stacked, "5": stacked},
+		assets: []utils.TAsset{
+			{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "3", OriginalFileName: "IMG_0002.JPG", LocalDateTime: "2024-01-01T11:00:00Z"},
+			{ID: "4", OriginalFileName: "IMG_0002.DNG", LocalDateTime: "2024-01-01T11:00:00Z"},
+			{ID: "5", OriginalFileName: "IMG_0009.JPG", LocalDateTime: "2024-01-01T12:00:00Z"},
+		},
+	}
+	client.SetStackHook(runAudit.hook())
+	require.NoError(t, runStackerOnce(client, logger, &runProgress{}, nil, nil, nil))
+
+	// A change made outside of the grouping has no key
+	require.NoError(t, client.DeleteStack("manual", utils.REASON_RESET_STACK))
+
+	entries, skipped, err := readAuditLog(path, "")
+	require.NoError(t, err)
+	assert.Zero(t, skipped)
+	require.Len(t, entries, 4)
+	assert.Equal(t, immich.StackCreated, entries[0].Action)
+	assert.Equal(t, []string{"1", "2"}, entries[0].AssetIDs)
+	assert.Equal(t, []string{"3", "4"}, entries[1].AssetIDs)
+	assert.NotEqual(t, entries[0].Key, entries[1].Key)
+	assert.Equal(t, immich.StackDeleted, entries[2].Action)
+	assert.Equal(t, "old", entries[2].StackID)
+	assert.Equal(t, entries[1].Key, entries[2].Key, "the replaced stack is deleted under the key of its replacement")
+	assert.Empty(t, entries[3].Key)
+	assert.Equal(t, []string{}, entries[3].AssetIDs)
+	for _, entry := range entries {
+		assert.Equal(t, "dev", entry.Version)
+		assert.Equal(t, criteriaHash(), entry.CriteriaHash)
+		assert.False(t, entry.DryRun)
+		assert.NotEmpty(t, entry.Time)
+	}
+}
+
+func TestReadAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.ndjson")
+	require.NoError(t, os.WriteFile(path, []byte(`{"time":"2024-01-01T10:00:00Z","action":"create","stackId":"s1","assetIds":["a1","a2"],"key":"IMG_0001","version":"v1","dryRun":false}
+{"time":"2024-01-01T10:00:01Z","action":"create","stackId":"s2","assetIds":["b1","b2"],"version":"v1","dryRun":false}
+
+{"time":"2024-01-02T10:00:00Z","action":"primary-change","stackId":"s3","replacedStacks":["s1"],"assetIds":["a2","a1"],"key":"IMG_0001","version":"v1","dryRun":false}
+{"time":"2024-01-03T10:00:00Z","action":"delete","stackId":"s3","assetIds":["a2","a1"],"reason":"reset","version":"v1","dryRun":true}
+{"time":"2024-01-03T10:00:01Z","action":"dele`), 0644))
+
+	entries, skipped, err := readAuditLog(path, "s1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, skipped, "a half-written line is skipped")
+	require.Len(t, entries, 2, "the entries replacing the stack are included")
+	assert.Equal(t, "create", entries[0].Action)
+	assert.Equal(t, "primary-change", entries[1].Action)
+
+	entries, _, err = readAuditLog(path, "")
+	require.NoError(t, err)
+	assert.Len(t, entries, 4)
+
+	var out bytes.Buffer
+	printAuditEntry(&out, entries[2])
+	printAuditEntry(&out, entries[3])
+	assert.Equal(t, "2024-01-02T10:00:00Z  primary-change  s3  2 assets, parent a2, replaced s1, key IMG_0001, version v1\n"+
+		"2024-01-03T10:00:00Z  delete          s3  2 assets, parent a2, reset, version v1, dry run\n", out.String())
+
+	_, _, err = readAuditLog(filepath.Join(t.TempDir(), "missing.ndjson"), "")
+	assert.ErrorContains(t, err, "error opening audit log")
+}
+
+func TestAuditShowCommand(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	path := filepath.Join(t.TempDir(), "audit.ndjson")
+	require.NoError(t, os.WriteFile(path, []byte(`{"time":"2024-01-01T10:00:00Z","action":"create","stackId":"s1","assetIds":["a1","a2"],"version":"v1","dryRun":false}
+{"time":"2024-01-01T10:00:01Z","action":"create","stackId":"s2","assetIds":["b1","b2"],"version":"v1","dryRun":false}
+`), 0644))
+	os.Setenv("AUDIT_LOG", path)
+
+	var out bytes.Buffer
+	cmd := CreateRootCommand()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"audit", "show", "--stack", "s2", "--output", "json"})
+	require.NoError(t, cmd.Execute())
+	assert.JSONEq(t, `{"time":"2024-01-01T10:00:01Z","action":"create","stackId":"s2","assetIds":["b1","b2"],"version":"v1","dryRun":false}`, out.String())
+
+	os.Unsetenv("AUDIT_LOG")
+	auditLog = ""
+	cmd = CreateRootCommand()
+	cmd.SetArgs([]string{"audit", "show"})
+	assert.ErrorContains(t, cmd.Execute(), "no audit log, set AUDIT_LOG")
+}
@@ -0,0 +1,360 @@
+/**************************************************************************************************
+** Bench command implementation for the Immich CLI application.
+** Measures the grouping phase on synthetic assets, or on a dump of filenames, so a criteria can
+** be tried on a library size before it is used. Nothing is fetched from Immich.
+**************************************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/stacker"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Settings of the bench command
+var benchAssets int
+var benchProfile string
+var benchFilenames string
+var benchRuns int
+var benchOutput string
+
+/**************************************************************************************************
+** benchProfiles generate the filenames of the shot of the given index, in the naming of a
+** camera. The mixed profile cycles through the others.
+**************************************************************************************************/
+var benchProfiles = map[string]func(shot int) []string{
+	"pixel":  benchPixelShot,
+	"iphone": benchIPhoneShot,
+	"camera": benchCameraShot,
+	"mixed": func(shot int) []string {
+		return []func(int) []string{benchPixelShot, benchIPhoneShot, benchCameraShot}[shot%3](shot / 3)
+	},
+}
+
+// benchPixelShot names a Pixel shot: a RAW pair, a motion photo or a plain JPEG
+func benchPixelShot(shot int) []string {
+	base := fmt.Sprintf("PXL_20240101_%09d", shot)
+	switch shot % 4 {
+	case 0:
+		return []string{base + ".RAW-01.MP.COVER.jpg", base + ".RAW-02.ORIGINAL.dng"}
+	case 1:
+		return []string{base + ".MP.jpg"}
+	default:
+		return []string{base + ".jpg"}
+	}
+}
+
+// benchIPhoneShot names an iPhone shot: a live photo, an edited photo or a plain HEIC
+func benchIPhoneShot(shot int) []string {
+	number := shot%9999 + 1
+	switch shot % 3 {
+	case 0:
+		return []string{fmt.Sprintf("IMG_%04d.HEIC", number), fmt.Sprintf("IMG_%04d.MOV", number)}
+	case 1:
+		return []string{fmt.Sprintf("IMG_%04d.HEIC", number), fmt.Sprintf("IMG_E%04d.HEIC", number)}
+	default:
+		return []string{fmt.Sprintf("IMG_%04d.HEIC", number)}
+	}
+}
+
+// benchCameraShot names a camera shot: a RAW and JPEG pair
+func benchCameraShot(shot int) []string {
+	number := shot%9999 + 1
+	return []string{fmt.Sprintf("DSCF%04d.JPG", number), fmt.Sprintf("DSCF%04d.RAF", number)}
+}
+
+/**************************************************************************************************
+** benchResult is the measure of a preset: the stacks it produces, the assets grouped per second
+** and the memory allocated per run, or the error that prevented the measure.
+**************************************************************************************************/
+type benchResult struct {
+	Name            string  `json:"name"`
+	Criteria        string  `json:"criteria"`
+	Stacks          int     `json:"stacks"`
+	AssetsPerSecond float64 `json:"assetsPerSecond"`
+	AllocsPerRun    uint64  `json:"allocsPerRun"`
+	AllocMBPerRun   float64 `json:"allocMBPerRun"`
+	PeakHeapMB      float64 `json:"peakHeapMB"`
+	Error           string  `json:"error,omitempty"`
+}
+
+/**************************************************************************************************
+** benchReport holds the measures of every preset on the same assets.
+**************************************************************************************************/
+type benchReport struct {
+	Assets  int           `json:"assets"`
+	Source  string        `json:"source"`
+	Runs    int           `json:"runs"`
+	Presets []benchResult `json:"presets"`
+}
+
+/**************************************************************************************************
+** Main execution logic for the bench command. Builds the assets, then groups them with every
+** built-in preset and the configured criteria, and prints the measures.
+**
+** @param cmd - Cobra command instance
+** @param args - Command line arguments
+** @return error - Categorized error mapped to the exit code by main, or nil
+**************************************************************************************************/
+func runBench(cmd *cobra.Command, args []string) error {
+	// The benchmark needs no API access, only the settings of the grouping
+	logger, err := loadEnvWithoutAPIKey()
+	if err != nil {
+		return err
+	}
+	if benchOutput != "text" && benchOutput != "json" {
+		return configError(fmt.Errorf("invalid output format %q: must be text or json", benchOutput))
+	}
+	if benchRuns < 1 {
+		return configError(fmt.Errorf("invalid runs %d: must be at least 1", benchRuns))
+	}
+	if benchOutput == "json" {
+		// Keep stdout a valid JSON document
+		logger.SetOutput(cmd.ErrOrStderr())
+	}
+
+	var assets []utils.TAsset
+	source := benchProfile
+	if benchFilenames != "" {
+		file, err := os.Open(benchFilenames)
+		if err != nil {
+			return configError(fmt.Errorf("error opening filenames: %w", err))
+		}
+		defer file.Close()
+		if assets, err = benchAssetsFromFilenames(file, benchAssets); err != nil {
+			return configError(fmt.Errorf("error reading filenames %s: %w", benchFilenames, err))
+		}
+		source = benchFilenames
+	} else {
+		generate, ok := benchProfiles[benchProfile]
+		if !ok {
+			return configError(fmt.Errorf("invalid profile %q: must be pixel, iphone, camera or mixed", benchProfile))
+		}
+		if benchAssets < 1 {
+			return configError(fmt.Errorf("invalid assets %d: must be at least 1", benchAssets))
+		}
+		assets = benchSyntheticAssets(generate, benchAssets)
+	}
+
+	logger.Infof("⏱️  Grouping %d assets (%s) %d time(s) per preset", len(assets), source, benchRuns)
+	report := benchReport{Assets: len(assets), Source: source, Runs: benchRuns}
+	for _, preset := range statsPresetsWithConfigured(criteria) {
+		report.Presets = append(report.Presets, benchPreset(assets, preset, benchRuns))
+	}
+
+	if benchOutput == "json" {
+		encoder := json.NewEncoder(cmd.OutOrStdout())
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return fatalError(fmt.Errorf("error encoding bench report: %w", err))
+		}
+		return nil
+	}
+	printBenchReport(cmd.OutOrStdout(), report)
+	return nil
+}
+
+/**************************************************************************************************
+** benchSyntheticAssets generates the assets of the shots of a profile, seven seconds apart, the
+** files of a shot sharing their capture time.
+**
+** @param generate - Filenames of the shot of an index
+** @param count - Number of assets to generate
+** @return []utils.TAsset - The assets
+**************************************************************************************************/
+func benchSyntheticAssets(generate func(shot int) []string, count int) []utils.TAsset {
+	assets := make([]utils.TAsset, 0, count)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for shot := 0; len(assets) < count; shot++ {
+		taken := start.Add(time.Duration(shot) * 7 * time.Second)
+		for _, name := range generate(shot) {
+			if len(assets) == count {
+				break
+			}
+			assets = append(assets, benchAsset(len(assets), name, taken))
+		}
+	}
+	return assets
+}
+
+/**************************************************************************************************
+** benchAssetsFromFilenames reads one filename per line. The files sharing the name before the
+** first dot share their capture time, seven seconds after the previous name.
+**
+** @param in - Reader of the filenames
+** @param limit - Maximum number of assets, 0 or less for all the lines
+** @return []utils.TAsset - The assets
+** @return error - An error if the filenames cannot be read or there are none
+**************************************************************************************************/
+func benchAssetsFromFilenames(in io.Reader, limit int) ([]utils.TAsset, error) {
+	var assets []utils.TAsset
+	shots := make(map[string]time.Time)
+	next := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() && (limit <= 0 || len(assets) < limit) {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" {
+			continue
+		}
+		base := strings.SplitN(name, ".", 2)[0]
+		taken, ok := shots[base]
+		if !ok {
+			taken = next
+			shots[base] = taken
+			next = next.Add(7 * time.Second)
+		}
+		assets = append(assets, benchAsset(len(assets), name, taken))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(assets) == 0 {
+		return nil, fmt.Errorf("no filename")
+	}
+	return assets, nil
+}
+
+/**************************************************************************************************
+** benchAsset builds a synthetic asset.
+**
+** @param index - Index of the asset, used as its ID
+** @param name - Filename of the asset
+** @param taken - Capture time of the asset
+** @return utils.TAsset - The asset
+**************************************************************************************************/
+func benchAsset(index int, name string, taken time.Time) utils.TAsset {
+	assetType := "IMAGE"
+	switch strings.ToLower(name[strings.LastIndex(name, ".")+1:]) {
+	case "mov", "mp4":
+		assetType = "VIDEO"
+	}
+	date := taken.Format("2006-01-02T15:04:05.000Z")
+	return utils.TAsset{
+		ID:               fmt.Sprintf("bench-%d", index),
+		OriginalFileName: name,
+		OriginalPath:     "/bench/" + name,
+		Type:             assetType,
+		LocalDateTime:    date,
+		FileCreatedAt:    date,
+	}
+}
+
+/**************************************************************************************************
+** benchPreset groups the assets with a preset the given number of times, measuring the time,
+** the allocations and the peak of the heap above what it held before.
+**
+** @param assets - Assets to group
+** @param preset - Preset to measure
+** @param runs - Number of runs
+** @return benchResult - The measure
+**************************************************************************************************/
+func benchPreset(assets []utils.TAsset, preset statsPreset, runs int) benchResult {
+	result := benchResult{Name: preset.Name, Criteria: preset.Criteria}
+	quiet := logrus.New()
+	quiet.SetOutput(io.Discard)
+
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	peak := before.HeapAlloc
+	done := make(chan struct{})
+	var sampler sync.WaitGroup
+	sampler.Add(1)
+	go func() {
+		defer sampler.Done()
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		var stats runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				runtime.ReadMemStats(&stats)
+				if stats.HeapAlloc > peak {
+					peak = stats.HeapAlloc
+				}
+			}
+		}
+	}()
+
+	started := time.Now()
+	for run := 0; run < runs; run++ {
+		stacks, err := stacker.New(stacker.Options{
+			Criteria:              preset.Criteria,
+			ParentFilenamePromote: parentFilenamePromote,
+			ParentExtPromote:      parentExtPromote,
+			PromoteOrder:          promoteOrder,
+			ExtRankFallback:       extRankFallback,
+			Delimiters:            delimiterList,
+			EditedSuffixes:        editedSuffixList,
+			UnionMode:             unionMode,
+			MaxTimeBucket:         maxTimeBucket,
+			SkipMatchMiss:         skipMatchMiss,
+			CrossLibraryStacking:  crossLibraryStacking,
+			CrossOwnerStacking:    crossOwnerStacking,
+			MaxStackTimeSpread:    maxStackTimeSpread,
+			TimeSpreadAction:      maxStackTimeSpreadAction,
+			RequireSameFolder:     requireSameFolder,
+			FolderAction:          requireSameFolderAction,
+			MaxStackSize:          serverMaxStackSize,
+			OversizePolicy:        oversizePolicy,
+			Logger:                quiet,
+		}).Stack(assets)
+		if err != nil {
+			result.Error = err.Error()
+			break
+		}
+		result.Stacks = len(stacks)
+	}
+	elapsed := time.Since(started)
+	close(done)
+	sampler.Wait()
+	runtime.ReadMemStats(&after)
+	if after.HeapAlloc > peak {
+		peak = after.HeapAlloc
+	}
+	if result.Error != "" {
+		return result
+	}
+
+	result.AssetsPerSecond = float64(len(assets)*runs) / elapsed.Seconds()
+	result.AllocsPerRun = (after.Mallocs - before.Mallocs) / uint64(runs)
+	result.AllocMBPerRun = float64(after.TotalAlloc-before.TotalAlloc) / float64(runs) / (1 << 20)
+	result.PeakHeapMB = float64(peak-before.HeapAlloc) / (1 << 20)
+	return result
+}
+
+/**************************************************************************************************
+** printBenchReport prints the measures as an aligned table.
+**
+** @param out - Writer of the report
+** @param report - The report to print
+**************************************************************************************************/
+func printBenchReport(out io.Writer, report benchReport) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Assets: %d (%s), %d run(s) per preset\n\n", report.Assets, report.Source, report.Runs)
+	fmt.Fprintln(w, "PRESET\tSTACKS\tASSETS/S\tALLOCS/RUN\tALLOC MB/RUN\tPEAK HEAP MB")
+	for _, preset := range report.Presets {
+		if preset.Error != "" {
+			fmt.Fprintf(w, "%s\t-\t%s\n", preset.Name, preset.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%.0f\t%d\t%.1f\t%.1f\n", preset.Name, preset.Stacks, preset.AssetsPerSecond, preset.AllocsPerRun, preset.AllocMBPerRun, preset.PeakHeapMB)
+	}
+	fmt.Fprintln(w)
+	w.Flush()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the bench command
+************************************************************************************************/
+
+func TestBenchSyntheticAssets(t *testing.T) {
+	for name, generate := range benchProfiles {
+		assets := benchSyntheticAssets(generate, 101)
+		require.Len(t, assets, 101, name)
+		ids := make(map[string]bool)
+		for _, asset := range assets {
+			ids[asset.ID] = true
+			assert.NotEmpty(t, asset.OriginalFileName, name)
+			assert.NotEmpty(t, asset.LocalDateTime, name)
+		}
+		assert.Len(t, ids, 101, "%s: the IDs are unique", name)
+	}
+
+	assets := benchSyntheticAssets(benchCameraShot, 4)
+	assert.Equal(t, "DSCF0001.JPG", assets[0].OriginalFileName)
+	assert.Equal(t, "DSCF0001.RAF", assets[1].OriginalFileName)
+	assert.Equal(t, assets[0].LocalDateTime, assets[1].LocalDateTime, "the files of a shot share their capture time")
+	assert.NotEqual(t, assets[1].LocalDateTime, assets[2].LocalDateTime)
+}
+
+func TestBenchAssetsFromFilenames(t *testing.T) {
+	dump := "IMG_0001.JPG\nIMG_0001.CR3\n\nIMG_0002.MOV\nIMG_0003.JPG\n"
+
+	assets, err := benchAssetsFromFilenames(strings.NewReader(dump), 0)
+	require.NoError(t, err)
+	require.Len(t, assets, 4, "blank lines are skipped")
+	assert.Equal(t, assets[0].LocalDateTime, assets[1].LocalDateTime)
+	assert.NotEqual(t, assets[1].LocalDateTime, assets[2].LocalDateTime)
+	assert.Equal(t, "VIDEO", assets[2].Type)
+	assert.Equal(t, "IMAGE", assets[3].Type)
+
+	assets, err = benchAssetsFromFilenames(strings.NewReader(dump), 2)
+	require.NoError(t, err)
+	assert.Len(t, assets, 2)
+
+	_, err = benchAssetsFromFilenames(strings.NewReader("\n\n"), 0)
+	assert.ErrorContains(t, err, "no filename")
+}
+
+func TestBenchPreset(t *testing.T) {
+	resetGlobalConfig()
+	defer resetGlobalConfig()
+
+	assets := benchSyntheticAssets(benchCameraShot, 200)
+	result := benchPreset(assets, statsPreset{Name: "default"}, 2)
+	assert.Empty(t, result.Error)
+	assert.Equal(t, 100, result.Stacks, "each RAW is stacked with its JPEG")
+	assert.Greater(t, result.AssetsPerSecond, 0.0)
+	assert.Greater(t, result.AllocsPerRun, uint64(0))
+
+	broken := benchPreset(assets, statsPreset{Name: "broken", Criteria: `[{"key":"nope"}]`}, 1)
+	assert.Contains(t, broken.Error, "unknown criteria key: nope")
+
+	var out bytes.Buffer
+	printBenchReport(&out, benchReport{Assets: 200, Source: "camera", Runs: 2, Presets: []benchResult{result, broken}})
+	assert.Contains(t, out.String(), "Assets: 200 (camera), 2 run(s) per preset")
+	assert.Regexp(t, `default\s+100\s+\d+`, out.String())
+	assert.Regexp(t, `broken\s+-\s+.*nope`, out.String())
+}
@@ -0,0 +1,224 @@
+/**************************************************************************************************
+** Chunked processing for the Immich CLI application.
+** A run can be bounded to a number of stacks or to a duration, ordered by grouping key. The
+** resume token of a run lets the next invocation continue where it stopped, so a giant library
+** can be processed in several short runs from a scheduler.
+**************************************************************************************************/
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/stacker"
+	"github.com/sirupsen/logrus"
+)
+
+/**************************************************************************************************
+** stackChunk bounds a run to a slice of the stacks, ordered by grouping key. A nil chunk
+** processes every stack in the order of the stacker.
+**************************************************************************************************/
+type stackChunk struct {
+	limit     int            // Maximum number of stacks to process, 0 for no limit
+	deadline  time.Time      // Time after which no new stack is picked up, zero for no limit
+	resume    resumePosition // Position of the last stack processed by the previous chunk
+	last      resumePosition // Position of the last stack processed by this chunk
+	processed int            // Number of stacks selected for this chunk
+	remaining int            // Number of stacks left for the next chunks
+	total     int            // Number of stacks in the library
+}
+
+/**************************************************************************************************
+** resumePosition is the place of a stack in the order of the chunks. Several stacks can share a
+** grouping key, for example when one group is split, so the asset ID of the parent breaks ties.
+**************************************************************************************************/
+type resumePosition struct {
+	key      string // Grouping key of the stack
+	parentID string // Asset ID of the parent of the stack
+}
+
+/**************************************************************************************************
+** positionOf returns the position of a stack in the order of the chunks.
+**
+** @param stack - The stack
+** @return resumePosition - Its grouping key and parent asset ID
+**************************************************************************************************/
+func positionOf(stack stacker.Stack) resumePosition {
+	return resumePosition{key: stack.Key, parentID: stack.Parent.ID}
+}
+
+/**************************************************************************************************
+** before reports whether the position comes before the stack in the order of the chunks.
+**
+** @param stack - The stack to compare with
+** @return bool - True when the stack sorts after the position
+**************************************************************************************************/
+func (p resumePosition) before(stack stacker.Stack) bool {
+	if stack.Key != p.key {
+		return stack.Key > p.key
+	}
+	return stack.Parent.ID > p.parentID
+}
+
+/**************************************************************************************************
+** newStackChunk creates a chunk from the limit, the deadline and the resume token of the
+** previous run. It returns nil when none is set, so the run is not chunked.
+**
+** @param limit - Maximum number of stacks to process, 0 for no limit
+** @param deadline - Time after which no new stack is picked up, zero for no limit
+** @param token - Resume token printed by the previous run, or an empty string
+** @return *stackChunk - The chunk, or nil
+** @return error - An error if the resume token is invalid
+**************************************************************************************************/
+func newStackChunk(limit int, deadline time.Time, token string) (*stackChunk, error) {
+	if limit <= 0 && deadline.IsZero() && token == "" {
+		return nil, nil
+	}
+	resume, err := decodeResumeToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return &stackChunk{limit: limit, deadline: deadline, resume: resume}, nil
+}
+
+/**************************************************************************************************
+** selectStacks sorts the stacks by grouping key and parent asset ID and returns the ones of this
+** chunk: the stacks after the resume position, up to the limit.
+**
+** @param stacks - All the stacks of the library
+** @return []stacker.Stack - The stacks to process in this chunk
+**************************************************************************************************/
+func (c *stackChunk) selectStacks(stacks []stacker.Stack) []stacker.Stack {
+	if c == nil {
+		return stacks
+	}
+
+	sorted := append([]stacker.Stack(nil), stacks...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Key != sorted[j].Key {
+			return sorted[i].Key < sorted[j].Key
+		}
+		return sorted[i].Parent.ID < sorted[j].Parent.ID
+	})
+
+	start := 0
+	if c.resume != (resumePosition{}) {
+		start = sort.Search(len(sorted), func(i int) bool { return c.resume.before(sorted[i]) })
+	}
+	end := len(sorted)
+	if c.limit > 0 && start+c.limit < end {
+		end = start + c.limit
+	}
+
+	c.total = len(sorted)
+	c.processed = end - start
+	c.remaining = len(sorted) - end
+	if end > start {
+		c.last = positionOf(sorted[end-1])
+	} else {
+		c.last = c.resume
+	}
+	return sorted[start:end]
+}
+
+/**************************************************************************************************
+** expired reports whether the time budget of the run is exhausted.
+**
+** @return bool - True when no new stack should be picked up
+**************************************************************************************************/
+func (c *stackChunk) expired() bool {
+	return c != nil && !c.deadline.IsZero() && !time.Now().Before(c.deadline)
+}
+
+/**************************************************************************************************
+** stop ends the chunk early, after the given number of its stacks, so the next run resumes
+** after the last of them.
+**
+** @param done - Number of stacks of the chunk processed
+** @param last - Last stack processed, ignored when done is 0
+**************************************************************************************************/
+func (c *stackChunk) stop(done int, last stacker.Stack) {
+	if c == nil || done >= c.processed {
+		return
+	}
+	c.remaining += c.processed - done
+	c.processed = done
+	c.last = c.resume
+	if done > 0 {
+		c.last = positionOf(last)
+	}
+}
+
+/**************************************************************************************************
+** complete reports whether the chunk reached the end of the stacks.
+**
+** @return bool - True when no stack is left for a next chunk
+**************************************************************************************************/
+func (c *stackChunk) complete() bool {
+	return c == nil || c.remaining == 0
+}
+
+/**************************************************************************************************
+** next returns the chunk continuing after this one, with the same limit and deadline.
+**
+** @return *stackChunk - The next chunk
+**************************************************************************************************/
+func (c *stackChunk) next() *stackChunk {
+	return &stackChunk{limit: c.limit, deadline: c.deadline, resume: c.last}
+}
+
+/**************************************************************************************************
+** logCoverage logs whether the library was fully covered and, if not, the resume token to pass
+** to the next run.
+**
+** @param logger - Logger instance for output
+**************************************************************************************************/
+func (c *stackChunk) logCoverage(logger *logrus.Logger) {
+	if c == nil {
+		return
+	}
+	done := c.total - c.remaining
+	if c.complete() {
+		logger.Infof("✅ Library fully covered: %d stacks processed in this chunk, %d in total", c.processed, c.total)
+		return
+	}
+	token := encodeResumeToken(c.last)
+	logger.WithField("resumeToken", token).Infof("⏸️  Library partially covered: %d of %d stacks done, %d left. Continue with --resume-token %s", done, c.total, c.remaining, token)
+}
+
+/**************************************************************************************************
+** encodeResumeToken encodes a resume position into a token safe to pass on a command line. The
+** parent asset ID follows the grouping key after a NUL byte.
+**
+** @param position - Position of the last processed stack
+** @return string - The resume token
+**************************************************************************************************/
+func encodeResumeToken(position resumePosition) string {
+	raw := position.key
+	if position.parentID != "" {
+		raw += "\x00" + position.parentID
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+/**************************************************************************************************
+** decodeResumeToken decodes a resume token into the position of the last processed stack. A
+** token holding only a grouping key, as printed by older versions, resumes at the first stack
+** of that key.
+**
+** @param token - The resume token, or an empty string
+** @return resumePosition - The position, zero for an empty token
+** @return error - An error if the token is not a valid resume token
+**************************************************************************************************/
+func decodeResumeToken(token string) (resumePosition, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return resumePosition{}, fmt.Errorf("invalid resume token %q: %w", token, err)
+	}
+	key, parentID, _ := strings.Cut(string(raw), "\x00")
+	return resumePosition{key: key, parentID: parentID}, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/stacker"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for chunked processing with a limit and a resume token
+************************************************************************************************/
+
+func chunkKeys(stacks []stacker.Stack) []string {
+	keys := make([]string, len(stacks))
+	for i, stack := range stacks {
+		keys[i] = stack.Key
+	}
+	return keys
+}
+
+func TestStackChunkSelection(t *testing.T) {
+	stacks := []stacker.Stack{{Key: "c"}, {Key: "a"}, {Key: "e"}, {Key: "b"}, {Key: "d"}}
+
+	chunk, err := newStackChunk(0, time.Time{}, "")
+	require.NoError(t, err)
+	assert.Nil(t, chunk, "no limit and no token means no chunking")
+	assert.Equal(t, chunkKeys(stacks), chunkKeys(chunk.selectStacks(stacks)), "a nil chunk keeps the stacker order")
+	assert.True(t, chunk.complete())
+
+	chunk, err = newStackChunk(2, time.Time{}, "")
+	require.NoError(t, err)
+	var covered []string
+	for i := 0; i < 5; i++ {
+		selected := chunk.selectStacks(stacks)
+		covered = append(covered, chunkKeys(selected)...)
+		if chunk.complete() {
+			break
+		}
+		chunk = chunk.next()
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, covered, "chained chunks cover every stack once, in key order")
+	assert.True(t, chunk.complete())
+
+	chunk, err = newStackChunk(2, time.Time{}, encodeResumeToken(resumePosition{key: "b"}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c", "d"}, chunkKeys(chunk.selectStacks(stacks)))
+	assert.False(t, chunk.complete())
+	assert.Equal(t, resumePosition{key: "d"}, chunk.last)
+
+	chunk, err = newStackChunk(0, time.Time{}, encodeResumeToken(resumePosition{key: "c"}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"d", "e"}, chunkKeys(chunk.selectStacks(stacks)), "a token without limit processes the rest")
+	assert.True(t, chunk.complete())
+
+	chunk, err = newStackChunk(2, time.Time{}, encodeResumeToken(resumePosition{key: "z"}))
+	require.NoError(t, err)
+	assert.Empty(t, chunk.selectStacks(stacks))
+	assert.True(t, chunk.complete())
+}
+
+func TestStackChunkSharedKey(t *testing.T) {
+	stacks := []stacker.Stack{
+		{Key: "a", Parent: utils.TAsset{ID: "1"}},
+		{Key: "b", Parent: utils.TAsset{ID: "3"}},
+		{Key: "b", Parent: utils.TAsset{ID: "2"}},
+		{Key: "c", Parent: utils.TAsset{ID: "4"}},
+	}
+	parents := func(stacks []stacker.Stack) []string {
+		ids := make([]string, len(stacks))
+		for i, stack := range stacks {
+			ids[i] = stack.Parent.ID
+		}
+		return ids
+	}
+
+	chunk, err := newStackChunk(2, time.Time{}, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "2"}, parents(chunk.selectStacks(stacks)))
+	assert.Equal(t, []string{"3", "4"}, parents(chunk.next().selectStacks(stacks)), "the chunk ending between two stacks of a key resumes with the second")
+
+	chunk, err = newStackChunk(0, time.Time{}, encodeResumeToken(resumePosition{key: "b"}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2", "3", "4"}, parents(chunk.selectStacks(stacks)), "a token without parent resumes at the first stack of its key")
+}
+
+func TestResumeToken(t *testing.T) {
+	position := resumePosition{key: "IMG_0001|2024-01-01T10:00:00.000Z/é", parentID: "a1"}
+	decoded, err := decodeResumeToken(encodeResumeToken(position))
+	require.NoError(t, err)
+	assert.Equal(t, position, decoded)
+
+	decoded, err = decodeResumeToken(base64.RawURLEncoding.EncodeToString([]byte("IMG_0001")))
+	require.NoError(t, err)
+	assert.Equal(t, resumePosition{key: "IMG_0001"}, decoded, "a token of an older version holds only the key")
+
+	_, err = newStackChunk(10, time.Time{}, "not a token!")
+	assert.ErrorContains(t, err, "invalid resume token")
+}
+
+func TestChunkEnvVarValidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		errorPart string
+	}{
+		{name: "valid limit and token", env: map[string]string{"LIMIT": "100", "RESUME_TOKEN": encodeResumeToken(resumePosition{key: "a"})}},
+		{name: "invalid limit", env: map[string]string{"LIMIT": "ten"}, errorPart: "invalid LIMIT"},
+		{name: "invalid run duration", env: map[string]string{"MAX_RUN_DURATION": "90"}, errorPart: "invalid MAX_RUN_DURATION"},
+		{name: "token in cron mode", env: map[string]string{"RUN_MODE": "cron", "RESUME_TOKEN": "YQ"}, errorPart: "RESUME_TOKEN can only be used in 'once' run mode"},
+		{
+			name: "token with reset stacks",
+			env: map[string]string{
+				"RESUME_TOKEN":        "YQ",
+				"RESET_STACKS":        "true",
+				"CONFIRM_RESET_STACK": "I acknowledge all my current stacks will be deleted and new one will be created",
+			},
+			errorPart: "RESUME_TOKEN cannot be combined with RESET_STACKS",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetGlobalConfig()
+			clearEnvironment()
+			defer resetGlobalConfig()
+			defer clearEnvironment()
+			defer os.Unsetenv("CONFIRM_RESET_STACK")
+			os.Setenv("API_KEY", "key")
+			for name, value := range tt.env {
+				os.Setenv(name, value)
+			}
+
+			config := LoadEnvForTesting()
+			if tt.errorPart != "" {
+				assert.ErrorContains(t, config.Error, tt.errorPart)
+				return
+			}
+			require.NoError(t, config.Error)
+			assert.Equal(t, 100, limit)
+			assert.Equal(t, encodeResumeToken(resumePosition{key: "a"}), resumeToken)
+		})
+	}
+}
+
+func TestRunStackerChunksCoversLibrary(t *testing.T) {
+	resetGlobalConfig()
+	defer resetGlobalConfig()
+	limit = 2
+
+	var mu sync.Mutex
+	var searches, created int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/stacks":
+			fmt.Fprint(w, `[]`)
+		case "POST /api/search/metadata":
+			searches++
+			fmt.Fprint(w, `{"assets": {"items": [
+				{"id": "1", "originalFileName": "IMG_0001.JPG", "localDateTime": "2024-01-01T10:00:00Z"},
+				{"id": "2", "originalFileName": "IMG_0001.CR3", "localDateTime": "2024-01-01T10:00:00Z"},
+				{"id": "3", "originalFileName": "IMG_0002.JPG", "localDateTime": "2024-01-01T11:00:00Z"},
+				{"id": "4", "originalFileName": "IMG_0002.CR3", "localDateTime": "2024-01-01T11:00:00Z"},
+				{"id": "5", "originalFileName": "IMG_0003.JPG", "localDateTime": "2024-01-01T12:00:00Z"},
+				{"id": "6", "originalFileName": "IMG_0003.CR3", "localDateTime": "2024-01-01T12:00:00Z"}
+			], "nextPage": null}}`)
+		case "POST /api/stacks":
+			created++
+			fmt.Fprint(w, `{}`)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	client := immich.NewClient(server.URL, "key", false, false, false, false, false, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
+	require.NotNil(t, client)
+
+	token, err := runStackerChunks(client, logger, &runProgress{}, time.Time{}, "", nil)
+	require.NoError(t, err)
+	assert.Empty(t, token, "the library is covered")
+	assert.Equal(t, 2, searches, "three stacks with a limit of two take two chunks")
+	assert.Equal(t, 3, created)
+
+	// An exhausted time budget stops before the first stack, the next tick starts over
+	searches, created = 0, 0
+	token, err = runStackerChunks(client, logger, &runProgress{}, time.Now().Add(-time.Second), "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, encodeResumeToken(resumePosition{}), token)
+	assert.Equal(t, 1, searches, "no chunk is chained once the time budget is exhausted")
+	assert.Equal(t, 0, created)
+
+	// A tick resuming with a token continues after its key
+	grouped, err := stacker.New(stacker.Options{Logger: logger}).Stack([]utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+		{ID: "2", OriginalFileName: "IMG_0001.CR3", LocalDateTime: "2024-01-01T10:00:00Z"},
+	})
+	require.NoError(t, err)
+	require.Len(t, grouped, 1)
+	searches, created = 0, 0
+	token, err = runStackerChunks(client, logger, &runProgress{}, time.Time{}, encodeResumeToken(positionOf(grouped[0])), nil)
+	require.NoError(t, err)
+	assert.Empty(t, token)
+	assert.Equal(t, 2, created)
+}
+
+func TestStackChunkTimeBudget(t *testing.T) {
+	stacks := []stacker.Stack{{Key: "a"}, {Key: "b"}, {Key: "c"}, {Key: "d"}}
+
+	chunk, err := newStackChunk(0, time.Now().Add(time.Hour), "")
+	require.NoError(t, err)
+	require.NotNil(t, chunk, "a time budget alone orders the stacks by key")
+	assert.False(t, chunk.expired())
+	assert.Len(t, chunk.selectStacks(stacks), 4)
+	chunk.stop(2, stacks[1])
+	assert.False(t, chunk.complete())
+	assert.Equal(t, resumePosition{key: "b"}, chunk.last)
+	assert.Equal(t, []string{"c", "d"}, chunkKeys(chunk.next().selectStacks(stacks)), "the next run resumes after the last stack processed")
+
+	chunk, err = newStackChunk(0, time.Now().Add(-time.Second), encodeResumeToken(resumePosition{key: "a"}))
+	require.NoError(t, err)
+	assert.True(t, chunk.expired())
+	chunk.selectStacks(stacks)
+	chunk.stop(0, stacker.Stack{})
+	assert.Equal(t, resumePosition{key: "a"}, chunk.last, "a chunk stopped before any stack keeps the resume position")
+	assert.Equal(t, 3, chunk.remaining)
+
+	var none *stackChunk
+	assert.False(t, none.expired())
+}
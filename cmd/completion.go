@@ -0,0 +1,51 @@
+/**************************************************************************************************
+** Shell completion of the Immich CLI application.
+** The completion command prints the completion script of bash, zsh or fish, completing the
+** commands and every flag of the CLI.
+**************************************************************************************************/
+
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+/**************************************************************************************************
+** newCompletionCommand creates the completion command, with one subcommand per shell. It
+** replaces the default completion command of cobra.
+**
+** @param rootCmd - Root command whose commands and flags are completed
+** @return *cobra.Command - The completion command
+**************************************************************************************************/
+func newCompletionCommand(rootCmd *cobra.Command) *cobra.Command {
+	completionCmd := &cobra.Command{
+		Use:   "completion",
+		Short: "Print the shell completion script of bash, zsh or fish",
+		Long:  "Print the completion script of a shell on stdout.\n\n  bash: source <(immich-stack completion bash)\n  zsh:  immich-stack completion zsh > \"${fpath[1]}/_immich-stack\"\n  fish: immich-stack completion fish > ~/.config/fish/completions/immich-stack.fish",
+	}
+	completionCmd.AddCommand(&cobra.Command{
+		Use:   "bash",
+		Short: "Print the completion script of bash",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return rootCmd.GenBashCompletionV2(cmd.OutOrStdout(), true)
+		},
+	})
+	completionCmd.AddCommand(&cobra.Command{
+		Use:   "zsh",
+		Short: "Print the completion script of zsh",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return rootCmd.GenZshCompletion(cmd.OutOrStdout())
+		},
+	})
+	completionCmd.AddCommand(&cobra.Command{
+		Use:   "fish",
+		Short: "Print the completion script of fish",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return rootCmd.GenFishCompletion(cmd.OutOrStdout(), true)
+		},
+	})
+	return completionCmd
+}
@@ -8,12 +8,13 @@ package main
 import (
 	"fmt"
 	"io"
+	"net/url"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/majorfi/immich-stack/pkg/stacker"
 	"github.com/majorfi/immich-stack/pkg/utils"
 	"github.com/sirupsen/logrus"
 )
@@ -21,23 +22,100 @@ import (
 // Global configuration variables
 var apiKey string
 var apiURL string
+var strictURL bool
+var headerFlags []string
+var extraHeaders map[string]string
+var basicAuthUser string
+var basicAuthPass string
 var criteria string
+var stackKeyTemplate string
 var parentFilenamePromote string
 var parentExtPromote string
+var editedSuffixes string
+var editedSuffixList []string
 var runMode string
 var cronInterval int
+var minCronInterval int
 var withArchived bool
+var withHidden bool
 var resetStacks bool
+var confirmResetStack string
 var dryRun bool
 var replaceStacks bool
-var replaceStacksFlagSet bool
 var withDeleted bool
 var logLevel string
 var logFormat string
+var logFile string
+var logFileMaxSizeMB int
+var logFileMaxBackups int
 var removeSingleAssetStacks bool
+var excludeExtension string
+var excludedExtensions []string
+var removeExcludedFromStacks bool
+var includeSidecars bool
+var skipIncompleteAssets bool
 var filterAlbumIDs []string
 var filterTakenAfter string
 var filterTakenBefore string
+var filterRegex []string
+var filterPathRegex []string
+var stackMarker string
+var resetMarkedOnly bool
+var withExif bool
+var diffOnlyChanges bool
+var analyzeTimeGaps bool
+var quiet bool
+var panicFatal bool
+var maxAssetErrors int
+var debugSample int
+var skipMatchMiss bool
+var prefetchFilenameQuery string
+var limit int
+var maxGroups int
+var sampleRandom bool
+var sampleSeed int
+var resumeToken string
+var maxRunDuration time.Duration
+var maxPendingJobs int
+var minAssetAge time.Duration
+var ignoreServerLoad bool
+var crossLibraryStacking bool
+var crossOwnerStacking bool
+var includePartnerAssets bool
+var maxStackTimeSpread time.Duration
+var maxStackTimeSpreadAction string
+var requireSameFolder bool
+var requireSameFolderAction string
+var tagParentWith string
+var interactive bool
+var skipListFile string
+var skipListFileSet bool
+var duplicatesReport string
+var auditLog string
+var assetsFromFile string
+var fromImmichDuplicates bool
+var addParentsToAlbum string
+var autoLearnRejections bool
+var forceRestack bool
+var maxDeleteFraction float64
+var maxDeleteCount int
+var forceDelete bool
+var onlyNewStacks bool
+var promoteOrder string
+var extRankFallback string
+var delimiters string
+var delimiterList []string
+var profiles string
+var profileList []utils.TProfile
+var unionMode string
+var unionLogSize int
+var maxTimeBucket int
+var serverMaxStackSize int
+var oversizePolicy string
+var parentSelectorCmd string
+var parentSelectorTimeout time.Duration
+var eventsFormat string
+var otlpEndpoint string
 
 /**************************************************************************************************
 ** Configures the logger based on command-line flags and environment variables. Sets up the
@@ -60,30 +138,16 @@ func configureLogger() *logrus.Logger {
 func configureLoggerWithOutput(output io.Writer) *logrus.Logger {
 	logger := logrus.New()
 
-	// Set output - file logging if LOG_FILE is set, otherwise stdout
+	// Set output - the console, and the log file as well if LOG_FILE is set
+	var file *utils.RotatingFile
 	if output != nil {
 		// Testing mode - use provided output
 		logger.SetOutput(output)
-	} else if logFile := os.Getenv("LOG_FILE"); logFile != "" {
-		// File logging enabled - write to both stdout and file
-		if err := os.MkdirAll(utils.GetDir(logFile), 0755); err != nil {
-			logger.Warnf("Failed to create log directory: %v, falling back to stdout only", err)
-			logger.SetOutput(os.Stdout)
-		} else {
-			file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-			if err != nil {
-				logger.Warnf("Failed to open log file %s: %v, falling back to stdout only", logFile, err)
-				logger.SetOutput(os.Stdout)
-			} else {
-				// Write to both stdout and file
-				multiWriter := io.MultiWriter(os.Stdout, file)
-				logger.SetOutput(multiWriter)
-				logger.Infof("Logging to file: %s", logFile)
-			}
-		}
 	} else {
-		// Default to stdout only
-		logger.SetOutput(os.Stdout)
+		logger.SetOutput(consoleOutput())
+		if path := logFilePath(); path != "" {
+			file = openLogFile(logger, path)
+		}
 	}
 
 	// Set log level - flag takes precedence over environment variable
@@ -121,9 +185,60 @@ func configureLoggerWithOutput(output io.Writer) *logrus.Logger {
 		})
 	}
 
+	// The file has its own formatter, so it stays plain whatever the console does
+	if file != nil {
+		logger.AddHook(newFileHook(file, format))
+		logger.Infof("Logging to file: %s", logFilePath())
+	}
+
 	return logger
 }
 
+/**************************************************************************************************
+** profileNames returns the names of the configured criteria profiles, in order.
+**
+** @return []string - Names of the profiles, empty without profiles
+**************************************************************************************************/
+func profileNames() []string {
+	names := make([]string, 0, len(profileList))
+	for _, profile := range profileList {
+		names = append(names, profile.Name)
+	}
+	return names
+}
+
+/**************************************************************************************************
+** criteriaPromote returns the promote block of CRITERIA. A criteria that cannot be parsed is left
+** to the run, which reports it.
+**
+** @return utils.TPromote - The promote block, empty when the criteria has none
+**************************************************************************************************/
+func criteriaPromote() utils.TPromote {
+	config, err := stacker.ParseCriteria(criteria)
+	if err != nil || config.Promote == nil {
+		return utils.TPromote{}
+	}
+	return *config.Promote
+}
+
+/**************************************************************************************************
+** applyCriteriaPromote applies the promote block of CRITERIA to the promote settings and the
+** delimiters. A flag given on the command line comes first, then the block, then the environment
+** and the defaults.
+**************************************************************************************************/
+func applyCriteriaPromote() {
+	promote := criteriaPromote()
+	if len(promote.Filename) > 0 && !flagChanged("parent-filename-promote") {
+		parentFilenamePromote = strings.Join(promote.Filename, ",")
+	}
+	if len(promote.Ext) > 0 && !flagChanged("parent-ext-promote") {
+		parentExtPromote = strings.Join(promote.Ext, ",")
+	}
+	if len(promote.Delimiters) > 0 && !flagChanged("delimiters") {
+		delimiterList = promote.Delimiters
+	}
+}
+
 /**************************************************************************************************
 ** LoadEnvConfig represents the result of environment loading, including any validation errors.
 **************************************************************************************************/
@@ -142,20 +257,84 @@ func logStartupSummary(logger *logrus.Logger) {
 	// Build summary based on format
 	if format := os.Getenv("LOG_FORMAT"); format == "json" {
 		fields := logrus.Fields{
+			"version":                 version,
+			"criteriaHash":            criteriaHash(),
 			"runMode":                 runMode,
 			"cronInterval":            cronInterval,
 			"logLevel":                logger.GetLevel().String(),
 			"logFormat":               "json",
-			"logFile":                 os.Getenv("LOG_FILE"),
+			"logFile":                 logFilePath(),
 			"dryRun":                  dryRun,
+			"diffOnlyChanges":         diffOnlyChanges,
+			"analyzeTimeGaps":         analyzeTimeGaps,
+			"quiet":                   quiet,
+			"panicFatal":              panicFatal,
+			"maxAssetErrors":          maxAssetErrors,
+			"debugSample":             debugSample,
+			"skipMatchMiss":           skipMatchMiss,
+			"prefetchFilenameQuery":   prefetchFilenameQuery,
+			"limit":                   limit,
+			"maxGroups":               maxGroups,
+			"sampleRandom":            sampleRandom,
+			"sampleSeed":              sampleSeed,
+			"resumeToken":             resumeToken,
+			"maxRunDuration":          maxRunDuration.String(),
+			"maxPendingJobs":          maxPendingJobs,
+			"minAssetAge":             minAssetAge.String(),
+			"ignoreServerLoad":        ignoreServerLoad,
+			"crossLibraryStacking":    crossLibraryStacking,
+			"crossOwnerStacking":      crossOwnerStacking,
+			"includePartnerAssets":    includePartnerAssets,
+			"maxStackTimeSpread":      maxStackTimeSpread.String(),
+			"timeSpreadAction":        maxStackTimeSpreadAction,
+			"requireSameFolder":       requireSameFolder,
+			"requireSameFolderAction": requireSameFolderAction,
 			"replaceStacks":           replaceStacks,
 			"resetStacks":             resetStacks,
 			"withArchived":            withArchived,
+			"withHidden":              withHidden,
 			"withDeleted":             withDeleted,
 			"removeSingleAssetStacks": removeSingleAssetStacks,
+			"excludeExtension":        excludedExtensions,
+			"removeExcluded":          removeExcludedFromStacks,
+			"includeSidecars":         includeSidecars,
+			"skipIncompleteAssets":    skipIncompleteAssets,
 			"criteria":                criteria,
+			"stackKeyTemplate":        stackKeyTemplate,
 			"parentFilenamePromote":   parentFilenamePromote,
+			"editedSuffixes":          editedSuffixes,
 			"parentExtPromote":        parentExtPromote,
+			"promoteOrder":            promoteOrder,
+			"extRankFallback":         extRankFallback,
+			"delimiters":              delimiterList,
+			"profiles":                profileNames(),
+			"unionMode":               unionMode,
+			"unionLogSize":            unionLogSize,
+			"maxTimeBucket":           maxTimeBucket,
+			"serverMaxStackSize":      serverMaxStackSize,
+			"oversizePolicy":          oversizePolicy,
+			"parentSelectorCmd":       parentSelectorCmd,
+			"parentSelectorTimeout":   parentSelectorTimeout.String(),
+			"stackMarker":             stackMarker,
+			"tagParentWith":           tagParentWith,
+			"interactive":             interactive,
+			"events":                  eventsFormat,
+			"otlpEndpoint":            otlpEndpoint,
+			"skipListFile":            skipListFile,
+			"duplicatesReport":        duplicatesReport,
+			"auditLog":                auditLog,
+			"assetsFromFile":          assetsFromFile,
+			"fromImmichDuplicates":    fromImmichDuplicates,
+			"addParentsToAlbum":       addParentsToAlbum,
+			"autoLearnRejections":     autoLearnRejections,
+			"forceRestack":            forceRestack,
+			"maxDeleteFraction":       maxDeleteFraction,
+			"maxDeleteCount":          maxDeleteCount,
+			"forceDelete":             forceDelete,
+			"onlyNewStacks":           onlyNewStacks,
+			"strictURL":               strictURL,
+			"extraHeaders":            headerNames(extraHeaders),
+			"basicAuth":               basicAuthUser != "",
 		}
 		if len(filterAlbumIDs) > 0 {
 			fields["filterAlbumIDs"] = filterAlbumIDs
@@ -166,40 +345,231 @@ func logStartupSummary(logger *logrus.Logger) {
 		if filterTakenBefore != "" {
 			fields["filterTakenBefore"] = filterTakenBefore
 		}
+		if len(filterRegex) > 0 {
+			fields["filterRegex"] = filterRegex
+		}
+		if len(filterPathRegex) > 0 {
+			fields["filterPathRegex"] = filterPathRegex
+		}
 		logger.WithFields(fields).Warn("Configuration loaded")
 	} else {
 		// Build human-readable summary
 		var summary []string
+		summary = append(summary, fmt.Sprintf("version=%s", version))
+		summary = append(summary, fmt.Sprintf("criteria-hash=%s", criteriaHash()))
 		summary = append(summary, fmt.Sprintf("mode=%s", runMode))
 		if runMode == "cron" {
-			summary = append(summary, fmt.Sprintf("interval=%ds", cronInterval))
+			summary = append(summary, fmt.Sprintf("interval=%s", formatSeconds(cronInterval)))
 		}
 		summary = append(summary, fmt.Sprintf("level=%s", logger.GetLevel().String()))
 		summary = append(summary, fmt.Sprintf("format=%s", "text"))
-		if logFile := os.Getenv("LOG_FILE"); logFile != "" {
-			summary = append(summary, fmt.Sprintf("file=%s", logFile))
+		if path := logFilePath(); path != "" {
+			summary = append(summary, fmt.Sprintf("file=%s", path))
 		}
 		if dryRun {
 			summary = append(summary, "dry-run=true")
 		}
+		if diffOnlyChanges {
+			summary = append(summary, "diff-only-changes=true")
+		}
+		if analyzeTimeGaps {
+			summary = append(summary, "analyze-time-gaps=true")
+		}
+		if quiet {
+			summary = append(summary, "quiet=true")
+		}
+		if panicFatal {
+			summary = append(summary, "panic-fatal=true")
+		}
+		if maxAssetErrors > 0 {
+			summary = append(summary, fmt.Sprintf("max-asset-errors=%d", maxAssetErrors))
+		}
+		if debugSample > 0 {
+			summary = append(summary, fmt.Sprintf("debug-sample=%d", debugSample))
+		}
+		if skipMatchMiss {
+			summary = append(summary, "skip-match-miss=true")
+		}
+		if prefetchFilenameQuery != "" {
+			summary = append(summary, fmt.Sprintf("prefetch-filename-query=%s", prefetchFilenameQuery))
+		}
+		if limit > 0 {
+			summary = append(summary, fmt.Sprintf("limit=%d", limit))
+		}
+		if maxGroups > 0 {
+			summary = append(summary, fmt.Sprintf("max-groups=%d (sampled run)", maxGroups))
+			if sampleRandom {
+				summary = append(summary, fmt.Sprintf("sample-random=true, seed=%d", sampleSeed))
+			}
+		}
+		if resumeToken != "" {
+			summary = append(summary, fmt.Sprintf("resume-token=%s", resumeToken))
+		}
+		if maxRunDuration > 0 {
+			summary = append(summary, fmt.Sprintf("max-run-duration=%s", maxRunDuration))
+		}
+		if maxPendingJobs > 0 {
+			summary = append(summary, fmt.Sprintf("max-pending-jobs=%d", maxPendingJobs))
+		}
+		if minAssetAge > 0 {
+			summary = append(summary, fmt.Sprintf("min-asset-age=%s", minAssetAge))
+		}
+		if ignoreServerLoad {
+			summary = append(summary, "ignore-server-load=true")
+		}
+		if crossLibraryStacking {
+			summary = append(summary, "cross-library-stacking=true")
+		}
+		if crossOwnerStacking {
+			summary = append(summary, "cross-owner-stacking=true")
+		}
+		if includePartnerAssets {
+			summary = append(summary, "include-partner-assets=true")
+		}
+		if maxStackTimeSpread > 0 {
+			summary = append(summary, fmt.Sprintf("max-stack-time-spread=%s", maxStackTimeSpread))
+			if maxStackTimeSpreadAction != "" {
+				summary = append(summary, fmt.Sprintf("max-stack-time-spread-action=%s", maxStackTimeSpreadAction))
+			}
+		}
+		if requireSameFolder {
+			summary = append(summary, "require-same-folder=true")
+			if requireSameFolderAction != "" {
+				summary = append(summary, fmt.Sprintf("require-same-folder-action=%s", requireSameFolderAction))
+			}
+		}
+		if interactive {
+			summary = append(summary, "interactive=true")
+		}
+		if eventsFormat != "" {
+			summary = append(summary, fmt.Sprintf("events=%s", eventsFormat))
+		}
+		if otlpEndpoint != "" {
+			summary = append(summary, fmt.Sprintf("otlp-endpoint=%s", otlpEndpoint))
+		}
+		if duplicatesReport != "" {
+			summary = append(summary, fmt.Sprintf("duplicates-report=%s", duplicatesReport))
+		}
+		if auditLog != "" {
+			summary = append(summary, fmt.Sprintf("audit-log=%s", auditLog))
+		}
+		if assetsFromFile != "" {
+			summary = append(summary, fmt.Sprintf("assets-from-file=%s", assetsFromFile))
+		}
+		if fromImmichDuplicates {
+			summary = append(summary, "from-immich-duplicates=true")
+		}
+		if addParentsToAlbum != "" {
+			summary = append(summary, fmt.Sprintf("parents-album=%s", addParentsToAlbum))
+		}
+		if autoLearnRejections {
+			summary = append(summary, "auto-learn-rejections=true")
+		}
+		if forceRestack {
+			summary = append(summary, "force-restack=true")
+		}
+		if maxDeleteFraction != defaultMaxDeleteFraction {
+			summary = append(summary, fmt.Sprintf("max-delete-fraction=%g", maxDeleteFraction))
+		}
+		if maxDeleteCount > 0 {
+			summary = append(summary, fmt.Sprintf("max-delete-count=%d", maxDeleteCount))
+		}
+		if forceDelete {
+			summary = append(summary, "force-delete=true")
+		}
+		if onlyNewStacks {
+			summary = append(summary, "only-new-stacks=true")
+		}
+		if strictURL {
+			summary = append(summary, "strict-url=true")
+		}
+		if len(extraHeaders) > 0 {
+			summary = append(summary, fmt.Sprintf("extra-headers=%s", strings.Join(headerNames(extraHeaders), ",")))
+		}
+		if basicAuthUser != "" {
+			summary = append(summary, "basic-auth=true")
+		}
+		if promoteOrder != "" {
+			summary = append(summary, fmt.Sprintf("promote-order=%s", promoteOrder))
+		}
+		if len(delimiterList) > 0 {
+			summary = append(summary, fmt.Sprintf("delimiters=%q", delimiterList))
+		}
+		if editedSuffixes != "" {
+			summary = append(summary, fmt.Sprintf("edited-suffixes=%s", editedSuffixes))
+		}
+		if len(profileList) > 0 {
+			summary = append(summary, fmt.Sprintf("profiles=%s", strings.Join(profileNames(), ",")))
+		}
+		if extRankFallback != "" && extRankFallback != utils.ExtRankFallbackBuiltin {
+			summary = append(summary, fmt.Sprintf("ext-rank-fallback=%s", extRankFallback))
+		}
+		if unionMode != "" && unionMode != utils.UnionModeConnected {
+			summary = append(summary, fmt.Sprintf("union-mode=%s", unionMode))
+		}
+		if unionLogSize > 0 {
+			summary = append(summary, fmt.Sprintf("union-log-size=%d", unionLogSize))
+		}
+		if maxTimeBucket > 0 {
+			summary = append(summary, fmt.Sprintf("max-time-bucket=%d", maxTimeBucket))
+		}
+		if serverMaxStackSize > 0 {
+			summary = append(summary, fmt.Sprintf("server-max-stack-size=%d", serverMaxStackSize))
+			if oversizePolicy != "" {
+				summary = append(summary, fmt.Sprintf("oversize-policy=%s", oversizePolicy))
+			}
+		}
+		if parentSelectorCmd != "" {
+			summary = append(summary, fmt.Sprintf("parent-selector-cmd=%s", parentSelectorCmd))
+			if parentSelectorTimeout > 0 {
+				summary = append(summary, fmt.Sprintf("parent-selector-timeout=%s", parentSelectorTimeout))
+			}
+		}
 		if replaceStacks {
 			summary = append(summary, "replace=true")
 		}
 		if resetStacks {
 			summary = append(summary, "reset=true")
 		}
+		if resetMarkedOnly {
+			summary = append(summary, "reset-marked-only=true")
+		}
+		if stackMarker != "" && stackMarker != utils.StackMarkerNone {
+			summary = append(summary, fmt.Sprintf("stack-marker=%s", stackMarker))
+		}
+		if tagParentWith != "" {
+			summary = append(summary, fmt.Sprintf("tag-parent-with=%s", tagParentWith))
+		}
 		if withArchived {
 			summary = append(summary, "archived=true")
 		}
+		if withHidden {
+			summary = append(summary, "with-hidden=true")
+		}
 		if withDeleted {
 			summary = append(summary, "deleted=true")
 		}
 		if removeSingleAssetStacks {
 			summary = append(summary, "remove-single=true")
 		}
+		if len(excludedExtensions) > 0 {
+			summary = append(summary, fmt.Sprintf("exclude-extension=%s", strings.Join(excludedExtensions, ",")))
+		}
+		if removeExcludedFromStacks {
+			summary = append(summary, "remove-excluded=true")
+		}
+		if includeSidecars {
+			summary = append(summary, "include-sidecars=true")
+		}
+		if !skipIncompleteAssets {
+			summary = append(summary, "skip-incomplete-assets=false")
+		}
 		if criteria != "" {
 			summary = append(summary, fmt.Sprintf("criteria=%s", criteria))
 		}
+		if stackKeyTemplate != "" {
+			summary = append(summary, fmt.Sprintf("stack-key-template=%s", stackKeyTemplate))
+		}
 		if len(filterAlbumIDs) > 0 {
 			summary = append(summary, fmt.Sprintf("filter-albums=%d", len(filterAlbumIDs)))
 		}
@@ -209,6 +579,12 @@ func logStartupSummary(logger *logrus.Logger) {
 		if filterTakenBefore != "" {
 			summary = append(summary, fmt.Sprintf("filter-before=%s", filterTakenBefore))
 		}
+		if len(filterRegex) > 0 {
+			summary = append(summary, fmt.Sprintf("filter-regex=%d", len(filterRegex)))
+		}
+		if len(filterPathRegex) > 0 {
+			summary = append(summary, fmt.Sprintf("filter-path-regex=%d", len(filterPathRegex)))
+		}
 
 		logger.Warnf("Starting with config: %s", strings.Join(summary, ", "))
 	}
@@ -221,102 +597,284 @@ func logStartupSummary(logger *logrus.Logger) {
 ** @return LoadEnvConfig - Configuration result with logger and any validation error
 **************************************************************************************************/
 func LoadEnvForTesting() LoadEnvConfig {
+	return validateEnv(true)
+}
+
+/**************************************************************************************************
+** validateEnv loads environment variables and validates the configuration. The commands that
+** never call the API, such as version or bench, validate the rest without an API key.
+**
+** @param requireAPIKey - Whether a missing API key is an error
+** @return LoadEnvConfig - Configuration result with logger and any validation error
+**************************************************************************************************/
+func validateEnv(requireAPIKey bool) LoadEnvConfig {
 	godotenv.Load()
 
+	// The logger settings are options as well, they are resolved first
+	envErr := applyEnvOptions()
 	logger := configureLogger()
-	if criteria == "" {
-		criteria = os.Getenv("CRITERIA")
+	if envErr != nil {
+		return LoadEnvConfig{Logger: logger, Error: envErr}
 	}
-	if apiKey == "" {
-		apiKey = os.Getenv("API_KEY")
-	}
-	if apiKey == "" {
+	if apiKey == "" && requireAPIKey {
 		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("API_KEY is not set")}
 	}
-	if apiURL == "" {
-		apiURL = os.Getenv("API_URL")
-	}
 	if apiURL == "" {
 		apiURL = "http://immich_server:3001/api"
 	}
-	if runMode == "" {
-		runMode = os.Getenv("RUN_MODE")
+	headers, err := parseExtraHeaders(headerFlags)
+	if err != nil {
+		return LoadEnvConfig{Logger: logger, Error: err}
 	}
-	if runMode == "" {
-		runMode = "once"
+	extraHeaders = headers
+	if basicAuthPass != "" && basicAuthUser == "" {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("BASIC_AUTH_PASS is set without BASIC_AUTH_USER")}
 	}
-	if cronInterval == 0 {
-		if val := os.Getenv("CRON_INTERVAL"); val != "" {
-			if intVal, err := strconv.Atoi(val); err == nil {
-				cronInterval = intVal
-			}
+	if apiKey != "" {
+		_, duplicateKeys, err := parseAPITargets(apiKey, apiURL)
+		if err != nil {
+			return LoadEnvConfig{Logger: logger, Error: err}
+		}
+		for _, position := range duplicateKeys {
+			logger.Warnf("⚠️  API key #%d is listed twice for the same server, it runs once", position)
 		}
 	}
+	if runMode == "" {
+		runMode = "once"
+	}
 	if cronInterval == 0 && runMode == "cron" {
 		cronInterval = 86400
 	}
-	if !resetStacks {
-		resetStacks = os.Getenv("RESET_STACKS") == "true"
+	if runMode == "cron" && cronInterval < minCronInterval {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("CRON_INTERVAL of %s is below MIN_CRON_INTERVAL of %s, lower MIN_CRON_INTERVAL to run this often", formatSeconds(cronInterval), formatSeconds(minCronInterval))}
+	}
+	if maxStackTimeSpread < 0 {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid MAX_STACK_TIME_SPREAD '%s', expected a positive duration", maxStackTimeSpread)}
+	}
+	if !stacker.IsValidSanityAction(maxStackTimeSpreadAction) {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid MAX_STACK_TIME_SPREAD_ACTION '%s', expected split or drop", maxStackTimeSpreadAction)}
+	}
+	if !stacker.IsValidSanityAction(requireSameFolderAction) {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid REQUIRE_SAME_FOLDER_ACTION '%s', expected split or drop", requireSameFolderAction)}
+	}
+	if maxAssetErrors < 0 {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid MAX_ASSET_ERRORS '%d', expected a non-negative integer", maxAssetErrors)}
+	}
+	if debugSample < 0 {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid DEBUG_SAMPLE '%d', expected a non-negative integer", debugSample)}
+	}
+	if stackMarker == "" {
+		stackMarker = utils.StackMarkerNone
+	}
+	if !utils.IsValidStackMarker(stackMarker) {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid STACK_MARKER '%s', expected description, tag or none", stackMarker)}
 	}
 	if resetStacks {
 		if runMode != "once" {
 			return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("RESET_STACKS can only be used in 'once' run mode")}
 		}
-		confirmReset := os.Getenv("CONFIRM_RESET_STACK")
 		const requiredConfirm = "I acknowledge all my current stacks will be deleted and new one will be created"
-		if confirmReset != requiredConfirm {
+		if confirmResetStack != requiredConfirm {
 			return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("to use RESET_STACKS, you must set CONFIRM_RESET_STACK to: '%s'", requiredConfirm)}
 		}
-		logger.Info("RESET_STACKS is set to true, all existing stacks will be deleted")
+		if resetMarkedOnly {
+			logger.Info("RESET_STACKS is set to true, stacks created by immich-stack will be deleted")
+		} else {
+			logger.Info("RESET_STACKS is set to true, all existing stacks will be deleted")
+		}
 	}
-	if !dryRun {
-		dryRun = os.Getenv("DRY_RUN") == "true"
+	if limit < 0 {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid LIMIT '%d', expected a non-negative integer", limit)}
 	}
-	if dryRun {
-		logger.Info("DRY_RUN is set to true, no changes will be applied")
+	if maxGroups < 0 {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid MAX_GROUPS '%d', expected a non-negative integer", maxGroups)}
+	}
+	if sampleRandom && maxGroups == 0 {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("SAMPLE_RANDOM requires MAX_GROUPS, the number of groups to pick")}
+	}
+	if maxGroups > 0 {
+		// A sample is for trying criteria, it never covers the library
+		switch {
+		case runMode != "once":
+			return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("MAX_GROUPS can only be used in 'once' run mode")}
+		case limit > 0 || resumeToken != "":
+			return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("MAX_GROUPS cannot be combined with LIMIT or RESUME_TOKEN, a sampled run is not chunked")}
+		case resetStacks:
+			return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("MAX_GROUPS cannot be combined with RESET_STACKS, the stacks left out of the sample would be lost")}
+		}
+	}
+	if resumeToken != "" {
+		if runMode != "once" {
+			return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("RESUME_TOKEN can only be used in 'once' run mode, cron mode chains the chunks itself")}
+		}
+		// Every chunk would delete the stacks created by the previous ones
+		if resetStacks {
+			return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("RESUME_TOKEN cannot be combined with RESET_STACKS")}
+		}
+	}
+	if maxRunDuration < 0 {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid MAX_RUN_DURATION '%s', expected a positive duration", maxRunDuration)}
+	}
+	if maxPendingJobs < 0 {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid MAX_PENDING_JOBS '%d', expected a non-negative integer", maxPendingJobs)}
+	}
+	if minAssetAge < 0 {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid MIN_ASSET_AGE '%s', expected a positive duration", minAssetAge)}
+	}
+	if interactive && runMode != "once" {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("INTERACTIVE can only be used in 'once' run mode")}
 	}
-	if !replaceStacksFlagSet {
-		if envReplace := os.Getenv("REPLACE_STACKS"); envReplace != "" {
-			replaceStacks = envReplace == "true"
+	if eventsFormat != "" && eventsFormat != eventsNDJSON {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid EVENTS '%s', expected ndjson", eventsFormat)}
+	}
+	if eventsFormat != "" && interactive {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("EVENTS cannot be used with INTERACTIVE, both write to stdout")}
+	}
+	if otlpEndpoint != "" {
+		if parsed, err := url.Parse(otlpEndpoint); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid OTEL_EXPORTER_OTLP_ENDPOINT '%s', expected an http(s) URL such as http://localhost:4318", otlpEndpoint)}
 		}
 	}
-	if !withArchived {
-		withArchived = os.Getenv("WITH_ARCHIVED") == "true"
+	// The default path is not enough, the album must follow a skip list the user knows to keep
+	if addParentsToAlbum != "" && skipListFile == "" {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("ADD_PARENTS_TO_ALBUM needs SKIP_LIST_FILE, which records the stacks created by the tool")}
+	}
+	skipListFileSet = skipListFile != ""
+	if skipListFile == "" {
+		skipListFile = defaultSkipListPath()
+	}
+	if assetsFromFile != "" {
+		if runMode != "once" {
+			return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("ASSETS_FROM_FILE can only be used in 'once' run mode")}
+		}
+		// Fetching the stacks would delete them all before the listed assets are stacked
+		if resetStacks {
+			return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("ASSETS_FROM_FILE cannot be combined with RESET_STACKS")}
+		}
+	}
+	if fromImmichDuplicates && assetsFromFile != "" {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("FROM_IMMICH_DUPLICATES cannot be combined with ASSETS_FROM_FILE, both replace the grouping of the library")}
+	}
+	if maxDeleteFraction < 0 || maxDeleteFraction > 1 {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid MAX_DELETE_FRACTION '%g', expected a fraction between 0 and 1 such as 0.3", maxDeleteFraction)}
+	}
+	if maxDeleteCount < 0 {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid MAX_DELETE_COUNT '%d', expected a non-negative integer", maxDeleteCount)}
 	}
-	if !withDeleted {
-		withDeleted = os.Getenv("WITH_DELETED") == "true"
+	if dryRun {
+		logger.Info("DRY_RUN is set to true, no changes will be applied")
+	}
+	if analyzeTimeGaps && !dryRun {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("ANALYZE_TIME_GAPS requires DRY_RUN, the analysis is only printed at the end of a dry run")}
 	}
-	if !removeSingleAssetStacks {
-		removeSingleAssetStacks = os.Getenv("REMOVE_SINGLE_ASSET_STACKS") == "true"
+	if crossOwnerStacking && !includePartnerAssets {
+		// The assets of the other owners are left out before grouping, there would be nothing to mix
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("CROSS_OWNER_STACKING requires INCLUDE_PARTNER_ASSETS, the assets of other owners are left out otherwise")}
 	}
-	if parentFilenamePromote == "" || parentFilenamePromote == utils.DefaultParentFilenamePromoteString {
-		if envVal := os.Getenv("PARENT_FILENAME_PROMOTE"); envVal != "" {
-			parentFilenamePromote = envVal
+	excludedExtensions = parseExtensionList(excludeExtension)
+	if removeExcludedFromStacks && len(excludedExtensions) == 0 {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("REMOVE_EXCLUDED_FROM_STACKS requires EXCLUDE_EXTENSION")}
+	}
+	if onlyNewStacks {
+		// The client refuses every delete and update, these settings could not do their job
+		conflicts := map[string]bool{
+			"RESET_STACKS":               resetStacks,
+			"REPLACE_STACKS":             replaceStacks,
+			"REMOVE_SINGLE_ASSET_STACKS": removeSingleAssetStacks,
+			"STACK_MARKER":               stackMarker != utils.StackMarkerNone,
+			"TAG_PARENT_WITH":            tagParentWith != "",
+			"ADD_PARENTS_TO_ALBUM":       addParentsToAlbum != "",
+		}
+		for _, name := range []string{"RESET_STACKS", "REPLACE_STACKS", "REMOVE_SINGLE_ASSET_STACKS", "STACK_MARKER", "TAG_PARENT_WITH", "ADD_PARENTS_TO_ALBUM"} {
+			if conflicts[name] {
+				return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("ONLY_NEW_STACKS cannot be combined with %s, which modifies existing assets or stacks", name)}
+			}
+		}
+		if removeExcludedFromStacks {
+			return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("ONLY_NEW_STACKS cannot be combined with REMOVE_EXCLUDED_FROM_STACKS, which modifies existing assets or stacks")}
 		}
 	}
-	if parentExtPromote == "" || parentExtPromote == utils.DefaultParentExtPromoteString {
-		if envVal := os.Getenv("PARENT_EXT_PROMOTE"); envVal != "" {
-			parentExtPromote = envVal
+	// The suffixes extend the built-in list used by editedAny and stripEditedSuffix
+	editedSuffixList = utils.DefaultEditedSuffixes
+	if editedSuffixes != "" {
+		editedSuffixList = append([]string(nil), utils.DefaultEditedSuffixes...)
+		for _, suffix := range strings.Split(editedSuffixes, ",") {
+			if suffix = strings.TrimSpace(suffix); suffix != "" {
+				editedSuffixList = append(editedSuffixList, suffix)
+			}
 		}
 	}
-	if len(filterAlbumIDs) == 0 {
-		if envVal := os.Getenv("FILTER_ALBUM_IDS"); envVal != "" {
-			parts := strings.Split(envVal, ",")
-			for i := range parts {
-				parts[i] = strings.TrimSpace(parts[i])
+	parsedDelimiters, err := stacker.ParseDelimiters(delimiters)
+	if err != nil {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid DELIMITERS: %w", err)}
+	}
+	delimiterList = parsedDelimiters
+	applyCriteriaPromote()
+	for _, entry := range strings.Split(parentFilenamePromote, ",") {
+		for _, delimiter := range delimiterList {
+			if strings.Contains(entry, delimiter) {
+				logger.Warnf("PARENT_FILENAME_PROMOTE entry %q contains the delimiter %q, this is likely a typo", strings.TrimSpace(entry), delimiter)
+				break
 			}
-			filterAlbumIDs = utils.RemoveEmptyStrings(parts)
 		}
 	}
-	if filterTakenAfter == "" {
-		filterTakenAfter = strings.TrimSpace(os.Getenv("FILTER_TAKEN_AFTER"))
+	order, err := stacker.ParsePromoteOrder(promoteOrder)
+	if err != nil {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid PROMOTE_ORDER: %w", err)}
+	}
+	if _, err := stacker.ParseExtPromote(parentExtPromote); err != nil {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid PARENT_EXT_PROMOTE: %w", err)}
+	}
+	if !stacker.IsValidExtRankFallback(extRankFallback) {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid EXT_RANK_FALLBACK '%s', expected builtin, alpha or none", extRankFallback)}
 	}
-	if filterTakenBefore == "" {
-		filterTakenBefore = strings.TrimSpace(os.Getenv("FILTER_TAKEN_BEFORE"))
+	parsedProfiles, err := stacker.ParseProfiles(profiles)
+	if err != nil {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid PROFILES: %w", err)}
+	}
+	profileList = parsedProfiles
+	if err := stacker.CheckStackKeyTemplate(stacker.Options{Criteria: criteria, StackKeyTemplate: stackKeyTemplate}); err != nil {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid STACK_KEY_TEMPLATE: %w", err)}
+	}
+	if !stacker.IsValidUnionMode(unionMode) {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid UNION_MODE '%s', expected connected or strict", unionMode)}
+	}
+	if unionLogSize < 0 {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid UNION_LOG_SIZE '%d', expected a non-negative integer", unionLogSize)}
+	}
+	if maxTimeBucket < 0 {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid MAX_TIME_BUCKET '%d', expected a non-negative integer", maxTimeBucket)}
+	}
+	if serverMaxStackSize < 0 || serverMaxStackSize == 1 {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid SERVER_MAX_STACK_SIZE '%d', expected 0 for no limit or at least 2", serverMaxStackSize)}
+	}
+	if !stacker.IsValidOversizePolicy(oversizePolicy) {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid OVERSIZE_POLICY '%s', expected skip or split", oversizePolicy)}
+	}
+	if parentSelectorTimeout < 0 {
+		return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("invalid PARENT_SELECTOR_TIMEOUT '%s', expected a positive duration", parentSelectorTimeout)}
+	}
+	withExif = stacker.RequiresExif(parentFilenamePromote, criteria) || utils.Contains(order, utils.PromoteRuleSize) || stacker.ProfilesRequireExif(profileList) || parentSelectorCmd != ""
+	// The assets of the profiles are not restricted by the criteria of the run
+	if prefetchFilenameQuery == "" && len(profileList) == 0 {
+		prefetchFilenameQuery = stacker.FilenameQuery(criteria, skipMatchMiss)
+	}
+	if _, err := newAssetPrefilter(filterRegex, filterPathRegex); err != nil {
+		return LoadEnvConfig{Logger: logger, Error: err}
+	}
+	// Both act on every stack, the assets left out included
+	if len(filterRegex) > 0 || len(filterPathRegex) > 0 {
+		if resetStacks {
+			return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("FILTER_REGEX and FILTER_PATH_REGEX cannot be combined with RESET_STACKS")}
+		}
+		if removeSingleAssetStacks {
+			return LoadEnvConfig{Logger: logger, Error: fmt.Errorf("FILTER_REGEX and FILTER_PATH_REGEX cannot be combined with REMOVE_SINGLE_ASSET_STACKS")}
+		}
 	}
 
 	// Log startup configuration summary
 	logStartupSummary(logger)
+	logEffectiveConfig(logger)
 
 	return LoadEnvConfig{Logger: logger, Error: nil}
 }
@@ -325,12 +883,28 @@ func LoadEnvForTesting() LoadEnvConfig {
 ** Loads environment variables and command-line flags, with flags taking precedence over env
 ** variables. Handles critical configuration like API credentials and operation modes.
 **
-** @param logger - Logger instance for outputting configuration status and errors
+** @return *logrus.Logger - Logger instance for outputting status and errors
+** @return error - Configuration error (exit code 1), or nil
 **************************************************************************************************/
-func loadEnv() *logrus.Logger {
+func loadEnv() (*logrus.Logger, error) {
 	config := LoadEnvForTesting()
 	if config.Error != nil {
-		config.Logger.Fatal(config.Error.Error())
+		return config.Logger, configError(config.Error)
+	}
+	return config.Logger, nil
+}
+
+/**************************************************************************************************
+** loadEnvWithoutAPIKey loads the configuration like loadEnv, for the commands that never call
+** the API: a missing API key is not an error.
+**
+** @return *logrus.Logger - Logger instance for outputting status and errors
+** @return error - Configuration error (exit code 1), or nil
+**************************************************************************************************/
+func loadEnvWithoutAPIKey() (*logrus.Logger, error) {
+	config := validateEnv(false)
+	if config.Error != nil {
+		return config.Logger, configError(config.Error)
 	}
-	return config.Logger
+	return config.Logger, nil
 }
@@ -2,11 +2,17 @@ package main
 
 import (
 	"bytes"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/majorfi/immich-stack/pkg/utils"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestStartupConfigurationSummary(t *testing.T) {
@@ -26,6 +32,7 @@ func TestStartupConfigurationSummary(t *testing.T) {
 			},
 			wantInLog: []string{
 				"Starting with config:",
+				"criteria-hash=",
 				"mode=once",
 				"level=info",
 				"format=text",
@@ -304,6 +311,35 @@ func TestFileLoggingPermissionFallback(t *testing.T) {
 	}
 }
 
+func TestFileLoggingPlainAndRotated(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	tmpDir := t.TempDir()
+	logFile = filepath.Join(tmpDir, "logs", "immich-stack.log")
+	os.Setenv("LOG_FILE_MAX_SIZE_MB", "1")
+	os.Setenv("LOG_FILE_MAX_BACKUPS", "1")
+
+	logger := configureLogger()
+	// Colors forced on the console never reach the file
+	logger.SetFormatter(&logrus.TextFormatter{ForceColors: true})
+	logger.SetOutput(io.Discard)
+	logger.Warn("Colored on the console")
+	content, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "level=warning msg=\"Colored on the console\"")
+	assert.NotContains(t, string(content), "\x1b[", "the file has no ANSI colors")
+	assert.Contains(t, string(content), "time=", "the file entries are timestamped")
+
+	message := strings.Repeat("x", 300*1024)
+	for i := 0; i < 4; i++ {
+		logger.Info(message)
+	}
+	_, err = os.Stat(logFile + ".1")
+	assert.NoError(t, err, "the file is rotated at LOG_FILE_MAX_SIZE_MB")
+	_, err = os.Stat(logFile + ".2")
+	assert.True(t, os.IsNotExist(err), "LOG_FILE_MAX_BACKUPS backups are kept")
+}
+
 func TestLogLevelConfiguration(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -367,13 +403,16 @@ func TestLogLevelConfiguration(t *testing.T) {
 // Helper function to reset test environment
 func resetTestEnv() {
 	envVars := []string{
-		"API_KEY", "API_URL", "RUN_MODE", "CRON_INTERVAL",
-		"LOG_LEVEL", "LOG_FORMAT", "LOG_FILE",
+		"API_KEY", "API_URL", "RUN_MODE", "CRON_INTERVAL", "MIN_CRON_INTERVAL",
+		"LOG_LEVEL", "LOG_FORMAT", "LOG_FILE", "LOG_FILE_MAX_SIZE_MB", "LOG_FILE_MAX_BACKUPS",
 		"DRY_RUN", "RESET_STACKS", "CONFIRM_RESET_STACK",
-		"REPLACE_STACKS", "WITH_ARCHIVED", "WITH_DELETED",
+		"REPLACE_STACKS", "WITH_ARCHIVED", "WITH_HIDDEN", "WITH_DELETED",
 		"REMOVE_SINGLE_ASSET_STACKS", "CRITERIA",
 		"PARENT_FILENAME_PROMOTE", "PARENT_EXT_PROMOTE",
 		"FILTER_ALBUM_IDS", "FILTER_TAKEN_AFTER", "FILTER_TAKEN_BEFORE",
+		"MAX_ASSET_ERRORS", "SKIP_MATCH_MISS", "PREFETCH_FILENAME_QUERY",
+		"LIMIT", "MAX_GROUPS", "SAMPLE_RANDOM", "SAMPLE_SEED", "RESUME_TOKEN", "MAX_RUN_DURATION", "CROSS_LIBRARY_STACKING", "CROSS_OWNER_STACKING", "INCLUDE_PARTNER_ASSETS", "TAG_PARENT_WITH",
+		"INTERACTIVE", "SKIP_LIST_FILE", "AUTO_LEARN_REJECTIONS", "FORCE_RESTACK", "PROMOTE_ORDER", "DELIMITERS", "PROFILES", "UNION_MODE", "UNION_LOG_SIZE", "EVENTS", "MAX_PENDING_JOBS", "MIN_ASSET_AGE", "IGNORE_SERVER_LOAD", "DUPLICATES_REPORT", "ADD_PARENTS_TO_ALBUM", "QUIET", "ASSETS_FROM_FILE", "MAX_TIME_BUCKET", "EDITED_SUFFIXES", "MAX_STACK_TIME_SPREAD", "MAX_STACK_TIME_SPREAD_ACTION", "REQUIRE_SAME_FOLDER", "REQUIRE_SAME_FOLDER_ACTION", "ONLY_NEW_STACKS", "STACK_MARKER", "STRICT_URL", "SERVER_MAX_STACK_SIZE", "OVERSIZE_POLICY", "PARENT_SELECTOR_CMD", "PARENT_SELECTOR_TIMEOUT", "FILTER_REGEX", "FILTER_PATH_REGEX", "OTEL_EXPORTER_OTLP_ENDPOINT", "EXCLUDE_EXTENSION", "REMOVE_EXCLUDED_FROM_STACKS", "FROM_IMMICH_DUPLICATES", "ANALYZE_TIME_GAPS", "AUDIT_LOG", "MAX_DELETE_FRACTION", "MAX_DELETE_COUNT", "FORCE_DELETE", "EXTRA_HEADERS", "BASIC_AUTH_USER", "BASIC_AUTH_PASS", "DIFF_ONLY_CHANGES", "PANIC_FATAL", "RESET_MARKED_ONLY", "INCLUDE_SIDECARS", "SKIP_INCOMPLETE_ASSETS", "DEBUG_SAMPLE", "STACK_KEY_TEMPLATE", "EXT_RANK_FALLBACK",
 	}
 
 	for _, env := range envVars {
@@ -388,14 +427,94 @@ func resetTestEnv() {
 	parentExtPromote = ""
 	runMode = ""
 	cronInterval = 0
+	minCronInterval = 300
 	withArchived = false
+	withHidden = false
 	resetStacks = false
+	confirmResetStack = ""
 	dryRun = false
 	replaceStacks = false
 	withDeleted = false
 	logLevel = ""
+	logFormat = ""
 	removeSingleAssetStacks = false
 	filterAlbumIDs = nil
+	maxAssetErrors = 0
+	debugSample = 0
+	stackKeyTemplate = ""
+	skipMatchMiss = false
+	prefetchFilenameQuery = ""
+	limit = 0
+	maxGroups = 0
+	sampleRandom = false
+	sampleSeed = 0
+	resumeToken = ""
+	maxRunDuration = 0
+	crossLibraryStacking = false
+	crossOwnerStacking = false
+	includePartnerAssets = false
+	stackMarker = ""
+	tagParentWith = ""
+	interactive = false
+	skipListFile = ""
+	skipListFileSet = false
+	autoLearnRejections = false
+	forceRestack = false
+	diffOnlyChanges = false
+	panicFatal = false
+	resetMarkedOnly = false
+	maxDeleteFraction = defaultMaxDeleteFraction
+	maxDeleteCount = 0
+	forceDelete = false
+	promoteOrder = ""
+	extRankFallback = ""
+	delimiters = ""
+	delimiterList = nil
+	profiles = ""
+	profileList = nil
+	unionMode = ""
+	unionLogSize = 0
+	maxTimeBucket = 0
+	serverMaxStackSize = 0
+	oversizePolicy = ""
+	parentSelectorCmd = ""
+	parentSelectorTimeout = 0
+	filterRegex = nil
+	filterPathRegex = nil
+	excludeExtension = ""
+	excludedExtensions = nil
+	removeExcludedFromStacks = false
+	includeSidecars = false
+	skipIncompleteAssets = false
+	fromImmichDuplicates = false
+	analyzeTimeGaps = false
+	auditLog = ""
+	editedSuffixes = ""
+	editedSuffixList = nil
+	maxStackTimeSpread = 0
+	maxStackTimeSpreadAction = ""
+	requireSameFolder = false
+	requireSameFolderAction = ""
+	boundFlags = nil
+	onlyNewStacks = false
+	strictURL = false
+	headerFlags = nil
+	extraHeaders = nil
+	basicAuthUser = ""
+	basicAuthPass = ""
+	stdoutDocument = false
+	eventsFormat = ""
+	otlpEndpoint = ""
+	maxPendingJobs = 0
+	minAssetAge = 0
+	duplicatesReport = ""
+	addParentsToAlbum = ""
+	logFile = ""
+	logFileMaxSizeMB = 0
+	logFileMaxBackups = 0
+	ignoreServerLoad = false
+	quiet = false
+	assetsFromFile = ""
 	filterTakenAfter = ""
 	filterTakenBefore = ""
 }
@@ -488,6 +607,85 @@ func TestFilterAlbumIDsEmptyEnv(t *testing.T) {
 	assert.Nil(t, filterAlbumIDs, "filterAlbumIDs should be nil when env var is not set")
 }
 
+/************************************************************************************************
+** Tests for STACK_KEY_TEMPLATE environment variable parsing
+************************************************************************************************/
+
+func TestStackKeyTemplateEnvVarParsing(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("STACK_KEY_TEMPLATE", "{{index .Values 0}}")
+	config := LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.Equal(t, "{{index .Values 0}}", stackKeyTemplate)
+
+	os.Setenv("STACK_KEY_TEMPLATE", "{{index .Values 0")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "invalid STACK_KEY_TEMPLATE")
+
+	os.Setenv("STACK_KEY_TEMPLATE", "{{index .Values 2}}")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "invalid STACK_KEY_TEMPLATE", "the default criteria have two values")
+}
+
+/************************************************************************************************
+** Tests for DEBUG_SAMPLE environment variable parsing
+************************************************************************************************/
+
+func TestDebugSampleEnvVarParsing(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("DEBUG_SAMPLE", "20")
+	config := LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.Equal(t, 20, debugSample)
+
+	os.Setenv("DEBUG_SAMPLE", "-1")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "invalid DEBUG_SAMPLE")
+}
+
+/************************************************************************************************
+** Tests for MAX_ASSET_ERRORS environment variable parsing
+************************************************************************************************/
+
+func TestMaxAssetErrorsEnvVarParsing(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         string
+		expected    int
+		expectError bool
+	}{
+		{name: "unset means no limit", env: "", expected: 0},
+		{name: "valid limit", env: "25", expected: 25},
+		{name: "not a number", env: "many", expectError: true},
+		{name: "negative", env: "-1", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetTestEnv()
+			defer resetTestEnv()
+			os.Setenv("API_KEY", "test-key")
+			if tt.env != "" {
+				os.Setenv("MAX_ASSET_ERRORS", tt.env)
+			}
+
+			config := LoadEnvForTesting()
+
+			if tt.expectError {
+				assert.Error(t, config.Error)
+				assert.Contains(t, config.Error.Error(), "MAX_ASSET_ERRORS")
+				return
+			}
+			assert.NoError(t, config.Error)
+			assert.Equal(t, tt.expected, maxAssetErrors)
+		})
+	}
+}
+
 /************************************************************************************************
 ** Tests for date filter environment variable parsing with TrimSpace
 ************************************************************************************************/
@@ -583,3 +781,368 @@ func TestDateFilterEnvVarParsing(t *testing.T) {
 		})
 	}
 }
+
+/************************************************************************************************
+** Tests for PROMOTE_ORDER environment variable validation
+************************************************************************************************/
+
+func TestPromoteOrderEnvVarValidation(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("PROMOTE_ORDER", "ext,size,alpha")
+
+	config := LoadEnvForTesting()
+	assert.NoError(t, config.Error)
+	assert.Equal(t, "ext,size,alpha", promoteOrder)
+	assert.True(t, withExif, "the size rule needs the EXIF file size")
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("PROMOTE_ORDER", "ext,weight")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, `invalid PROMOTE_ORDER: unknown promote rule "weight"`)
+}
+
+func TestParentExtPromoteMetaExtensions(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("PARENT_EXT_PROMOTE", ".jpg,@raw")
+	config := LoadEnvForTesting()
+	assert.NoError(t, config.Error)
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("PARENT_EXT_PROMOTE", ".jpg,@raws")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, `invalid PARENT_EXT_PROMOTE: unknown meta-extension "@raws", expected @raw, @image or @video`)
+}
+
+func TestExtRankFallbackEnvVarValidation(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("EXT_RANK_FALLBACK", "alpha")
+
+	config := LoadEnvForTesting()
+	assert.NoError(t, config.Error)
+	assert.Equal(t, "alpha", extRankFallback)
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("EXT_RANK_FALLBACK", "size")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "invalid EXT_RANK_FALLBACK 'size', expected builtin, alpha or none")
+}
+
+/************************************************************************************************
+** Tests for DELIMITERS environment variable validation
+************************************************************************************************/
+
+func TestDelimitersEnvVarValidation(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("DELIMITERS", `-,\,`)
+
+	config := LoadEnvForTesting()
+	assert.NoError(t, config.Error)
+	assert.Equal(t, []string{"-", ","}, delimiterList)
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("DELIMITERS", "-,,~")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "invalid DELIMITERS: delimiter 2")
+}
+
+func TestProfilesEnvVarValidation(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("PROFILES", `[{"name": "scans", "selector": {"criteria": {"key": "originalPath", "regex": {"key": "^/scans/"}}}}]`)
+
+	config := LoadEnvForTesting()
+	assert.NoError(t, config.Error)
+	assert.Equal(t, []string{"scans"}, profileNames())
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("PROFILES", `[{"name": "scans"}]`)
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "invalid PROFILES: profile scans has no selector")
+}
+
+func TestUnionModeEnvVarValidation(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("UNION_MODE", "strict")
+	os.Setenv("UNION_LOG_SIZE", "5")
+
+	config := LoadEnvForTesting()
+	assert.NoError(t, config.Error)
+	assert.Equal(t, "strict", unionMode)
+	assert.Equal(t, 5, unionLogSize)
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("UNION_MODE", "loose")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "invalid UNION_MODE 'loose'")
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("UNION_LOG_SIZE", "-1")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "invalid UNION_LOG_SIZE '-1'")
+}
+
+func TestMaxTimeBucketEnvVarValidation(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("MAX_TIME_BUCKET", "2000")
+
+	config := LoadEnvForTesting()
+	assert.NoError(t, config.Error)
+	assert.Equal(t, 2000, maxTimeBucket)
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("MAX_TIME_BUCKET", "many")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "invalid MAX_TIME_BUCKET 'many'")
+}
+
+func TestServerMaxStackSizeEnvVarValidation(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("SERVER_MAX_STACK_SIZE", "500")
+	os.Setenv("OVERSIZE_POLICY", "split")
+
+	config := LoadEnvForTesting()
+	assert.NoError(t, config.Error)
+	assert.Equal(t, 500, serverMaxStackSize)
+	assert.Equal(t, "split", oversizePolicy)
+
+	for env, value := range map[string]string{"SERVER_MAX_STACK_SIZE": "1", "OVERSIZE_POLICY": "truncate"} {
+		resetTestEnv()
+		os.Setenv("API_KEY", "test-key")
+		os.Setenv(env, value)
+		config = LoadEnvForTesting()
+		assert.ErrorContains(t, config.Error, "invalid "+env+" '"+value+"'")
+	}
+}
+
+func TestEditedSuffixesEnvVar(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("EDITED_SUFFIXES", "retocado, , bijgewerkt")
+
+	config := LoadEnvForTesting()
+	assert.NoError(t, config.Error)
+	assert.Equal(t, utils.DefaultEditedSuffixes, editedSuffixList[:len(utils.DefaultEditedSuffixes)])
+	assert.Equal(t, []string{"retocado", "bijgewerkt"}, editedSuffixList[len(utils.DefaultEditedSuffixes):])
+	assert.Len(t, utils.DefaultEditedSuffixes, 14, "the built-in list is left as is")
+	assert.Equal(t, editedSuffixList, stackerOptions(nil, nil).EditedSuffixes, "the suffixes reach the stacker through its options")
+}
+
+func TestSanityRulesEnvVarValidation(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("MAX_STACK_TIME_SPREAD", "24h")
+	os.Setenv("MAX_STACK_TIME_SPREAD_ACTION", "drop")
+	os.Setenv("REQUIRE_SAME_FOLDER", "true")
+
+	config := LoadEnvForTesting()
+	assert.NoError(t, config.Error)
+	assert.Equal(t, 24*time.Hour, maxStackTimeSpread)
+	assert.Equal(t, "drop", maxStackTimeSpreadAction)
+	assert.True(t, requireSameFolder)
+	assert.Empty(t, requireSameFolderAction)
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("MAX_STACK_TIME_SPREAD", "a day")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "invalid MAX_STACK_TIME_SPREAD 'a day'")
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("REQUIRE_SAME_FOLDER_ACTION", "merge")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "invalid REQUIRE_SAME_FOLDER_ACTION 'merge', expected split or drop")
+}
+
+func TestMaxPendingJobsEnvVarValidation(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("MAX_PENDING_JOBS", "100")
+	os.Setenv("IGNORE_SERVER_LOAD", "true")
+
+	config := LoadEnvForTesting()
+	assert.NoError(t, config.Error)
+	assert.Equal(t, 100, maxPendingJobs)
+	assert.True(t, ignoreServerLoad)
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("MAX_PENDING_JOBS", "many")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "invalid MAX_PENDING_JOBS 'many'")
+}
+
+func TestQuietEnvVar(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("QUIET", "true")
+
+	config := LoadEnvForTesting()
+	assert.NoError(t, config.Error)
+	assert.True(t, quiet)
+}
+
+func TestMinAssetAgeEnvVarValidation(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("MIN_ASSET_AGE", "5m")
+
+	config := LoadEnvForTesting()
+	assert.NoError(t, config.Error)
+	assert.Equal(t, 5*time.Minute, minAssetAge)
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("MIN_ASSET_AGE", "soon")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "invalid MIN_ASSET_AGE 'soon'")
+}
+
+func TestOnlyNewStacksConflicts(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("ONLY_NEW_STACKS", "true")
+
+	config := LoadEnvForTesting()
+	assert.NoError(t, config.Error)
+	assert.True(t, onlyNewStacks)
+
+	for env, value := range map[string]string{
+		"REPLACE_STACKS":             "true",
+		"REMOVE_SINGLE_ASSET_STACKS": "true",
+		"STACK_MARKER":               "description",
+		"TAG_PARENT_WITH":            "stacked",
+	} {
+		resetTestEnv()
+		os.Setenv("API_KEY", "test-key")
+		os.Setenv("ONLY_NEW_STACKS", "true")
+		os.Setenv(env, value)
+		config = LoadEnvForTesting()
+		assert.ErrorContains(t, config.Error, "ONLY_NEW_STACKS cannot be combined with "+env, env)
+	}
+}
+
+func TestCrossOwnerStackingRequiresPartnerAssets(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("CROSS_OWNER_STACKING", "true")
+
+	config := LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "CROSS_OWNER_STACKING requires INCLUDE_PARTNER_ASSETS")
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("CROSS_OWNER_STACKING", "true")
+	os.Setenv("INCLUDE_PARTNER_ASSETS", "true")
+	config = LoadEnvForTesting()
+	assert.NoError(t, config.Error)
+	assert.True(t, crossOwnerStacking)
+}
+
+func TestOTLPEndpointEnvVar(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318")
+
+	config := LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.Equal(t, "http://localhost:4318", otlpEndpoint)
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "localhost:4317")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "invalid OTEL_EXPORTER_OTLP_ENDPOINT 'localhost:4317'")
+}
+
+func TestCronIntervalEnvVarValidation(t *testing.T) {
+	defer resetTestEnv()
+	for value, want := range map[string]int{"3600": 3600, "90m": 5400, "24h": 86400, " 300 ": 300} {
+		resetTestEnv()
+		os.Setenv("API_KEY", "test-key")
+		os.Setenv("RUN_MODE", "cron")
+		os.Setenv("CRON_INTERVAL", value)
+		config := LoadEnvForTesting()
+		require.NoError(t, config.Error, value)
+		assert.Equal(t, want, cronInterval, value)
+	}
+
+	for _, value := range []string{"0", "-60", "1x", "0s", "soon"} {
+		resetTestEnv()
+		os.Setenv("API_KEY", "test-key")
+		os.Setenv("RUN_MODE", "cron")
+		os.Setenv("CRON_INTERVAL", value)
+		config := LoadEnvForTesting()
+		assert.EqualError(t, config.Error, "invalid CRON_INTERVAL '"+value+"', expected a positive number of seconds or a duration such as 90m")
+	}
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("RUN_MODE", "cron")
+	os.Setenv("CRON_INTERVAL", "1")
+	config := LoadEnvForTesting()
+	assert.EqualError(t, config.Error, "CRON_INTERVAL of 1s is below MIN_CRON_INTERVAL of 5m, lower MIN_CRON_INTERVAL to run this often")
+
+	os.Setenv("MIN_CRON_INTERVAL", "1s")
+	config = LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.Equal(t, 1, cronInterval)
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("CRON_INTERVAL", "1")
+	config = LoadEnvForTesting()
+	assert.NoError(t, config.Error, "the minimum only applies to the cron mode")
+}
+
+func TestCronIntervalSummary(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("RUN_MODE", "cron")
+	os.Setenv("CRON_INTERVAL", "5400")
+	config := LoadEnvForTesting()
+	require.NoError(t, config.Error)
+
+	var buf bytes.Buffer
+	config.Logger.SetOutput(&buf)
+	logStartupSummary(config.Logger)
+	assert.Contains(t, buf.String(), "interval=1h30m")
+}
+
+func TestFormatSeconds(t *testing.T) {
+	for seconds, want := range map[int]string{45: "45s", 300: "5m", 330: "5m30s", 5400: "1h30m", 86400: "24h", 3601: "1h0m1s"} {
+		assert.Equal(t, want, formatSeconds(seconds))
+	}
+}
@@ -0,0 +1,169 @@
+/**************************************************************************************************
+** Deletion safety brake for the Immich CLI application.
+** A bad criteria change can propose to tear apart most of the stacks of a library. The stacks
+** RESET_STACKS, REMOVE_SINGLE_ASSET_STACKS and REMOVE_EXCLUDED_FROM_STACKS delete are counted
+** before the stacks are fetched, the ones the replacements tear apart once the stacks are grouped,
+** and the run aborts when they exceed MAX_DELETE_FRACTION or MAX_DELETE_COUNT, unless
+** FORCE_DELETE is set.
+**************************************************************************************************/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/orchestrator"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultMaxDeleteFraction is the share of the existing stacks a run may delete without --force-delete
+const defaultMaxDeleteFraction = 0.3
+
+/**************************************************************************************************
+** Counts the stacks deleted before the grouping: the reset or the single asset stacks, which the
+** client deletes as it fetches the stacks, and the stacks holding an excluded extension. Nothing
+** is listed when none of these deletions is enabled.
+**
+** @param client - Immich client listing the stacks
+** @return int - Number of stacks the cleanup would delete
+** @return int - Number of existing stacks
+** @return error - Any error of the requests
+**************************************************************************************************/
+func cleanupDeletions(client immich.ImmichClient) (int, int, error) {
+	if !resetStacks && !removeSingleAssetStacks && !removeExcludedFromStacks {
+		return 0, 0, nil
+	}
+	existingStacks, doomed, err := client.PlanStackCleanup()
+	if err != nil {
+		return 0, 0, err
+	}
+	deletions := len(doomed)
+	if removeExcludedFromStacks && len(excludedExtensions) > 0 {
+		counted := make(map[string]bool)
+		for _, stack := range existingStacks {
+			if doomed[stack.ID] || counted[stack.ID] {
+				continue
+			}
+			for _, member := range stack.Assets {
+				if hasExcludedExtension(member.OriginalFileName, excludedExtensions) {
+					counted[stack.ID] = true
+					deletions++
+					break
+				}
+			}
+		}
+	}
+	return deletions, countStacks(existingStacks), nil
+}
+
+/**************************************************************************************************
+** Counts the existing stacks the apply loop would delete, with the same checks and in the same
+** order. A replaced stack whose members all join the new stack only changes its content, it is
+** not counted: the deletions counted are the stacks the run tears apart.
+**
+** @param stacks - Members of each group, parent first, in the order they are applied
+** @param existingStacks - Stacks fetched from Immich, by asset ID
+** @param filtered - Assets left out by the prefilter, by ID
+** @return int - Number of stacks the run would tear apart
+**************************************************************************************************/
+func plannedDeletions(stacks [][]utils.TAsset, existingStacks map[string]utils.TStack, filtered map[string]bool) int {
+	if !replaceStacks || onlyNewStacks {
+		return 0
+	}
+	index := orchestrator.NewStackIndex(existingStacks)
+	deletions := 0
+	for _, stack := range stacks {
+		index.Refresh(stack)
+		_, _, newStackIDs := orchestrator.ParentAndChildrenIDs(stack)
+		_, _, originalStackIDs := orchestrator.OriginalStackIDs(stack)
+		if !orchestrator.IsValidStack(newStackIDs) || !orchestrator.NeedsStackUpdate(originalStackIDs, newStackIDs, replaceStacks) || touchesFilteredStack(stack, filtered) {
+			continue
+		}
+		childrenWithStack, hasChildrenWithStack := orchestrator.ChildrenWithStack(stack)
+		if !hasChildrenWithStack {
+			continue
+		}
+
+		// A stack deleted after the creation loses its parent, which is not a member
+		deleteFirst, deleteAfter := index.ReplacedStacks(childrenWithStack, newStackIDs)
+		deletions += len(deleteAfter)
+		for _, old := range deleteFirst {
+			if !containsAll(newStackIDs, old.AssetIDs) {
+				deletions++
+			}
+			index.RemoveStack(old.ID)
+		}
+		index.RecordCreated(newStackIDs)
+		for _, stackID := range deleteAfter {
+			index.RemoveStack(stackID)
+		}
+	}
+	return deletions
+}
+
+/**************************************************************************************************
+** Tells whether every ID of a list is in another one.
+**
+** @param ids - IDs that must all be present
+** @param subset - IDs to check
+** @return bool - True when the list holds every ID of the subset
+**************************************************************************************************/
+func containsAll(ids []string, subset []string) bool {
+	present := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		present[id] = true
+	}
+	for _, id := range subset {
+		if !present[id] {
+			return false
+		}
+	}
+	return true
+}
+
+/**************************************************************************************************
+** Counts the distinct stacks of the stacks map, which lists each stack once per asset.
+**
+** @param existingStacks - Stacks fetched from Immich, by asset ID
+** @return int - Number of stacks
+**************************************************************************************************/
+func countStacks(existingStacks map[string]utils.TStack) int {
+	ids := make(map[string]bool)
+	for _, stack := range existingStacks {
+		ids[stack.ID] = true
+	}
+	return len(ids)
+}
+
+/**************************************************************************************************
+** Checks the planned deletions against MAX_DELETE_FRACTION and MAX_DELETE_COUNT. A dry run only
+** warns, as nothing is deleted, and FORCE_DELETE lifts the brake.
+**
+** @param deletions - Number of stacks the run would tear apart
+** @param total - Number of existing stacks
+** @param logger - Logger instance for output
+** @return error - An error when a real run would delete too many stacks
+**************************************************************************************************/
+func checkDeleteBrake(deletions, total int, logger *logrus.Logger) error {
+	overFraction := float64(deletions) > maxDeleteFraction*float64(total)
+	overCount := maxDeleteCount > 0 && deletions > maxDeleteCount
+	if !overFraction && !overCount {
+		return nil
+	}
+
+	limit := fmt.Sprintf("MAX_DELETE_FRACTION (%g)", maxDeleteFraction)
+	if overCount {
+		limit = fmt.Sprintf("MAX_DELETE_COUNT (%d)", maxDeleteCount)
+	}
+	switch {
+	case forceDelete:
+		logger.Warnf("⚠️  Deleting %d of the %d existing stacks, more than %s, as FORCE_DELETE is set", deletions, total, limit)
+		return nil
+	case dryRun:
+		logger.Warnf("⚠️  This run would delete %d of the %d existing stacks, more than %s: without --dry-run, it aborts unless --force-delete is set", deletions, total, limit)
+		return nil
+	}
+	return fmt.Errorf("the run would delete %d of the %d existing stacks, more than %s: check the changes with --dry-run first, or re-run with --force-delete", deletions, total, limit)
+}
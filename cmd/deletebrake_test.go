@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlannedDeletions(t *testing.T) {
+	defer resetGlobalConfig()
+	resetGlobalConfig()
+	replaceStacks = true
+
+	grown := utils.TStack{ID: "s1", PrimaryAssetID: "a", Assets: []utils.TAsset{{ID: "a"}, {ID: "b"}}}
+	torn := utils.TStack{ID: "s2", PrimaryAssetID: "c", Assets: []utils.TAsset{{ID: "c"}, {ID: "d"}}}
+	untouched := utils.TStack{ID: "s3", PrimaryAssetID: "e", Assets: []utils.TAsset{{ID: "e"}, {ID: "f"}}}
+	existingStacks := map[string]utils.TStack{"a": grown, "b": grown, "c": torn, "d": torn, "e": untouched, "f": untouched}
+	stacks := func() [][]utils.TAsset {
+		return [][]utils.TAsset{
+			// Same content and one more asset, the old stack is replaced, not torn apart
+			{{ID: "a"}, {ID: "b"}, {ID: "x"}},
+			// Takes a child of s2, which loses its parent
+			{{ID: "y"}, {ID: "d"}},
+			{{ID: "e"}, {ID: "f"}},
+		}
+	}
+
+	assert.Equal(t, 1, plannedDeletions(stacks(), existingStacks, nil))
+	assert.Equal(t, 3, countStacks(existingStacks))
+
+	// A filtered stack is left alone, like in the apply loop
+	assert.Equal(t, 0, plannedDeletions(stacks(), existingStacks, map[string]bool{"c": true}))
+
+	replaceStacks = false
+	assert.Equal(t, 0, plannedDeletions(stacks(), existingStacks, nil))
+}
+
+func TestCheckDeleteBrake(t *testing.T) {
+	defer resetGlobalConfig()
+	resetGlobalConfig()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	assert.NoError(t, checkDeleteBrake(0, 0, logger))
+	assert.NoError(t, checkDeleteBrake(3, 10, logger))
+	err := checkDeleteBrake(4, 10, logger)
+	assert.ErrorContains(t, err, "the run would delete 4 of the 10 existing stacks, more than MAX_DELETE_FRACTION (0.3)")
+	assert.ErrorContains(t, err, "--force-delete")
+
+	maxDeleteFraction = 1
+	assert.NoError(t, checkDeleteBrake(10, 10, logger))
+	maxDeleteCount = 2
+	assert.ErrorContains(t, checkDeleteBrake(3, 10, logger), "more than MAX_DELETE_COUNT (2)")
+
+	maxDeleteCount = 0
+	maxDeleteFraction = 0
+	assert.NoError(t, checkDeleteBrake(0, 10, logger))
+	assert.ErrorContains(t, checkDeleteBrake(1, 10, logger), "more than MAX_DELETE_FRACTION (0)", "0 blocks any deletion")
+
+	dryRun = true
+	assert.NoError(t, checkDeleteBrake(3, 10, logger), "a dry run only warns")
+	dryRun = false
+	forceDelete = true
+	assert.NoError(t, checkDeleteBrake(3, 10, logger))
+}
+
+func TestRunStackerOnceDeleteBrake(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+	replaceStacks = true
+
+	stacked := utils.TStack{ID: "old", PrimaryAssetID: "5", Assets: []utils.TAsset{{ID: "4"}, {ID: "5"}}}
+	client := &fakeClient{
+		stacks: map[string]utils.TStack{"4": stacked, "5": stacked},
+		assets: []utils.TAsset{
+			{ID: "3", OriginalFileName: "IMG_0002.JPG", LocalDateTime: "2024-01-01T11:00:00Z"},
+			{ID: "4", OriginalFileName: "IMG_0002.DNG", LocalDateTime: "2024-01-01T11:00:00Z"},
+			{ID: "5", OriginalFileName: "IMG_0009.JPG", LocalDateTime: "2024-01-01T12:00:00Z"},
+		},
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	err := runStackerOnce(client, logger, &runProgress{}, nil, nil, nil)
+	assert.ErrorContains(t, err, "the run would delete 1 of the 1 existing stacks")
+	assert.Equal(t, exitConfigError, exitCode(err))
+	assert.Empty(t, client.created, "nothing is applied")
+	assert.Empty(t, client.deleted)
+
+	forceDelete = true
+	require.NoError(t, runStackerOnce(client, logger, &runProgress{}, nil, nil, nil))
+	assert.Equal(t, []string{"old"}, client.deleted)
+}
+
+func TestRunStackerOnceDeleteBrakeCleanup(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+	resetStacks = true
+
+	stacked := utils.TStack{ID: "old", PrimaryAssetID: "1", Assets: []utils.TAsset{{ID: "1"}, {ID: "2"}}}
+	client := &fakeClient{
+		stacks:  map[string]utils.TStack{"1": stacked, "2": stacked},
+		cleanup: map[string]bool{"old": true},
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	// The reset is weighed before the client deletes anything
+	err := runStackerOnce(client, logger, &runProgress{}, nil, nil, nil)
+	assert.ErrorContains(t, err, "the run would delete 1 of the 1 existing stacks")
+	assert.Equal(t, exitConfigError, exitCode(err))
+
+	resetStacks = false
+	removeExcludedFromStacks = true
+	excludedExtensions = []string{".dng"}
+	stacked.Assets[1].OriginalFileName = "IMG_0001.DNG"
+	client = &fakeClient{stacks: map[string]utils.TStack{"1": stacked, "2": stacked}}
+	err = runStackerOnce(client, logger, &runProgress{}, nil, nil, nil)
+	assert.ErrorContains(t, err, "the run would delete 1 of the 1 existing stacks")
+	assert.Empty(t, client.deleted, "the stacks of excluded extensions are weighed before they are dissolved")
+}
+
+func TestDeleteBrakeEnvVars(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("MAX_DELETE_FRACTION", "0.05")
+	os.Setenv("MAX_DELETE_COUNT", "50")
+	os.Setenv("FORCE_DELETE", "true")
+	config := LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.Equal(t, 0.05, maxDeleteFraction)
+	assert.Equal(t, 50, maxDeleteCount)
+	assert.True(t, forceDelete)
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	require.NoError(t, LoadEnvForTesting().Error)
+	assert.Equal(t, defaultMaxDeleteFraction, maxDeleteFraction)
+	os.Setenv("MAX_DELETE_FRACTION", "0")
+	require.NoError(t, LoadEnvForTesting().Error)
+	assert.Equal(t, 0.0, maxDeleteFraction, "0 is kept, blocking any deletion")
+
+	for env, value := range map[string]string{"MAX_DELETE_FRACTION": "1.5", "MAX_DELETE_COUNT": "-1"} {
+		resetTestEnv()
+		os.Setenv("API_KEY", "test-key")
+		os.Setenv(env, value)
+		config = LoadEnvForTesting()
+		assert.ErrorContains(t, config.Error, "invalid "+env)
+	}
+}
@@ -1,27 +1,53 @@
 /**************************************************************************************************
 ** Duplicates command implementation for the Immich CLI application.
-** Handles duplicate asset detection and reporting functionality.
+** Handles duplicate asset detection and reporting functionality, and optionally stacks or
+** trashes the true duplicates: the assets sharing a checksum.
 **************************************************************************************************/
 
 package main
 
 import (
-	"strings"
+	"fmt"
+	"io"
+	"sort"
 
 	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/orchestrator"
+	"github.com/majorfi/immich-stack/pkg/stacker"
 	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+// duplicatesAction is what the duplicates command does with the duplicates: list, stack or trash
+var duplicatesAction string
+
+// Actions of the duplicates command
+const (
+	duplicatesActionList  = "list"
+	duplicatesActionStack = "stack"
+	duplicatesActionTrash = "trash"
+)
+
 /**************************************************************************************************
 ** Main execution logic for duplicate detection. Fetches assets and calls the ListDuplicates
-** function to identify and display duplicate assets based on filename and timestamp.
+** function to identify and display duplicate assets based on filename and timestamp. With the
+** stack or trash action, the assets sharing a checksum are stacked or trashed instead.
 **
 ** @param cmd - Cobra command instance
 ** @param args - Command line arguments
+** @return error - Categorized error mapped to the exit code by main, or nil
 **************************************************************************************************/
-func runDuplicates(cmd *cobra.Command, args []string) {
-	logger := loadEnv()
+func runDuplicates(cmd *cobra.Command, args []string) error {
+	logger, err := loadEnv()
+	if err != nil {
+		return err
+	}
+	switch duplicatesAction {
+	case duplicatesActionList, duplicatesActionStack, duplicatesActionTrash:
+	default:
+		return configError(fmt.Errorf("invalid action %q: must be list, stack or trash", duplicatesAction))
+	}
 
 	/**********************************************************************************************
 	** Warn if filter flags are set (they have no effect on this command).
@@ -31,34 +57,43 @@ func runDuplicates(cmd *cobra.Command, args []string) {
 	}
 
 	/**********************************************************************************************
-	** Support multiple API keys (comma-separated).
+	** Support multiple API keys (comma-separated), each with its server.
 	**********************************************************************************************/
-	apiKeys := utils.RemoveEmptyStrings(func(keys []string) []string {
-		for i, key := range keys {
-			keys[i] = strings.TrimSpace(key)
-		}
-		return keys
-	}(strings.Split(apiKey, ",")))
-	if len(apiKeys) == 0 {
-		logger.Fatalf("No API key(s) provided.")
+	targets, err := apiTargets()
+	if err != nil {
+		return err
 	}
+	runAudit = newAuditTrail(auditLog, logger)
 
-	for i, key := range apiKeys {
+	var runErr error
+	for i, target := range targets {
 		if i > 0 {
 			logger.Infof("\n")
 		}
-		client := immich.NewClient(apiURL, key, false, false, true, withArchived, withDeleted, false, nil, "", "", logger)
+		// Listing is read-only, the other actions respect --dry-run
+		readOnly := dryRun || duplicatesAction == duplicatesActionList
+		client := immich.NewClient(target.URL, target.Key, false, false, readOnly, withArchived, withDeleted, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
 		if client == nil {
-			logger.Errorf("Invalid client for API key: %s", key)
+			logger.Errorf("Invalid client for API key: %s", target.Key)
+			runErr = worstError(runErr, configError(fmt.Errorf("invalid client for API key: %s", target.Key)))
+			continue
+		}
+		setProxyAuth(client)
+		client.SetOnlyNewStacks(onlyNewStacks)
+		client.SetStackHook(runAudit.hook())
+		if err := client.CheckAPIURL(strictURL); err != nil {
+			logger.Errorf("Invalid API_URL for API key: %s: %v", target.Key, err)
+			runErr = worstError(runErr, configError(err))
 			continue
 		}
 		user, err := client.GetCurrentUser()
 		if err != nil {
-			logger.Errorf("Failed to fetch user for API key: %s: %v", key, err)
+			logger.Errorf("Failed to fetch user for API key: %s: %v", target.Key, err)
+			runErr = worstError(runErr, fatalError(fmt.Errorf("failed to fetch user: %w", err)))
 			continue
 		}
 		logger.Infof("=====================================================================================")
-		logger.Infof("Checking for duplicates for user: %s (%s)", user.Name, user.Email)
+		logger.Infof("Checking for duplicates for user: %s (%s) on %s", user.Name, user.Email, target.host())
 		logger.Infof("=====================================================================================")
 
 		/**********************************************************************************************
@@ -67,19 +102,170 @@ func runDuplicates(cmd *cobra.Command, args []string) {
 		existingStacks, err := client.FetchAllStacks()
 		if err != nil {
 			logger.Errorf("Error fetching stacks: %v", err)
+			runErr = worstError(runErr, fatalError(fmt.Errorf("error fetching stacks: %w", err)))
 			continue
 		}
-		assets, err := client.FetchAssets(1000, existingStacks)
+		assets, err := client.SearchAssets(1000, existingStacks)
 		if err != nil {
 			logger.Errorf("Error fetching assets: %v", err)
+			runErr = worstError(runErr, fatalError(fmt.Errorf("error fetching assets: %w", err)))
 			continue
 		}
 
 		/**********************************************************************************************
-		** List duplicates using the existing function.
+		** List duplicates using the existing function, or act on the true duplicates.
 		**********************************************************************************************/
+		if duplicatesAction != duplicatesActionList {
+			runErr = worstError(runErr, applyDuplicatesAction(client, logger, checksumDuplicateGroups(assets), existingStacks, duplicatesAction))
+			continue
+		}
 		if err := client.ListDuplicates(assets); err != nil {
 			logger.Errorf("Error listing duplicates: %v", err)
+			runErr = worstError(runErr, fatalError(fmt.Errorf("error listing duplicates: %w", err)))
+		}
+	}
+	return runErr
+}
+
+/**************************************************************************************************
+** checksumDuplicateGroups groups the assets sharing a checksum, each group ordered with its
+** parent first: the oldest upload, then the promote rules. Assets without a checksum are left
+** out, and the groups are ordered by parent filename.
+**
+** @param assets - Assets of the library
+** @return [][]utils.TAsset - Groups of two assets or more, parent first
+**************************************************************************************************/
+func checksumDuplicateGroups(assets []utils.TAsset) [][]utils.TAsset {
+	byChecksum := make(map[string][]utils.TAsset)
+	for _, asset := range assets {
+		if asset.Checksum != "" {
+			byChecksum[asset.Checksum] = append(byChecksum[asset.Checksum], asset)
+		}
+	}
+
+	// Every asset of a group shares the checksum, so the stacker only orders them
+	quiet := logrus.New()
+	quiet.SetOutput(io.Discard)
+	ordering := stacker.New(stacker.Options{
+		Criteria:              `[{"key":"checksum"}]`,
+		ParentFilenamePromote: parentFilenamePromote,
+		ParentExtPromote:      parentExtPromote,
+		PromoteOrder:          promoteOrder,
+		Delimiters:            delimiterList,
+		EditedSuffixes:        editedSuffixList,
+		PromoteResolved:       true,
+		CrossLibraryStacking:  true,
+		Logger:                quiet,
+	})
+
+	groups := make([][]utils.TAsset, 0)
+	for _, group := range byChecksum {
+		if len(group) < 2 {
+			continue
+		}
+		if stacks, err := ordering.Stack(group); err == nil && len(stacks) == 1 {
+			group = stacks[0].Members
+		}
+		sort.SliceStable(group, func(i, j int) bool {
+			return uploadedBefore(group[i], group[j])
+		})
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i][0].OriginalFileName != groups[j][0].OriginalFileName {
+			return groups[i][0].OriginalFileName < groups[j][0].OriginalFileName
+		}
+		return groups[i][0].ID < groups[j][0].ID
+	})
+	return groups
+}
+
+/**************************************************************************************************
+** uploadedBefore reports whether an asset was uploaded strictly before another. An asset
+** without an upload time comes after the others.
+**
+** @param a - First asset
+** @param b - Second asset
+** @return bool - True when a was uploaded before b
+**************************************************************************************************/
+func uploadedBefore(a utils.TAsset, b utils.TAsset) bool {
+	if a.CreatedAt == "" || b.CreatedAt == "" {
+		return a.CreatedAt != "" && b.CreatedAt == ""
+	}
+	return a.CreatedAt < b.CreatedAt
+}
+
+/**************************************************************************************************
+** applyDuplicatesAction stacks each duplicate group with its parent first, or keeps the parent
+** and moves the other assets to the trash. The decision for every group is logged, and the
+** client only logs the changes in dry run.
+**
+** @param client - Immich client instance
+** @param logger - Logger instance for output
+** @param groups - Duplicate groups, parent first
+** @param existingStacks - Stacks fetched from Immich, by asset ID
+** @param action - The stack or trash action
+** @return error - Partial failure if some groups failed, or nil
+**************************************************************************************************/
+func applyDuplicatesAction(client immich.ImmichClient, logger *logrus.Logger, groups [][]utils.TAsset, existingStacks map[string]utils.TStack, action string) error {
+	if len(groups) == 0 {
+		logger.Info("No duplicates found based on checksum.")
+		return nil
+	}
+
+	failed := 0
+	for _, group := range groups {
+		parent := group[0]
+		ids := make([]string, len(group))
+		for i, asset := range group {
+			ids[i] = asset.ID
+		}
+		logger.Infof("Duplicate group: %s (%d assets, checksum %s)", parent.OriginalFileName, len(group), parent.Checksum)
+		logger.Infof("  keeping %s (uploaded %s)", parent.ID, parent.CreatedAt)
+
+		switch action {
+		case duplicatesActionStack:
+			if stack, ok := existingStacks[parent.ID]; ok && stack.PrimaryAssetID == parent.ID && len(stack.Assets) == len(group) && sameStack(existingStacks, ids) {
+				logger.Infof("  already stacked, skipping")
+				continue
+			}
+			logger.Infof("  stacking %v", ids[1:])
+			if err := client.CreateStack(ids); err != nil {
+				logger.Errorf("Error stacking duplicates of %s: %v", parent.ID, orchestrator.DecorateMutationError(orchestrator.MutationCreate, "", parent, group, err))
+				failed++
+			}
+		case duplicatesActionTrash:
+			logger.Infof("  trashing %v", ids[1:])
+			if err := client.TrashAssets(ids[1:]); err != nil {
+				logger.Errorf("Error trashing duplicates of %s: %v", parent.ID, orchestrator.DecorateMutationError(orchestrator.MutationTrash, "", parent, group[1:], err))
+				failed++
+			}
+		}
+	}
+	if dryRun {
+		logger.Infof("Dry run: %d duplicate group(s), nothing was changed", len(groups))
+	}
+	if failed > 0 {
+		return partialFailure(fmt.Errorf("%d duplicate group(s) failed to %s", failed, action))
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** sameStack reports whether every asset already belongs to the same stack.
+**
+** @param existingStacks - Stacks fetched from Immich, by asset ID
+** @param ids - Asset IDs
+** @return bool - True when all the assets share one stack
+**************************************************************************************************/
+func sameStack(existingStacks map[string]utils.TStack, ids []string) bool {
+	stackID := ""
+	for _, id := range ids {
+		stack, ok := existingStacks[id]
+		if !ok || (stackID != "" && stack.ID != stackID) {
+			return false
 		}
+		stackID = stack.ID
 	}
+	return true
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the stack and trash actions of the duplicates command
+************************************************************************************************/
+
+func TestChecksumDuplicateGroups(t *testing.T) {
+	resetGlobalConfig()
+	defer resetGlobalConfig()
+
+	groups := checksumDuplicateGroups([]utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG", Checksum: "aaa", CreatedAt: "2024-03-01T10:00:00.000Z"},
+		{ID: "2", OriginalFileName: "IMG_0001 (1).JPG", Checksum: "aaa", CreatedAt: "2024-01-01T10:00:00.000Z"},
+		{ID: "3", OriginalFileName: "IMG_0001.JPG", Checksum: "aaa"},
+		{ID: "4", OriginalFileName: "IMG_0002.JPG", Checksum: "bbb", CreatedAt: "2024-01-01T10:00:00.000Z"},
+		{ID: "5", OriginalFileName: "IMG_0003.JPG", CreatedAt: "2024-01-01T10:00:00.000Z"},
+		{ID: "6", OriginalFileName: "IMG_0003.JPG", CreatedAt: "2024-01-01T10:00:00.000Z"},
+	})
+
+	require.Len(t, groups, 1, "single assets and assets without checksum are not duplicates")
+	ids := []string{groups[0][0].ID, groups[0][1].ID, groups[0][2].ID}
+	assert.Equal(t, []string{"2", "1", "3"}, ids, "the oldest upload is the parent, assets without upload time come last")
+}
+
+func TestApplyDuplicatesAction(t *testing.T) {
+	resetGlobalConfig()
+	defer resetGlobalConfig()
+
+	groups := [][]utils.TAsset{
+		{{ID: "1", Checksum: "aaa"}, {ID: "2", Checksum: "aaa"}, {ID: "3", Checksum: "aaa"}},
+		{{ID: "4", Checksum: "bbb"}, {ID: "5", Checksum: "bbb"}},
+	}
+	existingStacks := map[string]utils.TStack{
+		"4": {ID: "s1", PrimaryAssetID: "4", Assets: []utils.TAsset{{ID: "4"}, {ID: "5"}}},
+		"5": {ID: "s1", PrimaryAssetID: "4", Assets: []utils.TAsset{{ID: "4"}, {ID: "5"}}},
+	}
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			AssetIDs []string `json:"assetIds"`
+			IDs      []string `json:"ids"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		requests = append(requests, fmt.Sprintf("%s %s %v%v", r.Method, r.URL.Path, body.AssetIDs, body.IDs))
+		fmt.Fprint(w, `{}`)
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	newClient := func(dryRun bool) *immich.Client {
+		client := immich.NewClient(server.URL, "key", false, false, dryRun, false, false, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
+		require.NotNil(t, client)
+		return client
+	}
+
+	require.NoError(t, applyDuplicatesAction(newClient(false), logger, groups, existingStacks, duplicatesActionStack))
+	assert.Equal(t, []string{"POST /api/stacks [1 2 3][]"}, requests, "the group already stacked is skipped")
+
+	requests = nil
+	require.NoError(t, applyDuplicatesAction(newClient(false), logger, groups, existingStacks, duplicatesActionTrash))
+	assert.Equal(t, []string{"DELETE /api/assets [][2 3]", "DELETE /api/assets [][5]"}, requests, "the parent is kept")
+
+	requests = nil
+	require.NoError(t, applyDuplicatesAction(newClient(true), logger, groups, existingStacks, duplicatesActionTrash))
+	assert.Empty(t, requests, "nothing is changed in dry run")
+}
@@ -0,0 +1,217 @@
+/**************************************************************************************************
+** Effective configuration of the Immich CLI application.
+** Resolves every grouping setting to the value the run uses, defaults included, with the place
+** it came from, for the startup log and the config effective command.
+**************************************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/majorfi/immich-stack/pkg/stacker"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Sources of an effective setting
+const (
+	sourceFlag     = "flag"
+	sourceCriteria = "criteria"
+	sourceEnv      = "env"
+	sourceDefault  = "default"
+)
+
+// stdoutDocument sends the console logs to stderr, for the commands printing a JSON document
+var stdoutDocument bool
+
+/**************************************************************************************************
+** effectiveSetting is the value a setting resolves to and where it came from: sourceFlag,
+** sourceCriteria, sourceEnv or sourceDefault.
+**************************************************************************************************/
+type effectiveSetting struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+/**************************************************************************************************
+** settingSource tells where a setting came from: its flag when set on the command line, then its
+** environment variable, the .env file included, then the default.
+**
+** @param flag - Name of the flag of the setting
+** @param env - Name of the environment variable of the setting
+** @return string - sourceFlag, sourceEnv or sourceDefault
+**************************************************************************************************/
+func settingSource(flag, env string) string {
+	if flagChanged(flag) {
+		return sourceFlag
+	}
+	if os.Getenv(env) != "" {
+		return sourceEnv
+	}
+	return sourceDefault
+}
+
+/**************************************************************************************************
+** effectiveConfig resolves the grouping settings of the run once the environment is loaded: the
+** criteria with its defaults filled in, the promote lists, the delimiters, the run mode and the
+** filters. Secrets such as the API key are left out.
+**
+** @return map[string]effectiveSetting - The settings by name
+** @return error - An error if the criteria or the promote order cannot be parsed
+**************************************************************************************************/
+func effectiveConfig() (map[string]effectiveSetting, error) {
+	resolvedCriteria, resolvedDelimiters, err := stacker.EffectiveCriteria(stacker.Options{
+		Criteria:        criteria,
+		Delimiters:      delimiterList,
+		PromoteResolved: true,
+		SkipMatchMiss:   skipMatchMiss,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRITERIA: %w", err)
+	}
+	order, err := stacker.ParsePromoteOrder(promoteOrder)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROMOTE_ORDER: %w", err)
+	}
+	effectiveExtRankFallback := extRankFallback
+	if effectiveExtRankFallback == "" {
+		effectiveExtRankFallback = utils.ExtRankFallbackBuiltin
+	}
+	effectiveUnionMode := unionMode
+	if effectiveUnionMode == "" {
+		effectiveUnionMode = utils.UnionModeConnected
+	}
+	effectiveMaxTimeBucket := maxTimeBucket
+	if effectiveMaxTimeBucket == 0 {
+		effectiveMaxTimeBucket = utils.DefaultMaxTimeBucket
+	}
+	effectiveOversizePolicy := oversizePolicy
+	if effectiveOversizePolicy == "" {
+		effectiveOversizePolicy = utils.OversizePolicySkip
+	}
+	// An empty extension list falls back to the default one, unlike the filename list
+	extensions, err := stacker.ParseExtPromote(parentExtPromote)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PARENT_EXT_PROMOTE: %w", err)
+	}
+	if len(extensions) == 0 {
+		extensions = utils.DefaultParentExtPromote
+	}
+	albums := nonNil(filterAlbumIDs)
+
+	setting := func(flag, env string, value interface{}) effectiveSetting {
+		return effectiveSetting{Value: value, Source: settingSource(flag, env)}
+	}
+	// The promote block of the criteria comes after the flags, ahead of the environment
+	promote := criteriaPromote()
+	promoteSetting := func(flag, env string, inCriteria bool, value interface{}) effectiveSetting {
+		if inCriteria && !flagChanged(flag) {
+			return effectiveSetting{Value: value, Source: sourceCriteria}
+		}
+		return setting(flag, env, value)
+	}
+	return map[string]effectiveSetting{
+		"runMode":               setting("run-mode", "RUN_MODE", runMode),
+		"cronInterval":          setting("cron-interval", "CRON_INTERVAL", cronInterval),
+		"dryRun":                setting("dry-run", "DRY_RUN", dryRun),
+		"onlyNewStacks":         setting("only-new-stacks", "ONLY_NEW_STACKS", onlyNewStacks),
+		"criteria":              setting("criteria", "CRITERIA", json.RawMessage(resolvedCriteria)),
+		"parentFilenamePromote": promoteSetting("parent-filename-promote", "PARENT_FILENAME_PROMOTE", len(promote.Filename) > 0, splitList(parentFilenamePromote)),
+		"parentExtPromote":      promoteSetting("parent-ext-promote", "PARENT_EXT_PROMOTE", len(promote.Ext) > 0, extensions),
+		"editedSuffixes":        setting("edited-suffixes", "EDITED_SUFFIXES", editedSuffixList),
+		"promoteOrder":          setting("promote-order", "PROMOTE_ORDER", order),
+		"extRankFallback":       setting("ext-rank-fallback", "EXT_RANK_FALLBACK", effectiveExtRankFallback),
+		"delimiters":            promoteSetting("delimiters", "DELIMITERS", len(promote.Delimiters) > 0, resolvedDelimiters),
+		"skipMatchMiss":         setting("skip-match-miss", "SKIP_MATCH_MISS", skipMatchMiss),
+		"profiles":              setting("profiles", "PROFILES", profileNames()),
+		"fromImmichDuplicates":  setting("from-immich-duplicates", "FROM_IMMICH_DUPLICATES", fromImmichDuplicates),
+		"unionMode":             setting("union-mode", "UNION_MODE", effectiveUnionMode),
+		"maxTimeBucket":         setting("max-time-bucket", "MAX_TIME_BUCKET", effectiveMaxTimeBucket),
+		"crossLibraryStacking":  setting("cross-library-stacking", "CROSS_LIBRARY_STACKING", crossLibraryStacking),
+		"crossOwnerStacking":    setting("cross-owner-stacking", "CROSS_OWNER_STACKING", crossOwnerStacking),
+		"includePartnerAssets":  setting("include-partner-assets", "INCLUDE_PARTNER_ASSETS", includePartnerAssets),
+		"maxStackTimeSpread":    setting("max-stack-time-spread", "MAX_STACK_TIME_SPREAD", maxStackTimeSpread.String()),
+		"requireSameFolder":     setting("require-same-folder", "REQUIRE_SAME_FOLDER", requireSameFolder),
+		"serverMaxStackSize":    setting("server-max-stack-size", "SERVER_MAX_STACK_SIZE", serverMaxStackSize),
+		"oversizePolicy":        setting("oversize-policy", "OVERSIZE_POLICY", effectiveOversizePolicy),
+		"parentSelectorCmd":     setting("parent-selector-cmd", "PARENT_SELECTOR_CMD", parentSelectorCmd),
+		"withArchived":          setting("with-archived", "WITH_ARCHIVED", withArchived),
+		"withHidden":            setting("with-hidden", "WITH_HIDDEN", withHidden),
+		"withDeleted":           setting("with-deleted", "WITH_DELETED", withDeleted),
+		"filterAlbumIDs":        setting("filter-album-ids", "FILTER_ALBUM_IDS", albums),
+		"filterTakenAfter":      setting("filter-taken-after", "FILTER_TAKEN_AFTER", filterTakenAfter),
+		"filterTakenBefore":     setting("filter-taken-before", "FILTER_TAKEN_BEFORE", filterTakenBefore),
+		"filterRegex":           setting("filter-regex", "FILTER_REGEX", nonNil(filterRegex)),
+		"filterPathRegex":       setting("filter-path-regex", "FILTER_PATH_REGEX", nonNil(filterPathRegex)),
+		"limit":                 setting("limit", "LIMIT", limit),
+		"maxGroups":             setting("max-groups", "MAX_GROUPS", maxGroups),
+	}, nil
+}
+
+/**************************************************************************************************
+** nonNil returns the list, or an empty one for nil, so an unset list prints as [] and not null.
+**
+** @param list - The list
+** @return []string - The list, never nil
+**************************************************************************************************/
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+/**************************************************************************************************
+** logEffectiveConfig logs the effective configuration at info level: as a field with the JSON
+** log format, as indented JSON otherwise. A configuration that cannot be resolved is left to the
+** run, which reports the error.
+**
+** @param logger - Logger instance to output the configuration
+**************************************************************************************************/
+func logEffectiveConfig(logger *logrus.Logger) {
+	if !logger.IsLevelEnabled(logrus.InfoLevel) {
+		return
+	}
+	settings, err := effectiveConfig()
+	if err != nil {
+		logger.Debugf("Effective configuration not resolved: %v", err)
+		return
+	}
+	if format := os.Getenv("LOG_FORMAT"); format == "json" {
+		logger.WithField("effective", settings).Info("Effective configuration")
+		return
+	}
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		logger.Debugf("Effective configuration not encoded: %v", err)
+		return
+	}
+	logger.Infof("Effective configuration:\n%s", data)
+}
+
+/**************************************************************************************************
+** runConfigEffective prints the effective configuration as JSON on stdout, for bug reports. The
+** logs go to stderr, and no API key is needed.
+**
+** @param cmd - Command being run
+** @param args - Command arguments
+** @return error - A configuration error, or nil
+**************************************************************************************************/
+func runConfigEffective(cmd *cobra.Command, args []string) error {
+	// Keep stdout a valid JSON document, the startup logs included
+	stdoutDocument = true
+	if _, err := loadEnvWithoutAPIKey(); err != nil {
+		return err
+	}
+	settings, err := effectiveConfig()
+	if err != nil {
+		return configError(err)
+	}
+	encoder := json.NewEncoder(cmd.OutOrStdout())
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(settings)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEffectiveConfigDefaults(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("PARENT_FILENAME_PROMOTE", "cover, editedAny")
+
+	config := LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	settings, err := effectiveConfig()
+	require.NoError(t, err)
+
+	// The default criteria is filled in
+	assert.Equal(t, sourceDefault, settings["criteria"].Source)
+	assert.Contains(t, string(settings["criteria"].Value.(json.RawMessage)), `"key": "originalFileName"`)
+	assert.Equal(t, []string{"~", "."}, settings["delimiters"].Value)
+	assert.Equal(t, []string{"regex", "filename", "ext", "extRank", "alpha"}, settings["promoteOrder"].Value)
+	assert.Equal(t, utils.DefaultParentExtPromote, settings["parentExtPromote"].Value, "@raw is expanded")
+	assert.Equal(t, "once", settings["runMode"].Value)
+
+	assert.Equal(t, []string{"cover", "editedAny"}, settings["parentFilenamePromote"].Value)
+	assert.Equal(t, sourceEnv, settings["parentFilenamePromote"].Source)
+}
+
+func TestEffectiveConfigCommand(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("DRY_RUN", "true")
+
+	var out bytes.Buffer
+	cmd := CreateRootCommand()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"config", "effective", "--criteria", `[{"key": "originalFileName", "split": {"delimiters": ["_"], "index": 0}}]`, "--skip-match-miss"})
+	require.NoError(t, cmd.Execute())
+
+	var settings map[string]struct {
+		Value  json.RawMessage `json:"value"`
+		Source string          `json:"source"`
+	}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &settings), "stdout holds only the JSON document")
+	assert.Equal(t, sourceFlag, settings["criteria"].Source)
+	assert.JSONEq(t, `[{"key": "originalFileName", "split": {"delimiters": ["_"], "index": 0}, "onMiss": "skip"}]`, string(settings["criteria"].Value))
+	assert.JSONEq(t, `["_"]`, string(settings["delimiters"].Value))
+	assert.Equal(t, sourceFlag, settings["skipMatchMiss"].Source)
+	assert.Equal(t, sourceEnv, settings["dryRun"].Source)
+	assert.Equal(t, sourceDefault, settings["withArchived"].Source)
+	assert.NotContains(t, out.String(), "unused", "the API key is never printed")
+}
+
+func TestEffectiveConfigCriteriaPromote(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("PARENT_FILENAME_PROMOTE", "cover")
+	os.Setenv("PARENT_EXT_PROMOTE", ".jpg")
+	os.Setenv("CRITERIA", `{"mode": "advanced", "groups": [{"operator": "AND", "criteria": [{"key": "originalFileName", "split": {"delimiters": ["."], "index": 0}}]}],
+		"promote": {"filename": ["edit"], "ext": [".dng"], "delimiters": ["-"]}}`)
+
+	config := LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.Equal(t, "edit", parentFilenamePromote, "the block comes before the environment")
+	assert.Equal(t, ".dng", parentExtPromote)
+	assert.Equal(t, []string{"-"}, delimiterList)
+
+	settings, err := effectiveConfig()
+	require.NoError(t, err)
+	assert.Equal(t, sourceCriteria, settings["parentFilenamePromote"].Source)
+	assert.Equal(t, []string{".dng"}, settings["parentExtPromote"].Value)
+	assert.Equal(t, []string{"-"}, settings["delimiters"].Value)
+	assert.Equal(t, sourceCriteria, settings["delimiters"].Source)
+
+	var out bytes.Buffer
+	cmd := CreateRootCommand()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"config", "effective", "--parent-ext-promote", ".heic"})
+	require.NoError(t, cmd.Execute())
+	var flagged map[string]struct {
+		Value  json.RawMessage `json:"value"`
+		Source string          `json:"source"`
+	}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &flagged))
+	assert.JSONEq(t, `[".heic"]`, string(flagged["parentExtPromote"].Value), "a flag comes before the block")
+	assert.Equal(t, sourceFlag, flagged["parentExtPromote"].Source)
+	assert.JSONEq(t, `["edit"]`, string(flagged["parentFilenamePromote"].Value))
+	assert.Equal(t, sourceCriteria, flagged["parentFilenamePromote"].Source)
+}
@@ -0,0 +1,111 @@
+/**************************************************************************************************
+** Exit codes and error categories for the Immich CLI application.
+** Commands return errors wrapped with their category and main maps them to an exit code, so
+** orchestration tools can tell a bad configuration from a partial or a fatal failure.
+**************************************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+)
+
+// Exit codes returned by the CLI
+const (
+	exitSuccess        = 0 // Run completed, including runs with nothing to change
+	exitConfigError    = 1 // Configuration or validation error, or an API key rejected by Immich
+	exitPartialFailure = 2 // Run completed but some stacks failed to apply
+	exitFatalError     = 3 // API error that aborted the run
+)
+
+// exitCodesHelp documents the exit codes in the command help
+const exitCodesHelp = `Exit codes:
+  0  success, including runs with nothing to change
+  1  configuration or validation error, or an API key rejected by Immich (401/403)
+  2  partial failure, some stacks failed to apply
+  3  fatal API error during the run`
+
+/**************************************************************************************************
+** exitError wraps an error with the exit code of its category.
+**************************************************************************************************/
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+/**************************************************************************************************
+** configError marks an error as a configuration or validation error (exit code 1).
+**
+** @param err - The error to wrap
+** @return error - The categorized error
+**************************************************************************************************/
+func configError(err error) error {
+	return &exitError{code: exitConfigError, err: err}
+}
+
+/**************************************************************************************************
+** partialFailure marks an error as a partial failure (exit code 2).
+**
+** @param err - The error to wrap
+** @return error - The categorized error
+**************************************************************************************************/
+func partialFailure(err error) error {
+	return &exitError{code: exitPartialFailure, err: err}
+}
+
+/**************************************************************************************************
+** fatalError marks an error as a fatal API error (exit code 3).
+**
+** @param err - The error to wrap
+** @return error - The categorized error
+**************************************************************************************************/
+func fatalError(err error) error {
+	return &exitError{code: exitFatalError, err: err}
+}
+
+/**************************************************************************************************
+** exitCode returns the exit code for an error returned by a command. Errors without a category
+** come from cobra (unknown flag, bad argument) and are configuration errors, like an API key
+** rejected by Immich whatever the category it was returned with.
+**
+** @param err - The error returned by the command, or nil
+** @return int - The exit code
+**************************************************************************************************/
+func exitCode(err error) int {
+	if err == nil {
+		return exitSuccess
+	}
+	if immich.IsAuthError(err) {
+		return exitConfigError
+	}
+	var categorized *exitError
+	if errors.As(err, &categorized) {
+		return categorized.code
+	}
+	return exitConfigError
+}
+
+/**************************************************************************************************
+** worstError returns the error with the highest exit code, keeping the first one on ties. It is
+** used to report a single outcome when processing several users.
+**
+** @param current - The error reported so far, or nil
+** @param next - The error of the latest user, or nil
+** @return error - The error to report
+**************************************************************************************************/
+func worstError(current error, next error) error {
+	if exitCode(next) > exitCode(current) {
+		return next
+	}
+	return current
+}
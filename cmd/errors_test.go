@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for exit code categories
+************************************************************************************************/
+
+func TestExitCode(t *testing.T) {
+	base := errors.New("boom")
+
+	assert.Equal(t, exitSuccess, exitCode(nil))
+	assert.Equal(t, exitConfigError, exitCode(configError(base)))
+	assert.Equal(t, exitPartialFailure, exitCode(partialFailure(base)))
+	assert.Equal(t, exitFatalError, exitCode(fatalError(base)))
+	assert.Equal(t, exitFatalError, exitCode(fmt.Errorf("wrapped: %w", fatalError(base))), "category survives wrapping")
+	assert.Equal(t, exitConfigError, exitCode(base), "uncategorized errors come from cobra flag parsing")
+	assert.ErrorIs(t, fatalError(base), base)
+}
+
+func TestWorstError(t *testing.T) {
+	partial := partialFailure(errors.New("partial"))
+	fatal := fatalError(errors.New("fatal"))
+
+	assert.Nil(t, worstError(nil, nil))
+	assert.Equal(t, partial, worstError(nil, partial))
+	assert.Equal(t, fatal, worstError(partial, fatal))
+	assert.Equal(t, fatal, worstError(fatal, partial))
+}
+
+func TestRunStackerConfigErrorExitCode(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+
+	cmd := CreateTestableRootCommand()
+	cmd.SetArgs([]string{})
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+
+	err := cmd.Execute()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "API_KEY is not set")
+	assert.Equal(t, exitConfigError, exitCode(err))
+}
+
+func TestRunStackerOnceExitCodes(t *testing.T) {
+	defer resetGlobalConfig()
+
+	tests := []struct {
+		name         string
+		stacksStatus int
+		modifyStatus int
+		expectedCode int
+	}{
+		{name: "success", stacksStatus: http.StatusOK, modifyStatus: http.StatusOK, expectedCode: exitSuccess},
+		{name: "stack failing to apply is a partial failure", stacksStatus: http.StatusOK, modifyStatus: http.StatusInternalServerError, expectedCode: exitPartialFailure},
+		{name: "failing to fetch stacks is fatal", stacksStatus: http.StatusInternalServerError, modifyStatus: http.StatusOK, expectedCode: exitFatalError},
+		{name: "rejected API key is a configuration error", stacksStatus: http.StatusUnauthorized, modifyStatus: http.StatusOK, expectedCode: exitConfigError},
+		{name: "missing permission is a configuration error", stacksStatus: http.StatusOK, modifyStatus: http.StatusForbidden, expectedCode: exitConfigError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.Method + " " + r.URL.Path {
+				case "GET /api/stacks":
+					w.WriteHeader(tt.stacksStatus)
+					fmt.Fprint(w, `[]`)
+				case "POST /api/search/metadata":
+					fmt.Fprint(w, `{"assets": {"items": [
+						{"id": "1", "originalFileName": "IMG_0001.JPG", "localDateTime": "2024-01-01T10:00:00Z"},
+						{"id": "2", "originalFileName": "IMG_0001.CR3", "localDateTime": "2024-01-01T10:00:00Z"}
+					], "nextPage": null}}`)
+				case "POST /api/stacks":
+					w.WriteHeader(tt.modifyStatus)
+				default:
+					fmt.Fprint(w, `{}`)
+				}
+			}))
+			defer server.Close()
+
+			logger := logrus.New()
+			logger.SetOutput(io.Discard)
+			client := immich.NewClient(server.URL, "key", false, false, false, false, false, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
+			require.NotNil(t, client)
+
+			err := runStackerOnce(client, logger, nil, nil, nil, nil)
+			assert.Equal(t, tt.expectedCode, exitCode(err))
+		})
+	}
+}
+
+func TestRunStackerOnceStopsOnAuthError(t *testing.T) {
+	defer resetGlobalConfig()
+
+	modifyRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/stacks":
+			fmt.Fprint(w, `[]`)
+		case "POST /api/search/metadata":
+			fmt.Fprint(w, `{"assets": {"items": [
+				{"id": "1", "originalFileName": "IMG_0001.JPG", "localDateTime": "2024-01-01T10:00:00Z"},
+				{"id": "2", "originalFileName": "IMG_0001.CR3", "localDateTime": "2024-01-01T10:00:00Z"},
+				{"id": "3", "originalFileName": "IMG_0002.JPG", "localDateTime": "2024-01-01T11:00:00Z"},
+				{"id": "4", "originalFileName": "IMG_0002.CR3", "localDateTime": "2024-01-01T11:00:00Z"}
+			], "nextPage": null}}`)
+		case "POST /api/stacks":
+			modifyRequests++
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"message": "Missing required permission: stack.create", "error": "Forbidden", "statusCode": 403}`)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	client := immich.NewClient(server.URL, "key", false, false, false, false, false, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
+	require.NotNil(t, client)
+
+	err := runStackerOnce(client, logger, nil, nil, nil, nil)
+	require.Error(t, err)
+	assert.Equal(t, 1, modifyRequests, "the run stops at the first rejected request")
+	assert.Equal(t, exitConfigError, exitCode(err))
+	assert.Contains(t, err.Error(), "Missing required permission: stack.create")
+	assert.Contains(t, err.Error(), "asset.read, stack.create and stack.delete")
+}
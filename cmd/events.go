@@ -0,0 +1,233 @@
+/**************************************************************************************************
+** Machine-readable run events for the Immich CLI application.
+** With --events ndjson, every lifecycle event of a run is written to stdout as one JSON object
+** per line, while the logs go to stderr. The event structs are the stable schema of the output:
+** fields are only ever added.
+**************************************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/orchestrator"
+	"github.com/majorfi/immich-stack/pkg/stacker"
+)
+
+// Supported formats of the run events
+const eventsNDJSON = "ndjson"
+
+// Names of the run events
+const (
+	eventRunStart      = "run_start"
+	eventFetchPage     = "fetch_page"
+	eventGroupDone     = "group_done"
+	eventStackCreated  = "stack_created"
+	eventStackSkipped  = "stack_skipped"
+	eventStackFailed   = "stack_failed"
+	eventRunEnd        = "run_end"
+	eventCronIteration = "cron_iteration"
+)
+
+// Reasons of a stack_skipped event
+const (
+	skipReasonInvalid   = orchestrator.SkipInvalid
+	skipReasonUnchanged = orchestrator.SkipUnchanged
+	skipReasonStacked   = orchestrator.SkipStacked
+	skipReasonRejected  = orchestrator.SkipRejected
+	skipReasonOnlyNew   = orchestrator.SkipOnlyNew
+	skipReasonFiltered  = "stack holds filtered assets"
+)
+
+/**************************************************************************************************
+** eventHeader is the part shared by every event: its name and when it happened.
+**************************************************************************************************/
+type eventHeader struct {
+	Event string `json:"event"`
+	Time  string `json:"time"` // RFC3339, UTC
+}
+
+/**************************************************************************************************
+** runStartEvent is emitted when a run starts, before anything is fetched.
+**************************************************************************************************/
+type runStartEvent struct {
+	eventHeader
+	DryRun bool `json:"dryRun"`
+}
+
+/**************************************************************************************************
+** fetchPageEvent is emitted after each page of assets is fetched.
+**************************************************************************************************/
+type fetchPageEvent struct {
+	eventHeader
+	Page   int `json:"page"`
+	Assets int `json:"assets"`
+}
+
+/**************************************************************************************************
+** groupDoneEvent is emitted once the assets are grouped, with the stacks left to process.
+**************************************************************************************************/
+type groupDoneEvent struct {
+	eventHeader
+	Assets int `json:"assets"`
+	Stacks int `json:"stacks"`
+}
+
+/**************************************************************************************************
+** stackEvent is emitted for every stack processed: stack_created, stack_skipped with its reason
+** or stack_failed with its error. Branch names the part of the advanced criteria that produced
+** the key, Values the criteria values STACK_KEY_TEMPLATE rendered it from.
+**************************************************************************************************/
+type stackEvent struct {
+	eventHeader
+	Key      string   `json:"key"`
+	Branch   string   `json:"branch,omitempty"`
+	Values   []string `json:"values,omitempty"`
+	ParentID string   `json:"parentId"`
+	AssetIDs []string `json:"assetIds"`
+	Reason   string   `json:"reason,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+/**************************************************************************************************
+** runEndEvent is emitted when a run ends, with its summary. Deferred counts the assets left to a
+** later run by MIN_ASSET_AGE, Excluded those left out by EXCLUDE_EXTENSION, Sidecars the sidecar
+** files left out without INCLUDE_SIDECARS and Hidden the hidden and locked assets left out
+** without WITH_HIDDEN. Sampled is set when MAX_GROUPS left groups out, TotalGroups then counts
+** the groups before sampling. Error is set when the run stopped on an error or some stacks
+** failed. Version and CriteriaHash tell which build and which grouping ran.
+**************************************************************************************************/
+type runEndEvent struct {
+	eventHeader
+	Version      string `json:"version"`
+	CriteriaHash string `json:"criteriaHash"`
+	Stacks       int    `json:"stacks"`
+	Created      int    `json:"created"`
+	Skipped      int    `json:"skipped"`
+	Failed       int    `json:"failed"`
+	Deferred     int    `json:"deferred"`
+	Excluded     int    `json:"excluded"`
+	Sidecars     int    `json:"sidecars"`
+	Hidden       int    `json:"hidden"`
+	Sampled      bool   `json:"sampled,omitempty"`
+	TotalGroups  int    `json:"totalGroups,omitempty"`
+	DurationMs   int64  `json:"durationMs"`
+	Error        string `json:"error,omitempty"`
+}
+
+/**************************************************************************************************
+** cronIterationEvent is emitted at the end of each iteration of the cron loop, every user
+** included. Overrun tells whether the iteration took longer than the interval, OverrunsTotal
+** counts such iterations since the process started.
+**************************************************************************************************/
+type cronIterationEvent struct {
+	eventHeader
+	DurationMs      int64 `json:"durationMs"`
+	IntervalSeconds int   `json:"intervalSeconds"`
+	Overrun         bool  `json:"overrun"`
+	OverrunsTotal   int   `json:"overrunsTotal"`
+}
+
+/**************************************************************************************************
+** eventEmitter writes the run events as NDJSON. A nil emitter drops every event.
+**************************************************************************************************/
+type eventEmitter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+/**************************************************************************************************
+** Creates the event emitter of the run from the EVENTS setting.
+**
+** @param out - Writer of the events
+** @return *eventEmitter - The emitter, or nil when events are disabled
+**************************************************************************************************/
+func newEventEmitter(out io.Writer) *eventEmitter {
+	if eventsFormat != eventsNDJSON {
+		return nil
+	}
+	return &eventEmitter{encoder: json.NewEncoder(out)}
+}
+
+/**************************************************************************************************
+** Returns the writer of the console logs: stderr when the events or a JSON document take stdout,
+** stdout otherwise. The logger is configured before the settings are validated, so EVENTS is
+** read here as well.
+**
+** @return io.Writer - The console output of the logs
+**************************************************************************************************/
+func consoleOutput() io.Writer {
+	format := eventsFormat
+	if format == "" {
+		format = os.Getenv("EVENTS")
+	}
+	if format == eventsNDJSON || stdoutDocument {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+/**************************************************************************************************
+** Writes an event on its own line. An event that fails to encode is dropped.
+**
+** @param event - One of the event structs
+**************************************************************************************************/
+func (e *eventEmitter) emit(event interface{}) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_ = e.encoder.Encode(event)
+}
+
+/**************************************************************************************************
+** Returns the header of an event emitted now.
+**
+** @param name - Name of the event
+** @return eventHeader - The header
+**************************************************************************************************/
+func newEventHeader(name string) eventHeader {
+	return eventHeader{Event: name, Time: time.Now().UTC().Format(time.RFC3339)}
+}
+
+/**************************************************************************************************
+** Returns the hook of the client emitting a fetch_page event per page, or nil without events.
+**
+** @return func(int, int) - The page hook
+**************************************************************************************************/
+func (e *eventEmitter) pageHook() func(page int, assets int) {
+	if e == nil {
+		return nil
+	}
+	return func(page int, assets int) {
+		e.emit(fetchPageEvent{eventHeader: newEventHeader(eventFetchPage), Page: page, Assets: assets})
+	}
+}
+
+/**************************************************************************************************
+** Emits a stack event for the group about to be processed.
+**
+** @param name - stack_created, stack_skipped or stack_failed
+** @param group - The stack, for its grouping key, branch and values
+** @param assetIDs - IDs of the members, parent first
+** @param reason - Reason of a skipped stack
+** @param err - Error of a failed stack
+**************************************************************************************************/
+func (e *eventEmitter) stack(name string, group stacker.Stack, assetIDs []string, reason string, err error) {
+	if e == nil {
+		return
+	}
+	event := stackEvent{eventHeader: newEventHeader(name), Key: group.Key, Branch: group.Branch, Values: group.Values, AssetIDs: assetIDs, Reason: reason}
+	if len(assetIDs) > 0 {
+		event.ParentID = assetIDs[0]
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	e.emit(event)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/stacker"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the machine-readable run events
+************************************************************************************************/
+
+func TestRunEmitsEvents(t *testing.T) {
+	resetGlobalConfig()
+	defer resetGlobalConfig()
+	skipListFile = filepath.Join(t.TempDir(), "skip-list.json")
+	eventsFormat = eventsNDJSON
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/stacks":
+			// The second group is already stacked
+			fmt.Fprint(w, `[{"id": "s1", "primaryAssetId": "3", "assets": [{"id": "3"}, {"id": "4"}]}]`)
+		case "POST /api/search/metadata":
+			fmt.Fprint(w, `{"assets": {"items": [
+				{"id": "1", "originalFileName": "IMG_0001.JPG", "localDateTime": "2024-01-01T10:00:00Z"},
+				{"id": "2", "originalFileName": "IMG_0001.CR3", "localDateTime": "2024-01-01T10:00:00Z"},
+				{"id": "3", "originalFileName": "IMG_0002.JPG", "localDateTime": "2024-01-01T11:00:00Z"},
+				{"id": "4", "originalFileName": "IMG_0002.CR3", "localDateTime": "2024-01-01T11:00:00Z"},
+				{"id": "5", "originalFileName": "IMG_0003.JPG", "localDateTime": "2024-01-01T12:00:00Z"},
+				{"id": "6", "originalFileName": "IMG_0003.CR3", "localDateTime": "2024-01-01T12:00:00Z"}
+			], "nextPage": null}}`)
+		case "POST /api/stacks":
+			var body struct {
+				AssetIDs []string `json:"assetIds"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			if body.AssetIDs[0] == "5" {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			fmt.Fprint(w, `{}`)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	client := immich.NewClient(server.URL, "key", false, false, false, false, false, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
+	require.NotNil(t, client)
+
+	var out bytes.Buffer
+	err := runStackerOnce(client, logger, nil, nil, nil, newEventEmitter(&out))
+	require.Error(t, err, "the failed stack is a partial failure")
+
+	var names []string
+	var lines [][]byte
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var header eventHeader
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &header), "each line is a JSON object")
+		assert.NotEmpty(t, header.Time)
+		names = append(names, header.Event)
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+	}
+	require.Equal(t, []string{eventRunStart, eventFetchPage, eventGroupDone, eventStackCreated, eventStackSkipped, eventStackFailed, eventRunEnd}, names)
+
+	var start runStartEvent
+	require.NoError(t, json.Unmarshal(lines[0], &start))
+	assert.False(t, start.DryRun)
+
+	var page fetchPageEvent
+	require.NoError(t, json.Unmarshal(lines[1], &page))
+	assert.Equal(t, fetchPageEvent{eventHeader: page.eventHeader, Page: 1, Assets: 6}, page)
+
+	var grouped groupDoneEvent
+	require.NoError(t, json.Unmarshal(lines[2], &grouped))
+	assert.Equal(t, 6, grouped.Assets)
+	assert.Equal(t, 3, grouped.Stacks)
+
+	var created, skipped, failed stackEvent
+	require.NoError(t, json.Unmarshal(lines[3], &created))
+	require.NoError(t, json.Unmarshal(lines[4], &skipped))
+	require.NoError(t, json.Unmarshal(lines[5], &failed))
+	assert.Equal(t, "1", created.ParentID)
+	assert.Equal(t, []string{"1", "2"}, created.AssetIDs)
+	assert.NotEmpty(t, created.Key)
+	assert.Equal(t, skipReasonUnchanged, skipped.Reason)
+	assert.Equal(t, "5", failed.ParentID)
+	assert.NotEmpty(t, failed.Error)
+
+	var end runEndEvent
+	require.NoError(t, json.Unmarshal(lines[6], &end))
+	assert.Equal(t, 3, end.Stacks)
+	assert.Equal(t, 1, end.Created)
+	assert.Equal(t, 1, end.Skipped)
+	assert.Equal(t, 1, end.Failed)
+	assert.Contains(t, end.Error, "1 stack(s) failed to apply")
+	assert.Equal(t, "dev", end.Version)
+	assert.Equal(t, criteriaHash(), end.CriteriaHash)
+}
+
+func TestEventEmitterDisabled(t *testing.T) {
+	resetGlobalConfig()
+	defer resetGlobalConfig()
+
+	var out bytes.Buffer
+	events := newEventEmitter(&out)
+	assert.Nil(t, events)
+	events.emit(runStartEvent{eventHeader: newEventHeader(eventRunStart)})
+	events.stack(eventStackCreated, stacker.Stack{Key: "key"}, []string{"1"}, "", nil)
+	assert.Nil(t, events.pageHook())
+	assert.Empty(t, out.String())
+}
+
+func TestStackEventValues(t *testing.T) {
+	resetGlobalConfig()
+	defer resetGlobalConfig()
+	eventsFormat = eventsNDJSON
+
+	var out bytes.Buffer
+	events := newEventEmitter(&out)
+	events.stack(eventStackCreated, stacker.Stack{Key: "day=20230503", Values: []string{"20230503", "2023-05-03T15:28:00.000000000Z"}}, []string{"1", "2"}, "", nil)
+	events.stack(eventStackCreated, stacker.Stack{Key: "IMG_0001"}, []string{"3", "4"}, "", nil)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	var templated, plain map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &templated))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &plain))
+	assert.Equal(t, "day=20230503", templated["key"])
+	assert.Equal(t, []interface{}{"20230503", "2023-05-03T15:28:00.000000000Z"}, templated["values"])
+	assert.NotContains(t, plain, "values", "the values are only given with a stack key template")
+}
+
+func TestEventsEnvVarValidation(t *testing.T) {
+	resetGlobalConfig()
+	clearEnvironment()
+	defer resetGlobalConfig()
+	defer clearEnvironment()
+	os.Setenv("API_KEY", "key")
+	os.Setenv("EVENTS", "ndjson")
+
+	config := LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.Equal(t, eventsNDJSON, eventsFormat)
+	assert.Equal(t, os.Stderr, consoleOutput(), "the logs leave stdout to the events")
+
+	resetGlobalConfig()
+	os.Setenv("EVENTS", "xml")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "invalid EVENTS 'xml', expected ndjson")
+
+	resetGlobalConfig()
+	os.Setenv("EVENTS", "ndjson")
+	os.Setenv("INTERACTIVE", "true")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "EVENTS cannot be used with INTERACTIVE")
+}
@@ -0,0 +1,161 @@
+/**************************************************************************************************
+** Excluded extensions for the Immich CLI application.
+** EXCLUDE_EXTENSION keeps file types such as sidecars or screen recordings out of the stacks:
+** their assets are never grouped, and with REMOVE_EXCLUDED_FROM_STACKS the stacks holding one of
+** them are dissolved so their other members can be stacked again.
+**************************************************************************************************/
+
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/orchestrator"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+/**************************************************************************************************
+** Parses a comma-separated list of extensions, lowercased and with their leading dot, so .XMP,
+** xmp and .xmp are the same extension.
+**
+** @param list - Comma-separated extensions
+** @return []string - The extensions, nil when the list is empty
+**************************************************************************************************/
+func parseExtensionList(list string) []string {
+	var extensions []string
+	for _, extension := range splitList(list) {
+		extension = strings.ToLower(extension)
+		if !strings.HasPrefix(extension, ".") {
+			extension = "." + extension
+		}
+		extensions = append(extensions, extension)
+	}
+	return extensions
+}
+
+/**************************************************************************************************
+** Tells whether the extension of a filename is excluded, ignoring case.
+**
+** @param name - Original filename of the asset
+** @param extensions - Excluded extensions, as parsed by parseExtensionList
+** @return bool - True if the asset is excluded
+**************************************************************************************************/
+func hasExcludedExtension(name string, extensions []string) bool {
+	return len(extensions) > 0 && utils.Contains(extensions, strings.ToLower(path.Ext(name)))
+}
+
+/**************************************************************************************************
+** Leaves out the assets with an excluded extension before they are grouped.
+**
+** @param assets - Fetched assets
+** @param extensions - Excluded extensions
+** @return []utils.TAsset - The assets kept
+** @return int - Number of assets left out
+**************************************************************************************************/
+func dropExcludedExtensions(assets []utils.TAsset, extensions []string) ([]utils.TAsset, int) {
+	if len(extensions) == 0 {
+		return assets, 0
+	}
+	kept := make([]utils.TAsset, 0, len(assets))
+	for _, asset := range assets {
+		if !hasExcludedExtension(asset.OriginalFileName, extensions) {
+			kept = append(kept, asset)
+		}
+	}
+	return kept, len(assets) - len(kept)
+}
+
+/**************************************************************************************************
+** Returns the stacks without their members of an excluded extension, so a stack is compared to
+** the groups on its other members only and an excluded member never makes it look changed. A
+** stack whose primary asset is excluded gets its first remaining member as primary.
+**
+** @param existingStacks - Stacks fetched from Immich, by asset ID
+** @param extensions - Excluded extensions
+** @return map[string]utils.TStack - The stacks by asset ID, the excluded assets left out
+**************************************************************************************************/
+func withoutExcludedMembers(existingStacks map[string]utils.TStack, extensions []string) map[string]utils.TStack {
+	if len(extensions) == 0 {
+		return existingStacks
+	}
+	trimmed := make(map[string]utils.TStack, len(existingStacks))
+	for assetID, stack := range existingStacks {
+		members := make([]utils.TAsset, 0, len(stack.Assets))
+		primaryKept := false
+		for _, member := range stack.Assets {
+			if !hasExcludedExtension(member.OriginalFileName, extensions) {
+				members = append(members, member)
+				primaryKept = primaryKept || member.ID == stack.PrimaryAssetID
+			}
+		}
+		if len(members) == 0 {
+			continue
+		}
+		stack.Assets = members
+		if !primaryKept {
+			stack.PrimaryAssetID = members[0].ID
+		}
+		trimmed[assetID] = stack
+	}
+	return trimmed
+}
+
+/**************************************************************************************************
+** Dissolves the stacks holding an asset of an excluded extension, for REMOVE_EXCLUDED_FROM_STACKS.
+** Their members are unstacked for the rest of the run, so the other assets are grouped again
+** without the excluded ones, and the skip list forgets them as stacks of the tool.
+**
+** @param client - Immich client deleting the stacks
+** @param existingStacks - Stacks fetched from Immich, by asset ID
+** @param extensions - Excluded extensions
+** @param skipped - Skip list of the run (may be nil)
+** @param logger - Logger instance for output
+** @return map[string]utils.TStack - The stacks left, by asset ID
+** @return int - Number of stacks dissolved
+** @return error - An authentication error, which the following requests would hit as well
+**************************************************************************************************/
+func removeExcludedStacks(client immich.ImmichClient, existingStacks map[string]utils.TStack, extensions []string, skipped *skipList, logger *logrus.Logger) (map[string]utils.TStack, int, error) {
+	if len(extensions) == 0 {
+		return existingStacks, 0, nil
+	}
+	dissolved := make(map[string]bool)
+	for _, stack := range existingStacks {
+		if dissolved[stack.ID] {
+			continue
+		}
+		excluded := false
+		for _, member := range stack.Assets {
+			excluded = excluded || hasExcludedExtension(member.OriginalFileName, extensions)
+		}
+		if !excluded {
+			continue
+		}
+		if err := client.DeleteStack(stack.ID, utils.REASON_REMOVE_EXCLUDED_EXTENSION); err != nil {
+			if immich.IsAuthError(err) {
+				return existingStacks, len(dissolved), err
+			}
+			logger.Errorf("Error dissolving stack %s: %v", stack.ID, orchestrator.DecorateMutationError(orchestrator.MutationDelete, "", orchestrator.StackParent(stack), stack.Assets, err))
+			continue
+		}
+		dissolved[stack.ID] = true
+		memberIDs := make([]string, 0, len(stack.Assets))
+		for _, member := range stack.Assets {
+			memberIDs = append(memberIDs, member.ID)
+		}
+		skipped.forgetCreated(memberIDs)
+	}
+	if len(dissolved) == 0 {
+		return existingStacks, 0, nil
+	}
+
+	kept := make(map[string]utils.TStack, len(existingStacks))
+	for assetID, stack := range existingStacks {
+		if !dissolved[stack.ID] {
+			kept[assetID] = stack
+		}
+	}
+	return kept, len(dissolved), nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExcludedExtensions(t *testing.T) {
+	extensions := parseExtensionList(" .XMP, gif,,.Mp4 ")
+	assert.Equal(t, []string{".xmp", ".gif", ".mp4"}, extensions)
+	assert.Nil(t, parseExtensionList(""))
+
+	assert.True(t, hasExcludedExtension("IMG_0001.JPG.xmp", extensions))
+	assert.True(t, hasExcludedExtension("Screen Recording.MP4", extensions))
+	assert.False(t, hasExcludedExtension("IMG_0001.JPG", extensions))
+	assert.False(t, hasExcludedExtension("xmp", extensions), "an extension, not a suffix")
+	assert.False(t, hasExcludedExtension("IMG_0001.xmp", nil))
+
+	kept, excluded := dropExcludedExtensions([]utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG"},
+		{ID: "2", OriginalFileName: "IMG_0001.XMP"},
+		{ID: "3", OriginalFileName: "IMG_0002.gif"},
+	}, extensions)
+	assert.Equal(t, 2, excluded)
+	require.Len(t, kept, 1)
+	assert.Equal(t, "1", kept[0].ID)
+}
+
+func TestWithoutExcludedMembers(t *testing.T) {
+	sidecar := utils.TStack{ID: "s1", PrimaryAssetID: "2", Assets: []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG"},
+		{ID: "2", OriginalFileName: "IMG_0001.XMP"},
+		{ID: "3", OriginalFileName: "IMG_0001.DNG"},
+	}}
+	only := utils.TStack{ID: "s2", PrimaryAssetID: "4", Assets: []utils.TAsset{{ID: "4", OriginalFileName: "a.xmp"}, {ID: "5", OriginalFileName: "b.xmp"}}}
+	stacks := map[string]utils.TStack{"1": sidecar, "2": sidecar, "3": sidecar, "4": only, "5": only}
+
+	assert.Equal(t, stacks, withoutExcludedMembers(stacks, nil))
+	trimmed := withoutExcludedMembers(stacks, []string{".xmp"})
+	assert.Len(t, trimmed, 3, "the excluded assets and the stacks left empty are dropped")
+	assert.Equal(t, "1", trimmed["1"].PrimaryAssetID, "an excluded primary is replaced")
+	assert.Len(t, trimmed["3"].Assets, 2)
+	assert.Len(t, stacks["1"].Assets, 3, "the fetched stacks are left as is")
+}
+
+func TestRemoveExcludedStacks(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	sidecar := utils.TStack{ID: "s1", PrimaryAssetID: "1", Assets: []utils.TAsset{{ID: "1", OriginalFileName: "IMG_0001.JPG"}, {ID: "2", OriginalFileName: "IMG_0001.XMP"}}}
+	clean := utils.TStack{ID: "s2", PrimaryAssetID: "3", Assets: []utils.TAsset{{ID: "3", OriginalFileName: "IMG_0002.JPG"}, {ID: "4", OriginalFileName: "IMG_0002.DNG"}}}
+	client := &fakeClient{}
+	skipped := &skipList{created: [][]string{{"1", "2"}, {"3", "4"}}}
+
+	kept, dissolved, err := removeExcludedStacks(client, map[string]utils.TStack{"1": sidecar, "2": sidecar, "3": clean, "4": clean}, []string{".xmp"}, skipped, logger)
+	require.NoError(t, err)
+	assert.Equal(t, 1, dissolved)
+	assert.Equal(t, []string{"s1"}, client.deleted)
+	assert.Equal(t, map[string]utils.TStack{"3": clean, "4": clean}, kept)
+	assert.Equal(t, [][]string{{"3", "4"}}, skipped.created, "the dissolved stack is not taken as deleted by hand")
+}
+
+func TestExcludeExtensionEnvVar(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("EXCLUDE_EXTENSION", "xmp,.GIF")
+	os.Setenv("REMOVE_EXCLUDED_FROM_STACKS", "true")
+
+	config := LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.Equal(t, []string{".xmp", ".gif"}, excludedExtensions)
+	assert.True(t, removeExcludedFromStacks)
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("REMOVE_EXCLUDED_FROM_STACKS", "true")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "REMOVE_EXCLUDED_FROM_STACKS requires EXCLUDE_EXTENSION")
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("EXCLUDE_EXTENSION", "xmp")
+	os.Setenv("REMOVE_EXCLUDED_FROM_STACKS", "true")
+	os.Setenv("ONLY_NEW_STACKS", "true")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "ONLY_NEW_STACKS cannot be combined with REMOVE_EXCLUDED_FROM_STACKS")
+}
+
+func TestRunStackerOnceExcludeExtension(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+	excludedExtensions = []string{".xmp"}
+
+	single := utils.TStack{ID: "s1", PrimaryAssetID: "1", Assets: []utils.TAsset{{ID: "1", OriginalFileName: "IMG_0001.JPG"}, {ID: "2", OriginalFileName: "IMG_0001.XMP"}}}
+	pair := utils.TStack{ID: "s2", PrimaryAssetID: "3", Assets: []utils.TAsset{{ID: "3", OriginalFileName: "IMG_0002.JPG"}, {ID: "4", OriginalFileName: "IMG_0002.DNG"}, {ID: "5", OriginalFileName: "IMG_0002.xmp"}}}
+	newClient := func() *fakeClient {
+		return &fakeClient{
+			stacks: map[string]utils.TStack{"1": single, "2": single, "3": pair, "4": pair, "5": pair},
+			assets: []utils.TAsset{
+				{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+				{ID: "2", OriginalFileName: "IMG_0001.XMP", LocalDateTime: "2024-01-01T10:00:00Z"},
+				{ID: "3", OriginalFileName: "IMG_0002.JPG", LocalDateTime: "2024-01-01T11:00:00Z"},
+				{ID: "4", OriginalFileName: "IMG_0002.DNG", LocalDateTime: "2024-01-01T11:00:00Z"},
+				{ID: "5", OriginalFileName: "IMG_0002.xmp", LocalDateTime: "2024-01-01T11:00:00Z"},
+			},
+		}
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	// The excluded members do not make a stack look changed
+	client := newClient()
+	require.NoError(t, runStackerOnce(client, logger, &runProgress{}, nil, nil, nil))
+	assert.Empty(t, client.created)
+	assert.Empty(t, client.deleted)
+
+	// Dissolving every stack is above MAX_DELETE_FRACTION, nothing is deleted
+	removeExcludedFromStacks = true
+	client = newClient()
+	err := runStackerOnce(client, logger, &runProgress{}, nil, nil, nil)
+	assert.ErrorContains(t, err, "the run would delete 2 of the 2 existing stacks")
+	assert.Empty(t, client.deleted)
+
+	// They are cleaned up, and the other members stacked again
+	forceDelete = true
+	client = newClient()
+	require.NoError(t, runStackerOnce(client, logger, &runProgress{}, nil, nil, nil))
+	sort.Strings(client.deleted)
+	assert.Equal(t, []string{"s1", "s2"}, client.deleted)
+	assert.Equal(t, [][]string{{"3", "4"}}, client.created)
+}
+
+func TestRunStackerOnceSidecars(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+
+	stacked := utils.TStack{ID: "s1", PrimaryAssetID: "1", Assets: []utils.TAsset{{ID: "1", OriginalFileName: "IMG_0001.JPG"}, {ID: "2", OriginalFileName: "IMG_0001.DNG"}, {ID: "3", OriginalFileName: "IMG_0001.JPG.json"}}}
+	newClient := func() *fakeClient {
+		return &fakeClient{
+			stacks: map[string]utils.TStack{"1": stacked, "2": stacked, "3": stacked},
+			assets: []utils.TAsset{
+				{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+				{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+				{ID: "3", OriginalFileName: "IMG_0001.JPG.json", LocalDateTime: "2024-01-01T10:00:00Z"},
+				{ID: "4", OriginalFileName: "IMG_0002.JPG", LocalDateTime: "2024-01-01T11:00:00Z"},
+				{ID: "5", OriginalFileName: "IMG_0002.xmp", LocalDateTime: "2024-01-01T11:00:00Z"},
+				{ID: "6", OriginalFileName: "IMG_0002.AAE", LocalDateTime: "2024-01-01T11:00:00Z"},
+			},
+		}
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	// Left out by default, a sidecar in an existing stack does not make it look changed
+	client := newClient()
+	require.NoError(t, runStackerOnce(client, logger, &runProgress{}, nil, nil, nil))
+	assert.Empty(t, client.created)
+	assert.Empty(t, client.deleted)
+
+	// Included, they are grouped but never the parent
+	includeSidecars = true
+	parentExtPromote = ".xmp,.aae,.jpg"
+	client = newClient()
+	require.NoError(t, runStackerOnce(client, logger, &runProgress{}, nil, nil, nil))
+	require.Len(t, client.created, 1)
+	assert.Equal(t, "4", client.created[0][0])
+	assert.ElementsMatch(t, []string{"4", "5", "6"}, client.created[0])
+}
+
+func TestIncludeSidecarsEnvVar(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	config := LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.False(t, includeSidecars, "sidecars are left out by default")
+
+	os.Setenv("INCLUDE_SIDECARS", "true")
+	config = LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.True(t, includeSidecars)
+}
+
+func TestSkipIncompleteAssetsEnvVar(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	CreateRootCommand()
+	config := LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.True(t, skipIncompleteAssets, "the assets still uploading are skipped by default")
+
+	os.Setenv("SKIP_INCOMPLETE_ASSETS", "false")
+	config = LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.False(t, skipIncompleteAssets)
+}
@@ -6,11 +6,13 @@
 package main
 
 import (
+	"fmt"
 	"io"
-	"path/filepath"
+	"path"
 	"strings"
 
 	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/orchestrator"
 	"github.com/majorfi/immich-stack/pkg/stacker"
 	"github.com/majorfi/immich-stack/pkg/utils"
 	"github.com/sirupsen/logrus"
@@ -23,9 +25,13 @@ import (
 **
 ** @param cmd - Cobra command instance
 ** @param args - Command line arguments
+** @return error - Categorized error mapped to the exit code by main, or nil
 **************************************************************************************************/
-func runFixTrash(cmd *cobra.Command, args []string) {
-	logger := loadEnv()
+func runFixTrash(cmd *cobra.Command, args []string) error {
+	logger, err := loadEnv()
+	if err != nil {
+		return err
+	}
 
 	/**********************************************************************************************
 	** Warn if filter flags are set (they have no effect on this command).
@@ -35,34 +41,39 @@ func runFixTrash(cmd *cobra.Command, args []string) {
 	}
 
 	/**********************************************************************************************
-	** Support multiple API keys (comma-separated).
+	** Support multiple API keys (comma-separated), each with its server.
 	**********************************************************************************************/
-	apiKeys := utils.RemoveEmptyStrings(func(keys []string) []string {
-		for i, key := range keys {
-			keys[i] = strings.TrimSpace(key)
-		}
-		return keys
-	}(strings.Split(apiKey, ",")))
-	if len(apiKeys) == 0 {
-		logger.Fatalf("No API key(s) provided.")
+	targets, err := apiTargets()
+	if err != nil {
+		return err
 	}
 
-	for i, key := range apiKeys {
+	var runErr error
+	for i, target := range targets {
 		if i > 0 {
 			logger.Infof("\n")
 		}
-		client := immich.NewClient(apiURL, key, false, false, dryRun, withArchived, withDeleted, false, nil, "", "", logger)
+		client := immich.NewClient(target.URL, target.Key, false, false, dryRun, withArchived, withDeleted, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
 		if client == nil {
-			logger.Errorf("Invalid client for API key: %s", key)
+			logger.Errorf("Invalid client for API key: %s", target.Key)
+			runErr = worstError(runErr, configError(fmt.Errorf("invalid client for API key: %s", target.Key)))
+			continue
+		}
+		setProxyAuth(client)
+		client.SetOnlyNewStacks(onlyNewStacks)
+		if err := client.CheckAPIURL(strictURL); err != nil {
+			logger.Errorf("Invalid API_URL for API key: %s: %v", target.Key, err)
+			runErr = worstError(runErr, configError(err))
 			continue
 		}
 		user, err := client.GetCurrentUser()
 		if err != nil {
-			logger.Errorf("Failed to fetch user for API key: %s: %v", key, err)
+			logger.Errorf("Failed to fetch user for API key: %s: %v", target.Key, err)
+			runErr = worstError(runErr, fatalError(fmt.Errorf("failed to fetch user: %w", err)))
 			continue
 		}
 		logger.Infof("=====================================================================================")
-		logger.Infof("Fixing trash for user: %s (%s)", user.Name, user.Email)
+		logger.Infof("Fixing trash for user: %s (%s) on %s", user.Name, user.Email, target.host())
 		logger.Infof("=====================================================================================")
 
 		/**********************************************************************************************
@@ -71,6 +82,7 @@ func runFixTrash(cmd *cobra.Command, args []string) {
 		trashedAssets, err := client.FetchTrashedAssets(1000)
 		if err != nil {
 			logger.Errorf("Error fetching trashed assets: %v", err)
+			runErr = worstError(runErr, fatalError(fmt.Errorf("error fetching trashed assets: %w", err)))
 			continue
 		}
 
@@ -84,12 +96,14 @@ func runFixTrash(cmd *cobra.Command, args []string) {
 		existingStacks, err := client.FetchAllStacks()
 		if err != nil {
 			logger.Errorf("Error fetching stacks: %v", err)
+			runErr = worstError(runErr, fatalError(fmt.Errorf("error fetching stacks: %w", err)))
 			continue
 		}
 
-		allAssets, err := client.FetchAssets(1000, existingStacks)
+		allAssets, err := client.SearchAssets(1000, existingStacks)
 		if err != nil {
 			logger.Errorf("Error fetching all assets: %v", err)
+			runErr = worstError(runErr, fatalError(fmt.Errorf("error fetching all assets: %w", err)))
 			continue
 		}
 
@@ -250,7 +264,7 @@ func runFixTrash(cmd *cobra.Command, args []string) {
 		assetsByBaseName := make(map[string][]utils.TAsset)
 		for _, asset := range activeAssets {
 			// Get base filename without extension
-			baseName := strings.TrimSuffix(asset.OriginalFileName, filepath.Ext(asset.OriginalFileName))
+			baseName := strings.TrimSuffix(asset.OriginalFileName, path.Ext(asset.OriginalFileName))
 			// Also handle files with multiple extensions like .edit.jpg
 			if strings.Contains(baseName, ".") {
 				// Keep everything before the last dot sequence
@@ -278,7 +292,7 @@ func runFixTrash(cmd *cobra.Command, args []string) {
 			// Find all assets in the same stack
 			for _, asset := range activeAssets {
 				if asset.Stack != nil && asset.Stack.ID == dngAsset.Stack.ID && asset.ID != dngAsset.ID {
-					ext := strings.ToLower(filepath.Ext(asset.OriginalFileName))
+					ext := strings.ToLower(path.Ext(asset.OriginalFileName))
 					if ext == ".jpg" || ext == ".jpeg" {
 						// This DNG is in a stack that already has a JPG
 						return true
@@ -296,7 +310,7 @@ func runFixTrash(cmd *cobra.Command, args []string) {
 			var dngAsset utils.TAsset
 
 			for _, asset := range assets {
-				ext := strings.ToLower(filepath.Ext(asset.OriginalFileName))
+				ext := strings.ToLower(path.Ext(asset.OriginalFileName))
 				if ext == ".dng" {
 					hasDNG = true
 					dngAsset = asset
@@ -378,13 +392,15 @@ func runFixTrash(cmd *cobra.Command, args []string) {
 			}
 		}
 
+		trashed := make([]utils.TAsset, 0, len(assetsToTrash))
 		for _, asset := range assetsToTrash {
-			ext := filepath.Ext(asset.OriginalFileName)
+			ext := path.Ext(asset.OriginalFileName)
 			if ext == "" {
 				ext = "(no extension)"
 			}
 			extensionCount[ext]++
 			assetIDs = append(assetIDs, asset.ID)
+			trashed = append(trashed, asset)
 		}
 
 		// Show summary by file type
@@ -396,7 +412,10 @@ func runFixTrash(cmd *cobra.Command, args []string) {
 		}
 
 		if err := client.TrashAssets(assetIDs); err != nil {
+			err = orchestrator.DecorateMutationError(orchestrator.MutationTrash, "", utils.TAsset{}, trashed, err)
 			logger.Errorf("Error moving assets to trash: %v", err)
+			runErr = worstError(runErr, partialFailure(fmt.Errorf("error moving assets to trash: %w", err)))
 		}
 	}
+	return runErr
 }
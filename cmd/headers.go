@@ -0,0 +1,75 @@
+/**************************************************************************************************
+** Reverse proxy headers of the Immich CLI application.
+** An Immich behind an authenticating proxy may need a header of its own, or basic auth, besides
+** the API key. The repeatable --header flag, or EXTRA_HEADERS, adds headers to every request, and
+** BASIC_AUTH_USER and BASIC_AUTH_PASS the credentials of the proxy. Like the API key, their
+** values are never logged.
+**************************************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+)
+
+/**************************************************************************************************
+** parseExtraHeaders parses the extra headers, "Name: value", of the --header flags or of the
+** JSON object of EXTRA_HEADERS. The API key header is refused, as the client always sets it from
+** API_KEY.
+**
+** @param values - The headers, "Name: value"
+** @return map[string]string - Header values by canonical name, nil for none
+** @return error - An error if a header cannot be parsed
+**************************************************************************************************/
+func parseExtraHeaders(values []string) (map[string]string, error) {
+	var headers map[string]string
+	for _, header := range values {
+		name, value, found := strings.Cut(header, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid --header: must be \"Name: value\"")
+		}
+		name = strings.TrimSpace(name)
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		if strings.EqualFold(name, "x-api-key") {
+			return nil, fmt.Errorf("the x-api-key header is set from API_KEY")
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[http.CanonicalHeaderKey(name)] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+/**************************************************************************************************
+** headerNames returns the names of the extra headers, sorted, for the startup summary, which
+** leaves their values out.
+**
+** @param headers - Header values by name
+** @return []string - The names
+**************************************************************************************************/
+func headerNames(headers map[string]string) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/**************************************************************************************************
+** setProxyAuth passes the extra headers and the basic auth credentials to a client.
+**
+** @param client - Client of a target
+**************************************************************************************************/
+func setProxyAuth(client *immich.Client) {
+	client.SetExtraHeaders(extraHeaders)
+	client.SetBasicAuth(basicAuthUser, basicAuthPass)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExtraHeaders(t *testing.T) {
+	headers, err := parseExtraHeaders([]string{"remote-user: alice", "X-Proxy-Token: a:b", "X-Empty:"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"Remote-User": "alice", "X-Proxy-Token": "a:b", "X-Empty": ""}, headers)
+
+	headers, err = parseExtraHeaders(nil)
+	require.NoError(t, err)
+	assert.Nil(t, headers)
+
+	_, err = parseExtraHeaders([]string{"X-Api-Key: other"})
+	assert.ErrorContains(t, err, "the x-api-key header is set from API_KEY")
+	_, err = parseExtraHeaders([]string{"X-Proxy-Token secret"})
+	assert.EqualError(t, err, `invalid --header: must be "Name: value"`, "the value is not echoed")
+	_, err = parseExtraHeaders([]string{"X Proxy: secret"})
+	assert.ErrorContains(t, err, `invalid header name "X Proxy"`)
+}
+
+func TestExtraHeadersEnvVars(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("EXTRA_HEADERS", `{"X-Proxy-Token": "s3cret-token"}`)
+	os.Setenv("BASIC_AUTH_USER", "proxy")
+	os.Setenv("BASIC_AUTH_PASS", "s3cret-pass")
+	config := LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.Equal(t, map[string]string{"X-Proxy-Token": "s3cret-token"}, extraHeaders)
+	assert.Equal(t, "proxy", basicAuthUser)
+	assert.Equal(t, "s3cret-pass", basicAuthPass)
+
+	for _, format := range []string{"text", "json"} {
+		os.Setenv("LOG_FORMAT", format)
+		var buf bytes.Buffer
+		config.Logger.SetOutput(&buf)
+		logStartupSummary(config.Logger)
+		assert.Contains(t, buf.String(), "X-Proxy-Token")
+		assert.NotContains(t, buf.String(), "s3cret", "the values are redacted like the API key")
+	}
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("EXTRA_HEADERS", `["X-Proxy-Token"]`)
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "invalid EXTRA_HEADERS: must be a JSON object")
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("BASIC_AUTH_PASS", "s3cret-pass")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "BASIC_AUTH_PASS is set without BASIC_AUTH_USER")
+}
@@ -0,0 +1,114 @@
+/**************************************************************************************************
+** Machine-readable help of the Immich CLI application.
+** The hidden --help-json flag of the root command prints every command and flag, with its type,
+** its default and the environment variable of its option, as JSON for the tools wrapping the CLI.
+**************************************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// helpJSON prints the commands and flags as JSON instead of running the stacker
+var helpJSON bool
+
+/**************************************************************************************************
+** helpFlag is a flag of the JSON help. Env is empty for a flag without environment variable,
+** such as the flags of the subcommands.
+**************************************************************************************************/
+type helpFlag struct {
+	Name       string `json:"name"`
+	Shorthand  string `json:"shorthand,omitempty"`
+	Type       string `json:"type"`
+	Default    string `json:"default"`
+	Usage      string `json:"usage"`
+	Env        string `json:"env,omitempty"`
+	Persistent bool   `json:"persistent"`
+}
+
+/**************************************************************************************************
+** helpCommand is a command of the JSON help, with the flags it defines and its subcommands. The
+** persistent flags of the root command apply to every command.
+**************************************************************************************************/
+type helpCommand struct {
+	Name     string        `json:"name"`
+	Path     string        `json:"path"`
+	Short    string        `json:"short"`
+	Flags    []helpFlag    `json:"flags"`
+	Commands []helpCommand `json:"commands"`
+}
+
+/**************************************************************************************************
+** flagEnv returns the environment variable a flag is annotated with.
+**
+** @param f - The flag
+** @return string - Name of the environment variable, empty for none
+**************************************************************************************************/
+func flagEnv(f *pflag.Flag) string {
+	if env := f.Annotations[envAnnotation]; len(env) > 0 {
+		return env[0]
+	}
+	return ""
+}
+
+/**************************************************************************************************
+** describeCommand builds the JSON help of a command and its available subcommands, sorted by
+** name. Hidden commands and flags are left out.
+**
+** @param cmd - The command
+** @return helpCommand - Its JSON help
+**************************************************************************************************/
+func describeCommand(cmd *cobra.Command) helpCommand {
+	help := helpCommand{
+		Name:     cmd.Name(),
+		Path:     cmd.CommandPath(),
+		Short:    cmd.Short,
+		Flags:    []helpFlag{},
+		Commands: []helpCommand{},
+	}
+	persistent := cmd.PersistentFlags()
+	cmd.NonInheritedFlags().VisitAll(func(f *pflag.Flag) {
+		if f.Hidden || f.Name == "help" {
+			return
+		}
+		help.Flags = append(help.Flags, helpFlag{
+			Name:       f.Name,
+			Shorthand:  f.Shorthand,
+			Type:       f.Value.Type(),
+			Default:    f.DefValue,
+			Usage:      f.Usage,
+			Env:        flagEnv(f),
+			Persistent: persistent.Lookup(f.Name) != nil,
+		})
+	})
+	for _, sub := range cmd.Commands() {
+		if sub.IsAvailableCommand() {
+			help.Commands = append(help.Commands, describeCommand(sub))
+		}
+	}
+	return help
+}
+
+/**************************************************************************************************
+** runRoot runs the stacker, or prints the JSON help of every command with --help-json, which
+** needs no API key.
+**
+** @param cmd - Root command
+** @param args - Command line arguments
+** @return error - Categorized error mapped to the exit code by main, or nil
+**************************************************************************************************/
+func runRoot(cmd *cobra.Command, args []string) error {
+	if !helpJSON {
+		return runStacker(cmd, args)
+	}
+	encoder := json.NewEncoder(cmd.OutOrStdout())
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(describeCommand(cmd.Root())); err != nil {
+		return fatalError(err)
+	}
+	return nil
+}
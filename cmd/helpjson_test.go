@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHelpJSON(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	defer func() { helpJSON = false }()
+
+	var out bytes.Buffer
+	cmd := CreateRootCommand()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"--help-json"})
+	require.NoError(t, cmd.Execute(), "no API key is needed")
+
+	var help helpCommand
+	require.NoError(t, json.Unmarshal(out.Bytes(), &help))
+	assert.Equal(t, "immich-stack", help.Path)
+	flags := make(map[string]helpFlag)
+	for _, flag := range help.Flags {
+		flags[flag.Name] = flag
+	}
+	assert.Equal(t, helpFlag{Name: "dry-run", Type: "bool", Default: "false", Usage: flags["dry-run"].Usage, Env: "DRY_RUN", Persistent: true}, flags["dry-run"])
+	assert.Equal(t, "EXTRA_HEADERS", flags["header"].Env)
+	assert.Equal(t, "OTEL_EXPORTER_OTLP_ENDPOINT", flags["otlp-endpoint"].Env)
+	assert.Equal(t, "stringArray", flags["filter-regex"].Type)
+	assert.NotContains(t, flags, "help-json", "the flag is hidden")
+	assert.NotContains(t, flags, "help")
+
+	commands := make(map[string]helpCommand)
+	for _, sub := range help.Commands {
+		commands[sub.Name] = sub
+	}
+	assert.NotContains(t, commands, "help")
+	require.Contains(t, commands, "stats")
+	require.Len(t, commands["stats"].Flags, 1)
+	assert.Equal(t, helpFlag{Name: "output", Type: "string", Default: "text", Usage: "Output format: text, json"}, commands["stats"].Flags[0], "a subcommand flag has no environment variable")
+	require.Contains(t, commands, "audit")
+	require.Len(t, commands["audit"].Commands, 1)
+	assert.Equal(t, "immich-stack audit show", commands["audit"].Commands[0].Path)
+}
+
+func TestCompletionCommand(t *testing.T) {
+	for shell, want := range map[string]string{
+		"bash": "# bash completion V2 for immich-stack",
+		"zsh":  "#compdef immich-stack",
+		"fish": "# fish completion for immich-stack",
+	} {
+		var out bytes.Buffer
+		cmd := CreateRootCommand()
+		cmd.SetOut(&out)
+		cmd.SetArgs([]string{"completion", shell})
+		require.NoError(t, cmd.Execute(), shell)
+		assert.Contains(t, out.String(), want)
+	}
+}
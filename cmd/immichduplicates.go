@@ -0,0 +1,53 @@
+/**************************************************************************************************
+** Stacking from the duplicate detection of Immich for the Immich CLI application.
+** With FROM_IMMICH_DUPLICATES, each group of assets Immich found alike is a stack, its parent
+** picked by the promote rules, instead of the groups made by the criteria.
+**************************************************************************************************/
+
+package main
+
+import (
+	"github.com/majorfi/immich-stack/pkg/utils"
+)
+
+/**************************************************************************************************
+** Returns the assets of the duplicate groups with their current stacks, so the usual checks of
+** the run apply, and the group of each asset, keyed by duplicate=<duplicate ID>.
+**
+** @param duplicates - Duplicate groups fetched from Immich
+** @param existingStacks - Stacks fetched from Immich, by asset ID
+** @return []utils.TAsset - The assets of every group
+** @return map[string]string - Key of the group of each asset, by asset ID
+**************************************************************************************************/
+func duplicateAssets(duplicates []utils.TDuplicateGroup, existingStacks map[string]utils.TStack) ([]utils.TAsset, map[string]string) {
+	var assets []utils.TAsset
+	groupOf := make(map[string]string)
+	for _, group := range duplicates {
+		for _, asset := range group.Assets {
+			if _, seen := groupOf[asset.ID]; seen {
+				continue
+			}
+			if stack, ok := existingStacks[asset.ID]; ok {
+				asset.Stack = &stack
+			}
+			groupOf[asset.ID] = "duplicate=" + group.DuplicateID
+			assets = append(assets, asset)
+		}
+	}
+	return assets, groupOf
+}
+
+/**************************************************************************************************
+** Gathers the assets kept after the filters back into their duplicate groups.
+**
+** @param assets - The assets kept
+** @param groupOf - Key of the group of each asset, by asset ID
+** @return map[string][]utils.TAsset - Members of each group, by key
+**************************************************************************************************/
+func groupDuplicates(assets []utils.TAsset, groupOf map[string]string) map[string][]utils.TAsset {
+	groups := make(map[string][]utils.TAsset)
+	for _, asset := range assets {
+		groups[groupOf[asset.ID]] = append(groups[groupOf[asset.ID]], asset)
+	}
+	return groups
+}
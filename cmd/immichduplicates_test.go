@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuplicateAssets(t *testing.T) {
+	stack := utils.TStack{ID: "s1", PrimaryAssetID: "1", Assets: []utils.TAsset{{ID: "1"}, {ID: "2"}}}
+	duplicates := []utils.TDuplicateGroup{
+		{DuplicateID: "d1", Assets: []utils.TAsset{{ID: "1"}, {ID: "2"}, {ID: "3"}}},
+		{DuplicateID: "d2", Assets: []utils.TAsset{{ID: "4"}, {ID: "3"}}},
+	}
+
+	assets, groupOf := duplicateAssets(duplicates, map[string]utils.TStack{"1": stack, "2": stack})
+	require.Len(t, assets, 4, "an asset is only taken in its first group")
+	assert.Equal(t, "s1", assets[0].Stack.ID)
+	assert.Nil(t, assets[2].Stack)
+	assert.Equal(t, map[string]string{"1": "duplicate=d1", "2": "duplicate=d1", "3": "duplicate=d1", "4": "duplicate=d2"}, groupOf)
+
+	groups := groupDuplicates(assets[1:], groupOf)
+	assert.Len(t, groups["duplicate=d1"], 2)
+	assert.Len(t, groups["duplicate=d2"], 1)
+}
+
+func TestRunStackerOnceFromImmichDuplicates(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+	fromImmichDuplicates = true
+	parentFilenamePromote = "edit"
+
+	client := &fakeClient{
+		// Grouped by the criteria, these would make no stack
+		assets: []utils.TAsset{
+			{ID: "1", OriginalFileName: "beach.jpg", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "2", OriginalFileName: "beach_edit.jpg", LocalDateTime: "2024-02-01T10:00:00Z"},
+		},
+		duplicates: []utils.TDuplicateGroup{
+			{DuplicateID: "d1", Assets: []utils.TAsset{
+				{ID: "1", OriginalFileName: "beach.jpg", OwnerID: "owner"},
+				{ID: "2", OriginalFileName: "beach_edit.jpg", OwnerID: "owner"},
+				{ID: "3", OriginalFileName: "copy.jpg", OwnerID: "partner"},
+				{ID: "6", OriginalFileName: "beach_small.jpg", OwnerID: "owner"},
+			}},
+			{DuplicateID: "d2", Assets: []utils.TAsset{
+				{ID: "4", OriginalFileName: "IMG_0001.jpg", OwnerID: "owner"},
+				{ID: "5", OriginalFileName: "IMG_0002.jpg", OwnerID: "partner"},
+			}},
+		},
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	require.NoError(t, runStackerOnce(client, logger, &runProgress{}, nil, nil, nil))
+	assert.Equal(t, [][]string{{"2", "1", "6"}}, client.created, "the partner assets are left out and the promote rules pick the parent")
+
+	// A group above the size accepted by the server is skipped
+	serverMaxStackSize = 2
+	client.created = nil
+	require.NoError(t, runStackerOnce(client, logger, &runProgress{}, nil, nil, nil))
+	assert.Empty(t, client.created)
+}
+
+func TestFromImmichDuplicatesEnvVar(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("FROM_IMMICH_DUPLICATES", "true")
+
+	config := LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.True(t, fromImmichDuplicates)
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("FROM_IMMICH_DUPLICATES", "true")
+	os.Setenv("ASSETS_FROM_FILE", "assets.txt")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "FROM_IMMICH_DUPLICATES cannot be combined with ASSETS_FROM_FILE")
+}
@@ -0,0 +1,303 @@
+/**************************************************************************************************
+** Replacement journal for the Immich CLI application.
+** When a stack is replaced, Immich takes the members out of their old stacks as the new one is
+** created, so the new stack is created first and the old stacks deleted after. An old stack
+** whose parent is a member would be merged into the new one with all its assets, it has to be
+** deleted first: a run interrupted in between would leave the members unstacked. Such a
+** replacement is recorded in the skip list file before anything is deleted, so the next run or
+** the repair command completes it, or rolls it back to the old stacks.
+**************************************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/orchestrator"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// repairRollback restores the old stacks instead of completing the new ones
+var repairRollback bool
+
+// journalStack is an old stack deleted by a replacement, as the orchestrator reports it
+type journalStack = orchestrator.ReplacedStack
+
+/**************************************************************************************************
+** journalEntry is a stack replacement started and not completed yet: the new stack to create
+** and the old stacks deleted before it. Owner is the user of the assets, so a run of another
+** user leaves the entry alone.
+**************************************************************************************************/
+type journalEntry struct {
+	Key      string         `json:"key"`
+	Owner    string         `json:"owner,omitempty"`
+	AssetIDs []string       `json:"assetIds"` // Members of the new stack, parent first
+	Replaced []journalStack `json:"replaced"`
+	Started  string         `json:"started"` // RFC3339, UTC
+}
+
+/**************************************************************************************************
+** beginReplace records a replacement before its old stacks are deleted and saves the skip list
+** right away, so it survives a crash.
+**
+** @param entry - The replacement about to start
+** @return error - An error if the skip list cannot be written
+**************************************************************************************************/
+func (s *skipList) beginReplace(entry journalEntry) error {
+	if s == nil {
+		return nil
+	}
+	s.journal = append(s.journal, entry)
+	return s.save()
+}
+
+/**************************************************************************************************
+** finishReplace forgets a completed replacement and saves the skip list.
+**
+** @param key - Grouping key of the new stack
+** @param assetIDs - IDs of the members of the new stack, parent first
+** @return error - An error if the skip list cannot be written
+**************************************************************************************************/
+func (s *skipList) finishReplace(key string, assetIDs []string) error {
+	if s == nil {
+		return nil
+	}
+	kept := s.journal[:0]
+	for _, entry := range s.journal {
+		if entry.Key != key || !utils.AreArraysEqual(entry.AssetIDs, assetIDs) {
+			kept = append(kept, entry)
+		}
+	}
+	s.journal = kept
+	return s.save()
+}
+
+/**************************************************************************************************
+** pendingReplacements returns the number of replacements left to complete.
+**
+** @return int - Number of journal entries
+**************************************************************************************************/
+func (s *skipList) pendingReplacements() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.journal)
+}
+
+/**************************************************************************************************
+** newJournalEntry builds the journal entry of a replacement started now.
+**
+** @param key - Grouping key of the new stack
+** @param stack - Members of the new stack, parent first
+** @param newStackIDs - IDs of the members of the new stack, parent first
+** @param replaced - Old stacks deleted before the new stack is created
+** @return journalEntry - The entry
+**************************************************************************************************/
+func newJournalEntry(key string, stack []utils.TAsset, newStackIDs []string, replaced []journalStack) journalEntry {
+	return journalEntry{
+		Key:      key,
+		Owner:    stack[0].OwnerID,
+		AssetIDs: newStackIDs,
+		Replaced: replaced,
+		Started:  time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+/**************************************************************************************************
+** replayJournal completes, or with rollback undoes, the replacements of the user that an
+** interrupted run left half-done. A replacement that fails again stays in the journal. In dry
+** run mode, the journal is left as is.
+**
+** @param client - Immich client of the user
+** @param journal - Skip list holding the journal
+** @param rollback - Whether to restore the old stacks instead of creating the new ones
+** @param logger - Logger instance for output
+** @return error - An error if the user or the stacks cannot be fetched, or the API key is rejected
+**************************************************************************************************/
+func replayJournal(client immich.ImmichClient, journal *skipList, rollback bool, logger *logrus.Logger) error {
+	if journal.pendingReplacements() == 0 {
+		return nil
+	}
+	user, err := client.GetCurrentUser()
+	if err != nil {
+		return fmt.Errorf("error fetching user: %w", err)
+	}
+	// The run fetches the stacks again afterwards, this look must not reset or remove any of them
+	existingStacks, err := client.ListStacks()
+	if err != nil {
+		return fmt.Errorf("error fetching stacks: %w", err)
+	}
+
+	kept := make([]journalEntry, 0, len(journal.journal))
+	for i, entry := range journal.journal {
+		if entry.Owner != "" && entry.Owner != user.ID {
+			kept = append(kept, entry)
+			continue
+		}
+		var err error
+		runAudit.setKey(entry.Key)
+		if rollback {
+			err = rollbackReplacement(client, entry, existingStacks)
+		} else {
+			err = completeReplacement(client, entry, existingStacks)
+		}
+		runAudit.setKey("")
+		if immich.IsAuthError(err) {
+			journal.journal = append(kept, journal.journal[i:]...)
+			return err
+		}
+		if err != nil {
+			logger.Errorf("Error repairing the replacement of stack %s started %s: %v", entry.Key, entry.Started, err)
+			kept = append(kept, entry)
+			continue
+		}
+		if dryRun {
+			logger.Infof("🩹 Would repair the replacement of stack %s (dry run)", entry.Key)
+			kept = append(kept, entry)
+			continue
+		}
+		if rollback {
+			logger.Infof("🩹 Rolled back the replacement of stack %s", entry.Key)
+		} else {
+			logger.Infof("🩹 Completed the replacement of stack %s", entry.Key)
+			journal.recordCreated(entry.AssetIDs)
+		}
+	}
+	journal.journal = kept
+	if dryRun {
+		return nil
+	}
+	return journal.save()
+}
+
+/**************************************************************************************************
+** completeReplacement deletes the old stacks still there and creates the new stack, unless it
+** already exists.
+**
+** @param client - Immich client of the user
+** @param entry - The replacement to complete
+** @param existingStacks - Stacks fetched from Immich, by asset ID
+** @return error - An error if a stack cannot be deleted or created
+**************************************************************************************************/
+func completeReplacement(client immich.ImmichClient, entry journalEntry, existingStacks map[string]utils.TStack) error {
+	for _, old := range entry.Replaced {
+		if stack, ok := existingStacks[old.AssetIDs[0]]; ok && stack.ID == old.ID {
+			if err := client.DeleteStack(old.ID, utils.REASON_REPLACE_CHILD_STACK_WITH_NEW_ONE); err != nil {
+				return err
+			}
+		}
+	}
+	if stackedTogether(existingStacks, entry.AssetIDs) {
+		return nil
+	}
+	return client.CreateStack(entry.AssetIDs)
+}
+
+/**************************************************************************************************
+** rollbackReplacement creates the old stacks again, taking their members out of the new stack
+** if it was created.
+**
+** @param client - Immich client of the user
+** @param entry - The replacement to roll back
+** @param existingStacks - Stacks fetched from Immich, by asset ID
+** @return error - An error if a stack cannot be created
+**************************************************************************************************/
+func rollbackReplacement(client immich.ImmichClient, entry journalEntry, existingStacks map[string]utils.TStack) error {
+	for _, old := range entry.Replaced {
+		if stackedTogether(existingStacks, old.AssetIDs) {
+			continue
+		}
+		if err := client.CreateStack(old.AssetIDs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** stackedTogether reports whether the assets are in the same stack, with the first as parent.
+**
+** @param existingStacks - Stacks fetched from Immich, by asset ID
+** @param assetIDs - IDs of the assets, parent first
+** @return bool - True when one stack holds them all
+**************************************************************************************************/
+func stackedTogether(existingStacks map[string]utils.TStack, assetIDs []string) bool {
+	parentStack, ok := existingStacks[assetIDs[0]]
+	if !ok || parentStack.PrimaryAssetID != assetIDs[0] {
+		return false
+	}
+	for _, id := range assetIDs[1:] {
+		if stack, ok := existingStacks[id]; !ok || stack.ID != parentStack.ID {
+			return false
+		}
+	}
+	return true
+}
+
+/**************************************************************************************************
+** Main execution logic for the repair command. Replays the journal with every API key, each
+** user repairing its own replacements.
+**
+** @param cmd - Cobra command instance
+** @param args - Command line arguments
+** @return error - Categorized error mapped to the exit code by main, or nil
+**************************************************************************************************/
+func runRepair(cmd *cobra.Command, args []string) error {
+	logger, err := loadEnv()
+	if err != nil {
+		return err
+	}
+	journal, err := loadSkipList(skipListFile)
+	if err != nil {
+		return configError(err)
+	}
+	if journal == nil {
+		return configError(fmt.Errorf("no skip list file, set SKIP_LIST_FILE"))
+	}
+	if journal.pendingReplacements() == 0 {
+		logger.Infof("🩹 No interrupted stack replacement to repair")
+		return nil
+	}
+
+	/**********************************************************************************************
+	** Support multiple API keys (comma-separated), each with its server.
+	**********************************************************************************************/
+	targets, err := apiTargets()
+	if err != nil {
+		return err
+	}
+	runAudit = newAuditTrail(auditLog, logger)
+
+	var runErr error
+	for _, target := range targets {
+		client := immich.NewClient(target.URL, target.Key, false, false, dryRun, false, false, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
+		if client == nil {
+			runErr = worstError(runErr, configError(fmt.Errorf("invalid client for API key: %s", target.Key)))
+			continue
+		}
+		setProxyAuth(client)
+		client.SetOnlyNewStacks(onlyNewStacks)
+		client.SetTagParentWith(tagParentWith)
+		client.SetStackHook(runAudit.hook())
+		if err := client.CheckAPIURL(strictURL); err != nil {
+			runErr = worstError(runErr, configError(err))
+			continue
+		}
+		if err := replayJournal(client, journal, repairRollback, logger); err != nil {
+			logger.Errorf("Error repairing stack replacements: %v", err)
+			if immich.IsAuthError(err) {
+				runErr = worstError(runErr, configError(err))
+			} else {
+				runErr = worstError(runErr, fatalError(err))
+			}
+		}
+	}
+	if left := journal.pendingReplacements(); left > 0 && !dryRun {
+		runErr = worstError(runErr, partialFailure(fmt.Errorf("%d stack replacement(s) could not be repaired", left)))
+	}
+	return runErr
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the journal of the stack replacements
+************************************************************************************************/
+
+const journalTestAssets = `{"assets": {"items": [
+	{"id": "1", "originalFileName": "IMG_0001.JPG", "localDateTime": "2024-01-01T10:00:00Z"},
+	{"id": "2", "originalFileName": "IMG_0001.CR3", "localDateTime": "2024-01-01T10:00:00Z"}
+], "nextPage": null}}`
+
+/************************************************************************************************
+** journalTestServer serves the stacks and assets given, records the stack requests and fails
+** the creation of a stack while failCreate is set. A created stack is served afterwards.
+************************************************************************************************/
+type journalTestServer struct {
+	mu         sync.Mutex
+	stacks     string
+	failCreate bool
+	requests   []string
+}
+
+func (s *journalTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method + " " + r.URL.Path {
+	case "GET /api/stacks":
+		fmt.Fprint(w, s.stacks)
+	case "POST /api/search/metadata":
+		fmt.Fprint(w, journalTestAssets)
+	case "POST /api/stacks":
+		var body struct {
+			AssetIDs []string `json:"assetIds"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		s.requests = append(s.requests, fmt.Sprintf("POST %v", body.AssetIDs))
+		if s.failCreate {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{}`)
+			return
+		}
+		assets := make([]utils.TAsset, 0, len(body.AssetIDs))
+		for _, id := range body.AssetIDs {
+			assets = append(assets, utils.TAsset{ID: id})
+		}
+		created, _ := json.Marshal([]utils.TStack{{ID: "new", PrimaryAssetID: body.AssetIDs[0], Assets: assets}})
+		s.stacks = string(created)
+		fmt.Fprint(w, `{}`)
+	case "DELETE /api/stacks/old":
+		s.requests = append(s.requests, "DELETE old")
+	default:
+		fmt.Fprint(w, `{}`)
+	}
+}
+
+func newJournalTestClient(t *testing.T, server *httptest.Server) (*immich.Client, *logrus.Logger) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	client := immich.NewClient(server.URL, "key", false, true, false, false, false, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
+	require.NotNil(t, client)
+	return client, logger
+}
+
+func TestRunCreatesStackBeforeDeletingOldOne(t *testing.T) {
+	resetGlobalConfig()
+	defer resetGlobalConfig()
+	skipListFile = filepath.Join(t.TempDir(), "skip-list.json")
+	replaceStacks = true
+	// The old stacks are most of the library, above MAX_DELETE_FRACTION
+	forceDelete = true
+
+	// The parent of the old stack is not a member, Immich takes asset 2 out of it
+	handler := &journalTestServer{stacks: `[{"id": "old", "primaryAssetId": "9", "assets": [{"id": "9"}, {"id": "2"}, {"id": "8"}]}]`}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client, logger := newJournalTestClient(t, server)
+
+	require.NoError(t, runStackerOnce(client, logger, nil, nil, nil, nil))
+	assert.Equal(t, []string{"POST [1 2]", "DELETE old"}, handler.requests)
+
+	list, err := loadSkipList(skipListFile)
+	require.NoError(t, err)
+	assert.Zero(t, list.pendingReplacements(), "nothing is journaled")
+}
+
+func TestRunJournalsStackDeletedFirst(t *testing.T) {
+	resetGlobalConfig()
+	defer resetGlobalConfig()
+	skipListFile = filepath.Join(t.TempDir(), "skip-list.json")
+	replaceStacks = true
+	// The old stacks are most of the library, above MAX_DELETE_FRACTION
+	forceDelete = true
+
+	// The parent of the old stack is a member, it is deleted first and the creation fails
+	handler := &journalTestServer{
+		stacks:     `[{"id": "old", "primaryAssetId": "2", "assets": [{"id": "2"}, {"id": "4"}]}]`,
+		failCreate: true,
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client, logger := newJournalTestClient(t, server)
+
+	err := runStackerOnce(client, logger, nil, nil, nil, nil)
+	assert.Equal(t, exitPartialFailure, exitCode(err))
+	assert.Equal(t, []string{"DELETE old", "POST [1 2]"}, handler.requests)
+
+	list, err := loadSkipList(skipListFile)
+	require.NoError(t, err)
+	require.Equal(t, 1, list.pendingReplacements())
+	entry := list.journal[0]
+	assert.Equal(t, []string{"1", "2"}, entry.AssetIDs)
+	assert.Equal(t, []journalStack{{ID: "old", AssetIDs: []string{"2", "4"}}}, entry.Replaced)
+	assert.NotEmpty(t, entry.Key)
+	assert.NotEmpty(t, entry.Started)
+
+	// The next run completes the replacement before anything else
+	handler.stacks = `[]`
+	handler.failCreate = false
+	handler.requests = nil
+	require.NoError(t, runStackerOnce(client, logger, nil, nil, nil, nil))
+	assert.Equal(t, []string{"POST [1 2]"}, handler.requests, "the repaired stack is left unchanged")
+
+	list, err = loadSkipList(skipListFile)
+	require.NoError(t, err)
+	assert.Zero(t, list.pendingReplacements())
+	assert.Equal(t, [][]string{{"1", "2"}}, list.created)
+}
+
+func TestReplayJournal(t *testing.T) {
+	resetGlobalConfig()
+	defer resetGlobalConfig()
+
+	entry := journalEntry{
+		Key:      "key",
+		AssetIDs: []string{"1", "2"},
+		Replaced: []journalStack{{ID: "old", AssetIDs: []string{"2", "4"}}},
+	}
+	tests := []struct {
+		name     string
+		stacks   string
+		rollback bool
+		dryRun   bool
+		requests []string
+		pending  int
+	}{
+		{
+			name:     "old stack still there",
+			stacks:   `[{"id": "old", "primaryAssetId": "2", "assets": [{"id": "2"}, {"id": "4"}]}]`,
+			requests: []string{"DELETE old", "POST [1 2]"},
+		},
+		{
+			name:     "new stack already created",
+			stacks:   `[{"id": "new", "primaryAssetId": "1", "assets": [{"id": "1"}, {"id": "2"}]}]`,
+			requests: nil,
+		},
+		{
+			name:     "rollback",
+			stacks:   `[]`,
+			rollback: true,
+			requests: []string{"POST [2 4]"},
+		},
+		{
+			name:    "dry run",
+			stacks:  `[]`,
+			dryRun:  true,
+			pending: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dryRun = tt.dryRun
+			defer func() { dryRun = false }()
+			handler := &journalTestServer{stacks: tt.stacks}
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			logger := logrus.New()
+			logger.SetOutput(io.Discard)
+			client := immich.NewClient(server.URL, "key", false, false, tt.dryRun, false, false, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
+			require.NotNil(t, client)
+
+			list, err := loadSkipList(filepath.Join(t.TempDir(), "skip-list.json"))
+			require.NoError(t, err)
+			require.NoError(t, list.beginReplace(entry))
+
+			require.NoError(t, replayJournal(client, list, tt.rollback, logger))
+			assert.Equal(t, tt.requests, handler.requests)
+			assert.Equal(t, tt.pending, list.pendingReplacements())
+		})
+	}
+}
+
+func TestReplayJournalLeavesOtherUsers(t *testing.T) {
+	resetGlobalConfig()
+	defer resetGlobalConfig()
+
+	handler := &journalTestServer{stacks: `[]`}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client, logger := newJournalTestClient(t, server)
+
+	list, err := loadSkipList(filepath.Join(t.TempDir(), "skip-list.json"))
+	require.NoError(t, err)
+	require.NoError(t, list.beginReplace(journalEntry{Key: "key", Owner: "someone-else", AssetIDs: []string{"1", "2"}}))
+
+	require.NoError(t, replayJournal(client, list, false, logger))
+	assert.Empty(t, handler.requests)
+	assert.Equal(t, 1, list.pendingReplacements())
+}
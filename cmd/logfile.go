@@ -0,0 +1,114 @@
+/**************************************************************************************************
+** File logging for the Immich CLI application.
+** With LOG_FILE, every log entry is also written to a file rotated by size. The console keeps its
+** own output and formatting, while the file is always plain text or JSON, without colors.
+**************************************************************************************************/
+
+package main
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+/**************************************************************************************************
+** fileHook writes every log entry to the log file with its own formatter.
+**************************************************************************************************/
+type fileHook struct {
+	out       io.Writer
+	formatter logrus.Formatter
+}
+
+/**************************************************************************************************
+** Creates the hook of the log file. Text entries are timestamped and never colored.
+**
+** @param out - The log file
+** @param format - Log format: json or text
+** @return *fileHook - The hook
+**************************************************************************************************/
+func newFileHook(out io.Writer, format string) *fileHook {
+	if format == "json" {
+		return &fileHook{out: out, formatter: &logrus.JSONFormatter{TimestampFormat: time.RFC3339}}
+	}
+	return &fileHook{out: out, formatter: &logrus.TextFormatter{DisableColors: true, FullTimestamp: true, TimestampFormat: time.RFC3339}}
+}
+
+func (h *fileHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *fileHook) Fire(entry *logrus.Entry) error {
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	_, err = h.out.Write(line)
+	return err
+}
+
+/**************************************************************************************************
+** Returns the path of the log file: the --log-file flag, or the LOG_FILE env var.
+**
+** @return string - The path, empty when file logging is disabled
+**************************************************************************************************/
+func logFilePath() string {
+	if logFile != "" {
+		return logFile
+	}
+	return strings.TrimSpace(os.Getenv("LOG_FILE"))
+}
+
+/**************************************************************************************************
+** Returns a positive setting of the log file rotation: the flag, or the env var, or the default.
+** An invalid env var logs a warning and uses the default, like an invalid LOG_LEVEL.
+**
+** @param logger - Logger for the warning
+** @param flagValue - Value of the flag, 0 when not set
+** @param envName - Name of the env var
+** @param defaultValue - Default value
+** @return int - The setting
+**************************************************************************************************/
+func logFileSetting(logger *logrus.Logger, flagValue int, envName string, defaultValue int) int {
+	if flagValue > 0 {
+		return flagValue
+	}
+	val := strings.TrimSpace(os.Getenv(envName))
+	if val == "" {
+		return defaultValue
+	}
+	intVal, err := strconv.Atoi(val)
+	if err != nil || intVal <= 0 {
+		logger.Warnf("Invalid %s '%s', using default %d", envName, val, defaultValue)
+		return defaultValue
+	}
+	return intVal
+}
+
+/**************************************************************************************************
+** Opens the log file, creating its directory if needed. On failure a warning is logged and the
+** logs only go to the console.
+**
+** @param logger - Logger for the warnings
+** @param path - Path of the log file
+** @return *utils.RotatingFile - The log file, or nil on failure
+**************************************************************************************************/
+func openLogFile(logger *logrus.Logger, path string) *utils.RotatingFile {
+	if err := os.MkdirAll(utils.GetDir(path), 0755); err != nil {
+		logger.Warnf("Failed to create log directory: %v, falling back to stdout only", err)
+		return nil
+	}
+	maxSizeMB := logFileSetting(logger, logFileMaxSizeMB, "LOG_FILE_MAX_SIZE_MB", utils.DefaultLogFileMaxSizeMB)
+	maxBackups := logFileSetting(logger, logFileMaxBackups, "LOG_FILE_MAX_BACKUPS", utils.DefaultLogFileMaxBackups)
+	file, err := utils.NewRotatingFile(path, maxSizeMB, maxBackups)
+	if err != nil {
+		logger.Warnf("Failed to open log file %s: %v, falling back to stdout only", path, err)
+		return nil
+	}
+	return file
+}
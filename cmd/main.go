@@ -8,33 +8,23 @@ package main
 import (
 	"os"
 
-	"github.com/majorfi/immich-stack/pkg/utils"
 	"github.com/spf13/cobra"
 )
 
+// version, commit and buildDate describe the build, set at build time via
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
 /**************************************************************************************************
-** bindFlags adds all persistent flags to the root command. This shared function eliminates
-** duplication between CreateRootCommand and CreateTestableRootCommand.
+** bindFlags adds the flag of every option to the root command, as a persistent flag. This shared
+** function eliminates duplication between CreateRootCommand and CreateTestableRootCommand.
 **************************************************************************************************/
 func bindFlags(rootCmd *cobra.Command) {
-	rootCmd.PersistentFlags().StringVar(&apiKey, "api-key", "", "API key (or set API_KEY env var)")
-	rootCmd.PersistentFlags().StringVar(&apiURL, "api-url", "", "API URL (or set API_URL env var)")
-	rootCmd.PersistentFlags().BoolVar(&resetStacks, "reset-stacks", false, "Delete all existing stacks (or set RESET_STACKS=true)")
-	rootCmd.PersistentFlags().BoolVar(&replaceStacks, "replace-stacks", false, "Replace stacks for new groups (or set REPLACE_STACKS=true)")
-	rootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "Dry run (or set DRY_RUN=true)")
-	rootCmd.PersistentFlags().StringVar(&criteria, "criteria", "", "Criteria (or set CRITERIA env var)")
-	rootCmd.PersistentFlags().StringVar(&parentFilenamePromote, "parent-filename-promote", utils.DefaultParentFilenamePromoteString, "Parent filename promote (or set PARENT_FILENAME_PROMOTE env var)")
-	rootCmd.PersistentFlags().StringVar(&parentExtPromote, "parent-ext-promote", utils.DefaultParentExtPromoteString, "Parent ext promote (or set PARENT_EXT_PROMOTE env var)")
-	rootCmd.PersistentFlags().BoolVar(&withArchived, "with-archived", false, "Include archived assets (or set WITH_ARCHIVED=true)")
-	rootCmd.PersistentFlags().BoolVar(&withDeleted, "with-deleted", false, "Include deleted assets (or set WITH_DELETED=true)")
-	rootCmd.PersistentFlags().StringVar(&runMode, "run-mode", os.Getenv("RUN_MODE"), "Run mode (or set RUN_MODE env var)")
-	rootCmd.PersistentFlags().IntVar(&cronInterval, "cron-interval", 0, "Cron interval (or set CRON_INTERVAL env var)")
-	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "", "Log level: debug, info, warn, error (or set LOG_LEVEL env var)")
-	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "", "Log format: text, json (or set LOG_FORMAT env var)")
-	rootCmd.PersistentFlags().BoolVar(&removeSingleAssetStacks, "remove-single-asset-stacks", false, "Remove stacks with only one asset (or set REMOVE_SINGLE_ASSET_STACKS=true)")
-	rootCmd.PersistentFlags().StringSliceVar(&filterAlbumIDs, "filter-album-ids", nil, "Filter by album IDs or names, comma-separated (or set FILTER_ALBUM_IDS env var)")
-	rootCmd.PersistentFlags().StringVar(&filterTakenAfter, "filter-taken-after", "", "Filter assets taken after date, ISO 8601 (or set FILTER_TAKEN_AFTER env var)")
-	rootCmd.PersistentFlags().StringVar(&filterTakenBefore, "filter-taken-before", "", "Filter assets taken before date, ISO 8601 (or set FILTER_TAKEN_BEFORE env var)")
+	bindOptions(rootCmd.PersistentFlags())
 }
 
 /**************************************************************************************************
@@ -43,17 +33,97 @@ func bindFlags(rootCmd *cobra.Command) {
 func addSubcommands(rootCmd *cobra.Command) {
 	var duplicatesCmd = &cobra.Command{
 		Use:   "duplicates",
-		Short: "List duplicate assets",
-		Long:  "Scan your Immich library and list duplicate assets based on filename and timestamp.",
-		Run:   runDuplicates,
+		Short: "List, stack or trash duplicate assets",
+		Long:  "Scan your Immich library and list duplicate assets based on filename and timestamp.\n\nWith --action stack or trash, the assets sharing a checksum are stacked with the oldest upload as parent, or the oldest upload is kept and the others are moved to the trash. Both respect --dry-run.\n\n" + exitCodesHelp,
+		RunE:  runDuplicates,
 	}
+	duplicatesCmd.Flags().StringVar(&duplicatesAction, "action", duplicatesActionList, "What to do with the duplicates: list, stack, trash")
 
 	var fixTrashCmd = &cobra.Command{
 		Use:   "fix-trash",
 		Short: "Fix incomplete stack trash operations",
-		Long:  "Scan trash for assets and move related stack members to trash to maintain consistency.",
-		Run:   runFixTrash,
+		Long:  "Scan trash for assets and move related stack members to trash to maintain consistency.\n\n" + exitCodesHelp,
+		RunE:  runFixTrash,
+	}
+
+	var statsCmd = &cobra.Command{
+		Use:   "stats",
+		Short: "Summarize the stacking potential of the library",
+		Long:  "Count the assets per filename prefix and extension, the RAW/JPEG pairs and the stacks each built-in preset would produce. Nothing is modified.\n\n" + exitCodesHelp,
+		RunE:  runStats,
+	}
+	statsCmd.Flags().StringVar(&statsOutput, "output", "text", "Output format: text, json")
+
+	var verifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Report the existing stacks the current criteria would change",
+		Long:  "Group the library with the current configuration and report the existing stacks it would change: stacks that would split, members that would move to another stack or be unstacked, assets that would join and parents that would change. Nothing is modified, run it before REPLACE_STACKS.\n\n" + exitCodesHelp,
+		RunE:  runVerify,
+	}
+	verifyCmd.Flags().StringVar(&verifyOutput, "output", "text", "Output format: text, json")
+
+	var versionCmd = &cobra.Command{
+		Use:   "version",
+		Short: "Print the version, the build and the criteria hash",
+		Long:  "Print the version, commit, build date and Go version of the binary, the short hash of the effective criteria logged at the start of every run and, when API_KEY and API_URL are set, the version of each Immich server.\n\n" + exitCodesHelp,
+		RunE:  runVersion,
+	}
+	versionCmd.Flags().StringVar(&versionOutput, "output", "text", "Output format: text, json")
+
+	var rejectCmd = &cobra.Command{
+		Use:   "reject",
+		Short: "Unstack stacks and never stack their assets together again",
+		Long:  "Record the assets of the given stacks in the skip list so later runs never stack them together again, then delete the stacks.\n\n" + exitCodesHelp,
+		RunE:  runReject,
+	}
+	rejectCmd.Flags().StringSliceVar(&rejectStackIDs, "stack", nil, "ID of a stack to reject, repeatable or comma-separated")
+
+	var repairCmd = &cobra.Command{
+		Use:   "repair",
+		Short: "Complete stack replacements an interrupted run left half-done",
+		Long:  "Replay the journal of the skip list file: the old stacks of a replacement still there are deleted and the new stack is created. With --rollback, the old stacks are created again instead. Respects --dry-run.\n\n" + exitCodesHelp,
+		RunE:  runRepair,
+	}
+	repairCmd.Flags().BoolVar(&repairRollback, "rollback", false, "Restore the old stacks instead of completing the new ones")
+
+	var benchCmd = &cobra.Command{
+		Use:   "bench",
+		Short: "Measure the grouping speed and memory of the criteria",
+		Long:  "Group synthetic assets, or the filenames of a dump, with each built-in preset and the configured criteria, and report the assets grouped per second, the allocations and the peak memory. Nothing is fetched from Immich and no API key is needed.\n\n" + exitCodesHelp,
+		RunE:  runBench,
+	}
+	benchCmd.Flags().IntVar(&benchAssets, "assets", 10000, "Number of assets to group, or at most this many filenames of --filenames (0 for all)")
+	benchCmd.Flags().StringVar(&benchProfile, "profile", "mixed", "Naming of the synthetic assets: pixel, iphone, camera, mixed")
+	benchCmd.Flags().StringVar(&benchFilenames, "filenames", "", "File with one filename per line to group instead of synthetic assets")
+	benchCmd.Flags().IntVar(&benchRuns, "runs", 3, "Number of times each preset groups the assets")
+	benchCmd.Flags().StringVar(&benchOutput, "output", "text", "Output format: text, json")
+
+	var configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+	}
+	configCmd.AddCommand(&cobra.Command{
+		Use:   "effective",
+		Short: "Print the effective configuration as JSON",
+		Long:  "Print the grouping settings the run would use as JSON, defaults filled in, each with its source: flag, env or default. Useful for bug reports: no API key is needed and the key is never printed.\n\n" + exitCodesHelp,
+		Args:  cobra.NoArgs,
+		RunE:  runConfigEffective,
+	})
+
+	var auditCmd = &cobra.Command{
+		Use:   "audit",
+		Short: "Inspect the audit log of the stack changes",
+	}
+	auditShowCmd := &cobra.Command{
+		Use:   "show",
+		Short: "Print the history of a stack from the audit log",
+		Long:  "Print the entries of AUDIT_LOG about a stack: its creation, the stacks merged into it, its primary changes and its deletion. Without --stack, every entry is printed. No API key is needed.\n\n" + exitCodesHelp,
+		Args:  cobra.NoArgs,
+		RunE:  runAuditShow,
 	}
+	auditShowCmd.Flags().StringVar(&auditStackID, "stack", "", "ID of the stack whose history to print")
+	auditShowCmd.Flags().StringVar(&auditOutput, "output", "text", "Output format: text, json")
+	auditCmd.AddCommand(auditShowCmd)
 
 	// var fixAlbumCmd = &cobra.Command{
 	// 	Use:   "fix-album [album name or ID]",
@@ -65,6 +135,15 @@ func addSubcommands(rootCmd *cobra.Command) {
 
 	rootCmd.AddCommand(duplicatesCmd)
 	rootCmd.AddCommand(fixTrashCmd)
+	rootCmd.AddCommand(statsCmd)
+	rootCmd.AddCommand(verifyCmd)
+	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(rejectCmd)
+	rootCmd.AddCommand(repairCmd)
+	rootCmd.AddCommand(benchCmd)
+	rootCmd.AddCommand(configCmd)
+	rootCmd.AddCommand(auditCmd)
+	rootCmd.AddCommand(newCompletionCommand(rootCmd))
 	// rootCmd.AddCommand(fixAlbumCmd)
 }
 
@@ -76,28 +155,29 @@ func CreateRootCommand() *cobra.Command {
 	var rootCmd = &cobra.Command{
 		Use:   "immich-stack",
 		Short: "Immich Stack CLI",
-		Long:  "A tool to automatically stack Immich assets.",
-		Run:   runStacker,
+		Long:  "A tool to automatically stack Immich assets.\n\n" + exitCodesHelp,
+		RunE:  runRoot,
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
-			if cmd.Flags().Lookup("replace-stacks") != nil && cmd.Flags().Lookup("replace-stacks").Changed {
-				replaceStacksFlagSet = true
-			}
+			// Flags are valid past this point, errors from the run do not need the usage
+			cmd.SilenceUsage = true
 		},
 	}
 
 	bindFlags(rootCmd)
+	rootCmd.Flags().BoolVar(&helpJSON, "help-json", false, "Print every command and flag, with its type, default and environment variable, as JSON")
+	rootCmd.Flags().MarkHidden("help-json")
 	addSubcommands(rootCmd)
 	return rootCmd
 }
 
 /**************************************************************************************************
 ** Application entry point. Sets up the CLI command structure using Cobra, including all
-** available commands and their associated flags. Handles command execution and error
-** reporting.
+** available commands and their associated flags. Handles command execution and maps the
+** returned error to the exit code of its category.
 **************************************************************************************************/
 func main() {
 	rootCmd := CreateRootCommand()
 	if err := rootCmd.Execute(); err != nil {
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
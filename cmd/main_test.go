@@ -22,8 +22,8 @@ func CreateTestableRootCommand() *cobra.Command {
 	var rootCmd = &cobra.Command{
 		Use:   "immich-stack",
 		Short: "Immich Stack CLI",
-		Long:  "A tool to automatically stack Immich assets.",
-		Run:   runStacker,
+		Long:  "A tool to automatically stack Immich assets.\n\n" + exitCodesHelp,
+		RunE:  runStacker,
 	}
 
 	bindFlags(rootCmd)
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the errors of the stack mutations, decorated with the filenames of their assets
+************************************************************************************************/
+
+// rejectingClient fails every stack creation as Immich does for an asset already stacked
+type rejectingClient struct {
+	*fakeClient
+}
+
+func (c *rejectingClient) CreateStack(assetIDs []string) error {
+	return fmt.Errorf("error modifying stack: Asset %s is already in a stack", assetIDs[1])
+}
+
+func TestRunStackerOnceMutationError(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+
+	client := &rejectingClient{&fakeClient{
+		stacks: map[string]utils.TStack{},
+		assets: []utils.TAsset{
+			{ID: "a1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "a2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+		},
+	}}
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+
+	err := runStackerOnce(client, logger, &runProgress{}, nil, nil, nil)
+	require.Error(t, err)
+	assert.Equal(t, exitPartialFailure, exitCode(err))
+	assert.Contains(t, out.String(), `create of stack`)
+	assert.Contains(t, out.String(), `Asset a2 is already in a stack (parent \"IMG_0001.JPG\" [a1]; members \"IMG_0001.JPG\" [a1], \"IMG_0001.DNG\" [a2])`)
+}
+
+// failingDeleteClient fails every stack deletion
+type failingDeleteClient struct {
+	*fakeClient
+}
+
+func (c *failingDeleteClient) DeleteStack(stackID string, reason string) error {
+	return errors.New("error deleting stack: server error")
+}
+
+func TestRunStackerOnceDeleteErrorNamesOldStack(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+	replaceStacks = true
+	forceDelete = true
+
+	old := utils.TStack{ID: "s1", PrimaryAssetID: "a3", Assets: []utils.TAsset{
+		{ID: "a3", OriginalFileName: "OTHER.JPG"},
+		{ID: "a2", OriginalFileName: "IMG_0001.DNG"},
+	}}
+	client := &failingDeleteClient{&fakeClient{
+		stacks: map[string]utils.TStack{"a2": old, "a3": old},
+		assets: []utils.TAsset{
+			{ID: "a1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "a2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "a3", OriginalFileName: "OTHER.JPG", LocalDateTime: "2024-01-01T12:00:00Z"},
+		},
+	}}
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+
+	_ = runStackerOnce(client, logger, &runProgress{}, nil, nil, nil)
+	assert.Contains(t, out.String(), `Error deleting stack s1`)
+	assert.Contains(t, out.String(), `(parent \"OTHER.JPG\" [a3]; members \"OTHER.JPG\" [a3], \"IMG_0001.DNG\" [a2])`, "the old stack is named, not the new one")
+}
@@ -0,0 +1,514 @@
+/**************************************************************************************************
+** Options of the Immich CLI application.
+** Every setting is declared once in cliOptions, with its flag, its environment variable, its type
+** and its default. The declaration generates the persistent flag of the root command and the
+** fallback on the environment variable, with the same precedence for every setting: the flag
+** when set on the command line, then the environment variable, the .env file included, then the
+** default.
+**************************************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/spf13/pflag"
+)
+
+// envAnnotation is the flag annotation holding the name of its environment variable
+const envAnnotation = "immich-stack/env"
+
+// boundFlags are the flags of the last root command created, nil before one is
+var boundFlags *pflag.FlagSet
+
+/**************************************************************************************************
+** option is a setting of the CLI. define adds its flag, with the setting as value and the suffix
+** at the end of its help, and parse sets the setting from the value of its environment variable.
+**************************************************************************************************/
+type option struct {
+	name   string // Name of the flag
+	env    string // Name of the environment variable
+	define func(flags *pflag.FlagSet, suffix string)
+	parse  func(value string) error
+	trim   bool // Surrounding spaces are dropped from the environment variable
+}
+
+/**************************************************************************************************
+** stringOption declares a text setting.
+**
+** @param p - The setting
+** @param name - Name of the flag
+** @param env - Name of the environment variable
+** @param value - Default value
+** @param usage - Help of the flag
+** @return option - The declaration
+**************************************************************************************************/
+func stringOption(p *string, name, env, value, usage string) option {
+	return option{
+		name:   name,
+		env:    env,
+		define: func(flags *pflag.FlagSet, suffix string) { flags.StringVar(p, name, value, usage+suffix) },
+		parse:  func(v string) error { *p = v; return nil },
+		trim:   true,
+	}
+}
+
+/**************************************************************************************************
+** rawStringOption declares a text setting whose environment variable is kept as is, surrounding
+** spaces included, such as a list of delimiters holding a space.
+**
+** @param p - The setting
+** @param name - Name of the flag
+** @param env - Name of the environment variable
+** @param usage - Help of the flag
+** @return option - The declaration
+**************************************************************************************************/
+func rawStringOption(p *string, name, env, usage string) option {
+	o := stringOption(p, name, env, "", usage)
+	o.trim = false
+	return o
+}
+
+/**************************************************************************************************
+** boolOption declares a setting off by default. The environment variable accepts true or false,
+** as well as 1, 0 and their upper case forms.
+**
+** @param p - The setting
+** @param name - Name of the flag
+** @param env - Name of the environment variable
+** @param usage - Help of the flag
+** @return option - The declaration
+**************************************************************************************************/
+func boolOption(p *bool, name, env, usage string) option {
+	return option{
+		name:   name,
+		env:    env,
+		define: func(flags *pflag.FlagSet, suffix string) { flags.BoolVar(p, name, false, usage+suffix) },
+		parse: func(v string) error {
+			parsed, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s '%s', expected true or false", env, v)
+			}
+			*p = parsed
+			return nil
+		},
+		trim: true,
+	}
+}
+
+/**************************************************************************************************
+** onBoolOption declares a setting on by default, turned off with --name=false or the environment
+** variable set to false.
+**
+** @param p - The setting
+** @param name - Name of the flag
+** @param env - Name of the environment variable
+** @param usage - Help of the flag
+** @return option - The declaration
+**************************************************************************************************/
+func onBoolOption(p *bool, name, env, usage string) option {
+	o := boolOption(p, name, env, usage)
+	o.define = func(flags *pflag.FlagSet, suffix string) { flags.BoolVar(p, name, true, usage+suffix) }
+	return o
+}
+
+/**************************************************************************************************
+** intOption declares a number setting, 0 by default.
+**
+** @param p - The setting
+** @param name - Name of the flag
+** @param env - Name of the environment variable
+** @param usage - Help of the flag
+** @return option - The declaration
+**************************************************************************************************/
+func intOption(p *int, name, env, usage string) option {
+	return option{
+		name:   name,
+		env:    env,
+		define: func(flags *pflag.FlagSet, suffix string) { flags.IntVar(p, name, 0, usage+suffix) },
+		parse: func(v string) error {
+			parsed, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s '%s', expected an integer", env, v)
+			}
+			*p = parsed
+			return nil
+		},
+		trim: true,
+	}
+}
+
+/**************************************************************************************************
+** floatOption declares a decimal setting.
+**
+** @param p - The setting
+** @param name - Name of the flag
+** @param env - Name of the environment variable
+** @param value - Default value
+** @param usage - Help of the flag
+** @return option - The declaration
+**************************************************************************************************/
+func floatOption(p *float64, name, env string, value float64, usage string) option {
+	return option{
+		name:   name,
+		env:    env,
+		define: func(flags *pflag.FlagSet, suffix string) { flags.Float64Var(p, name, value, usage+suffix) },
+		parse: func(v string) error {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s '%s', expected a number such as 0.3", env, v)
+			}
+			*p = parsed
+			return nil
+		},
+		trim: true,
+	}
+}
+
+/**************************************************************************************************
+** durationOption declares a duration setting, 0 by default.
+**
+** @param p - The setting
+** @param name - Name of the flag
+** @param env - Name of the environment variable
+** @param usage - Help of the flag
+** @return option - The declaration
+**************************************************************************************************/
+func durationOption(p *time.Duration, name, env, usage string) option {
+	return option{
+		name:   name,
+		env:    env,
+		define: func(flags *pflag.FlagSet, suffix string) { flags.DurationVar(p, name, 0, usage+suffix) },
+		parse: func(v string) error {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s '%s', expected a duration such as 90m", env, v)
+			}
+			*p = parsed
+			return nil
+		},
+		trim: true,
+	}
+}
+
+/**************************************************************************************************
+** secondsValue is the flag value of an interval in seconds, given as a number of seconds or as a
+** duration such as 90m.
+**************************************************************************************************/
+type secondsValue int
+
+func (s *secondsValue) Set(v string) error {
+	seconds, err := parseSeconds(v)
+	if err != nil {
+		return err
+	}
+	*s = secondsValue(seconds)
+	return nil
+}
+
+func (s *secondsValue) String() string { return strconv.Itoa(int(*s)) }
+
+func (s *secondsValue) Type() string { return "seconds" }
+
+/**************************************************************************************************
+** parseSeconds parses a positive interval, a number of seconds such as 3600 or a duration such as
+** 90m or 24h. The fractions of a second of a duration are dropped.
+**
+** @param v - The interval
+** @return int - The interval in seconds
+** @return error - An error if the interval is not positive or cannot be parsed
+**************************************************************************************************/
+func parseSeconds(v string) (int, error) {
+	seconds, err := strconv.Atoi(v)
+	if err != nil {
+		duration, durationErr := time.ParseDuration(v)
+		if durationErr != nil {
+			return 0, fmt.Errorf("expected a positive number of seconds or a duration such as 90m")
+		}
+		seconds = int(duration / time.Second)
+	}
+	if seconds <= 0 {
+		return 0, fmt.Errorf("expected a positive number of seconds or a duration such as 90m")
+	}
+	return seconds, nil
+}
+
+/**************************************************************************************************
+** formatSeconds writes an interval in seconds the way it is read, such as 1h30m or 45s.
+**
+** @param seconds - The interval in seconds
+** @return string - The interval without its zero units
+**************************************************************************************************/
+func formatSeconds(seconds int) string {
+	text := (time.Duration(seconds) * time.Second).String()
+	if strings.HasSuffix(text, "m0s") {
+		text = strings.TrimSuffix(text, "0s")
+	}
+	if strings.HasSuffix(text, "h0m") {
+		text = strings.TrimSuffix(text, "0m")
+	}
+	return text
+}
+
+/**************************************************************************************************
+** secondsOption declares a positive interval in seconds, also accepting a duration such as 90m.
+**
+** @param p - The setting, in seconds
+** @param name - Name of the flag
+** @param env - Name of the environment variable
+** @param value - Default value, 0 for none
+** @param usage - Help of the flag
+** @return option - The declaration
+**************************************************************************************************/
+func secondsOption(p *int, name, env string, value int, usage string) option {
+	return option{
+		name: name,
+		env:  env,
+		define: func(flags *pflag.FlagSet, suffix string) {
+			*p = value
+			flags.Var((*secondsValue)(p), name, usage+suffix)
+		},
+		parse: func(v string) error {
+			seconds, err := parseSeconds(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s '%s', %v", env, v, err)
+			}
+			*p = seconds
+			return nil
+		},
+		trim: true,
+	}
+}
+
+/**************************************************************************************************
+** listOption declares a list setting, comma-separated in the flag and the environment variable.
+**
+** @param p - The setting
+** @param name - Name of the flag
+** @param env - Name of the environment variable
+** @param usage - Help of the flag
+** @return option - The declaration
+**************************************************************************************************/
+func listOption(p *[]string, name, env, usage string) option {
+	return option{
+		name:   name,
+		env:    env,
+		define: func(flags *pflag.FlagSet, suffix string) { flags.StringSliceVar(p, name, nil, usage+suffix) },
+		parse:  func(v string) error { *p = splitList(v); return nil },
+		trim:   true,
+	}
+}
+
+/**************************************************************************************************
+** multiOption declares a repeatable setting whose values may hold commas, such as a regex. The
+** environment variable sets a single value.
+**
+** @param p - The setting
+** @param name - Name of the flag
+** @param env - Name of the environment variable
+** @param usage - Help of the flag
+** @return option - The declaration
+**************************************************************************************************/
+func multiOption(p *[]string, name, env, usage string) option {
+	return option{
+		name:   name,
+		env:    env,
+		define: func(flags *pflag.FlagSet, suffix string) { flags.StringArrayVar(p, name, nil, usage+suffix) },
+		parse:  func(v string) error { *p = []string{v}; return nil },
+		trim:   true,
+	}
+}
+
+/**************************************************************************************************
+** headerOption declares the extra headers: a repeatable "Name: value" flag, and an environment
+** variable holding a JSON object of the header values by name.
+**
+** @param p - The setting, in the format of the flag
+** @param name - Name of the flag
+** @param env - Name of the environment variable
+** @param usage - Help of the flag
+** @return option - The declaration
+**************************************************************************************************/
+func headerOption(p *[]string, name, env, usage string) option {
+	o := multiOption(p, name, env, usage)
+	o.parse = func(v string) error {
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(v), &headers); err != nil {
+			return fmt.Errorf("invalid %s: must be a JSON object of header values by name", env)
+		}
+		*p = make([]string, 0, len(headers))
+		for header, value := range headers {
+			*p = append(*p, header+": "+value)
+		}
+		sort.Strings(*p)
+		return nil
+	}
+	return o
+}
+
+/**************************************************************************************************
+** usageSuffix tells where else a setting comes from, at the end of the help of its flag.
+**
+** @return string - The suffix of the help
+**************************************************************************************************/
+func (o option) usageSuffix() string {
+	if o.env == "EXTRA_HEADERS" {
+		return " (or set EXTRA_HEADERS to a JSON object)"
+	}
+	return fmt.Sprintf(" (or set %s)", o.env)
+}
+
+/**************************************************************************************************
+** bindOptions adds the flag of every option to the persistent flags of the root command, with the
+** setting as value and annotated with its environment variable.
+**
+** @param flags - Persistent flags of the root command
+**************************************************************************************************/
+func bindOptions(flags *pflag.FlagSet) {
+	for _, o := range cliOptions {
+		o.define(flags, o.usageSuffix())
+		flags.SetAnnotation(o.name, envAnnotation, []string{o.env})
+	}
+	boundFlags = flags
+}
+
+/**************************************************************************************************
+** flagChanged tells whether the flag of a setting was set on the command line.
+**
+** @param name - Name of the flag
+** @return bool - True when the flag was set
+**************************************************************************************************/
+func flagChanged(name string) bool {
+	if boundFlags == nil {
+		return false
+	}
+	f := boundFlags.Lookup(name)
+	return f != nil && f.Changed
+}
+
+/**************************************************************************************************
+** applyEnvOptions sets every setting whose flag was not set on the command line from its
+** environment variable. An empty variable is ignored, the setting keeps its default.
+**
+** @return error - An error if a variable cannot be parsed
+**************************************************************************************************/
+func applyEnvOptions() error {
+	for _, o := range cliOptions {
+		if flagChanged(o.name) {
+			continue
+		}
+		value := os.Getenv(o.env)
+		if o.trim {
+			value = strings.TrimSpace(value)
+		}
+		if value == "" {
+			continue
+		}
+		if err := o.parse(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** cliOptions are the settings of the CLI, in the order of the help.
+**************************************************************************************************/
+var cliOptions = []option{
+	stringOption(&apiKey, "api-key", "API_KEY", "", "API key"),
+	stringOption(&apiURL, "api-url", "API_URL", "", "API URL"),
+	boolOption(&strictURL, "strict-url", "STRICT_URL", "Use API_URL as configured and fail when it is wrong, instead of correcting it"),
+	headerOption(&headerFlags, "header", "EXTRA_HEADERS", "Header added to every request, \"Name: value\", repeatable, for a reverse proxy in front of Immich"),
+	stringOption(&basicAuthUser, "basic-auth-user", "BASIC_AUTH_USER", "", "Basic auth user of a reverse proxy in front of Immich"),
+	stringOption(&basicAuthPass, "basic-auth-pass", "BASIC_AUTH_PASS", "", "Basic auth password of a reverse proxy in front of Immich"),
+	boolOption(&resetStacks, "reset-stacks", "RESET_STACKS", "Delete all existing stacks"),
+	stringOption(&confirmResetStack, "confirm-reset-stack", "CONFIRM_RESET_STACK", "", "Confirmation of --reset-stacks, the sentence the error of a reset without it gives"),
+	boolOption(&replaceStacks, "replace-stacks", "REPLACE_STACKS", "Replace stacks for new groups"),
+	boolOption(&onlyNewStacks, "only-new-stacks", "ONLY_NEW_STACKS", "Only create stacks of unstacked assets, never deleting or modifying anything"),
+	boolOption(&dryRun, "dry-run", "DRY_RUN", "Dry run"),
+	boolOption(&diffOnlyChanges, "diff-only-changes", "DIFF_ONLY_CHANGES", "Hide unchanged stacks from the dry run diff"),
+	boolOption(&analyzeTimeGaps, "analyze-time-gaps", "ANALYZE_TIME_GAPS", "Print the time gaps of the assets the time delta kept apart and a delta covering them at the end of a dry run"),
+	stringOption(&criteria, "criteria", "CRITERIA", "", "Criteria"),
+	stringOption(&stackKeyTemplate, "stack-key-template", "STACK_KEY_TEMPLATE", "", "Go template building the grouping key from the values of the legacy criteria, such as {{index .Values 0}}; the values it leaves out no longer keep assets apart"),
+	stringOption(&parentFilenamePromote, "parent-filename-promote", "PARENT_FILENAME_PROMOTE", utils.DefaultParentFilenamePromoteString, "Parent filename promote"),
+	stringOption(&editedSuffixes, "edited-suffixes", "EDITED_SUFFIXES", "", "Comma-separated edited suffixes added to the built-in localized ones of editedAny and stripEditedSuffix"),
+	stringOption(&parentExtPromote, "parent-ext-promote", "PARENT_EXT_PROMOTE", utils.DefaultParentExtPromoteString, "Parent ext promote"),
+	boolOption(&withArchived, "with-archived", "WITH_ARCHIVED", "Include archived assets"),
+	boolOption(&withHidden, "with-hidden", "WITH_HIDDEN", "Also stack the hidden and locked assets, never with visible ones"),
+	boolOption(&withDeleted, "with-deleted", "WITH_DELETED", "Include deleted assets"),
+	stringOption(&runMode, "run-mode", "RUN_MODE", "", "Run mode"),
+	secondsOption(&cronInterval, "cron-interval", "CRON_INTERVAL", 0, "Interval of the cron mode, in seconds or as a duration such as 90m, default 24h"),
+	secondsOption(&minCronInterval, "min-cron-interval", "MIN_CRON_INTERVAL", 300, "Shortest interval of the cron mode allowed, lower it to run more often"),
+	boolOption(&panicFatal, "panic-fatal", "PANIC_FATAL", "Let panics stop the cron loop instead of recovering"),
+	boolOption(&skipMatchMiss, "skip-match-miss", "SKIP_MATCH_MISS", "Leave out assets missing a criteria instead of grouping them on the others"),
+	stringOption(&prefetchFilenameQuery, "prefetch-filename-query", "PREFETCH_FILENAME_QUERY", "", "Only fetch assets whose filename contains this text, derived from the criteria when possible"),
+	intOption(&limit, "limit", "LIMIT", "Process at most this many stacks per run, ordered by grouping key, 0 for no limit"),
+	intOption(&maxGroups, "max-groups", "MAX_GROUPS", "Sampled run: process only this many groups, to try criteria without going through the library, 0 for every group"),
+	boolOption(&sampleRandom, "sample-random", "SAMPLE_RANDOM", "Pick the groups of --max-groups at random instead of the first ones by grouping key"),
+	intOption(&sampleSeed, "seed", "SAMPLE_SEED", "Seed of --sample-random, the same seed picks the same groups"),
+	durationOption(&minAssetAge, "min-asset-age", "MIN_ASSET_AGE", "Leave assets uploaded more recently than this, such as 5m, to a later run, 0 for none"),
+	intOption(&maxPendingJobs, "max-pending-jobs", "MAX_PENDING_JOBS", "Skip a cron run while a metadata extraction or library scan queue of Immich has more pending jobs, 0 for no limit"),
+	boolOption(&ignoreServerLoad, "ignore-server-load", "IGNORE_SERVER_LOAD", "Run even when the Immich job queues exceed --max-pending-jobs"),
+	durationOption(&maxRunDuration, "max-run-duration", "MAX_RUN_DURATION", "Stop picking up new stacks after this duration, such as 90m, and print the resume token, 0 for no limit"),
+	stringOption(&resumeToken, "resume-token", "RESUME_TOKEN", "", "Continue after the last stack of the run that printed this token"),
+	boolOption(&crossLibraryStacking, "cross-library-stacking", "CROSS_LIBRARY_STACKING", "Allow stacks mixing assets of different libraries"),
+	boolOption(&crossOwnerStacking, "cross-owner-stacking", "CROSS_OWNER_STACKING", "Allow stacks mixing assets of different owners, as an admin API key may search"),
+	boolOption(&includePartnerAssets, "include-partner-assets", "INCLUDE_PARTNER_ASSETS", "Also group the assets shared by a partner, never mixing owners in a stack"),
+	durationOption(&maxStackTimeSpread, "max-stack-time-spread", "MAX_STACK_TIME_SPREAD", "Never stack assets taken further apart than this, such as 24h, whatever the criteria, 0 for no limit"),
+	stringOption(&maxStackTimeSpreadAction, "max-stack-time-spread-action", "MAX_STACK_TIME_SPREAD_ACTION", "", "What to do with a stack spreading more: split (default) or drop"),
+	boolOption(&requireSameFolder, "require-same-folder", "REQUIRE_SAME_FOLDER", "Never stack assets of different folders, whatever the criteria"),
+	stringOption(&requireSameFolderAction, "require-same-folder-action", "REQUIRE_SAME_FOLDER_ACTION", "", "What to do with a stack spanning folders: split (default) or drop"),
+	stringOption(&eventsFormat, "events", "EVENTS", "", "Write the run events to stdout, logs going to stderr: ndjson"),
+	stringOption(&otlpEndpoint, "otlp-endpoint", "OTEL_EXPORTER_OTLP_ENDPOINT", "", "OTLP/HTTP collector receiving the traces of the runs, such as http://localhost:4318"),
+	boolOption(&interactive, "interactive", "INTERACTIVE", "Review each stack change in the terminal before applying it"),
+	stringOption(&skipListFile, "skip-list-file", "SKIP_LIST_FILE", "", "File of the rejected stacks and of the stacks created by the tool"),
+	stringOption(&duplicatesReport, "duplicates-report", "DUPLICATES_REPORT", "", "Write the copies of a same file found in a stack to this CSV file, such as duplicates-in-stacks.csv"),
+	stringOption(&auditLog, "audit-log", "AUDIT_LOG", "", "Append every stack created, deleted, merged or given a new primary to this NDJSON file, such as /app/data/audit.ndjson"),
+	stringOption(&assetsFromFile, "assets-from-file", "ASSETS_FROM_FILE", "", "Stack together the assets listed in this file, one ID per line or a JSON array, instead of grouping the library"),
+	boolOption(&fromImmichDuplicates, "from-immich-duplicates", "FROM_IMMICH_DUPLICATES", "Stack the duplicate groups found by Immich instead of grouping the library with the criteria"),
+	stringOption(&addParentsToAlbum, "add-parents-to-album", "ADD_PARENTS_TO_ALBUM", "", "Keep this album, by name or ID, holding exactly the parents of the stacks created by the tool"),
+	boolOption(&autoLearnRejections, "auto-learn-rejections", "AUTO_LEARN_REJECTIONS", "Never stack again the assets of a stack of the tool deleted by hand"),
+	stringOption(&profiles, "profiles", "PROFILES", "", "JSON array of criteria profiles, each grouping the assets its selector matches first"),
+	stringOption(&unionMode, "union-mode", "UNION_MODE", "", "How OR groups merge assets: connected (default) or strict"),
+	intOption(&unionLogSize, "union-log-size", "UNION_LOG_SIZE", "Log the stacks bridged by different OR keys with more assets than this, default 2"),
+	intOption(&maxTimeBucket, "max-time-bucket", "MAX_TIME_BUCKET", "Skip the groups of more assets than this sharing a timestamp, as left by bulk imports, default 500"),
+	intOption(&serverMaxStackSize, "server-max-stack-size", "SERVER_MAX_STACK_SIZE", "Largest stack the Immich server accepts, 0 for no limit"),
+	stringOption(&oversizePolicy, "oversize-policy", "OVERSIZE_POLICY", "", "What to do with a larger stack: skip (default) or split into chronological chunks"),
+	stringOption(&parentSelectorCmd, "parent-selector-cmd", "PARENT_SELECTOR_CMD", "", "Command reading each stack as JSON on stdin and printing the ID of its parent"),
+	durationOption(&parentSelectorTimeout, "parent-selector-timeout", "PARENT_SELECTOR_TIMEOUT", "Time after which the parent selector command is killed, default 10s"),
+	rawStringOption(&delimiters, "delimiters", "DELIMITERS", "Comma-separated delimiters for the number suffix of biggestNumber and the default criteria, \\, for a literal comma"),
+	stringOption(&promoteOrder, "promote-order", "PROMOTE_ORDER", "", "Parent selection rules in order: regex, filename, ext, extRank, size, alpha"),
+	stringOption(&extRankFallback, "ext-rank-fallback", "EXT_RANK_FALLBACK", "", "Order of the extensions PARENT_EXT_PROMOTE does not list: builtin (default, jpeg > jpg > png > others), alpha or none"),
+	boolOption(&forceRestack, "force-restack", "FORCE_RESTACK", "Create again the stacks of the tool deleted by hand"),
+	floatOption(&maxDeleteFraction, "max-delete-fraction", "MAX_DELETE_FRACTION", defaultMaxDeleteFraction, "Abort when the run would tear apart more than this fraction of the existing stacks, 0 to block any deletion, 1 for no limit"),
+	intOption(&maxDeleteCount, "max-delete-count", "MAX_DELETE_COUNT", "Abort when the run would tear apart more than this many existing stacks, 0 for no limit"),
+	boolOption(&forceDelete, "force-delete", "FORCE_DELETE", "Apply the run even when it deletes more stacks than --max-delete-fraction or --max-delete-count"),
+	intOption(&maxAssetErrors, "max-asset-errors", "MAX_ASSET_ERRORS", "Abort when more than this many assets fail to apply the criteria, 0 for no limit"),
+	intOption(&debugSample, "debug-sample", "DEBUG_SAMPLE", "At debug level, log the first values each criterion extracts and their distribution, such as 20, 0 for none"),
+	boolOption(&quiet, "quiet", "QUIET", "Log the routine per-stack messages at debug level, keeping warnings, errors and the summary"),
+	stringOption(&logLevel, "log-level", "LOG_LEVEL", "", "Log level: debug, info, warn, error"),
+	stringOption(&logFormat, "log-format", "LOG_FORMAT", "", "Log format: text, json"),
+	stringOption(&logFile, "log-file", "LOG_FILE", "", "Also write the logs to this file, rotated by size, such as /app/logs/immich-stack.log"),
+	intOption(&logFileMaxSizeMB, "log-file-max-size-mb", "LOG_FILE_MAX_SIZE_MB", "Size in megabytes at which the log file is rotated, default 10"),
+	intOption(&logFileMaxBackups, "log-file-max-backups", "LOG_FILE_MAX_BACKUPS", "Number of rotated log files to keep, default 5"),
+	boolOption(&removeSingleAssetStacks, "remove-single-asset-stacks", "REMOVE_SINGLE_ASSET_STACKS", "Remove stacks with only one asset"),
+	stringOption(&excludeExtension, "exclude-extension", "EXCLUDE_EXTENSION", "", "Comma-separated extensions never stacked, such as .xmp,.gif, ignoring case"),
+	boolOption(&removeExcludedFromStacks, "remove-excluded-from-stacks", "REMOVE_EXCLUDED_FROM_STACKS", "Dissolve the stacks holding an asset of an excluded extension and stack their other members again"),
+	boolOption(&includeSidecars, "include-sidecars", "INCLUDE_SIDECARS", "Group the .json, .xmp and .aae sidecar files Immich ingested as assets, never as the parent"),
+	onBoolOption(&skipIncompleteAssets, "skip-incomplete-assets", "SKIP_INCOMPLETE_ASSETS", "Leave the assets still uploading, without checksum or of type OTHER, to a later run"),
+	listOption(&filterAlbumIDs, "filter-album-ids", "FILTER_ALBUM_IDS", "Filter by album IDs or names, comma-separated"),
+	stringOption(&filterTakenAfter, "filter-taken-after", "FILTER_TAKEN_AFTER", "", "Filter assets taken after date, ISO 8601"),
+	stringOption(&filterTakenBefore, "filter-taken-before", "FILTER_TAKEN_BEFORE", "", "Filter assets taken before date, ISO 8601"),
+	multiOption(&filterRegex, "filter-regex", "FILTER_REGEX", "Only process the assets whose filename matches this regex, repeatable and OR-ed"),
+	multiOption(&filterPathRegex, "filter-path-regex", "FILTER_PATH_REGEX", "Only process the assets whose original path matches this regex, repeatable and OR-ed"),
+	stringOption(&stackMarker, "stack-marker", "STACK_MARKER", "", "Mark created stacks' parent: description, tag, none"),
+	stringOption(&tagParentWith, "tag-parent-with", "TAG_PARENT_WITH", "", "Tag attached to the parent of created stacks"),
+	boolOption(&resetMarkedOnly, "reset-marked-only", "RESET_MARKED_ONLY", "Only reset stacks marked by immich-stack"),
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// optionSample is a value of each type of flag, as set in the environment and as printed by the flag
+type optionSample struct {
+	env, envWant, flag, flagWant string
+}
+
+var optionSamples = map[string]optionSample{
+	"bool":        {env: "true", envWant: "true", flag: "false", flagWant: "false"},
+	"int":         {env: "7", envWant: "7", flag: "3", flagWant: "3"},
+	"float64":     {env: "0.5", envWant: "0.5", flag: "0.25", flagWant: "0.25"},
+	"duration":    {env: "90m", envWant: "1h30m0s", flag: "5m", flagWant: "5m0s"},
+	"string":      {env: "from-env", envWant: "from-env", flag: "from-flag", flagWant: "from-flag"},
+	"stringSlice": {env: "a,b", envWant: "[a,b]", flag: "c", flagWant: "[c]"},
+	"stringArray": {env: "a,b", envWant: `["a,b"]`, flag: "c", flagWant: "[c]"},
+	"seconds":     {env: "90m", envWant: "5400", flag: "600", flagWant: "600"},
+}
+
+/**************************************************************************************************
+** newOptionFlags binds every option to a new set of flags, parsed from the arguments.
+**************************************************************************************************/
+func newOptionFlags(t *testing.T, args ...string) *pflag.FlagSet {
+	t.Helper()
+	flags := pflag.NewFlagSet("immich-stack", pflag.ContinueOnError)
+	bindOptions(flags)
+	require.NoError(t, flags.Parse(args))
+	return flags
+}
+
+func TestEveryOptionHasFlagAndEnv(t *testing.T) {
+	defer resetTestEnv()
+	flags := newOptionFlags(t)
+	names := make(map[string]bool)
+	envs := make(map[string]bool)
+	for _, o := range cliOptions {
+		assert.False(t, names[o.name], "flag %s is declared twice", o.name)
+		assert.False(t, envs[o.env], "environment variable %s is declared twice", o.env)
+		names[o.name] = true
+		envs[o.env] = true
+
+		f := flags.Lookup(o.name)
+		require.NotNil(t, f, o.name)
+		assert.Equal(t, o.env, flagEnv(f))
+		assert.Contains(t, f.Usage, o.env, "the help of --%s names its environment variable", o.name)
+	}
+}
+
+func TestOptionPrecedence(t *testing.T) {
+	defer resetTestEnv()
+	for _, o := range cliOptions {
+		t.Run(o.name, func(t *testing.T) {
+			os.Unsetenv(o.env)
+			flags := newOptionFlags(t)
+			f := flags.Lookup(o.name)
+			sample, ok := optionSamples[f.Value.Type()]
+			if o.env == "EXTRA_HEADERS" {
+				sample = optionSample{env: `{"X-A": "b"}`, envWant: "[X-A: b]", flag: "X-B: c", flagWant: "[X-B: c]"}
+			} else {
+				require.True(t, ok, "no sample of type %s", f.Value.Type())
+			}
+
+			require.NoError(t, applyEnvOptions())
+			assert.Equal(t, f.DefValue, f.Value.String(), "the default applies without flag nor variable")
+
+			t.Setenv(o.env, sample.env)
+			require.NoError(t, applyEnvOptions())
+			assert.Equal(t, sample.envWant, f.Value.String(), "the variable applies without flag")
+
+			flags = newOptionFlags(t, "--"+o.name+"="+sample.flag)
+			require.NoError(t, applyEnvOptions())
+			assert.Equal(t, sample.flagWant, flags.Lookup(o.name).Value.String(), "the flag wins over the variable")
+		})
+	}
+}
+
+func TestOptionEnvErrors(t *testing.T) {
+	defer resetTestEnv()
+	for env, want := range map[string]string{
+		"DRY_RUN":             "invalid DRY_RUN 'yes', expected true or false",
+		"LIMIT":               "invalid LIMIT 'yes', expected an integer",
+		"MAX_DELETE_FRACTION": "invalid MAX_DELETE_FRACTION 'yes', expected a number such as 0.3",
+		"MAX_RUN_DURATION":    "invalid MAX_RUN_DURATION 'yes', expected a duration such as 90m",
+	} {
+		resetTestEnv()
+		newOptionFlags(t)
+		t.Setenv(env, "yes")
+		assert.EqualError(t, applyEnvOptions(), want)
+	}
+}
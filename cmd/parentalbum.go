@@ -0,0 +1,144 @@
+/**************************************************************************************************
+** Parent album for the Immich CLI application.
+** With ADD_PARENTS_TO_ALBUM, an album is kept holding exactly the parents of the stacks the tool
+** manages: the stacks it created that still exist, recorded in the skip list file. Parents of
+** new stacks are added and the other assets removed, so running it again changes nothing.
+**************************************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/orchestrator"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// Description of the album created for the parents
+const parentAlbumDescription = "Parents of the stacks managed by immich-stack"
+
+/**************************************************************************************************
+** managedParents returns the parents of the stacks holding the recorded sets: a set is managed
+** while one stack holds two of its assets or more.
+**
+** @param index - Current stacks of the run
+** @param sets - Members of the stacks created by the tool
+** @return []string - IDs of the parents, sorted
+**************************************************************************************************/
+func managedParents(index *orchestrator.StackIndex, sets [][]string) []string {
+	seen := make(map[string]bool)
+	parents := make([]string, 0, len(sets))
+	for _, set := range sets {
+		perStack := make(map[*utils.TStack]int)
+		for _, id := range set {
+			stack := index.StackOf(id)
+			if stack == nil {
+				continue
+			}
+			perStack[stack]++
+			if perStack[stack] == 2 && !seen[stack.PrimaryAssetID] {
+				seen[stack.PrimaryAssetID] = true
+				parents = append(parents, stack.PrimaryAssetID)
+			}
+		}
+	}
+	sort.Strings(parents)
+	return parents
+}
+
+/**************************************************************************************************
+** syncParentAlbum makes the album hold exactly the given parents, creating it if no album has
+** this name or ID. In dry run mode, the changes are only logged by the client.
+**
+** @param client - Immich client of the user
+** @param logger - Logger instance for output
+** @param album - Name or ID of the album
+** @param parentIDs - IDs of the parents of the managed stacks
+** @return error - An error if the album cannot be read or updated
+**************************************************************************************************/
+func syncParentAlbum(client immich.ImmichClient, logger *logrus.Logger, album string, parentIDs []string) error {
+	albums, err := client.FetchAlbums()
+	if err != nil {
+		return err
+	}
+	var target *utils.TAlbum
+	for i := range albums {
+		if albums[i].ID == album || albums[i].AlbumName == album {
+			target = &albums[i]
+			break
+		}
+	}
+
+	current := make(map[string]bool)
+	if target == nil {
+		if target, err = client.CreateAlbum(album, parentAlbumDescription); err != nil {
+			return err
+		}
+		logger.Infof("📒 Created album %s for the stack parents", album)
+	} else {
+		assets, err := client.FetchAlbumAssets(target.ID)
+		if err != nil {
+			return err
+		}
+		for _, asset := range assets {
+			current[asset.ID] = true
+		}
+	}
+
+	wanted := make(map[string]bool, len(parentIDs))
+	var toAdd, toRemove []string
+	for _, id := range parentIDs {
+		wanted[id] = true
+		if !current[id] {
+			toAdd = append(toAdd, id)
+		}
+	}
+	for id := range current {
+		if !wanted[id] {
+			toRemove = append(toRemove, id)
+		}
+	}
+	sort.Strings(toRemove)
+
+	if err := client.AddAssetsToAlbum(target.ID, toAdd); err != nil {
+		return err
+	}
+	if err := client.RemoveAssetsFromAlbum(target.ID, toRemove); err != nil {
+		return err
+	}
+	if len(toAdd) == 0 && len(toRemove) == 0 {
+		logger.Debugf("Album %s already holds the %d stack parents", album, len(parentIDs))
+		return nil
+	}
+	logger.Infof("📒 Album %s: %d stack parents added, %d assets removed", album, len(toAdd), len(toRemove))
+	return nil
+}
+
+/**************************************************************************************************
+** updateParentAlbum syncs the ADD_PARENTS_TO_ALBUM album at the end of a run, when set.
+**
+** @param client - Immich client of the user
+** @param logger - Logger instance for output
+** @param index - Current stacks of the run
+** @param skipped - Skip list holding the stacks created by the tool, or nil
+** @param applied - Members of the stacks applied during the run, recorded in the skip list
+** unless in dry run mode
+** @return error - An error if the album cannot be updated
+**************************************************************************************************/
+func updateParentAlbum(client immich.ImmichClient, logger *logrus.Logger, index *orchestrator.StackIndex, skipped *skipList, applied [][]string) error {
+	if addParentsToAlbum == "" {
+		return nil
+	}
+	var sets [][]string
+	if skipped != nil {
+		sets = append(sets, skipped.created...)
+	}
+	sets = append(sets, applied...)
+	if err := syncParentAlbum(client, logger, addParentsToAlbum, managedParents(index, sets)); err != nil {
+		return fmt.Errorf("error updating album %s: %w", addParentsToAlbum, err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/orchestrator"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the album of the stack parents
+************************************************************************************************/
+
+func TestManagedParents(t *testing.T) {
+	s1 := utils.TStack{ID: "s1", PrimaryAssetID: "2", Assets: []utils.TAsset{{ID: "1"}, {ID: "2"}}}
+	s2 := utils.TStack{ID: "s2", PrimaryAssetID: "9", Assets: []utils.TAsset{{ID: "9"}, {ID: "3"}}}
+	index := orchestrator.NewStackIndex(map[string]utils.TStack{"1": s1, "2": s1, "9": s2, "3": s2})
+
+	parents := managedParents(index, [][]string{
+		{"1", "2"},      // Stacked together, parent 2
+		{"2", "1"},      // Listed twice
+		{"3", "4"},      // Only one asset left in a stack
+		{"5", "6"},      // Not stacked anymore
+		{"3", "9", "8"}, // An asset left the stack
+	})
+	assert.Equal(t, []string{"2", "9"}, parents)
+}
+
+func TestRunAddsParentsToAlbum(t *testing.T) {
+	tests := []struct {
+		name     string
+		albums   string
+		dryRun   bool
+		requests []string
+	}{
+		{
+			name:     "album kept in sync",
+			albums:   `[{"id": "album-1", "albumName": "Best of stacks"}]`,
+			requests: []string{"POST /api/stacks [1 2]", "PUT /api/albums/album-1/assets [1]", "DELETE /api/albums/album-1/assets [7]"},
+		},
+		{
+			name:     "album created",
+			albums:   `[]`,
+			requests: []string{"POST /api/stacks [1 2]", "POST /api/albums Best of stacks", "PUT /api/albums/album-2/assets [1 3]"},
+		},
+		{
+			name:     "dry run",
+			albums:   `[{"id": "album-1", "albumName": "Best of stacks"}]`,
+			dryRun:   true,
+			requests: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetGlobalConfig()
+			defer resetGlobalConfig()
+			skipListFile = filepath.Join(t.TempDir(), "skip-list.json")
+			addParentsToAlbum = "Best of stacks"
+			dryRun = tt.dryRun
+
+			// 3 and 4 were stacked by a previous run, 5 and 6 were unstacked since
+			require.NoError(t, os.WriteFile(skipListFile, []byte(`{"keys": [], "created": [["3", "4"], ["5", "6"]]}`), 0644))
+
+			var mu sync.Mutex
+			var requests []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				var body struct {
+					AssetIDs  []string `json:"assetIds"`
+					IDs       []string `json:"ids"`
+					AlbumName string   `json:"albumName"`
+				}
+				_ = json.NewDecoder(r.Body).Decode(&body)
+				switch r.Method + " " + r.URL.Path {
+				case "GET /api/stacks":
+					fmt.Fprint(w, `[{"id": "s1", "primaryAssetId": "3", "assets": [{"id": "3"}, {"id": "4"}]}]`)
+				case "POST /api/search/metadata":
+					fmt.Fprint(w, `{"assets": {"items": [
+						{"id": "1", "originalFileName": "IMG_0001.JPG", "localDateTime": "2024-01-01T10:00:00Z"},
+						{"id": "2", "originalFileName": "IMG_0001.CR3", "localDateTime": "2024-01-01T10:00:00Z"},
+						{"id": "3", "originalFileName": "IMG_0002.JPG", "localDateTime": "2024-01-01T11:00:00Z"},
+						{"id": "4", "originalFileName": "IMG_0002.CR3", "localDateTime": "2024-01-01T11:00:00Z"}
+					], "nextPage": null}}`)
+				case "POST /api/stacks":
+					requests = append(requests, fmt.Sprintf("POST /api/stacks %v", body.AssetIDs))
+					fmt.Fprint(w, `{}`)
+				case "GET /api/albums":
+					fmt.Fprint(w, tt.albums)
+				case "GET /api/albums/album-1":
+					fmt.Fprint(w, `{"id": "album-1", "assets": [{"id": "3"}, {"id": "7"}]}`)
+				case "POST /api/albums":
+					requests = append(requests, "POST /api/albums "+body.AlbumName)
+					fmt.Fprint(w, `{"id": "album-2", "albumName": "Best of stacks"}`)
+				case "PUT /api/albums/album-1/assets", "PUT /api/albums/album-2/assets", "DELETE /api/albums/album-1/assets":
+					requests = append(requests, fmt.Sprintf("%s %s %v", r.Method, r.URL.Path, body.IDs))
+					fmt.Fprint(w, `[]`)
+				default:
+					fmt.Fprint(w, `{}`)
+				}
+			}))
+			defer server.Close()
+
+			logger := logrus.New()
+			logger.SetOutput(io.Discard)
+			client := immich.NewClient(server.URL, "key", false, false, tt.dryRun, false, false, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
+			require.NotNil(t, client)
+
+			require.NoError(t, runStackerOnce(client, logger, nil, nil, nil, nil))
+			assert.Equal(t, tt.requests, requests)
+		})
+	}
+}
+
+func TestAddParentsToAlbumEnvVar(t *testing.T) {
+	resetGlobalConfig()
+	clearEnvironment()
+	defer resetGlobalConfig()
+	defer clearEnvironment()
+	os.Setenv("API_KEY", "key")
+	os.Setenv("ADD_PARENTS_TO_ALBUM", " Best of stacks ")
+
+	config := LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "ADD_PARENTS_TO_ALBUM needs SKIP_LIST_FILE", "the default skip list path is not enough")
+
+	resetGlobalConfig()
+	os.Setenv("SKIP_LIST_FILE", filepath.Join(t.TempDir(), "skip-list.json"))
+	config = LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.Equal(t, "Best of stacks", addParentsToAlbum)
+}
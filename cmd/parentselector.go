@@ -0,0 +1,107 @@
+/**************************************************************************************************
+** External parent selection for the Immich CLI application.
+** PARENT_SELECTOR_CMD names a command picking the parent of each stack, such as a script looking
+** for the sharpest frame. It receives the stack as JSON on stdin and prints the ID of the parent.
+** The promote rules pick the parent when the command fails, times out or prints another ID.
+**************************************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/stacker"
+	"github.com/majorfi/immich-stack/pkg/utils"
+)
+
+// defaultParentSelectorTimeout bounds a PARENT_SELECTOR_CMD run when PARENT_SELECTOR_TIMEOUT is unset
+const defaultParentSelectorTimeout = 10 * time.Second
+
+/**************************************************************************************************
+** selectorAsset is an asset of the stack sent to the parent selector, members in sorted order.
+**************************************************************************************************/
+type selectorAsset struct {
+	ID               string   `json:"id"`
+	OriginalFileName string   `json:"originalFileName"`
+	OriginalPath     string   `json:"originalPath"`
+	LocalDateTime    string   `json:"localDateTime"`
+	Type             string   `json:"type"`
+	FileSize         *float64 `json:"fileSize,omitempty"`
+}
+
+/**************************************************************************************************
+** selectorInput is the JSON document written on the stdin of the parent selector. Parent is the
+** parent picked by the promote rules.
+**************************************************************************************************/
+type selectorInput struct {
+	Parent string          `json:"parent"`
+	Assets []selectorAsset `json:"assets"`
+}
+
+/**************************************************************************************************
+** Returns the parent selector running PARENT_SELECTOR_CMD, or nil when it is unset. The command
+** is split on spaces, without a shell, and its stderr is part of the error of a failed run.
+**
+** @param command - The command and its arguments
+** @param timeout - Time after which a run is killed, 0 for defaultParentSelectorTimeout
+** @return stacker.ParentSelector - The selector
+**************************************************************************************************/
+func newParentSelector(command string, timeout time.Duration) stacker.ParentSelector {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = defaultParentSelectorTimeout
+	}
+	return func(members []utils.TAsset) (string, error) {
+		input := selectorInput{Parent: members[0].ID, Assets: make([]selectorAsset, 0, len(members))}
+		for _, member := range members {
+			asset := selectorAsset{
+				ID:               member.ID,
+				OriginalFileName: member.OriginalFileName,
+				OriginalPath:     member.OriginalPath,
+				LocalDateTime:    member.LocalDateTime,
+				Type:             member.Type,
+			}
+			if member.ExifInfo != nil {
+				asset.FileSize = member.ExifInfo.FileSizeInByte
+			}
+			input.Assets = append(input.Assets, asset)
+		}
+		data, err := json.Marshal(input)
+		if err != nil {
+			return "", fmt.Errorf("error encoding the stack: %w", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		// A child left holding the output open must not outlive the timeout
+		cmd.WaitDelay = time.Second
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("timed out after %s", timeout)
+			}
+			if output := strings.TrimSpace(stderr.String()); output != "" {
+				return "", fmt.Errorf("%s: %w, stderr: %s", args[0], err, output)
+			}
+			return "", fmt.Errorf("%s: %w", args[0], err)
+		}
+		id := strings.TrimSpace(stdout.String())
+		if id == "" {
+			return "", fmt.Errorf("%s printed no asset ID", args[0])
+		}
+		return id, nil
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeSelectorScript(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pick.sh")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755))
+	return path
+}
+
+func TestParentSelector(t *testing.T) {
+	size := 2048.0
+	members := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+		{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z", ExifInfo: &utils.TExifInfo{FileSizeInByte: &size}},
+	}
+
+	assert.Nil(t, newParentSelector("  ", 0), "no command, no selector")
+
+	t.Run("the stack on stdin, the parent on stdout", func(t *testing.T) {
+		input := filepath.Join(t.TempDir(), "input.json")
+		selector := newParentSelector(writeSelectorScript(t, "cat > "+input+"\necho ' 2'"), 0)
+		id, err := selector(members)
+		require.NoError(t, err)
+		assert.Equal(t, "2", id)
+
+		data, err := os.ReadFile(input)
+		require.NoError(t, err)
+		var got selectorInput
+		require.NoError(t, json.Unmarshal(data, &got))
+		assert.Equal(t, "1", got.Parent)
+		require.Len(t, got.Assets, 2)
+		assert.Equal(t, "IMG_0001.DNG", got.Assets[1].OriginalFileName)
+		assert.Equal(t, &size, got.Assets[1].FileSize)
+	})
+
+	t.Run("failure with its stderr", func(t *testing.T) {
+		selector := newParentSelector(writeSelectorScript(t, "echo 'no sharp frame' >&2\nexit 3"), 0)
+		_, err := selector(members)
+		assert.ErrorContains(t, err, "exit status 3, stderr: no sharp frame")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		selector := newParentSelector(writeSelectorScript(t, "sleep 5"), 100*time.Millisecond)
+		_, err := selector(members)
+		assert.ErrorContains(t, err, "timed out after 100ms")
+	})
+
+	t.Run("no output", func(t *testing.T) {
+		selector := newParentSelector(writeSelectorScript(t, "cat > /dev/null"), 0)
+		_, err := selector(members)
+		assert.ErrorContains(t, err, "printed no asset ID")
+	})
+}
+
+func TestRunStackerOnceParentSelector(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+
+	runs := filepath.Join(t.TempDir(), "runs")
+	parentSelectorCmd = writeSelectorScript(t, "cat > /dev/null\necho run >> "+runs+"\necho a4")
+	existing := utils.TStack{ID: "s1", PrimaryAssetID: "a1", Assets: []utils.TAsset{{ID: "a1"}, {ID: "a2"}}}
+	client := &fakeClient{
+		stacks: map[string]utils.TStack{"a1": existing, "a2": existing},
+		assets: []utils.TAsset{
+			{ID: "a1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "a2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "a3", OriginalFileName: "IMG_0002.JPG", LocalDateTime: "2024-01-01T11:00:00Z"},
+			{ID: "a4", OriginalFileName: "IMG_0002.DNG", LocalDateTime: "2024-01-01T11:00:00Z"},
+		},
+	}
+
+	require.NoError(t, runStackerOnce(client, logrus.New(), &runProgress{}, nil, nil, nil))
+	assert.Equal(t, [][]string{{"a4", "a3"}}, client.created, "the selector picks the parent of the new stack")
+	data, err := os.ReadFile(runs)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "run"), "the unchanged stack is not sent to the command")
+}
@@ -0,0 +1,62 @@
+/**************************************************************************************************
+** Default locations of the files the Immich CLI application keeps between runs.
+** In the Docker image they live under /app/data, the directory to mount as a volume. Run as a
+** binary on Linux, macOS or Windows, they follow the conventions of the system through
+** os.UserConfigDir: ~/.config, ~/Library/Application Support or %AppData%.
+** These are local paths, built with path/filepath; asset paths and filenames come from the
+** Immich server with forward slashes whatever the system, and are handled with path.
+**************************************************************************************************/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// containerEnv forces the container detection on or off, the Docker image sets it to true
+const containerEnv = "IMMICH_STACK_CONTAINER"
+
+// containerDataDir is the directory of the files kept between runs in the Docker image
+const containerDataDir = "/app/data"
+
+// dockerEnvFile is created by Docker at the root of every container
+var dockerEnvFile = "/.dockerenv"
+
+// userConfigDir returns the configuration directory of the user, replaced by the tests
+var userConfigDir = os.UserConfigDir
+
+/**************************************************************************************************
+** runningInContainer tells whether the tool runs in a container: IMMICH_STACK_CONTAINER when
+** set to a boolean, else the presence of /.dockerenv.
+**
+** @return bool - True in a container
+**************************************************************************************************/
+func runningInContainer() bool {
+	if value := strings.TrimSpace(os.Getenv(containerEnv)); value != "" {
+		if inContainer, err := strconv.ParseBool(value); err == nil {
+			return inContainer
+		}
+	}
+	_, err := os.Stat(dockerEnvFile)
+	return err == nil
+}
+
+/**************************************************************************************************
+** defaultDataDir returns the directory of the files kept between runs: /app/data in a container,
+** the immich-stack directory of the user configuration directory otherwise.
+**
+** @return string - The directory, or an empty string when the system has none
+**************************************************************************************************/
+func defaultDataDir() string {
+	if runningInContainer() {
+		return containerDataDir
+	}
+	dir, err := userConfigDir()
+	if err != nil || dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "immich-stack")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultDataDir(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, ".dockerenv")
+	originalMarker, originalConfigDir := dockerEnvFile, userConfigDir
+	defer func() { dockerEnvFile, userConfigDir = originalMarker, originalConfigDir }()
+	dockerEnvFile = marker
+	userConfigDir = func() (string, error) { return filepath.Join(dir, "config"), nil }
+
+	t.Run("binary uses the user configuration directory", func(t *testing.T) {
+		t.Setenv(containerEnv, "")
+		assert.False(t, runningInContainer())
+		assert.Equal(t, filepath.Join(dir, "config", "immich-stack"), defaultDataDir())
+		assert.Equal(t, filepath.Join(dir, "config", "immich-stack", "skip-list.json"), defaultSkipListPath())
+	})
+
+	t.Run("container detected by the env flag", func(t *testing.T) {
+		t.Setenv(containerEnv, "true")
+		assert.True(t, runningInContainer())
+		assert.Equal(t, "/app/data", defaultDataDir())
+		assert.Equal(t, filepath.Join("/app/data", "skip-list.json"), defaultSkipListPath())
+	})
+
+	t.Run("container detected by /.dockerenv", func(t *testing.T) {
+		t.Setenv(containerEnv, "")
+		assert.NoError(t, os.WriteFile(marker, nil, 0644))
+		defer os.Remove(marker)
+		assert.True(t, runningInContainer())
+
+		t.Setenv(containerEnv, "false")
+		assert.False(t, runningInContainer(), "the env flag overrides the detection")
+		t.Setenv(containerEnv, "maybe")
+		assert.True(t, runningInContainer(), "an invalid env flag falls back to the detection")
+	})
+
+	t.Run("no configuration directory disables the default", func(t *testing.T) {
+		t.Setenv(containerEnv, "false")
+		userConfigDir = func() (string, error) { return "", errors.New("neither $XDG_CONFIG_HOME nor $HOME are defined") }
+		assert.Empty(t, defaultDataDir())
+		assert.Empty(t, defaultSkipListPath())
+	})
+}
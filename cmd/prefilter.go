@@ -0,0 +1,136 @@
+/**************************************************************************************************
+** Regex prefilters for the Immich CLI application.
+** FILTER_REGEX and FILTER_PATH_REGEX restrict a run to the assets whose original filename or
+** path match, without touching the criteria. The assets left out are neither grouped nor is a
+** stack holding one of them modified.
+**************************************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+/**************************************************************************************************
+** assetPrefilter holds the compiled regexes of FILTER_REGEX and FILTER_PATH_REGEX. The regexes of
+** a field are OR-ed, and an asset must match both fields when both are set.
+**************************************************************************************************/
+type assetPrefilter struct {
+	names []*regexp.Regexp
+	paths []*regexp.Regexp
+}
+
+/**************************************************************************************************
+** Compiles the regexes of the prefilters.
+**
+** @param names - Regexes of the original filename
+** @param paths - Regexes of the original path
+** @return *assetPrefilter - The prefilter, or nil when no regex is set
+** @return error - An error naming the invalid regex
+**************************************************************************************************/
+func newAssetPrefilter(names, paths []string) (*assetPrefilter, error) {
+	if len(names) == 0 && len(paths) == 0 {
+		return nil, nil
+	}
+	filter := &assetPrefilter{}
+	for _, pattern := range names {
+		re, err := utils.RegexCompile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FILTER_REGEX %q: %w", pattern, err)
+		}
+		filter.names = append(filter.names, re)
+	}
+	for _, pattern := range paths {
+		re, err := utils.RegexCompile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FILTER_PATH_REGEX %q: %w", pattern, err)
+		}
+		filter.paths = append(filter.paths, re)
+	}
+	return filter, nil
+}
+
+/**************************************************************************************************
+** Tells whether a value matches one of the regexes, or no regex is set.
+**
+** @param regexes - Regexes of the field
+** @param value - Value of the field
+** @return bool - Whether the value passes
+**************************************************************************************************/
+func matchesAny(regexes []*regexp.Regexp, value string) bool {
+	if len(regexes) == 0 {
+		return true
+	}
+	for _, re := range regexes {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+/**************************************************************************************************
+** Leaves out the assets failing the prefilters and logs how many each filter removed. A nil
+** prefilter keeps every asset.
+**
+** @param assets - Fetched assets
+** @param logger - Logger for the counts
+** @return []utils.TAsset - Assets passing the prefilters
+** @return map[string]bool - IDs of the assets left out
+**************************************************************************************************/
+func (f *assetPrefilter) apply(assets []utils.TAsset, logger *logrus.Logger) ([]utils.TAsset, map[string]bool) {
+	if f == nil {
+		return assets, nil
+	}
+	kept := make([]utils.TAsset, 0, len(assets))
+	excluded := make(map[string]bool)
+	var byName, byPath int
+	for _, asset := range assets {
+		switch {
+		case !matchesAny(f.names, asset.OriginalFileName):
+			byName++
+		case !matchesAny(f.paths, asset.OriginalPath):
+			byPath++
+		default:
+			kept = append(kept, asset)
+			continue
+		}
+		excluded[asset.ID] = true
+	}
+	if len(f.names) > 0 {
+		logger.Infof("🔎 FILTER_REGEX left out %d of %d assets", byName, len(assets))
+	}
+	if len(f.paths) > 0 {
+		logger.Infof("🔎 FILTER_PATH_REGEX left out %d of %d assets", byPath, len(assets)-byName)
+	}
+	return kept, excluded
+}
+
+/**************************************************************************************************
+** Tells whether applying a stack would modify an existing stack holding an asset left out by the
+** prefilters: the stack of any member, merged or replaced by the new one.
+**
+** @param stack - Members of the new stack
+** @param excluded - IDs of the assets left out
+** @return bool - Whether a filtered asset would be touched
+**************************************************************************************************/
+func touchesFilteredStack(stack []utils.TAsset, excluded map[string]bool) bool {
+	if len(excluded) == 0 {
+		return false
+	}
+	for _, member := range stack {
+		if member.Stack == nil {
+			continue
+		}
+		for _, asset := range member.Stack.Assets {
+			if excluded[asset.ID] {
+				return true
+			}
+		}
+	}
+	return false
+}
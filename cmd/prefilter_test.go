@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssetPrefilter(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "PXL_20250101_1.jpg", OriginalPath: "/upload/phone/PXL_20250101_1.jpg"},
+		{ID: "2", OriginalFileName: "PXL_20240101_1.jpg", OriginalPath: "/upload/phone/PXL_20240101_1.jpg"},
+		{ID: "3", OriginalFileName: "IMG_0001.jpg", OriginalPath: "/upload/camera/IMG_0001.jpg"},
+		{ID: "4", OriginalFileName: "PXL_20250102_1.jpg", OriginalPath: "/upload/tablet/PXL_20250102_1.jpg"},
+	}
+
+	filter, err := newAssetPrefilter(nil, nil)
+	require.NoError(t, err)
+	kept, excluded := filter.apply(assets, logger)
+	assert.Len(t, kept, 4, "no regex keeps every asset")
+	assert.Empty(t, excluded)
+
+	filter, err = newAssetPrefilter([]string{"^PXL_2025", "^IMG_"}, []string{"/phone/", "/camera/"})
+	require.NoError(t, err)
+	kept, excluded = filter.apply(assets, logger)
+	var ids []string
+	for _, asset := range kept {
+		ids = append(ids, asset.ID)
+	}
+	assert.Equal(t, []string{"1", "3"}, ids, "the regexes of a field are OR-ed, the fields AND-ed")
+	assert.Equal(t, map[string]bool{"2": true, "4": true}, excluded)
+
+	_, err = newAssetPrefilter(nil, []string{"("})
+	assert.ErrorContains(t, err, `invalid FILTER_PATH_REGEX "("`)
+}
+
+func TestTouchesFilteredStack(t *testing.T) {
+	stacked := &utils.TStack{ID: "s", Assets: []utils.TAsset{{ID: "1"}, {ID: "9"}}}
+	stack := []utils.TAsset{{ID: "1", Stack: stacked}, {ID: "2"}}
+
+	assert.False(t, touchesFilteredStack(stack, nil))
+	assert.False(t, touchesFilteredStack(stack, map[string]bool{"5": true}))
+	assert.True(t, touchesFilteredStack(stack, map[string]bool{"9": true}))
+}
+
+func TestFilterRegexEnvVar(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("FILTER_REGEX", "^PXL_(2024|2025),v2")
+
+	config := LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.Equal(t, []string{"^PXL_(2024|2025),v2"}, filterRegex, "the environment sets a single regex, commas included")
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("FILTER_REGEX", "^PXL_")
+	os.Setenv("REMOVE_SINGLE_ASSET_STACKS", "true")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "cannot be combined with REMOVE_SINGLE_ASSET_STACKS")
+}
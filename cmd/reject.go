@@ -0,0 +1,107 @@
+/**************************************************************************************************
+** Reject command implementation for the Immich CLI application.
+** Records the assets of existing stacks in the skip list so they are never stacked together
+** again, and deletes the stacks.
+**************************************************************************************************/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/orchestrator"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/spf13/cobra"
+)
+
+// rejectStackIDs are the IDs of the stacks to reject
+var rejectStackIDs []string
+
+/**************************************************************************************************
+** Main execution logic for the reject command. Looks up each stack with every API key, records
+** its assets as rejected together and deletes it. In dry run mode, nothing is recorded or
+** deleted.
+**
+** @param cmd - Cobra command instance
+** @param args - Command line arguments
+** @return error - Categorized error mapped to the exit code by main, or nil
+**************************************************************************************************/
+func runReject(cmd *cobra.Command, args []string) error {
+	logger, err := loadEnv()
+	if err != nil {
+		return err
+	}
+	if len(rejectStackIDs) == 0 {
+		return configError(fmt.Errorf("no stack to reject, use --stack <id>"))
+	}
+	skipped, err := loadSkipList(skipListFile)
+	if err != nil {
+		return configError(err)
+	}
+	if skipped == nil {
+		return configError(fmt.Errorf("no skip list file, set SKIP_LIST_FILE"))
+	}
+
+	/**********************************************************************************************
+	** Support multiple API keys (comma-separated), each with its server.
+	**********************************************************************************************/
+	targets, err := apiTargets()
+	if err != nil {
+		return err
+	}
+	runAudit = newAuditTrail(auditLog, logger)
+	clients := make([]*immich.Client, 0, len(targets))
+	for _, target := range targets {
+		client := immich.NewClient(target.URL, target.Key, false, false, dryRun, false, false, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
+		if client == nil {
+			return configError(fmt.Errorf("invalid client for API key: %s", target.Key))
+		}
+		setProxyAuth(client)
+		client.SetOnlyNewStacks(onlyNewStacks)
+		client.SetTagParentWith(tagParentWith)
+		client.SetStackHook(runAudit.hook())
+		if err := client.CheckAPIURL(strictURL); err != nil {
+			return configError(err)
+		}
+		clients = append(clients, client)
+	}
+
+	var runErr error
+	for _, stackID := range rejectStackIDs {
+		var found bool
+		for _, client := range clients {
+			stack, err := client.FetchStack(stackID)
+			if err != nil {
+				continue
+			}
+			found = true
+
+			ids := make([]string, 0, len(stack.Assets))
+			for _, asset := range stack.Assets {
+				ids = append(ids, asset.ID)
+			}
+			if dryRun {
+				logger.Infof("🚫 Would reject stack %s of %d assets (dry run)", stackID, len(ids))
+				break
+			}
+			if err := skipped.addAssetSet(ids); err != nil {
+				logger.Errorf("Error saving skip list: %v", err)
+				runErr = worstError(runErr, fatalError(err))
+				break
+			}
+			if err := client.DeleteStack(stackID, utils.REASON_REJECT_STACK); err != nil {
+				err = orchestrator.DecorateMutationError(orchestrator.MutationDelete, "", orchestrator.StackParent(stack), stack.Assets, err)
+				runErr = worstError(runErr, partialFailure(err))
+				break
+			}
+			logger.Infof("🚫 Rejected stack %s, its %d assets will not be stacked together again", stackID, len(ids))
+			break
+		}
+		if !found {
+			logger.Errorf("Stack %s not found for any API key", stackID)
+			runErr = worstError(runErr, partialFailure(fmt.Errorf("stack %s not found", stackID)))
+		}
+	}
+	return runErr
+}
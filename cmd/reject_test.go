@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the reject command
+************************************************************************************************/
+
+func TestRunReject(t *testing.T) {
+	resetGlobalConfig()
+	clearEnvironment()
+	defer resetGlobalConfig()
+	defer clearEnvironment()
+	defer func() { rejectStackIDs = nil }()
+
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/stacks/stack-1":
+			fmt.Fprint(w, `{"id": "stack-1", "primaryAssetId": "2", "assets": [{"id": "2"}, {"id": "1"}]}`)
+		case "DELETE /api/stacks/stack-1":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "skip-list.json")
+	os.Setenv("API_KEY", "key")
+	os.Setenv("API_URL", server.URL)
+	os.Setenv("SKIP_LIST_FILE", path)
+	rejectStackIDs = []string{"stack-1", "stack-404"}
+
+	err := runReject(nil, nil)
+	assert.ErrorContains(t, err, "stack stack-404 not found")
+	assert.Equal(t, exitPartialFailure, exitCode(err))
+	assert.Contains(t, requests, "DELETE /api/stacks/stack-1")
+
+	list, err := loadSkipList(path)
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"1", "2"}}, list.assetSets)
+}
@@ -0,0 +1,106 @@
+/**************************************************************************************************
+** Interactive review for the Immich CLI application.
+** With --interactive, every proposed stack change is shown in the terminal before it is applied.
+** Rejected stacks are recorded by grouping key in the skip list, so later runs leave them alone.
+**************************************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+)
+
+/**************************************************************************************************
+** reviewDecision is the answer given for a proposed stack.
+**************************************************************************************************/
+type reviewDecision int
+
+const (
+	reviewApprove reviewDecision = iota // Apply the stack
+	reviewReject                        // Do not apply the stack and skip it in future runs
+	reviewQuit                          // Stop the run, leaving the remaining stacks untouched
+)
+
+/**************************************************************************************************
+** stackReviewer asks in the terminal whether each proposed stack should be applied. A nil
+** reviewer approves every stack.
+**************************************************************************************************/
+type stackReviewer struct {
+	in         *bufio.Reader
+	out        io.Writer
+	approveAll bool
+}
+
+/**************************************************************************************************
+** newStackReviewer creates a reviewer reading the answers from in and writing the proposed
+** stacks to out.
+**
+** @param in - Source of the answers
+** @param out - Destination of the proposed stacks and prompts
+** @return *stackReviewer - The reviewer
+**************************************************************************************************/
+func newStackReviewer(in io.Reader, out io.Writer) *stackReviewer {
+	return &stackReviewer{in: bufio.NewReader(in), out: out}
+}
+
+/**************************************************************************************************
+** review shows a proposed stack, parent first and marked, and reads the answer: y applies it,
+** n rejects it, a applies it and every following stack, q stops the run. An unknown answer asks
+** again, and the end of the input quits.
+**
+** @param stack - Members of the proposed stack, parent first
+** @param key - Grouping key of the stack
+** @param action - Description of the change, such as "new stack"
+** @return reviewDecision - The decision for the stack
+**************************************************************************************************/
+func (r *stackReviewer) review(stack []utils.TAsset, key string, action string) reviewDecision {
+	if r == nil || r.approveAll {
+		return reviewApprove
+	}
+
+	fmt.Fprintf(r.out, "\n%s: %s\n", action, key)
+	for i, asset := range stack {
+		marker := " "
+		if i == 0 {
+			marker = "*"
+		}
+		fmt.Fprintf(r.out, "  %s %s  %s\n", marker, asset.OriginalFileName, asset.LocalDateTime)
+	}
+
+	for {
+		fmt.Fprint(r.out, "Apply? [y]es, [n]o and skip in future runs, [a]ll remaining, [q]uit: ")
+		answer, err := r.in.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return reviewApprove
+		case "n", "no":
+			return reviewReject
+		case "a", "all":
+			r.approveAll = true
+			return reviewApprove
+		case "q", "quit":
+			return reviewQuit
+		}
+		if err != nil {
+			fmt.Fprintln(r.out)
+			return reviewQuit
+		}
+	}
+}
+
+/**************************************************************************************************
+** isTerminal reports whether the file is an interactive terminal.
+**
+** @param f - The file to check, usually os.Stdin
+** @return bool - True for a terminal
+**************************************************************************************************/
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/stacker"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the interactive review
+************************************************************************************************/
+
+func TestStackReviewer(t *testing.T) {
+	stack := []utils.TAsset{
+		{OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+		{OriginalFileName: "IMG_0001.CR3", LocalDateTime: "2024-01-01T10:00:00Z"},
+	}
+
+	var out bytes.Buffer
+	reviewer := newStackReviewer(strings.NewReader("maybe\ny\nN\na\n"), &out)
+	assert.Equal(t, reviewApprove, reviewer.review(stack, "IMG_0001", "🆕 Creating new stack"), "an unknown answer asks again")
+	assert.Equal(t, reviewReject, reviewer.review(stack, "IMG_0002", "🆕 Creating new stack"))
+	assert.Equal(t, reviewApprove, reviewer.review(stack, "IMG_0003", "🆕 Creating new stack"))
+	assert.Equal(t, reviewApprove, reviewer.review(stack, "IMG_0004", "🆕 Creating new stack"), "all approves the following stacks without asking")
+	assert.Equal(t, 4, strings.Count(out.String(), "Apply?"))
+	assert.Contains(t, out.String(), "🆕 Creating new stack: IMG_0001\n  * IMG_0001.JPG  2024-01-01T10:00:00Z\n    IMG_0001.CR3  2024-01-01T10:00:00Z\n")
+
+	reviewer = newStackReviewer(strings.NewReader("q\n"), io.Discard)
+	assert.Equal(t, reviewQuit, reviewer.review(stack, "IMG_0001", "🆕 Creating new stack"))
+	reviewer = newStackReviewer(strings.NewReader(""), io.Discard)
+	assert.Equal(t, reviewQuit, reviewer.review(stack, "IMG_0001", "🆕 Creating new stack"), "the end of the input quits")
+
+	var none *stackReviewer
+	assert.Equal(t, reviewApprove, none.review(stack, "IMG_0001", "🆕 Creating new stack"))
+}
+
+func TestInteractiveRunRecordsRejectedStacks(t *testing.T) {
+	resetGlobalConfig()
+	defer resetGlobalConfig()
+	skipListFile = filepath.Join(t.TempDir(), "skip-list.json")
+
+	var created [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/stacks":
+			fmt.Fprint(w, `[]`)
+		case "POST /api/search/metadata":
+			fmt.Fprint(w, `{"assets": {"items": [
+				{"id": "1", "originalFileName": "IMG_0001.JPG", "localDateTime": "2024-01-01T10:00:00Z"},
+				{"id": "2", "originalFileName": "IMG_0001.CR3", "localDateTime": "2024-01-01T10:00:00Z"},
+				{"id": "3", "originalFileName": "IMG_0002.JPG", "localDateTime": "2024-01-01T11:00:00Z"},
+				{"id": "4", "originalFileName": "IMG_0002.CR3", "localDateTime": "2024-01-01T11:00:00Z"}
+			], "nextPage": null}}`)
+		case "POST /api/stacks":
+			var body struct {
+				AssetIDs []string `json:"assetIds"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			created = append(created, body.AssetIDs)
+			fmt.Fprint(w, `{}`)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	client := immich.NewClient(server.URL, "key", false, false, false, false, false, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
+	require.NotNil(t, client)
+
+	// The first stack is rejected and the second approved, in the order of the stacker
+	grouped, err := stacker.New(stacker.Options{Criteria: criteria, ParentFilenamePromote: parentFilenamePromote, ParentExtPromote: parentExtPromote}).Stack([]utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+		{ID: "2", OriginalFileName: "IMG_0001.CR3", LocalDateTime: "2024-01-01T10:00:00Z"},
+		{ID: "3", OriginalFileName: "IMG_0002.JPG", LocalDateTime: "2024-01-01T11:00:00Z"},
+		{ID: "4", OriginalFileName: "IMG_0002.CR3", LocalDateTime: "2024-01-01T11:00:00Z"},
+	})
+	require.NoError(t, err)
+	require.Len(t, grouped, 2)
+
+	reviewer := newStackReviewer(strings.NewReader("n\ny\n"), io.Discard)
+	require.NoError(t, runStackerOnce(client, logger, nil, nil, reviewer, nil))
+	require.Len(t, created, 1)
+	assert.Equal(t, grouped[1].Parent.ID, created[0][0])
+
+	// The next run does not propose the rejected stack again. The server keeps no stacks, so the
+	// approved one is forced to be created again instead of being taken as deleted by hand
+	created = nil
+	forceRestack = true
+	reviewer = newStackReviewer(strings.NewReader("a\n"), io.Discard)
+	require.NoError(t, runStackerOnce(client, logger, nil, nil, reviewer, nil))
+	require.Len(t, created, 1)
+	assert.Equal(t, grouped[1].Parent.ID, created[0][0])
+}
+
+func TestInteractiveEnvVarValidation(t *testing.T) {
+	resetGlobalConfig()
+	clearEnvironment()
+	defer resetGlobalConfig()
+	defer clearEnvironment()
+	os.Setenv("API_KEY", "key")
+	os.Setenv("INTERACTIVE", "true")
+	os.Setenv("SKIP_LIST_FILE", "/tmp/skip.json")
+
+	config := LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.True(t, interactive)
+	assert.Equal(t, "/tmp/skip.json", skipListFile)
+
+	resetGlobalConfig()
+	os.Setenv("RUN_MODE", "cron")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "INTERACTIVE can only be used in 'once' run mode")
+}
@@ -0,0 +1,110 @@
+/**************************************************************************************************
+** Sampled runs for the Immich CLI application.
+** When trying new criteria, a run can stop after a few groups instead of going through the whole
+** library: the first groups by grouping key, or groups picked at random from a seed so the same
+** seed always gives the same sample. A sampled run is reported as such, it never covers the
+** library.
+**************************************************************************************************/
+
+package main
+
+import (
+	"math/rand"
+	"sort"
+
+	"github.com/majorfi/immich-stack/pkg/stacker"
+	"github.com/sirupsen/logrus"
+)
+
+/**************************************************************************************************
+** groupSample bounds a run to a sample of the groups. A nil sample processes every group.
+**************************************************************************************************/
+type groupSample struct {
+	size   int   // Number of groups to keep
+	random bool  // Pick the groups at random instead of the first ones by grouping key
+	seed   int64 // Seed of the random pick
+	total  int   // Number of groups before sampling
+	kept   int   // Number of groups sampled
+}
+
+/**************************************************************************************************
+** newGroupSample creates the sample of MAX_GROUPS, SAMPLE_RANDOM and --seed. It returns nil
+** when the size is 0, so the run is not sampled.
+**
+** @param size - Number of groups to keep, 0 for every group
+** @param random - Whether to pick the groups at random
+** @param seed - Seed of the random pick
+** @return *groupSample - The sample, or nil
+**************************************************************************************************/
+func newGroupSample(size int, random bool, seed int64) *groupSample {
+	if size <= 0 {
+		return nil
+	}
+	return &groupSample{size: size, random: random, seed: seed}
+}
+
+/**************************************************************************************************
+** selectGroups sorts the groups by grouping key and keeps the sample: the first ones, or a
+** random pick of the seed kept in key order. The groups are sorted first so the sample depends
+** only on the groups and the seed, not on the order the stacker formed them in.
+**
+** @param stacks - All the groups of the run
+** @return []stacker.Stack - The groups to process
+**************************************************************************************************/
+func (s *groupSample) selectGroups(stacks []stacker.Stack) []stacker.Stack {
+	if s == nil {
+		return stacks
+	}
+
+	sorted := append([]stacker.Stack(nil), stacks...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Key != sorted[j].Key {
+			return sorted[i].Key < sorted[j].Key
+		}
+		return sorted[i].Parent.ID < sorted[j].Parent.ID
+	})
+	s.total = len(sorted)
+	if len(sorted) <= s.size {
+		s.kept = len(sorted)
+		return sorted
+	}
+
+	if !s.random {
+		s.kept = s.size
+		return sorted[:s.size]
+	}
+	picked := rand.New(rand.NewSource(s.seed)).Perm(len(sorted))[:s.size]
+	sort.Ints(picked)
+	sample := make([]stacker.Stack, 0, s.size)
+	for _, i := range picked {
+		sample = append(sample, sorted[i])
+	}
+	s.kept = s.size
+	return sample
+}
+
+/**************************************************************************************************
+** sampled reports whether the sample left groups out.
+**
+** @return bool - True when the run did not process every group
+**************************************************************************************************/
+func (s *groupSample) sampled() bool {
+	return s != nil && s.kept < s.total
+}
+
+/**************************************************************************************************
+** logSample warns that the run was sampled, with how the groups were picked, so the results are
+** not taken for the whole library.
+**
+** @param logger - Logger instance for output
+**************************************************************************************************/
+func (s *groupSample) logSample(logger *logrus.Logger) {
+	if !s.sampled() {
+		return
+	}
+	if s.random {
+		logger.Warnf("🧪 Sampled run: %d of %d groups picked at random with seed %d, the others were not processed", s.kept, s.total, s.seed)
+		return
+	}
+	logger.Warnf("🧪 Sampled run: the first %d of %d groups by grouping key, the others were not processed", s.kept, s.total)
+}
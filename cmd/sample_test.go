@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/stacker"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the sampled runs of MAX_GROUPS, SAMPLE_RANDOM and --seed
+************************************************************************************************/
+
+func TestGroupSampleSelection(t *testing.T) {
+	var stacks []stacker.Stack
+	for i := 20; i > 0; i-- {
+		stacks = append(stacks, stacker.Stack{Key: fmt.Sprintf("key-%02d", i)})
+	}
+
+	sample := newGroupSample(0, true, 1)
+	assert.Nil(t, sample, "no size means no sampling")
+	assert.Equal(t, chunkKeys(stacks), chunkKeys(sample.selectGroups(stacks)), "a nil sample keeps the stacker order")
+	assert.False(t, sample.sampled())
+
+	sample = newGroupSample(3, false, 0)
+	assert.Equal(t, []string{"key-01", "key-02", "key-03"}, chunkKeys(sample.selectGroups(stacks)), "the first groups by grouping key")
+	assert.True(t, sample.sampled())
+	assert.Equal(t, 20, sample.total)
+
+	first := newGroupSample(5, true, 42).selectGroups(stacks)
+	again := newGroupSample(5, true, 42).selectGroups(stacks)
+	other := newGroupSample(5, true, 7).selectGroups(stacks)
+	require.Len(t, first, 5)
+	assert.Equal(t, chunkKeys(first), chunkKeys(again), "the same seed picks the same groups")
+	assert.NotEqual(t, chunkKeys(first), chunkKeys(other), "another seed picks other groups")
+	assert.IsIncreasing(t, chunkKeys(first), "the picked groups keep the key order")
+
+	reversed := append([]stacker.Stack(nil), stacks...)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+	assert.Equal(t, chunkKeys(first), chunkKeys(newGroupSample(5, true, 42).selectGroups(reversed)), "the pick does not depend on the stacker order")
+
+	sample = newGroupSample(50, true, 42)
+	assert.Len(t, sample.selectGroups(stacks), 20)
+	assert.False(t, sample.sampled(), "a sample larger than the groups keeps them all")
+}
+
+func TestRunStackerOnceSampled(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+	eventsFormat = eventsNDJSON
+	dryRun = true
+	maxGroups = 2
+
+	var assets []utils.TAsset
+	for i := 1; i <= 5; i++ {
+		at := fmt.Sprintf("2024-01-01T1%d:00:00Z", i)
+		assets = append(assets,
+			utils.TAsset{ID: fmt.Sprintf("%d-jpg", i), OriginalFileName: fmt.Sprintf("IMG_000%d.JPG", i), LocalDateTime: at},
+			utils.TAsset{ID: fmt.Sprintf("%d-dng", i), OriginalFileName: fmt.Sprintf("IMG_000%d.DNG", i), LocalDateTime: at},
+		)
+	}
+	client := &fakeClient{stacks: map[string]utils.TStack{}, assets: assets}
+	var logs, out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&logs)
+
+	require.NoError(t, runStackerOnce(client, logger, &runProgress{}, nil, nil, newEventEmitter(&out)))
+	assert.Contains(t, logs.String(), "Sampled run: the first 2 of 5 groups")
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	var end runEndEvent
+	require.NoError(t, json.Unmarshal(lines[len(lines)-1], &end))
+	assert.True(t, end.Sampled)
+	assert.Equal(t, 2, end.Stacks)
+	assert.Equal(t, 5, end.TotalGroups)
+}
+
+func TestMaxGroupsEnvVar(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	os.Setenv("API_KEY", "test-key")
+
+	os.Setenv("MAX_GROUPS", "50")
+	os.Setenv("SAMPLE_RANDOM", "true")
+	os.Setenv("SAMPLE_SEED", "7")
+	config := LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.Equal(t, 50, maxGroups)
+	assert.True(t, sampleRandom)
+	assert.Equal(t, 7, sampleSeed)
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		error string
+	}{
+		{"negative", map[string]string{"MAX_GROUPS": "-1"}, "invalid MAX_GROUPS"},
+		{"random without a size", map[string]string{"MAX_GROUPS": "0", "SAMPLE_RANDOM": "true"}, "SAMPLE_RANDOM requires MAX_GROUPS"},
+		{"with a limit", map[string]string{"MAX_GROUPS": "5", "LIMIT": "10"}, "cannot be combined with LIMIT"},
+		{"in cron mode", map[string]string{"MAX_GROUPS": "5", "RUN_MODE": "cron"}, "'once' run mode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetTestEnv()
+			os.Setenv("API_KEY", "test-key")
+			for key, value := range tt.env {
+				os.Setenv(key, value)
+			}
+			config := LoadEnvForTesting()
+			require.Error(t, config.Error)
+			assert.Contains(t, config.Error.Error(), tt.error)
+		})
+	}
+}
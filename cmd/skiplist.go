@@ -0,0 +1,364 @@
+/**************************************************************************************************
+** Skip list for the Immich CLI application.
+** The skip list remembers the stacks the user rejected, so later runs never propose them again.
+** A rejection is either a grouping key, recorded by the interactive review, or a set of assets
+** never to be stacked together, recorded by the reject command or learned from the stacks of
+** the tool that were deleted by hand. The stacks created by the tool are recorded as well, so a
+** stack deleted by hand is not created again with the same members. The file also holds the
+** journal of the stack replacements in progress, see journal.go.
+**************************************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/majorfi/immich-stack/pkg/stacker"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+/**************************************************************************************************
+** skipList is the persistent list of rejected stacks. A nil skip list skips nothing.
+**************************************************************************************************/
+type skipList struct {
+	path      string
+	keys      map[string]bool
+	assetSets [][]string     // Assets never to be stacked together, each set sorted
+	created   [][]string     // Stacks created by the tool, to detect the ones deleted by hand
+	deleted   [][]string     // Stacks created by the tool and deleted by hand, not created again
+	journal   []journalEntry // Stack replacements started and not completed yet
+}
+
+/**************************************************************************************************
+** skipListContent is the JSON layout of the skip list file.
+**************************************************************************************************/
+type skipListContent struct {
+	Keys      []string       `json:"keys"`
+	AssetSets [][]string     `json:"assetSets,omitempty"`
+	Created   [][]string     `json:"created,omitempty"`
+	Deleted   [][]string     `json:"deleted,omitempty"`
+	Journal   []journalEntry `json:"journal,omitempty"`
+}
+
+/**************************************************************************************************
+** defaultSkipListPath returns the skip list location in the data directory, or an empty string
+** when there is none.
+**
+** @return string - Path of the skip list file
+**************************************************************************************************/
+func defaultSkipListPath() string {
+	dir := defaultDataDir()
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "skip-list.json")
+}
+
+/**************************************************************************************************
+** loadSkipList reads the skip list file. A missing file is an empty skip list, and an empty
+** path disables the skip list. A file holding a plain array of grouping keys is still read.
+**
+** @param path - Path of the skip list file
+** @return *skipList - The skip list, or nil when disabled
+** @return error - An error if the file cannot be read or parsed
+**************************************************************************************************/
+func loadSkipList(path string) (*skipList, error) {
+	if path == "" {
+		return nil, nil
+	}
+	list := &skipList{path: path, keys: make(map[string]bool)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return list, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading skip list %s: %w", path, err)
+	}
+
+	var content skipListContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		if json.Unmarshal(data, &content.Keys) != nil {
+			return nil, fmt.Errorf("invalid skip list %s: %w", path, err)
+		}
+	}
+	for _, key := range content.Keys {
+		list.keys[key] = true
+	}
+	list.assetSets = content.AssetSets
+	list.created = content.Created
+	list.deleted = content.Deleted
+	list.journal = content.Journal
+	return list, nil
+}
+
+/**************************************************************************************************
+** filter removes the stacks whose grouping key is rejected, that hold two assets or more of a
+** rejected asset set, or whose members are those of a stack deleted by hand.
+**
+** @param stacks - Stacks built by the stacker
+** @param logger - Logger instance for output
+** @return []stacker.Stack - The stacks not skipped
+**************************************************************************************************/
+func (s *skipList) filter(stacks []stacker.Stack, logger *logrus.Logger) []stacker.Stack {
+	if s == nil || (len(s.keys) == 0 && len(s.assetSets) == 0 && len(s.deleted) == 0) {
+		return stacks
+	}
+	kept := make([]stacker.Stack, 0, len(stacks))
+	for _, stack := range stacks {
+		if s.keys[stack.Key] {
+			logger.Infof("⏭️  Skipping stack %s, its grouping key was rejected (%s)", stack.Key, s.path)
+			continue
+		}
+		if set := s.rejectedSet(stack.Members); set != nil {
+			logger.Infof("⏭️  Skipping stack %s, it joins assets rejected together: %v (%s)", stack.Key, set, s.path)
+			continue
+		}
+		if s.wasDeleted(stack.Members) {
+			logger.Infof("⏭️  Skipping stack %s, it was deleted by hand since the tool created it (use --force-restack to create it again)", stack.Key)
+			continue
+		}
+		kept = append(kept, stack)
+	}
+	return kept
+}
+
+/**************************************************************************************************
+** rejectedSet returns the first rejected asset set holding two members of the stack or more.
+**
+** @param members - Members of a stack
+** @return []string - The rejected asset set, or nil
+**************************************************************************************************/
+func (s *skipList) rejectedSet(members []utils.TAsset) []string {
+	ids := make(map[string]bool, len(members))
+	for _, member := range members {
+		ids[member.ID] = true
+	}
+	for _, set := range s.assetSets {
+		together := 0
+		for _, id := range set {
+			if ids[id] {
+				together++
+			}
+		}
+		if together >= 2 {
+			return set
+		}
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** wasDeleted reports whether the members are exactly those of a stack deleted by hand.
+**
+** @param members - Members of a stack
+** @return bool - True when the same stack was deleted by hand
+**************************************************************************************************/
+func (s *skipList) wasDeleted(members []utils.TAsset) bool {
+	ids := make([]string, 0, len(members))
+	for _, member := range members {
+		ids = append(ids, member.ID)
+	}
+	set := sortedSet(ids)
+	for _, deleted := range s.deleted {
+		if utils.AreArraysEqual(deleted, set) {
+			return true
+		}
+	}
+	return false
+}
+
+/**************************************************************************************************
+** add records a rejected grouping key and saves the skip list right away, so an interrupted
+** review keeps its answers.
+**
+** @param key - Grouping key of the rejected stack
+** @return error - An error if the skip list cannot be written
+**************************************************************************************************/
+func (s *skipList) add(key string) error {
+	if s == nil {
+		return nil
+	}
+	s.keys[key] = true
+	return s.save()
+}
+
+/**************************************************************************************************
+** addAssetSet records assets that must never be stacked together and saves the skip list.
+**
+** @param assetIDs - IDs of the rejected assets
+** @return error - An error if the skip list cannot be written
+**************************************************************************************************/
+func (s *skipList) addAssetSet(assetIDs []string) error {
+	if s == nil || len(assetIDs) < 2 {
+		return nil
+	}
+	set := sortedSet(assetIDs)
+	for _, existing := range s.assetSets {
+		if utils.AreArraysEqual(existing, set) {
+			return nil
+		}
+	}
+	s.assetSets = append(s.assetSets, set)
+	return s.save()
+}
+
+/**************************************************************************************************
+** tracksCreatedStacks reports whether the run records the stacks it applies in the skip list.
+** Without SKIP_LIST_FILE, FORCE_RESTACK or AUTO_LEARN_REJECTIONS, nobody asked for the stacks
+** deleted by hand to be detected, and a plain run writes no file to the default path.
+**
+** @return bool - True when the applied stacks are recorded
+**************************************************************************************************/
+func tracksCreatedStacks() bool {
+	return skipListFileSet || forceRestack || autoLearnRejections
+}
+
+/**************************************************************************************************
+** recordCreated remembers a stack applied by the tool, replacing the recorded stacks sharing
+** an asset with it, deleted ones included. The skip list is saved by the caller at the end of
+** the run.
+**
+** @param assetIDs - IDs of the members of the applied stack
+**************************************************************************************************/
+func (s *skipList) recordCreated(assetIDs []string) {
+	if s == nil {
+		return
+	}
+	set := sortedSet(assetIDs)
+	members := make(map[string]bool, len(set))
+	for _, id := range set {
+		members[id] = true
+	}
+	s.created = append(withoutOverlapping(s.created, members), set)
+	s.deleted = withoutOverlapping(s.deleted, members)
+}
+
+/**************************************************************************************************
+** forgetCreated forgets the recorded stacks sharing an asset with a stack the tool dissolved, so
+** it is not taken as deleted by hand on the next run.
+**
+** @param assetIDs - IDs of the members of the dissolved stack
+**************************************************************************************************/
+func (s *skipList) forgetCreated(assetIDs []string) {
+	if s == nil {
+		return
+	}
+	members := make(map[string]bool, len(assetIDs))
+	for _, id := range assetIDs {
+		members[id] = true
+	}
+	s.created = withoutOverlapping(s.created, members)
+}
+
+/**************************************************************************************************
+** withoutOverlapping returns the sets sharing no asset with the members.
+**
+** @param sets - Recorded asset sets
+** @param members - IDs of the members, as a set
+** @return [][]string - The sets kept
+**************************************************************************************************/
+func withoutOverlapping(sets [][]string, members map[string]bool) [][]string {
+	kept := sets[:0]
+	for _, set := range sets {
+		overlaps := false
+		for _, id := range set {
+			overlaps = overlaps || members[id]
+		}
+		if !overlaps {
+			kept = append(kept, set)
+		}
+	}
+	return kept
+}
+
+/**************************************************************************************************
+** detectDeletedStacks finds the stacks created by the tool that were deleted by hand since: no
+** existing stack holds two of their assets anymore. They are not created again with the same
+** members, and with learn their assets are never stacked together again.
+**
+** @param existingStacks - Stacks fetched from Immich, by asset ID
+** @param learn - Whether to reject the assets of the deleted stacks for good
+** @param logger - Logger instance for output
+**************************************************************************************************/
+func (s *skipList) detectDeletedStacks(existingStacks map[string]utils.TStack, learn bool, logger *logrus.Logger) {
+	if s == nil || len(s.created) == 0 {
+		return
+	}
+	kept := make([][]string, 0, len(s.created))
+	for _, set := range s.created {
+		perStack := make(map[string]int)
+		intact := false
+		for _, id := range set {
+			if stack, ok := existingStacks[id]; ok {
+				perStack[stack.ID]++
+				intact = intact || perStack[stack.ID] >= 2
+			}
+		}
+		if intact {
+			kept = append(kept, set)
+			continue
+		}
+		if learn {
+			logger.Infof("🧠 Stack of %v was deleted by hand, never stacking these assets together again", set)
+			s.assetSets = append(s.assetSets, set)
+			continue
+		}
+		logger.Debugf("Stack of %v was deleted by hand, not creating it again", set)
+		s.deleted = append(s.deleted, set)
+	}
+	s.created = kept
+}
+
+/**************************************************************************************************
+** forgetDeleted forgets the stacks deleted by hand, so they can be created again.
+**************************************************************************************************/
+func (s *skipList) forgetDeleted() {
+	if s != nil {
+		s.deleted = nil
+	}
+}
+
+/**************************************************************************************************
+** save writes the skip list file, creating its directory if needed.
+**
+** @return error - An error if the skip list cannot be written
+**************************************************************************************************/
+func (s *skipList) save() error {
+	if s == nil {
+		return nil
+	}
+	content := skipListContent{Keys: make([]string, 0, len(s.keys)), AssetSets: s.assetSets, Created: s.created, Deleted: s.deleted, Journal: s.journal}
+	for key := range s.keys {
+		content.Keys = append(content.Keys, key)
+	}
+	sort.Strings(content.Keys)
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding skip list: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("error creating skip list directory: %w", err)
+	}
+	if err := os.WriteFile(s.path, data, 0644); err != nil {
+		return fmt.Errorf("error writing skip list %s: %w", s.path, err)
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** sortedSet returns a sorted copy of the IDs, so sets compare and serialize the same way.
+**
+** @param ids - Asset IDs
+** @return []string - The sorted IDs
+**************************************************************************************************/
+func sortedSet(ids []string) []string {
+	set := append([]string(nil), ids...)
+	sort.Strings(set)
+	return set
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/stacker"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the skip list of rejected stacks
+************************************************************************************************/
+
+func TestSkipList(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	path := filepath.Join(t.TempDir(), "nested", "skip-list.json")
+
+	disabled, err := loadSkipList("")
+	require.NoError(t, err)
+	assert.Nil(t, disabled)
+	stacks := []stacker.Stack{{Key: "a"}, {Key: "b"}, {Key: "c"}}
+	assert.Equal(t, stacks, disabled.filter(stacks, logger))
+	assert.NoError(t, disabled.add("a"))
+
+	list, err := loadSkipList(path)
+	require.NoError(t, err, "a missing file is an empty skip list")
+	require.NoError(t, list.add("c"))
+	require.NoError(t, list.add("a"))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"keys":["a","c"]}`, string(data))
+
+	reloaded, err := loadSkipList(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b"}, chunkKeys(reloaded.filter(stacks, logger)))
+
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0644))
+	_, err = loadSkipList(path)
+	assert.ErrorContains(t, err, "invalid skip list")
+}
+
+func TestSkipListLegacyArray(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "skip-list.json")
+	require.NoError(t, os.WriteFile(path, []byte(`["a","b"]`), 0644))
+
+	list, err := loadSkipList(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"a": true, "b": true}, list.keys)
+}
+
+func TestSkipListAssetSets(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	list, err := loadSkipList(filepath.Join(t.TempDir(), "skip-list.json"))
+	require.NoError(t, err)
+
+	require.NoError(t, list.addAssetSet([]string{"3", "1", "2"}))
+	require.NoError(t, list.addAssetSet([]string{"1", "2", "3"}))
+	require.NoError(t, list.addAssetSet([]string{"9"}))
+	assert.Equal(t, [][]string{{"1", "2", "3"}}, list.assetSets, "sets are sorted, deduplicated and need two assets")
+
+	members := func(ids ...string) []utils.TAsset {
+		assets := make([]utils.TAsset, len(ids))
+		for i, id := range ids {
+			assets[i] = utils.TAsset{ID: id}
+		}
+		return assets
+	}
+	stacks := []stacker.Stack{
+		{Key: "a", Members: members("1", "2")},
+		{Key: "b", Members: members("3", "4")},
+		{Key: "c", Members: members("1", "2", "3", "4")},
+	}
+	assert.Equal(t, []string{"b"}, chunkKeys(list.filter(stacks, logger)), "a stack joining two rejected assets is skipped")
+
+	reloaded, err := loadSkipList(list.path)
+	require.NoError(t, err)
+	assert.Equal(t, list.assetSets, reloaded.assetSets)
+}
+
+func TestSkipListLearnDeletedStacks(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	list, err := loadSkipList(filepath.Join(t.TempDir(), "skip-list.json"))
+	require.NoError(t, err)
+
+	list.recordCreated([]string{"2", "1"})
+	list.recordCreated([]string{"3", "4"})
+	list.recordCreated([]string{"5", "6"})
+	list.recordCreated([]string{"4", "7"})
+	assert.Equal(t, [][]string{{"1", "2"}, {"5", "6"}, {"4", "7"}}, list.created, "a new stack replaces the ones it overlaps")
+
+	kept := utils.TStack{ID: "s1"}
+	trashed := utils.TStack{ID: "s3"}
+	existing := map[string]utils.TStack{
+		"1": kept, "2": kept,
+		"7": trashed,
+	}
+	list.detectDeletedStacks(existing, true, logger)
+	assert.Equal(t, [][]string{{"1", "2"}}, list.created)
+	assert.Equal(t, [][]string{{"5", "6"}, {"4", "7"}}, list.assetSets, "stacks with fewer than two assets left are learned")
+	assert.Empty(t, list.deleted)
+
+	require.NoError(t, list.save())
+	reloaded, err := loadSkipList(list.path)
+	require.NoError(t, err)
+	assert.Equal(t, list.assetSets, reloaded.assetSets)
+	assert.Equal(t, list.created, reloaded.created)
+}
+
+func TestSkipListDeletedStacks(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	list, err := loadSkipList(filepath.Join(t.TempDir(), "skip-list.json"))
+	require.NoError(t, err)
+
+	list.recordCreated([]string{"1", "2"})
+	list.recordCreated([]string{"3", "4"})
+	list.detectDeletedStacks(map[string]utils.TStack{"3": {ID: "s2"}, "4": {ID: "s2"}}, false, logger)
+	assert.Equal(t, [][]string{{"3", "4"}}, list.created)
+	assert.Equal(t, [][]string{{"1", "2"}}, list.deleted)
+	assert.Empty(t, list.assetSets, "without learning the assets are not rejected")
+
+	stacks := []stacker.Stack{
+		{Key: "same", Members: []utils.TAsset{{ID: "2"}, {ID: "1"}}},
+		{Key: "grown", Members: []utils.TAsset{{ID: "1"}, {ID: "2"}, {ID: "5"}}},
+	}
+	kept := list.filter(stacks, logger)
+	require.Len(t, kept, 1)
+	assert.Equal(t, "grown", kept[0].Key, "only the same members are not created again")
+
+	require.NoError(t, list.save())
+	reloaded, err := loadSkipList(list.path)
+	require.NoError(t, err)
+	assert.Equal(t, list.deleted, reloaded.deleted)
+
+	reloaded.forgetDeleted()
+	assert.Len(t, reloaded.filter(stacks, logger), 2, "forced stacks are created again")
+
+	list.recordCreated([]string{"1", "2", "5"})
+	assert.Empty(t, list.deleted, "a new stack of the assets replaces the deleted one")
+}
+
+func TestSkipListRecordsOnlyWhenAsked(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+		{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+	}
+
+	// The default path is used for the rejections, but a plain run writes nothing to it
+	skipListFile = filepath.Join(t.TempDir(), "skip-list.json")
+	require.NoError(t, runStackerOnce(&fakeClient{stacks: map[string]utils.TStack{}, assets: assets}, logger, nil, nil, nil, nil))
+	_, err := os.Stat(skipListFile)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	skipListFileSet = true
+	require.NoError(t, runStackerOnce(&fakeClient{stacks: map[string]utils.TStack{}, assets: assets}, logger, nil, nil, nil, nil))
+	list, err := loadSkipList(skipListFile)
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"1", "2"}}, list.created)
+}
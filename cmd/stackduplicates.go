@@ -0,0 +1,56 @@
+/**************************************************************************************************
+** Duplicates in stacks report for the Immich CLI application.
+** A file uploaded twice lands in the same stack as its copy. With DUPLICATES_REPORT, every run
+** writes these copies to a CSV file so they can be cleaned up in Immich.
+**************************************************************************************************/
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/majorfi/immich-stack/pkg/stacker"
+)
+
+// Header of the duplicates in stacks report
+var duplicatesReportHeader = []string{"stackKey", "checksum", "originalFileName", "assetId", "originalPath", "parent"}
+
+/**************************************************************************************************
+** Writes the copies of a same file found in the stacks to a CSV file, one line per copy. The file
+** is replaced on every run, so it only lists the duplicates still in the library.
+**
+** @param path - Path of the CSV file
+** @param stacks - Stacks built from the criteria
+** @return int - Number of sets of copies written
+** @return error - An error if the report cannot be written
+**************************************************************************************************/
+func writeDuplicatesReport(path string, stacks []stacker.Stack) (int, error) {
+	records := [][]string{duplicatesReportHeader}
+	sets := 0
+	for _, stack := range stacks {
+		for _, copies := range stacker.IdenticalDuplicates(stack.Members) {
+			sets++
+			for _, asset := range copies {
+				records = append(records, []string{stack.Key, asset.Checksum, asset.OriginalFileName, asset.ID, asset.OriginalPath, strconv.FormatBool(asset.ID == stack.Parent.ID)})
+			}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, fmt.Errorf("error creating duplicates report directory: %w", err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("error writing duplicates report %s: %w", path, err)
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	if err := writer.WriteAll(records); err != nil {
+		return 0, fmt.Errorf("error writing duplicates report %s: %w", path, err)
+	}
+	return sets, nil
+}
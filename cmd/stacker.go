@@ -6,140 +6,252 @@
 package main
 
 import (
-	"strings"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
 	"time"
 
 	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/orchestrator"
 	"github.com/majorfi/immich-stack/pkg/stacker"
 	"github.com/majorfi/immich-stack/pkg/utils"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+// runTracer records the spans of the runs, nil unless OTEL_EXPORTER_OTLP_ENDPOINT is set
+var runTracer *utils.Tracer
+
+/**************************************************************************************************
+** Outcome of a stack in the dry run diff.
+**************************************************************************************************/
+const (
+	stackDiffNew       = orchestrator.DiffNew
+	stackDiffUnchanged = orchestrator.DiffUnchanged
+	stackDiffModified  = orchestrator.DiffModified
+)
+
 /**************************************************************************************************
-** Extracts parent and child asset IDs from a stack of assets. The first asset is considered
-** the parent, while subsequent assets are treated as children. This function is used when
-** creating new stacks or modifying existing ones.
+** Tally of the dry run diff: how many stacks would be created, left unchanged, modified and
+** deleted. Deleted stacks are tracked by ID as several new stacks can replace the same one.
+**************************************************************************************************/
+type stackDiffTally struct {
+	created   int
+	unchanged int
+	modified  int
+	deleted   map[string]bool
+}
+
+/**************************************************************************************************
+** Records the outcome of a stack in the tally.
 **
-** @param stack - Array of assets to process
-** @return parentID - ID of the parent asset
-** @return childrenIDs - Array of child asset IDs
-** @return newStackIDs - Combined array of parent and child IDs
+** @param status - Outcome of the stack (stackDiffNew, stackDiffUnchanged or stackDiffModified)
+** @param deletedStackIDs - IDs of the existing stacks deleted to build this one
 **************************************************************************************************/
-func getParentAndChildrenIDs(stack []utils.TAsset) (string, []string, []string) {
-	parentID := stack[0].ID
-	childrenIDs := make([]string, 0, len(stack)-1)
-	for _, asset := range stack[1:] {
-		if asset.ID != parentID {
-			childrenIDs = append(childrenIDs, asset.ID)
+func (t *stackDiffTally) add(status string, deletedStackIDs []string) {
+	switch status {
+	case stackDiffNew:
+		t.created++
+	case stackDiffUnchanged:
+		t.unchanged++
+	case stackDiffModified:
+		t.modified++
+	}
+	for _, stackID := range deletedStackIDs {
+		if t.deleted == nil {
+			t.deleted = make(map[string]bool)
 		}
+		t.deleted[stackID] = true
 	}
-	newStackIDs := append([]string{parentID}, utils.RemoveEmptyStrings(childrenIDs)...)
-	return parentID, childrenIDs, newStackIDs
 }
 
 /**************************************************************************************************
-** Retrieves the original stack configuration from Immich for a given stack of assets.
-** This is used to compare existing stacks with proposed new configurations.
+** Builds a diff-style description of a proposed stack against the stack currently on the server.
+** Members and parent only in the existing stack are marked with "-", the ones only in the
+** proposed stack with "+", and the ones in both are left unmarked.
 **
-** @param stack - Array of assets to process
-** @return parentID - ID of the parent asset in existing stack
-** @return childrenIDs - Array of child asset IDs in existing stack
-** @return originalStackIDs - Combined array of existing parent and child IDs
+** @param stack - Proposed stack of assets, parent first
+** @return []string - Diff lines, parent first then members
 **************************************************************************************************/
-func getOriginalStackIDs(stack []utils.TAsset) (string, []string, []string) {
-	if len(stack) == 0 {
-		return "", nil, nil
-	}
-
+func buildStackDiff(stack []utils.TAsset) []string {
+	names := make(map[string]string, len(stack))
 	var existingStack *utils.TStack
 	for _, asset := range stack {
-		if asset.Stack != nil {
+		if existingStack == nil && asset.Stack != nil {
 			existingStack = asset.Stack
-			break
 		}
 	}
-
-	if existingStack == nil {
-		return "", nil, nil
+	if existingStack != nil {
+		for _, asset := range existingStack.Assets {
+			names[asset.ID] = asset.OriginalFileName
+		}
+	}
+	for _, asset := range stack {
+		names[asset.ID] = asset.OriginalFileName
+	}
+	name := func(assetID string) string {
+		if names[assetID] == "" {
+			return assetID
+		}
+		return names[assetID]
 	}
 
-	parentID := existingStack.PrimaryAssetID
+	existingParentID, _, existingIDs := orchestrator.OriginalStackIDs(stack)
+	proposedParentID, _, proposedIDs := orchestrator.ParentAndChildrenIDs(stack)
 
-	if len(existingStack.Assets) == 0 {
-		return parentID, nil, []string{parentID}
+	lines := make([]string, 0, len(proposedIDs)+len(existingIDs)+2)
+	switch existingParentID {
+	case "":
+		lines = append(lines, fmt.Sprintf("parent: + %s", name(proposedParentID)))
+	case proposedParentID:
+		lines = append(lines, fmt.Sprintf("parent:   %s", name(proposedParentID)))
+	default:
+		lines = append(lines, fmt.Sprintf("parent: - %s", name(existingParentID)))
+		lines = append(lines, fmt.Sprintf("parent: + %s", name(proposedParentID)))
 	}
 
-	childrenIDs := make([]string, 0, len(existingStack.Assets)-1)
-	for _, asset := range existingStack.Assets {
-		if asset.ID != parentID {
-			childrenIDs = append(childrenIDs, asset.ID)
+	existing := make(map[string]bool, len(existingIDs))
+	for _, assetID := range existingIDs {
+		existing[assetID] = true
+	}
+	proposed := make(map[string]bool, len(proposedIDs))
+	for _, assetID := range proposedIDs {
+		proposed[assetID] = true
+		if existing[assetID] {
+			lines = append(lines, fmt.Sprintf("  %s", name(assetID)))
+		} else {
+			lines = append(lines, fmt.Sprintf("+ %s", name(assetID)))
 		}
 	}
-
-	originalStackIDs := append([]string{parentID}, childrenIDs...)
-	return parentID, childrenIDs, originalStackIDs
+	for _, assetID := range existingIDs {
+		if !proposed[assetID] {
+			lines = append(lines, fmt.Sprintf("- %s", name(assetID)))
+		}
+	}
+	return lines
 }
 
 /**************************************************************************************************
-** Validates if a proposed stack configuration is valid. A valid stack must have at least
-** one child asset and the parent asset must not be listed as a child.
+** Logs the dry run diff of a stack, unless it is unchanged and only changes are requested. A key
+** rendered by STACK_KEY_TEMPLATE is logged with the criteria values it came from, quoted as they
+** hold filenames.
 **
-** @param newStackIDs - Array of asset IDs to validate
-** @return bool - True if the stack configuration is valid
+** @param logger - Logger instance for outputting the diff
+** @param group - Proposed stack, members parent first
+** @param status - Outcome of the stack (stackDiffNew, stackDiffUnchanged or stackDiffModified)
 **************************************************************************************************/
-func isValidStack(newStackIDs []string) bool {
-	newStackIDs = utils.RemoveEmptyStrings(newStackIDs)
-	if len(newStackIDs) <= 1 {
-		return false
+func logStackDiff(logger *logrus.Logger, group stacker.Stack, status string) {
+	if status == stackDiffUnchanged && diffOnlyChanges {
+		return
 	}
-	parentID := newStackIDs[0]
-	for _, childID := range newStackIDs[1:] {
-		if childID == parentID {
-			return false
-		}
+	logger.Logf(stackLogLevel(), "\t📝 Diff (%s):", status)
+	if len(group.Values) > 0 {
+		logger.Logf(stackLogLevel(), "\t  key: %q from values %q", group.Key, group.Values)
+	}
+	for _, line := range buildStackDiff(group.Members) {
+		logger.Logf(stackLogLevel(), "\t  %s", line)
 	}
-	return true
 }
 
 /**************************************************************************************************
-** Determines if a stack needs to be updated by comparing original and expected configurations.**
-** Takes into account the replaceStacks flag to decide whether to force updates.
+** Returns the level of the routine per-stack messages, lowered to debug by QUIET so a run only
+** logs its warnings, errors and summary.
 **
-** @param originalStack - Array of IDs from existing stack
-** @param expectedStack - Array of IDs from proposed new stack
-** @return bool - True if the stack needs to be updated
+** @return logrus.Level - Debug in quiet mode, info otherwise
 **************************************************************************************************/
-func needsStackUpdate(originalStack, expectedStack []string) bool {
-	if len(expectedStack) <= 1 {
-		return false
+func stackLogLevel() logrus.Level {
+	if quiet {
+		return logrus.DebugLevel
+	}
+	return logrus.InfoLevel
+}
+
+/**************************************************************************************************
+** Logs the dry run tally once every stack has been processed.
+**
+** @param logger - Logger instance for outputting the tally
+** @param tally - Tally of the dry run diff
+**************************************************************************************************/
+func logStackDiffTally(logger *logrus.Logger, tally stackDiffTally) {
+	logger.Infof("--------------------------------")
+	logger.Infof("🧾 Dry run summary: %d new, %d unchanged, %d modified, %d deleted",
+		tally.created, tally.unchanged, tally.modified, len(tally.deleted))
+}
+
+/**************************************************************************************************
+** Logs the number of stacks of each criteria profile and how many were applied, in the order
+** of the profiles. Nothing is logged without profiles.
+**
+** @param logger - Logger instance for outputting the summary
+** @param grouped - Stacks of the run
+** @param applied - Number of stacks applied, by profile
+**************************************************************************************************/
+func logProfileSummary(logger *logrus.Logger, grouped []stacker.Stack, applied map[string]int) {
+	if len(profileList) == 0 {
+		return
 	}
-	if len(originalStack) != len(expectedStack) {
-		return true
+	counts := make(map[string]int)
+	for _, stack := range grouped {
+		counts[stack.Profile]++
 	}
+	logger.Infof("--------------------------------")
+	for _, name := range append(profileNames(), utils.DefaultProfileName) {
+		logger.Infof("🗂️  Profile %s: %d stacks, %d applied", name, counts[name], applied[name])
+	}
+}
+
+/**************************************************************************************************
+** Tracks what a stacker run is doing, so a recovered panic can report the group key and the
+** asset IDs involved. A nil progress ignores updates.
+**************************************************************************************************/
+type runProgress struct {
+	phase    string
+	key      string
+	assetIDs []string
+}
 
-	if !utils.AreArraysEqual(originalStack, expectedStack) && replaceStacks {
-		return true
+/**************************************************************************************************
+** Records the current phase of the run, with the group key and asset IDs being processed.
+**
+** @param phase - Current phase (fetching, stacking, applying)
+** @param key - Group key being processed, if any
+** @param assetIDs - IDs of the assets being processed, if any
+**************************************************************************************************/
+func (p *runProgress) set(phase string, key string, assetIDs []string) {
+	if p == nil {
+		return
 	}
-	return false
+	p.phase = phase
+	p.key = key
+	p.assetIDs = assetIDs
 }
 
 /**************************************************************************************************
-** Identifies any child assets that are already part of existing stacks. This is used to
-** prevent conflicts when creating new stacks and to handle stack replacement scenarios.
+** Runs a stacker run and recovers from any panic it raises, logging the panic with its stack
+** trace and the progress of the run, so a cron loop survives to the next scheduled run. With
+** PANIC_FATAL, panics are not recovered.
 **
-** @param stack - Array of assets to check
-** @return []string - Array of stack IDs where conflicts were found
-** @return bool - True if any conflicts were found
+** @param logger - Logger instance for outputting the recovered panic
+** @param progress - Progress of the run, updated by run
+** @param run - The run to protect
+** @return error - The error returned by run, or nil when a panic was recovered
 **************************************************************************************************/
-func getChildrenWithStack(stack []utils.TAsset) ([]string, bool) {
-	childrenWithStack := make([]string, 0)
-	for _, asset := range stack[1:] {
-		if asset.Stack != nil {
-			childrenWithStack = append(childrenWithStack, asset.Stack.ID)
-		}
+func runWithPanicRecovery(logger *logrus.Logger, progress *runProgress, run func() error) (err error) {
+	if panicFatal {
+		return run()
 	}
-	return childrenWithStack, len(childrenWithStack) > 0
+	defer func() {
+		if r := recover(); r != nil {
+			logger.WithFields(logrus.Fields{
+				"phase":    progress.phase,
+				"key":      progress.key,
+				"assetIds": progress.assetIDs,
+			}).Errorf("💥 Recovered from panic: %v\n%s", r, debug.Stack())
+			err = nil
+		}
+	}()
+	return run()
 }
 
 /**************************************************************************************************
@@ -149,47 +261,122 @@ func getChildrenWithStack(stack []utils.TAsset) ([]string, bool) {
 **
 ** @param cmd - Cobra command instance
 ** @param args - Command line arguments
+** @return error - Categorized error mapped to the exit code by main, or nil
 **************************************************************************************************/
-func runStacker(cmd *cobra.Command, args []string) {
-	logger := loadEnv()
+func runStacker(cmd *cobra.Command, args []string) error {
+	logger, err := loadEnv()
+	if err != nil {
+		return err
+	}
+	if _, err := stacker.ParseCriteria(criteria); err != nil {
+		return configError(fmt.Errorf("invalid criteria: %w", err))
+	}
 
 	/**********************************************************************************************
-	** Support multiple API keys (comma-separated).
+	** Support multiple API keys (comma-separated), each with its server.
 	**********************************************************************************************/
-	apiKeys := utils.RemoveEmptyStrings(func(keys []string) []string {
-		for i, key := range keys {
-			keys[i] = strings.TrimSpace(key)
+	targets, err := apiTargets()
+	if err != nil {
+		return err
+	}
+	if resumeToken != "" && len(targets) > 1 {
+		return configError(fmt.Errorf("a resume token only applies to a single API key"))
+	}
+	chunk, err := newStackChunk(limit, runDeadline(), resumeToken)
+	if err != nil {
+		return configError(err)
+	}
+	var reviewer *stackReviewer
+	if interactive {
+		if !isTerminal(os.Stdin) {
+			return configError(fmt.Errorf("--interactive requires a terminal, stdin is not a TTY"))
 		}
-		return keys
-	}(strings.Split(apiKey, ",")))
-	if len(apiKeys) == 0 {
-		logger.Fatalf("No API key(s) provided.")
+		reviewer = newStackReviewer(os.Stdin, os.Stdout)
 	}
+	events := newEventEmitter(os.Stdout)
+	runTracer = utils.NewTracer(otlpEndpoint, "immich-stack", version)
+	runAudit = newAuditTrail(auditLog, logger)
 
 	if runMode == "cron" {
-		logger.Infof("Running in cron mode with interval of %d seconds", cronInterval)
-		runCronLoopForAllUsers(apiKeys, apiURL, logger)
-	} else {
-		for i, key := range apiKeys {
-			if i > 0 {
-				logger.Infof("\n")
-			}
-			client := immich.NewClient(apiURL, key, resetStacks, replaceStacks, dryRun, withArchived, withDeleted, removeSingleAssetStacks, filterAlbumIDs, filterTakenAfter, filterTakenBefore, logger)
-			if client == nil {
-				logger.Errorf("Invalid client for API key: %s", key)
-				continue
-			}
-			user, err := client.GetCurrentUser()
-			if err != nil {
-				logger.Errorf("Failed to fetch user for API key: %s: %v", key, err)
-				continue
-			}
-			logger.Infof("=====================================================================================")
-			logger.Infof("Running for user: %s (%s)", user.Name, user.Email)
-			logger.Infof("=====================================================================================")
-			logger.Info("Running in once mode")
-			runStackerOnce(client, logger)
+		logger.Infof("Running in cron mode every %s", formatSeconds(cronInterval))
+		return runCronLoopForAllUsers(targets, logger, events)
+	}
+
+	var runErr error
+	for i, target := range targets {
+		if i > 0 {
+			logger.Infof("\n")
+		}
+		client := immich.NewClient(target.URL, target.Key, resetStacks, replaceStacks, dryRun, withArchived, withDeleted, removeSingleAssetStacks, filterAlbumIDs, filterTakenAfter, filterTakenBefore, stackMarker, resetMarkedOnly, withExif, prefetchFilenameQuery, logger)
+		if client == nil {
+			logger.Errorf("Invalid client for API key: %s", target.Key)
+			runErr = worstError(runErr, configError(fmt.Errorf("invalid client for API key: %s", target.Key)))
+			continue
 		}
+		setProxyAuth(client)
+		client.SetQuiet(quiet)
+		client.SetOnlyNewStacks(onlyNewStacks)
+		client.SetTagParentWith(tagParentWith)
+		client.SetWithHidden(withHidden)
+		client.SetStackHook(runAudit.hook())
+		if err := client.CheckAPIURL(strictURL); err != nil {
+			logger.Errorf("Invalid API_URL for API key: %s: %v", target.Key, err)
+			runErr = worstError(runErr, configError(err))
+			continue
+		}
+		user, err := client.GetCurrentUser()
+		if err != nil {
+			logger.Errorf("Failed to fetch user for API key: %s: %v", target.Key, err)
+			runErr = worstError(runErr, fatalError(fmt.Errorf("failed to fetch user: %w", err)))
+			continue
+		}
+		logger.Infof("=====================================================================================")
+		logger.Infof("Running for user: %s (%s) on %s", user.Name, user.Email, target.host())
+		logger.Infof("=====================================================================================")
+		logger.Info("Running in once mode")
+		runErr = worstError(runErr, runStackerOnce(client, logger, nil, chunk, reviewer, events))
+	}
+	return runErr
+}
+
+/**************************************************************************************************
+** stackerOptions returns the grouping options of the configuration, shared by the run and the
+** commands that group the assets the way a run would. PARENT_SELECTOR_CMD is left out: the run
+** applies it to the stacks it creates or changes only.
+**
+** @param span - Span of the grouping (may be nil)
+** @param logger - Logger instance for output
+** @return stacker.Options - The options of the stacker
+**************************************************************************************************/
+func stackerOptions(span *utils.Span, logger *logrus.Logger) stacker.Options {
+	return stacker.Options{
+		Criteria:              criteria,
+		ParentFilenamePromote: parentFilenamePromote,
+		ParentExtPromote:      parentExtPromote,
+		PromoteOrder:          promoteOrder,
+		ExtRankFallback:       extRankFallback,
+		Delimiters:            delimiterList,
+		EditedSuffixes:        editedSuffixList,
+		PromoteResolved:       true,
+		Profiles:              profileList,
+		UnionMode:             unionMode,
+		UnionLogSize:          unionLogSize,
+		MaxTimeBucket:         maxTimeBucket,
+		SkipMatchMiss:         skipMatchMiss,
+		MaxAssetErrors:        maxAssetErrors,
+		DebugSample:           debugSample,
+		StackKeyTemplate:      stackKeyTemplate,
+		CrossLibraryStacking:  crossLibraryStacking,
+		CrossOwnerStacking:    crossOwnerStacking,
+		MaxStackTimeSpread:    maxStackTimeSpread,
+		TimeSpreadAction:      maxStackTimeSpreadAction,
+		RequireSameFolder:     requireSameFolder,
+		FolderAction:          requireSameFolderAction,
+		MaxStackSize:          serverMaxStackSize,
+		OversizePolicy:        oversizePolicy,
+		RecordTimeGaps:        analyzeTimeGaps,
+		Span:                  span,
+		Logger:                logger,
 	}
 }
 
@@ -199,132 +386,701 @@ func runStacker(cmd *cobra.Command, args []string) {
 **
 ** @param client - Immich client instance
 ** @param logger - Logger instance for outputting status and errors
+** @param progress - Progress of the run, reported on panic (may be nil)
+** @param chunk - Slice of the stacks to process (nil processes every stack)
+** @param reviewer - Interactive review of the stack changes (nil applies every change)
+** @param events - Emitter of the run events (nil emits nothing)
+** @return error - Fatal error if the assets could not be fetched, partial failure if some
+**                 stacks failed to apply, or nil
 **************************************************************************************************/
-func runStackerOnce(client *immich.Client, logger *logrus.Logger) {
+func runStackerOnce(client immich.ImmichClient, logger *logrus.Logger, progress *runProgress, chunk *stackChunk, reviewer *stackReviewer, events *eventEmitter) (err error) {
+	events.emit(runStartEvent{eventHeader: newEventHeader(eventRunStart), DryRun: dryRun})
+	started := time.Now()
+	var summary runEndEvent
+	span := runTracer.Start("run")
+	span.SetBool("dryRun", dryRun)
+	client.SetTraceSpan(span)
+	defer func() {
+		summary.eventHeader = newEventHeader(eventRunEnd)
+		summary.Version = version
+		summary.CriteriaHash = criteriaHash()
+		summary.DurationMs = time.Since(started).Milliseconds()
+		if err != nil {
+			summary.Error = err.Error()
+		}
+		events.emit(summary)
+		endRunSpan(span, summary, err, logger)
+	}()
+
+	skipped, err := loadSkipList(skipListFile)
+	if err != nil {
+		logger.Errorf("Error loading skip list: %v", err)
+		return configError(err)
+	}
+
 	/**********************************************************************************************
-	** Fetch all the assets from Immich.
+	** Check the assets of ASSETS_FROM_FILE before anything is modified.
 	**********************************************************************************************/
-	existingStacks, err := client.FetchAllStacks()
-	if err != nil {
-		logger.Fatalf("Error fetching stacks: %v", err)
+	var listed []utils.TAsset
+	if assetsFromFile != "" {
+		ids, err := loadAssetIDs(assetsFromFile)
+		if err != nil {
+			logger.Errorf("%v", err)
+			return configError(err)
+		}
+		if listed, err = fetchListedAssets(client, ids); err != nil {
+			logger.Errorf("%v", err)
+			return err
+		}
 	}
-	assets, err := client.FetchAssets(1000, existingStacks)
-	if err != nil {
-		logger.Fatalf("Error fetching assets: %v", err)
+
+	/**********************************************************************************************
+	** Complete the stack replacements an interrupted run left half-done.
+	**********************************************************************************************/
+	if pending := skipped.pendingReplacements(); pending > 0 {
+		logger.Warnf("🩹 %d stack replacement(s) left half-done by a previous run, completing them", pending)
+		if err := replayJournal(client, skipped, false, logger); err != nil {
+			logger.Errorf("Error completing stack replacements: %v", err)
+			if immich.IsAuthError(err) {
+				return configError(err)
+			}
+		}
 	}
 
 	/**********************************************************************************************
-	** Group the assets into stacks.
+	** Fetch all the assets from Immich.
 	**********************************************************************************************/
-	stacks, err := stacker.StackBy(assets, criteria, parentFilenamePromote, parentExtPromote, logger)
+	progress.set("fetching", "", nil)
+	client.SetPageHook(events.pageHook())
+	cleaned, cleanedFrom, err := cleanupDeletions(client)
 	if err != nil {
-		logger.Fatalf("Error stacking assets: %v", err)
+		logger.Errorf("Error fetching stacks: %v", err)
+		return fatalError(fmt.Errorf("error fetching stacks: %w", err))
 	}
+	if err := checkDeleteBrake(cleaned, cleanedFrom, logger); err != nil {
+		logger.Errorf("%v", err)
+		return configError(err)
+	}
+	options := stackerOptions(span, logger)
+	sample := newGroupSample(maxGroups, sampleRandom, int64(sampleSeed))
 
-	for i, stack := range stacks {
-		_, _, newStackIDs := getParentAndChildrenIDs(stack)
-		_, _, originalStackIDs := getOriginalStackIDs(stack)
-
+	/**********************************************************************************************
+	** Run the stacking, the features of the command plugging in through the hooks.
+	**********************************************************************************************/
+	var filtered map[string]bool
+	var tally stackDiffTally
+	applied := make(map[string]int)
+	hooks := orchestrator.Hooks{
+		Stacks: func(existingStacks map[string]utils.TStack) (map[string]utils.TStack, error) {
+			// A reset deletes the stacks of the tool itself, they must not be taken as deleted by hand
+			if !resetStacks {
+				skipped.detectDeletedStacks(existingStacks, autoLearnRejections, logger)
+			}
+			if forceRestack {
+				skipped.forgetDeleted()
+			}
+			if removeExcludedFromStacks {
+				var dissolved int
+				var err error
+				if existingStacks, dissolved, err = removeExcludedStacks(client, existingStacks, excludedExtensions, skipped, logger); err != nil {
+					logger.Errorf("Error dissolving the stacks of excluded extensions: %v", err)
+					return nil, configError(err)
+				}
+				if dissolved > 0 {
+					logger.Infof("🧹 %d stacks holding an excluded extension dissolved", dissolved)
+				}
+			} else {
+				existingStacks = withoutExcludedMembers(existingStacks, excludedExtensions)
+			}
+			// Sidecars left out of the groups are left out of the stacks they are compared to
+			if !includeSidecars {
+				existingStacks = withoutExcludedMembers(existingStacks, utils.SidecarExtensions)
+			}
+			return existingStacks, nil
+		},
+		Assets: func(assets []utils.TAsset) ([]utils.TAsset, error) {
+			assets, summary.Deferred = deferRecentAssets(assets, minAssetAge, time.Now())
+			if summary.Deferred > 0 {
+				logger.Infof("⏳ %d assets uploaded less than %s ago deferred to a later run", summary.Deferred, minAssetAge)
+			}
+			assets, err := leaveOutAssets(client, assets, &summary, logger)
+			if err != nil {
+				return nil, err
+			}
+			prefilter, err := newAssetPrefilter(filterRegex, filterPathRegex)
+			if err != nil {
+				logger.Errorf("%v", err)
+				return nil, configError(err)
+			}
+			assets, filtered = prefilter.apply(assets, logger)
+			progress.set("stacking", "", nil)
+			return assets, nil
+		},
+		Groups: func(assets []utils.TAsset, grouped []stacker.Stack, existingStacks map[string]utils.TStack) ([]stacker.Stack, error) {
+			// The listed assets are stacked together whatever the skip list, the chunks and the sample
+			if listed == nil {
+				if duplicatesReport != "" && !fromImmichDuplicates {
+					if sets, err := writeDuplicatesReport(duplicatesReport, grouped); err != nil {
+						logger.Warnf("⚠️  %v", err)
+					} else if sets > 0 {
+						logger.Infof("🪞 %d files uploaded more than once found in stacks, see %s", sets, duplicatesReport)
+					}
+				}
+				grouped = sample.selectGroups(chunk.selectStacks(skipped.filter(grouped, logger)))
+			}
+			stacks := make([][]utils.TAsset, 0, len(grouped))
+			for _, stack := range grouped {
+				stacks = append(stacks, stack.Members)
+			}
+			summary.Stacks = len(stacks)
+			if sample.sampled() {
+				summary.Sampled = true
+				summary.TotalGroups = sample.total
+			}
+			events.emit(groupDoneEvent{eventHeader: newEventHeader(eventGroupDone), Assets: len(assets), Stacks: len(stacks)})
+			// The stacks the cleanup deleted count towards the limits, against the stacks found before it
+			if deletions := plannedDeletions(stacks, existingStacks, filtered); deletions > 0 {
+				if err := checkDeleteBrake(cleaned+deletions, cleaned+countStacks(existingStacks), logger); err != nil {
+					logger.Errorf("%v", err)
+					return nil, configError(err)
+				}
+			}
+			return grouped, nil
+		},
+		Expired: func(i int, grouped []stacker.Stack) bool {
+			if !chunk.expired() {
+				return false
+			}
+			logger.Warnf("⏱️  Time budget exhausted, processed %d/%d groups", i, len(grouped))
+			var last stacker.Stack
+			if i > 0 {
+				last = grouped[i-1]
+			}
+			chunk.stop(i, last)
+			return true
+		},
+		Applying: func(group stacker.Stack, newStackIDs []string) {
+			progress.set("applying", group.Members[0].OriginalFileName, newStackIDs)
+		},
+		Skip: func(group stacker.Stack) string {
+			if touchesFilteredStack(group.Members, filtered) {
+				logger.Debugf("\tℹ️ Skipping stack merging a stack with assets left out by the filters: %s", group.Members[0].OriginalFileName)
+				return skipReasonFiltered
+			}
+			return ""
+		},
+		Skipped: func(group stacker.Stack, newStackIDs []string, reason string) {
+			events.stack(eventStackSkipped, group, newStackIDs, reason, nil)
+		},
+		Diff: func(group stacker.Stack, status string, deletedStackIDs []string) {
+			tally.add(status, deletedStackIDs)
+			logStackDiff(logger, group, status)
+		},
+		Review: func(group stacker.Stack, action string) orchestrator.Decision {
+			switch reviewer.review(group.Members, group.Key, action) {
+			case reviewReject:
+				logger.Infof("\t⏭️  Rejected, skipping stack %s in future runs", group.Key)
+				if err := skipped.add(group.Key); err != nil {
+					logger.Errorf("Error saving skip list: %v", err)
+				}
+				return orchestrator.ReviewReject
+			case reviewQuit:
+				return orchestrator.ReviewQuit
+			}
+			return orchestrator.ReviewApply
+		},
+		BeginReplace: func(group stacker.Stack, newStackIDs []string, replaced []journalStack) error {
+			return skipped.beginReplace(newJournalEntry(group.Key, group.Members, newStackIDs, replaced))
+		},
+		FinishReplace: func(group stacker.Stack, newStackIDs []string) {
+			if err := skipped.finishReplace(group.Key, newStackIDs); err != nil {
+				logger.Errorf("Error saving skip list: %v", err)
+			}
+		},
+		Mutation: func(group stacker.Stack, newStackIDs []string, replaced int) func(err error) {
+			mutation := span.Child("stack_mutation")
+			if mutation != nil {
+				mutation.SetString("stack.key", utils.HashKey(group.Key))
+				mutation.SetInt("stack.assets", len(newStackIDs))
+				mutation.SetInt("stack.replaced", replaced)
+				client.SetTraceSpan(mutation)
+			}
+			runAudit.setKey(group.Key)
+			return func(err error) {
+				endMutationSpan(client, mutation, span, err)
+			}
+		},
+		Failed: func(group stacker.Stack, newStackIDs []string, err error) {
+			events.stack(eventStackFailed, group, newStackIDs, "", err)
+		},
+		Applied: func(group stacker.Stack, newStackIDs []string) {
+			events.stack(eventStackCreated, group, newStackIDs, "", nil)
+			applied[group.Profile]++
+			if !dryRun && tracksCreatedStacks() {
+				skipped.recordCreated(newStackIDs)
+			}
+		},
+	}
+	if listed != nil {
 		/******************************************************************************************
-		** Adding debug logs
+		** Stack the listed assets together, the skip list and the criteria do not apply.
 		******************************************************************************************/
-		{
-			logger.Debugf("--------------------------------")
-			logger.Debugf("%d/%d Key: %s", i+1, len(stacks), stack[0].OriginalFileName)
-			logger.WithFields(logrus.Fields{
-				"Name": stack[0].OriginalFileName,
-				"ID":   stack[0].ID,
-				"Time": stack[0].LocalDateTime,
-			}).Debugf("\tParent")
-			for _, child := range stack[1:] {
-				logger.WithFields(logrus.Fields{
-					"Name": child.OriginalFileName,
-					"ID":   child.ID,
-					"Time": child.LocalDateTime,
-				}).Debugf("\tChild")
+		hooks.Group = func(existingStacks map[string]utils.TStack) ([]utils.TAsset, []stacker.Stack, error) {
+			stack, err := listedStack(listed, existingStacks, options)
+			if err != nil {
+				logger.Errorf("Error stacking the listed assets: %v", err)
+				return nil, nil, configError(fmt.Errorf("error stacking the listed assets: %w", err))
 			}
+			logger.Infof("📋 Stacking the %d assets of %s", len(listed), assetsFromFile)
+			return listed, []stacker.Stack{stack}, nil
 		}
-
+	} else if fromImmichDuplicates {
 		/******************************************************************************************
-		** Doing standard stacker checks.
+		** Stack the duplicate groups of Immich, the criteria do not apply.
 		******************************************************************************************/
-		if !isValidStack(newStackIDs) {
-			logger.Debugf("\t⚠️ Invalid stack: %s", stack[0].OriginalFileName)
-			continue
+		hooks.Group = func(existingStacks map[string]utils.TStack) ([]utils.TAsset, []stacker.Stack, error) {
+			duplicates, err := client.FetchDuplicates()
+			if err != nil {
+				logger.Errorf("Error fetching duplicates: %v", err)
+				if immich.IsAuthError(err) {
+					return nil, nil, configError(err)
+				}
+				return nil, nil, fatalError(fmt.Errorf("error fetching duplicates: %w", err))
+			}
+			assets, groupOf := duplicateAssets(duplicates, existingStacks)
+			logger.Infof("🪞 %d duplicate groups of %d assets found by Immich", len(duplicates), len(assets))
+			if assets, err = leaveOutAssets(client, assets, &summary, logger); err != nil {
+				return nil, nil, err
+			}
+
+			progress.set("stacking", "", nil)
+			grouped, err := stacker.New(options).StackGroups(groupDuplicates(assets, groupOf))
+			if err != nil {
+				logger.Errorf("Error stacking the duplicate groups: %v", err)
+				return nil, nil, configError(fmt.Errorf("error stacking the duplicate groups: %w", err))
+			}
+			return assets, grouped, nil
 		}
-		if !needsStackUpdate(originalStackIDs, newStackIDs) {
-			logger.Debugf("\tℹ️ No update needed for stack: %s", stack[0].OriginalFileName)
-			continue
+	}
+
+	// The changes made after the run belong to no stack
+	defer runAudit.setKey("")
+	result, err := orchestrator.Run(client, orchestrator.Options{
+		Grouping:      options,
+		ReplaceStacks: replaceStacks,
+		OnlyNewStacks: onlyNewStacks,
+		DryRun:        dryRun,
+		Quiet:         quiet,
+		// The command runs on the stacks about to be created or changed only, not on every group
+		ParentSelector: newParentSelector(parentSelectorCmd, parentSelectorTimeout),
+		Version:        version,
+	}, hooks, logger)
+	summary.Created, summary.Skipped, summary.Failed = result.Created, result.Skipped, result.Failed
+	if err != nil {
+		return runError(err)
+	}
+
+	if dryRun {
+		logStackDiffTally(logger, tally)
+	}
+	if analyzeTimeGaps {
+		logTimeGaps(logger, result.TimeGaps)
+	}
+	logProfileSummary(logger, result.Grouped, applied)
+	if !dryRun && tracksCreatedStacks() {
+		if err := skipped.save(); err != nil {
+			logger.Errorf("Error saving skip list: %v", err)
 		}
-		childrenWithStack, hasChildrenWithStack := getChildrenWithStack(stack)
-		if hasChildrenWithStack && !replaceStacks {
-			logger.Debugf("\tℹ️ No replaceStacks, skipping stack: %s", stack[0].OriginalFileName)
+	}
+	chunk.logCoverage(logger)
+	sample.logSample(logger)
+	albumErr := updateParentAlbum(client, logger, result.Index, skipped, result.Applied)
+	if albumErr != nil {
+		logger.Errorf("%v", albumErr)
+	}
+	if result.Failed > 0 {
+		return partialFailure(fmt.Errorf("%d stack(s) failed to apply", result.Failed))
+	}
+	if albumErr != nil {
+		return partialFailure(albumErr)
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** Ends the span of a run with its summary and exports the spans of the run. A failed export is
+** only logged, the traces never fail a run.
+**
+** @param span - Span of the run (nil without tracing)
+** @param summary - Summary of the run
+** @param err - Error of the run
+** @param logger - Logger instance for the export error
+**************************************************************************************************/
+func endRunSpan(span *utils.Span, summary runEndEvent, err error, logger *logrus.Logger) {
+	if span == nil {
+		return
+	}
+	span.SetInt("stacks", summary.Stacks)
+	span.SetInt("stacks.created", summary.Created)
+	span.SetInt("stacks.skipped", summary.Skipped)
+	span.SetInt("stacks.failed", summary.Failed)
+	span.SetError(err)
+	span.End()
+	if err := runTracer.Flush(); err != nil {
+		logger.Warnf("⚠️  Could not export the traces: %v", err)
+	}
+}
+
+/**************************************************************************************************
+** Ends the span of a stack mutation, and traces the next requests of the client under the run.
+**
+** @param client - Immich client tracing its requests under the mutation
+** @param mutation - Span of the mutation (nil without tracing)
+** @param run - Span of the run
+** @param err - Error of the mutation
+**************************************************************************************************/
+func endMutationSpan(client immich.ImmichClient, mutation *utils.Span, run *utils.Span, err error) {
+	if mutation == nil {
+		return
+	}
+	mutation.SetError(err)
+	mutation.End()
+	client.SetTraceSpan(run)
+}
+
+/**************************************************************************************************
+** Categorizes an error of orchestrator.Run. The errors of the hooks are categorized already, a
+** failed fetch of the stacks or the assets is fatal, and the others come from the configuration.
+**
+** @param err - The error of the run
+** @return error - The categorized error
+**************************************************************************************************/
+func runError(err error) error {
+	var categorized *exitError
+	var fetchErr *orchestrator.FetchError
+	switch {
+	case errors.As(err, &categorized):
+		return err
+	case errors.As(err, &fetchErr):
+		return fatalError(err)
+	}
+	return configError(err)
+}
+
+/**************************************************************************************************
+** Leaves out the assets uploaded less than MIN_ASSET_AGE ago, so the other files of a shot have
+** time to arrive before it is stacked. Assets without a valid upload time are kept.
+**
+** @param assets - Fetched assets
+** @param minAge - Minimum time since the upload, 0 keeps every asset
+** @param now - Current time
+** @return []utils.TAsset - Assets old enough to be stacked
+** @return int - Number of deferred assets
+**************************************************************************************************/
+func deferRecentAssets(assets []utils.TAsset, minAge time.Duration, now time.Time) ([]utils.TAsset, int) {
+	if minAge <= 0 {
+		return assets, 0
+	}
+	kept := make([]utils.TAsset, 0, len(assets))
+	for _, asset := range assets {
+		uploaded, err := time.Parse(time.RFC3339Nano, asset.CreatedAt)
+		if err == nil && now.Sub(uploaded) < minAge {
 			continue
 		}
+		kept = append(kept, asset)
+	}
+	return kept, len(assets) - len(kept)
+}
 
-		/******************************************************************************************
-		** Adding info logs, but only if we are not in debug mode.
-		******************************************************************************************/
-		{
-			if !logger.IsLevelEnabled(logrus.DebugLevel) {
-				logger.Infof("--------------------------------")
-				logger.Infof("%d/%d Key: %s", i+1, len(stacks), stack[0].OriginalFileName)
-			}
-			if !logger.IsLevelEnabled(logrus.DebugLevel) {
-				logger.WithFields(logrus.Fields{
-					"Name": stack[0].OriginalFileName,
-					"ID":   stack[0].ID,
-					"Time": stack[0].LocalDateTime,
-				}).Infof("\tParent")
-				for _, child := range stack[1:] {
-					logger.WithFields(logrus.Fields{
-						"Name": child.OriginalFileName,
-						"ID":   child.ID,
-						"Time": child.LocalDateTime,
-					}).Infof("\tChild")
-				}
-			}
+/**************************************************************************************************
+** Leaves out the assets still uploading, see utils.IsIncompleteAsset, so a later run stacks them
+** once Immich has processed them, instead of a broken stack now.
+**
+** @param assets - Fetched assets
+** @param skip - Whether to leave them out, SKIP_INCOMPLETE_ASSETS
+** @return []utils.TAsset - Assets complete enough to be stacked
+** @return int - Number of deferred assets
+**************************************************************************************************/
+func deferIncompleteAssets(assets []utils.TAsset, skip bool) ([]utils.TAsset, int) {
+	if !skip {
+		return assets, 0
+	}
+	kept := make([]utils.TAsset, 0, len(assets))
+	for _, asset := range assets {
+		if !utils.IsIncompleteAsset(asset) {
+			kept = append(kept, asset)
 		}
+	}
+	return kept, len(assets) - len(kept)
+}
 
-		/******************************************************************************************
-		** Add comparison debug logging.
-		******************************************************************************************/
-		if logger.IsLevelEnabled(logrus.DebugLevel) {
-			logger.Debugf("\tStack comparison:")
-			logger.Debugf("\t  Original: %v", originalStackIDs)
-			logger.Debugf("\t  Expected: %v", newStackIDs)
-			logger.Debugf("\t  REPLACE_STACKS: %v", replaceStacks)
+/**************************************************************************************************
+** Leaves out the hidden and locked assets, see utils.IsHiddenAsset, unless WITH_HIDDEN is set.
+** Immich hides the video of a live photo, so a hidden video referenced by a kept asset stays to
+** be paired with its image.
+**
+** @param assets - Fetched assets
+** @param withHidden - Whether to keep them, WITH_HIDDEN
+** @return []utils.TAsset - Assets to group
+** @return int - Number of hidden assets left out
+**************************************************************************************************/
+func leaveOutHiddenAssets(assets []utils.TAsset, withHidden bool) ([]utils.TAsset, int) {
+	if withHidden {
+		return assets, 0
+	}
+	livePhotoVideos := make(map[string]bool)
+	for _, asset := range assets {
+		if asset.LivePhotoVideoID != "" && !utils.IsHiddenAsset(asset) {
+			livePhotoVideos[asset.LivePhotoVideoID] = true
 		}
+	}
+	kept := make([]utils.TAsset, 0, len(assets))
+	for _, asset := range assets {
+		if !utils.IsHiddenAsset(asset) || livePhotoVideos[asset.ID] {
+			kept = append(kept, asset)
+		}
+	}
+	return kept, len(assets) - len(kept)
+}
 
-		/******************************************************************************************
-		** Delete children stacks if replaceStacks is true.
-		******************************************************************************************/
-		if replaceStacks {
-			for _, childID := range childrenWithStack {
-				client.DeleteStack(childID, utils.REASON_REPLACE_CHILD_STACK_WITH_NEW_ONE)
-			}
+/**************************************************************************************************
+** Tells whether any asset carries its owner, so the partner assets can be told apart.
+**
+** @param assets - Fetched assets
+** @return bool - Whether an owner is set on some asset
+**************************************************************************************************/
+func hasOwners(assets []utils.TAsset) bool {
+	for _, asset := range assets {
+		if asset.OwnerID != "" {
+			return true
 		}
+	}
+	return false
+}
 
-		/******************************************************************************************
-		** Determine action type for logging.
-		******************************************************************************************/
-		var actionMsg string
-		if len(originalStackIDs) == 0 {
-			actionMsg = "\t🆕 Creating new stack"
-		} else if replaceStacks && len(childrenWithStack) > 0 {
-			actionMsg = "\t🔄 Replacing existing stack (deleted child stacks)"
-		} else {
-			actionMsg = "\t✏️  Updating stack configuration"
+/**************************************************************************************************
+** Counts the owners of the assets, the assets without an owner left out.
+**
+** @param assets - Fetched assets
+** @return int - Number of distinct owners
+**************************************************************************************************/
+func countOwners(assets []utils.TAsset) int {
+	owners := make(map[string]bool)
+	for _, asset := range assets {
+		if asset.OwnerID != "" {
+			owners[asset.OwnerID] = true
 		}
-		logger.Info(actionMsg)
+	}
+	return len(owners)
+}
 
-		/******************************************************************************************
-		** Modify the stack after a little delay to avoid self-rekt.
-		******************************************************************************************/
-		time.Sleep(100 * time.Millisecond)
-		if err := client.ModifyStack(newStackIDs); err != nil {
-			logger.Errorf("Error modifying stack: %v", err)
+/**************************************************************************************************
+** Warns when the assets to group belong to several owners, the partner assets being included:
+** the same filename taken at the same second by two users would otherwise make one stack that
+** Immich rejects. Called once per run, after leaveOutPartnerAssets.
+**
+** @param assets - Assets to group
+** @param logger - Logger instance for output
+**************************************************************************************************/
+func warnMixedOwners(assets []utils.TAsset, logger *logrus.Logger) {
+	owners := countOwners(assets)
+	if owners < 2 {
+		return
+	}
+	if crossOwnerStacking {
+		logger.Warnf("👥 The search returned the assets of %d owners, CROSS_OWNER_STACKING lets a stack mix them", owners)
+		return
+	}
+	logger.Warnf("👥 The search returned the assets of %d owners, they are never stacked together unless CROSS_OWNER_STACKING=true", owners)
+}
+
+/**************************************************************************************************
+** Leaves out the assets owned by another user than the one of the API key, such as the assets a
+** partner shares in the timeline. Immich rejects a stack of assets the user does not own. Assets
+** without an owner are kept.
+**
+** @param assets - Fetched assets
+** @param userID - ID of the user of the API key
+** @return []utils.TAsset - Assets of the user
+** @return int - Number of partner assets left out
+**************************************************************************************************/
+func dropPartnerAssets(assets []utils.TAsset, userID string) ([]utils.TAsset, int) {
+	kept := make([]utils.TAsset, 0, len(assets))
+	for _, asset := range assets {
+		if asset.OwnerID != "" && asset.OwnerID != userID {
+			continue
+		}
+		kept = append(kept, asset)
+	}
+	return kept, len(assets) - len(kept)
+}
+
+/**************************************************************************************************
+** Leaves out the partner assets unless INCLUDE_PARTNER_ASSETS is set, see dropPartnerAssets.
+**
+** @param client - Immich client, for the user of the API key
+** @param assets - Fetched assets
+** @param logger - Logger instance for output
+** @return []utils.TAsset - Assets to group
+** @return error - Categorized error if the user could not be fetched
+**************************************************************************************************/
+func leaveOutPartnerAssets(client immich.ImmichClient, assets []utils.TAsset, logger *logrus.Logger) ([]utils.TAsset, error) {
+	if includePartnerAssets || !hasOwners(assets) {
+		return assets, nil
+	}
+	user, err := client.GetCurrentUser()
+	if err != nil {
+		logger.Errorf("Error fetching the user: %v", err)
+		if immich.IsAuthError(err) {
+			return nil, configError(err)
+		}
+		return nil, fatalError(fmt.Errorf("error fetching the user: %w", err))
+	}
+	kept, partner := dropPartnerAssets(assets, user.ID)
+	if partner > 0 {
+		logger.Infof("🤝 %d assets shared by a partner left out, set INCLUDE_PARTNER_ASSETS=true to group them", partner)
+	}
+	return kept, nil
+}
+
+/**************************************************************************************************
+** Leaves out the assets the run must not group: the ones still uploading, the hidden ones, the
+** ones of a partner and the ones with an excluded extension, counting them in the summary.
+**
+** @param client - Immich client, for the user of the API key
+** @param assets - Fetched assets
+** @param summary - Summary of the run, counting the assets left out
+** @param logger - Logger instance for output
+** @return []utils.TAsset - Assets to group
+** @return error - Categorized error if the user could not be fetched
+**************************************************************************************************/
+func leaveOutAssets(client immich.ImmichClient, assets []utils.TAsset, summary *runEndEvent, logger *logrus.Logger) ([]utils.TAsset, error) {
+	var incomplete int
+	if assets, incomplete = deferIncompleteAssets(assets, skipIncompleteAssets); incomplete > 0 {
+		logger.Infof("⏳ %d assets still uploading deferred to a later run", incomplete)
+		summary.Deferred += incomplete
+	}
+	if assets, summary.Hidden = leaveOutHiddenAssets(assets, withHidden); summary.Hidden > 0 {
+		logger.Infof("🙈 %d hidden or locked assets left out, set WITH_HIDDEN to stack them", summary.Hidden)
+	}
+	assets, err := leaveOutPartnerAssets(client, assets, logger)
+	if err != nil {
+		return nil, err
+	}
+	warnMixedOwners(assets, logger)
+	if assets, summary.Excluded = dropExcludedExtensions(assets, excludedExtensions); summary.Excluded > 0 {
+		logger.Infof("🚫 %d assets with an excluded extension left out", summary.Excluded)
+	}
+	if !includeSidecars {
+		if assets, summary.Sidecars = dropExcludedExtensions(assets, utils.SidecarExtensions); summary.Sidecars > 0 {
+			logger.Infof("🗂️  %d sidecar files left out, set INCLUDE_SIDECARS to group them", summary.Sidecars)
+		}
+	}
+	return assets, nil
+}
+
+/**************************************************************************************************
+** Returns the time after which a run picks up no new stack, from MAX_RUN_DURATION.
+**
+** @return time.Time - The deadline, zero for no limit
+**************************************************************************************************/
+func runDeadline() time.Time {
+	if maxRunDuration <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(maxRunDuration)
+}
+
+// Immich job queues still filling in the metadata of imported assets
+var importQueues = []string{"metadataExtraction", "library"}
+
+/**************************************************************************************************
+** Reports whether Immich is busy importing assets: an import queue has more pending jobs than
+** MAX_PENDING_JOBS. Stacking then would group assets whose metadata is not extracted yet. When
+** the queues cannot be read, for example with the API key of a user who is not an admin, Immich
+** is taken as idle.
+**
+** @param client - Immich client instance
+** @param logger - Logger instance for outputting the skipped run
+** @return bool - True when the run should wait for the next tick
+**************************************************************************************************/
+func serverBusy(client immich.ImmichClient, logger *logrus.Logger) bool {
+	if maxPendingJobs <= 0 || ignoreServerLoad {
+		return false
+	}
+	jobs, err := client.FetchJobs()
+	if err != nil {
+		logger.Warnf("Could not read the Immich job queues, running anyway: %v", err)
+		return false
+	}
+	for _, queue := range importQueues {
+		counts := jobs[queue].JobCounts
+		if pending := counts.Active + counts.Waiting + counts.Delayed; pending > maxPendingJobs {
+			logger.Infof("⏳ Immich queue %s has %d pending jobs (max %d), skipping this run until the next tick", queue, pending, maxPendingJobs)
+			return true
+		}
+	}
+	return false
+}
+
+/**************************************************************************************************
+** cronOverruns counts the iterations of the cron loop that took longer than CRON_INTERVAL. No
+** run is skipped: the loop waits CRON_INTERVAL after the end of each iteration, so an overrun
+** only shifts the following runs later.
+**************************************************************************************************/
+type cronOverruns struct {
+	interval time.Duration
+	count    int
+}
+
+/**************************************************************************************************
+** Checks the duration of an iteration against CRON_INTERVAL. An iteration longer than the
+** interval is logged with a warning, as the runs then drift later than the interval suggests.
+**
+** @param logger - Logger instance for the warning
+** @param duration - Duration of the iteration, every user included
+** @return bool - True when the iteration took longer than CRON_INTERVAL
+**************************************************************************************************/
+func (o *cronOverruns) record(logger *logrus.Logger, duration time.Duration) bool {
+	if o.interval <= 0 || duration <= o.interval {
+		return false
+	}
+	o.count++
+	logger.Warnf("⚠️  The last cron iteration took %s, longer than CRON_INTERVAL (%s), %d overrun(s) since start. The next run still waits CRON_INTERVAL: raise it or bound the runs with MAX_RUN_DURATION", duration.Round(time.Second), o.interval, o.count)
+	return true
+}
+
+/**************************************************************************************************
+** Runs the stacker for one user of the cron loop. With a limit, the chunks are chained until
+** the whole library is covered, each one fetching the assets again. When the time budget is
+** exhausted, the chaining stops and the resume token lets the next tick continue.
+**
+** @param client - Immich client instance
+** @param logger - Logger instance for outputting status and errors
+** @param progress - Progress of the run, reported on panic
+** @param deadline - Time after which no new stack is picked up, zero for no limit
+** @param token - Resume token left by the previous tick, or an empty string
+** @param events - Emitter of the run events (nil emits nothing)
+** @return string - Resume token for the next tick, empty when the library is covered
+** @return error - The worst error of the chunks, or the first one that is not a partial failure
+**************************************************************************************************/
+func runStackerChunks(client immich.ImmichClient, logger *logrus.Logger, progress *runProgress, deadline time.Time, token string, events *eventEmitter) (string, error) {
+	// The tokens are encoded by the loop itself, they always decode
+	chunk, _ := newStackChunk(limit, deadline, token)
+	var runErr error
+	for {
+		err := runStackerOnce(client, logger, progress, chunk, nil, events)
+		if err != nil && exitCode(err) != exitPartialFailure {
+			return "", err
+		}
+		runErr = worstError(runErr, err)
+		if chunk.complete() {
+			return "", runErr
+		}
+		if chunk.expired() {
+			return encodeResumeToken(chunk.last), runErr
 		}
+		chunk = chunk.next()
 	}
 }
 
@@ -332,32 +1088,71 @@ func runStackerOnce(client *immich.Client, logger *logrus.Logger) {
 ** Runs the stacker process in a continuous loop for all users. Processes each user sequentially
 ** in each iteration to ensure all users are handled.
 **
-** @param apiKeys - Array of API keys for each user
-** @param apiURL - Base URL for the Immich API
+** @param targets - API key of each user, with its server
 ** @param logger - Logger instance for outputting status and errors
+** @param events - Emitter of the run events (nil emits nothing)
+** @return error - The error that stopped the loop
 **************************************************************************************************/
-func runCronLoopForAllUsers(apiKeys []string, apiURL string, logger *logrus.Logger) {
+func runCronLoopForAllUsers(targets []apiTarget, logger *logrus.Logger, events *eventEmitter) error {
+	// Users whose run was stopped by the time budget resume on the next tick
+	resumeTokens := make(map[apiTarget]string, len(targets))
+	overruns := &cronOverruns{interval: time.Duration(cronInterval) * time.Second}
 	for {
-		for i, key := range apiKeys {
+		started := time.Now()
+		deadline := runDeadline()
+		for i, target := range targets {
 			if i > 0 {
 				logger.Infof("\n")
 			}
-			client := immich.NewClient(apiURL, key, resetStacks, replaceStacks, dryRun, withArchived, withDeleted, removeSingleAssetStacks, filterAlbumIDs, filterTakenAfter, filterTakenBefore, logger)
+			client := immich.NewClient(target.URL, target.Key, resetStacks, replaceStacks, dryRun, withArchived, withDeleted, removeSingleAssetStacks, filterAlbumIDs, filterTakenAfter, filterTakenBefore, stackMarker, resetMarkedOnly, withExif, prefetchFilenameQuery, logger)
 			if client == nil {
-				logger.Errorf("Invalid client for API key: %s", key)
+				logger.Errorf("Invalid client for API key: %s", target.Key)
 				continue
 			}
+			setProxyAuth(client)
+			client.SetQuiet(quiet)
+			client.SetOnlyNewStacks(onlyNewStacks)
+			client.SetTagParentWith(tagParentWith)
+			client.SetWithHidden(withHidden)
+			client.SetStackHook(runAudit.hook())
+			if err := client.CheckAPIURL(strictURL); err != nil {
+				logger.Errorf("Invalid API_URL for API key: %s: %v", target.Key, err)
+				continue
+			}
+			// The queues are shared by every user, a busy server skips the whole iteration
+			if serverBusy(client, logger) {
+				break
+			}
 			user, err := client.GetCurrentUser()
 			if err != nil {
-				logger.Errorf("Failed to fetch user for API key: %s: %v", key, err)
+				logger.Errorf("Failed to fetch user for API key: %s: %v", target.Key, err)
 				continue
 			}
 			logger.Infof("=====================================================================================")
-			logger.Infof("Running for user: %s (%s)", user.Name, user.Email)
+			logger.Infof("Running for user: %s (%s) on %s", user.Name, user.Email, target.host())
 			logger.Infof("=====================================================================================")
-			runStackerOnce(client, logger)
+			// Stacks that failed to apply are retried on the next run, other errors stop the loop.
+			// A panic is logged and the loop goes on, unless PANIC_FATAL is set
+			progress := &runProgress{}
+			err = runWithPanicRecovery(logger, progress, func() error {
+				token, err := runStackerChunks(client, logger, progress, deadline, resumeTokens[target], events)
+				resumeTokens[target] = token
+				return err
+			})
+			if err != nil && exitCode(err) != exitPartialFailure {
+				return err
+			}
 		}
-		logger.Infof("Sleeping for %d seconds until next run", cronInterval)
+		duration := time.Since(started)
+		overrun := overruns.record(logger, duration)
+		events.emit(cronIterationEvent{
+			eventHeader:     newEventHeader(eventCronIteration),
+			DurationMs:      duration.Milliseconds(),
+			IntervalSeconds: cronInterval,
+			Overrun:         overrun,
+			OverrunsTotal:   overruns.count,
+		})
+		logger.Infof("Sleeping for %s until next run", formatSeconds(cronInterval))
 		time.Sleep(time.Duration(cronInterval) * time.Second)
 	}
 }
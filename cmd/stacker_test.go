@@ -7,10 +7,20 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/majorfi/immich-stack/pkg/immich"
 	"github.com/majorfi/immich-stack/pkg/stacker"
 	"github.com/majorfi/immich-stack/pkg/utils"
 	"github.com/sirupsen/logrus"
@@ -29,14 +39,97 @@ func resetGlobalConfig() {
 	parentExtPromote = utils.DefaultParentExtPromoteString
 	runMode = ""
 	cronInterval = 0
+	minCronInterval = 300
 	withArchived = false
+	withHidden = false
 	resetStacks = false
+	confirmResetStack = ""
 	dryRun = false
 	replaceStacks = false
-	replaceStacksFlagSet = false
 	withDeleted = false
 	logLevel = ""
+	logFormat = ""
+	filterAlbumIDs = nil
+	filterTakenAfter = ""
+	filterTakenBefore = ""
 	removeSingleAssetStacks = false
+	stackMarker = ""
+	resetMarkedOnly = false
+	withExif = false
+	diffOnlyChanges = false
+	panicFatal = false
+	maxAssetErrors = 0
+	debugSample = 0
+	stackKeyTemplate = ""
+	skipMatchMiss = false
+	prefetchFilenameQuery = ""
+	limit = 0
+	maxGroups = 0
+	sampleRandom = false
+	sampleSeed = 0
+	resumeToken = ""
+	maxRunDuration = 0
+	crossLibraryStacking = false
+	crossOwnerStacking = false
+	includePartnerAssets = false
+	tagParentWith = ""
+	interactive = false
+	skipListFile = ""
+	skipListFileSet = false
+	autoLearnRejections = false
+	forceRestack = false
+	maxDeleteFraction = defaultMaxDeleteFraction
+	maxDeleteCount = 0
+	forceDelete = false
+	promoteOrder = ""
+	extRankFallback = ""
+	delimiters = ""
+	delimiterList = nil
+	profiles = ""
+	profileList = nil
+	unionMode = ""
+	unionLogSize = 0
+	maxTimeBucket = 0
+	serverMaxStackSize = 0
+	oversizePolicy = ""
+	parentSelectorCmd = ""
+	parentSelectorTimeout = 0
+	filterRegex = nil
+	filterPathRegex = nil
+	excludeExtension = ""
+	excludedExtensions = nil
+	removeExcludedFromStacks = false
+	includeSidecars = false
+	skipIncompleteAssets = false
+	fromImmichDuplicates = false
+	analyzeTimeGaps = false
+	auditLog = ""
+	editedSuffixes = ""
+	editedSuffixList = nil
+	maxStackTimeSpread = 0
+	maxStackTimeSpreadAction = ""
+	requireSameFolder = false
+	requireSameFolderAction = ""
+	boundFlags = nil
+	onlyNewStacks = false
+	strictURL = false
+	headerFlags = nil
+	extraHeaders = nil
+	basicAuthUser = ""
+	basicAuthPass = ""
+	stdoutDocument = false
+	eventsFormat = ""
+	otlpEndpoint = ""
+	maxPendingJobs = 0
+	minAssetAge = 0
+	duplicatesReport = ""
+	addParentsToAlbum = ""
+	logFile = ""
+	logFileMaxSizeMB = 0
+	logFileMaxBackups = 0
+	ignoreServerLoad = false
+	quiet = false
+	assetsFromFile = ""
 }
 
 func clearEnvironment() {
@@ -47,14 +140,88 @@ func clearEnvironment() {
 	os.Unsetenv("PARENT_EXT_PROMOTE")
 	os.Unsetenv("RUN_MODE")
 	os.Unsetenv("CRON_INTERVAL")
+	os.Unsetenv("MIN_CRON_INTERVAL")
 	os.Unsetenv("WITH_ARCHIVED")
+	os.Unsetenv("WITH_HIDDEN")
 	os.Unsetenv("RESET_STACKS")
 	os.Unsetenv("DRY_RUN")
 	os.Unsetenv("REPLACE_STACKS")
 	os.Unsetenv("WITH_DELETED")
 	os.Unsetenv("LOG_LEVEL")
+	os.Unsetenv("LOG_FORMAT")
+	os.Unsetenv("LOG_FILE")
+	os.Unsetenv("FILTER_ALBUM_IDS")
+	os.Unsetenv("FILTER_TAKEN_AFTER")
+	os.Unsetenv("FILTER_TAKEN_BEFORE")
 	os.Unsetenv("REMOVE_SINGLE_ASSET_STACKS")
 	os.Unsetenv("CONFIRM_RESET_STACK")
+	os.Unsetenv("STACK_MARKER")
+	os.Unsetenv("RESET_MARKED_ONLY")
+	os.Unsetenv("DIFF_ONLY_CHANGES")
+	os.Unsetenv("PANIC_FATAL")
+	os.Unsetenv("MAX_ASSET_ERRORS")
+	os.Unsetenv("DEBUG_SAMPLE")
+	os.Unsetenv("STACK_KEY_TEMPLATE")
+	os.Unsetenv("SKIP_MATCH_MISS")
+	os.Unsetenv("PREFETCH_FILENAME_QUERY")
+	os.Unsetenv("LIMIT")
+	os.Unsetenv("MAX_GROUPS")
+	os.Unsetenv("SAMPLE_RANDOM")
+	os.Unsetenv("SAMPLE_SEED")
+	os.Unsetenv("RESUME_TOKEN")
+	os.Unsetenv("MAX_RUN_DURATION")
+	os.Unsetenv("CROSS_LIBRARY_STACKING")
+	os.Unsetenv("CROSS_OWNER_STACKING")
+	os.Unsetenv("INCLUDE_PARTNER_ASSETS")
+	os.Unsetenv("TAG_PARENT_WITH")
+	os.Unsetenv("INTERACTIVE")
+	os.Unsetenv("SKIP_LIST_FILE")
+	os.Unsetenv("AUTO_LEARN_REJECTIONS")
+	os.Unsetenv("FORCE_RESTACK")
+	os.Unsetenv("PROMOTE_ORDER")
+	os.Unsetenv("EXT_RANK_FALLBACK")
+	os.Unsetenv("DELIMITERS")
+	os.Unsetenv("PROFILES")
+	os.Unsetenv("UNION_MODE")
+	os.Unsetenv("UNION_LOG_SIZE")
+	os.Unsetenv("MAX_TIME_BUCKET")
+	os.Unsetenv("SERVER_MAX_STACK_SIZE")
+	os.Unsetenv("OVERSIZE_POLICY")
+	os.Unsetenv("PARENT_SELECTOR_CMD")
+	os.Unsetenv("PARENT_SELECTOR_TIMEOUT")
+	os.Unsetenv("FILTER_REGEX")
+	os.Unsetenv("FILTER_PATH_REGEX")
+	os.Unsetenv("EXCLUDE_EXTENSION")
+	os.Unsetenv("REMOVE_EXCLUDED_FROM_STACKS")
+	os.Unsetenv("INCLUDE_SIDECARS")
+	os.Unsetenv("SKIP_INCOMPLETE_ASSETS")
+	os.Unsetenv("FROM_IMMICH_DUPLICATES")
+	os.Unsetenv("ANALYZE_TIME_GAPS")
+	os.Unsetenv("AUDIT_LOG")
+	os.Unsetenv("MAX_DELETE_FRACTION")
+	os.Unsetenv("MAX_DELETE_COUNT")
+	os.Unsetenv("FORCE_DELETE")
+	os.Unsetenv("EDITED_SUFFIXES")
+	os.Unsetenv("MAX_STACK_TIME_SPREAD")
+	os.Unsetenv("MAX_STACK_TIME_SPREAD_ACTION")
+	os.Unsetenv("REQUIRE_SAME_FOLDER")
+	os.Unsetenv("REQUIRE_SAME_FOLDER_ACTION")
+	os.Unsetenv("ONLY_NEW_STACKS")
+	os.Unsetenv("STRICT_URL")
+	os.Unsetenv("EXTRA_HEADERS")
+	os.Unsetenv("BASIC_AUTH_USER")
+	os.Unsetenv("BASIC_AUTH_PASS")
+	os.Unsetenv("EVENTS")
+	os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	os.Unsetenv("MAX_PENDING_JOBS")
+	os.Unsetenv("MIN_ASSET_AGE")
+	os.Unsetenv("DUPLICATES_REPORT")
+	os.Unsetenv("ADD_PARENTS_TO_ALBUM")
+	os.Unsetenv("LOG_FILE_MAX_SIZE_MB")
+	os.Unsetenv("LOG_FILE_MAX_BACKUPS")
+	os.Unsetenv("IGNORE_SERVER_LOAD")
+	os.Unsetenv("QUIET")
+	os.Unsetenv("ASSETS_FROM_FILE")
 }
 
 func setupTest() {
@@ -127,6 +294,7 @@ func TestInvalidCriteriaJSONEndToEnd(t *testing.T) {
 	cmd := CreateTestableRootCommand()
 
 	// Override Run to test the actual integration path
+	cmd.RunE = nil
 	cmd.Run = func(cmd *cobra.Command, args []string) {
 		// Load environment to set up global state
 		config := LoadEnvForTesting()
@@ -213,6 +381,19 @@ func TestLoadEnvPrecedenceAndValidation(t *testing.T) {
 			expectError:   true,
 			errorContains: "to use RESET_STACKS, you must set CONFIRM_RESET_STACK",
 		},
+		{
+			name:          "Invalid STACK_MARKER returns error",
+			envVars:       map[string]string{"API_KEY": "test-key", "STACK_MARKER": "album"},
+			expectError:   true,
+			errorContains: "invalid STACK_MARKER",
+		},
+		{
+			name:              "Valid STACK_MARKER is accepted",
+			envVars:           map[string]string{"API_KEY": "test-key", "STACK_MARKER": "description"},
+			expectedCronInt:   0,
+			expectedPromotion: utils.DefaultParentFilenamePromoteString,
+			expectedExtPromo:  utils.DefaultParentExtPromoteString,
+		},
 		{
 			name:              "Boolean CLI flags work correctly",
 			envVars:           map[string]string{"API_KEY": "test-key"},
@@ -319,6 +500,7 @@ func TestCriteriaFlagOverridesEnvEndToEnd(t *testing.T) {
 	cmd.SetArgs([]string{"--criteria", `[{"key": "originalFileName"}]`})
 
 	// Override Run to test integration
+	cmd.RunE = nil
 	cmd.Run = func(cmd *cobra.Command, args []string) {
 		// Load environment
 		config := LoadEnvForTesting()
@@ -467,6 +649,7 @@ func TestMultiAPIKeyEndToEndFlow(t *testing.T) {
 	cmd := CreateTestableRootCommand()
 	cmd.SetArgs([]string{"--api-key", "key1,key2,key3"})
 
+	cmd.RunE = nil
 	cmd.Run = func(cmd *cobra.Command, args []string) {
 		// Test the same splitting logic used in runStacker
 		apiKeys := utils.RemoveEmptyStrings(func(keys []string) []string {
@@ -556,9 +739,14 @@ func TestFullRunPathWithMockedImmich(t *testing.T) {
 	cmd.SetArgs([]string{"--criteria", `[{"key": "originalFileName"}]`})
 
 	// Override Run to test the full integration path
+	cmd.RunE = nil
 	cmd.Run = func(cmd *cobra.Command, args []string) {
 		// This follows the exact same flow as the real runStacker
-		logger := loadEnv()
+		logger, err := loadEnv()
+		if err != nil {
+			t.Errorf("loadEnv failed: %v", err)
+			return
+		}
 
 		// Create minimal test assets to pass to StackBy
 		testAssets := []utils.TAsset{
@@ -632,6 +820,7 @@ func TestSubcommandRequiresAPIKey(t *testing.T) {
 			// Find the subcommand and override its Run function
 			for _, subcmd := range cmd.Commands() {
 				if subcmd.Use == tt.subcommand {
+					subcmd.RunE = nil
 					subcmd.Run = func(cmd *cobra.Command, args []string) {
 						// Test that loadEnv validation is enforced
 						config := LoadEnvForTesting()
@@ -661,205 +850,865 @@ func TestSubcommandRequiresAPIKey(t *testing.T) {
 }
 
 /**************************************************************************************************
-** Test getOriginalStackIDs function with edge cases
+** Test boolean environment variable overrides
 **************************************************************************************************/
-func TestGetOriginalStackIDs(t *testing.T) {
+func TestBooleanEnvironmentOverrides(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+
 	tests := []struct {
-		name                string
-		stack               []utils.TAsset
-		expectedParentID    string
-		expectedChildrenIDs []string
-		expectedOriginalIDs []string
+		name      string
+		envVar    string
+		envValue  string
+		globalVar *bool
+		expected  bool
 	}{
-		{
-			name:                "Empty stack returns empty results",
-			stack:               []utils.TAsset{},
-			expectedParentID:    "",
-			expectedChildrenIDs: nil,
-			expectedOriginalIDs: nil,
-		},
-		{
-			name: "Stack with nil Stack field returns empty results",
-			stack: []utils.TAsset{
-				{ID: "asset1", Stack: nil},
-			},
-			expectedParentID:    "",
-			expectedChildrenIDs: nil,
-			expectedOriginalIDs: nil,
-		},
-		{
-			name: "Stack with empty Assets array returns only parentID",
-			stack: []utils.TAsset{
-				{
-					ID: "asset1",
-					Stack: &utils.TStack{
-						ID:             "stack1",
-						PrimaryAssetID: "parent1",
-						Assets:         []utils.TAsset{}, // Empty Assets array - the bug case
-					},
-				},
-			},
-			expectedParentID:    "parent1",
-			expectedChildrenIDs: nil,
-			expectedOriginalIDs: []string{"parent1"},
+		{"WITH_ARCHIVED true", "WITH_ARCHIVED", "true", &withArchived, true},
+		{"WITH_ARCHIVED false", "WITH_ARCHIVED", "false", &withArchived, false},
+		{"WITH_HIDDEN true", "WITH_HIDDEN", "true", &withHidden, true},
+		{"WITH_HIDDEN false", "WITH_HIDDEN", "false", &withHidden, false},
+		{"INCLUDE_PARTNER_ASSETS true", "INCLUDE_PARTNER_ASSETS", "true", &includePartnerAssets, true},
+		{"WITH_DELETED true", "WITH_DELETED", "true", &withDeleted, true},
+		{"DRY_RUN true", "DRY_RUN", "true", &dryRun, true},
+		{"REPLACE_STACKS true", "REPLACE_STACKS", "true", &replaceStacks, true},
+		{"REPLACE_STACKS false", "REPLACE_STACKS", "false", &replaceStacks, false},
+		{"REMOVE_SINGLE_ASSET_STACKS true", "REMOVE_SINGLE_ASSET_STACKS", "true", &removeSingleAssetStacks, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest()
+			os.Setenv("API_KEY", "test-key") // Avoid API_KEY error
+			os.Setenv(tt.envVar, tt.envValue)
+
+			config := LoadEnvForTesting()
+			if config.Error != nil {
+				t.Errorf("LoadEnv failed: %v", config.Error)
+				return
+			}
+
+			if *tt.globalVar != tt.expected {
+				t.Errorf("Expected %s to be %v, got %v", tt.envVar, tt.expected, *tt.globalVar)
+			}
+		})
+	}
+}
+
+/**************************************************************************************************
+** Test the dry run diff of a proposed stack against the existing one
+**************************************************************************************************/
+func TestBuildStackDiff(t *testing.T) {
+	existing := &utils.TStack{
+		ID:             "stack-1",
+		PrimaryAssetID: "a",
+		Assets: []utils.TAsset{
+			{ID: "a", OriginalFileName: "IMG_0001.CR3"},
+			{ID: "b", OriginalFileName: "IMG_0001.JPG"},
+			{ID: "c", OriginalFileName: "IMG_0001_old.JPG"},
 		},
+	}
+
+	tests := []struct {
+		name     string
+		stack    []utils.TAsset
+		expected []string
+	}{
 		{
-			name: "Stack with one asset returns only parentID",
+			name: "new stack",
 			stack: []utils.TAsset{
-				{
-					ID: "asset1",
-					Stack: &utils.TStack{
-						ID:             "stack1",
-						PrimaryAssetID: "parent1",
-						Assets: []utils.TAsset{
-							{ID: "parent1"},
-						},
-					},
-				},
+				{ID: "x", OriginalFileName: "IMG_0002.JPG"},
+				{ID: "y", OriginalFileName: "IMG_0002.CR3"},
 			},
-			expectedParentID:    "parent1",
-			expectedChildrenIDs: []string{},
-			expectedOriginalIDs: []string{"parent1"},
+			expected: []string{"parent: + IMG_0002.JPG", "+ IMG_0002.JPG", "+ IMG_0002.CR3"},
 		},
 		{
-			name: "Stack with multiple assets returns parent and children",
+			name: "unchanged stack",
 			stack: []utils.TAsset{
-				{
-					ID: "asset1",
-					Stack: &utils.TStack{
-						ID:             "stack1",
-						PrimaryAssetID: "parent1",
-						Assets: []utils.TAsset{
-							{ID: "parent1"},
-							{ID: "child1"},
-							{ID: "child2"},
-						},
-					},
-				},
+				{ID: "a", OriginalFileName: "IMG_0001.CR3", Stack: existing},
+				{ID: "b", OriginalFileName: "IMG_0001.JPG", Stack: existing},
+				{ID: "c", OriginalFileName: "IMG_0001_old.JPG", Stack: existing},
 			},
-			expectedParentID:    "parent1",
-			expectedChildrenIDs: []string{"child1", "child2"},
-			expectedOriginalIDs: []string{"parent1", "child1", "child2"},
+			expected: []string{"parent:   IMG_0001.CR3", "  IMG_0001.CR3", "  IMG_0001.JPG", "  IMG_0001_old.JPG"},
 		},
 		{
-			name: "PRIMARY BUG TEST: Parent NOT at index 0 - children derived correctly",
+			name: "modified stack with new parent, added and removed members",
 			stack: []utils.TAsset{
-				{
-					ID: "asset1",
-					Stack: &utils.TStack{
-						ID:             "stack1",
-						PrimaryAssetID: "parentA",
-						Assets: []utils.TAsset{
-							{ID: "childB"},
-							{ID: "parentA"},
-							{ID: "childC"},
-						},
-					},
-				},
+				{ID: "b", OriginalFileName: "IMG_0001.JPG", Stack: existing},
+				{ID: "a", OriginalFileName: "IMG_0001.CR3", Stack: existing},
+				{ID: "d", OriginalFileName: "IMG_0001_edit.JPG"},
 			},
-			expectedParentID:    "parentA",
-			expectedChildrenIDs: []string{"childB", "childC"},
-			expectedOriginalIDs: []string{"parentA", "childB", "childC"},
-		},
-		{
-			name: "Parent at end of Assets array - children derived correctly",
-			stack: []utils.TAsset{
-				{
-					ID: "asset1",
-					Stack: &utils.TStack{
-						ID:             "stack1",
-						PrimaryAssetID: "parentC",
-						Assets: []utils.TAsset{
-							{ID: "childA"},
-							{ID: "childB"},
-							{ID: "parentC"},
-						},
-					},
-				},
+			expected: []string{
+				"parent: - IMG_0001.CR3",
+				"parent: + IMG_0001.JPG",
+				"  IMG_0001.JPG",
+				"  IMG_0001.CR3",
+				"+ IMG_0001_edit.JPG",
+				"- IMG_0001_old.JPG",
 			},
-			expectedParentID:    "parentC",
-			expectedChildrenIDs: []string{"childA", "childB"},
-			expectedOriginalIDs: []string{"parentC", "childA", "childB"},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			parentID, childrenIDs, originalStackIDs := getOriginalStackIDs(tt.stack)
-
-			if parentID != tt.expectedParentID {
-				t.Errorf("Expected parentID '%s', got '%s'", tt.expectedParentID, parentID)
+			got := buildStackDiff(tt.stack)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected diff %q, got %q", tt.expected, got)
 			}
+		})
+	}
+}
 
-			if tt.expectedChildrenIDs == nil && childrenIDs != nil {
-				t.Errorf("Expected nil childrenIDs, got %v", childrenIDs)
-			} else if tt.expectedChildrenIDs != nil && childrenIDs == nil {
-				t.Errorf("Expected childrenIDs %v, got nil", tt.expectedChildrenIDs)
-			} else if len(childrenIDs) != len(tt.expectedChildrenIDs) {
-				t.Errorf("Expected %d childrenIDs, got %d", len(tt.expectedChildrenIDs), len(childrenIDs))
-			} else {
-				for i, expected := range tt.expectedChildrenIDs {
-					if childrenIDs[i] != expected {
-						t.Errorf("Expected childrenIDs[%d] to be '%s', got '%s'", i, expected, childrenIDs[i])
-					}
-				}
-			}
+/**************************************************************************************************
+** Test the dry run tally and the diff-only-changes filter
+**************************************************************************************************/
+func TestStackDiffTallyAndFilter(t *testing.T) {
+	defer resetGlobalConfig()
+
+	var tally stackDiffTally
+	tally.add(stackDiffNew, nil)
+	tally.add(stackDiffNew, []string{"stack-1", "stack-2"})
+	tally.add(stackDiffModified, []string{"stack-2"})
+	tally.add(stackDiffUnchanged, nil)
+	if tally.created != 2 || tally.modified != 1 || tally.unchanged != 1 {
+		t.Errorf("Expected 2 new, 1 modified, 1 unchanged, got %d, %d, %d", tally.created, tally.modified, tally.unchanged)
+	}
+	if len(tally.deleted) != 2 {
+		t.Errorf("Expected a stack deleted twice to be counted once, got %d deleted", len(tally.deleted))
+	}
 
-			if tt.expectedOriginalIDs == nil && originalStackIDs != nil {
-				t.Errorf("Expected nil originalStackIDs, got %v", originalStackIDs)
-			} else if tt.expectedOriginalIDs != nil && originalStackIDs == nil {
-				t.Errorf("Expected originalStackIDs %v, got nil", tt.expectedOriginalIDs)
-			} else if len(originalStackIDs) != len(tt.expectedOriginalIDs) {
-				t.Errorf("Expected %d originalStackIDs, got %d", len(tt.expectedOriginalIDs), len(originalStackIDs))
-			} else {
-				for i, expected := range tt.expectedOriginalIDs {
-					if originalStackIDs[i] != expected {
-						t.Errorf("Expected originalStackIDs[%d] to be '%s', got '%s'", i, expected, originalStackIDs[i])
-					}
-				}
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	stack := stacker.Stack{Key: "IMG_0002", Members: []utils.TAsset{{ID: "x", OriginalFileName: "IMG_0002.JPG"}, {ID: "y", OriginalFileName: "IMG_0002.CR3"}}}
+
+	diffOnlyChanges = true
+	logStackDiff(logger, stack, stackDiffUnchanged)
+	if buf.Len() != 0 {
+		t.Errorf("Expected unchanged stacks to be hidden with diff-only-changes, got %q", buf.String())
+	}
+	logStackDiff(logger, stack, stackDiffNew)
+	if !strings.Contains(buf.String(), "Diff (new)") || !strings.Contains(buf.String(), "+ IMG_0002.CR3") {
+		t.Errorf("Expected the diff of the new stack, got %q", buf.String())
+	}
+
+	buf.Reset()
+	diffOnlyChanges = false
+	logStackDiff(logger, stack, stackDiffUnchanged)
+	if !strings.Contains(buf.String(), "Diff (unchanged)") {
+		t.Errorf("Expected the diff of the unchanged stack, got %q", buf.String())
+	}
+	if strings.Contains(buf.String(), "from values") {
+		t.Errorf("Expected no values without a stack key template, got %q", buf.String())
+	}
+
+	buf.Reset()
+	stack.Key = "day=20240101"
+	stack.Values = []string{"20240101", "2024-01-01T10:00:00Z"}
+	logStackDiff(logger, stack, stackDiffNew)
+	if !strings.Contains(buf.String(), `key: \"day=20240101\" from values [\"20240101\" \"2024-01-01T10:00:00Z\"]`) {
+		t.Errorf("Expected the rendered key with its values, got %q", buf.String())
+	}
+
+	buf.Reset()
+	logStackDiffTally(logger, tally)
+	if !strings.Contains(buf.String(), "2 new, 1 unchanged, 1 modified, 2 deleted") {
+		t.Errorf("Expected the dry run tally, got %q", buf.String())
+	}
+}
+
+/**************************************************************************************************
+** Test panic recovery of a cron run and the PANIC_FATAL escape hatch
+**************************************************************************************************/
+func TestRunWithPanicRecovery(t *testing.T) {
+	defer resetGlobalConfig()
+
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+
+	progress := &runProgress{}
+	err := runWithPanicRecovery(logger, progress, func() error {
+		progress.set("applying", "IMG_0001.JPG", []string{"asset-1", "asset-2"})
+		var values []int
+		_ = values[3]
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected a recovered panic to return nil, got %v", err)
+	}
+	output := buf.String()
+	for _, expected := range []string{"Recovered from panic", `"key":"IMG_0001.JPG"`, `"assetIds":["asset-1","asset-2"]`, `"phase":"applying"`, "runtime/debug.Stack"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected log to contain %q, got %q", expected, output)
+		}
+	}
+
+	expectedErr := partialFailure(errors.New("1 stack(s) failed to apply"))
+	if err := runWithPanicRecovery(logger, &runProgress{}, func() error { return expectedErr }); err != expectedErr {
+		t.Errorf("Expected the run error to be returned, got %v", err)
+	}
+
+	panicFatal = true
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Expected the panic to propagate with PANIC_FATAL")
+		}
+	}()
+	runWithPanicRecovery(logger, &runProgress{}, func() error { panic("boom") })
+}
+
+/**************************************************************************************************
+** Test that the create payload submits every member in the sorted order, not only the parent
+**************************************************************************************************/
+func TestStackCreatePayloadOrder(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+	criteria = `[{"key":"localDateTime"}]`
+
+	var payloads [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/stacks":
+			fmt.Fprint(w, `[]`)
+		case "POST /api/search/metadata":
+			fmt.Fprint(w, `{"assets": {"items": [
+				{"id": "2", "originalFileName": "IMG_0002.JPG", "localDateTime": "2024-01-01T10:00:00Z"},
+				{"id": "0", "originalFileName": "IMG_0000.JPG", "localDateTime": "2024-01-01T10:00:00Z"},
+				{"id": "3", "originalFileName": "IMG_0003.JPG", "localDateTime": "2024-01-01T10:00:00Z"},
+				{"id": "1", "originalFileName": "IMG_0001.JPG", "localDateTime": "2024-01-01T10:00:00Z"}
+			], "nextPage": null}}`)
+		case "POST /api/stacks":
+			var body struct {
+				AssetIDs []string `json:"assetIds"`
 			}
-		})
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Errorf("Failed to decode stack payload: %v", err)
+			}
+			payloads = append(payloads, body.AssetIDs)
+			fmt.Fprint(w, `{}`)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	client := immich.NewClient(server.URL, "key", false, false, false, false, false, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
+	if err := runStackerOnce(client, logger, &runProgress{}, nil, nil, nil); err != nil {
+		t.Fatalf("runStackerOnce failed: %v", err)
+	}
+
+	expected := []string{"0", "1", "2", "3"}
+	if len(payloads) != 1 || !reflect.DeepEqual(payloads[0], expected) {
+		t.Errorf("Expected one stack created with members %v, got %v", expected, payloads)
 	}
 }
 
 /**************************************************************************************************
-** Test boolean environment variable overrides
+** fakeClient is an in-memory Immich client, recording the stacks a run writes.
 **************************************************************************************************/
-func TestBooleanEnvironmentOverrides(t *testing.T) {
+type fakeClient struct {
+	stacks     map[string]utils.TStack
+	cleanup    map[string]bool
+	assets     []utils.TAsset
+	duplicates []utils.TDuplicateGroup
+	created    [][]string
+	deleted    []string
+	updated    []string
+	marked     []string
+	markers    []string
+	stackHook  func(change immich.StackChange)
+}
+
+func (f *fakeClient) GetCurrentUser() (utils.TUserResponse, error) {
+	return utils.TUserResponse{ID: "owner", Name: "fake"}, nil
+}
+func (f *fakeClient) SetPageHook(hook func(page int, assets int)) {}
+func (f *fakeClient) SetStackHook(hook func(change immich.StackChange)) {
+	f.stackHook = hook
+}
+func (f *fakeClient) SetTraceSpan(span *utils.Span) {}
+func (f *fakeClient) FetchAllStacks() (map[string]utils.TStack, error) {
+	return f.stacks, nil
+}
+func (f *fakeClient) ListStacks() (map[string]utils.TStack, error) {
+	return f.stacks, nil
+}
+func (f *fakeClient) PlanStackCleanup() (map[string]utils.TStack, map[string]bool, error) {
+	return f.stacks, f.cleanup, nil
+}
+func (f *fakeClient) SearchAssets(size int, stacksMap map[string]utils.TStack) ([]utils.TAsset, error) {
+	assets := make([]utils.TAsset, len(f.assets))
+	for i, asset := range f.assets {
+		if stack, ok := stacksMap[asset.ID]; ok {
+			asset.Stack = &stack
+		}
+		assets[i] = asset
+	}
+	return assets, nil
+}
+func (f *fakeClient) FetchAsset(assetID string) (utils.TAsset, error) {
+	for _, asset := range f.assets {
+		if asset.ID == assetID {
+			return asset, nil
+		}
+	}
+	return utils.TAsset{}, &immich.ResponseError{Status: "400 Bad Request", StatusCode: http.StatusBadRequest}
+}
+func (f *fakeClient) FetchLivePhotoVideos(assets []utils.TAsset, stacksMap map[string]utils.TStack) []utils.TAsset {
+	return nil
+}
+func (f *fakeClient) CreateStack(assetIDs []string) error {
+	f.created = append(f.created, assetIDs)
+	if f.stackHook != nil {
+		f.stackHook(immich.StackChange{Action: immich.StackCreated, AssetIDs: assetIDs})
+	}
+	return nil
+}
+func (f *fakeClient) UpdateStack(stackID string, primaryAssetID string) error {
+	f.updated = append(f.updated, stackID)
+	if f.stackHook != nil {
+		f.stackHook(immich.StackChange{Action: immich.StackPrimaryChanged, StackID: stackID, AssetIDs: []string{primaryAssetID}})
+	}
+	return nil
+}
+func (f *fakeClient) DeleteStack(stackID string, reason string) error {
+	f.deleted = append(f.deleted, stackID)
+	if f.stackHook != nil {
+		f.stackHook(immich.StackChange{Action: immich.StackDeleted, StackID: stackID, Reason: reason})
+	}
+	return nil
+}
+func (f *fakeClient) MarkStackParent(parent utils.TAsset, marker string) error {
+	f.marked = append(f.marked, parent.ID)
+	f.markers = append(f.markers, marker)
+	return nil
+}
+func (f *fakeClient) TagStackParent(parent utils.TAsset) error { return nil }
+func (f *fakeClient) TrashAssets(assetIDs []string) error      { return nil }
+func (f *fakeClient) FetchJobs() (map[string]utils.TJobStatus, error) {
+	return nil, nil
+}
+func (f *fakeClient) FetchAlbums() ([]utils.TAlbum, error)                    { return nil, nil }
+func (f *fakeClient) FetchAlbumAssets(albumID string) ([]utils.TAsset, error) { return nil, nil }
+func (f *fakeClient) FetchDuplicates() ([]utils.TDuplicateGroup, error) {
+	return f.duplicates, nil
+}
+func (f *fakeClient) CreateAlbum(name, description string) (*utils.TAlbum, error) {
+	return &utils.TAlbum{ID: "album", AlbumName: name}, nil
+}
+func (f *fakeClient) AddAssetsToAlbum(albumID string, assetIDs []string) error      { return nil }
+func (f *fakeClient) RemoveAssetsFromAlbum(albumID string, assetIDs []string) error { return nil }
+
+/**************************************************************************************************
+** Test that a run drives any implementation of the client interface, without an Immich server
+**************************************************************************************************/
+func TestRunStackerOnceWithInjectedClient(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+	replaceStacks = true
+	// The old stacks are most of the library, above MAX_DELETE_FRACTION
+	forceDelete = true
+
+	stacked := utils.TStack{ID: "old", PrimaryAssetID: "5", Assets: []utils.TAsset{{ID: "4"}, {ID: "5"}}}
+	client := &fakeClient{
+		stacks: map[string]utils.TStack{"4": stacked, "5": stacked},
+		assets: []utils.TAsset{
+			{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "3", OriginalFileName: "IMG_0002.JPG", LocalDateTime: "2024-01-01T11:00:00Z"},
+			{ID: "4", OriginalFileName: "IMG_0002.DNG", LocalDateTime: "2024-01-01T11:00:00Z"},
+			{ID: "5", OriginalFileName: "IMG_0009.JPG", LocalDateTime: "2024-01-01T12:00:00Z"},
+		},
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	if err := runStackerOnce(client, logger, &runProgress{}, nil, nil, nil); err != nil {
+		t.Fatalf("runStackerOnce failed: %v", err)
+	}
+
+	expected := [][]string{{"1", "2"}, {"3", "4"}}
+	if !reflect.DeepEqual(client.created, expected) {
+		t.Errorf("Expected stacks %v, got %v", expected, client.created)
+	}
+	if !reflect.DeepEqual(client.deleted, []string{"old"}) {
+		t.Errorf("Expected the replaced stack to be deleted, got %v", client.deleted)
+	}
+	if !reflect.DeepEqual(client.marked, []string{"1", "3"}) {
+		t.Errorf("Expected the parents to be marked, got %v", client.marked)
+	}
+	if len(client.markers) != 2 || !strings.HasPrefix(client.markers[0], "[immich-stack dev key=IMG_0001|") {
+		t.Errorf("Expected the markers to hold the grouping keys, got %v", client.markers)
+	}
+}
+
+/**************************************************************************************************
+** Test that ONLY_NEW_STACKS leaves the groups holding a stacked asset alone
+**************************************************************************************************/
+func TestRunStackerOnceOnlyNewStacks(t *testing.T) {
 	defer teardownTest()
 	setupTest()
+	onlyNewStacks = true
+
+	stacked := utils.TStack{ID: "old", PrimaryAssetID: "3", Assets: []utils.TAsset{{ID: "3"}, {ID: "5"}}}
+	client := &fakeClient{
+		stacks: map[string]utils.TStack{"3": stacked, "5": stacked},
+		assets: []utils.TAsset{
+			{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "3", OriginalFileName: "IMG_0002.JPG", LocalDateTime: "2024-01-01T11:00:00Z"},
+			{ID: "4", OriginalFileName: "IMG_0002.DNG", LocalDateTime: "2024-01-01T11:00:00Z"},
+			{ID: "5", OriginalFileName: "IMG_0009.JPG", LocalDateTime: "2024-01-01T12:00:00Z"},
+		},
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	if err := runStackerOnce(client, logger, &runProgress{}, nil, nil, nil); err != nil {
+		t.Fatalf("runStackerOnce failed: %v", err)
+	}
+
+	expected := [][]string{{"1", "2"}}
+	if !reflect.DeepEqual(client.created, expected) {
+		t.Errorf("Expected only the unstacked group to be stacked, got %v", client.created)
+	}
+	if len(client.deleted) != 0 {
+		t.Errorf("Expected no stack to be deleted, got %v", client.deleted)
+	}
+}
+
+/**************************************************************************************************
+** Test that the assets of a partner are left out without a warning, or stacked apart with
+** INCLUDE_PARTNER_ASSETS, or together with CROSS_OWNER_STACKING as well, with a warning
+**************************************************************************************************/
+func TestRunStackerOncePartnerAssets(t *testing.T) {
+	defer teardownTest()
+	assets := []utils.TAsset{
+		{ID: "1", OwnerID: "owner", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+		{ID: "2", OwnerID: "owner", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+		{ID: "3", OwnerID: "partner", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+		{ID: "4", OwnerID: "partner", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+	}
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+
+	setupTest()
+	client := &fakeClient{assets: assets}
+	if err := runStackerOnce(client, logger, &runProgress{}, nil, nil, nil); err != nil {
+		t.Fatalf("runStackerOnce failed: %v", err)
+	}
+	if expected := [][]string{{"1", "2"}}; !reflect.DeepEqual(client.created, expected) {
+		t.Errorf("Expected only the assets of the user to be stacked, got %v", client.created)
+	}
+	if strings.Contains(out.String(), "owners") {
+		t.Errorf("Expected no warning about the owners once the partner assets are left out, got %q", out.String())
+	}
+
+	setupTest()
+	includePartnerAssets = true
+	client = &fakeClient{assets: assets}
+	if err := runStackerOnce(client, logger, &runProgress{}, nil, nil, nil); err != nil {
+		t.Fatalf("runStackerOnce failed: %v", err)
+	}
+	if strings.Count(out.String(), "returned the assets of 2 owners") != 1 {
+		t.Errorf("Expected one warning about the owners, got %q", out.String())
+	}
+	if len(client.created) != 2 {
+		t.Fatalf("Expected one stack per owner, got %v", client.created)
+	}
+	for _, ids := range client.created {
+		if !reflect.DeepEqual(ids, []string{"1", "2"}) && !reflect.DeepEqual(ids, []string{"3", "4"}) {
+			t.Errorf("Expected no stack mixing owners, got %v", ids)
+		}
+	}
+
+	setupTest()
+	includePartnerAssets = true
+	crossOwnerStacking = true
+	client = &fakeClient{assets: assets}
+	if err := runStackerOnce(client, logger, &runProgress{}, nil, nil, nil); err != nil {
+		t.Fatalf("runStackerOnce failed: %v", err)
+	}
+	if len(client.created) != 1 || len(client.created[0]) != 4 {
+		t.Errorf("Expected one stack mixing the owners with CROSS_OWNER_STACKING, got %v", client.created)
+	}
+}
+
+/**************************************************************************************************
+** Test that FILTER_REGEX leaves the assets out and never merges a stack holding one of them
+**************************************************************************************************/
+func TestRunStackerOnceFilterRegex(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+	filterRegex = []string{"^IMG_"}
+
+	stacked := utils.TStack{ID: "old", PrimaryAssetID: "5", Assets: []utils.TAsset{{ID: "5"}, {ID: "6"}}}
+	client := &fakeClient{
+		stacks: map[string]utils.TStack{"5": stacked, "6": stacked},
+		assets: []utils.TAsset{
+			{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "3", OriginalFileName: "PXL_0002.JPG", LocalDateTime: "2024-01-01T11:00:00Z"},
+			{ID: "4", OriginalFileName: "PXL_0002.DNG", LocalDateTime: "2024-01-01T11:00:00Z"},
+			{ID: "5", OriginalFileName: "IMG_0003.JPG", LocalDateTime: "2024-01-01T12:00:00Z"},
+			{ID: "6", OriginalFileName: "DSC_0009.JPG", LocalDateTime: "2024-01-01T12:00:00Z"},
+			{ID: "7", OriginalFileName: "IMG_0003.DNG", LocalDateTime: "2024-01-01T12:00:00Z"},
+			{ID: "8", OriginalFileName: "IMG_0003.HEIC", LocalDateTime: "2024-01-01T12:00:00Z"},
+		},
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	if err := runStackerOnce(client, logger, &runProgress{}, nil, nil, nil); err != nil {
+		t.Fatalf("runStackerOnce failed: %v", err)
+	}
+
+	// IMG_0003 would merge the stack of DSC_0009, left out by the filter
+	expected := [][]string{{"1", "2"}}
+	if !reflect.DeepEqual(client.created, expected) {
+		t.Errorf("Expected only the matching assets to be stacked, got %v", client.created)
+	}
+}
+
+/**************************************************************************************************
+** Test that a run exports its spans to OTEL_EXPORTER_OTLP_ENDPOINT, the group keys hashed
+**************************************************************************************************/
+func TestRunStackerOnceTracing(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+
+	var exported []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		exported = append(exported, string(body))
+	}))
+	defer server.Close()
+	runTracer = utils.NewTracer(server.URL, "immich-stack", "test")
+	defer func() { runTracer = nil }()
+
+	client := &fakeClient{
+		assets: []utils.TAsset{
+			{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+		},
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	if err := runStackerOnce(client, logger, &runProgress{}, nil, nil, nil); err != nil {
+		t.Fatalf("runStackerOnce failed: %v", err)
+	}
+
+	if len(exported) != 1 {
+		t.Fatalf("Expected the spans to be exported once at the end of the run, got %d exports", len(exported))
+	}
+	// The OTLP protobuf encoding keeps the span names as they are
+	for _, name := range []string{"run", "group", "sort", "stack_mutation", "immich-stack"} {
+		if !strings.Contains(exported[0], name) {
+			t.Errorf("Expected a span %s, got %s", name, exported[0])
+		}
+	}
+	if strings.Contains(exported[0], "IMG_0001") {
+		t.Errorf("Expected the group keys to be hashed, got %s", exported[0])
+	}
+}
+
+/**************************************************************************************************
+** Test that a cron run waits while the import queues of Immich exceed MAX_PENDING_JOBS
+**************************************************************************************************/
+func TestServerBusy(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+
+	jobsStatus := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/jobs" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(jobsStatus)
+		fmt.Fprint(w, `{
+			"metadataExtraction": {"jobCounts": {"active": 2, "waiting": 40, "delayed": 0, "completed": 9, "failed": 1, "paused": 0}},
+			"library": {"jobCounts": {"active": 0, "waiting": 3, "delayed": 0}},
+			"thumbnailGeneration": {"jobCounts": {"active": 0, "waiting": 5000, "delayed": 0}}
+		}`)
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	client := immich.NewClient(server.URL, "key", false, false, false, false, false, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
 
 	tests := []struct {
-		name      string
-		envVar    string
-		envValue  string
-		globalVar *bool
-		expected  bool
+		name    string
+		max     int
+		ignore  bool
+		status  int
+		expects bool
 	}{
-		{"WITH_ARCHIVED true", "WITH_ARCHIVED", "true", &withArchived, true},
-		{"WITH_ARCHIVED false", "WITH_ARCHIVED", "false", &withArchived, false},
-		{"WITH_DELETED true", "WITH_DELETED", "true", &withDeleted, true},
-		{"DRY_RUN true", "DRY_RUN", "true", &dryRun, true},
-		{"REPLACE_STACKS true", "REPLACE_STACKS", "true", &replaceStacks, true},
-		{"REPLACE_STACKS false", "REPLACE_STACKS", "false", &replaceStacks, false},
-		{"REMOVE_SINGLE_ASSET_STACKS true", "REMOVE_SINGLE_ASSET_STACKS", "true", &removeSingleAssetStacks, true},
+		{"disabled", 0, false, http.StatusOK, false},
+		{"metadata extraction backed up", 41, false, http.StatusOK, true},
+		{"under the limit", 42, false, http.StatusOK, false},
+		{"ignored", 1, true, http.StatusOK, false},
+		{"queues not readable", 1, false, http.StatusForbidden, false},
 	}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			setupTest()
-			os.Setenv("API_KEY", "test-key") // Avoid API_KEY error
-			os.Setenv(tt.envVar, tt.envValue)
-
-			config := LoadEnvForTesting()
-			if config.Error != nil {
-				t.Errorf("LoadEnv failed: %v", config.Error)
-				return
-			}
-
-			if *tt.globalVar != tt.expected {
-				t.Errorf("Expected %s to be %v, got %v", tt.envVar, tt.expected, *tt.globalVar)
+			maxPendingJobs = tt.max
+			ignoreServerLoad = tt.ignore
+			jobsStatus = tt.status
+			if busy := serverBusy(client, logger); busy != tt.expects {
+				t.Errorf("Expected busy=%v, got %v", tt.expects, busy)
 			}
 		})
 	}
 }
+
+/**************************************************************************************************
+** Test that QUIET lowers the per-stack messages to debug and keeps the warnings
+**************************************************************************************************/
+func TestQuietRun(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+	dryRun = true
+
+	newClient := func() *fakeClient {
+		return &fakeClient{assets: []utils.TAsset{
+			{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+		}}
+	}
+	run := func(level logrus.Level) string {
+		var out bytes.Buffer
+		logger := logrus.New()
+		logger.SetOutput(&out)
+		logger.SetLevel(level)
+		if err := runStackerOnce(newClient(), logger, &runProgress{}, nil, nil, nil); err != nil {
+			t.Fatalf("runStackerOnce failed: %v", err)
+		}
+		return out.String()
+	}
+
+	if output := run(logrus.InfoLevel); !strings.Contains(output, "Creating new stack") || !strings.Contains(output, "Diff (new)") {
+		t.Errorf("Expected the per-stack messages without quiet, got %q", output)
+	}
+
+	quiet = true
+	output := run(logrus.InfoLevel)
+	for _, noise := range []string{"Key: IMG_0001", "Creating new stack", "Diff (new)"} {
+		if strings.Contains(output, noise) {
+			t.Errorf("Expected %q to be hidden in quiet mode, got %q", noise, output)
+		}
+	}
+	if !strings.Contains(output, "Dry run summary: 1 new") {
+		t.Errorf("Expected the summary in quiet mode, got %q", output)
+	}
+	if output := run(logrus.DebugLevel); !strings.Contains(output, "Creating new stack") {
+		t.Errorf("Expected the per-stack messages at debug level, got %q", output)
+	}
+}
+
+/**************************************************************************************************
+** Test that a cron iteration longer than CRON_INTERVAL is warned about and counted as an overrun
+**************************************************************************************************/
+func TestCronOverruns(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+
+	overruns := &cronOverruns{interval: time.Minute}
+	if overrun := overruns.record(logger, 50*time.Second); overrun || out.Len() != 0 {
+		t.Errorf("Expected no overrun nor warning under the interval, got %v and %q", overrun, out.String())
+	}
+	if !overruns.record(logger, 150*time.Second) {
+		t.Error("Expected an overrun over the interval")
+	}
+	if !strings.Contains(out.String(), "took 2m30s, longer than CRON_INTERVAL (1m0s), 1 overrun(s) since start") {
+		t.Errorf("Expected an overrun warning, got %q", out.String())
+	}
+	overruns.record(logger, 61*time.Second)
+	if overruns.count != 2 {
+		t.Errorf("Expected 2 overruns in total, got %d", overruns.count)
+	}
+
+	disabled := &cronOverruns{}
+	if disabled.record(logger, time.Hour) {
+		t.Error("Expected no overrun without an interval")
+	}
+}
+
+/**************************************************************************************************
+** Test that MIN_ASSET_AGE defers the assets uploaded too recently
+**************************************************************************************************/
+func TestDeferRecentAssets(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	assets := []utils.TAsset{
+		{ID: "old", CreatedAt: "2024-01-01T11:50:00.000Z"},
+		{ID: "recent", CreatedAt: "2024-01-01T11:59:30.000Z"},
+		{ID: "unknown"},
+	}
+
+	kept, deferred := deferRecentAssets(assets, 0, now)
+	if len(kept) != 3 || deferred != 0 {
+		t.Errorf("Expected every asset kept without MIN_ASSET_AGE, got %d kept and %d deferred", len(kept), deferred)
+	}
+
+	kept, deferred = deferRecentAssets(assets, 5*time.Minute, now)
+	if deferred != 1 || len(kept) != 2 || kept[0].ID != "old" || kept[1].ID != "unknown" {
+		t.Errorf("Expected the recent asset deferred, got %v kept and %d deferred", kept, deferred)
+	}
+}
+
+/**************************************************************************************************
+** Test that SKIP_INCOMPLETE_ASSETS defers the assets still uploading
+**************************************************************************************************/
+func TestDeferIncompleteAssets(t *testing.T) {
+	assets := []utils.TAsset{
+		{ID: "complete", Type: "IMAGE", Checksum: "c1"},
+		{ID: "no-checksum", Type: "IMAGE"},
+		{ID: "other", Type: "OTHER", Checksum: "c2"},
+	}
+
+	kept, deferred := deferIncompleteAssets(assets, false)
+	if len(kept) != 3 || deferred != 0 {
+		t.Errorf("Expected every asset kept without SKIP_INCOMPLETE_ASSETS, got %d kept and %d deferred", len(kept), deferred)
+	}
+
+	kept, deferred = deferIncompleteAssets(assets, true)
+	if deferred != 2 || len(kept) != 1 || kept[0].ID != "complete" {
+		t.Errorf("Expected the incomplete assets deferred, got %v kept and %d deferred", kept, deferred)
+	}
+}
+
+func TestLeaveOutHiddenAssets(t *testing.T) {
+	assets := []utils.TAsset{
+		{ID: "visible", Type: "IMAGE", Visibility: "timeline", LivePhotoVideoID: "motion"},
+		{ID: "motion", Type: "VIDEO", Visibility: utils.VisibilityHidden},
+		{ID: "hidden", Type: "IMAGE", Visibility: utils.VisibilityHidden},
+		{ID: "locked", Type: "IMAGE", Visibility: utils.VisibilityLocked},
+		{ID: "archived", Type: "IMAGE", Visibility: "archive"},
+	}
+
+	kept, hidden := leaveOutHiddenAssets(assets, true)
+	if len(kept) != 5 || hidden != 0 {
+		t.Errorf("Expected every asset kept with WITH_HIDDEN, got %d kept and %d hidden", len(kept), hidden)
+	}
+
+	kept, hidden = leaveOutHiddenAssets(assets, false)
+	var ids []string
+	for _, asset := range kept {
+		ids = append(ids, asset.ID)
+	}
+	if hidden != 2 || !reflect.DeepEqual(ids, []string{"visible", "motion", "archived"}) {
+		t.Errorf("Expected the hidden and locked assets left out but the live photo video, got %v kept and %d hidden", ids, hidden)
+	}
+}
+
+/**************************************************************************************************
+** Test that a run leaves the hidden assets unstacked and counts them in the summary
+**************************************************************************************************/
+func TestRunStackerOnceHiddenAssets(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+	eventsFormat = eventsNDJSON
+
+	client := &fakeClient{
+		stacks: map[string]utils.TStack{},
+		assets: []utils.TAsset{
+			{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z", Visibility: "timeline"},
+			{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z", Visibility: utils.VisibilityLocked},
+			{ID: "3", OriginalFileName: "IMG_0002.JPG", LocalDateTime: "2024-01-01T11:00:00Z", Visibility: "timeline"},
+			{ID: "4", OriginalFileName: "IMG_0002.DNG", LocalDateTime: "2024-01-01T11:00:00Z", Visibility: "timeline"},
+		},
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	var out bytes.Buffer
+
+	if err := runStackerOnce(client, logger, &runProgress{}, nil, nil, newEventEmitter(&out)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(client.created) != 1 || !reflect.DeepEqual(client.created[0], []string{"3", "4"}) {
+		t.Errorf("Expected only the visible pair stacked, got %v", client.created)
+	}
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	var end runEndEvent
+	if err := json.Unmarshal(lines[len(lines)-1], &end); err != nil {
+		t.Fatalf("Unexpected error decoding the run_end event: %v", err)
+	}
+	if end.Hidden != 1 {
+		t.Errorf("Expected the locked asset counted as hidden, got %d", end.Hidden)
+	}
+}
+
+/**************************************************************************************************
+** Test that a run leaves an asset still uploading unstacked and counts it as deferred
+**************************************************************************************************/
+func TestRunStackerOnceIncompleteAssets(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+	skipIncompleteAssets = true
+	eventsFormat = eventsNDJSON
+
+	client := &fakeClient{
+		stacks: map[string]utils.TStack{},
+		assets: []utils.TAsset{
+			{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z", Type: "IMAGE", Checksum: "c1"},
+			{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z", Type: "IMAGE"},
+			{ID: "3", OriginalFileName: "IMG_0002.JPG", LocalDateTime: "2024-01-01T11:00:00Z", Type: "IMAGE", Checksum: "c3"},
+			{ID: "4", OriginalFileName: "IMG_0002.DNG", LocalDateTime: "2024-01-01T11:00:00Z", Type: "IMAGE", Checksum: "c4"},
+		},
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	var out bytes.Buffer
+
+	if err := runStackerOnce(client, logger, &runProgress{}, nil, nil, newEventEmitter(&out)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(client.created) != 1 || !reflect.DeepEqual(client.created[0], []string{"3", "4"}) {
+		t.Errorf("Expected only the complete pair stacked, got %v", client.created)
+	}
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	var end runEndEvent
+	if err := json.Unmarshal(lines[len(lines)-1], &end); err != nil {
+		t.Fatalf("Unexpected error decoding the run_end event: %v", err)
+	}
+	if end.Deferred != 1 {
+		t.Errorf("Expected the uploading asset counted as deferred, got %d", end.Deferred)
+	}
+}
+
+/**************************************************************************************************
+** Test that the copies of a same file found in the stacks are written to the CSV report
+**************************************************************************************************/
+func TestWriteDuplicatesReport(t *testing.T) {
+	copyA := utils.TAsset{ID: "a", OriginalFileName: "IMG_0001.JPG", OriginalPath: "/upload/a/IMG_0001.JPG", Checksum: "c1"}
+	copyZ := utils.TAsset{ID: "z", OriginalFileName: "IMG_0001.JPG", OriginalPath: "/upload/z/IMG_0001.JPG", Checksum: "c1"}
+	raw := utils.TAsset{ID: "m", OriginalFileName: "IMG_0001.CR3", Checksum: "c2"}
+	stacks := []stacker.Stack{
+		{Key: "IMG_0001", Parent: copyA, Members: []utils.TAsset{copyA, copyZ, raw}},
+		{Key: "IMG_0002", Parent: raw, Members: []utils.TAsset{raw}},
+	}
+
+	path := filepath.Join(t.TempDir(), "reports", "duplicates-in-stacks.csv")
+	sets, err := writeDuplicatesReport(path, stacks)
+	if err != nil {
+		t.Fatalf("Expected the report written, got %v", err)
+	}
+	if sets != 1 {
+		t.Errorf("Expected 1 set of copies, got %d", sets)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected the report readable, got %v", err)
+	}
+	expected := "stackKey,checksum,originalFileName,assetId,originalPath,parent\n" +
+		"IMG_0001,c1,IMG_0001.JPG,a,/upload/a/IMG_0001.JPG,true\n" +
+		"IMG_0001,c1,IMG_0001.JPG,z,/upload/z/IMG_0001.JPG,false\n"
+	if string(content) != expected {
+		t.Errorf("Expected report:\n%s\ngot:\n%s", expected, content)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the stack index kept up to date during a run
+************************************************************************************************/
+
+func TestRunDeletesSharedChildStackOnce(t *testing.T) {
+	resetGlobalConfig()
+	defer resetGlobalConfig()
+	skipListFile = filepath.Join(t.TempDir(), "skip-list.json")
+	replaceStacks = true
+	// The old stacks are most of the library, above MAX_DELETE_FRACTION
+	forceDelete = true
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/stacks":
+			// One old stack holds a child of both groups
+			fmt.Fprint(w, `[{"id": "old", "primaryAssetId": "2", "assets": [{"id": "2"}, {"id": "4"}]}]`)
+		case "POST /api/search/metadata":
+			fmt.Fprint(w, `{"assets": {"items": [
+				{"id": "1", "originalFileName": "IMG_0001.JPG", "localDateTime": "2024-01-01T10:00:00Z"},
+				{"id": "2", "originalFileName": "IMG_0001.CR3", "localDateTime": "2024-01-01T10:00:00Z"},
+				{"id": "3", "originalFileName": "IMG_0002.JPG", "localDateTime": "2024-01-01T11:00:00Z"},
+				{"id": "4", "originalFileName": "IMG_0002.CR3", "localDateTime": "2024-01-01T11:00:00Z"}
+			], "nextPage": null}}`)
+		case "POST /api/stacks":
+			var body struct {
+				AssetIDs []string `json:"assetIds"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			requests = append(requests, fmt.Sprintf("POST %v", body.AssetIDs))
+			fmt.Fprint(w, `{}`)
+		case "DELETE /api/stacks/old":
+			requests = append(requests, "DELETE old")
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	client := immich.NewClient(server.URL, "key", false, true, false, false, false, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
+	require.NotNil(t, client)
+
+	require.NoError(t, runStackerOnce(client, logger, nil, nil, nil, nil))
+	assert.Equal(t, []string{"DELETE old", "POST [1 2]", "POST [3 4]"}, requests)
+}
@@ -0,0 +1,327 @@
+/**************************************************************************************************
+** Stats command implementation for the Immich CLI application.
+** Summarizes the library before any criteria is configured: filename prefixes, extensions,
+** RAW/JPEG pairs and the stacks each built-in preset would produce. This is read-only.
+**************************************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/stacker"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// statsOutput is the output format of the stats command: text or json
+var statsOutput string
+
+/**************************************************************************************************
+** statsPreset is a criteria the stats command estimates the stacks of. The presets are the
+** setups documented in the real-world examples.
+**************************************************************************************************/
+type statsPreset struct {
+	Name     string
+	Criteria string
+}
+
+var statsPresets = []statsPreset{
+	{Name: "default", Criteria: ""},
+	{Name: "raw-jpeg", Criteria: `[{"key":"originalFileName","split":{"delimiters":["."],"index":0}},{"key":"localDateTime","delta":{"milliseconds":1000}}]`},
+	{Name: "edits", Criteria: `[{"key":"originalFileName","split":{"delimiters":["-","~","."],"index":0}},{"key":"localDateTime","delta":{"milliseconds":1000}}]`},
+	{Name: "burst", Criteria: `[{"key":"originalFileName","regex":{"key":"BURST(\\d+)","index":1}},{"key":"localDateTime","delta":{"milliseconds":1000}}]`},
+	{Name: "sequence", Criteria: `[{"key":"originalFileName","regex":{"key":"^(.+?)_\\d+\\.","index":1}},{"key":"localDateTime","delta":{"milliseconds":3000}}]`},
+	{Name: "video-parts", Criteria: `[{"key":"originalFileName","regex":{"key":"^(.+?)(?:_\\d{3})?\\.(?i:mp4|mov|mts|m2ts)$","index":1}},{"key":"localDateTime","delta":{"milliseconds":3600000}}]`},
+}
+
+// Extensions counted as the processed counterpart of utils.RawExtensions for the RAW/JPEG pairs
+var jpegExtensions = map[string]bool{".jpg": true, ".jpeg": true, ".heic": true, ".heif": true}
+
+// Leading letters of a camera filename, with their separator: PXL_, IMG_, DSCF, DJI_
+var filenamePrefixRegex = regexp.MustCompile(`^[A-Za-z]+[_-]?`)
+
+/**************************************************************************************************
+** statsCount is the number of assets sharing a filename prefix or an extension.
+**************************************************************************************************/
+type statsCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+/**************************************************************************************************
+** statsPresetResult is the estimate of a preset: the stacks it would produce and the assets
+** they would hold, or the error that prevented the estimate.
+**************************************************************************************************/
+type statsPresetResult struct {
+	Name          string `json:"name"`
+	Criteria      string `json:"criteria"`
+	Stacks        int    `json:"stacks"`
+	StackedAssets int    `json:"stackedAssets"`
+	Error         string `json:"error,omitempty"`
+}
+
+/**************************************************************************************************
+** statsReport summarizes the library of one user.
+**************************************************************************************************/
+type statsReport struct {
+	User         string              `json:"user"`
+	Server       string              `json:"server,omitempty"`
+	Assets       int                 `json:"assets"`
+	Prefixes     []statsCount        `json:"prefixes"`
+	Extensions   []statsCount        `json:"extensions"`
+	RawJpegPairs int                 `json:"rawJpegPairs"`
+	Presets      []statsPresetResult `json:"presets"`
+}
+
+/**************************************************************************************************
+** Main execution logic for the stats command. Fetches the assets of every user, respecting the
+** filters, and prints a report per user. Nothing is modified in Immich.
+**
+** @param cmd - Cobra command instance
+** @param args - Command line arguments
+** @return error - Categorized error mapped to the exit code by main, or nil
+**************************************************************************************************/
+func runStats(cmd *cobra.Command, args []string) error {
+	logger, err := loadEnv()
+	if err != nil {
+		return err
+	}
+	if statsOutput != "text" && statsOutput != "json" {
+		return configError(fmt.Errorf("invalid output format %q: must be text or json", statsOutput))
+	}
+	if statsOutput == "json" {
+		// Keep stdout a valid JSON document
+		logger.SetOutput(cmd.ErrOrStderr())
+	}
+
+	/**********************************************************************************************
+	** Support multiple API keys (comma-separated), each with its server.
+	**********************************************************************************************/
+	targets, err := apiTargets()
+	if err != nil {
+		return err
+	}
+
+	var runErr error
+	reports := make([]statsReport, 0, len(targets))
+	for _, target := range targets {
+		client := immich.NewClient(target.URL, target.Key, false, false, true, withArchived, withDeleted, false, filterAlbumIDs, filterTakenAfter, filterTakenBefore, utils.StackMarkerNone, false, withExif, "", logger)
+		if client == nil {
+			logger.Errorf("Invalid client for API key: %s", target.Key)
+			runErr = worstError(runErr, configError(fmt.Errorf("invalid client for API key: %s", target.Key)))
+			continue
+		}
+		setProxyAuth(client)
+		if err := client.CheckAPIURL(strictURL); err != nil {
+			logger.Errorf("Invalid API_URL for API key: %s: %v", target.Key, err)
+			runErr = worstError(runErr, configError(err))
+			continue
+		}
+		user, err := client.GetCurrentUser()
+		if err != nil {
+			logger.Errorf("Failed to fetch user for API key: %s: %v", target.Key, err)
+			runErr = worstError(runErr, fatalError(fmt.Errorf("failed to fetch user: %w", err)))
+			continue
+		}
+
+		existingStacks, err := client.FetchAllStacks()
+		if err != nil {
+			logger.Errorf("Error fetching stacks: %v", err)
+			runErr = worstError(runErr, fatalError(fmt.Errorf("error fetching stacks: %w", err)))
+			continue
+		}
+		assets, err := client.SearchAssets(1000, existingStacks)
+		if err != nil {
+			logger.Errorf("Error fetching assets: %v", err)
+			runErr = worstError(runErr, fatalError(fmt.Errorf("error fetching assets: %w", err)))
+			continue
+		}
+		if !includePartnerAssets {
+			assets, _ = dropPartnerAssets(assets, user.ID)
+		}
+
+		report := buildStatsReport(assets, statsPresetsWithConfigured(criteria))
+		report.User = fmt.Sprintf("%s (%s)", user.Name, user.Email)
+		report.Server = target.host()
+		reports = append(reports, report)
+	}
+
+	if statsOutput == "json" {
+		encoder := json.NewEncoder(cmd.OutOrStdout())
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(reports); err != nil {
+			return fatalError(fmt.Errorf("error encoding stats: %w", err))
+		}
+		return runErr
+	}
+	for _, report := range reports {
+		printStatsReport(cmd.OutOrStdout(), report)
+	}
+	return runErr
+}
+
+/**************************************************************************************************
+** statsPresetsWithConfigured returns the built-in presets, followed by the configured criteria
+** when one is set.
+**
+** @param configured - The CRITERIA of the run, or an empty string
+** @return []statsPreset - The presets to estimate
+**************************************************************************************************/
+func statsPresetsWithConfigured(configured string) []statsPreset {
+	if configured == "" {
+		return statsPresets
+	}
+	return append(append([]statsPreset(nil), statsPresets...), statsPreset{Name: "configured", Criteria: configured})
+}
+
+/**************************************************************************************************
+** buildStatsReport classifies the assets by filename prefix and extension, counts the RAW/JPEG
+** pairs and estimates the stacks of each preset as a dry run.
+**
+** @param assets - Assets of the library
+** @param presets - Presets to estimate
+** @return statsReport - The report, without the user
+**************************************************************************************************/
+func buildStatsReport(assets []utils.TAsset, presets []statsPreset) statsReport {
+	prefixes := make(map[string]int)
+	extensions := make(map[string]int)
+	pairs := make(map[string][2]bool)
+	for _, asset := range assets {
+		prefix := strings.ToUpper(filenamePrefixRegex.FindString(asset.OriginalFileName))
+		if prefix == "" {
+			prefix = "(none)"
+		}
+		prefixes[prefix]++
+
+		ext := strings.ToLower(path.Ext(asset.OriginalFileName))
+		if ext == "" {
+			extensions["(none)"]++
+		} else {
+			extensions[strings.ToUpper(ext)]++
+		}
+
+		// A pair shares the directory and the filename up to the extension
+		base := strings.ToLower(path.Join(path.Dir(utils.NormalizePathSeparators(asset.OriginalPath)), strings.TrimSuffix(asset.OriginalFileName, path.Ext(asset.OriginalFileName))))
+		pair := pairs[base]
+		pair[0] = pair[0] || utils.Contains(utils.RawExtensions, ext)
+		pair[1] = pair[1] || jpegExtensions[ext]
+		pairs[base] = pair
+	}
+
+	report := statsReport{
+		Assets:     len(assets),
+		Prefixes:   sortedStatsCounts(prefixes),
+		Extensions: sortedStatsCounts(extensions),
+	}
+	for _, pair := range pairs {
+		if pair[0] && pair[1] {
+			report.RawJpegPairs++
+		}
+	}
+
+	// Errors of the presets are part of the estimate, not of the output
+	quiet := logrus.New()
+	quiet.SetOutput(io.Discard)
+	for _, preset := range presets {
+		result := statsPresetResult{Name: preset.Name, Criteria: preset.Criteria}
+		stacks, err := stacker.New(stacker.Options{
+			Criteria:              preset.Criteria,
+			ParentFilenamePromote: parentFilenamePromote,
+			ParentExtPromote:      parentExtPromote,
+			PromoteOrder:          promoteOrder,
+			ExtRankFallback:       extRankFallback,
+			Delimiters:            delimiterList,
+			EditedSuffixes:        editedSuffixList,
+			UnionMode:             unionMode,
+			MaxTimeBucket:         maxTimeBucket,
+			SkipMatchMiss:         skipMatchMiss,
+			CrossLibraryStacking:  crossLibraryStacking,
+			CrossOwnerStacking:    crossOwnerStacking,
+			MaxStackTimeSpread:    maxStackTimeSpread,
+			TimeSpreadAction:      maxStackTimeSpreadAction,
+			RequireSameFolder:     requireSameFolder,
+			FolderAction:          requireSameFolderAction,
+			MaxStackSize:          serverMaxStackSize,
+			OversizePolicy:        oversizePolicy,
+			Logger:                quiet,
+		}).Stack(assets)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.Stacks = len(stacks)
+		for _, stack := range stacks {
+			result.StackedAssets += len(stack.Members)
+		}
+		report.Presets = append(report.Presets, result)
+	}
+	return report
+}
+
+/**************************************************************************************************
+** sortedStatsCounts returns the counts from the most to the least common, ties by name.
+**
+** @param counts - Number of assets per name
+** @return []statsCount - The sorted counts
+**************************************************************************************************/
+func sortedStatsCounts(counts map[string]int) []statsCount {
+	result := make([]statsCount, 0, len(counts))
+	for name, count := range counts {
+		result = append(result, statsCount{Name: name, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+/**************************************************************************************************
+** printStatsReport prints the report of one user as aligned tables.
+**
+** @param out - Writer of the report
+** @param report - The report to print
+**************************************************************************************************/
+func printStatsReport(out io.Writer, report statsReport) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "User: %s\n", report.User)
+	if report.Server != "" {
+		fmt.Fprintf(w, "Server: %s\n", report.Server)
+	}
+	fmt.Fprintf(w, "Assets: %d\n", report.Assets)
+	fmt.Fprintf(w, "RAW/JPEG pairs: %d\n\n", report.RawJpegPairs)
+
+	fmt.Fprintln(w, "PREFIX\tASSETS")
+	for _, count := range report.Prefixes {
+		fmt.Fprintf(w, "%s\t%d\n", count.Name, count.Count)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "EXTENSION\tASSETS")
+	for _, count := range report.Extensions {
+		fmt.Fprintf(w, "%s\t%d\n", count.Name, count.Count)
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "PRESET\tSTACKS\tSTACKED ASSETS")
+	for _, preset := range report.Presets {
+		if preset.Error != "" {
+			fmt.Fprintf(w, "%s\t-\t%s\n", preset.Name, preset.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\n", preset.Name, preset.Stacks, preset.StackedAssets)
+	}
+	fmt.Fprintln(w)
+	w.Flush()
+}
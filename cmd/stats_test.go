@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the stats command report
+************************************************************************************************/
+
+func TestBuildStatsReport(t *testing.T) {
+	resetGlobalConfig()
+	defer resetGlobalConfig()
+
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "PXL_20240101_100000000.jpg", OriginalPath: "/a/PXL_20240101_100000000.jpg", LocalDateTime: "2024-01-01T10:00:00.000Z"},
+		{ID: "2", OriginalFileName: "PXL_20240101_100000000.dng", OriginalPath: "/a/PXL_20240101_100000000.dng", LocalDateTime: "2024-01-01T10:00:00.000Z"},
+		{ID: "3", OriginalFileName: "IMG_0001.JPG", OriginalPath: "/b/IMG_0001.JPG", LocalDateTime: "2024-01-02T10:00:00.000Z"},
+		{ID: "4", OriginalFileName: "IMG_0001.CR3", OriginalPath: "/c/IMG_0001.CR3", LocalDateTime: "2024-01-02T10:00:00.000Z"},
+		{ID: "5", OriginalFileName: "DSCF0001.RAF", OriginalPath: "/d/DSCF0001.RAF", LocalDateTime: "2024-01-03T10:00:00.000Z"},
+		{ID: "6", OriginalFileName: "20240101.png", OriginalPath: "/d/20240101.png", LocalDateTime: "2024-01-04T10:00:00.000Z"},
+	}
+	presets := []statsPreset{
+		{Name: "default", Criteria: ""},
+		{Name: "broken", Criteria: `[{"key":"nope"}]`},
+	}
+
+	report := buildStatsReport(assets, presets)
+	assert.Equal(t, 6, report.Assets)
+	assert.Equal(t, []statsCount{{"IMG_", 2}, {"PXL_", 2}, {"(none)", 1}, {"DSCF", 1}}, report.Prefixes)
+	assert.Equal(t, []statsCount{{".JPG", 2}, {".CR3", 1}, {".DNG", 1}, {".PNG", 1}, {".RAF", 1}}, report.Extensions, "JPG and jpg are counted together")
+	assert.Equal(t, 1, report.RawJpegPairs, "a pair shares the directory")
+
+	require.Len(t, report.Presets, 2)
+	assert.Equal(t, statsPresetResult{Name: "default", Stacks: 2, StackedAssets: 4}, report.Presets[0])
+	assert.Contains(t, report.Presets[1].Error, "unknown criteria key: nope")
+
+	var out bytes.Buffer
+	printStatsReport(&out, report)
+	assert.Contains(t, out.String(), "RAW/JPEG pairs: 1")
+	assert.Regexp(t, `default\s+2\s+4`, out.String())
+}
+
+func TestStatsPresetsWithConfigured(t *testing.T) {
+	assert.Equal(t, statsPresets, statsPresetsWithConfigured(""))
+
+	presets := statsPresetsWithConfigured(`[{"key":"localDateTime"}]`)
+	require.Len(t, presets, len(statsPresets)+1)
+	assert.Equal(t, statsPreset{Name: "configured", Criteria: `[{"key":"localDateTime"}]`}, presets[len(presets)-1])
+}
+
+func TestVideoPartsPreset(t *testing.T) {
+	resetGlobalConfig()
+	defer resetGlobalConfig()
+
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "C0042.MP4", OriginalPath: "/v/C0042.MP4", LocalDateTime: "2024-05-01T10:00:00.000Z"},
+		{ID: "2", OriginalFileName: "C0042_001.MP4", OriginalPath: "/v/C0042_001.MP4", LocalDateTime: "2024-05-01T10:12:00.000Z"},
+		{ID: "3", OriginalFileName: "C0042_002.MP4", OriginalPath: "/v/C0042_002.MP4", LocalDateTime: "2024-05-01T10:24:00.000Z"},
+		{ID: "4", OriginalFileName: "C0043.MP4", OriginalPath: "/v/C0043.MP4", LocalDateTime: "2024-05-01T10:40:00.000Z"},
+	}
+	var preset statsPreset
+	for _, p := range statsPresets {
+		if p.Name == "video-parts" {
+			preset = p
+		}
+	}
+	require.NotEmpty(t, preset.Criteria)
+
+	report := buildStatsReport(assets, []statsPreset{preset})
+	assert.Equal(t, statsPresetResult{Name: "video-parts", Criteria: preset.Criteria, Stacks: 1, StackedAssets: 3}, report.Presets[0])
+}
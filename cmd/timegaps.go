@@ -0,0 +1,105 @@
+/**************************************************************************************************
+** Time gap analysis for the Immich CLI application.
+** With ANALYZE_TIME_GAPS, a dry run ends with the capture time gaps of the assets matched by
+** their other criteria but kept apart by the time delta, such as a camera and a phone whose
+** clocks drift a few seconds apart, and the delta that would have stacked most of them.
+**************************************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Upper bounds of the buckets of the time gap histogram, the stacker records gaps up to a minute
+var timeGapBuckets = []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute}
+
+// Share of the gaps the suggested delta covers, and the step it is rounded up to
+const (
+	timeGapCoverage = 0.95
+	timeGapStep     = 500 * time.Millisecond
+)
+
+// Width of the longest bar of the histogram
+const timeGapBarWidth = 40
+
+/**************************************************************************************************
+** Counts the gaps of each bucket of the histogram.
+**
+** @param gaps - Recorded time gaps
+** @return []int - Number of gaps by bucket, in the order of timeGapBuckets
+**************************************************************************************************/
+func timeGapHistogram(gaps []time.Duration) []int {
+	counts := make([]int, len(timeGapBuckets))
+	for _, gap := range gaps {
+		for i, bound := range timeGapBuckets {
+			if gap <= bound {
+				counts[i]++
+				break
+			}
+		}
+	}
+	return counts
+}
+
+/**************************************************************************************************
+** Returns the delta covering timeGapCoverage of the gaps, their nearest-rank percentile rounded
+** up to timeGapStep.
+**
+** @param gaps - Recorded time gaps, at least one
+** @return time.Duration - The suggested delta
+**************************************************************************************************/
+func suggestedTimeDelta(gaps []time.Duration) time.Duration {
+	sorted := append([]time.Duration(nil), gaps...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(float64(len(sorted))*timeGapCoverage)) - 1
+	steps := (sorted[rank] + timeGapStep - 1) / timeGapStep
+	return steps * timeGapStep
+}
+
+/**************************************************************************************************
+** Logs the histogram of the time gaps and the suggested delta, at the end of a dry run.
+**
+** @param logger - Logger instance for outputting the analysis
+** @param gaps - Time gaps recorded by the stacker
+**************************************************************************************************/
+func logTimeGaps(logger *logrus.Logger, gaps []time.Duration) {
+	logger.Infof("--------------------------------")
+	if len(gaps) == 0 {
+		logger.Infof("⏱️  Time gaps: no assets matched by the other criteria were kept apart by the time delta")
+		return
+	}
+	logger.Infof("⏱️  Time gaps of %d asset pairs matched by the other criteria but kept apart by the time delta:", len(gaps))
+	counts := timeGapHistogram(gaps)
+	largest := 0
+	for _, count := range counts {
+		if count > largest {
+			largest = count
+		}
+	}
+	for i, count := range counts {
+		bar := strings.Repeat("█", (count*timeGapBarWidth+largest-1)/largest)
+		logger.Infof("   ≤ %-3s │ %s %d", shortDuration(timeGapBuckets[i]), bar, count)
+	}
+	delta := suggestedTimeDelta(gaps)
+	logger.Infof("💡 A delta of %d ms covers %.0f%% of them: {\"key\": \"localDateTime\", \"delta\": {\"milliseconds\": %d}}", delta.Milliseconds(), timeGapCoverage*100, delta.Milliseconds())
+}
+
+/**************************************************************************************************
+** Formats a bucket bound of the histogram, 1m instead of 1m0s.
+**
+** @param d - Bucket bound
+** @return string - The short duration
+**************************************************************************************************/
+func shortDuration(d time.Duration) string {
+	if d%time.Minute == 0 {
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return d.String()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeGapHistogram(t *testing.T) {
+	gaps := []time.Duration{1200 * time.Millisecond, 1500 * time.Millisecond, 2 * time.Second, 2500 * time.Millisecond, 45 * time.Second}
+	assert.Equal(t, []int{0, 3, 1, 0, 0, 0, 1}, timeGapHistogram(gaps))
+	assert.Equal(t, 45*time.Second, suggestedTimeDelta(gaps), "the 95th percentile of five gaps is the largest")
+
+	var many []time.Duration
+	for i := 1; i <= 20; i++ {
+		many = append(many, time.Duration(i)*100*time.Millisecond)
+	}
+	assert.Equal(t, 2*time.Second, suggestedTimeDelta(many), "1.9s rounded up to the next half second")
+	assert.Equal(t, "1m", shortDuration(time.Minute))
+	assert.Equal(t, "10s", shortDuration(10*time.Second))
+}
+
+func TestRunStackerOnceAnalyzeTimeGaps(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+	dryRun = true
+	analyzeTimeGaps = true
+
+	client := &fakeClient{
+		assets: []utils.TAsset{
+			{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00.000Z"},
+			{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:02.300Z"},
+			{ID: "3", OriginalFileName: "IMG_0002.JPG", LocalDateTime: "2024-01-01T11:00:00.000Z"},
+			{ID: "4", OriginalFileName: "IMG_0002.DNG", LocalDateTime: "2024-01-01T11:00:00.200Z"},
+		},
+	}
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+
+	require.NoError(t, runStackerOnce(client, logger, &runProgress{}, nil, nil, nil))
+	assert.Contains(t, out.String(), "Time gaps of 1 asset pairs")
+	assert.Contains(t, out.String(), `A delta of 2500 ms covers 95% of them`)
+}
+
+func TestAnalyzeTimeGapsEnvVar(t *testing.T) {
+	resetTestEnv()
+	defer resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("ANALYZE_TIME_GAPS", "true")
+	os.Setenv("DRY_RUN", "true")
+
+	config := LoadEnvForTesting()
+	require.NoError(t, config.Error)
+	assert.True(t, analyzeTimeGaps)
+
+	resetTestEnv()
+	os.Setenv("API_KEY", "test-key")
+	os.Setenv("ANALYZE_TIME_GAPS", "true")
+	config = LoadEnvForTesting()
+	assert.ErrorContains(t, config.Error, "ANALYZE_TIME_GAPS requires DRY_RUN")
+}
@@ -0,0 +1,365 @@
+/**************************************************************************************************
+** Verify command implementation for the Immich CLI application.
+** Groups the library under the current configuration and reports the existing stacks it would
+** change: stacks that would split, members that would move and parents that would change. This
+** is read-only, the safe check before a run with REPLACE_STACKS.
+**************************************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/stacker"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// verifyOutput is the output format of the verify command: text or json
+var verifyOutput string
+
+// Kinds of discrepancy between an existing stack and the grouping of the current configuration
+const (
+	verifySplit  = "split"  // Some members would leave the stack
+	verifyGrow   = "grow"   // Other assets would join the stack
+	verifyParent = "parent" // The stack would keep its members with another parent
+)
+
+/**************************************************************************************************
+** verifyMove is a member of an existing stack that the current configuration would stack
+** elsewhere, or leave unstacked.
+**************************************************************************************************/
+type verifyMove struct {
+	AssetID  string `json:"assetId"`
+	FileName string `json:"fileName"`
+	To       string `json:"to,omitempty"` // Parent of the stack it would join, empty when unstacked
+}
+
+/**************************************************************************************************
+** verifyFinding is an existing stack the current configuration would change.
+**************************************************************************************************/
+type verifyFinding struct {
+	StackID   string       `json:"stackId"`
+	Parent    string       `json:"parent"`
+	Kind      string       `json:"kind"`
+	Moves     []verifyMove `json:"moves,omitempty"`
+	Joined    []string     `json:"joined,omitempty"`
+	NewParent string       `json:"newParent,omitempty"`
+}
+
+/**************************************************************************************************
+** verifyReport lists the existing stacks of one user the current configuration would change.
+**************************************************************************************************/
+type verifyReport struct {
+	User       string          `json:"user"`
+	Server     string          `json:"server,omitempty"`
+	Stacks     int             `json:"stacks"`
+	Consistent int             `json:"consistent"`
+	Findings   []verifyFinding `json:"findings"`
+}
+
+/**************************************************************************************************
+** Main execution logic for the verify command. Fetches the stacks and assets of every user,
+** groups the assets with the current configuration and prints the stacks it would change.
+** Nothing is modified in Immich.
+**
+** @param cmd - Cobra command instance
+** @param args - Command line arguments
+** @return error - Categorized error mapped to the exit code by main, or nil
+**************************************************************************************************/
+func runVerify(cmd *cobra.Command, args []string) error {
+	logger, err := loadEnv()
+	if err != nil {
+		return err
+	}
+	if verifyOutput != "text" && verifyOutput != "json" {
+		return configError(fmt.Errorf("invalid output format %q: must be text or json", verifyOutput))
+	}
+	if verifyOutput == "json" {
+		// Keep stdout a valid JSON document
+		logger.SetOutput(cmd.ErrOrStderr())
+	}
+
+	/**********************************************************************************************
+	** Support multiple API keys (comma-separated), each with its server.
+	**********************************************************************************************/
+	targets, err := apiTargets()
+	if err != nil {
+		return err
+	}
+
+	var runErr error
+	reports := make([]verifyReport, 0, len(targets))
+	for _, target := range targets {
+		client := immich.NewClient(target.URL, target.Key, false, false, true, withArchived, withDeleted, false, filterAlbumIDs, filterTakenAfter, filterTakenBefore, utils.StackMarkerNone, false, withExif, "", logger)
+		if client == nil {
+			logger.Errorf("Invalid client for API key: %s", target.Key)
+			runErr = worstError(runErr, configError(fmt.Errorf("invalid client for API key: %s", target.Key)))
+			continue
+		}
+		setProxyAuth(client)
+		client.SetWithHidden(withHidden)
+		if err := client.CheckAPIURL(strictURL); err != nil {
+			logger.Errorf("Invalid API_URL for API key: %s: %v", target.Key, err)
+			runErr = worstError(runErr, configError(err))
+			continue
+		}
+		user, err := client.GetCurrentUser()
+		if err != nil {
+			logger.Errorf("Failed to fetch user for API key: %s: %v", target.Key, err)
+			runErr = worstError(runErr, fatalError(fmt.Errorf("failed to fetch user: %w", err)))
+			continue
+		}
+
+		report, err := verifyStacks(client, logger)
+		if err != nil {
+			runErr = worstError(runErr, err)
+			continue
+		}
+		report.User = fmt.Sprintf("%s (%s)", user.Name, user.Email)
+		report.Server = target.host()
+		reports = append(reports, report)
+	}
+
+	if verifyOutput == "json" {
+		encoder := json.NewEncoder(cmd.OutOrStdout())
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(reports); err != nil {
+			return fatalError(fmt.Errorf("error encoding verify report: %w", err))
+		}
+		return runErr
+	}
+	for _, report := range reports {
+		printVerifyReport(cmd.OutOrStdout(), report)
+	}
+	return runErr
+}
+
+/**************************************************************************************************
+** verifyStacks groups the assets the way a run would, with the exclusions, the filters and the
+** skip list, and compares the groups with the existing stacks.
+**
+** @param client - Immich client instance, only read from
+** @param logger - Logger instance for output
+** @return verifyReport - The report, without the user
+** @return error - Categorized error if the assets could not be fetched or grouped
+**************************************************************************************************/
+func verifyStacks(client immich.ImmichClient, logger *logrus.Logger) (verifyReport, error) {
+	skipped, err := loadSkipList(skipListFile)
+	if err != nil {
+		logger.Errorf("Error loading skip list: %v", err)
+		return verifyReport{}, configError(err)
+	}
+	existingStacks, err := client.FetchAllStacks()
+	if err != nil {
+		logger.Errorf("Error fetching stacks: %v", err)
+		return verifyReport{}, fatalError(fmt.Errorf("error fetching stacks: %w", err))
+	}
+	existingStacks = withoutExcludedMembers(existingStacks, excludedExtensions)
+	if !includeSidecars {
+		existingStacks = withoutExcludedMembers(existingStacks, utils.SidecarExtensions)
+	}
+
+	assets, err := client.SearchAssets(1000, existingStacks)
+	if err != nil {
+		logger.Errorf("Error fetching assets: %v", err)
+		return verifyReport{}, fatalError(fmt.Errorf("error fetching assets: %w", err))
+	}
+	assets = append(assets, client.FetchLivePhotoVideos(assets, existingStacks)...)
+	assets, _ = deferIncompleteAssets(assets, skipIncompleteAssets)
+	assets, _ = leaveOutHiddenAssets(assets, withHidden)
+	if assets, err = leaveOutPartnerAssets(client, assets, logger); err != nil {
+		return verifyReport{}, err
+	}
+	assets, _ = dropExcludedExtensions(assets, excludedExtensions)
+	if !includeSidecars {
+		assets, _ = dropExcludedExtensions(assets, utils.SidecarExtensions)
+	}
+	prefilter, err := newAssetPrefilter(filterRegex, filterPathRegex)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return verifyReport{}, configError(err)
+	}
+	assets, _ = prefilter.apply(assets, logger)
+
+	grouped, err := stacker.New(stackerOptions(nil, logger)).Stack(assets)
+	if err != nil {
+		logger.Errorf("Error stacking assets: %v", err)
+		return verifyReport{}, configError(fmt.Errorf("error stacking assets: %w", err))
+	}
+	return compareStacks(existingStacks, skipped.filter(grouped, logger)), nil
+}
+
+/**************************************************************************************************
+** compareStacks compares each existing stack with the groups of the current configuration. The
+** group holding most of its members, the parent first on a tie, is where the stack would go:
+** the other members would move, the other assets of that group would join, and its parent would
+** become the parent of the stack.
+**
+** @param existingStacks - Existing stacks, by asset ID
+** @param grouped - Groups of the current configuration
+** @return verifyReport - The findings, ordered by stack ID, without the user
+**************************************************************************************************/
+func compareStacks(existingStacks map[string]utils.TStack, grouped []stacker.Stack) verifyReport {
+	groupOf := make(map[string]int)
+	for i, group := range grouped {
+		for _, member := range group.Members {
+			groupOf[member.ID] = i
+		}
+	}
+
+	seen := make(map[string]bool)
+	stacks := make([]utils.TStack, 0, len(existingStacks))
+	for _, stack := range existingStacks {
+		if !seen[stack.ID] {
+			seen[stack.ID] = true
+			stacks = append(stacks, stack)
+		}
+	}
+	sort.Slice(stacks, func(i, j int) bool { return stacks[i].ID < stacks[j].ID })
+
+	report := verifyReport{Stacks: len(stacks), Findings: []verifyFinding{}}
+	for _, stack := range stacks {
+		finding, changed := compareStack(stack, groupOf, grouped)
+		if !changed {
+			report.Consistent++
+			continue
+		}
+		report.Findings = append(report.Findings, finding)
+	}
+	return report
+}
+
+/**************************************************************************************************
+** compareStack compares one existing stack with the groups of the current configuration.
+**
+** @param stack - The existing stack
+** @param groupOf - Index of the group of each grouped asset
+** @param grouped - Groups of the current configuration
+** @return verifyFinding - What would change, the most severe kind first
+** @return bool - Whether anything would change
+**************************************************************************************************/
+func compareStack(stack utils.TStack, groupOf map[string]int, grouped []stacker.Stack) (verifyFinding, bool) {
+	finding := verifyFinding{StackID: stack.ID}
+	counts := make(map[int]int)
+	members := make(map[string]bool, len(stack.Assets))
+	for _, member := range stack.Assets {
+		members[member.ID] = true
+		if member.ID == stack.PrimaryAssetID {
+			finding.Parent = member.OriginalFileName
+		}
+		if i, ok := groupOf[member.ID]; ok {
+			counts[i]++
+		}
+	}
+
+	primaryGroup, primaryGrouped := groupOf[stack.PrimaryAssetID]
+	target := -1
+	for _, member := range stack.Assets {
+		i, ok := groupOf[member.ID]
+		if !ok {
+			continue
+		}
+		if target < 0 || counts[i] > counts[target] || (counts[i] == counts[target] && primaryGrouped && i == primaryGroup) {
+			target = i
+		}
+	}
+	// A group holding a single member does not keep the stack
+	if target >= 0 && counts[target] < 2 {
+		target = -1
+	}
+
+	for _, member := range stack.Assets {
+		i, ok := groupOf[member.ID]
+		if ok && i == target {
+			continue
+		}
+		move := verifyMove{AssetID: member.ID, FileName: member.OriginalFileName}
+		if ok {
+			move.To = grouped[i].Parent.OriginalFileName
+		}
+		finding.Moves = append(finding.Moves, move)
+	}
+	if target >= 0 {
+		for _, member := range grouped[target].Members {
+			if !members[member.ID] {
+				finding.Joined = append(finding.Joined, member.OriginalFileName)
+			}
+		}
+		if grouped[target].Parent.ID != stack.PrimaryAssetID {
+			finding.NewParent = grouped[target].Parent.OriginalFileName
+		}
+	}
+
+	switch {
+	case len(finding.Moves) > 0:
+		finding.Kind = verifySplit
+	case len(finding.Joined) > 0:
+		finding.Kind = verifyGrow
+	case finding.NewParent != "":
+		finding.Kind = verifyParent
+	default:
+		return finding, false
+	}
+	return finding, true
+}
+
+/**************************************************************************************************
+** printVerifyReport prints the report of one user as a table.
+**
+** @param out - Writer of the report
+** @param report - The report
+**************************************************************************************************/
+func printVerifyReport(out io.Writer, report verifyReport) {
+	if report.Server != "" {
+		fmt.Fprintf(out, "User: %s on %s\n", report.User, report.Server)
+	} else {
+		fmt.Fprintf(out, "User: %s\n", report.User)
+	}
+	fmt.Fprintf(out, "Stacks: %d, %d consistent with the current configuration, %d would change\n", report.Stacks, report.Consistent, len(report.Findings))
+	if len(report.Findings) == 0 {
+		fmt.Fprintln(out)
+		return
+	}
+
+	fmt.Fprintln(out)
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STACK\tPARENT\tCHANGE\tDETAILS")
+	for _, finding := range report.Findings {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", finding.StackID, finding.Parent, finding.Kind, verifyDetails(finding))
+	}
+	w.Flush()
+	fmt.Fprintln(out)
+}
+
+/**************************************************************************************************
+** verifyDetails describes a finding on one line: the members that would move and where, the
+** assets that would join and the new parent.
+**
+** @param finding - The finding
+** @return string - The description
+**************************************************************************************************/
+func verifyDetails(finding verifyFinding) string {
+	var details []string
+	for _, move := range finding.Moves {
+		to := "unstacked"
+		if move.To != "" {
+			to = "stack of " + move.To
+		}
+		details = append(details, fmt.Sprintf("%s -> %s", move.FileName, to))
+	}
+	if len(finding.Joined) > 0 {
+		details = append(details, "joined by "+strings.Join(finding.Joined, ", "))
+	}
+	if finding.NewParent != "" {
+		details = append(details, "parent -> "+finding.NewParent)
+	}
+	return strings.Join(details, "; ")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyStacks(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+	parentExtPromote = ".jpg,.dng"
+
+	asset := func(id, name, at string) utils.TAsset {
+		return utils.TAsset{ID: id, OriginalFileName: name, LocalDateTime: at}
+	}
+	assets := []utils.TAsset{
+		asset("1", "IMG_0001.JPG", "2024-01-01T10:00:00Z"),
+		asset("2", "IMG_0001.DNG", "2024-01-01T10:00:00Z"),
+		asset("3", "IMG_0002.JPG", "2024-01-01T11:00:00Z"),
+		asset("4", "IMG_0003.JPG", "2024-01-01T12:00:00Z"),
+		asset("5", "IMG_0003.DNG", "2024-01-01T12:00:00Z"),
+		asset("6", "IMG_0004.DNG", "2024-01-01T13:00:00Z"),
+		asset("7", "IMG_0004.JPG", "2024-01-01T13:00:00Z"),
+		asset("8", "IMG_0005.JPG", "2024-01-01T14:00:00Z"),
+		asset("9", "IMG_0005.DNG", "2024-01-01T14:00:00Z"),
+		asset("10", "IMG_0005.HEIC", "2024-01-01T14:00:00Z"),
+	}
+	stacks := map[string]utils.TStack{}
+	for _, stack := range []utils.TStack{
+		{ID: "s1", PrimaryAssetID: "1", Assets: []utils.TAsset{assets[0], assets[1]}},
+		{ID: "s2", PrimaryAssetID: "3", Assets: []utils.TAsset{assets[2], assets[3]}},
+		{ID: "s3", PrimaryAssetID: "6", Assets: []utils.TAsset{assets[5], assets[6]}},
+		{ID: "s4", PrimaryAssetID: "8", Assets: []utils.TAsset{assets[7], assets[8]}},
+	} {
+		for _, member := range stack.Assets {
+			stacks[member.ID] = stack
+		}
+	}
+	client := &fakeClient{stacks: stacks, assets: assets}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	report, err := verifyStacks(client, logger)
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Stacks)
+	assert.Equal(t, 1, report.Consistent, "s1 matches the current criteria")
+	require.Len(t, report.Findings, 3)
+
+	split := report.Findings[0]
+	assert.Equal(t, "s2", split.StackID)
+	assert.Equal(t, verifySplit, split.Kind)
+	assert.Equal(t, "IMG_0002.JPG", split.Parent)
+	assert.Equal(t, []verifyMove{
+		{AssetID: "3", FileName: "IMG_0002.JPG"},
+		{AssetID: "4", FileName: "IMG_0003.JPG", To: "IMG_0003.JPG"},
+	}, split.Moves)
+
+	parent := report.Findings[1]
+	assert.Equal(t, "s3", parent.StackID)
+	assert.Equal(t, verifyParent, parent.Kind)
+	assert.Equal(t, "IMG_0004.JPG", parent.NewParent)
+	assert.Empty(t, parent.Moves)
+
+	grow := report.Findings[2]
+	assert.Equal(t, "s4", grow.StackID)
+	assert.Equal(t, verifyGrow, grow.Kind)
+	assert.Equal(t, []string{"IMG_0005.HEIC"}, grow.Joined)
+	assert.Empty(t, grow.NewParent)
+
+	assert.Empty(t, client.created, "verify is read-only")
+	assert.Empty(t, client.deleted, "verify is read-only")
+
+	var out bytes.Buffer
+	printVerifyReport(&out, report)
+	assert.Contains(t, out.String(), "Stacks: 4, 1 consistent with the current configuration, 3 would change")
+	assert.Contains(t, out.String(), "IMG_0002.JPG -> unstacked; IMG_0003.JPG -> stack of IMG_0003.JPG")
+	assert.Contains(t, out.String(), "joined by IMG_0005.HEIC")
+	assert.Contains(t, out.String(), "parent -> IMG_0004.JPG")
+}
+
+func TestVerifyStacksSkipsExcludedMembers(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+
+	stack := utils.TStack{ID: "s1", PrimaryAssetID: "1", Assets: []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG"},
+		{ID: "2", OriginalFileName: "IMG_0001.DNG"},
+		{ID: "3", OriginalFileName: "IMG_0001.JPG.json"},
+	}}
+	client := &fakeClient{
+		stacks: map[string]utils.TStack{"1": stack, "2": stack, "3": stack},
+		assets: []utils.TAsset{
+			{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "3", OriginalFileName: "IMG_0001.JPG.json", LocalDateTime: "2024-01-01T10:00:00Z"},
+		},
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	report, err := verifyStacks(client, logger)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Consistent, "a sidecar left out of the grouping does not look moved")
+	assert.Empty(t, report.Findings)
+}
@@ -0,0 +1,217 @@
+/**************************************************************************************************
+** Version command implementation for the Immich CLI application.
+** Prints the build of the binary, the hash of the effective criteria every run logs and the
+** version of the Immich servers, the details a support request needs.
+**************************************************************************************************/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/stacker"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/spf13/cobra"
+)
+
+// versionOutput is the output format of the version command: text or json
+var versionOutput string
+
+// criteriaHashInvalid is the criteria hash of a CRITERIA that cannot be parsed
+const criteriaHashInvalid = "invalid"
+
+/**************************************************************************************************
+** buildInfo describes the binary: the version, commit and build date set at build time, filled
+** in from the VCS stamp of the Go toolchain when missing, and the Go version.
+**************************************************************************************************/
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+/**************************************************************************************************
+** versionServer is the Immich server of an API key, with its version or the error that
+** prevented reading it.
+**************************************************************************************************/
+type versionServer struct {
+	URL     string `json:"url"`
+	Version string `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+/**************************************************************************************************
+** versionReport is the output of the version command.
+**************************************************************************************************/
+type versionReport struct {
+	buildInfo
+	CriteriaHash string          `json:"criteriaHash"`
+	Servers      []versionServer `json:"servers,omitempty"`
+}
+
+/**************************************************************************************************
+** currentBuild returns the build of the binary. A binary built without -ldflags, with go build
+** or go install, takes its commit and date from the VCS stamp and its version from the module.
+**
+** @return buildInfo - The build
+**************************************************************************************************/
+func currentBuild() buildInfo {
+	build := buildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return build
+	}
+	if build.Version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		build.Version = info.Main.Version
+	}
+	modified := false
+	revision := ""
+	stamped := ""
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.time":
+			stamped = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if build.Commit == "" && revision != "" {
+		build.Commit = revision
+		if len(build.Commit) > 12 {
+			build.Commit = build.Commit[:12]
+		}
+		if modified {
+			build.Commit += "-dirty"
+		}
+	}
+	if build.BuildDate == "" {
+		build.BuildDate = stamped
+	}
+	return build
+}
+
+/**************************************************************************************************
+** criteriaHash returns a short hash of the effective criteria, delimiters and stack key template,
+** the grouping the run applies. Two runs logging the same hash group the assets the same way,
+** whatever the spelling of their CRITERIA.
+**
+** @return string - The first 8 hex digits of the SHA-256 of the resolved criteria, or "invalid"
+**                  when CRITERIA cannot be parsed
+**************************************************************************************************/
+func criteriaHash() string {
+	resolved, delimiters, err := stacker.EffectiveCriteria(stacker.Options{
+		Criteria:        criteria,
+		Delimiters:      delimiterList,
+		PromoteResolved: true,
+		SkipMatchMiss:   skipMatchMiss,
+	})
+	if err != nil {
+		return criteriaHashInvalid
+	}
+	grouping := resolved + "\n" + strings.Join(delimiters, "\n")
+	// The template changes which values keep assets apart, without it the hash is unchanged
+	if stackKeyTemplate != "" {
+		grouping += "\n" + stackKeyTemplate
+	}
+	sum := sha256.Sum256([]byte(grouping))
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+/**************************************************************************************************
+** Main execution logic for the version command. Prints the build and the criteria hash, and the
+** version of each Immich server when API_KEY and API_URL are set. A server that cannot be
+** reached is reported in the output, the command still succeeds.
+**
+** @param cmd - Cobra command instance
+** @param args - Command line arguments
+** @return error - Categorized error mapped to the exit code by main, or nil
+**************************************************************************************************/
+func runVersion(cmd *cobra.Command, args []string) error {
+	if versionOutput != "text" && versionOutput != "json" {
+		return configError(fmt.Errorf("invalid output format %q: must be text or json", versionOutput))
+	}
+	// Keep stdout the version alone, the startup logs go to stderr
+	stdoutDocument = true
+	logger, err := loadEnvWithoutAPIKey()
+	if err != nil {
+		return err
+	}
+	checkServers := apiKey != ""
+
+	report := versionReport{buildInfo: currentBuild(), CriteriaHash: criteriaHash()}
+	if checkServers {
+		targets, err := apiTargets()
+		if err != nil {
+			return err
+		}
+		for _, target := range targets {
+			server := versionServer{URL: target.URL}
+			client := immich.NewClient(target.URL, target.Key, false, false, true, withArchived, withDeleted, false, nil, "", "", utils.StackMarkerNone, false, withExif, "", logger)
+			if client == nil {
+				server.Error = "invalid client"
+				report.Servers = append(report.Servers, server)
+				continue
+			}
+			setProxyAuth(client)
+			if err := client.CheckAPIURL(strictURL); err != nil {
+				server.Error = err.Error()
+			} else if server.Version, err = client.FetchServerVersion(); err != nil {
+				server.Error = err.Error()
+			}
+			report.Servers = append(report.Servers, server)
+		}
+	}
+
+	if versionOutput == "json" {
+		encoder := json.NewEncoder(cmd.OutOrStdout())
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return fatalError(fmt.Errorf("error encoding version: %w", err))
+		}
+		return nil
+	}
+	printVersionReport(cmd.OutOrStdout(), report)
+	return nil
+}
+
+/**************************************************************************************************
+** printVersionReport prints the version report as text, one detail per line.
+**
+** @param out - Writer of the report
+** @param report - The report
+**************************************************************************************************/
+func printVersionReport(out io.Writer, report versionReport) {
+	orUnknown := func(value string) string {
+		if value == "" {
+			return "unknown"
+		}
+		return value
+	}
+	fmt.Fprintf(out, "immich-stack %s\n", report.Version)
+	fmt.Fprintf(out, "  commit:    %s\n", orUnknown(report.Commit))
+	fmt.Fprintf(out, "  built:     %s\n", orUnknown(report.BuildDate))
+	fmt.Fprintf(out, "  go:        %s\n", report.GoVersion)
+	fmt.Fprintf(out, "  criteria:  %s\n", report.CriteriaHash)
+	if len(report.Servers) == 0 {
+		fmt.Fprintln(out, "  immich:    not checked, set API_KEY and API_URL")
+		return
+	}
+	for _, server := range report.Servers {
+		if server.Error != "" {
+			fmt.Fprintf(out, "  immich:    %s: %s\n", server.URL, server.Error)
+			continue
+		}
+		fmt.Fprintf(out, "  immich:    %s at %s\n", server.Version, server.URL)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCurrentBuild(t *testing.T) {
+	defer func() { version, commit, buildDate = "dev", "", "" }()
+	version, commit, buildDate = "v1.2.3", "abc1234", "2024-05-01T10:00:00Z"
+
+	build := currentBuild()
+	assert.Equal(t, "v1.2.3", build.Version)
+	assert.Equal(t, "abc1234", build.Commit, "the ldflags win over the VCS stamp")
+	assert.Equal(t, "2024-05-01T10:00:00Z", build.BuildDate)
+	assert.Equal(t, runtime.Version(), build.GoVersion)
+}
+
+func TestCriteriaHash(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+
+	defaultHash := criteriaHash()
+	assert.Len(t, defaultHash, 8)
+
+	criteria = `[{"key":"originalFileName","split":{"delimiters":["~","."],"index":0}},{"key":"localDateTime","delta":{"milliseconds":1000}}]`
+	assert.Equal(t, defaultHash, criteriaHash(), "the default criteria spelled out groups the same way")
+
+	criteria = `[ {"key": "originalFileName", "split": {"delimiters": ["~", "."], "index": 0}}, {"key": "localDateTime", "delta": {"milliseconds": 1000}} ]`
+	assert.Equal(t, defaultHash, criteriaHash(), "the spacing of CRITERIA does not change the hash")
+
+	criteria = `[{"key":"originalFileName","split":{"delimiters":["."],"index":0}},{"key":"localDateTime","delta":{"milliseconds":3000}}]`
+	assert.NotEqual(t, defaultHash, criteriaHash())
+
+	criteria = ""
+	stackKeyTemplate = "{{index .Values 0}}"
+	assert.NotEqual(t, defaultHash, criteriaHash(), "the stack key template changes the grouping")
+	stackKeyTemplate = ""
+
+	criteria = `{`
+	assert.Equal(t, criteriaHashInvalid, criteriaHash())
+}
+
+func TestPrintVersionReport(t *testing.T) {
+	report := versionReport{
+		buildInfo:    buildInfo{Version: "v1.2.3", Commit: "abc1234", GoVersion: "go1.21.5"},
+		CriteriaHash: "24099d27",
+	}
+	var out bytes.Buffer
+	printVersionReport(&out, report)
+	assert.Contains(t, out.String(), "immich-stack v1.2.3\n")
+	assert.Contains(t, out.String(), "commit:    abc1234")
+	assert.Contains(t, out.String(), "built:     unknown")
+	assert.Contains(t, out.String(), "criteria:  24099d27")
+	assert.Contains(t, out.String(), "immich:    not checked, set API_KEY and API_URL")
+
+	report.Servers = []versionServer{
+		{URL: "http://immich:2283/api", Version: "1.119.2"},
+		{URL: "http://other:2283/api", Error: "error fetching server version: unauthorized"},
+	}
+	out.Reset()
+	printVersionReport(&out, report)
+	assert.Contains(t, out.String(), "immich:    1.119.2 at http://immich:2283/api")
+	assert.Contains(t, out.String(), "immich:    http://other:2283/api: error fetching server version: unauthorized")
+}
+
+func TestLoadEnvWithoutAPIKey(t *testing.T) {
+	defer teardownTest()
+	setupTest()
+
+	assert.ErrorContains(t, LoadEnvForTesting().Error, "API_KEY is not set")
+
+	resetGlobalConfig()
+	_, err := loadEnvWithoutAPIKey()
+	assert.NoError(t, err)
+	assert.Empty(t, apiKey, "no placeholder key is set")
+
+	resetGlobalConfig()
+	maxDeleteCount = -1
+	_, err = loadEnvWithoutAPIKey()
+	assert.ErrorContains(t, err, "invalid MAX_DELETE_COUNT", "the other settings are still validated")
+}
@@ -2,12 +2,15 @@ package immich
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/majorfi/immich-stack/pkg/utils"
@@ -22,8 +25,12 @@ const (
 	idleConnTimeout     = 90 * time.Second
 	retryBaseDelay      = 500 * time.Millisecond
 	maxRetries          = 3
+	pingTimeout         = 10 * time.Second
 )
 
+// serverPingPath is the unauthenticated endpoint of the Immich API probed to check API_URL
+const serverPingPath = "/server/ping"
+
 /**************************************************************************************************
 ** Client represents an Immich API client with standard http package implementation.
 ** It handles all API interactions with the Immich server including authentication,
@@ -32,6 +39,7 @@ const (
 type Client struct {
 	client                  *http.Client
 	apiURL                  string
+	configuredURL           string
 	apiKey                  string
 	resetStacks             bool
 	replaceStacks           bool
@@ -42,14 +50,72 @@ type Client struct {
 	filterAlbumIDs          []string
 	filterTakenAfter        string
 	filterTakenBefore       string
+	stackMarker             string
+	resetMarkedOnly         bool
+	withExif                bool
+	filenameQuery           string
+	tagParentWith           string
+	extraHeaders            map[string]string // Headers added to every request, for a reverse proxy
+	basicAuthUser           string
+	basicAuthPass           string
+	tagIDs                  map[string]string          // ID of each tag resolved this run, by name
+	taggedAssets            map[string]map[string]bool // Assets carrying each tag, by tag ID, searched once per run
+	stackParents            map[string]string          // Primary asset ID of each fetched stack, by stack ID
+	stackMembers            map[string][]string        // Asset IDs of each fetched stack, parent first, by stack ID
+	assetStacks             map[string]string          // Stack ID of the assets of the fetched stacks, nil until the stacks are fetched
+	decodeWarned            map[string]bool            // Asset fields whose decode failure was logged
+	span                    *utils.Span                // Parent span of the requests, nil without tracing
+	pageHook                func(page int, assets int)
+	stackHook               func(change StackChange)
+	quiet                   bool  // Per-stack messages are logged at debug level
+	onlyNewStacks           bool  // Nothing is deleted or updated, only stacks of unstacked assets are created
+	withHidden              bool  // The hidden assets are searched as well, in a search of their own
+	fullPayload             bool  // The server rejected the search projection, fetch the full assets
+	authErr                 error // Set once Immich answered 401, returned by every later request
 	logger                  *logrus.Logger
 }
 
+/**************************************************************************************************
+** ImmichClient is the part of the Immich API a stacking run relies on. Client implements it;
+** tests and library users can pass their own implementation instead of a live server.
+** Searching the assets is SearchAssets, listing the stacks is ListStacks, or FetchAllStacks to
+** apply the reset and single asset removal settings as well. CreateStack also merges the stacks
+** of the given assets into the new one, as Immich does, while UpdateStack only changes the
+** primary asset of a stack.
+**************************************************************************************************/
+type ImmichClient interface {
+	GetCurrentUser() (utils.TUserResponse, error)
+	SetPageHook(hook func(page int, assets int))
+	SetStackHook(hook func(change StackChange))
+	SetTraceSpan(span *utils.Span)
+	FetchAllStacks() (map[string]utils.TStack, error)
+	ListStacks() (map[string]utils.TStack, error)
+	PlanStackCleanup() (map[string]utils.TStack, map[string]bool, error)
+	SearchAssets(size int, stacksMap map[string]utils.TStack) ([]utils.TAsset, error)
+	FetchAsset(assetID string) (utils.TAsset, error)
+	FetchLivePhotoVideos(assets []utils.TAsset, stacksMap map[string]utils.TStack) []utils.TAsset
+	CreateStack(assetIDs []string) error
+	UpdateStack(stackID string, primaryAssetID string) error
+	DeleteStack(stackID string, reason string) error
+	MarkStackParent(parent utils.TAsset, marker string) error
+	TagStackParent(parent utils.TAsset) error
+	TrashAssets(assetIDs []string) error
+	FetchJobs() (map[string]utils.TJobStatus, error)
+	FetchAlbums() ([]utils.TAlbum, error)
+	FetchAlbumAssets(albumID string) ([]utils.TAsset, error)
+	FetchDuplicates() ([]utils.TDuplicateGroup, error)
+	CreateAlbum(name, description string) (*utils.TAlbum, error)
+	AddAssetsToAlbum(albumID string, assetIDs []string) error
+	RemoveAssetsFromAlbum(albumID string, assetIDs []string) error
+}
+
+var _ ImmichClient = (*Client)(nil)
+
 /**************************************************************************************************
 ** NewClient creates a new Immich client with standard http package.
 ** It configures the client with retry logic and proper headers.
 **
-** @param apiURL - Base URL of the Immich API
+** @param apiURL - Base URL of the Immich API, normalized by normalizeAPIURL
 ** @param apiKey - API key for authentication
 ** @param resetStacks - Whether to reset all existing stacks
 ** @param replaceStacks - Whether to replace existing stacks
@@ -60,10 +126,14 @@ type Client struct {
 ** @param filterAlbumIDs - Filter by album IDs (empty slice means no filter)
 ** @param filterTakenAfter - Filter assets taken after this date (empty means no filter)
 ** @param filterTakenBefore - Filter assets taken before this date (empty means no filter)
+** @param stackMarker - How to mark created stacks: "description", "tag" or "none"
+** @param resetMarkedOnly - Whether resetting stacks only deletes stacks marked by the tool
+** @param withExif - Whether to request EXIF metadata when fetching assets
+** @param filenameQuery - Filename search term applied server-side (empty means no filter)
 ** @param logger - Logger instance for output
 ** @return *Client - Configured Immich client instance
 **************************************************************************************************/
-func NewClient(apiURL, apiKey string, resetStacks bool, replaceStacks bool, dryRun bool, withArchived bool, withDeleted bool, removeSingleAssetStacks bool, filterAlbumIDs []string, filterTakenAfter string, filterTakenBefore string, logger *logrus.Logger) *Client {
+func NewClient(apiURL, apiKey string, resetStacks bool, replaceStacks bool, dryRun bool, withArchived bool, withDeleted bool, removeSingleAssetStacks bool, filterAlbumIDs []string, filterTakenAfter string, filterTakenBefore string, stackMarker string, resetMarkedOnly bool, withExif bool, filenameQuery string, logger *logrus.Logger) *Client {
 	if apiKey == "" {
 		return nil
 	}
@@ -81,7 +151,8 @@ func NewClient(apiURL, apiKey string, resetStacks bool, replaceStacks bool, dryR
 		return nil
 	}
 
-	baseURL := fmt.Sprintf("%s://%s/api", parsedURL.Scheme, parsedURL.Host)
+	configuredURL := fmt.Sprintf("%s://%s%s", parsedURL.Scheme, parsedURL.Host, strings.TrimRight(parsedURL.Path, "/"))
+	baseURL := normalizeAPIURL(parsedURL)
 
 	client := &http.Client{
 		Timeout: defaultHTTPTimeout,
@@ -95,6 +166,7 @@ func NewClient(apiURL, apiKey string, resetStacks bool, replaceStacks bool, dryR
 	return &Client{
 		client:                  client,
 		apiURL:                  baseURL,
+		configuredURL:           configuredURL,
 		apiKey:                  apiKey,
 		resetStacks:             resetStacks,
 		replaceStacks:           replaceStacks,
@@ -105,13 +177,102 @@ func NewClient(apiURL, apiKey string, resetStacks bool, replaceStacks bool, dryR
 		filterAlbumIDs:          filterAlbumIDs,
 		filterTakenAfter:        filterTakenAfter,
 		filterTakenBefore:       filterTakenBefore,
+		stackMarker:             stackMarker,
+		resetMarkedOnly:         resetMarkedOnly,
+		withExif:                withExif,
+		filenameQuery:           filenameQuery,
 		logger:                  logger,
 	}
 }
 
+// Actions of a stack change reported to the stack hook
+const (
+	StackCreated        = "create"
+	StackDeleted        = "delete"
+	StackMerged         = "merge"
+	StackPrimaryChanged = "primary-change"
+)
+
+/**************************************************************************************************
+** StackChange is a change the client made to the stacks of Immich, dry runs included. A stack
+** created from the members of one existing stack only changed its primary, one taking assets of
+** other stacks merged them, as Immich merges the stacks of the given assets into the new one.
+**************************************************************************************************/
+type StackChange struct {
+	Action         string   // StackCreated, StackDeleted, StackMerged or StackPrimaryChanged
+	StackID        string   // ID of the stack, empty for a stack created in a dry run
+	AssetIDs       []string // IDs of the members, parent first, empty for a stack the client did not fetch
+	ReplacedStacks []string // IDs of the stacks merged into the created one
+	Reason         string   // Reason of a deleted stack
+}
+
+/**************************************************************************************************
+** ErrOnlyNewStacks is the error of a request refused because the client only creates stacks of
+** unstacked assets: every delete or update, and every stack touching a stacked asset.
+**************************************************************************************************/
+var ErrOnlyNewStacks = errors.New("refused by ONLY_NEW_STACKS, which never deletes or modifies anything")
+
+/**************************************************************************************************
+** ResponseError is the error of a request Immich answered with a status other than 2xx.
+**************************************************************************************************/
+type ResponseError struct {
+	Status     string
+	StatusCode int
+	Body       string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("error response: %s - %s", e.Status, e.Body)
+}
+
+/**************************************************************************************************
+** AuthError is the error of a request Immich answered with 401 or 403: the API key was deleted or
+** lacks a permission. Message is the message field of the Immich error, verbatim.
+**************************************************************************************************/
+type AuthError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("Immich rejected the API key (%d %s): %s. Check that the key still exists and has the asset.read, stack.create and stack.delete permissions",
+		e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+/**************************************************************************************************
+** IsAuthError reports whether the error, or one it wraps, is an AuthError.
+**
+** @param err - The error to check
+** @return bool - True when Immich rejected the API key
+**************************************************************************************************/
+func IsAuthError(err error) bool {
+	var authErr *AuthError
+	return errors.As(err, &authErr)
+}
+
+/**************************************************************************************************
+** newAuthError builds the AuthError of a 401 or 403 response, keeping the message field of the
+** Immich error body, or the whole body when it has none.
+**
+** @param statusCode - HTTP status of the response
+** @param body - Body of the response
+** @return *AuthError - The error
+**************************************************************************************************/
+func newAuthError(statusCode int, body []byte) *AuthError {
+	var immichErr struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &immichErr); err != nil || immichErr.Message == "" {
+		return &AuthError{StatusCode: statusCode, Message: string(bytes.TrimSpace(body))}
+	}
+	return &AuthError{StatusCode: statusCode, Message: immichErr.Message}
+}
+
 /**************************************************************************************************
 ** doRequest handles the HTTP request with retry logic and proper error handling.
-** It's a helper function to reduce code duplication across API calls.
+** It's a helper function to reduce code duplication across API calls. A 401 or 403 response is an
+** AuthError. After a 401 the key is unusable, so every later request fails with the same error
+** without reaching Immich. A 403 only concerns the permission of that request.
 **
 ** @param method - HTTP method (GET, POST, etc.)
 ** @param path - API endpoint path
@@ -120,6 +281,13 @@ func NewClient(apiURL, apiKey string, resetStacks bool, replaceStacks bool, dryR
 ** @return error - Any error that occurred during the request
 **************************************************************************************************/
 func (c *Client) doRequest(method, path string, body interface{}, result interface{}) error {
+	if c.authErr != nil {
+		return c.authErr
+	}
+	if c.onlyNewStacks && (method == http.MethodDelete || method == http.MethodPut || method == http.MethodPatch) {
+		return fmt.Errorf("%w: %s %s", ErrOnlyNewStacks, method, path)
+	}
+
 	var bodyReader io.Reader
 	if body != nil {
 		jsonBody, err := json.Marshal(body)
@@ -134,11 +302,20 @@ func (c *Client) doRequest(method, path string, body interface{}, result interfa
 		return fmt.Errorf("error creating request: %w", err)
 	}
 
+	c.setProxyHeaders(req)
 	req.Header.Set("x-api-key", c.apiKey)
 	req.Header.Set("Accept", "application/json")
 	if body != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	// The trace of the run continues in the traces of Immich
+	span := c.span.ClientChild("immich.request")
+	if span != nil {
+		span.SetString("http.request.method", method)
+		span.SetString("url.path", path)
+		req.Header.Set("traceparent", span.TraceParent())
+		defer span.End()
+	}
 
 	for i := 0; i < maxRetries; i++ {
 		resp, err := c.client.Do(req)
@@ -151,10 +328,12 @@ func (c *Client) doRequest(method, path string, body interface{}, result interfa
 		}
 
 		defer resp.Body.Close()
+		span.SetInt("http.response.status_code", resp.StatusCode)
 
 		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
 			if result != nil {
-				if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+				// An empty body leaves the result as is
+				if err := json.NewDecoder(resp.Body).Decode(result); err != nil && err != io.EOF {
 					return fmt.Errorf("error decoding response: %w", err)
 				}
 			}
@@ -162,12 +341,251 @@ func (c *Client) doRequest(method, path string, body interface{}, result interfa
 		}
 
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("error response: %s - %s", resp.Status, string(body))
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			authErr := newAuthError(resp.StatusCode, body)
+			if resp.StatusCode == http.StatusUnauthorized {
+				c.authErr = authErr
+			}
+			return authErr
+		}
+		return &ResponseError{Status: resp.Status, StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	return fmt.Errorf("failed after %d retries", maxRetries)
 }
 
+/**************************************************************************************************
+** SetPageHook sets a function called after each page of assets is fetched, with the page number
+** and the number of assets of the page. A nil hook is not called.
+**
+** @param hook - Function called after each page
+**************************************************************************************************/
+func (c *Client) SetPageHook(hook func(page int, assets int)) {
+	c.pageHook = hook
+}
+
+/**************************************************************************************************
+** SetStackHook sets a function called after each stack is created or deleted, dry runs included,
+** the stacks reset or removed by FetchAllStacks as well. A nil hook is not called.
+**
+** @param hook - Function called after each stack change
+**************************************************************************************************/
+func (c *Client) SetStackHook(hook func(change StackChange)) {
+	c.stackHook = hook
+}
+
+/**************************************************************************************************
+** SetExtraHeaders sets headers added to every request, such as the one a reverse proxy in front
+** of Immich requires. They cannot replace the API key, which is set after them.
+**
+** @param headers - Header values by name, nil for none
+**************************************************************************************************/
+func (c *Client) SetExtraHeaders(headers map[string]string) {
+	c.extraHeaders = headers
+}
+
+/**************************************************************************************************
+** SetBasicAuth sends the credentials of a reverse proxy with every request, in the Authorization
+** header. An empty user sends none.
+**
+** @param user - User name of the proxy
+** @param pass - Password of the proxy
+**************************************************************************************************/
+func (c *Client) SetBasicAuth(user, pass string) {
+	c.basicAuthUser = user
+	c.basicAuthPass = pass
+}
+
+/**************************************************************************************************
+** setProxyHeaders adds the extra headers and the basic auth credentials to a request.
+**
+** @param req - Request to send
+**************************************************************************************************/
+func (c *Client) setProxyHeaders(req *http.Request) {
+	for name, value := range c.extraHeaders {
+		req.Header.Set(name, value)
+	}
+	if c.basicAuthUser != "" {
+		req.SetBasicAuth(c.basicAuthUser, c.basicAuthPass)
+	}
+}
+
+/**************************************************************************************************
+** SetTraceSpan sets the span the requests are traced under, and whose trace they carry to Immich
+** in their traceparent header. A nil span traces nothing.
+**
+** @param span - Parent span of the requests
+**************************************************************************************************/
+func (c *Client) SetTraceSpan(span *utils.Span) {
+	c.span = span
+}
+
+/**************************************************************************************************
+** SetQuiet logs the routine per-stack messages of the client, such as the deleted stacks, at
+** debug level instead of info. Warnings and errors are not affected.
+**
+** @param quiet - Whether to lower the per-stack messages to debug
+**************************************************************************************************/
+func (c *Client) SetQuiet(quiet bool) {
+	c.quiet = quiet
+}
+
+/**************************************************************************************************
+** SetTagParentWith attaches a tag to the parent of every stack the client creates, and removes it
+** from the parent of every stack it deletes.
+**
+** @param tag - Name of the tag, empty for no tag
+**************************************************************************************************/
+func (c *Client) SetTagParentWith(tag string) {
+	c.tagParentWith = tag
+}
+
+/**************************************************************************************************
+** SetOnlyNewStacks restricts the client to creating stacks of unstacked assets. Every delete or
+** update request is refused, whatever the caller, as is a stack including an asset of the fetched
+** stacks, which Immich would merge. A stack is refused as well before the stacks are fetched.
+**
+** @param onlyNew - Whether to refuse anything but the creation of new stacks
+**************************************************************************************************/
+func (c *Client) SetOnlyNewStacks(onlyNew bool) {
+	c.onlyNewStacks = onlyNew
+}
+
+/**************************************************************************************************
+** SetWithHidden searches the hidden assets as well in SearchAssets. The search of Immich leaves
+** them out, so they are fetched by a search of their own, which an older server without the
+** visibility field may refuse: the visible assets are then fetched alone.
+**
+** @param withHidden - Whether to search the hidden assets
+**************************************************************************************************/
+func (c *Client) SetWithHidden(withHidden bool) {
+	c.withHidden = withHidden
+}
+
+/**************************************************************************************************
+** searchPass is one search of SearchAssets: the album filter, empty for all the albums, and the
+** visibility searched, empty for the visible assets.
+**************************************************************************************************/
+type searchPass struct {
+	albums     []string
+	visibility string
+}
+
+/**************************************************************************************************
+** normalizeAPIURL returns the API URL of a configured API_URL: duplicate and trailing slashes are
+** dropped and /api is appended when missing. The path is kept, for servers behind a reverse proxy
+** on a subpath.
+**
+** @param parsedURL - The parsed API_URL
+** @return string - The normalized API URL
+**************************************************************************************************/
+func normalizeAPIURL(parsedURL *url.URL) string {
+	path := parsedURL.Path
+	for strings.Contains(path, "//") {
+		path = strings.ReplaceAll(path, "//", "/")
+	}
+	path = strings.TrimRight(path, "/")
+	if !strings.HasSuffix(path, "/api") {
+		path += "/api"
+	}
+	return fmt.Sprintf("%s://%s%s", parsedURL.Scheme, parsedURL.Host, path)
+}
+
+/**************************************************************************************************
+** CheckAPIURL probes the ping endpoint of the API URL before the run. When it does not answer,
+** the normalized URL and the /api of the host are tried in turn and the first one answering is
+** used, with a warning. In strict mode API_URL is used as configured, trailing slashes aside, and
+** a URL that does not answer is an error naming the one that does. A server that cannot be
+** reached is left to the first request of the run, which reports it.
+**
+** @param strict - Whether to use API_URL as configured instead of correcting it
+** @return error - An error if API_URL is wrong in strict mode, or nil
+**************************************************************************************************/
+func (c *Client) CheckAPIURL(strict bool) error {
+	if strict {
+		c.apiURL = c.configuredURL
+	}
+	answered, err := c.ping(c.apiURL)
+	if err != nil {
+		c.logger.Debugf("Could not probe %s: %v", c.apiURL+serverPingPath, err)
+		return nil
+	}
+	if answered {
+		if c.apiURL != c.configuredURL {
+			c.logger.Infof("Using API URL %s for API_URL %s", c.apiURL, c.configuredURL)
+		}
+		return nil
+	}
+
+	parsedURL, err := url.Parse(c.configuredURL)
+	if err != nil {
+		return fmt.Errorf("invalid API_URL %s: %w", c.configuredURL, err)
+	}
+	for _, candidate := range []string{normalizeAPIURL(parsedURL), fmt.Sprintf("%s://%s/api", parsedURL.Scheme, parsedURL.Host)} {
+		if candidate == c.apiURL {
+			continue
+		}
+		if answered, err := c.ping(candidate); err != nil || !answered {
+			continue
+		}
+		if strict {
+			return fmt.Errorf("API_URL %s is not the Immich API, %s is: fix API_URL or unset STRICT_URL", c.configuredURL, candidate)
+		}
+		c.logger.Warnf("API_URL %s is not the Immich API, using %s instead. Set API_URL to it to silence this warning", c.configuredURL, candidate)
+		c.apiURL = candidate
+		return nil
+	}
+	if strict {
+		return fmt.Errorf("API_URL %s is not the Immich API: %s did not answer", c.configuredURL, c.apiURL+serverPingPath)
+	}
+	c.logger.Warnf("API_URL %s does not look like the Immich API: %s did not answer", c.configuredURL, c.apiURL+serverPingPath)
+	return nil
+}
+
+/**************************************************************************************************
+** ping tells whether an API URL answers the ping endpoint of Immich. The web app answers any
+** path outside /api with its index page, so the answer must be the pong of the API.
+**
+** @param apiURL - API URL to probe
+** @return bool - Whether the Immich API answered
+** @return error - An error if the server could not be reached
+**************************************************************************************************/
+func (c *Client) ping(apiURL string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL+serverPingPath, nil)
+	if err != nil {
+		return false, fmt.Errorf("error creating request: %w", err)
+	}
+	c.setProxyHeaders(req)
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var pong struct {
+		Res string `json:"res"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&pong) != nil {
+		return false, nil
+	}
+	return pong.Res == "pong", nil
+}
+
+/**************************************************************************************************
+** stackLogLevel returns the level of the routine per-stack messages.
+**
+** @return logrus.Level - Debug when quiet, info otherwise
+**************************************************************************************************/
+func (c *Client) stackLogLevel() logrus.Level {
+	if c.quiet {
+		return logrus.DebugLevel
+	}
+	return logrus.InfoLevel
+}
+
 /**************************************************************************************************
 ** FetchAllStacks retrieves all stacks from Immich and handles stack management.
 ** If resetStacks is true, it will delete all existing stacks.
@@ -177,231 +595,1228 @@ func (c *Client) doRequest(method, path string, body interface{}, result interfa
 ** @return error - Any error that occurred during the fetch
 **************************************************************************************************/
 func (c *Client) FetchAllStacks() (map[string]utils.TStack, error) {
-	var stacks []utils.TStack
-	if err := c.doRequest(http.MethodGet, "/stacks", nil, &stacks); err != nil {
-		return nil, fmt.Errorf("error fetching stacks: %w", err)
+	stacks, err := c.fetchStacks()
+	if err != nil {
+		return nil, err
+	}
+
+	toClean, err := c.stacksToClean(stacks)
+	if err != nil {
+		return nil, err
 	}
 
 	// Log info when starting reset stacks operation
 	if c.resetStacks {
-		if len(stacks) > 0 {
-			c.logger.Infof("🔄 Starting reset stacks operation - will delete %d existing stacks", len(stacks))
+		if len(toClean) > 0 {
+			c.logger.Infof("🔄 Starting reset stacks operation - will delete %d existing stacks", len(toClean))
 		} else {
 			c.logger.Infof("🔄 Reset stacks operation - no existing stacks to delete")
 		}
-	}
-
-	// Handle single-asset stacks and reset if needed
-	for _, stack := range stacks {
-		if c.resetStacks {
+		for _, stack := range toClean {
 			c.logger.Debugf("🔄 Resetting stack %s", stack.PrimaryAssetID)
 			if err := c.DeleteStack(stack.ID, utils.REASON_RESET_STACK); err != nil {
+				if IsAuthError(err) {
+					return nil, fmt.Errorf("error resetting stacks: %w", err)
+				}
 				c.logger.Errorf("Error deleting stack: %v", err)
 			}
-		} else if c.removeSingleAssetStacks && len(stack.Assets) <= 1 {
+		}
+	} else {
+		for _, stack := range toClean {
 			if err := c.DeleteStack(stack.ID, utils.REASON_DELETE_STACK_WITH_ONE_ASSET); err != nil {
+				if IsAuthError(err) {
+					return nil, fmt.Errorf("error removing single-asset stacks: %w", err)
+				}
 				c.logger.Errorf("Error deleting stack: %v", err)
 			}
 		}
 	}
 
-	if c.resetStacks {
-		if c.dryRun {
-			return nil, nil
+	if c.resetStacks {
+		if c.dryRun {
+			return nil, nil
+		}
+		c.logger.Warnf(`⚠️ Done resetting stacks.`)
+		c.resetStacks = false
+		if !c.resetMarkedOnly {
+			return map[string]utils.TStack{}, nil
+		}
+		stacks = excludeStacks(stacks, toClean)
+	}
+
+	// Log stack statistics only in debug mode
+	if c.logger.IsLevelEnabled(logrus.DebugLevel) {
+		stackCounts := make(map[int]int)
+		for _, stack := range stacks {
+			stackCounts[len(stack.Assets)]++
+		}
+
+		for count, num := range stackCounts {
+			c.logger.Debugf("📚 %d assets in a stack with %d assets", num, count)
+		}
+	}
+
+	c.logger.Infof("📚 Fetched %d stacks", len(stacks))
+	return stacksByAsset(stacks), nil
+}
+
+/**************************************************************************************************
+** ListStacks retrieves all stacks from Immich without changing any of them, whatever the reset
+** and single asset removal settings of the client. It suits a second look at the stacks within
+** a run, such as the repair of an interrupted replacement.
+**
+** @return map[string]utils.TStack - Map of stacks indexed by the ID of each of their assets
+** @return error - Any error that occurred during the fetch
+**************************************************************************************************/
+func (c *Client) ListStacks() (map[string]utils.TStack, error) {
+	stacks, err := c.fetchStacks()
+	if err != nil {
+		return nil, err
+	}
+	return stacksByAsset(stacks), nil
+}
+
+/**************************************************************************************************
+** PlanStackCleanup retrieves all stacks from Immich without changing any of them, along with the
+** ones FetchAllStacks would delete for the reset or the single asset removal, so the deletions
+** can be weighed before they happen.
+**
+** @return map[string]utils.TStack - Map of stacks indexed by the ID of each of their assets
+** @return map[string]bool - IDs of the stacks FetchAllStacks would delete
+** @return error - Any error that occurred during the fetch
+**************************************************************************************************/
+func (c *Client) PlanStackCleanup() (map[string]utils.TStack, map[string]bool, error) {
+	stacks, err := c.fetchStacks()
+	if err != nil {
+		return nil, nil, err
+	}
+	doomed, err := c.stacksToClean(stacks)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := make(map[string]bool, len(doomed))
+	for _, stack := range doomed {
+		ids[stack.ID] = true
+	}
+	return stacksByAsset(stacks), ids, nil
+}
+
+/**************************************************************************************************
+** stacksToClean returns the stacks FetchAllStacks deletes: all of them, or only the marked ones,
+** for a reset, and the stacks of a single asset otherwise, when their removal is enabled.
+**
+** @param stacks - All stacks
+** @return []utils.TStack - The stacks to delete
+** @return error - Any error while fetching the marked stacks
+**************************************************************************************************/
+func (c *Client) stacksToClean(stacks []utils.TStack) ([]utils.TStack, error) {
+	switch {
+	case c.resetStacks && c.resetMarkedOnly:
+		// Only reset stacks created by the tool when requested
+		tagged, err := c.markerTagged()
+		if err != nil {
+			return nil, fmt.Errorf("error fetching the marked stacks: %w", err)
+		}
+		return filterMarkedStacks(stacks, tagged), nil
+	case c.resetStacks:
+		return stacks, nil
+	case c.removeSingleAssetStacks:
+		var single []utils.TStack
+		for _, stack := range stacks {
+			if len(stack.Assets) <= 1 {
+				single = append(single, stack)
+			}
+		}
+		return single, nil
+	}
+	return nil, nil
+}
+
+/**************************************************************************************************
+** fetchStacks retrieves all stacks from Immich (GET /stacks) and records them, for the untagging
+** of their parents and the stack changes.
+**
+** @return []utils.TStack - The stacks
+** @return error - Any error that occurred during the fetch
+**************************************************************************************************/
+func (c *Client) fetchStacks() ([]utils.TStack, error) {
+	var stacks []utils.TStack
+	if err := c.doRequest(http.MethodGet, "/stacks", nil, &stacks); err != nil {
+		return nil, fmt.Errorf("error fetching stacks: %w", err)
+	}
+	c.stackParents = make(map[string]string, len(stacks))
+	c.stackMembers = make(map[string][]string, len(stacks))
+	c.assetStacks = make(map[string]string)
+	for _, stack := range stacks {
+		c.recordStack(stack.ID, stackAssetIDs(stack))
+	}
+	return stacks, nil
+}
+
+/**************************************************************************************************
+** stacksByAsset indexes the stacks by the ID of each of their assets.
+**
+** @param stacks - The stacks
+** @return map[string]utils.TStack - The stack of each stacked asset
+**************************************************************************************************/
+func stacksByAsset(stacks []utils.TStack) map[string]utils.TStack {
+	stacksMap := make(map[string]utils.TStack)
+	for _, stack := range stacks {
+		for _, asset := range stack.Assets {
+			stacksMap[asset.ID] = stack
+		}
+	}
+	return stacksMap
+}
+
+/**************************************************************************************************
+** FetchStack retrieves a single stack by ID (GET /stacks/{id}).
+**
+** @param stackID - ID of the stack to fetch
+** @return utils.TStack - The stack
+** @return error - Any error that occurred during the fetch
+**************************************************************************************************/
+func (c *Client) FetchStack(stackID string) (utils.TStack, error) {
+	var stack utils.TStack
+	if err := c.doRequest(http.MethodGet, "/stacks/"+stackID, nil, &stack); err != nil {
+		return stack, fmt.Errorf("error fetching stack %s: %w", stackID, err)
+	}
+	c.recordStack(stack.ID, stackAssetIDs(stack))
+	return stack, nil
+}
+
+/**************************************************************************************************
+** recordStack remembers a stack, its parent and its members, for the untagging of its parent and
+** the stack changes.
+**
+** @param stackID - ID of the stack
+** @param assetIDs - IDs of the members, parent first
+**************************************************************************************************/
+func (c *Client) recordStack(stackID string, assetIDs []string) {
+	if c.stackParents == nil {
+		c.stackParents = make(map[string]string)
+		c.stackMembers = make(map[string][]string)
+	}
+	c.stackParents[stackID] = assetIDs[0]
+	c.stackMembers[stackID] = assetIDs
+	if c.assetStacks != nil {
+		for _, id := range assetIDs {
+			c.assetStacks[id] = stackID
+		}
+	}
+}
+
+/**************************************************************************************************
+** stackAssetIDs returns the IDs of the members of a fetched stack, parent first.
+**
+** @param stack - The stack
+** @return []string - The IDs
+**************************************************************************************************/
+func stackAssetIDs(stack utils.TStack) []string {
+	ids := make([]string, 0, len(stack.Assets)+1)
+	ids = append(ids, stack.PrimaryAssetID)
+	for _, asset := range stack.Assets {
+		if asset.ID != stack.PrimaryAssetID {
+			ids = append(ids, asset.ID)
+		}
+	}
+	return ids
+}
+
+/**************************************************************************************************
+** forgetStack drops a deleted stack, its members being unstacked.
+**
+** @param stackID - ID of the stack
+**************************************************************************************************/
+func (c *Client) forgetStack(stackID string) {
+	for _, id := range c.stackMembers[stackID] {
+		if c.assetStacks[id] == stackID {
+			delete(c.assetStacks, id)
+		}
+	}
+	delete(c.stackMembers, stackID)
+}
+
+/**************************************************************************************************
+** reportStackChange passes a stack change to the stack hook, if any.
+**
+** @param change - The change
+**************************************************************************************************/
+func (c *Client) reportStackChange(change StackChange) {
+	if c.stackHook != nil {
+		c.stackHook(change)
+	}
+}
+
+/**************************************************************************************************
+** newStackChange tells what creating a stack of the given assets does to the fetched stacks: a
+** create, a primary change when they are exactly the members of one stack, or a merge.
+**
+** @param assetIDs - IDs of the members, parent first
+** @return StackChange - The change, without the ID of the new stack
+**************************************************************************************************/
+func (c *Client) newStackChange(assetIDs []string) StackChange {
+	change := StackChange{Action: StackCreated, AssetIDs: assetIDs}
+	seen := make(map[string]bool)
+	unstacked := false
+	for _, id := range assetIDs {
+		stackID, ok := c.assetStacks[id]
+		unstacked = unstacked || !ok
+		if ok && !seen[stackID] {
+			seen[stackID] = true
+			change.ReplacedStacks = append(change.ReplacedStacks, stackID)
+		}
+	}
+	switch {
+	case len(change.ReplacedStacks) == 0:
+	case len(change.ReplacedStacks) == 1 && !unstacked && len(c.stackMembers[change.ReplacedStacks[0]]) == len(assetIDs):
+		change.Action = StackPrimaryChanged
+	default:
+		change.Action = StackMerged
+	}
+	return change
+}
+
+/**************************************************************************************************
+** SearchAssets retrieves all assets from Immich with pagination support.
+** Assets are enriched with their stack information if available. With SetWithHidden, the hidden
+** assets of each album filter are searched after the visible ones.
+**
+** @param size - Number of assets per page
+** @param stacksMap - Map of existing stacks for enrichment
+** @return []stacker.Asset - List of all assets
+** @return error - Any error that occurred during the fetch
+**************************************************************************************************/
+func (c *Client) SearchAssets(size int, stacksMap map[string]utils.TStack) ([]utils.TAsset, error) {
+	// Resolve album filters (names to UUIDs) once
+	resolvedAlbumIDs, err := c.resolveAlbumFilters(c.filterAlbumIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate date filters once before processing (not inside loops)
+	var takenAfterTime, takenBeforeTime time.Time
+	if c.filterTakenAfter != "" {
+		takenAfterTime, err = time.Parse(time.RFC3339, c.filterTakenAfter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid takenAfter date format (expected ISO 8601/RFC3339): %s", c.filterTakenAfter)
+		}
+	}
+	if c.filterTakenBefore != "" {
+		takenBeforeTime, err = time.Parse(time.RFC3339, c.filterTakenBefore)
+		if err != nil {
+			return nil, fmt.Errorf("invalid takenBefore date format (expected ISO 8601/RFC3339): %s", c.filterTakenBefore)
+		}
+	}
+	if c.filterTakenAfter != "" && c.filterTakenBefore != "" && !takenAfterTime.Before(takenBeforeTime) {
+		return nil, fmt.Errorf("takenAfter (%s) must be before takenBefore (%s)", c.filterTakenAfter, c.filterTakenBefore)
+	}
+
+	c.logger.Infof("⬇️  Fetching assets:")
+	if c.fullPayload {
+		c.logger.Infof("🔎 Asset projection: full assets, the server rejected the projection")
+	} else {
+		c.logger.Infof("🔎 Asset projection: exif=%t, people=false", c.searchProjection()["withExif"])
+	}
+
+	// If multiple albums specified, fetch each separately and deduplicate.
+	// This implements OR logic: assets in album1 OR album2 OR album3.
+	var albumFilters [][]string
+	if len(resolvedAlbumIDs) == 0 {
+		albumFilters = [][]string{nil} // No album filter
+	} else if len(resolvedAlbumIDs) == 1 {
+		albumFilters = [][]string{resolvedAlbumIDs}
+	} else {
+		for _, albumID := range resolvedAlbumIDs {
+			albumFilters = append(albumFilters, []string{albumID})
+		}
+	}
+	var passes []searchPass
+	for _, albumFilter := range albumFilters {
+		passes = append(passes, searchPass{albums: albumFilter})
+		if c.withHidden {
+			passes = append(passes, searchPass{albums: albumFilter, visibility: utils.VisibilityHidden})
+		}
+	}
+
+	// Search pass whose pages first returned each asset
+	seen := make(map[string]int)
+	var allAssets []utils.TAsset
+	var pages int
+	var overlaps int
+	var unfilteredTotal int
+	var countErr error
+
+	received := make([]int, len(passes))
+passes:
+	for i, pass := range passes {
+		if c.filenameQuery != "" && countErr == nil {
+			var total int
+			total, countErr = c.countAssets(pass, "")
+			unfilteredTotal += total
+		}
+
+		pager := newSearchPager()
+		count := 0
+		repeated := 0
+		for {
+			switch {
+			case len(pass.albums) > 0 && pass.visibility != "":
+				c.logger.Debugf("Fetching page %v of the %s assets for album(s) %v", pager.page, pass.visibility, pass.albums)
+			case len(pass.albums) > 0:
+				c.logger.Debugf("Fetching page %v for album(s) %v", pager.page, pass.albums)
+			case pass.visibility != "":
+				c.logger.Debugf("Fetching page %v of the %s assets", pager.page, pass.visibility)
+			default:
+				c.logger.Debugf("Fetching page %v", pager.page)
+			}
+			var response utils.TSearchResponse
+
+			payload := c.searchFilters(pass)
+			payload["size"] = size
+			payload["page"] = pager.page
+			payload["order"] = "asc"
+			payload["withStacked"] = true
+			if c.filenameQuery != "" {
+				payload["originalFileName"] = c.filenameQuery
+			}
+			for key, value := range c.searchProjection() {
+				payload[key] = value
+			}
+
+			pageSpan := c.span.Child("fetch_page")
+			pageSpan.SetInt("page", pages+pager.pages+1)
+			err := c.doRequest(http.MethodPost, "/search/metadata", payload, &response)
+			var respErr *ResponseError
+			// An older server refuses the visibility, the hidden assets are then left out
+			if err != nil && pass.visibility != "" && errors.As(err, &respErr) && respErr.StatusCode == http.StatusBadRequest {
+				pageSpan.SetError(err)
+				pageSpan.End()
+				c.logger.Warnf("⚠️  Immich refused the search of the %s assets (%v), they are left out", pass.visibility, err)
+				received[i] = -1
+				continue passes
+			}
+			if err != nil && !c.fullPayload && errors.As(err, &respErr) && respErr.StatusCode == http.StatusBadRequest {
+				c.logger.Warnf("Immich rejected the asset projection (%v), fetching the full assets", err)
+				for key := range c.searchProjection() {
+					delete(payload, key)
+				}
+				c.fullPayload = true
+				err = c.doRequest(http.MethodPost, "/search/metadata", payload, &response)
+			}
+			pageSpan.SetInt("assets", len(response.Assets.Items))
+			pageSpan.SetError(err)
+			pageSpan.End()
+			if err != nil {
+				c.logger.Errorf("Error fetching assets: %v", err)
+				return nil, fmt.Errorf("error fetching assets: %w", err)
+			}
+
+			c.reportDecodeErrors(response.Assets.Items)
+
+			// Enrich assets with stack information and deduplicate
+			count += len(response.Assets.Items)
+			for j := range response.Assets.Items {
+				asset := &response.Assets.Items[j]
+				if first, ok := seen[asset.ID]; ok {
+					// An asset in two albums is expected, twice in one search the pages shifted
+					if first == i {
+						repeated++
+					}
+					continue
+				}
+				seen[asset.ID] = i
+				if stack, ok := stacksMap[asset.ID]; ok {
+					asset.Stack = &stack
+				}
+				allAssets = append(allAssets, *asset)
+			}
+			if c.pageHook != nil {
+				c.pageHook(pages+pager.pages+1, len(response.Assets.Items))
+			}
+
+			more, err := pager.next(response.Assets.NextPage)
+			if err != nil {
+				c.logger.Errorf("Error fetching assets: %v", err)
+				return nil, fmt.Errorf("error fetching assets: %w", err)
+			}
+			if !more {
+				break
+			}
+		}
+		pages += pager.pages
+		received[i] = count - repeated
+		overlaps += repeated
+	}
+
+	c.logger.Infof("🌄 %d assets fetched in %d pages", len(allAssets), pages)
+	if overlaps > 0 {
+		c.logger.Warnf("⚠️  %d assets returned on two pages skipped, the library changed during the fetch", overlaps)
+	}
+	c.checkFetchedAssets(passes, received)
+	if c.filenameQuery != "" {
+		if countErr != nil {
+			c.logger.Debugf("Could not count the assets skipped by the filename filter: %v", countErr)
+		} else if skipped := unfilteredTotal - len(allAssets); skipped > 0 {
+			c.logger.Infof("🔎 Filename filter %q skipped %d of %d assets server-side", c.filenameQuery, skipped, unfilteredTotal)
+		}
+	}
+	return allAssets, nil
+}
+
+/**************************************************************************************************
+** reportDecodeErrors warns about the asset fields that failed to decode, such as a field whose
+** type changed in a newer Immich. Each field is logged once per client, with a sample asset.
+**
+** @param assets - Assets just decoded
+**************************************************************************************************/
+func (c *Client) reportDecodeErrors(assets []utils.TAsset) {
+	for _, asset := range assets {
+		for _, field := range asset.DecodeErrors {
+			if c.decodeWarned[field] {
+				continue
+			}
+			if c.decodeWarned == nil {
+				c.decodeWarned = make(map[string]bool)
+			}
+			c.decodeWarned[field] = true
+			c.logger.Warnf("⚠️  Could not decode the %s field of the assets, left empty (e.g. asset %s)", field, asset.ID)
+		}
+	}
+}
+
+/**************************************************************************************************
+** checkFetchedAssets compares the assets received for each search pass with the count of the
+** server, so a server stopping the pages early does not go unnoticed. A count that cannot be
+** taken is only logged in debug.
+**
+** @param passes - Search passes of the fetch
+** @param received - Assets received for each pass, without those repeated by its pages, -1 for a
+**                   pass the server refused
+**************************************************************************************************/
+func (c *Client) checkFetchedAssets(passes []searchPass, received []int) {
+	for i, pass := range passes {
+		if received[i] < 0 {
+			continue
+		}
+		expected, err := c.countAssets(pass, c.filenameQuery)
+		if err != nil {
+			c.logger.Debugf("Could not count the assets on the server: %v", err)
+			return
+		}
+		if received[i] < expected {
+			c.logger.Warnf("⚠️  Fetched %d assets but the server reports %d, the fetch may be truncated", received[i], expected)
+			continue
+		}
+		c.logger.Debugf("Fetched %d assets, the server reports %d", received[i], expected)
+	}
+}
+
+/**************************************************************************************************
+** searchPager follows the pages of a metadata search. A page number is sent back as a number
+** and must grow, any other token is a cursor sent back as is and must not repeat, so a server
+** returning the same page again stops the fetch with an error instead of looping.
+**************************************************************************************************/
+type searchPager struct {
+	page  interface{} // Page of the next request: a page number or a cursor
+	last  int         // Last page number requested
+	pages int         // Pages fetched
+	seen  map[string]bool
+}
+
+/**************************************************************************************************
+** newSearchPager starts at the first page.
+**
+** @return *searchPager - The pager
+**************************************************************************************************/
+func newSearchPager() *searchPager {
+	return &searchPager{page: 1, last: 1, seen: map[string]bool{"1": true}}
+}
+
+/**************************************************************************************************
+** next moves to the page following a fetched one.
+**
+** @param token - Next page returned with the fetched page
+** @return bool - False after the last page
+** @return error - An error if the server went back to a page already fetched
+**************************************************************************************************/
+func (p *searchPager) next(token utils.TPageToken) (bool, error) {
+	p.pages++
+	next := strings.TrimSpace(string(token))
+	if next == "" || next == "0" {
+		return false, nil
+	}
+	if p.seen[next] {
+		return false, fmt.Errorf("the server returned page %q again after %d pages, the fetch would never end", next, p.pages)
+	}
+	p.seen[next] = true
+	if number, err := strconv.Atoi(next); err == nil {
+		if number <= p.last {
+			return false, fmt.Errorf("the server returned page %d after page %d, the fetch would not progress", number, p.last)
+		}
+		p.last = number
+		p.page = number
+		return true, nil
+	}
+	p.page = next
+	return true, nil
+}
+
+/**************************************************************************************************
+** searchProjection returns the search parameters selecting the asset fields the run needs, from
+** the criteria and promote settings analyzed at startup. EXIF is only requested for EXIF based
+** criteria or promotion, and for the description marker, which must not overwrite existing
+** descriptions. People are never used. Once the server rejected the projection, it is empty and
+** the server returns its full assets.
+**
+** @return map[string]interface{} - The projection parameters of the search payload
+**************************************************************************************************/
+func (c *Client) searchProjection() map[string]interface{} {
+	if c.fullPayload {
+		return nil
+	}
+	return map[string]interface{}{
+		"withExif":   c.withExif || c.stackMarker == utils.StackMarkerDescription,
+		"withPeople": false,
+	}
+}
+
+/**************************************************************************************************
+** searchFilters builds the asset search filters shared by the search and the statistics
+** requests: type, visibility, archived and deleted assets, album and date range.
+**
+** @param pass - Album IDs to search in (empty means all albums) and visibility searched
+** @return map[string]interface{} - The search payload
+**************************************************************************************************/
+func (c *Client) searchFilters(pass searchPass) map[string]interface{} {
+	payload := map[string]interface{}{
+		"type":         "IMAGE",
+		"isVisible":    true,
+		"withArchived": c.withArchived,
+		"withDeleted":  c.withDeleted,
+	}
+	if pass.visibility != "" {
+		delete(payload, "isVisible")
+		payload["visibility"] = pass.visibility
+	}
+	if len(pass.albums) > 0 {
+		payload["albumIds"] = pass.albums
+	}
+	if c.filterTakenAfter != "" {
+		payload["takenAfter"] = c.filterTakenAfter
+	}
+	if c.filterTakenBefore != "" {
+		payload["takenBefore"] = c.filterTakenBefore
+	}
+	return payload
+}
+
+/**************************************************************************************************
+** countAssets counts the assets matching the search filters (POST /search/statistics), to
+** report how many assets the filename filter saved and to detect a truncated fetch.
+**
+** @param pass - Album IDs to search in (empty means all albums) and visibility searched
+** @param filenameQuery - Filename filter, empty for none
+** @return int - Number of matching assets
+** @return error - Any error that occurred during the request
+**************************************************************************************************/
+func (c *Client) countAssets(pass searchPass, filenameQuery string) (int, error) {
+	var response struct {
+		Total int `json:"total"`
+	}
+	payload := c.searchFilters(pass)
+	if filenameQuery != "" {
+		payload["originalFileName"] = filenameQuery
+	}
+	if err := c.doRequest(http.MethodPost, "/search/statistics", payload, &response); err != nil {
+		return 0, err
+	}
+	return response.Total, nil
+}
+
+/**************************************************************************************************
+** FetchAsset retrieves a single asset by ID (GET /assets/{id}).
+**
+** @param assetID - ID of the asset to fetch
+** @return utils.TAsset - The asset
+** @return error - Any error that occurred during the fetch
+**************************************************************************************************/
+func (c *Client) FetchAsset(assetID string) (utils.TAsset, error) {
+	var asset utils.TAsset
+	if err := c.doRequest(http.MethodGet, "/assets/"+assetID, nil, &asset); err != nil {
+		return asset, fmt.Errorf("error fetching asset %s: %w", assetID, err)
+	}
+	c.reportDecodeErrors([]utils.TAsset{asset})
+	return asset, nil
+}
+
+/**************************************************************************************************
+** FetchLivePhotoVideos retrieves the live photo videos referenced by the given assets that are
+** not part of the set. The asset search only returns visible images, so the motion part of a
+** live photo is fetched by a search of the hidden videos, a few pages for the whole library. An
+** older server refusing the visibility field falls back on fetching the videos one by one, as
+** does a video the search did not return. Videos that cannot be fetched are logged and skipped.
+**
+** @param assets - Assets already fetched
+** @param stacksMap - Map of existing stacks for enrichment
+** @return []utils.TAsset - The referenced videos missing from assets
+**************************************************************************************************/
+func (c *Client) FetchLivePhotoVideos(assets []utils.TAsset, stacksMap map[string]utils.TStack) []utils.TAsset {
+	seen := make(map[string]bool, len(assets))
+	for _, asset := range assets {
+		seen[asset.ID] = true
+	}
+	var missing []utils.TAsset
+	for _, asset := range assets {
+		videoID := asset.LivePhotoVideoID
+		if videoID == "" || seen[videoID] {
+			continue
+		}
+		seen[videoID] = true
+		missing = append(missing, asset)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	hidden, err := c.searchHiddenVideos()
+	if err != nil {
+		c.logger.Warnf("⚠️  Immich refused the search of the live photo videos (%v), fetching them one by one", err)
+	}
+
+	var videos []utils.TAsset
+	for _, asset := range missing {
+		video, ok := hidden[asset.LivePhotoVideoID]
+		if !ok {
+			if video, err = c.FetchAsset(asset.LivePhotoVideoID); err != nil {
+				c.logger.Warnf("Could not fetch live photo video of %s: %v", asset.OriginalFileName, err)
+				if IsAuthError(err) {
+					// The other videos would fail the same way
+					break
+				}
+				continue
+			}
+		}
+		if stack, ok := stacksMap[video.ID]; ok {
+			video.Stack = &stack
+		}
+		videos = append(videos, video)
+	}
+
+	if len(videos) > 0 {
+		c.logger.Infof("🎞️  %d live photo videos fetched", len(videos))
+	}
+	return videos
+}
+
+/**************************************************************************************************
+** searchHiddenVideos fetches the hidden videos of the library, the motion parts of its live
+** photos, page after page (POST /search/metadata).
+**
+** @return map[string]utils.TAsset - The videos by ID
+** @return error - Any error of the search, such as an older server refusing the visibility
+**************************************************************************************************/
+func (c *Client) searchHiddenVideos() (map[string]utils.TAsset, error) {
+	videos := make(map[string]utils.TAsset)
+	pager := newSearchPager()
+	for {
+		payload := map[string]interface{}{
+			"type":         "VIDEO",
+			"visibility":   utils.VisibilityHidden,
+			"withArchived": c.withArchived,
+			"withDeleted":  c.withDeleted,
+			"size":         1000,
+			"page":         pager.page,
+			"order":        "asc",
+		}
+		for key, value := range c.searchProjection() {
+			payload[key] = value
+		}
+		var response utils.TSearchResponse
+		if err := c.doRequest(http.MethodPost, "/search/metadata", payload, &response); err != nil {
+			return nil, err
+		}
+		c.reportDecodeErrors(response.Assets.Items)
+		for _, video := range response.Assets.Items {
+			videos[video.ID] = video
+		}
+		more, err := pager.next(response.Assets.NextPage)
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			return videos, nil
+		}
+	}
+}
+
+/**************************************************************************************************
+** DeleteStack removes a stack from Immich.
+** In dry run mode, it only logs the action without making changes.
+**
+** @param stackID - ID of the stack to delete
+** @param reason - Reason for deletion (for logging)
+** @return error - Any error that occurred during deletion
+**************************************************************************************************/
+func (c *Client) DeleteStack(stackID string, reason string) error {
+	reasonMsg := ""
+	if reason != utils.REASON_DELETE_STACK_WITH_ONE_ASSET {
+		reasonMsg = "\t"
+	}
+
+	change := StackChange{Action: StackDeleted, StackID: stackID, AssetIDs: c.stackMembers[stackID], Reason: reason}
+	if c.dryRun {
+
+		c.logger.Warnf("%sDeleted Stack %s (dry run) - %s", reasonMsg, stackID, reason)
+		c.forgetStack(stackID)
+		c.reportStackChange(change)
+		return nil
+	}
+
+	if err := c.doRequest(http.MethodDelete, fmt.Sprintf("/stacks/%s", stackID), nil, nil); err != nil {
+		c.logger.Errorf("Error deleting stack: %v", err)
+		return fmt.Errorf("error deleting stack: %w", err)
+	}
+
+	c.logger.Logf(c.stackLogLevel(), "%sDeleted Stack %s - %s", reasonMsg, stackID, reason)
+	c.forgetStack(stackID)
+	c.reportStackChange(change)
+	if err := c.untagStackParent(stackID); err != nil {
+		c.logger.Errorf("Error removing tag %q from the parent of stack %s: %v", c.tagParentWith, stackID, err)
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** CreateStack creates a stack in Immich, merging the stacks of the given assets into it.
+** In dry run mode, it only logs the action without making changes. With only new stacks, a stack
+** including a stacked asset is refused with ErrOnlyNewStacks.
+**
+** @param assetIDs - Array of asset IDs to include in the stack
+** @return error - Any error that occurred during modification
+**************************************************************************************************/
+func (c *Client) CreateStack(assetIDs []string) error {
+	if c.onlyNewStacks {
+		if c.assetStacks == nil {
+			return fmt.Errorf("%w: the stacks were not fetched, stacked assets cannot be told apart", ErrOnlyNewStacks)
+		}
+		for _, id := range assetIDs {
+			if _, ok := c.assetStacks[id]; ok {
+				return fmt.Errorf("%w: asset %s is already stacked", ErrOnlyNewStacks, id)
+			}
+		}
+	}
+	change := c.newStackChange(assetIDs)
+	if c.dryRun {
+		c.reportStackChange(change)
+		return nil
+	}
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := c.doRequest(http.MethodPost, "/stacks", map[string]interface{}{
+		"assetIds": assetIDs,
+	}, &created); err != nil {
+		c.logger.Errorf("\t❌ Stack operation failed: %v", err)
+		return fmt.Errorf("error modifying stack: %w", err)
+	}
+
+	c.logger.Debug("\t✅ API call successful")
+	// The members of the merged stacks join the new one
+	members := append([]string(nil), assetIDs...)
+	for _, stackID := range change.ReplacedStacks {
+		for _, id := range c.stackMembers[stackID] {
+			if !utils.Contains(members, id) {
+				members = append(members, id)
+			}
+		}
+		c.forgetStack(stackID)
+	}
+	if created.ID != "" {
+		change.StackID = created.ID
+		c.recordStack(created.ID, members)
+	}
+	c.reportStackChange(change)
+	return nil
+}
+
+/**************************************************************************************************
+** UpdateStack makes another member the primary asset of a stack (PUT /stacks/{id}), keeping its
+** ID and its members. The tag of TAG_PARENT_WITH leaves the former primary.
+** In dry run mode, it only reports the change.
+**
+** @param stackID - ID of the stack
+** @param primaryAssetID - ID of the member to make primary
+** @return error - Any error that occurred during the update
+**************************************************************************************************/
+func (c *Client) UpdateStack(stackID string, primaryAssetID string) error {
+	members := []string{primaryAssetID}
+	for _, id := range c.stackMembers[stackID] {
+		if id != primaryAssetID {
+			members = append(members, id)
 		}
-		c.logger.Warnf(`⚠️ Done resetting stacks.`)
-		c.resetStacks = false
-		return map[string]utils.TStack{}, nil
+	}
+	change := StackChange{Action: StackPrimaryChanged, StackID: stackID, AssetIDs: members}
+	if c.dryRun {
+		c.reportStackChange(change)
+		return nil
 	}
 
-	// Log stack statistics only in debug mode
-	if c.logger.IsLevelEnabled(logrus.DebugLevel) {
-		stackCounts := make(map[int]int)
-		for _, stack := range stacks {
-			stackCounts[len(stack.Assets)]++
-		}
+	if err := c.doRequest(http.MethodPut, fmt.Sprintf("/stacks/%s", stackID), map[string]interface{}{
+		"primaryAssetId": primaryAssetID,
+	}, nil); err != nil {
+		c.logger.Errorf("\t❌ Stack operation failed: %v", err)
+		return fmt.Errorf("error updating stack %s: %w", stackID, err)
+	}
 
-		for count, num := range stackCounts {
-			c.logger.Debugf("📚 %d assets in a stack with %d assets", num, count)
-		}
+	c.logger.Debug("\t✅ API call successful")
+	if err := c.untagStackParent(stackID); err != nil {
+		c.logger.Errorf("Error removing tag %q from the former parent of stack %s: %v", c.tagParentWith, stackID, err)
 	}
+	c.recordStack(stackID, members)
+	c.reportStackChange(change)
+	return nil
+}
 
-	stacksMap := make(map[string]utils.TStack)
+/**************************************************************************************************
+** filterMarkedStacks keeps only the stacks whose primary asset carries the tool's stack marker,
+** in its description or as the immich-stack tag.
+**
+** @param stacks - Stacks fetched from Immich
+** @param tagged - IDs of the assets carrying the immich-stack tag
+** @return []utils.TStack - Stacks created by the tool
+**************************************************************************************************/
+func filterMarkedStacks(stacks []utils.TStack, tagged map[string]bool) []utils.TStack {
+	marked := make([]utils.TStack, 0, len(stacks))
 	for _, stack := range stacks {
 		for _, asset := range stack.Assets {
-			stacksMap[asset.ID] = stack
+			if asset.ID == stack.PrimaryAssetID && (tagged[asset.ID] || utils.HasStackMarker(asset)) {
+				marked = append(marked, stack)
+				break
+			}
 		}
 	}
-
-	c.logger.Infof("📚 Fetched %d stacks", len(stacks))
-	return stacksMap, nil
+	return marked
 }
 
 /**************************************************************************************************
-** FetchAssets retrieves all assets from Immich with pagination support.
-** Assets are enriched with their stack information if available.
+** markerTagged returns the IDs of the assets carrying the immich-stack tag of the "tag" marker,
+** whatever the marker mode of the run, as the stacks may have been marked by an earlier one.
 **
-** @param size - Number of assets per page
-** @param stacksMap - Map of existing stacks for enrichment
-** @return []stacker.Asset - List of all assets
-** @return error - Any error that occurred during the fetch
+** @return map[string]bool - The IDs of the tagged assets, empty without the tag
+** @return error - Any error of the requests
 **************************************************************************************************/
-func (c *Client) FetchAssets(size int, stacksMap map[string]utils.TStack) ([]utils.TAsset, error) {
-	// Resolve album filters (names to UUIDs) once
-	resolvedAlbumIDs, err := c.resolveAlbumFilters(c.filterAlbumIDs)
-	if err != nil {
+func (c *Client) markerTagged() (map[string]bool, error) {
+	tagID, err := c.findTag(utils.StackMarkerTagName)
+	if err != nil || tagID == "" {
 		return nil, err
 	}
+	return c.assetsTagged(tagID)
+}
 
-	// Validate date filters once before processing (not inside loops)
-	var takenAfterTime, takenBeforeTime time.Time
-	if c.filterTakenAfter != "" {
-		takenAfterTime, err = time.Parse(time.RFC3339, c.filterTakenAfter)
-		if err != nil {
-			return nil, fmt.Errorf("invalid takenAfter date format (expected ISO 8601/RFC3339): %s", c.filterTakenAfter)
-		}
+/**************************************************************************************************
+** excludeStacks returns the stacks that are not part of the removed list.
+**
+** @param stacks - All stacks
+** @param removed - Stacks to exclude
+** @return []utils.TStack - Remaining stacks
+**************************************************************************************************/
+func excludeStacks(stacks []utils.TStack, removed []utils.TStack) []utils.TStack {
+	removedIDs := make(map[string]bool, len(removed))
+	for _, stack := range removed {
+		removedIDs[stack.ID] = true
 	}
-	if c.filterTakenBefore != "" {
-		takenBeforeTime, err = time.Parse(time.RFC3339, c.filterTakenBefore)
-		if err != nil {
-			return nil, fmt.Errorf("invalid takenBefore date format (expected ISO 8601/RFC3339): %s", c.filterTakenBefore)
+	remaining := make([]utils.TStack, 0, len(stacks))
+	for _, stack := range stacks {
+		if !removedIDs[stack.ID] {
+			remaining = append(remaining, stack)
 		}
 	}
-	if c.filterTakenAfter != "" && c.filterTakenBefore != "" && !takenAfterTime.Before(takenBeforeTime) {
-		return nil, fmt.Errorf("takenAfter (%s) must be before takenBefore (%s)", c.filterTakenAfter, c.filterTakenBefore)
+	return remaining
+}
+
+/**************************************************************************************************
+** MarkStackParent writes the stack marker onto the parent asset of a created stack, according
+** to the configured marker mode. In "description" mode the marker is appended to the existing
+** description; in "tag" mode the immich-stack tag is attached. Assets already marked are left
+** untouched, the assets of the tag being searched on the first parent to tag. In dry run mode,
+** it only logs the action without making changes.
+**
+** @param parent - Parent asset of the stack
+** @param marker - Marker text to append in description mode
+** @return error - Any error that occurred while marking the asset
+**************************************************************************************************/
+func (c *Client) MarkStackParent(parent utils.TAsset, marker string) error {
+	if c.stackMarker == "" || c.stackMarker == utils.StackMarkerNone || utils.HasStackMarker(parent) {
+		return nil
 	}
 
-	c.logger.Infof("⬇️  Fetching assets:")
+	if c.dryRun {
+		c.logger.Debugf("\t🏷️  Marking parent %s with %s (dry run)", parent.OriginalFileName, c.stackMarker)
+		return nil
+	}
 
-	// If multiple albums specified, fetch each separately and deduplicate.
-	// This implements OR logic: assets in album1 OR album2 OR album3.
-	var albumFilters [][]string
-	if len(resolvedAlbumIDs) == 0 {
-		albumFilters = [][]string{nil} // No album filter
-	} else if len(resolvedAlbumIDs) == 1 {
-		albumFilters = [][]string{resolvedAlbumIDs}
-	} else {
-		for _, albumID := range resolvedAlbumIDs {
-			albumFilters = append(albumFilters, []string{albumID})
+	switch c.stackMarker {
+	case utils.StackMarkerDescription:
+		description := marker
+		if parent.ExifInfo != nil && parent.ExifInfo.Description != "" {
+			description = parent.ExifInfo.Description + " " + marker
+		}
+		return c.UpdateAssetDescription(parent.ID, description)
+	case utils.StackMarkerTag:
+		tagID, err := c.resolveTag(utils.StackMarkerTagName)
+		if err != nil {
+			return err
+		}
+		tagged, err := c.assetsTagged(tagID)
+		if err != nil {
+			return fmt.Errorf("failed to search the assets tagged %q: %w", utils.StackMarkerTagName, err)
+		}
+		if tagged[parent.ID] {
+			return nil
 		}
+		if err := c.doRequest(http.MethodPut, fmt.Sprintf("/tags/%s/assets", tagID), map[string]interface{}{
+			"ids": []string{parent.ID},
+		}, nil); err != nil {
+			return fmt.Errorf("failed to tag assets: %w", err)
+		}
+		tagged[parent.ID] = true
+		return nil
+	default:
+		return fmt.Errorf("unknown stack marker mode: %s", c.stackMarker)
 	}
+}
 
-	seen := make(map[string]bool)
-	var allAssets []utils.TAsset
+/**************************************************************************************************
+** TagStackParent attaches the tagParentWith tag to the parent asset of a created or merged
+** stack. The tag is created the first time it is needed, and the assets already carrying it are
+** searched then and left untouched. In dry run mode, it only logs the action without making
+** changes.
+**
+** @param parent - Parent asset of the stack
+** @return error - Any error that occurred while tagging the asset
+**************************************************************************************************/
+func (c *Client) TagStackParent(parent utils.TAsset) error {
+	if c.tagParentWith == "" {
+		return nil
+	}
 
-	for _, albumFilter := range albumFilters {
-		page := 1
-		for {
-			if len(albumFilter) > 0 {
-				c.logger.Debugf("Fetching page %d for album(s) %v", page, albumFilter)
-			} else {
-				c.logger.Debugf("Fetching page %d", page)
-			}
-			var response utils.TSearchResponse
+	if c.dryRun {
+		c.logger.Debugf("\t🏷️  Tagging parent %s with %s (dry run)", parent.OriginalFileName, c.tagParentWith)
+		return nil
+	}
 
-			payload := map[string]interface{}{
-				"size":         size,
-				"page":         page,
-				"order":        "asc",
-				"type":         "IMAGE",
-				"isVisible":    true,
-				"withStacked":  true,
-				"withArchived": c.withArchived,
-				"withDeleted":  c.withDeleted,
-			}
-			if len(albumFilter) > 0 {
-				payload["albumIds"] = albumFilter
-			}
-			if c.filterTakenAfter != "" {
-				payload["takenAfter"] = c.filterTakenAfter
-			}
-			if c.filterTakenBefore != "" {
-				payload["takenBefore"] = c.filterTakenBefore
-			}
+	tagID, err := c.resolveTag(c.tagParentWith)
+	if err != nil {
+		return err
+	}
+	tagged, err := c.assetsTagged(tagID)
+	if err != nil {
+		return fmt.Errorf("failed to search the assets tagged %q: %w", c.tagParentWith, err)
+	}
+	if tagged[parent.ID] {
+		return nil
+	}
+	if err := c.doRequest(http.MethodPut, fmt.Sprintf("/tags/%s/assets", tagID), map[string]interface{}{
+		"ids": []string{parent.ID},
+	}, nil); err != nil {
+		return fmt.Errorf("failed to tag stack parent: %w", err)
+	}
+	tagged[parent.ID] = true
+	return nil
+}
 
-			if err := c.doRequest(http.MethodPost, "/search/metadata", payload, &response); err != nil {
-				c.logger.Errorf("Error fetching assets: %v", err)
-				return nil, fmt.Errorf("error fetching assets: %w", err)
-			}
+/**************************************************************************************************
+** untagStackParent removes the tagParentWith tag from the parent asset of a stack deleted by
+** the tool. Stacks that were not fetched in this run are ignored.
+**
+** @param stackID - ID of the deleted stack
+** @return error - Any error that occurred while removing the tag
+**************************************************************************************************/
+func (c *Client) untagStackParent(stackID string) error {
+	parentID, ok := c.stackParents[stackID]
+	if c.tagParentWith == "" || !ok {
+		return nil
+	}
 
-			// Enrich assets with stack information and deduplicate
-			for i := range response.Assets.Items {
-				asset := &response.Assets.Items[i]
-				if seen[asset.ID] {
-					continue
-				}
-				seen[asset.ID] = true
-				if stack, ok := stacksMap[asset.ID]; ok {
-					asset.Stack = &stack
-				}
-				allAssets = append(allAssets, *asset)
-			}
+	tagID, err := c.resolveTag(c.tagParentWith)
+	if err != nil {
+		return err
+	}
+	if err := c.doRequest(http.MethodDelete, fmt.Sprintf("/tags/%s/assets", tagID), map[string]interface{}{
+		"ids": []string{parentID},
+	}, nil); err != nil {
+		return fmt.Errorf("failed to untag stack parent: %w", err)
+	}
+	delete(c.taggedAssets[tagID], parentID)
+	return nil
+}
 
-			// Handle string nextPage: empty string means no more pages
-			if response.Assets.NextPage == "" || response.Assets.NextPage == "0" {
-				break
-			}
-			nextPageInt, err := strconv.Atoi(response.Assets.NextPage)
-			if err != nil || nextPageInt == 0 {
-				break
-			}
-			page = nextPageInt
-		}
+/**************************************************************************************************
+** resolveTag returns the ID of a tag, creating the tag if it does not exist yet. The ID is cached
+** so a tag is only upserted once per run.
+**
+** @param name - Name of the tag
+** @return string - ID of the tag
+** @return error - Error if the request failed
+**************************************************************************************************/
+func (c *Client) resolveTag(name string) (string, error) {
+	if tagID, ok := c.tagIDs[name]; ok && tagID != "" {
+		return tagID, nil
 	}
 
-	c.logger.Infof("🌄 %d assets fetched", len(allAssets))
-	return allAssets, nil
+	var tags []utils.TTag
+	if err := c.doRequest(http.MethodPut, "/tags", map[string]interface{}{
+		"tags": []string{name},
+	}, &tags); err != nil {
+		return "", fmt.Errorf("failed to upsert tag: %w", err)
+	}
+	if len(tags) == 0 {
+		return "", fmt.Errorf("failed to upsert tag: no tag returned for %q", name)
+	}
+	if c.tagIDs == nil {
+		c.tagIDs = make(map[string]string)
+	}
+	c.tagIDs[name] = tags[0].ID
+	return tags[0].ID, nil
 }
 
 /**************************************************************************************************
-** DeleteStack removes a stack from Immich.
-** In dry run mode, it only logs the action without making changes.
+** findTag returns the ID of an existing tag (GET /tags), without creating it. The ID is cached
+** like the ones of resolveTag.
 **
-** @param stackID - ID of the stack to delete
-** @param reason - Reason for deletion (for logging)
-** @return error - Any error that occurred during deletion
+** @param name - Name of the tag
+** @return string - ID of the tag, empty when there is no such tag
+** @return error - Error if the request failed
 **************************************************************************************************/
-func (c *Client) DeleteStack(stackID string, reason string) error {
-	reasonMsg := ""
-	if reason != utils.REASON_DELETE_STACK_WITH_ONE_ASSET {
-		reasonMsg = "\t"
+func (c *Client) findTag(name string) (string, error) {
+	if tagID, ok := c.tagIDs[name]; ok {
+		return tagID, nil
 	}
 
-	if c.dryRun {
+	var tags []utils.TTag
+	if err := c.doRequest(http.MethodGet, "/tags", nil, &tags); err != nil {
+		return "", fmt.Errorf("failed to list tags: %w", err)
+	}
+	if c.tagIDs == nil {
+		c.tagIDs = make(map[string]string)
+	}
+	for _, tag := range tags {
+		if tag.Value == name || tag.Name == name {
+			c.tagIDs[name] = tag.ID
+			return tag.ID, nil
+		}
+	}
+	c.tagIDs[name] = ""
+	return "", nil
+}
 
-		c.logger.Warnf("%sDeleted Stack %s (dry run) - %s", reasonMsg, stackID, reason)
-		return nil
+/**************************************************************************************************
+** assetsTagged returns the IDs of the assets carrying a tag, searched the first time they are
+** needed in the run. The assets the client tags or untags afterwards are added to or removed
+** from the returned map.
+**
+** @param tagID - ID of the tag
+** @return map[string]bool - The IDs of the tagged assets
+** @return error - Any error of the search
+**************************************************************************************************/
+func (c *Client) assetsTagged(tagID string) (map[string]bool, error) {
+	if tagged, ok := c.taggedAssets[tagID]; ok {
+		return tagged, nil
+	}
+	tagged, err := c.searchTaggedAssets(tagID)
+	if err != nil {
+		return nil, err
 	}
+	if c.taggedAssets == nil {
+		c.taggedAssets = make(map[string]map[string]bool)
+	}
+	c.taggedAssets[tagID] = tagged
+	return tagged, nil
+}
 
-	if err := c.doRequest(http.MethodDelete, fmt.Sprintf("/stacks/%s", stackID), nil, nil); err != nil {
-		c.logger.Errorf("Error deleting stack: %v", err)
-		return fmt.Errorf("error deleting stack: %w", err)
+/**************************************************************************************************
+** searchTaggedAssets returns the IDs of the assets carrying a tag, page after page
+** (POST /search/metadata). Only the IDs are used, the projection keeps the pages small.
+**
+** @param tagID - ID of the tag
+** @return map[string]bool - The IDs of the tagged assets
+** @return error - Any error of the search
+**************************************************************************************************/
+func (c *Client) searchTaggedAssets(tagID string) (map[string]bool, error) {
+	tagged := make(map[string]bool)
+	pager := newSearchPager()
+	for {
+		payload := map[string]interface{}{
+			"tagIds":       []string{tagID},
+			"withArchived": true,
+			"size":         1000,
+			"page":         pager.page,
+		}
+		for key, value := range c.searchProjection() {
+			payload[key] = value
+		}
+		var response utils.TSearchResponse
+		if err := c.doRequest(http.MethodPost, "/search/metadata", payload, &response); err != nil {
+			return nil, err
+		}
+		for _, asset := range response.Assets.Items {
+			tagged[asset.ID] = true
+		}
+		more, err := pager.next(response.Assets.NextPage)
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			return tagged, nil
+		}
 	}
+}
 
-	c.logger.Infof("%sDeleted Stack %s - %s", reasonMsg, stackID, reason)
+/**************************************************************************************************
+** UpdateAssetDescription replaces the description of an asset.
+**
+** @param assetID - Asset identifier
+** @param description - New description
+** @return error - Error if the request failed
+**************************************************************************************************/
+func (c *Client) UpdateAssetDescription(assetID string, description string) error {
+	if err := c.doRequest(http.MethodPut, fmt.Sprintf("/assets/%s", assetID), map[string]interface{}{
+		"description": description,
+	}, nil); err != nil {
+		return fmt.Errorf("failed to update asset description: %w", err)
+	}
 	return nil
 }
 
 /**************************************************************************************************
-** ModifyStack creates or updates a stack in Immich.
-** In dry run mode, it only logs the action without making changes.
+** TagAssets attaches a tag to the given assets, creating the tag if it does not exist yet.
 **
-** @param assetIDs - Array of asset IDs to include in the stack
-** @return error - Any error that occurred during modification
+** @param tagName - Name of the tag to attach
+** @param assetIDs - List of asset IDs to tag
+** @return error - Error if the request failed
 **************************************************************************************************/
-func (c *Client) ModifyStack(assetIDs []string) error {
-	if c.dryRun {
+func (c *Client) TagAssets(tagName string, assetIDs []string) error {
+	if len(assetIDs) == 0 {
 		return nil
 	}
 
-	if err := c.doRequest(http.MethodPost, "/stacks", map[string]interface{}{
-		"assetIds": assetIDs,
-	}, nil); err != nil {
-		c.logger.Errorf("\t❌ Stack operation failed: %v", err)
-		return fmt.Errorf("error modifying stack: %w", err)
+	var tags []utils.TTag
+	if err := c.doRequest(http.MethodPut, "/tags", map[string]interface{}{
+		"tags": []string{tagName},
+	}, &tags); err != nil {
+		return fmt.Errorf("failed to upsert tag: %w", err)
+	}
+	if len(tags) == 0 {
+		return fmt.Errorf("failed to upsert tag: no tag returned for %q", tagName)
 	}
 
-	c.logger.Debug("\t✅ API call successful")
+	if err := c.doRequest(http.MethodPut, fmt.Sprintf("/tags/%s/assets", tags[0].ID), map[string]interface{}{
+		"ids": assetIDs,
+	}, nil); err != nil {
+		return fmt.Errorf("failed to tag assets: %w", err)
+	}
 	return nil
 }
 
@@ -456,6 +1871,39 @@ func (c *Client) GetCurrentUser() (utils.TUserResponse, error) {
 	return user, nil
 }
 
+/**************************************************************************************************
+** FetchServerVersion fetches the version of the Immich server (GET /server/version).
+**
+** @return string - The version, such as 1.119.0
+** @return error - Any error that occurred during the fetch
+**************************************************************************************************/
+func (c *Client) FetchServerVersion() (string, error) {
+	var serverVersion struct {
+		Major int `json:"major"`
+		Minor int `json:"minor"`
+		Patch int `json:"patch"`
+	}
+	if err := c.doRequest(http.MethodGet, "/server/version", nil, &serverVersion); err != nil {
+		return "", fmt.Errorf("error fetching server version: %w", err)
+	}
+	return fmt.Sprintf("%d.%d.%d", serverVersion.Major, serverVersion.Minor, serverVersion.Patch), nil
+}
+
+/**************************************************************************************************
+** FetchJobs fetches the status of the Immich job queues (GET /jobs). Reading the queues needs
+** an API key of an admin.
+**
+** @return map[string]utils.TJobStatus - Status of each queue, by queue name
+** @return error - Any error that occurred during the fetch
+**************************************************************************************************/
+func (c *Client) FetchJobs() (map[string]utils.TJobStatus, error) {
+	var jobs map[string]utils.TJobStatus
+	if err := c.doRequest(http.MethodGet, "/jobs", nil, &jobs); err != nil {
+		return nil, fmt.Errorf("error fetching jobs: %w", err)
+	}
+	return jobs, nil
+}
+
 /**************************************************************************************************
 ** FetchTrashedAssets retrieves only assets that are in the trash.
 ** This function specifically filters for assets where IsTrashed is true.
@@ -466,15 +1914,15 @@ func (c *Client) GetCurrentUser() (utils.TUserResponse, error) {
 **************************************************************************************************/
 func (c *Client) FetchTrashedAssets(size int) ([]utils.TAsset, error) {
 	var allTrashedAssets []utils.TAsset
-	page := 1
+	pager := newSearchPager()
 
 	c.logger.Debugf("🗑️  Fetching trashed assets:")
 	for {
-		c.logger.Debugf("Fetching trashed assets page %d", page)
+		c.logger.Debugf("Fetching trashed assets page %v", pager.page)
 		var response utils.TSearchResponse
 		if err := c.doRequest(http.MethodPost, "/search/metadata", map[string]interface{}{
 			"size":         size,
-			"page":         page,
+			"page":         pager.page,
 			"order":        "asc",
 			"type":         "IMAGE",
 			"isVisible":    true,
@@ -486,6 +1934,8 @@ func (c *Client) FetchTrashedAssets(size int) ([]utils.TAsset, error) {
 			return nil, fmt.Errorf("error fetching trashed assets: %w", err)
 		}
 
+		c.reportDecodeErrors(response.Assets.Items)
+
 		// Filter for only trashed assets
 		for _, asset := range response.Assets.Items {
 			if asset.IsTrashed {
@@ -493,17 +1943,16 @@ func (c *Client) FetchTrashedAssets(size int) ([]utils.TAsset, error) {
 			}
 		}
 
-		// Handle string nextPage: empty string means no more pages
-		if response.Assets.NextPage == "" || response.Assets.NextPage == "0" {
-			break
+		more, err := pager.next(response.Assets.NextPage)
+		if err != nil {
+			c.logger.Errorf("Error fetching trashed assets: %v", err)
+			return nil, fmt.Errorf("error fetching trashed assets: %w", err)
 		}
-		nextPageInt, err := strconv.Atoi(response.Assets.NextPage)
-		if err != nil || nextPageInt == 0 {
+		if !more {
 			break
 		}
-		page = nextPageInt
 	}
-	c.logger.Debugf("🗑️  %d trashed assets found", len(allTrashedAssets))
+	c.logger.Debugf("🗑️  %d trashed assets found in %d pages", len(allTrashedAssets), pager.pages)
 
 	return allTrashedAssets, nil
 }
@@ -641,9 +2090,28 @@ func (c *Client) FetchAlbumAssets(albumID string) ([]utils.TAsset, error) {
 	if err := c.doRequest(http.MethodGet, fmt.Sprintf("/albums/%s", albumID), nil, &response); err != nil {
 		return nil, fmt.Errorf("failed to fetch album assets: %w", err)
 	}
+	c.reportDecodeErrors(response.Assets)
 	return response.Assets, nil
 }
 
+/**************************************************************************************************
+** FetchDuplicates fetches the groups of assets the duplicate detection of Immich found alike,
+** the groups a user resolved in the Immich interface left out.
+**
+** @return []utils.TDuplicateGroup - The duplicate groups
+** @return error - Error if the request failed
+**************************************************************************************************/
+func (c *Client) FetchDuplicates() ([]utils.TDuplicateGroup, error) {
+	var groups []utils.TDuplicateGroup
+	if err := c.doRequest(http.MethodGet, "/duplicates", nil, &groups); err != nil {
+		return nil, fmt.Errorf("failed to fetch duplicates: %w", err)
+	}
+	for _, group := range groups {
+		c.reportDecodeErrors(group.Assets)
+	}
+	return groups, nil
+}
+
 /**************************************************************************************************
 ** CreateAlbum creates a new album with the given name and description.
 **
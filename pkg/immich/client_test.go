@@ -1,8 +1,13 @@
 package immich
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 
@@ -58,7 +63,7 @@ func TestNewClient(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Act
-			client := NewClient(tt.apiURL, tt.apiKey, tt.resetStacks, tt.replaceStacks, tt.dryRun, true, false, false, nil, "", "", logrus.New())
+			client := NewClient(tt.apiURL, tt.apiKey, tt.resetStacks, tt.replaceStacks, tt.dryRun, true, false, false, nil, "", "", "", false, false, "", logrus.New())
 
 			// Assert
 			if tt.wantErr {
@@ -72,7 +77,7 @@ func TestNewClient(t *testing.T) {
 	}
 }
 
-func TestFetchAssets(t *testing.T) {
+func TestSearchAssets(t *testing.T) {
 	tests := []struct {
 		name      string
 		client    *Client
@@ -97,7 +102,7 @@ func TestFetchAssets(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Act
-			assets, err := tt.client.FetchAssets(tt.size, tt.stacksMap)
+			assets, err := tt.client.SearchAssets(tt.size, tt.stacksMap)
 
 			// Assert
 			if tt.wantErr {
@@ -244,7 +249,7 @@ func TestFetchAllStacks(t *testing.T) {
 	}
 }
 
-func TestModifyStack(t *testing.T) {
+func TestCreateStack(t *testing.T) {
 	tests := []struct {
 		name    string
 		client  *Client
@@ -274,7 +279,7 @@ func TestModifyStack(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Act
-			err := tt.client.ModifyStack(tt.assets)
+			err := tt.client.CreateStack(tt.assets)
 
 			// Assert
 			if tt.wantErr {
@@ -446,10 +451,10 @@ func TestResolveAlbumFilters(t *testing.T) {
 }
 
 /************************************************************************************************
-** Tests for date validation in FetchAssets
+** Tests for date validation in SearchAssets
 ************************************************************************************************/
 
-func TestFetchAssetsDateValidation(t *testing.T) {
+func TestSearchAssetsDateValidation(t *testing.T) {
 	tests := []struct {
 		name        string
 		takenAfter  string
@@ -558,7 +563,7 @@ func TestFetchAssetsDateValidation(t *testing.T) {
 			}
 
 			// Act
-			_, err := client.FetchAssets(10, make(map[string]utils.TStack))
+			_, err := client.SearchAssets(10, make(map[string]utils.TStack))
 
 			// Assert
 			if tt.wantErr {
@@ -574,10 +579,10 @@ func TestFetchAssetsDateValidation(t *testing.T) {
 }
 
 /************************************************************************************************
-** Tests for FetchAssets album filter building and deduplication
+** Tests for SearchAssets album filter building and deduplication
 ************************************************************************************************/
 
-func TestFetchAssetsWithAlbumFilters(t *testing.T) {
+func TestSearchAssetsWithAlbumFilters(t *testing.T) {
 	// Standard assets response
 	assetsResponse := `{"assets": {"items": [
 		{"id": "asset-1", "originalFileName": "photo1.jpg"},
@@ -632,7 +637,7 @@ func TestFetchAssetsWithAlbumFilters(t *testing.T) {
 			}
 
 			// Act
-			assets, err := client.FetchAssets(10, make(map[string]utils.TStack))
+			assets, err := client.SearchAssets(10, make(map[string]utils.TStack))
 
 			// Assert
 			require.NoError(t, err)
@@ -641,7 +646,7 @@ func TestFetchAssetsWithAlbumFilters(t *testing.T) {
 	}
 }
 
-func TestFetchAssetsDeduplication(t *testing.T) {
+func TestSearchAssetsDeduplication(t *testing.T) {
 	// First album returns asset-1 and asset-2
 	album1Response := `{"assets": {"items": [
 		{"id": "asset-1", "originalFileName": "photo1.jpg"},
@@ -670,7 +675,7 @@ func TestFetchAssetsDeduplication(t *testing.T) {
 	}
 
 	// Act
-	assets, err := client.FetchAssets(10, make(map[string]utils.TStack))
+	assets, err := client.SearchAssets(10, make(map[string]utils.TStack))
 
 	// Assert
 	require.NoError(t, err)
@@ -686,7 +691,7 @@ func TestFetchAssetsDeduplication(t *testing.T) {
 	assert.True(t, assetIDs["asset-3"])
 }
 
-func TestFetchAssetsPagination(t *testing.T) {
+func TestSearchAssetsPagination(t *testing.T) {
 	page1 := `{"assets": {"items": [{"id": "asset-1"}], "nextPage": "2"}}`
 	page2 := `{"assets": {"items": [{"id": "asset-2"}], "nextPage": "3"}}`
 	page3 := `{"assets": {"items": [{"id": "asset-3"}], "nextPage": ""}}`
@@ -695,6 +700,7 @@ func TestFetchAssetsPagination(t *testing.T) {
 		name          string
 		responses     []string
 		expectedCount int
+		wantErr       string
 	}{
 		{
 			name:          "single page - empty nextPage",
@@ -712,10 +718,30 @@ func TestFetchAssetsPagination(t *testing.T) {
 			expectedCount: 3,
 		},
 		{
-			name:          "invalid nextPage stops pagination",
-			responses:     []string{`{"assets": {"items": [{"id": "asset-1"}], "nextPage": "invalid"}}`},
+			name:          "cursor nextPage is followed",
+			responses:     []string{`{"assets": {"items": [{"id": "asset-1"}], "nextPage": "cursor-a"}}`, page3},
+			expectedCount: 2,
+		},
+		{
+			name:          "numeric nextPage of older builds",
+			responses:     []string{`{"assets": {"items": [{"id": "asset-1"}], "nextPage": 2}}`, page3},
+			expectedCount: 2,
+		},
+		{
+			name:          "null nextPage",
+			responses:     []string{`{"assets": {"items": [{"id": "asset-1"}], "nextPage": null}}`},
 			expectedCount: 1,
 		},
+		{
+			name:      "repeated cursor is an error",
+			responses: []string{`{"assets": {"items": [{"id": "asset-1"}], "nextPage": "cursor-a"}}`, `{"assets": {"items": [{"id": "asset-2"}], "nextPage": "cursor-a"}}`},
+			wantErr:   `the server returned page "cursor-a" again after 2 pages`,
+		},
+		{
+			name:      "page number going back is an error",
+			responses: []string{`{"assets": {"items": [{"id": "asset-1"}], "nextPage": "3"}}`, `{"assets": {"items": [{"id": "asset-2"}], "nextPage": "2"}}`},
+			wantErr:   "the server returned page 2 after page 3",
+		},
 	}
 
 	for _, tt := range tests {
@@ -738,16 +764,87 @@ func TestFetchAssetsPagination(t *testing.T) {
 			}
 
 			// Act
-			assets, err := client.FetchAssets(10, make(map[string]utils.TStack))
+			assets, err := client.SearchAssets(10, make(map[string]utils.TStack))
 
 			// Assert
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
 			require.NoError(t, err)
 			assert.Len(t, assets, tt.expectedCount)
 		})
 	}
 }
 
-func TestFetchAssetsStackEnrichment(t *testing.T) {
+func TestSearchAssetsPageOverlap(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+
+	// An upload between two requests shifts the page boundary: asset 2 comes back on page 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if r.URL.Path == "/search/statistics" {
+			fmt.Fprint(w, `{"total": 4}`)
+			return
+		}
+		switch body["page"] {
+		case float64(1):
+			fmt.Fprint(w, `{"assets": {"items": [{"id": "1"}, {"id": "2"}], "nextPage": "2"}}`)
+		case float64(2):
+			fmt.Fprint(w, `{"assets": {"items": [{"id": "2"}, {"id": "3"}], "nextPage": "3"}}`)
+		default:
+			fmt.Fprint(w, `{"assets": {"items": [{"id": "4"}], "nextPage": null}}`)
+		}
+	}))
+	defer server.Close()
+
+	client := &Client{apiKey: "test", apiURL: server.URL, logger: logger, client: &http.Client{}}
+	assets, err := client.SearchAssets(2, nil)
+	require.NoError(t, err)
+	ids := make([]string, 0, len(assets))
+	for _, asset := range assets {
+		ids = append(ids, asset.ID)
+	}
+	assert.Equal(t, []string{"1", "2", "3", "4"}, ids, "the repeated asset is kept once")
+	assert.Contains(t, out.String(), "1 assets returned on two pages skipped")
+	assert.NotContains(t, out.String(), "the fetch may be truncated", "the repeated asset does not count as received")
+}
+
+func TestSearchAssetsSendsCursorBack(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+
+	var pages []interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if r.URL.Path == "/search/statistics" {
+			fmt.Fprint(w, `{"total": 5}`)
+			return
+		}
+		pages = append(pages, body["page"])
+		if body["page"] == float64(1) {
+			fmt.Fprint(w, `{"assets": {"items": [{"id": "1"}, {"id": "2"}], "nextPage": "eyJwYWdlIjoyfQ"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"assets": {"items": [{"id": "3"}], "nextPage": null}}`)
+	}))
+	defer server.Close()
+
+	client := &Client{apiKey: "test", apiURL: server.URL, logger: logger, client: &http.Client{}}
+	assets, err := client.SearchAssets(2, nil)
+	require.NoError(t, err)
+	assert.Len(t, assets, 3)
+	assert.Equal(t, []interface{}{float64(1), "eyJwYWdlIjoyfQ"}, pages, "the cursor is sent back as is")
+	assert.Contains(t, out.String(), "3 assets fetched in 2 pages")
+	assert.Contains(t, out.String(), "Fetched 3 assets but the server reports 5, the fetch may be truncated")
+}
+
+func TestSearchAssetsStackEnrichment(t *testing.T) {
 	assetsResponse := `{"assets": {"items": [
 		{"id": "asset-1", "originalFileName": "photo1.jpg"},
 		{"id": "asset-2", "originalFileName": "photo2.jpg"}
@@ -776,7 +873,7 @@ func TestFetchAssetsStackEnrichment(t *testing.T) {
 	}
 
 	// Act
-	assets, err := client.FetchAssets(10, stacksMap)
+	assets, err := client.SearchAssets(10, stacksMap)
 
 	// Assert
 	require.NoError(t, err)
@@ -799,8 +896,8 @@ func TestFetchAssetsStackEnrichment(t *testing.T) {
 	assert.Nil(t, asset2.Stack, "asset-2 should not have stack info")
 }
 
-func TestFetchAssetsAlbumResolutionError(t *testing.T) {
-	// When album name can't be resolved, FetchAssets should return error
+func TestSearchAssetsAlbumResolutionError(t *testing.T) {
+	// When album name can't be resolved, SearchAssets should return error
 	client := &Client{
 		apiKey:         "test",
 		apiURL:         "http://test/api",
@@ -817,7 +914,7 @@ func TestFetchAssetsAlbumResolutionError(t *testing.T) {
 	}
 
 	// Act
-	assets, err := client.FetchAssets(10, make(map[string]utils.TStack))
+	assets, err := client.SearchAssets(10, make(map[string]utils.TStack))
 
 	// Assert
 	assert.Error(t, err)
@@ -896,6 +993,7 @@ func TestNewClientWithFilterParams(t *testing.T) {
 				tt.filterAlbumIDs,
 				tt.filterTakenAfter,
 				tt.filterTakenBefore,
+				"", false, false, "",
 				logrus.New(),
 			)
 
@@ -979,6 +1077,33 @@ func TestGetCurrentUser(t *testing.T) {
 	}
 }
 
+func TestFetchServerVersion(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	newClient := func(statusCode int, response string) *Client {
+		return &Client{
+			apiKey: "test",
+			apiURL: "http://test/api",
+			logger: logger,
+			client: &http.Client{
+				Transport: &mockTransport{
+					response: &http.Response{
+						StatusCode: statusCode,
+						Body:       io.NopCloser(strings.NewReader(response)),
+					},
+				},
+			},
+		}
+	}
+
+	serverVersion, err := newClient(http.StatusOK, `{"major": 1, "minor": 119, "patch": 2}`).FetchServerVersion()
+	require.NoError(t, err)
+	assert.Equal(t, "1.119.2", serverVersion)
+
+	_, err = newClient(http.StatusUnauthorized, `{"message": "Unauthorized", "statusCode": 401}`).FetchServerVersion()
+	assert.Error(t, err)
+}
+
 /************************************************************************************************
 ** Tests for DeleteStack
 ************************************************************************************************/
@@ -1534,10 +1659,10 @@ func TestFetchAllStacksWithDebugLogging(t *testing.T) {
 }
 
 /************************************************************************************************
-** Tests for ModifyStack - comprehensive coverage
+** Tests for CreateStack - comprehensive coverage
 ************************************************************************************************/
 
-func TestModifyStackComprehensive(t *testing.T) {
+func TestCreateStackComprehensive(t *testing.T) {
 	tests := []struct {
 		name       string
 		assetIDs   []string
@@ -1616,7 +1741,7 @@ func TestModifyStackComprehensive(t *testing.T) {
 				},
 			}
 
-			err := client.ModifyStack(tt.assetIDs)
+			err := client.CreateStack(tt.assetIDs)
 
 			if tt.wantErr {
 				assert.Error(t, err)
@@ -1691,6 +1816,7 @@ func TestNewClientEdgeCases(t *testing.T) {
 				tt.apiKey,
 				false, false, false, false, false, false,
 				nil, "", "",
+				"", false, false, "",
 				tt.logger,
 			)
 
@@ -1727,9 +1853,9 @@ func TestFetchTrashedAssetsErrors(t *testing.T) {
 			wantErr:    true,
 		},
 		{
-			name:       "invalid nextPage number",
+			name:       "null nextPage",
 			statusCode: http.StatusOK,
-			response:   `{"assets": {"items": [{"id": "1", "isTrashed": true}], "nextPage": "invalid"}}`,
+			response:   `{"assets": {"items": [{"id": "1", "isTrashed": true}], "nextPage": null}}`,
 			wantErr:    false,
 		},
 	}
@@ -2250,3 +2376,894 @@ func TestUpdateAlbum(t *testing.T) {
 		})
 	}
 }
+
+/************************************************************************************************
+** Tests for stack markers
+************************************************************************************************/
+
+// mockTransportRecorder records every request and answers with a body per "METHOD path" key
+type mockTransportRecorder struct {
+	responses map[string]string
+	requests  []string
+	bodies    []string
+}
+
+func (m *mockTransportRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := req.Method + " " + req.URL.Path
+	m.requests = append(m.requests, key)
+	body := ""
+	if req.Body != nil {
+		raw, _ := io.ReadAll(req.Body)
+		body = string(raw)
+	}
+	m.bodies = append(m.bodies, body)
+	response, ok := m.responses[key]
+	if !ok {
+		response = `{}`
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(response)),
+	}, nil
+}
+
+func TestFetchAllStacksResetMarkedOnly(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	transport := &mockTransportRecorder{
+		responses: map[string]string{
+			"GET /api/stacks": `[
+				{"id": "stack-marked", "primaryAssetId": "asset-1", "assets": [
+					{"id": "asset-1", "exifInfo": {"description": "[immich-stack v1.0 key=IMG_1]"}}, {"id": "asset-2"}
+				]},
+				{"id": "stack-manual", "primaryAssetId": "asset-3", "assets": [{"id": "asset-3"}, {"id": "asset-4"}]},
+				{"id": "stack-tagged", "primaryAssetId": "asset-5", "assets": [{"id": "asset-5"}, {"id": "asset-6"}]}
+			]`,
+			"GET /api/tags":             `[{"id": "tag-0", "name": "family", "value": "family"}, {"id": "tag-1", "name": "immich-stack", "value": "immich-stack"}]`,
+			"POST /api/search/metadata": `{"assets": {"items": [{"id": "asset-5"}], "nextPage": null}}`,
+		},
+	}
+	client := &Client{
+		apiKey:          "test",
+		apiURL:          "http://test/api",
+		logger:          logger,
+		resetStacks:     true,
+		resetMarkedOnly: true,
+		client:          &http.Client{Transport: transport},
+	}
+
+	stacksMap, err := client.FetchAllStacks()
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"GET /api/stacks", "GET /api/tags", "POST /api/search/metadata", "DELETE /api/stacks/stack-marked", "DELETE /api/stacks/stack-tagged"}, transport.requests)
+	assert.Contains(t, transport.bodies[2], `"tagIds":["tag-1"]`, "the assets of the marker tag are searched, the stacks come without tags")
+	assert.Len(t, stacksMap, 2, "manual stack should be kept in the stacks map")
+	assert.Equal(t, "stack-manual", stacksMap["asset-3"].ID)
+}
+
+func TestListStacksChangesNothing(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	transport := &mockTransportRecorder{
+		responses: map[string]string{
+			"GET /api/stacks": `[
+				{"id": "stack-1", "primaryAssetId": "asset-1", "assets": [{"id": "asset-1"}, {"id": "asset-2"}]},
+				{"id": "stack-single", "primaryAssetId": "asset-3", "assets": [{"id": "asset-3"}]}
+			]`,
+		},
+	}
+	client := &Client{
+		apiKey:                  "test",
+		apiURL:                  "http://test/api",
+		logger:                  logger,
+		resetStacks:             true,
+		removeSingleAssetStacks: true,
+		client:                  &http.Client{Transport: transport},
+	}
+
+	stacksMap, err := client.ListStacks()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"GET /api/stacks"}, transport.requests, "neither reset nor single asset removal")
+	assert.Len(t, stacksMap, 3)
+	assert.Equal(t, "stack-1", stacksMap["asset-2"].ID)
+	assert.True(t, client.resetStacks, "the reset is left to FetchAllStacks")
+}
+
+func TestPlanStackCleanup(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	for _, reset := range []bool{false, true} {
+		transport := &mockTransportRecorder{
+			responses: map[string]string{
+				"GET /api/stacks": `[
+					{"id": "stack-1", "primaryAssetId": "asset-1", "assets": [{"id": "asset-1"}, {"id": "asset-2"}]},
+					{"id": "stack-single", "primaryAssetId": "asset-3", "assets": [{"id": "asset-3"}]}
+				]`,
+			},
+		}
+		client := &Client{
+			apiKey:                  "test",
+			apiURL:                  "http://test/api",
+			logger:                  logger,
+			resetStacks:             reset,
+			removeSingleAssetStacks: true,
+			client:                  &http.Client{Transport: transport},
+		}
+
+		stacksMap, doomed, err := client.PlanStackCleanup()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"GET /api/stacks"}, transport.requests, "nothing is deleted")
+		assert.Len(t, stacksMap, 3)
+		if reset {
+			assert.Equal(t, map[string]bool{"stack-1": true, "stack-single": true}, doomed)
+		} else {
+			assert.Equal(t, map[string]bool{"stack-single": true}, doomed)
+		}
+	}
+}
+
+func TestMarkStackParent(t *testing.T) {
+	tests := []struct {
+		name             string
+		stackMarker      string
+		dryRun           bool
+		parent           utils.TAsset
+		expectedRequests []string
+		expectedBody     string
+	}{
+		{
+			name:             "none does nothing",
+			stackMarker:      utils.StackMarkerNone,
+			parent:           utils.TAsset{ID: "asset-1"},
+			expectedRequests: nil,
+		},
+		{
+			name:             "description without existing description",
+			stackMarker:      utils.StackMarkerDescription,
+			parent:           utils.TAsset{ID: "asset-1"},
+			expectedRequests: []string{"PUT /api/assets/asset-1"},
+			expectedBody:     `{"description":"[immich-stack v1.0 key=IMG_1]"}`,
+		},
+		{
+			name:             "description appended to existing description",
+			stackMarker:      utils.StackMarkerDescription,
+			parent:           utils.TAsset{ID: "asset-1", ExifInfo: &utils.TExifInfo{Description: "Sunset"}},
+			expectedRequests: []string{"PUT /api/assets/asset-1"},
+			expectedBody:     `{"description":"Sunset [immich-stack v1.0 key=IMG_1]"}`,
+		},
+		{
+			name:             "already marked asset is skipped",
+			stackMarker:      utils.StackMarkerDescription,
+			parent:           utils.TAsset{ID: "asset-1", ExifInfo: &utils.TExifInfo{Description: "[immich-stack v0.9 key=IMG_1]"}},
+			expectedRequests: nil,
+		},
+		{
+			name:             "tag mode upserts and attaches the tag",
+			stackMarker:      utils.StackMarkerTag,
+			parent:           utils.TAsset{ID: "asset-1"},
+			expectedRequests: []string{"PUT /api/tags", "POST /api/search/metadata", "PUT /api/tags/tag-1/assets"},
+			expectedBody:     `{"ids":["asset-1"]}`,
+		},
+		{
+			name:             "tag mode skips an asset already tagged",
+			stackMarker:      utils.StackMarkerTag,
+			parent:           utils.TAsset{ID: "asset-7"},
+			expectedRequests: []string{"PUT /api/tags", "POST /api/search/metadata"},
+		},
+		{
+			name:             "dry run does not call the API",
+			stackMarker:      utils.StackMarkerTag,
+			dryRun:           true,
+			parent:           utils.TAsset{ID: "asset-1"},
+			expectedRequests: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := logrus.New()
+			logger.SetOutput(io.Discard)
+			transport := &mockTransportRecorder{
+				responses: map[string]string{
+					"PUT /api/tags":             `[{"id": "tag-1", "name": "immich-stack", "value": "immich-stack"}]`,
+					"POST /api/search/metadata": `{"assets": {"items": [{"id": "asset-7"}], "nextPage": null}}`,
+				},
+			}
+			client := &Client{
+				apiKey:      "test",
+				apiURL:      "http://test/api",
+				logger:      logger,
+				dryRun:      tt.dryRun,
+				stackMarker: tt.stackMarker,
+				client:      &http.Client{Transport: transport},
+			}
+
+			err := client.MarkStackParent(tt.parent, "[immich-stack v1.0 key=IMG_1]")
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedRequests, transport.requests)
+			if tt.expectedBody != "" {
+				assert.JSONEq(t, tt.expectedBody, transport.bodies[len(transport.bodies)-1])
+			}
+		})
+	}
+}
+
+func TestTagStackParent(t *testing.T) {
+	newClient := func(dryRun bool) (*Client, *mockTransportRecorder) {
+		logger := logrus.New()
+		logger.SetOutput(io.Discard)
+		transport := &mockTransportRecorder{
+			responses: map[string]string{
+				"GET /api/stacks":           `[{"id": "stack-1", "primaryAssetId": "asset-9", "assets": [{"id": "asset-9"}, {"id": "asset-10"}]}]`,
+				"PUT /api/tags":             `[{"id": "tag-1", "name": "stacked", "value": "stacked"}]`,
+				"POST /api/search/metadata": `{"assets": {"items": [{"id": "asset-3"}], "nextPage": null}}`,
+			},
+		}
+		return &Client{
+			apiKey:        "test",
+			apiURL:        "http://test/api",
+			logger:        logger,
+			dryRun:        dryRun,
+			tagParentWith: "stacked",
+			client:        &http.Client{Transport: transport},
+		}, transport
+	}
+
+	t.Run("tag is created and searched once per run", func(t *testing.T) {
+		client, transport := newClient(false)
+		require.NoError(t, client.TagStackParent(utils.TAsset{ID: "asset-1"}))
+		require.NoError(t, client.TagStackParent(utils.TAsset{ID: "asset-2"}))
+		require.NoError(t, client.TagStackParent(utils.TAsset{ID: "asset-3"}))
+		require.NoError(t, client.TagStackParent(utils.TAsset{ID: "asset-1"}))
+		assert.Equal(t, []string{"PUT /api/tags", "POST /api/search/metadata", "PUT /api/tags/tag-1/assets", "PUT /api/tags/tag-1/assets"}, transport.requests, "the assets already tagged are left untouched")
+		assert.Contains(t, transport.bodies[1], `"tagIds":["tag-1"]`)
+		assert.JSONEq(t, `{"ids":["asset-2"]}`, transport.bodies[len(transport.bodies)-1])
+	})
+
+	t.Run("deleting a stack untags its parent", func(t *testing.T) {
+		client, transport := newClient(false)
+		_, err := client.FetchAllStacks()
+		require.NoError(t, err)
+		require.NoError(t, client.DeleteStack("stack-1", utils.REASON_RESET_STACK))
+		assert.Equal(t, []string{"GET /api/stacks", "DELETE /api/stacks/stack-1", "PUT /api/tags", "DELETE /api/tags/tag-1/assets"}, transport.requests)
+		assert.JSONEq(t, `{"ids":["asset-9"]}`, transport.bodies[len(transport.bodies)-1])
+	})
+
+	t.Run("dry run does not call the API", func(t *testing.T) {
+		client, transport := newClient(true)
+		_, err := client.FetchAllStacks()
+		require.NoError(t, err)
+		require.NoError(t, client.TagStackParent(utils.TAsset{ID: "asset-1"}))
+		require.NoError(t, client.DeleteStack("stack-1", utils.REASON_RESET_STACK))
+		assert.Equal(t, []string{"GET /api/stacks"}, transport.requests)
+	})
+}
+
+func TestSearchAssetsRequestsExif(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	for _, withExif := range []bool{false, true} {
+		transport := &mockTransportRecorder{
+			responses: map[string]string{
+				"POST /api/search/metadata": `{"assets": {"items": [
+					{"id": "asset-1", "originalFileName": "IMG_0001.jpg", "exifInfo": {"rating": 5}}
+				], "nextPage": null}}`,
+			},
+		}
+		client := &Client{
+			apiKey:   "test",
+			apiURL:   "http://test/api",
+			logger:   logger,
+			withExif: withExif,
+			client:   &http.Client{Transport: transport},
+		}
+
+		assets, err := client.SearchAssets(100, map[string]utils.TStack{})
+		require.NoError(t, err)
+		require.Len(t, transport.bodies, 2, "the search, then the count of the server")
+		assert.Equal(t, withExif, strings.Contains(transport.bodies[0], `"withExif":true`))
+		assert.NotContains(t, transport.bodies[1], "withExif")
+		require.Len(t, assets, 1)
+		require.NotNil(t, assets[0].ExifInfo)
+		assert.Equal(t, 5, assets[0].ExifInfo.Rating)
+	}
+}
+
+func TestFetchLivePhotoVideos(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	transport := &mockTransportRecorder{
+		responses: map[string]string{
+			"POST /api/search/metadata": `{"assets": {"items": [
+				{"id": "video-1", "originalFileName": "IMG_0001.MOV", "type": "VIDEO"},
+				{"id": "video-9", "originalFileName": "IMG_0009.MOV", "type": "VIDEO"}
+			], "nextPage": null}}`,
+		},
+	}
+	client := &Client{
+		apiKey: "test",
+		apiURL: "http://test/api",
+		logger: logger,
+		client: &http.Client{Transport: transport},
+	}
+	assets := []utils.TAsset{
+		{ID: "image-1", OriginalFileName: "IMG_0001.HEIC", LivePhotoVideoID: "video-1"},
+		{ID: "image-2", OriginalFileName: "IMG_0002.HEIC", LivePhotoVideoID: "video-2"},
+		{ID: "video-2", OriginalFileName: "IMG_0002.MOV", Type: "VIDEO"},
+		{ID: "image-3", OriginalFileName: "IMG_0001_edited.HEIC", LivePhotoVideoID: "video-1"},
+		{ID: "image-4", OriginalFileName: "IMG_0004.jpg"},
+	}
+	stacksMap := map[string]utils.TStack{"video-1": {ID: "stack-1", PrimaryAssetID: "image-1"}}
+
+	videos := client.FetchLivePhotoVideos(assets, stacksMap)
+
+	assert.Equal(t, []string{"POST /api/search/metadata"}, transport.requests, "the videos are searched at once")
+	assert.Contains(t, transport.bodies[0], `"visibility":"hidden"`)
+	assert.Contains(t, transport.bodies[0], `"type":"VIDEO"`)
+	require.Len(t, videos, 1, "only missing videos are kept")
+	assert.Equal(t, "video-1", videos[0].ID)
+	assert.Equal(t, "VIDEO", videos[0].Type)
+	require.NotNil(t, videos[0].Stack)
+	assert.Equal(t, "stack-1", videos[0].Stack.ID)
+
+	transport.requests = nil
+	assert.Nil(t, client.FetchLivePhotoVideos(assets[1:3], stacksMap))
+	assert.Empty(t, transport.requests, "nothing is searched without a missing video")
+}
+
+func TestFetchLivePhotoVideosFallback(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.URL.Path {
+		case "/search/metadata":
+			// An older server without the visibility field
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"message": ["property visibility should not exist"]}`)
+		case "/assets/video-1":
+			fmt.Fprint(w, `{"id": "video-1", "originalFileName": "IMG_0001.MOV", "type": "VIDEO"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := &Client{apiKey: "test", apiURL: server.URL, logger: logger, client: &http.Client{}}
+	videos := client.FetchLivePhotoVideos([]utils.TAsset{{ID: "image-1", LivePhotoVideoID: "video-1"}}, nil)
+	assert.Equal(t, []string{"POST /search/metadata", "GET /assets/video-1"}, requests)
+	require.Len(t, videos, 1)
+	assert.Equal(t, "video-1", videos[0].ID)
+}
+
+func TestSearchAssetsFilenameQuery(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+
+	transport := &mockTransportRecorder{
+		responses: map[string]string{
+			"POST /api/search/statistics": `{"total": 10}`,
+			"POST /api/search/metadata":   `{"assets": {"items": [{"id": "1", "originalFileName": "PXL_001.jpg"}], "nextPage": ""}}`,
+		},
+	}
+	client := &Client{
+		apiKey:        "test",
+		apiURL:        "http://test/api",
+		logger:        logger,
+		client:        &http.Client{Transport: transport},
+		filenameQuery: "PXL_",
+	}
+
+	assets, err := client.SearchAssets(1000, nil)
+	require.NoError(t, err)
+	require.Len(t, assets, 1)
+
+	assert.Equal(t, []string{"POST /api/search/statistics", "POST /api/search/metadata", "POST /api/search/statistics"}, transport.requests)
+	assert.NotContains(t, transport.bodies[0], "originalFileName", "the count is taken without the filename filter")
+	assert.Contains(t, transport.bodies[1], `"originalFileName":"PXL_"`)
+	assert.Contains(t, transport.bodies[2], `"originalFileName":"PXL_"`, "the fetch is checked against the filtered count")
+	assert.Contains(t, out.String(), "skipped 9 of 10 assets server-side")
+
+	// Without a filename query, every asset is searched and only the fetch is checked
+	transport.requests, transport.bodies = nil, nil
+	client.filenameQuery = ""
+	_, err = client.SearchAssets(1000, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"POST /api/search/metadata", "POST /api/search/statistics"}, transport.requests)
+	assert.NotContains(t, transport.bodies[0], "originalFileName")
+}
+
+func TestSearchAssetsProjectionFallback(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(raw))
+		// A server without field selection rejects the projection parameters
+		if strings.Contains(string(raw), "withPeople") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"message": ["property withPeople should not exist"]}`)
+			return
+		}
+		fmt.Fprint(w, `{"assets": {"items": [{"id": "asset-1", "originalFileName": "IMG_0001.jpg"}], "nextPage": null}}`)
+	}))
+	defer server.Close()
+
+	client := &Client{apiKey: "test", apiURL: server.URL, logger: logger, client: &http.Client{}}
+	assets, err := client.SearchAssets(100, map[string]utils.TStack{})
+	require.NoError(t, err)
+	require.Len(t, assets, 1)
+	require.Len(t, bodies, 3, "the rejected search, the full search and the count")
+	assert.Contains(t, bodies[0], `"withExif":false`)
+	assert.Contains(t, bodies[0], `"withPeople":false`)
+	assert.NotContains(t, bodies[1], "withExif", "the full assets are fetched after the rejection")
+
+	// The projection is not sent again to a server that rejected it
+	_, err = client.SearchAssets(100, map[string]utils.TStack{})
+	require.NoError(t, err)
+	require.Len(t, bodies, 5)
+	assert.NotContains(t, bodies[3], "withPeople")
+}
+
+func TestAuthError(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	status := http.StatusForbidden
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"message": "Missing required permission: job.read", "statusCode": %d}`, status)
+	}))
+	defer server.Close()
+
+	client := &Client{apiKey: "test", apiURL: server.URL, logger: logger, client: &http.Client{}}
+	_, err := client.FetchJobs()
+	require.Error(t, err)
+	assert.True(t, IsAuthError(err))
+	var authErr *AuthError
+	require.ErrorAs(t, err, &authErr)
+	assert.Equal(t, "Missing required permission: job.read", authErr.Message)
+
+	// A 403 only concerns its own request
+	_, err = client.FetchAllStacks()
+	assert.True(t, IsAuthError(err))
+	assert.Equal(t, 2, requests)
+
+	// After a 401 the key is unusable and Immich is not called again
+	status = http.StatusUnauthorized
+	_, err = client.FetchAllStacks()
+	assert.True(t, IsAuthError(err))
+	_, err = client.FetchAllStacks()
+	assert.ErrorContains(t, err, "Immich rejected the API key (401 Unauthorized)")
+	assert.Equal(t, 3, requests)
+
+	assert.False(t, IsAuthError(fmt.Errorf("error: %w", &ResponseError{StatusCode: http.StatusBadRequest})))
+	assert.Equal(t, "not json", newAuthError(http.StatusUnauthorized, []byte(" not json\n")).Message)
+}
+
+func TestOnlyNewStacks(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Method == http.MethodGet && r.URL.Path == "/stacks" {
+			fmt.Fprint(w, `[{"id": "stack-1", "primaryAssetId": "a1", "assets": [{"id": "a1"}, {"id": "a2"}]}]`)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := &Client{apiKey: "test", apiURL: server.URL, logger: logger, client: &http.Client{}}
+	client.SetOnlyNewStacks(true)
+
+	// Nothing tells the stacked assets apart before the stacks are fetched
+	assert.ErrorIs(t, client.CreateStack([]string{"b1", "b2"}), ErrOnlyNewStacks)
+
+	_, err := client.FetchAllStacks()
+	require.NoError(t, err)
+	require.NoError(t, client.CreateStack([]string{"b1", "b2"}))
+	assert.ErrorIs(t, client.CreateStack([]string{"b1", "a2"}), ErrOnlyNewStacks)
+
+	// Deletes and updates never reach Immich, whatever the caller
+	assert.ErrorIs(t, client.DeleteStack("stack-1", utils.REASON_REPLACE_CHILD_STACK_WITH_NEW_ONE), ErrOnlyNewStacks)
+	assert.ErrorIs(t, client.TrashAssets([]string{"a1"}), ErrOnlyNewStacks)
+	assert.ErrorIs(t, client.UpdateAssetDescription("a1", "edited"), ErrOnlyNewStacks)
+	assert.ErrorIs(t, client.UpdateAlbum("album", map[string]interface{}{"albumName": "renamed"}), ErrOnlyNewStacks)
+	assert.Equal(t, []string{"GET /stacks", "POST /stacks"}, requests)
+}
+
+func TestNormalizeAPIURL(t *testing.T) {
+	tests := []struct {
+		apiURL string
+		want   string
+	}{
+		{"http://immich:2283", "http://immich:2283/api"},
+		{"http://immich:2283/", "http://immich:2283/api"},
+		{"http://immich:2283/api/", "http://immich:2283/api"},
+		{"http://immich:2283//api//", "http://immich:2283/api"},
+		{"https://example.com/immich", "https://example.com/immich/api"},
+		{"https://example.com/immich/api", "https://example.com/immich/api"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.apiURL, func(t *testing.T) {
+			client := NewClient(tt.apiURL, "test-key", false, false, false, true, false, false, nil, "", "", "", false, false, "", logrus.New())
+			require.NotNil(t, client)
+			assert.Equal(t, tt.want, client.apiURL)
+		})
+	}
+}
+
+func TestCheckAPIURL(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	// The API answers under /api, the web app answers anything else with its index page
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/server/ping" {
+			fmt.Fprint(w, `{"res": "pong"}`)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, "<!doctype html>")
+	}))
+	defer server.Close()
+
+	newClient := func(apiURL string) *Client {
+		client := NewClient(apiURL, "test-key", false, false, false, true, false, false, nil, "", "", "", false, false, "", logger)
+		require.NotNil(t, client)
+		return client
+	}
+
+	t.Run("missing /api and trailing slash", func(t *testing.T) {
+		client := newClient(server.URL + "/")
+		require.NoError(t, client.CheckAPIURL(false))
+		assert.Equal(t, server.URL+"/api", client.apiURL)
+	})
+
+	t.Run("wrong path corrected to the /api of the host", func(t *testing.T) {
+		client := newClient(server.URL + "/photos")
+		require.NoError(t, client.CheckAPIURL(false))
+		assert.Equal(t, server.URL+"/api", client.apiURL)
+	})
+
+	t.Run("strict mode uses API_URL as configured", func(t *testing.T) {
+		client := newClient(server.URL + "/api/")
+		require.NoError(t, client.CheckAPIURL(true))
+		assert.Equal(t, server.URL+"/api", client.apiURL)
+
+		client = newClient(server.URL)
+		err := client.CheckAPIURL(true)
+		assert.ErrorContains(t, err, "is not the Immich API, "+server.URL+"/api is")
+	})
+
+	t.Run("unreachable server left to the run", func(t *testing.T) {
+		closed := httptest.NewServer(http.NotFoundHandler())
+		closed.Close()
+		client := newClient(closed.URL)
+		require.NoError(t, client.CheckAPIURL(true))
+	})
+}
+
+func TestSearchAssetsWithHidden(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+
+	refuseHidden := false
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(raw))
+		hidden := strings.Contains(string(raw), `"visibility":"hidden"`)
+		switch {
+		case hidden && refuseHidden:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"message": ["visibility must be one of the following values: archive, timeline"]}`)
+		case strings.HasSuffix(r.URL.Path, "/search/statistics"):
+			fmt.Fprint(w, `{"total": 1}`)
+		case hidden:
+			fmt.Fprint(w, `{"assets": {"items": [{"id": "asset-2", "originalFileName": "IMG_0002.jpg", "visibility": "hidden"}], "nextPage": null}}`)
+		default:
+			fmt.Fprint(w, `{"assets": {"items": [{"id": "asset-1", "originalFileName": "IMG_0001.jpg", "visibility": "timeline"}], "nextPage": null}}`)
+		}
+	}))
+	defer server.Close()
+
+	client := &Client{apiKey: "test", apiURL: server.URL, logger: logger, client: &http.Client{}}
+	assets, err := client.SearchAssets(100, map[string]utils.TStack{})
+	require.NoError(t, err)
+	require.Len(t, assets, 1, "the hidden assets are not searched by default")
+	assert.Contains(t, bodies[0], `"isVisible":true`)
+	assert.NotContains(t, bodies[0], "visibility")
+
+	// The hidden assets are searched in a pass of their own
+	bodies = nil
+	client.SetWithHidden(true)
+	assets, err = client.SearchAssets(100, map[string]utils.TStack{})
+	require.NoError(t, err)
+	require.Len(t, assets, 2)
+	assert.Equal(t, utils.VisibilityHidden, assets[1].Visibility)
+	require.Len(t, bodies, 4, "two searches, then their counts")
+	assert.NotContains(t, bodies[1], "isVisible")
+	assert.NotContains(t, out.String(), "truncated")
+
+	// A server refusing the visibility leaves the hidden assets out
+	bodies = nil
+	refuseHidden = true
+	assets, err = client.SearchAssets(100, map[string]utils.TStack{})
+	require.NoError(t, err)
+	require.Len(t, assets, 1)
+	assert.Equal(t, "asset-1", assets[0].ID)
+	assert.Len(t, bodies, 3, "the refused pass is not counted")
+	assert.Contains(t, out.String(), "Immich refused the search of the hidden assets")
+	assert.False(t, client.fullPayload, "the projection is kept")
+}
+
+func TestSearchAssetsResponseShapes(t *testing.T) {
+	for _, fixture := range []string{"search_metadata_v1.json", "search_metadata_v2.json"} {
+		t.Run(fixture, func(t *testing.T) {
+			data, err := os.ReadFile("testdata/" + fixture)
+			require.NoError(t, err)
+			var out bytes.Buffer
+			logger := logrus.New()
+			logger.SetOutput(&out)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/search/statistics" {
+					fmt.Fprint(w, `{"total": 2}`)
+					return
+				}
+				w.Write(data)
+			}))
+			defer server.Close()
+
+			client := &Client{apiKey: "test", apiURL: server.URL, logger: logger, client: &http.Client{}}
+			assets, err := client.SearchAssets(100, nil)
+			require.NoError(t, err)
+			require.Len(t, assets, 2)
+			for _, asset := range assets {
+				assert.NotEmpty(t, asset.ID)
+				assert.NotEmpty(t, asset.OriginalFileName)
+				assert.Empty(t, asset.DecodeErrors)
+			}
+			assert.NotContains(t, out.String(), "Could not decode")
+		})
+	}
+
+	t.Run("null timestamps", func(t *testing.T) {
+		data, err := os.ReadFile("testdata/search_metadata_v2.json")
+		require.NoError(t, err)
+		var response utils.TSearchResponse
+		require.NoError(t, json.Unmarshal(data, &response))
+		scan := response.Assets.Items[1]
+		assert.Equal(t, "scan-0042.tif", scan.OriginalFileName)
+		assert.Empty(t, scan.LocalDateTime)
+		assert.Empty(t, scan.FileCreatedAt)
+		assert.Equal(t, "2025-01-20T09:12:00.000Z", scan.FileModifiedAt)
+	})
+
+	t.Run("fields of a changed type", func(t *testing.T) {
+		var out bytes.Buffer
+		logger := logrus.New()
+		logger.SetOutput(&out)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/search/statistics" {
+				fmt.Fprint(w, `{"total": 3}`)
+				return
+			}
+			fmt.Fprint(w, `{"assets": {"items": [
+				{"id": "1", "originalFileName": "IMG_0001.jpg", "duration": 1500, "exifInfo": {"rating": "4", "iso": 100}},
+				{"id": "2", "originalFileName": "IMG_0002.jpg", "duration": 2000},
+				{"id": "3", "originalFileName": "IMG_0003.jpg", "duration": "0:00:00.00000"}
+			], "nextPage": null}}`)
+		}))
+		defer server.Close()
+
+		client := &Client{apiKey: "test", apiURL: server.URL, logger: logger, client: &http.Client{}}
+		assets, err := client.SearchAssets(100, nil)
+		require.NoError(t, err, "a field of a changed type does not fail the page")
+		require.Len(t, assets, 3)
+		assert.Equal(t, "IMG_0001.jpg", assets[0].OriginalFileName)
+		assert.Empty(t, assets[0].Duration)
+		require.NotNil(t, assets[0].ExifInfo)
+		assert.Equal(t, 100.0, *assets[0].ExifInfo.ISO, "the other exif fields are kept")
+		assert.Equal(t, []string{"duration", "exifInfo.rating"}, assets[0].DecodeErrors)
+		assert.Empty(t, assets[2].DecodeErrors)
+
+		// Each field is logged once, with a sample asset
+		assert.Equal(t, 1, strings.Count(out.String(), "Could not decode the duration field"))
+		assert.Contains(t, out.String(), "Could not decode the duration field of the assets, left empty (e.g. asset 1)")
+		assert.Contains(t, out.String(), "Could not decode the exifInfo.rating field")
+	})
+}
+
+func TestTraceParentHeader(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	var headers []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Get("traceparent"))
+		fmt.Fprint(w, `{"id": "user"}`)
+	}))
+	defer server.Close()
+
+	client := &Client{apiKey: "test", apiURL: server.URL, logger: logger, client: &http.Client{}}
+	_, err := client.GetCurrentUser()
+	require.NoError(t, err)
+
+	run := utils.NewTracer("http://localhost:4318", "immich-stack", "test").Start("run")
+	client.SetTraceSpan(run)
+	_, err = client.GetCurrentUser()
+	require.NoError(t, err)
+
+	require.Len(t, headers, 2)
+	assert.Empty(t, headers[0], "no header without tracing")
+	assert.Regexp(t, `^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`, headers[1])
+	assert.Equal(t, run.TraceParent()[:35], headers[1][:35], "the request carries the trace of the run")
+	assert.NotEqual(t, run.TraceParent(), headers[1], "under a span of its own")
+}
+
+func TestFetchDuplicates(t *testing.T) {
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		fmt.Fprint(w, `[{"duplicateId": "d1", "assets": [{"id": "a1", "originalFileName": "IMG_0001.jpg"}, {"id": "a2", "originalFileName": "IMG_0001 (1).jpg"}]}]`)
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	client := NewClient(server.URL, "key", false, false, false, false, false, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
+
+	groups, err := client.FetchDuplicates()
+	require.NoError(t, err)
+	assert.Equal(t, "/api/duplicates", path)
+	require.Len(t, groups, 1)
+	assert.Equal(t, "d1", groups[0].DuplicateID)
+	assert.Len(t, groups[0].Assets, 2)
+}
+
+func TestStackHook(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	created := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/stacks":
+			fmt.Fprint(w, `[
+				{"id": "stack-1", "primaryAssetId": "a1", "assets": [{"id": "a1"}, {"id": "a2"}]},
+				{"id": "stack-2", "primaryAssetId": "b1", "assets": [{"id": "b1"}, {"id": "b2"}]}
+			]`)
+		case r.Method == http.MethodPost && r.URL.Path == "/stacks":
+			created++
+			fmt.Fprintf(w, `{"id": "new-%d"}`, created)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	client := &Client{apiKey: "test", apiURL: server.URL, logger: logger, client: &http.Client{}}
+	var changes []StackChange
+	client.SetStackHook(func(change StackChange) { changes = append(changes, change) })
+
+	_, err := client.FetchAllStacks()
+	require.NoError(t, err)
+	require.NoError(t, client.CreateStack([]string{"a2", "a1"}))
+	require.NoError(t, client.CreateStack([]string{"c1", "c2"}))
+	require.NoError(t, client.CreateStack([]string{"b1", "c3"}))
+	require.NoError(t, client.DeleteStack("new-2", utils.REASON_RESET_STACK))
+
+	assert.Equal(t, []StackChange{
+		{Action: StackPrimaryChanged, StackID: "new-1", AssetIDs: []string{"a2", "a1"}, ReplacedStacks: []string{"stack-1"}},
+		{Action: StackCreated, StackID: "new-2", AssetIDs: []string{"c1", "c2"}},
+		{Action: StackMerged, StackID: "new-3", AssetIDs: []string{"b1", "c3"}, ReplacedStacks: []string{"stack-2"}},
+		{Action: StackDeleted, StackID: "new-2", AssetIDs: []string{"c1", "c2"}, Reason: utils.REASON_RESET_STACK},
+	}, changes)
+
+	// A dry run reports the changes it would make, without the ID of the new stacks
+	changes = nil
+	client.dryRun = true
+	require.NoError(t, client.CreateStack([]string{"a1", "b2"}))
+	assert.Equal(t, []StackChange{{Action: StackMerged, AssetIDs: []string{"a1", "b2"}, ReplacedStacks: []string{"new-1", "new-3"}}}, changes)
+}
+
+func TestUpdateStack(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	var updates []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/stacks":
+			fmt.Fprint(w, `[{"id": "stack-1", "primaryAssetId": "a1", "assets": [{"id": "a1"}, {"id": "a2"}, {"id": "a3"}]}]`)
+		case r.Method == http.MethodPut && r.URL.Path == "/stacks/stack-1":
+			body, _ := io.ReadAll(r.Body)
+			updates = append(updates, string(body))
+			fmt.Fprint(w, `{"id": "stack-1"}`)
+		case r.Method == http.MethodPut:
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	client := &Client{apiKey: "test", apiURL: server.URL, logger: logger, client: &http.Client{}}
+	var changes []StackChange
+	client.SetStackHook(func(change StackChange) { changes = append(changes, change) })
+
+	_, err := client.FetchAllStacks()
+	require.NoError(t, err)
+	require.NoError(t, client.UpdateStack("stack-1", "a2"))
+	assert.Equal(t, []string{`{"primaryAssetId":"a2"}`}, updates)
+	assert.Equal(t, []StackChange{{Action: StackPrimaryChanged, StackID: "stack-1", AssetIDs: []string{"a2", "a1", "a3"}}}, changes)
+
+	// The members are recorded with their new primary first
+	changes = nil
+	require.NoError(t, client.DeleteStack("stack-1", utils.REASON_RESET_STACK))
+	assert.Equal(t, []string{"a2", "a1", "a3"}, changes[0].AssetIDs)
+
+	err = client.UpdateStack("stack-2", "b2")
+	assert.ErrorContains(t, err, "error updating stack stack-2")
+
+	// A dry run only reports the change
+	client.dryRun = true
+	changes = nil
+	require.NoError(t, client.UpdateStack("stack-2", "b2"))
+	assert.Len(t, updates, 1)
+	assert.Equal(t, []StackChange{{Action: StackPrimaryChanged, StackID: "stack-2", AssetIDs: []string{"b2"}}}, changes)
+}
+
+func TestProxyHeaders(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		if r.URL.Path == "/api/server/ping" {
+			fmt.Fprint(w, `{"res": "pong"}`)
+			return
+		}
+		fmt.Fprint(w, `{"id": "user"}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "test-key", false, false, false, false, false, false, nil, "", "", utils.StackMarkerNone, false, false, "", logger)
+	client.SetExtraHeaders(map[string]string{"X-Proxy-Token": "token", "X-Api-Key": "ignored"})
+	client.SetBasicAuth("proxy", "secret")
+	require.NoError(t, client.CheckAPIURL(false))
+	_, err := client.GetCurrentUser()
+	require.NoError(t, err)
+
+	require.Len(t, requests, 2)
+	for _, r := range requests {
+		assert.Equal(t, "token", r.Header.Get("X-Proxy-Token"), r.URL.Path)
+		user, pass, ok := r.BasicAuth()
+		assert.True(t, ok, r.URL.Path)
+		assert.Equal(t, "proxy", user)
+		assert.Equal(t, "secret", pass)
+	}
+	assert.Equal(t, "test-key", requests[1].Header.Get("x-api-key"), "the API key is not replaced")
+}
@@ -0,0 +1,197 @@
+/**************************************************************************************************
+** Stack index of the runs.
+** The stacks are fetched once at the start of a run. The index keeps the stack of every asset
+** up to date with the changes the tool makes during the run, so each group is compared against
+** the current stacks without fetching them again.
+**************************************************************************************************/
+
+package orchestrator
+
+import (
+	"github.com/majorfi/immich-stack/pkg/utils"
+)
+
+/**************************************************************************************************
+** StackIndex holds the stack of each asset during a run. Stacks created during the run have no
+** known ID, as Immich is not asked for them again.
+**************************************************************************************************/
+type StackIndex struct {
+	byAsset map[string]*utils.TStack
+	byID    map[string]*utils.TStack
+}
+
+/**************************************************************************************************
+** ReplacedStack is an old stack deleted by a replacement, with its members, parent first.
+**************************************************************************************************/
+type ReplacedStack struct {
+	ID       string   `json:"id"`
+	AssetIDs []string `json:"assetIds"`
+}
+
+/**************************************************************************************************
+** NewStackIndex builds the index from the stacks fetched at the start of the run.
+**
+** @param existingStacks - Stacks fetched from Immich, by asset ID
+** @return *StackIndex - The index
+**************************************************************************************************/
+func NewStackIndex(existingStacks map[string]utils.TStack) *StackIndex {
+	index := &StackIndex{byAsset: make(map[string]*utils.TStack, len(existingStacks)), byID: make(map[string]*utils.TStack)}
+	for assetID, stack := range existingStacks {
+		current, ok := index.byID[stack.ID]
+		if !ok {
+			current = &utils.TStack{ID: stack.ID, PrimaryAssetID: stack.PrimaryAssetID, Assets: append([]utils.TAsset(nil), stack.Assets...)}
+			index.byID[stack.ID] = current
+		}
+		index.byAsset[assetID] = current
+	}
+	return index
+}
+
+/**************************************************************************************************
+** Refresh sets the current stack of each member, or none when the member is not stacked
+** anymore.
+**
+** @param stack - Members of a group
+**************************************************************************************************/
+func (s *StackIndex) Refresh(stack []utils.TAsset) {
+	for i := range stack {
+		stack[i].Stack = s.byAsset[stack[i].ID]
+	}
+}
+
+/**************************************************************************************************
+** StackOf returns the current stack of an asset.
+**
+** @param assetID - ID of the asset
+** @return *utils.TStack - The stack, nil when the asset is not stacked
+**************************************************************************************************/
+func (s *StackIndex) StackOf(assetID string) *utils.TStack {
+	return s.byAsset[assetID]
+}
+
+/**************************************************************************************************
+** RemoveStack forgets a stack deleted during the run.
+**
+** @param stackID - ID of the deleted stack
+** @return bool - False when the stack is unknown or already deleted
+**************************************************************************************************/
+func (s *StackIndex) RemoveStack(stackID string) bool {
+	stack, ok := s.byID[stackID]
+	if !ok {
+		return false
+	}
+	delete(s.byID, stackID)
+	s.forget(stack)
+	return true
+}
+
+/**************************************************************************************************
+** ReplacedStacks splits the stacks of the children to replace by when they can be deleted.
+** Immich merges a stack whose parent is a member into the new stack, with all its assets, so
+** such a stack is deleted before the new stack is created. The others are deleted after it.
+** A stack is listed once, and a stack already gone during the run is left out.
+**
+** @param childStackIDs - IDs of the stacks of the children
+** @param newStackIDs - IDs of the members of the new stack, parent first
+** @return []ReplacedStack - Stacks to delete first, with their members
+** @return []string - IDs of the stacks to delete after the new stack is created
+**************************************************************************************************/
+func (s *StackIndex) ReplacedStacks(childStackIDs []string, newStackIDs []string) ([]ReplacedStack, []string) {
+	members := make(map[string]bool, len(newStackIDs))
+	for _, id := range newStackIDs {
+		members[id] = true
+	}
+	var first []ReplacedStack
+	var after []string
+	for _, stackID := range uniqueIDs(childStackIDs) {
+		stack, ok := s.byID[stackID]
+		if !ok {
+			continue
+		}
+		if !members[stack.PrimaryAssetID] {
+			after = append(after, stackID)
+			continue
+		}
+		assetIDs := []string{stack.PrimaryAssetID}
+		for _, asset := range stack.Assets {
+			if asset.ID != stack.PrimaryAssetID {
+				assetIDs = append(assetIDs, asset.ID)
+			}
+		}
+		first = append(first, ReplacedStack{ID: stackID, AssetIDs: assetIDs})
+	}
+	return first, after
+}
+
+/**************************************************************************************************
+** RecordCreated records a stack created during the run. Like Immich, a stack whose parent is
+** one of the members is merged into the new stack, and a member taken from another stack is
+** removed from it.
+**
+** @param assetIDs - IDs of the members of the created stack, parent first
+**************************************************************************************************/
+func (s *StackIndex) RecordCreated(assetIDs []string) {
+	members := make(map[string]bool, len(assetIDs))
+	for _, id := range assetIDs {
+		members[id] = true
+	}
+	created := &utils.TStack{PrimaryAssetID: assetIDs[0]}
+	for _, id := range assetIDs {
+		created.Assets = append(created.Assets, utils.TAsset{ID: id})
+	}
+
+	for _, id := range assetIDs {
+		previous, ok := s.byAsset[id]
+		if !ok || previous == created {
+			continue
+		}
+		if !members[previous.PrimaryAssetID] {
+			previous.Assets = withoutAsset(previous.Assets, id)
+			continue
+		}
+		for _, asset := range previous.Assets {
+			if !members[asset.ID] {
+				members[asset.ID] = true
+				created.Assets = append(created.Assets, utils.TAsset{ID: asset.ID})
+			}
+		}
+		if previous.ID != "" {
+			delete(s.byID, previous.ID)
+		}
+		s.forget(previous)
+	}
+
+	for _, asset := range created.Assets {
+		s.byAsset[asset.ID] = created
+	}
+}
+
+/**************************************************************************************************
+** forget removes the assets of a stack from the index, unless they moved to another stack.
+**
+** @param stack - The stack to forget
+**************************************************************************************************/
+func (s *StackIndex) forget(stack *utils.TStack) {
+	for _, asset := range stack.Assets {
+		if s.byAsset[asset.ID] == stack {
+			delete(s.byAsset, asset.ID)
+		}
+	}
+}
+
+/**************************************************************************************************
+** withoutAsset returns the assets without the given one.
+**
+** @param assets - Assets of a stack
+** @param assetID - ID of the asset to remove
+** @return []utils.TAsset - The remaining assets
+**************************************************************************************************/
+func withoutAsset(assets []utils.TAsset, assetID string) []utils.TAsset {
+	kept := make([]utils.TAsset, 0, len(assets))
+	for _, asset := range assets {
+		if asset.ID != assetID {
+			kept = append(kept, asset)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,47 @@
+package orchestrator
+
+import (
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the stack index kept up to date during a run
+************************************************************************************************/
+
+func TestStackIndex(t *testing.T) {
+	s1 := utils.TStack{ID: "s1", PrimaryAssetID: "1", Assets: []utils.TAsset{{ID: "1"}, {ID: "2"}, {ID: "3"}}}
+	s2 := utils.TStack{ID: "s2", PrimaryAssetID: "4", Assets: []utils.TAsset{{ID: "4"}, {ID: "5"}}}
+	index := NewStackIndex(map[string]utils.TStack{"1": s1, "2": s1, "3": s1, "4": s2, "5": s2})
+
+	group := []utils.TAsset{{ID: "3"}, {ID: "6"}}
+	index.Refresh(group)
+	require.NotNil(t, group[0].Stack)
+	assert.Equal(t, "s1", group[0].Stack.ID)
+	assert.Nil(t, group[1].Stack)
+
+	// A member taken from a stack whose parent is not a member leaves it
+	index.RecordCreated([]string{"6", "3"})
+	group = []utils.TAsset{{ID: "1"}, {ID: "3"}}
+	index.Refresh(group)
+	assert.Len(t, group[0].Stack.Assets, 2, "asset 3 moved out of s1")
+	assert.Equal(t, "6", group[1].Stack.PrimaryAssetID)
+
+	// A stack whose parent is a member is merged into the new stack
+	index.RecordCreated([]string{"7", "4"})
+	group = []utils.TAsset{{ID: "5"}}
+	index.Refresh(group)
+	assert.Equal(t, "7", group[0].Stack.PrimaryAssetID)
+	assert.Len(t, group[0].Stack.Assets, 3)
+	assert.False(t, index.RemoveStack("s2"), "the merged stack is gone")
+
+	assert.True(t, index.RemoveStack("s1"))
+	assert.False(t, index.RemoveStack("s1"), "a stack is removed once")
+	group = []utils.TAsset{{ID: "1"}, {ID: "2"}}
+	index.Refresh(group)
+	assert.Nil(t, group[0].Stack)
+	assert.Nil(t, group[1].Stack)
+}
@@ -0,0 +1,136 @@
+/**************************************************************************************************
+** Errors of the stack mutations.
+** Immich reports a failed mutation with asset IDs only, such as "Asset X is already in a stack".
+** The orchestration decorates these errors with what it knows of the assets, the grouping key,
+** the parent and the filename of every member, so a log line can be acted on without looking
+** the IDs up.
+**************************************************************************************************/
+
+package orchestrator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+)
+
+// Stack mutations named by the decorated errors
+const (
+	MutationCreate = "create"
+	MutationMerge  = "merge"
+	MutationDelete = "delete"
+	MutationTrash  = "trash"
+)
+
+// maxMutationNames bounds the members named by an error, a trash can hold a whole library
+const maxMutationNames = 50
+
+/**************************************************************************************************
+** mutationError is an error of Immich on a stack mutation, with the assets it was applied to.
+** It unwraps to the error of the client, so immich.IsAuthError still sees through it.
+**************************************************************************************************/
+type mutationError struct {
+	action  string         // One of the mutation constants
+	key     string         // Grouping key of the stack, empty outside the criteria
+	parent  utils.TAsset   // Parent of the stack, zero when the mutation has none
+	members []utils.TAsset // Assets of the mutation
+	err     error
+}
+
+func (e *mutationError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.action)
+	if e.key != "" {
+		fmt.Fprintf(&b, " of stack %q", e.key)
+	}
+	fmt.Fprintf(&b, " failed: %v", e.err)
+
+	var context []string
+	if e.parent.ID != "" {
+		context = append(context, "parent "+describeMutationAsset(e.parent))
+	}
+	if len(e.members) > 0 {
+		names := make([]string, 0, len(e.members))
+		for i, member := range e.members {
+			if i == maxMutationNames {
+				names = append(names, fmt.Sprintf("and %d more", len(e.members)-i))
+				break
+			}
+			names = append(names, describeMutationAsset(member))
+		}
+		context = append(context, "members "+strings.Join(names, ", "))
+	}
+	if len(context) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(context, "; "))
+	}
+	return b.String()
+}
+
+func (e *mutationError) Unwrap() error {
+	return e.err
+}
+
+/**************************************************************************************************
+** DecorateMutationError wraps the error of a mutation with the grouping key, the parent and the
+** members it was applied to.
+**
+** @param action - The mutation: MutationCreate, MutationMerge, MutationDelete or MutationTrash
+** @param key - Grouping key of the stack, or an empty string
+** @param parent - Parent of the stack, or a zero asset
+** @param members - Assets of the mutation
+** @param err - Error of the client, or nil
+** @return error - The decorated error, nil when err is nil
+**************************************************************************************************/
+func DecorateMutationError(action, key string, parent utils.TAsset, members []utils.TAsset, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &mutationError{action: action, key: key, parent: parent, members: members, err: err}
+}
+
+/**************************************************************************************************
+** StackParent returns the primary asset of a stack fetched from Immich, for the errors of its
+** mutations.
+**
+** @param stack - The stack
+** @return utils.TAsset - The primary asset, with its ID only when it is not among the assets
+**************************************************************************************************/
+func StackParent(stack utils.TStack) utils.TAsset {
+	for _, asset := range stack.Assets {
+		if asset.ID == stack.PrimaryAssetID {
+			return asset
+		}
+	}
+	return utils.TAsset{ID: stack.PrimaryAssetID}
+}
+
+/**************************************************************************************************
+** FetchedStack returns a stack fetched from Immich by its ID, for the errors of its deletion.
+**
+** @param existingStacks - Stacks fetched from Immich, by asset ID
+** @param stackID - ID of the stack
+** @return utils.TStack - The stack, with its ID only when it was not fetched
+**************************************************************************************************/
+func FetchedStack(existingStacks map[string]utils.TStack, stackID string) utils.TStack {
+	for _, stack := range existingStacks {
+		if stack.ID == stackID {
+			return stack
+		}
+	}
+	return utils.TStack{ID: stackID}
+}
+
+/**************************************************************************************************
+** describeMutationAsset names an asset by its quoted filename and its ID, the filename being
+** left out when unknown. The filename is quoted so a crafted one cannot add lines to the logs.
+**
+** @param asset - The asset
+** @return string - Such as "IMG_0001.JPG" [asset-id]
+**************************************************************************************************/
+func describeMutationAsset(asset utils.TAsset) string {
+	if asset.OriginalFileName == "" {
+		return fmt.Sprintf("[%s]", asset.ID)
+	}
+	return fmt.Sprintf("%q [%s]", asset.OriginalFileName, asset.ID)
+}
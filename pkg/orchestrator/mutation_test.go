@@ -0,0 +1,48 @@
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+/************************************************************************************************
+** Tests for the errors of the stack mutations, decorated with the filenames of their assets
+************************************************************************************************/
+
+func TestMutationErrorMessage(t *testing.T) {
+	parent := utils.TAsset{ID: "a1", OriginalFileName: "IMG_0001.JPG"}
+	members := []utils.TAsset{parent, {ID: "a2", OriginalFileName: "IMG_0001.DNG"}}
+	cause := errors.New("error modifying stack: Asset a2 is already in a stack")
+
+	assert.NoError(t, DecorateMutationError(MutationCreate, "IMG_0001", parent, members, nil))
+
+	err := DecorateMutationError(MutationCreate, "IMG_0001", parent, members, cause)
+	assert.Equal(t, `create of stack "IMG_0001" failed: error modifying stack: Asset a2 is already in a stack (parent "IMG_0001.JPG" [a1]; members "IMG_0001.JPG" [a1], "IMG_0001.DNG" [a2])`, err.Error())
+	assert.ErrorIs(t, err, cause)
+
+	err = DecorateMutationError(MutationTrash, "", utils.TAsset{}, members[1:], cause)
+	assert.Equal(t, `trash failed: error modifying stack: Asset a2 is already in a stack (members "IMG_0001.DNG" [a2])`, err.Error())
+
+	stack := utils.TStack{ID: "s1", PrimaryAssetID: "a9", Assets: []utils.TAsset{{ID: "a8", OriginalFileName: "bad\nname.jpg"}}}
+	err = DecorateMutationError(MutationDelete, "", StackParent(stack), stack.Assets, cause)
+	assert.Contains(t, err.Error(), `(parent [a9]; members "bad\nname.jpg" [a8])`, "filenames are quoted and unknown ones left out")
+
+	authErr := DecorateMutationError(MutationMerge, "IMG_0001", parent, members, &immich.AuthError{StatusCode: 401, Message: "Invalid API key"})
+	assert.True(t, immich.IsAuthError(authErr), "the error of the client is still seen through")
+}
+
+func TestMutationErrorNamesAreBounded(t *testing.T) {
+	var members []utils.TAsset
+	for i := 0; i < maxMutationNames+3; i++ {
+		members = append(members, utils.TAsset{ID: fmt.Sprintf("a%d", i), OriginalFileName: fmt.Sprintf("IMG_%04d.JPG", i)})
+	}
+	err := DecorateMutationError(MutationTrash, "", utils.TAsset{}, members, errors.New("boom"))
+	assert.Contains(t, err.Error(), fmt.Sprintf(`"IMG_%04d.JPG"`, maxMutationNames-1))
+	assert.NotContains(t, err.Error(), fmt.Sprintf(`"IMG_%04d.JPG"`, maxMutationNames))
+	assert.Contains(t, err.Error(), "and 3 more)")
+}
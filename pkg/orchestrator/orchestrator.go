@@ -0,0 +1,538 @@
+/**************************************************************************************************
+** Orchestration of a stacking run.
+** Run fetches the stacks and the assets of Immich, groups the assets with the stacker and applies
+** the groups: it creates the new stacks, replaces or updates the existing ones and marks their
+** parents. It only talks to Immich through immich.ImmichClient, so a test or a library user can
+** drive a whole run with a client of their own. The features of the CLI, such as the skip list,
+** the review prompt or the run events, plug in through Hooks.
+**************************************************************************************************/
+
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/stacker"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// Reasons of a group left as is, as passed to Hooks.Skipped
+const (
+	SkipInvalid   = "invalid"
+	SkipUnchanged = "unchanged"
+	SkipStacked   = "children already stacked"
+	SkipRejected  = "rejected"
+	SkipOnlyNew   = "assets already stacked"
+)
+
+// Outcomes of a group in the dry run diff, as passed to Hooks.Diff
+const (
+	DiffNew       = "new"
+	DiffUnchanged = "unchanged"
+	DiffModified  = "modified"
+)
+
+// Decision is the answer of Hooks.Review on a change
+type Decision int
+
+const (
+	ReviewApply  Decision = iota // Apply the change
+	ReviewReject                 // Leave the group as is
+	ReviewQuit                   // Stop the run, leaving the remaining groups untouched
+)
+
+// defaultPageSize is the number of assets per search page when Options.PageSize is 0
+const defaultPageSize = 1000
+
+// mutationDelay is the pause before each stack mutation, so Immich is not flooded
+const mutationDelay = 100 * time.Millisecond
+
+/**************************************************************************************************
+** Options of a run.
+**************************************************************************************************/
+type Options struct {
+	Grouping       stacker.Options        // Options of the grouping of the assets
+	ReplaceStacks  bool                   // Replace the existing stacks of the children of a group
+	OnlyNewStacks  bool                   // Leave the groups holding a stacked asset as is
+	DryRun         bool                   // Log the changes without applying them
+	Quiet          bool                   // Log the per-stack messages at debug level
+	PageSize       int                    // Assets per page of the search, 1000 when 0
+	ParentSelector stacker.ParentSelector // Picks the parent of the groups about to change, nil keeps the sorted one
+	Version        string                 // Version written in the stack markers
+}
+
+/**************************************************************************************************
+** Hooks are called by Run at each step of a run. Every hook is optional: a nil hook leaves the
+** step as Run does it alone. An error returned by a hook aborts the run and is returned as is.
+**************************************************************************************************/
+type Hooks struct {
+	// Stacks adjusts the stacks fetched from Immich before they are compared to the groups
+	Stacks func(existing map[string]utils.TStack) (map[string]utils.TStack, error)
+	// Group replaces the search and the grouping of the assets, returning the assets and their groups
+	Group func(existing map[string]utils.TStack) ([]utils.TAsset, []stacker.Stack, error)
+	// Assets filters the assets searched before they are grouped
+	Assets func(assets []utils.TAsset) ([]utils.TAsset, error)
+	// Groups filters the groups before any of them is applied
+	Groups func(assets []utils.TAsset, grouped []stacker.Stack, existing map[string]utils.TStack) ([]stacker.Stack, error)
+	// Expired tells whether the run must stop before the group at the given position
+	Expired func(i int, grouped []stacker.Stack) bool
+	// Applying is called as a group is picked up
+	Applying func(group stacker.Stack, newStackIDs []string)
+	// Skip returns a reason to leave a group as is, empty to go on
+	Skip func(group stacker.Stack) string
+	// Skipped is called for a group left as is, with one of the Skip reasons
+	Skipped func(group stacker.Stack, newStackIDs []string, reason string)
+	// Diff is called in a dry run with the outcome of each group, invalid and rejected ones aside
+	Diff func(group stacker.Stack, status string, deletedStackIDs []string)
+	// Review decides on a change before anything is modified
+	Review func(group stacker.Stack, action string) Decision
+	// BeginReplace records a replacement before the stacks merged into the new one are deleted
+	BeginReplace func(group stacker.Stack, newStackIDs []string, replaced []ReplacedStack) error
+	// FinishReplace records that a replacement begun with BeginReplace is complete
+	FinishReplace func(group stacker.Stack, newStackIDs []string)
+	// Mutation is called before the mutations of a group, and returns the function called after them
+	Mutation func(group stacker.Stack, newStackIDs []string, replaced int) func(err error)
+	// Failed is called for a group whose change failed
+	Failed func(group stacker.Stack, newStackIDs []string, err error)
+	// Applied is called for a group whose change was applied
+	Applied func(group stacker.Stack, newStackIDs []string)
+}
+
+/**************************************************************************************************
+** Result of a run.
+**************************************************************************************************/
+type Result struct {
+	Existing map[string]utils.TStack // Stacks fetched from Immich, by asset ID, as adjusted by Hooks.Stacks
+	Grouped  []stacker.Stack         // Groups of the run, with the parent picked by the selector
+	Index    *StackIndex             // Stacks as the run left them
+	Applied  [][]string              // Members of each stack created or updated, parent first
+	TimeGaps []time.Duration         // Time gaps recorded by the grouping, with Grouping.RecordTimeGaps
+	Created  int                     // Groups applied
+	Skipped  int                     // Groups left as is
+	Failed   int                     // Groups whose change failed
+}
+
+/**************************************************************************************************
+** FetchError is an error of Immich while the stacks or the assets are fetched, which leaves the
+** run nothing to work on.
+**************************************************************************************************/
+type FetchError struct {
+	err error
+}
+
+func (e *FetchError) Error() string {
+	return e.err.Error()
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.err
+}
+
+/**************************************************************************************************
+** Run fetches the stacks and the assets of Immich, groups the assets and applies the groups.
+** The groups are applied in order, each one compared against the stacks as the previous ones
+** left them. A group whose change fails is counted in the result and the run goes on, except on
+** an authentication error, which the following requests would hit as well.
+**
+** @param client - Immich client
+** @param opts - Options of the run
+** @param hooks - Hooks of the run
+** @param logger - Logger instance for output
+** @return Result - Result of the run, filled as far as it went
+** @return error - A FetchError if the stacks or the assets could not be fetched, the error of a
+**                 hook or of the grouping, or an authentication error
+**************************************************************************************************/
+func Run(client immich.ImmichClient, opts Options, hooks Hooks, logger *logrus.Logger) (Result, error) {
+	var result Result
+
+	/**********************************************************************************************
+	** Fetch the stacks, then the assets, and group them.
+	**********************************************************************************************/
+	existing, err := client.FetchAllStacks()
+	if err != nil {
+		logger.Errorf("Error fetching stacks: %v", err)
+		return result, &FetchError{err: fmt.Errorf("error fetching stacks: %w", err)}
+	}
+	if hooks.Stacks != nil {
+		if existing, err = hooks.Stacks(existing); err != nil {
+			return result, err
+		}
+	}
+	result.Existing = existing
+
+	var assets []utils.TAsset
+	var grouped []stacker.Stack
+	if hooks.Group != nil {
+		if assets, grouped, err = hooks.Group(existing); err != nil {
+			return result, err
+		}
+	} else {
+		pageSize := opts.PageSize
+		if pageSize == 0 {
+			pageSize = defaultPageSize
+		}
+		assets, err = client.SearchAssets(pageSize, existing)
+		if err != nil {
+			logger.Errorf("Error fetching assets: %v", err)
+			return result, &FetchError{err: fmt.Errorf("error fetching assets: %w", err)}
+		}
+		// Live photo videos are hidden from the search, fetch them so they can be paired with their image
+		assets = append(assets, client.FetchLivePhotoVideos(assets, existing)...)
+		if hooks.Assets != nil {
+			if assets, err = hooks.Assets(assets); err != nil {
+				return result, err
+			}
+		}
+
+		grouper := stacker.New(opts.Grouping)
+		grouped, err = grouper.Stack(assets)
+		if err != nil {
+			logger.Errorf("Error stacking assets: %v", err)
+			return result, fmt.Errorf("error stacking assets: %w", err)
+		}
+		result.TimeGaps = grouper.TimeGaps()
+	}
+	if hooks.Groups != nil {
+		if grouped, err = hooks.Groups(assets, grouped, existing); err != nil {
+			return result, err
+		}
+	}
+	result.Grouped = grouped
+
+	/**********************************************************************************************
+	** Apply the groups, each one against the stacks as the previous ones left them.
+	**********************************************************************************************/
+	r := &runner{client: client, opts: opts, hooks: hooks, logger: logger, result: &result}
+	result.Index = NewStackIndex(existing)
+	for i := range grouped {
+		// The group in flight is finished, the following ones are left to the next run
+		if hooks.Expired != nil && hooks.Expired(i, grouped) {
+			break
+		}
+		if err := r.apply(i); err != nil {
+			if errors.Is(err, errReviewQuit) {
+				break
+			}
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// errReviewQuit stops the apply loop when the review is stopped
+var errReviewQuit = errors.New("review stopped")
+
+/**************************************************************************************************
+** runner applies the groups of a run.
+**************************************************************************************************/
+type runner struct {
+	client immich.ImmichClient
+	opts   Options
+	hooks  Hooks
+	logger *logrus.Logger
+	result *Result
+}
+
+/**************************************************************************************************
+** apply compares a group against the current stacks and applies it when it changes them.
+**
+** @param i - Position of the group
+** @return error - errReviewQuit when the review is stopped, an authentication error, or nil
+**************************************************************************************************/
+func (r *runner) apply(i int) error {
+	group := &r.result.Grouped[i]
+	index := r.result.Index
+	total := len(r.result.Grouped)
+	stack := group.Members
+	index.Refresh(stack)
+	_, _, newStackIDs := ParentAndChildrenIDs(stack)
+	_, _, originalStackIDs := OriginalStackIDs(stack)
+	if r.hooks.Applying != nil {
+		r.hooks.Applying(*group, newStackIDs)
+	}
+	r.logGroup(i, total, *group)
+
+	/**********************************************************************************************
+	** Doing standard stacker checks.
+	**********************************************************************************************/
+	if !IsValidStack(newStackIDs) {
+		r.logger.Debugf("\t⚠️ Invalid stack: %s", stack[0].OriginalFileName)
+		r.skip(*group, newStackIDs, SkipInvalid)
+		return nil
+	}
+	if !NeedsStackUpdate(originalStackIDs, newStackIDs, r.opts.ReplaceStacks) {
+		r.logger.Debugf("\tℹ️ No update needed for stack: %s", stack[0].OriginalFileName)
+		r.skip(*group, newStackIDs, SkipUnchanged)
+		return nil
+	}
+	if r.opts.OnlyNewStacks && len(originalStackIDs) > 0 {
+		r.logger.Debugf("\tℹ️ ONLY_NEW_STACKS, skipping stack with stacked assets: %s", stack[0].OriginalFileName)
+		r.skip(*group, newStackIDs, SkipOnlyNew)
+		return nil
+	}
+	if r.hooks.Skip != nil {
+		if reason := r.hooks.Skip(*group); reason != "" {
+			r.skip(*group, newStackIDs, reason)
+			return nil
+		}
+	}
+	childrenWithStack, hasChildrenWithStack := ChildrenWithStack(stack)
+	if hasChildrenWithStack && !r.opts.ReplaceStacks {
+		r.logger.Debugf("\tℹ️ No replaceStacks, skipping stack: %s", stack[0].OriginalFileName)
+		r.skip(*group, newStackIDs, SkipStacked)
+		return nil
+	}
+	if r.opts.ParentSelector != nil {
+		*group = stacker.SelectParent(*group, r.opts.ParentSelector, r.logger)
+		stack = group.Members
+		_, _, newStackIDs = ParentAndChildrenIDs(stack)
+	}
+	r.logChange(i, total, stack, originalStackIDs, newStackIDs)
+
+	/**********************************************************************************************
+	** Determine action type for logging.
+	**********************************************************************************************/
+	var actionMsg string
+	if len(originalStackIDs) == 0 {
+		actionMsg = "\t🆕 Creating new stack"
+	} else if r.opts.ReplaceStacks && len(childrenWithStack) > 0 {
+		actionMsg = "\t🔄 Replacing existing stack (deleted child stacks)"
+	} else {
+		actionMsg = "\t✏️  Updating stack configuration"
+	}
+
+	/**********************************************************************************************
+	** Let the user review the change before anything is modified.
+	**********************************************************************************************/
+	if r.hooks.Review != nil {
+		switch r.hooks.Review(*group, strings.TrimSpace(actionMsg)) {
+		case ReviewReject:
+			r.result.Skipped++
+			if r.hooks.Skipped != nil {
+				r.hooks.Skipped(*group, newStackIDs, SkipRejected)
+			}
+			return nil
+		case ReviewQuit:
+			r.logger.Warnf("⏹️  Review stopped, %d stacks left unprocessed", total-i)
+			return errReviewQuit
+		}
+	}
+
+	/**********************************************************************************************
+	** Replace children stacks if replaceStacks is true. The new stack is created before the old
+	** stacks are deleted, except for the ones Immich would merge into it: those are deleted
+	** first, once the replacement is recorded so an interrupted run can be repaired.
+	**********************************************************************************************/
+	var deleteFirst []ReplacedStack
+	var deleteAfter []string
+	if r.opts.ReplaceStacks {
+		deleteFirst, deleteAfter = index.ReplacedStacks(childrenWithStack, newStackIDs)
+	}
+	journaled := len(deleteFirst) > 0 && !r.opts.DryRun && r.hooks.BeginReplace != nil
+	if journaled {
+		if err := r.hooks.BeginReplace(*group, newStackIDs, deleteFirst); err != nil {
+			r.logger.Errorf("Error journaling the replacement of stack %s, leaving it as is: %v", group.Key, err)
+			r.fail(*group, newStackIDs, err)
+			return nil
+		}
+	}
+	endMutation := func(err error) {}
+	if r.hooks.Mutation != nil {
+		endMutation = r.hooks.Mutation(*group, newStackIDs, len(deleteFirst)+len(deleteAfter))
+	}
+	for _, old := range deleteFirst {
+		index.RemoveStack(old.ID)
+		if err := r.client.DeleteStack(old.ID, utils.REASON_REPLACE_CHILD_STACK_WITH_NEW_ONE); err != nil {
+			oldStack := FetchedStack(r.result.Existing, old.ID)
+			r.logger.Errorf("Error deleting stack %s: %v", old.ID, DecorateMutationError(MutationDelete, group.Key, StackParent(oldStack), oldStack.Assets, err))
+		}
+	}
+
+	r.logger.Log(r.stackLogLevel(), actionMsg)
+	if r.opts.DryRun && r.hooks.Diff != nil {
+		status := DiffModified
+		if len(originalStackIDs) == 0 {
+			status = DiffNew
+		}
+		var deletedStackIDs []string
+		if r.opts.ReplaceStacks {
+			deletedStackIDs = childrenWithStack
+		}
+		r.hooks.Diff(*group, status, deletedStackIDs)
+	}
+
+	/**********************************************************************************************
+	** Modify the stack after a little delay to avoid self-rekt.
+	**********************************************************************************************/
+	time.Sleep(mutationDelay)
+	action := MutationCreate
+	if len(originalStackIDs) > 0 {
+		action = MutationMerge
+	}
+	if err := r.client.CreateStack(newStackIDs); err != nil {
+		err = DecorateMutationError(action, group.Key, stack[0], stack, err)
+		endMutation(err)
+		r.fail(*group, newStackIDs, err)
+		// The following stacks would fail the same way
+		if immich.IsAuthError(err) {
+			return err
+		}
+		r.logger.Errorf("Error modifying stack: %v", err)
+		if journaled {
+			r.logger.Warnf("⚠️  Replacement of stack %s left half-done, the next run or the repair command completes it", group.Key)
+		}
+		return nil
+	}
+	index.RecordCreated(newStackIDs)
+	r.result.Applied = append(r.result.Applied, newStackIDs)
+	for _, stackID := range deleteAfter {
+		// Several children can share a stack, it is deleted once
+		if index.RemoveStack(stackID) {
+			if err := r.client.DeleteStack(stackID, utils.REASON_REPLACE_CHILD_STACK_WITH_NEW_ONE); err != nil {
+				oldStack := FetchedStack(r.result.Existing, stackID)
+				r.logger.Errorf("Error deleting stack %s: %v", stackID, DecorateMutationError(MutationDelete, group.Key, StackParent(oldStack), oldStack.Assets, err))
+			}
+		}
+	}
+	endMutation(nil)
+	if journaled && r.hooks.FinishReplace != nil {
+		r.hooks.FinishReplace(*group, newStackIDs)
+	}
+	r.result.Created++
+	if r.hooks.Applied != nil {
+		r.hooks.Applied(*group, newStackIDs)
+	}
+
+	/**********************************************************************************************
+	** Mark the parent so stacks created by the tool can be identified later, and tag it if asked.
+	**********************************************************************************************/
+	parentName := stack[0].OriginalFileName
+	marker := utils.BuildStackMarker(r.opts.Version, group.Key)
+	if err := r.client.MarkStackParent(stack[0], marker); err != nil {
+		r.logger.Errorf("Error marking stack parent %s: %v", parentName, err)
+	}
+	if err := r.client.TagStackParent(stack[0]); err != nil {
+		r.logger.Errorf("Error tagging stack parent %s: %v", parentName, err)
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** skip counts a group left as is and reports it, as unchanged in the dry run diff unless it is
+** invalid.
+**
+** @param group - The group
+** @param newStackIDs - IDs of its members, parent first
+** @param reason - One of the Skip reasons
+**************************************************************************************************/
+func (r *runner) skip(group stacker.Stack, newStackIDs []string, reason string) {
+	if r.opts.DryRun && reason != SkipInvalid && r.hooks.Diff != nil {
+		r.hooks.Diff(group, DiffUnchanged, nil)
+	}
+	r.result.Skipped++
+	if r.hooks.Skipped != nil {
+		r.hooks.Skipped(group, newStackIDs, reason)
+	}
+}
+
+/**************************************************************************************************
+** fail counts a group whose change failed and reports it.
+**
+** @param group - The group
+** @param newStackIDs - IDs of its members, parent first
+** @param err - Error of the change
+**************************************************************************************************/
+func (r *runner) fail(group stacker.Stack, newStackIDs []string, err error) {
+	r.result.Failed++
+	if r.hooks.Failed != nil {
+		r.hooks.Failed(group, newStackIDs, err)
+	}
+}
+
+/**************************************************************************************************
+** stackLogLevel returns the level of the per-stack messages: debug in quiet mode, info otherwise.
+**
+** @return logrus.Level - The level
+**************************************************************************************************/
+func (r *runner) stackLogLevel() logrus.Level {
+	if r.opts.Quiet {
+		return logrus.DebugLevel
+	}
+	return logrus.InfoLevel
+}
+
+/**************************************************************************************************
+** logGroup logs a group and its members at debug level.
+**
+** @param i - Position of the group
+** @param total - Number of groups
+** @param group - The group
+**************************************************************************************************/
+func (r *runner) logGroup(i, total int, group stacker.Stack) {
+	if !r.logger.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
+	stack := group.Members
+	r.logger.Debugf("--------------------------------")
+	r.logger.Debugf("%d/%d Key: %s", i+1, total, stack[0].OriginalFileName)
+	r.logger.Debugf("\tGrouping key: %q", group.Key)
+	if group.Branch != "" {
+		r.logger.Debugf("\tBranch: %s", group.Branch)
+	}
+	if len(group.Values) > 0 {
+		r.logger.Debugf("\tCriteria values: %q", group.Values)
+	}
+	r.logMembers(logrus.DebugLevel, stack)
+}
+
+/**************************************************************************************************
+** logChange logs a group about to change at info level, unless in quiet mode or when the debug
+** logs already list it, and compares it to its current stack at debug level.
+**
+** @param i - Position of the group
+** @param total - Number of groups
+** @param stack - Members of the group, parent first
+** @param originalStackIDs - IDs of the members of its current stack
+** @param newStackIDs - IDs of its members
+**************************************************************************************************/
+func (r *runner) logChange(i, total int, stack []utils.TAsset, originalStackIDs, newStackIDs []string) {
+	if r.logger.IsLevelEnabled(logrus.DebugLevel) {
+		r.logger.Debugf("\tStack comparison:")
+		r.logger.Debugf("\t  Original: %v", originalStackIDs)
+		r.logger.Debugf("\t  Expected: %v", newStackIDs)
+		r.logger.Debugf("\t  REPLACE_STACKS: %v", r.opts.ReplaceStacks)
+		return
+	}
+	if r.opts.Quiet {
+		return
+	}
+	r.logger.Infof("--------------------------------")
+	r.logger.Infof("%d/%d Key: %s", i+1, total, stack[0].OriginalFileName)
+	r.logMembers(logrus.InfoLevel, stack)
+}
+
+/**************************************************************************************************
+** logMembers logs the parent and the children of a group.
+**
+** @param level - Level of the logs
+** @param stack - Members of the group, parent first
+**************************************************************************************************/
+func (r *runner) logMembers(level logrus.Level, stack []utils.TAsset) {
+	r.logger.WithFields(logrus.Fields{
+		"Name": stack[0].OriginalFileName,
+		"ID":   stack[0].ID,
+		"Time": stack[0].LocalDateTime,
+	}).Logf(level, "\tParent")
+	for _, child := range stack[1:] {
+		r.logger.WithFields(logrus.Fields{
+			"Name": child.OriginalFileName,
+			"ID":   child.ID,
+			"Time": child.LocalDateTime,
+		}).Logf(level, "\tChild")
+	}
+}
@@ -0,0 +1,232 @@
+package orchestrator
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/immich"
+	"github.com/majorfi/immich-stack/pkg/stacker"
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for a whole run, against a client kept in memory
+************************************************************************************************/
+
+// fakeClient serves the stacks and assets it holds and records the mutations. The methods a run
+// does not call are left to the embedded interface.
+type fakeClient struct {
+	immich.ImmichClient
+	stacks    map[string]utils.TStack
+	assets    []utils.TAsset
+	fetchErr  error
+	createErr error
+	created   [][]string
+	deleted   []string
+	markers   []string
+}
+
+func (f *fakeClient) FetchAllStacks() (map[string]utils.TStack, error) {
+	return f.stacks, f.fetchErr
+}
+
+func (f *fakeClient) SearchAssets(size int, stacksMap map[string]utils.TStack) ([]utils.TAsset, error) {
+	assets := make([]utils.TAsset, 0, len(f.assets))
+	for _, asset := range f.assets {
+		if stack, ok := stacksMap[asset.ID]; ok {
+			asset.Stack = &stack
+		}
+		assets = append(assets, asset)
+	}
+	return assets, nil
+}
+
+func (f *fakeClient) FetchLivePhotoVideos(assets []utils.TAsset, stacksMap map[string]utils.TStack) []utils.TAsset {
+	return nil
+}
+
+func (f *fakeClient) CreateStack(assetIDs []string) error {
+	if f.createErr != nil {
+		return f.createErr
+	}
+	f.created = append(f.created, assetIDs)
+	return nil
+}
+
+func (f *fakeClient) DeleteStack(stackID string, reason string) error {
+	f.deleted = append(f.deleted, stackID)
+	return nil
+}
+
+func (f *fakeClient) MarkStackParent(parent utils.TAsset, marker string) error {
+	f.markers = append(f.markers, marker)
+	return nil
+}
+
+func (f *fakeClient) TagStackParent(parent utils.TAsset) error {
+	return nil
+}
+
+func discardLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func TestRunCreatesStacks(t *testing.T) {
+	stacked := utils.TStack{ID: "s1", PrimaryAssetID: "b1", Assets: []utils.TAsset{{ID: "b1"}, {ID: "b2"}}}
+	client := &fakeClient{
+		stacks: map[string]utils.TStack{"b1": stacked, "b2": stacked},
+		assets: []utils.TAsset{
+			{ID: "a1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "a2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "b1", OriginalFileName: "IMG_0002.JPG", LocalDateTime: "2024-01-01T11:00:00Z"},
+			{ID: "b2", OriginalFileName: "IMG_0002.DNG", LocalDateTime: "2024-01-01T11:00:00Z"},
+		},
+	}
+	var skipped, applied []string
+	hooks := Hooks{
+		Skipped: func(group stacker.Stack, newStackIDs []string, reason string) { skipped = append(skipped, reason) },
+		Applied: func(group stacker.Stack, newStackIDs []string) { applied = append(applied, group.Key) },
+	}
+
+	result, err := Run(client, Options{Version: "1.0.0"}, hooks, discardLogger())
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Created)
+	assert.Equal(t, 1, result.Skipped)
+	assert.Len(t, result.Grouped, 2)
+	require.Len(t, client.created, 1)
+	assert.ElementsMatch(t, []string{"a1", "a2"}, client.created[0])
+	assert.Equal(t, client.created, result.Applied)
+	assert.Equal(t, []string{SkipUnchanged}, skipped)
+	assert.Len(t, applied, 1)
+	assert.Len(t, client.markers, 1, "the parent of the new stack is marked")
+	assert.Empty(t, client.deleted)
+	assert.NotNil(t, result.Index.StackOf("a1"), "the index knows the new stack")
+}
+
+func TestRunReplacesStacks(t *testing.T) {
+	old := utils.TStack{ID: "s1", PrimaryAssetID: "a3", Assets: []utils.TAsset{{ID: "a3"}, {ID: "a2"}}}
+	client := &fakeClient{
+		stacks: map[string]utils.TStack{"a2": old, "a3": old},
+		assets: []utils.TAsset{
+			{ID: "a1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "a2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "a3", OriginalFileName: "OTHER.JPG", LocalDateTime: "2024-01-01T12:00:00Z"},
+		},
+	}
+
+	// Without ReplaceStacks, a group the size of the stack of its child is taken as unchanged
+	var reasons []string
+	hooks := Hooks{Skipped: func(group stacker.Stack, newStackIDs []string, reason string) { reasons = append(reasons, reason) }}
+	result, err := Run(client, Options{}, hooks, discardLogger())
+	require.NoError(t, err)
+	assert.Equal(t, 0, result.Created)
+	assert.Equal(t, []string{SkipUnchanged}, reasons)
+	assert.Empty(t, client.created)
+
+	var replaced int
+	hooks.Mutation = func(group stacker.Stack, newStackIDs []string, count int) func(err error) {
+		replaced = count
+		return func(err error) { assert.NoError(t, err) }
+	}
+	result, err = Run(client, Options{ReplaceStacks: true}, hooks, discardLogger())
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Created)
+	assert.Equal(t, 1, replaced)
+	assert.Equal(t, []string{"s1"}, client.deleted, "the old stack is deleted once the new one is created")
+}
+
+func TestRunDryRunHooks(t *testing.T) {
+	client := &fakeClient{
+		stacks: map[string]utils.TStack{},
+		assets: []utils.TAsset{
+			{ID: "a1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "a2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "b1", OriginalFileName: "IMG_0002.JPG", LocalDateTime: "2024-01-01T11:00:00Z"},
+			{ID: "b2", OriginalFileName: "IMG_0002.DNG", LocalDateTime: "2024-01-01T11:00:00Z"},
+			{ID: "c1", OriginalFileName: "IMG_0003.JPG", LocalDateTime: "2024-01-01T12:00:00Z"},
+			{ID: "c2", OriginalFileName: "IMG_0003.DNG", LocalDateTime: "2024-01-01T12:00:00Z"},
+		},
+	}
+	var statuses, reasons []string
+	hooks := Hooks{
+		Assets: func(assets []utils.TAsset) ([]utils.TAsset, error) {
+			return assets[:4], nil
+		},
+		Skip: func(group stacker.Stack) string {
+			if group.Members[0].ID == "b1" || group.Members[0].ID == "b2" {
+				return "filtered"
+			}
+			return ""
+		},
+		Skipped: func(group stacker.Stack, newStackIDs []string, reason string) { reasons = append(reasons, reason) },
+		Diff: func(group stacker.Stack, status string, deletedStackIDs []string) {
+			statuses = append(statuses, status)
+		},
+	}
+
+	result, err := Run(client, Options{DryRun: true}, hooks, discardLogger())
+	require.NoError(t, err)
+	assert.Len(t, result.Grouped, 2, "the assets hook leaves out the third shot")
+	assert.Equal(t, 1, result.Created)
+	assert.Equal(t, []string{"filtered"}, reasons)
+	assert.ElementsMatch(t, []string{DiffNew, DiffUnchanged}, statuses)
+
+	// A review stopped leaves the remaining groups untouched
+	client.created = nil
+	hooks.Skip = nil
+	hooks.Review = func(group stacker.Stack, action string) Decision {
+		assert.Equal(t, "🆕 Creating new stack", action)
+		return ReviewQuit
+	}
+	result, err = Run(client, Options{}, hooks, discardLogger())
+	require.NoError(t, err)
+	assert.Equal(t, 0, result.Created)
+	assert.Empty(t, client.created)
+}
+
+func TestRunErrors(t *testing.T) {
+	client := &fakeClient{fetchErr: errors.New("connection refused")}
+	_, err := Run(client, Options{}, Hooks{}, discardLogger())
+	var fetchErr *FetchError
+	require.ErrorAs(t, err, &fetchErr)
+	assert.ErrorContains(t, err, "error fetching stacks: connection refused")
+
+	hookErr := errors.New("bad configuration")
+	client = &fakeClient{stacks: map[string]utils.TStack{}}
+	_, err = Run(client, Options{}, Hooks{Assets: func(assets []utils.TAsset) ([]utils.TAsset, error) {
+		return nil, hookErr
+	}}, discardLogger())
+	assert.Same(t, hookErr, err, "the error of a hook is returned as is")
+
+	// An authentication error stops the run, the following stacks would fail the same way
+	client = &fakeClient{
+		stacks:    map[string]utils.TStack{},
+		createErr: &immich.AuthError{StatusCode: 401, Message: "Invalid API key"},
+		assets: []utils.TAsset{
+			{ID: "a1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "a2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+			{ID: "b1", OriginalFileName: "IMG_0002.JPG", LocalDateTime: "2024-01-01T11:00:00Z"},
+			{ID: "b2", OriginalFileName: "IMG_0002.DNG", LocalDateTime: "2024-01-01T11:00:00Z"},
+		},
+	}
+	var failed []error
+	result, err := Run(client, Options{}, Hooks{Failed: func(group stacker.Stack, newStackIDs []string, err error) {
+		failed = append(failed, err)
+	}}, discardLogger())
+	assert.True(t, immich.IsAuthError(err))
+	assert.Equal(t, 1, result.Failed)
+	require.Len(t, failed, 1)
+	assert.Contains(t, failed[0].Error(), "create of stack")
+
+	// Any other error is counted and the run goes on
+	client.createErr = errors.New("server error")
+	result, err = Run(client, Options{}, Hooks{}, discardLogger())
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Failed)
+}
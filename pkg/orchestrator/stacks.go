@@ -0,0 +1,156 @@
+package orchestrator
+
+import (
+	"github.com/majorfi/immich-stack/pkg/utils"
+)
+
+/**************************************************************************************************
+** Extracts parent and child asset IDs from a stack of assets. The first asset is considered
+** the parent, while subsequent assets are treated as children. This function is used when
+** creating new stacks or modifying existing ones. The IDs keep the sorted order of the stack,
+** since Immich displays the members in the order they are submitted.
+**
+** @param stack - Array of assets to process
+** @return parentID - ID of the parent asset
+** @return childrenIDs - Array of child asset IDs
+** @return newStackIDs - Combined array of parent and child IDs
+**************************************************************************************************/
+func ParentAndChildrenIDs(stack []utils.TAsset) (string, []string, []string) {
+	parentID := stack[0].ID
+	childrenIDs := make([]string, 0, len(stack)-1)
+	seen := map[string]bool{parentID: true}
+	for _, asset := range stack[1:] {
+		if !seen[asset.ID] {
+			seen[asset.ID] = true
+			childrenIDs = append(childrenIDs, asset.ID)
+		}
+	}
+	newStackIDs := append([]string{parentID}, utils.RemoveEmptyStrings(childrenIDs)...)
+	return parentID, childrenIDs, newStackIDs
+}
+
+/**************************************************************************************************
+** Retrieves the original stack configuration from Immich for a given stack of assets.
+** This is used to compare existing stacks with proposed new configurations.
+**
+** @param stack - Array of assets to process
+** @return parentID - ID of the parent asset in existing stack
+** @return childrenIDs - Array of child asset IDs in existing stack
+** @return originalStackIDs - Combined array of existing parent and child IDs
+**************************************************************************************************/
+func OriginalStackIDs(stack []utils.TAsset) (string, []string, []string) {
+	if len(stack) == 0 {
+		return "", nil, nil
+	}
+
+	var existingStack *utils.TStack
+	for _, asset := range stack {
+		if asset.Stack != nil {
+			existingStack = asset.Stack
+			break
+		}
+	}
+
+	if existingStack == nil {
+		return "", nil, nil
+	}
+
+	parentID := existingStack.PrimaryAssetID
+
+	if len(existingStack.Assets) == 0 {
+		return parentID, nil, []string{parentID}
+	}
+
+	childrenIDs := make([]string, 0, len(existingStack.Assets)-1)
+	for _, asset := range existingStack.Assets {
+		if asset.ID != parentID {
+			childrenIDs = append(childrenIDs, asset.ID)
+		}
+	}
+
+	originalStackIDs := append([]string{parentID}, childrenIDs...)
+	return parentID, childrenIDs, originalStackIDs
+}
+
+/**************************************************************************************************
+** Validates if a proposed stack configuration is valid. A valid stack must have at least
+** one child asset and the parent asset must not be listed as a child.
+**
+** @param newStackIDs - Array of asset IDs to validate
+** @return bool - True if the stack configuration is valid
+**************************************************************************************************/
+func IsValidStack(newStackIDs []string) bool {
+	newStackIDs = utils.RemoveEmptyStrings(newStackIDs)
+	if len(newStackIDs) <= 1 {
+		return false
+	}
+	parentID := newStackIDs[0]
+	for _, childID := range newStackIDs[1:] {
+		if childID == parentID {
+			return false
+		}
+	}
+	return true
+}
+
+/**************************************************************************************************
+** Determines if a stack needs to be updated by comparing original and expected configurations.
+** Takes into account the replaceStacks flag to decide whether to force updates. The members are
+** compared as sets of IDs, so an asset listed twice never makes a stack look changed.
+**
+** @param originalStack - Array of IDs from existing stack
+** @param expectedStack - Array of IDs from proposed new stack
+** @param replaceStacks - Whether the existing stacks may be replaced
+** @return bool - True if the stack needs to be updated
+**************************************************************************************************/
+func NeedsStackUpdate(originalStack, expectedStack []string, replaceStacks bool) bool {
+	originalStack = uniqueIDs(originalStack)
+	expectedStack = uniqueIDs(expectedStack)
+	if len(expectedStack) <= 1 {
+		return false
+	}
+	if len(originalStack) != len(expectedStack) {
+		return true
+	}
+
+	if !utils.AreArraysEqual(originalStack, expectedStack) && replaceStacks {
+		return true
+	}
+	return false
+}
+
+/**************************************************************************************************
+** Returns the IDs without repetition, in the order they first appear.
+**
+** @param ids - Asset IDs
+** @return []string - The distinct IDs
+**************************************************************************************************/
+func uniqueIDs(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	unique := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+/**************************************************************************************************
+** Identifies any child assets that are already part of existing stacks. This is used to
+** prevent conflicts when creating new stacks and to handle stack replacement scenarios.
+**
+** @param stack - Array of assets to check
+** @return []string - Array of stack IDs where conflicts were found
+** @return bool - True if any conflicts were found
+**************************************************************************************************/
+func ChildrenWithStack(stack []utils.TAsset) ([]string, bool) {
+	childrenWithStack := make([]string, 0)
+	for _, asset := range stack[1:] {
+		if asset.Stack != nil {
+			childrenWithStack = append(childrenWithStack, asset.Stack.ID)
+		}
+	}
+	return childrenWithStack, len(childrenWithStack) > 0
+}
@@ -0,0 +1,190 @@
+package orchestrator
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+)
+
+/**************************************************************************************************
+** Test OriginalStackIDs function with edge cases
+**************************************************************************************************/
+func TestOriginalStackIDs(t *testing.T) {
+	tests := []struct {
+		name                string
+		stack               []utils.TAsset
+		expectedParentID    string
+		expectedChildrenIDs []string
+		expectedOriginalIDs []string
+	}{
+		{
+			name:                "Empty stack returns empty results",
+			stack:               []utils.TAsset{},
+			expectedParentID:    "",
+			expectedChildrenIDs: nil,
+			expectedOriginalIDs: nil,
+		},
+		{
+			name: "Stack with nil Stack field returns empty results",
+			stack: []utils.TAsset{
+				{ID: "asset1", Stack: nil},
+			},
+			expectedParentID:    "",
+			expectedChildrenIDs: nil,
+			expectedOriginalIDs: nil,
+		},
+		{
+			name: "Stack with empty Assets array returns only parentID",
+			stack: []utils.TAsset{
+				{
+					ID: "asset1",
+					Stack: &utils.TStack{
+						ID:             "stack1",
+						PrimaryAssetID: "parent1",
+						Assets:         []utils.TAsset{}, // Empty Assets array - the bug case
+					},
+				},
+			},
+			expectedParentID:    "parent1",
+			expectedChildrenIDs: nil,
+			expectedOriginalIDs: []string{"parent1"},
+		},
+		{
+			name: "Stack with one asset returns only parentID",
+			stack: []utils.TAsset{
+				{
+					ID: "asset1",
+					Stack: &utils.TStack{
+						ID:             "stack1",
+						PrimaryAssetID: "parent1",
+						Assets: []utils.TAsset{
+							{ID: "parent1"},
+						},
+					},
+				},
+			},
+			expectedParentID:    "parent1",
+			expectedChildrenIDs: []string{},
+			expectedOriginalIDs: []string{"parent1"},
+		},
+		{
+			name: "Stack with multiple assets returns parent and children",
+			stack: []utils.TAsset{
+				{
+					ID: "asset1",
+					Stack: &utils.TStack{
+						ID:             "stack1",
+						PrimaryAssetID: "parent1",
+						Assets: []utils.TAsset{
+							{ID: "parent1"},
+							{ID: "child1"},
+							{ID: "child2"},
+						},
+					},
+				},
+			},
+			expectedParentID:    "parent1",
+			expectedChildrenIDs: []string{"child1", "child2"},
+			expectedOriginalIDs: []string{"parent1", "child1", "child2"},
+		},
+		{
+			name: "PRIMARY BUG TEST: Parent NOT at index 0 - children derived correctly",
+			stack: []utils.TAsset{
+				{
+					ID: "asset1",
+					Stack: &utils.TStack{
+						ID:             "stack1",
+						PrimaryAssetID: "parentA",
+						Assets: []utils.TAsset{
+							{ID: "childB"},
+							{ID: "parentA"},
+							{ID: "childC"},
+						},
+					},
+				},
+			},
+			expectedParentID:    "parentA",
+			expectedChildrenIDs: []string{"childB", "childC"},
+			expectedOriginalIDs: []string{"parentA", "childB", "childC"},
+		},
+		{
+			name: "Parent at end of Assets array - children derived correctly",
+			stack: []utils.TAsset{
+				{
+					ID: "asset1",
+					Stack: &utils.TStack{
+						ID:             "stack1",
+						PrimaryAssetID: "parentC",
+						Assets: []utils.TAsset{
+							{ID: "childA"},
+							{ID: "childB"},
+							{ID: "parentC"},
+						},
+					},
+				},
+			},
+			expectedParentID:    "parentC",
+			expectedChildrenIDs: []string{"childA", "childB"},
+			expectedOriginalIDs: []string{"parentC", "childA", "childB"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parentID, childrenIDs, originalStackIDs := OriginalStackIDs(tt.stack)
+
+			if parentID != tt.expectedParentID {
+				t.Errorf("Expected parentID '%s', got '%s'", tt.expectedParentID, parentID)
+			}
+
+			if tt.expectedChildrenIDs == nil && childrenIDs != nil {
+				t.Errorf("Expected nil childrenIDs, got %v", childrenIDs)
+			} else if tt.expectedChildrenIDs != nil && childrenIDs == nil {
+				t.Errorf("Expected childrenIDs %v, got nil", tt.expectedChildrenIDs)
+			} else if len(childrenIDs) != len(tt.expectedChildrenIDs) {
+				t.Errorf("Expected %d childrenIDs, got %d", len(tt.expectedChildrenIDs), len(childrenIDs))
+			} else {
+				for i, expected := range tt.expectedChildrenIDs {
+					if childrenIDs[i] != expected {
+						t.Errorf("Expected childrenIDs[%d] to be '%s', got '%s'", i, expected, childrenIDs[i])
+					}
+				}
+			}
+
+			if tt.expectedOriginalIDs == nil && originalStackIDs != nil {
+				t.Errorf("Expected nil originalStackIDs, got %v", originalStackIDs)
+			} else if tt.expectedOriginalIDs != nil && originalStackIDs == nil {
+				t.Errorf("Expected originalStackIDs %v, got nil", tt.expectedOriginalIDs)
+			} else if len(originalStackIDs) != len(tt.expectedOriginalIDs) {
+				t.Errorf("Expected %d originalStackIDs, got %d", len(tt.expectedOriginalIDs), len(originalStackIDs))
+			} else {
+				for i, expected := range tt.expectedOriginalIDs {
+					if originalStackIDs[i] != expected {
+						t.Errorf("Expected originalStackIDs[%d] to be '%s', got '%s'", i, expected, originalStackIDs[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+/**************************************************************************************************
+** Test that an asset listed twice never makes a stack look changed
+**************************************************************************************************/
+func TestNeedsStackUpdateComparesIDSets(t *testing.T) {
+	stack := []utils.TAsset{{ID: "1"}, {ID: "2"}, {ID: "2"}, {ID: "3"}}
+	_, _, newStackIDs := ParentAndChildrenIDs(stack)
+	if !reflect.DeepEqual(newStackIDs, []string{"1", "2", "3"}) {
+		t.Errorf("Expected each member once, got %v", newStackIDs)
+	}
+	if NeedsStackUpdate([]string{"1", "2", "3"}, []string{"1", "2", "3", "2"}, false) {
+		t.Error("Expected no update for the same set of IDs")
+	}
+	if NeedsStackUpdate([]string{"3", "1", "2"}, []string{"1", "2", "3"}, true) {
+		t.Error("Expected no update for the same set of IDs in another order")
+	}
+	if !NeedsStackUpdate([]string{"1", "2", "4"}, []string{"1", "2", "3"}, true) {
+		t.Error("Expected an update for a different set of IDs")
+	}
+}
@@ -78,7 +78,7 @@ func TestBuildExpressionGroupingKey(t *testing.T) {
 				{Key: "originalFileName", Regex: &utils.TRegex{Key: "^IMG_", Index: 0}},
 				{Key: "originalFileName", Regex: &utils.TRegex{Key: "^DSC_", Index: 0}},
 			},
-			expectedKey: "originalFileName=IMG_",
+			expectedKey: "originalFileName=IMG_|", // The second branch keeps its empty part
 		},
 		{
 			name: "NOT expression - assets match but contribute no values",
@@ -111,7 +111,7 @@ func TestBuildExpressionGroupingKey(t *testing.T) {
 				{Key: "originalFileName", Regex: &utils.TRegex{Key: "normal", Index: 0}},
 				{Key: "isArchived"},
 			},
-			expectedKey: "originalFileName=normal", // NOT contributes no values
+			expectedKey: "originalFileName=normal|", // NOT contributes no values
 		},
 		{
 			name: "Asset doesn't match expression",
@@ -225,7 +225,8 @@ func TestStackByAdvanced(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			stacks, err := stackByAdvanced(tt.assets, tt.config, "", "", logger)
+			result, err := stackByAdvanced(tt.assets, tt.config, Options{Logger: logger})
+			stacks := stacksToAssets(result)
 
 			if tt.expectError && err == nil {
 				t.Errorf("Expected error but got none")
@@ -328,7 +329,8 @@ func TestStackByLegacyGroups_UnionSemantics(t *testing.T) {
 				Mode:   "advanced",
 				Groups: tt.groups,
 			}
-			stacks, err := stackByLegacyGroups(tt.assets, config, "", "", logger)
+			result, err := stackByLegacyGroups(tt.assets, config, Options{Logger: logger})
+			stacks := stacksToAssets(result)
 
 			if tt.expectError && err == nil {
 				t.Errorf("Expected error but got none")
@@ -530,7 +532,8 @@ func TestAdvancedCriteriaIntegration(t *testing.T) {
 		},
 	}
 
-	stacks, err := stackByAdvanced(assets, config, "", "", logger)
+	result, err := stackByAdvanced(assets, config, Options{Logger: logger})
+	stacks := stacksToAssets(result)
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -576,3 +579,65 @@ func TestAdvancedCriteriaIntegration(t *testing.T) {
 		t.Errorf("Expected 1 PXL stack and 1 IMG stack, got %d PXL and %d IMG", pxlCount, imgCount)
 	}
 }
+
+func TestStackByLegacyGroupsUnionMode(t *testing.T) {
+	// IMG_0001.JPG shares its filename with IMG_0001.CR3 and its time with scan.jpg, which
+	// bridges the two groups in connected mode
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+		{ID: "2", OriginalFileName: "IMG_0001.CR3", LocalDateTime: "2024-01-01T09:00:00Z"},
+		{ID: "3", OriginalFileName: "scan.jpg", LocalDateTime: "2024-01-01T10:00:00Z"},
+	}
+	config, err := getCriteriaConfig(`{"mode": "advanced", "groups": [{"operator": "OR", "criteria": [
+		{"key": "originalFileName", "split": {"delimiters": ["."], "index": 0}},
+		{"key": "localDateTime"}
+	]}]}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var logs strings.Builder
+	logger := logrus.New()
+	logger.SetOutput(&logs)
+
+	stacks, err := stackByLegacyGroups(assets, config, Options{Logger: logger})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(stacks) != 1 || len(stacks[0].Members) != 3 {
+		t.Fatalf("Expected one stack of 3 assets in connected mode, got %v", stacks)
+	}
+	if !strings.Contains(logs.String(), "stacked together through 2 different grouping keys") {
+		t.Errorf("Expected the bridged component to be logged, got %q", logs.String())
+	}
+
+	logs.Reset()
+	stacks, err = stackByLegacyGroups(assets, config, Options{Logger: logger, UnionLogSize: 3})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if strings.Contains(logs.String(), "different grouping keys") {
+		t.Errorf("Expected components up to the log size not to be logged, got %q", logs.String())
+	}
+
+	logs.Reset()
+	stacks, err = stackByLegacyGroups(assets, config, Options{Logger: logger, UnionMode: utils.UnionModeStrict})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(stacks) != 1 || len(stacks[0].Members) != 2 {
+		t.Fatalf("Expected one stack of 2 assets in strict mode, got %v", stacks)
+	}
+	for _, member := range stacks[0].Members {
+		if member.ID == "3" {
+			t.Errorf("Expected scan.jpg to be left out by the filename criterion of higher priority")
+		}
+	}
+	if !strings.Contains(logs.String(), "Union conflict: IMG_0001.JPG matched 2 grouping keys") {
+		t.Errorf("Expected the conflict to be logged, got %q", logs.String())
+	}
+
+	if _, err := New(Options{UnionMode: "loose"}).Stack(assets); err == nil || !strings.Contains(err.Error(), "unknown union mode") {
+		t.Errorf("Expected an unknown union mode error, got %v", err)
+	}
+}
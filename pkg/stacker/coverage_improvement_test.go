@@ -48,7 +48,6 @@ func TestStackBy_ErrorCases(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			t.Setenv("CRITERIA", tt.criteria)
 
 			stacks, err := StackBy(tt.assets, tt.criteria, "", "", logger)
 			if tt.expectError {
@@ -64,6 +63,51 @@ func TestStackBy_ErrorCases(t *testing.T) {
 	}
 }
 
+func TestStackBy_DuplicateAssetIDs(t *testing.T) {
+	logger := logrus.New()
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z"},
+		{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+		{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z"},
+	}
+
+	stacks, err := StackBy(assets, "", "", "", logger)
+	assert.ErrorContains(t, err, "holds asset 2 twice")
+	assert.Empty(t, stacks)
+
+	stacks, err = StackBy(assets[:2], "", "", "", logger)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.Len(t, stacks[0], 2)
+}
+
+func TestStackBy_IncompleteAssetFixture(t *testing.T) {
+	logger := logrus.New()
+	// IMG_0001.DNG is still uploading: the search lists it without checksum
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00Z", Type: "IMAGE", Checksum: "c1"},
+		{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00Z", Type: "IMAGE"},
+		{ID: "3", OriginalFileName: "IMG_0002.JPG", LocalDateTime: "2024-01-01T11:00:00Z", Type: "IMAGE", Checksum: "c3"},
+		{ID: "4", OriginalFileName: "IMG_0002.DNG", LocalDateTime: "2024-01-01T11:00:00Z", Type: "IMAGE", Checksum: "c4"},
+	}
+
+	// The grouping alone stacks it with its pair, the run leaves it out first
+	stacks, err := StackBy(assets, "", "", "", logger)
+	require.NoError(t, err)
+	require.Len(t, stacks, 2)
+
+	var complete []utils.TAsset
+	for _, asset := range assets {
+		if !utils.IsIncompleteAsset(asset) {
+			complete = append(complete, asset)
+		}
+	}
+	stacks, err = StackBy(complete, "", "", "", logger)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.ElementsMatch(t, []string{"3", "4"}, []string{stacks[0][0].ID, stacks[0][1].ID})
+}
+
 func TestStackBy_AdvancedMode(t *testing.T) {
 	logger := logrus.New()
 
@@ -87,8 +131,7 @@ func TestStackBy_AdvancedMode(t *testing.T) {
 		]
 	}`
 
-	t.Setenv("CRITERIA", criteria)
-	stacks, err := StackBy(assets, "", "", "", logger)
+	stacks, err := StackBy(assets, criteria, "", "", logger)
 	require.NoError(t, err)
 
 	// Should create stacks based on OR logic
@@ -116,8 +159,7 @@ func TestStackBy_ExpressionMode(t *testing.T) {
 		}
 	}`
 
-	t.Setenv("CRITERIA", criteria)
-	stacks, err := StackBy(assets, "", "", "", logger)
+	stacks, err := StackBy(assets, criteria, "", "", logger)
 	require.NoError(t, err)
 
 	// Should create stacks based on archived status and time grouping
@@ -288,10 +330,18 @@ func TestSplitByDelimiters_EdgeCases(t *testing.T) {
 			wantErr:    true,
 		},
 		{
-			name:       "negative index returns error",
-			input:      "part1_part2",
+			name:       "negative index counts from the end",
+			input:      "part1_part2_part3",
 			delimiters: []string{"_"},
 			index:      -1,
+			expected:   "part3",
+			wantErr:    false,
+		},
+		{
+			name:       "negative index out of range",
+			input:      "part1_part2",
+			delimiters: []string{"_"},
+			index:      -3,
 			expected:   "",
 			wantErr:    true,
 		},
@@ -342,6 +392,36 @@ func TestSplitByDelimiters_EdgeCases(t *testing.T) {
 	}
 }
 
+func TestSplitRangeByDelimiters(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		from     int
+		to       int
+		expected string
+		wantErr  bool
+	}{
+		{name: "year and month", input: "photos/2023/05/IMG_0001.jpg", from: 1, to: 2, expected: "2023/05"},
+		{name: "negative to", input: "photos/2023/05/IMG_0001.jpg", from: 0, to: -2, expected: "photos/2023/05"},
+		{name: "last two folders whatever the depth", input: "a/b/c/d/IMG_0001.jpg", from: -3, to: -2, expected: "c/d"},
+		{name: "single part", input: "photos/2023", from: 1, to: 1, expected: "2023"},
+		{name: "to out of range", input: "photos/2023", from: 0, to: 5, wantErr: true},
+		{name: "from after to", input: "photos/2023/05", from: 2, to: -3, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := splitRangeByDelimiters(tt.input, []string{"/"}, tt.from, tt.to)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, errSplitOutOfRange)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expected, result)
+			}
+		})
+	}
+}
+
 /************************************************************************************************
 ** Additional coverage for EvaluateExpression function
 ************************************************************************************************/
@@ -223,6 +223,57 @@ func TestExtractTimeWithDelta(t *testing.T) {
 	}
 }
 
+/************************************************************************************************
+** Test cases for checksum prefix grouping
+************************************************************************************************/
+func TestChecksumLengthCriteria(t *testing.T) {
+	tests := []struct {
+		name     string
+		checksum string
+		length   int
+		expected string
+		wantErr  bool
+	}{
+		{name: "missing length keeps full checksum", checksum: "q2V4YW1wbGVjaGVja3N1bQ==", length: 0, expected: "q2V4YW1wbGVjaGVja3N1bQ=="},
+		{name: "length truncates checksum", checksum: "q2V4YW1wbGVjaGVja3N1bQ==", length: 8, expected: "q2V4YW1w"},
+		{name: "length beyond checksum keeps full value", checksum: "abc", length: 16, expected: "abc"},
+		{name: "empty checksum stays empty", checksum: "", length: 8, expected: ""},
+		{name: "negative length returns error", checksum: "abc", length: -1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extractor, ok := getExtractor("checksum")
+			require.True(t, ok)
+
+			result, err := extractor(utils.TAsset{Checksum: tt.checksum}, utils.TCriteria{Key: "checksum", Length: tt.length})
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestStackByChecksumPrefix(t *testing.T) {
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.jpg", Checksum: "AAAAAAAAaaaa"},
+		{ID: "2", OriginalFileName: "copy_of_photo.jpg", Checksum: "AAAAAAAAbbbb"},
+		{ID: "3", OriginalFileName: "other.jpg", Checksum: "BBBBBBBBcccc"},
+	}
+
+	stacks, err := StackBy(assets, `[{"key":"checksum","length":8}]`, "", "", logrus.New())
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.Len(t, stacks[0], 2)
+
+	stacks, err = StackBy(assets, `[{"key":"checksum"}]`, "", "", logrus.New())
+	require.NoError(t, err)
+	assert.Len(t, stacks, 0)
+}
+
 /************************************************************************************************
 ** Test cases for time-based criteria matching with delta
 ************************************************************************************************/
@@ -359,10 +410,7 @@ func TestApplyCriteriaWithTimeDelta(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Set up test criteria in environment
-			t.Setenv("CRITERIA", mustMarshalJSON(t, tt.criteria))
-
-			groups, err := StackBy(tt.assets, "", "", "", logrus.New())
+			groups, err := StackBy(tt.assets, mustMarshalJSON(t, tt.criteria), "", "", logrus.New())
 			require.NoError(t, err)
 			assert.Equal(t, tt.want, len(groups), "Expected %d groups but got %d", tt.want, len(groups))
 
@@ -692,10 +740,7 @@ func TestApplyCriteriaWithOriginalPath(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Set up test criteria in environment
-			t.Setenv("CRITERIA", mustMarshalJSON(t, tt.criteria))
-
-			groups, err := StackBy(tt.assets, "", "", "", logrus.New())
+			groups, err := StackBy(tt.assets, mustMarshalJSON(t, tt.criteria), "", "", logrus.New())
 			require.NoError(t, err)
 			assert.Equal(t, tt.want, len(groups), "Expected %d groups but got %d", tt.want, len(groups))
 
@@ -1214,10 +1259,7 @@ func TestApplyCriteriaWithRegex(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Set up test criteria in environment
-			t.Setenv("CRITERIA", mustMarshalJSON(t, tt.criteria))
-
-			groups, err := StackBy(tt.assets, "", "", "", logrus.New())
+			groups, err := StackBy(tt.assets, mustMarshalJSON(t, tt.criteria), "", "", logrus.New())
 			require.NoError(t, err)
 			assert.Equal(t, tt.want, len(groups), "Expected %d groups but got %d", tt.want, len(groups))
 
@@ -1322,6 +1364,51 @@ func TestExtractOriginalFileNameRegexPromotion(t *testing.T) {
 			expectedProm: "",
 			wantErr:      true,
 		},
+		{
+			name:     "indices combine capture groups alongside promote_index",
+			filename: "DSC_BURST20180828114700954_E18-55_COVER.JPG",
+			criteria: utils.TCriteria{
+				Key: "originalFileName",
+				Regex: &utils.TRegex{
+					Key:          `^(DSC)_BURST(\d+)_(E(\d+-\d+))(_COVER)?\.JPG$`,
+					Indices:      []int{2, 4},
+					Joiner:       "|",
+					PromoteIndex: &promoteIndex,
+				},
+			},
+			expectedKey:  "20180828114700954|18-55",
+			expectedProm: "E18-55",
+			wantErr:      false,
+		},
+		{
+			name:     "indices with empty optional groups yield no value",
+			filename: "IMG.JPG",
+			criteria: utils.TCriteria{
+				Key: "originalFileName",
+				Regex: &utils.TRegex{
+					Key:     `^IMG(_\d+)?(_\w+)?\.JPG$`,
+					Indices: []int{1, 2},
+					Joiner:  "-",
+				},
+			},
+			expectedKey:  "",
+			expectedProm: "",
+			wantErr:      false,
+		},
+		{
+			name:     "indices out of range",
+			filename: "PXL_20230503_152823814.jpg",
+			criteria: utils.TCriteria{
+				Key: "originalFileName",
+				Regex: &utils.TRegex{
+					Key:     `PXL_(\d{8})_(\d{9})\.jpg`,
+					Indices: []int{1, 3},
+				},
+			},
+			expectedKey:  "",
+			expectedProm: "",
+			wantErr:      true,
+		},
 	}
 
 	for _, tc := range tests {
@@ -1381,12 +1468,9 @@ func TestStackByWithRegexPromotion(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Set up test criteria in environment
-			t.Setenv("CRITERIA", mustMarshalJSON(t, tt.criteria))
-
 			// Run stacking
 			logger := logrus.New()
-			stacks, err := StackBy(tt.assets, "", "", "", logger)
+			stacks, err := StackBy(tt.assets, mustMarshalJSON(t, tt.criteria), "", "", logger)
 			require.NoError(t, err)
 			require.Len(t, stacks, 1, "Expected exactly one stack")
 
@@ -1421,9 +1505,8 @@ func TestStackByWithRegexPromotion_UneditedFirst(t *testing.T) {
 	//  - Group 3: the edit token (crop|cropped|edit|edited) if present, else empty string
 	//  - Group 4: file extension
 	criteriaJSON := `[{"key":"originalFileName","regex":{"key":"^(.*?)([._-](crop|cropped|edit|edited).*)?\\.([^.]+)$","index":1,"promote_index":3,"promote_keys":["","edited","edit","cropped","crop"]}}]`
-	t.Setenv("CRITERIA", criteriaJSON)
 
-	stacks, err := StackBy(assets, "", "", "", logger)
+	stacks, err := StackBy(assets, criteriaJSON, "", "", logger)
 	require.NoError(t, err)
 	require.Len(t, stacks, 1, "Expected exactly one stack for same base name")
 
@@ -1475,7 +1558,7 @@ func TestApplyCriteriaWithPromoteMultipleRegex(t *testing.T) {
 		},
 	}
 
-	values, promoteValues, err := applyCriteriaWithPromote(asset, criteria)
+	values, promoteValues, err := applyCriteriaWithPromote(asset, criteria, nil)
 	require.NoError(t, err)
 
 	// Verify both criteria extracted values
@@ -1609,6 +1692,24 @@ func TestParseCriteria(t *testing.T) {
 			expectMode:  "expression",
 			expectError: false,
 		},
+		{
+			name:        "compare on numeric key",
+			criteria:    `[{"key":"iso","compare":{"op":"gte","value":1600}}]`,
+			expectMode:  "legacy",
+			expectError: false,
+		},
+		{
+			name:        "compare on non-numeric key returns error",
+			criteria:    `{"mode":"advanced","expression":{"criteria":{"key":"originalFileName","compare":{"op":"gte","value":1}}}}`,
+			expectMode:  "",
+			expectError: true,
+		},
+		{
+			name:        "compare with unknown operator returns error",
+			criteria:    `[{"key":"fNumber","compare":{"op":"between","value":2}}]`,
+			expectMode:  "",
+			expectError: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -1623,3 +1724,89 @@ func TestParseCriteria(t *testing.T) {
 		})
 	}
 }
+
+func TestNamedCaptureGroups(t *testing.T) {
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "PXL_20230503_152823814.jpg"},
+		{ID: "2", OriginalFileName: "PXL_20230503_152823814_MP.jpg"},
+		{ID: "3", OriginalFileName: "PXL_20230504_101010101.jpg"},
+	}
+	criteria := []string{
+		`[{"key": "originalFileName", "regex": {"key": "PXL_(?P<date>\\d{8})_\\d{9}(?P<suffix>_\\w+)?\\.jpg", "index": "date", "promote_index": "suffix", "promote_keys": ["_MP"]}}]`,
+		`[{"key": "originalFileName", "regex": {"key": "PXL_(?P<date>\\d{8})_\\d{9}(?P<suffix>_\\w+)?\\.jpg", "index": 1, "promote_index": "suffix", "promote_keys": ["_MP"]}}]`,
+		`[{"key": "originalFileName", "regex": {"key": "PXL_(?P<date>\\d{8})_\\d{9}(?P<suffix>_\\w+)?\\.jpg", "index": "date", "promote_index": 2, "promote_keys": ["_MP"]}}]`,
+		`{"mode": "advanced", "expression": {"criteria": {"key": "originalFileName", "regex": {"key": "PXL_(?P<date>\\d{8})_\\d{9}(?P<suffix>_\\w+)?\\.jpg", "index": "date", "promote_index": "suffix", "promote_keys": ["_MP"]}}}}`,
+	}
+	for _, c := range criteria {
+		stacks, err := New(Options{Criteria: c}).Stack(assets)
+		require.NoError(t, err, c)
+		assert.Equal(t, []string{"2 1,2"}, stackSignatures(stacks), c)
+	}
+
+	// An unknown name fails when the criteria are parsed, in every format
+	for _, c := range []string{
+		`[{"key": "originalFileName", "regex": {"key": "(?P<date>\\d{8})", "index": "day"}}]`,
+		`[{"key": "originalFileName", "regex": {"key": "(?P<date>\\d{8})", "promote_index": "suffix"}}]`,
+		`{"mode": "advanced", "groups": [{"operator": "AND", "criteria": [{"key": "originalFileName", "regex": {"key": "(?P<date>\\d{8})", "index": "day"}}]}]}`,
+		`{"mode": "advanced", "expression": {"criteria": {"key": "originalPath", "regex": {"key": "(?P<date>\\d{8})", "index": "day"}}}}`,
+	} {
+		_, err := ParseCriteria(c)
+		assert.ErrorContains(t, err, "has no capture group named", c)
+	}
+
+	// Names set on a criteria built in Go are resolved when it is precompiled
+	regex := &utils.TRegex{Key: `(?P<date>\d{8})_(?P<time>\d{9})`, IndexName: "time", PromoteName: "date"}
+	require.NoError(t, PrecompileRegexes([]utils.TCriteria{{Key: "originalFileName", Regex: regex}}))
+	assert.Equal(t, 2, regex.Index)
+	require.NotNil(t, regex.PromoteIndex)
+	assert.Equal(t, 1, *regex.PromoteIndex)
+}
+
+func TestRegexStripExtension(t *testing.T) {
+	regex := &utils.TRegex{Key: `^(IMG_\d+)(_edit)?$`, Index: 1}
+	for _, name := range []string{"IMG_0001.JPG", "IMG_0001.jpg", "IMG_0001_edit.HEIC"} {
+		value, _, err := extractOriginalFileName(utils.TAsset{OriginalFileName: name}, utils.TCriteria{Key: "originalFileName", Regex: regex, StripExtension: true})
+		require.NoError(t, err)
+		assert.Equal(t, "IMG_0001", value, name)
+
+		// By default the regex sees the extension, which the anchored pattern does not allow
+		value, _, err = extractOriginalFileName(utils.TAsset{OriginalFileName: name}, utils.TCriteria{Key: "originalFileName", Regex: regex})
+		require.NoError(t, err)
+		assert.Empty(t, value, name)
+	}
+
+	// A miss names the form of the name the regex was matched against
+	asset := utils.TAsset{OriginalFileName: "DSC_0001.JPG"}
+	_, _, err := applyCriteriaWithPromote(asset, []utils.TCriteria{{Key: "originalFileName", Regex: regex, StripExtension: true, OnMiss: utils.OnMissSkip}}, nil)
+	assert.ErrorIs(t, err, errMatchMiss)
+	assert.ErrorContains(t, err, "(regex matched against the file name without its extension)")
+	_, _, err = applyCriteriaWithPromote(asset, []utils.TCriteria{{Key: "originalFileName", Regex: regex, OnMiss: utils.OnMissError}}, nil)
+	assert.ErrorContains(t, err, "criteria originalFileName yielded no value (regex matched against the file name with its extension)")
+	_, _, err = applyCriteriaWithPromote(utils.TAsset{OriginalFileName: "IMG_0001.JPG"}, []utils.TCriteria{{Key: "originalFileName", Regex: &utils.TRegex{Key: `IMG_\d+`, Index: 1}, StripExtension: true}}, nil)
+	assert.ErrorContains(t, err, `out of range for "IMG_0001" (found 0 groups) (regex matched against the file name without its extension)`)
+
+	_, err = ParseCriteria(`[{"key": "originalPath", "regex": {"key": "(\\d+)", "index": 1}, "stripExtension": true}]`)
+	assert.ErrorContains(t, err, "stripExtension is only supported on the originalFileName key")
+	config, err := ParseCriteria(`[{"key": "originalFileName", "regex": {"key": "^(IMG_\\d+)$", "index": 1}, "stripExtension": true}]`)
+	require.NoError(t, err)
+	assert.True(t, config.Legacy[0].StripExtension)
+}
+
+func TestStackByNumericCompareLegacy(t *testing.T) {
+	iso := func(id string, value float64) utils.TAsset {
+		return utils.TAsset{ID: id, OriginalFileName: "NIGHT_" + id + ".jpg", LocalDateTime: "2024-01-15T22:00:00.000Z", ExifInfo: &utils.TExifInfo{ISO: &value}}
+	}
+	assets := []utils.TAsset{iso("1", 1600), iso("2", 3200), iso("3", 100), iso("4", 200)}
+	criteria := `[{"key":"iso","compare":{"op":"gte","value":1600}},{"key":"localDateTime"}]`
+
+	// Matching assets share the comparison value so varying ISO values still group together;
+	// non-matching assets lose the iso component and group on the remaining criteria
+	stacks, err := StackBy(assets, criteria, "", "", logrus.New())
+	require.NoError(t, err)
+	require.Len(t, stacks, 2)
+
+	skipped, err := New(Options{Criteria: criteria, SkipMatchMiss: true}).Stack(assets)
+	require.NoError(t, err)
+	require.Len(t, skipped, 1)
+	assert.ElementsMatch(t, []string{"1", "2"}, []string{skipped[0].Members[0].ID, skipped[0].Members[1].ID})
+}
@@ -1,6 +1,7 @@
 package stacker
 
 import (
+	"errors"
 	"fmt"
 	"sort"
 	"strings"
@@ -12,9 +13,14 @@ import (
 /**************************************************************************************************
 ** StackBy groups photos into stacks based on configured criteria.
 ** Photos that match the same criteria values are grouped together.
+** It is a thin wrapper around New(Options{...}).Stack kept for backward compatibility. The
+** promote block of an advanced criteria replaces the promote settings given here.
 **
 ** @param assets - List of assets to group into stacks
 ** @param criteria - List of criteria to use for grouping
+** @param parentFilenamePromote - Comma-separated filename substrings to promote as parent
+** @param parentExtPromote - Comma-separated extensions to promote as parent
+** @param logger - Logger for progress and debug output
 ** @return [][]Asset - List of stacks, where each stack is a list of assets
 ** @return error - Any error that occurred during stacking
 **************************************************************************************************/
@@ -23,33 +29,215 @@ func StackBy(assets []utils.TAsset, criteria string, parentFilenamePromote strin
 		return nil, nil
 	}
 
-	criteriaConfig, err := getCriteriaConfig(criteria)
+	stacks, err := New(Options{
+		Criteria:              criteria,
+		ParentFilenamePromote: parentFilenamePromote,
+		ParentExtPromote:      parentExtPromote,
+		Logger:                logger,
+	}).Stack(assets)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUniqueMembers(stacks); err != nil {
+		return nil, err
+	}
+	return stacksToAssets(stacks), nil
+}
+
+/**************************************************************************************************
+** checkUniqueMembers makes sure no stack holds the same asset twice, which Immich rejects when
+** the stack is created. An asset given twice to the stacker would end up twice in its stack.
+** Assets without an ID, which cannot be stacked, are not checked.
+**
+** @param stacks - Stacks to check
+** @return error - The first stack holding an asset twice, or nil
+**************************************************************************************************/
+func checkUniqueMembers(stacks []Stack) error {
+	for _, stack := range stacks {
+		ids := make(map[string]bool, len(stack.Members))
+		for _, member := range stack.Members {
+			if member.ID == "" {
+				continue
+			}
+			if ids[member.ID] {
+				return fmt.Errorf("stack %q holds asset %s twice", stack.Key, member.ID)
+			}
+			ids[member.ID] = true
+		}
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** Stack groups the assets into stacks according to the stacker options.
+**
+** @param assets - List of assets to group into stacks
+** @return []Stack - Stacks with their parent, members and grouping key
+** @return error - Any error that occurred during stacking
+**************************************************************************************************/
+func (s *Stacker) Stack(assets []utils.TAsset) ([]Stack, error) {
+	if len(assets) == 0 {
+		return nil, nil
+	}
+	criteriaConfig, err := getCriteriaConfig(s.opts.Criteria)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get criteria config: %w", err)
 	}
+	// The promote block of the run also applies to the profiles grouping with its criteria
+	s.opts = withCriteriaPromote(s.opts, criteriaConfig.Promote)
+	if len(s.opts.Profiles) > 0 {
+		return s.stackByProfiles(assets)
+	}
+	if s.opts.Criteria == "" && len(s.opts.Delimiters) > 0 {
+		criteriaConfig.Legacy = defaultCriteriaWithDelimiters(s.opts.Delimiters)
+	}
+	criteriaConfig = withEditedSuffixes(criteriaConfig, s.opts.EditedSuffixes)
+
+	promoteOrder, err := ParsePromoteOrder(s.opts.PromoteOrder)
+	if err != nil {
+		return nil, err
+	}
+	if !IsValidExtRankFallback(s.opts.ExtRankFallback) {
+		return nil, fmt.Errorf("unknown extension rank fallback %q, expected builtin, alpha or none", s.opts.ExtRankFallback)
+	}
+	promoteOrder = withExtRankFallback(promoteOrder, s.opts.ExtRankFallback)
+	if _, err := ParseExtPromote(s.opts.ParentExtPromote); err != nil {
+		return nil, err
+	}
+	if !IsValidUnionMode(s.opts.UnionMode) {
+		return nil, fmt.Errorf("unknown union mode %q, expected connected or strict", s.opts.UnionMode)
+	}
+	for _, action := range []string{s.opts.TimeSpreadAction, s.opts.FolderAction} {
+		if !IsValidSanityAction(action) {
+			return nil, fmt.Errorf("unknown sanity action %q, expected split or drop", action)
+		}
+	}
+	if !IsValidOversizePolicy(s.opts.OversizePolicy) {
+		return nil, fmt.Errorf("unknown oversize policy %q, expected skip or split", s.opts.OversizePolicy)
+	}
+	keyTemplate, err := parseKeyTemplate(s.opts.StackKeyTemplate, criteriaConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// Errors raised by a single asset exclude it instead of aborting the run
+	opts := s.opts
+	opts.promoteOrder = promoteOrder
+	opts.keyTemplate = keyTemplate
+	opts.Span = s.opts.Span.Child("group")
+	opts.Span.SetInt("assets", len(assets))
+	defer opts.Span.End()
+	opts.assetErrors = newAssetErrorTracker(opts.MaxAssetErrors, opts.Logger)
+	defer func() { s.erroredAssets = opts.assetErrors.count }()
+	if opts.RecordTimeGaps {
+		opts.timeGaps = &timeGapRecorder{}
+	}
+	defer func() { s.timeGaps = opts.timeGaps.list() }()
 
 	// Handle different criteria modes
+	var stacks []Stack
 	switch criteriaConfig.Mode {
 	case "advanced":
 		if criteriaConfig.Expression != nil {
-			return stackByAdvanced(assets, criteriaConfig, parentFilenamePromote, parentExtPromote, logger)
+			stacks, err = stackByAdvanced(assets, criteriaConfig, opts)
 		} else if len(criteriaConfig.Groups) > 0 {
-			return stackByLegacyGroups(assets, criteriaConfig, parentFilenamePromote, parentExtPromote, logger)
+			stacks, err = stackByLegacyGroups(assets, criteriaConfig, opts)
+		} else {
+			return nil, fmt.Errorf("advanced mode specified but no expression or groups provided")
 		}
-		return nil, fmt.Errorf("advanced mode specified but no expression or groups provided")
 	case "legacy":
 		fallthrough
 	default:
 		// Use legacy criteria for backward compatibility
-		return stackByLegacy(assets, criteriaConfig.Legacy, parentFilenamePromote, parentExtPromote, logger)
+		stacks, err = stackByLegacy(assets, criteriaConfig.Legacy, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if count := opts.assetErrors.count; count > 0 {
+		opts.assetErrors.logSummary()
+		opts.Logger.Warnf("⚠️  %d assets skipped because the criteria could not be applied to them", count)
+	}
+
+	// The library is an implicit part of every grouping key
+	if !opts.CrossLibraryStacking {
+		stacks = splitByLibrary(stacks, opts.Logger)
+	}
+	// So is the owner, Immich rejects a stack mixing the assets of a partner with the user's
+	if !opts.CrossOwnerStacking {
+		stacks = splitByOwner(stacks, opts.Logger)
+	}
+	// And the visibility, a stack never mixes hidden or locked assets with the timeline
+	stacks = splitByVisibility(stacks, assets, opts.Logger)
+
+	// Rules holding whatever the criteria catch a criteria grouping unrelated files
+	stacks = applySanityRules(stacks, opts)
+
+	// An image and its live photo video always belong to the same stack
+	stacks = pairLivePhotos(assets, stacks)
+
+	// Last, as the live photo videos count towards the size accepted by the server
+	stacks = enforceMaxStackSize(stacks, opts)
+	stacks = applyParentOverrides(stacks, criteriaConfig.ParentOverride, opts.Logger)
+	stacks = applyParentSelector(stacks, opts.ParentSelector, opts.Logger)
+	return keepSidecarsOffParent(stacks, opts.Logger), nil
+}
+
+/**************************************************************************************************
+** defaultCriteriaWithDelimiters returns utils.DefaultCriteria with its filename split on the
+** given delimiters instead of "~" and ".".
+**
+** @param delimiters - Configured delimiters
+** @return []utils.TCriteria - The default criteria
+**************************************************************************************************/
+func defaultCriteriaWithDelimiters(delimiters []string) []utils.TCriteria {
+	criteria := append([]utils.TCriteria(nil), utils.DefaultCriteria...)
+	for i, c := range criteria {
+		if c.Key == "originalFileName" && c.Split != nil {
+			split := *c.Split
+			split.Delimiters = delimiters
+			criteria[i].Split = &split
+		}
 	}
+	return criteria
+}
+
+/**************************************************************************************************
+** resolveDelimiters returns the delimiters configured in the options, or the ones derived from
+** the originalFileName split criteria when none are configured.
+**************************************************************************************************/
+func resolveDelimiters(opts Options, criteria []utils.TCriteria) []string {
+	if len(opts.Delimiters) > 0 {
+		return opts.Delimiters
+	}
+	return findOriginalNameDelimiters(criteria)
+}
+
+/**************************************************************************************************
+** resolveOnMiss returns the criteria with the default onMiss applied: with SkipMatchMiss, every
+** criteria without its own onMiss skips the assets it misses.
+**************************************************************************************************/
+func resolveOnMiss(opts Options, criteria []utils.TCriteria) []utils.TCriteria {
+	if !opts.SkipMatchMiss {
+		return criteria
+	}
+	resolved := make([]utils.TCriteria, len(criteria))
+	for i, c := range criteria {
+		if c.OnMiss == "" {
+			c.OnMiss = utils.OnMissSkip
+		}
+		resolved[i] = c
+	}
+	return resolved
 }
 
 /**************************************************************************************************
 ** stackByLegacy handles traditional criteria-based stacking using a simple list of criteria.
 ** This is the original stacking logic that groups assets based on matching criteria values.
 **************************************************************************************************/
-func stackByLegacy(assets []utils.TAsset, stackingCriteria []utils.TCriteria, parentFilenamePromote string, parentExtPromote string, logger *logrus.Logger) ([][]utils.TAsset, error) {
+func stackByLegacy(assets []utils.TAsset, stackingCriteria []utils.TCriteria, opts Options) ([]Stack, error) {
+	logger := opts.Logger
+
 	// Precompile regex patterns from legacy criteria
 	if err := PrecompileRegexes(stackingCriteria); err != nil {
 		return nil, fmt.Errorf("failed to precompile legacy criteria regexes: %w", err)
@@ -58,7 +246,8 @@ func stackByLegacy(assets []utils.TAsset, stackingCriteria []utils.TCriteria, pa
 	promotionMaps := buildPromotionMaps(stackingCriteria)
 
 	// Find delimiters for originalFileName criteria
-	delimiters := findOriginalNameDelimiters(stackingCriteria)
+	delimiters := resolveDelimiters(opts, stackingCriteria)
+	stackingCriteria = resolveOnMiss(opts, stackingCriteria)
 
 	// Debug logging
 	if logger.IsLevelEnabled(logrus.DebugLevel) {
@@ -67,11 +256,12 @@ func stackByLegacy(assets []utils.TAsset, stackingCriteria []utils.TCriteria, pa
 			listOfCriteria[i] = c.Key
 		}
 		logger.Debugf("Legacy criteria stacking with criteria: %s", listOfCriteria)
-		logger.Debugf("Parent filename promote: %s", parentFilenamePromote)
-		logger.Debugf("Parent extension promote: %s", parentExtPromote)
+		logger.Debugf("Parent filename promote: %s", opts.ParentFilenamePromote)
+		logger.Debugf("Parent extension promote: %s", opts.ParentExtPromote)
 		logger.Debugf("Delimiters: %v", delimiters)
 	}
 
+	assetErrs := assetErrors(opts)
 	groups := make(map[string][]utils.TAsset, len(assets)/2)
 	// Thread-safe map to store promotion data: assetID -> (criteriaKey -> promoteValue)
 	promoteData := &safePromoteData{
@@ -82,10 +272,20 @@ func stackByLegacy(assets []utils.TAsset, stackingCriteria []utils.TCriteria, pa
 	var keyBuilder strings.Builder
 	keyBuilder.Grow(512) // Pre-allocate reasonable size for keys
 
+	sampler := newCriteriaSampler(opts.DebugSample, stackingCriteria, logger)
 	for _, asset := range assets {
-		values, assetPromoteValues, err := applyCriteriaWithPromote(asset, stackingCriteria)
+		values, assetPromoteValues, err := applyCriteriaWithPromote(asset, stackingCriteria, sampler)
+		if errors.Is(err, errMatchMiss) {
+			if logger.IsLevelEnabled(logrus.DebugLevel) {
+				logger.Debugf("Skipping asset %s: %v", asset.OriginalFileName, err)
+			}
+			continue
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to apply criteria to asset %s: %w", asset.OriginalFileName, err)
+			if abortErr := assetErrs.record(asset, err); abortErr != nil {
+				return nil, abortErr
+			}
+			continue
 		}
 
 		key := buildGroupKey(values, &keyBuilder)
@@ -104,34 +304,52 @@ func stackByLegacy(assets []utils.TAsset, stackingCriteria []utils.TCriteria, pa
 			promoteData.Set(asset.ID, assetPromoteValues)
 		}
 	}
+	sampler.report()
+
+	// Skip the time buckets of bulk imports before any pairwise comparison or sort
+	groups = dropCrowdedTimeBuckets(groups, stackingCriteria, timeBucketLimit(opts), logger)
 
-	// Merge groups that should be together based on time proximity
-	groups, err := mergeTimeBasedGroups(groups, stackingCriteria)
+	// Unite the groups whose filenames only differ slightly, then those close in time
+	groups = mergeFuzzyGroups(groups, stackingCriteria, logger)
+	groups, err := mergeTimeBasedGroups(groups, stackingCriteria, opts.timeGaps)
 	if err != nil {
 		return nil, fmt.Errorf("failed to merge time-based groups: %w", err)
 	}
 
+	// Key the groups by the template last, the merges above read the raw keys
+	var keyValues map[string][]string
+	if opts.keyTemplate != nil {
+		groups, keyValues, err = applyKeyTemplate(groups, stackingCriteria, opts.keyTemplate, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Convert map to slice and sort for deterministic processing order
-	groupSlice := make([][]utils.TAsset, 0, len(groups))
-	for _, group := range groups {
+	groupKeys := make([]string, 0, len(groups))
+	for key, group := range groups {
 		if len(group) > 1 {
-			groupSlice = append(groupSlice, group)
+			groupKeys = append(groupKeys, key)
 		}
 	}
 
 	// Sort groups by first asset's filename for consistent queue positions across runs
-	sort.Slice(groupSlice, func(i, j int) bool {
-		if len(groupSlice[i]) > 0 && len(groupSlice[j]) > 0 {
-			return groupSlice[i][0].OriginalFileName < groupSlice[j][0].OriginalFileName
-		}
-		return false
+	sort.SliceStable(groupKeys, func(i, j int) bool {
+		return groups[groupKeys[i]][0].OriginalFileName < groups[groupKeys[j]][0].OriginalFileName
 	})
 
 	// Process sorted groups
-	result := make([][]utils.TAsset, 0, len(groupSlice))
-	for _, group := range groupSlice {
-		result = append(result, sortStack(group, parentFilenamePromote, parentExtPromote, delimiters, stackingCriteria, promoteData, promotionMaps))
+	sortSpan := opts.Span.Child("sort")
+	result := make([]Stack, 0, len(groupKeys))
+	for _, key := range groupKeys {
+		sorted := sortStackWithOrder(groups[key], opts.ParentFilenamePromote, opts.ParentExtPromote, delimiters, stackingCriteria, promoteData, promotionMaps, opts.promoteOrder, opts.EditedSuffixes)
+		stack := newStack(sorted, key)
+		stack.Values = keyValues[key]
+		result = append(result, stack)
+		logFormedStack(stack, logger)
 	}
+	sortSpan.SetInt("stacks", len(result))
+	sortSpan.End()
 
 	logStackingResults("Legacy criteria stacking", len(result), len(assets), logger)
 
@@ -142,7 +360,9 @@ func stackByLegacy(assets []utils.TAsset, stackingCriteria []utils.TCriteria, pa
 ** stackByAdvanced handles expression-based stacking using nested logical expressions.
 ** This allows complex AND/OR/NOT logic for advanced asset filtering and grouping.
 **************************************************************************************************/
-func stackByAdvanced(assets []utils.TAsset, config CriteriaConfig, parentFilenamePromote string, parentExtPromote string, logger *logrus.Logger) ([][]utils.TAsset, error) {
+func stackByAdvanced(assets []utils.TAsset, config CriteriaConfig, opts Options) ([]Stack, error) {
+	logger := opts.Logger
+
 	if config.Expression == nil {
 		return nil, fmt.Errorf("advanced mode requires a criteria expression")
 	}
@@ -154,8 +374,8 @@ func stackByAdvanced(assets []utils.TAsset, config CriteriaConfig, parentFilenam
 		} else {
 			logger.Debugf("Advanced criteria (groups-based) stacking with %d groups", len(config.Groups))
 		}
-		logger.Debugf("Parent filename promote: %s", parentFilenamePromote)
-		logger.Debugf("Parent extension promote: %s", parentExtPromote)
+		logger.Debugf("Parent filename promote: %s", opts.ParentFilenamePromote)
+		logger.Debugf("Parent extension promote: %s", opts.ParentExtPromote)
 	}
 
 	// Precompile regex patterns from the expression leaves to avoid first-hit compilation
@@ -170,17 +390,26 @@ func stackByAdvanced(assets []utils.TAsset, config CriteriaConfig, parentFilenam
 	promotionMaps := buildPromotionMaps(exprCriteria)
 
 	// Find delimiters for originalFileName criteria
-	delimiters := findOriginalNameDelimiters(exprCriteria)
+	delimiters := resolveDelimiters(opts, exprCriteria)
 
 	// Group assets by their expression-based grouping keys
 	stackGroups := make(map[string][]utils.TAsset)
+	branches := make(map[string]string) // Expression branch of each asset, by asset ID
 	promoteData := &safePromoteData{data: make(map[string]map[string]string)}
+	assetErrs := assetErrors(opts)
 
+	sampler := newCriteriaSampler(opts.DebugSample, exprCriteria, logger)
 	for _, asset := range assets {
+		sampler.extract(asset)
+
 		// Check if asset matches the expression
 		matches, err := EvaluateExpression(config.Expression, asset)
 		if err != nil {
-			return nil, fmt.Errorf("failed to evaluate expression for asset %s: %w", asset.OriginalFileName, err)
+			locateExpressionError(err, exprCriteria)
+			if abortErr := assetErrs.record(asset, fmt.Errorf("failed to evaluate expression: %w", err)); abortErr != nil {
+				return nil, abortErr
+			}
+			continue
 		}
 
 		if !matches {
@@ -188,37 +417,49 @@ func stackByAdvanced(assets []utils.TAsset, config CriteriaConfig, parentFilenam
 		}
 
 		// Build grouping key based on matching criteria values
-		key, err := buildExpressionGroupingKey(asset, config.Expression, exprCriteria)
+		values, err := collectMatchingCriteriaValues(asset, config.Expression, exprCriteria)
 		if err != nil {
-			return nil, fmt.Errorf("failed to build grouping key for asset %s: %w", asset.OriginalFileName, err)
+			locateExpressionError(err, exprCriteria)
+			if abortErr := assetErrs.record(asset, fmt.Errorf("failed to build grouping key: %w", err)); abortErr != nil {
+				return nil, abortErr
+			}
+			continue
 		}
 
+		key := joinExpressionKey(values, exprCriteria)
 		if key == "" {
 			continue // Skip assets with empty grouping keys
 		}
 
 		if logger.IsLevelEnabled(logrus.DebugLevel) {
-			logger.Debugf("Asset %s (%s) -> grouping key: %s", asset.OriginalFileName, asset.ID, key)
+			logger.Debugf("Asset %q (%s) -> grouping key: %q", asset.OriginalFileName, asset.ID, key)
 		}
 
-		// Add asset to the appropriate group
+		// Add asset to the appropriate group, the time-based merge may rename the group later
 		stackGroups[key] = append(stackGroups[key], asset)
+		branches[asset.ID] = describeExpressionBranch(values, exprCriteria)
 
 		// Collect promotion values for sorting within each group
-		_, promVals, _ := applyCriteriaWithPromote(asset, exprCriteria)
+		_, promVals, _ := applyCriteriaWithPromote(asset, exprCriteria, nil)
 		if len(promVals) > 0 {
 			promoteData.Set(asset.ID, promVals)
 		}
 	}
+	sampler.report()
+
+	// Skip the time buckets of bulk imports before any pairwise comparison or sort
+	stackGroups = dropCrowdedTimeBuckets(stackGroups, exprCriteria, timeBucketLimit(opts), logger)
 
-	// Merge groups that should be together based on time proximity
-	stackGroups, err := mergeTimeBasedGroups(stackGroups, exprCriteria)
+	// Unite the groups whose filenames only differ slightly, then those close in time
+	stackGroups = mergeFuzzyGroups(stackGroups, exprCriteria, logger)
+	stackGroups, err := mergeTimeBasedGroups(stackGroups, exprCriteria, opts.timeGaps)
 	if err != nil {
 		return nil, fmt.Errorf("failed to merge time-based groups: %w", err)
 	}
 
 	// Convert groups to stacks (filter out groups with < 2 assets)
-	result := make([][]utils.TAsset, 0, len(stackGroups))
+	sortSpan := opts.Span.Child("sort")
+	result := make([]Stack, 0, len(stackGroups))
 
 	for key, group := range stackGroups {
 		if len(group) < 2 {
@@ -229,13 +470,14 @@ func stackByAdvanced(assets []utils.TAsset, config CriteriaConfig, parentFilenam
 		}
 
 		// Sort the group using existing sorting pipeline
-		sorted := sortStack(group, parentFilenamePromote, parentExtPromote, delimiters, exprCriteria, promoteData, promotionMaps)
-		result = append(result, sorted)
-
-		if logger.IsLevelEnabled(logrus.DebugLevel) {
-			logger.Debugf("Formed stack with %d assets from key: %s", len(sorted), key)
-		}
+		sorted := sortStackWithOrder(group, opts.ParentFilenamePromote, opts.ParentExtPromote, delimiters, exprCriteria, promoteData, promotionMaps, opts.promoteOrder, opts.EditedSuffixes)
+		stack := newStack(sorted, key)
+		stack.Branch = branches[stack.Parent.ID]
+		result = append(result, stack)
+		logFormedStack(stack, logger)
 	}
+	sortSpan.SetInt("stacks", len(result))
+	sortSpan.End()
 
 	logStackingResults("Advanced criteria (expression-based)", len(result), len(assets), logger)
 
@@ -246,7 +488,9 @@ func stackByAdvanced(assets []utils.TAsset, config CriteriaConfig, parentFilenam
 ** stackByLegacyGroups handles group-based stacking using OR/AND logic between criteria groups.
 ** This is the intermediate complexity level between legacy and full expression-based stacking.
 **************************************************************************************************/
-func stackByLegacyGroups(assets []utils.TAsset, config CriteriaConfig, parentFilenamePromote string, parentExtPromote string, logger *logrus.Logger) ([][]utils.TAsset, error) {
+func stackByLegacyGroups(assets []utils.TAsset, config CriteriaConfig, opts Options) ([]Stack, error) {
+	logger := opts.Logger
+
 	if len(config.Groups) == 0 {
 		return nil, fmt.Errorf("groups-based mode requires at least one criteria group")
 	}
@@ -254,8 +498,8 @@ func stackByLegacyGroups(assets []utils.TAsset, config CriteriaConfig, parentFil
 	// Debug logging
 	if logger.IsLevelEnabled(logrus.DebugLevel) {
 		logger.Debugf("Advanced criteria (groups-based) stacking with %d groups", len(config.Groups))
-		logger.Debugf("Parent filename promote: %s", parentFilenamePromote)
-		logger.Debugf("Parent extension promote: %s", parentExtPromote)
+		logger.Debugf("Parent filename promote: %s", opts.ParentFilenamePromote)
+		logger.Debugf("Parent extension promote: %s", opts.ParentExtPromote)
 	}
 
 	// Precompile regex patterns from groups
@@ -270,18 +514,23 @@ func stackByLegacyGroups(assets []utils.TAsset, config CriteriaConfig, parentFil
 	promotionMaps := buildPromotionMaps(groupCriteria)
 
 	// Find delimiters for originalFileName criteria
-	delimiters := findOriginalNameDelimiters(groupCriteria)
+	delimiters := resolveDelimiters(opts, groupCriteria)
 
 	// For groups mode with OR semantics, we need to build a connectivity graph
 	// where assets are connected if they share any grouping keys from OR groups
 	assetKeys := make(map[string][]string) // assetID -> list of grouping keys
 	promoteData := &safePromoteData{data: make(map[string]map[string]string)}
 	matchingAssets := make([]utils.TAsset, 0)
+	assetErrs := assetErrors(opts)
 
+	sampler := newCriteriaSampler(opts.DebugSample, groupCriteria, logger)
 	for _, asset := range assets {
-		groupKeys, err := applyAdvancedCriteria(asset, config.Groups)
+		groupKeys, err := applyAdvancedCriteria(asset, config.Groups, sampler)
 		if err != nil {
-			return nil, fmt.Errorf("failed to apply advanced criteria to asset %s: %w", asset.OriginalFileName, err)
+			if abortErr := assetErrs.record(asset, err); abortErr != nil {
+				return nil, abortErr
+			}
+			continue
 		}
 
 		if len(groupKeys) > 0 {
@@ -293,36 +542,49 @@ func stackByLegacyGroups(assets []utils.TAsset, config CriteriaConfig, parentFil
 			}
 
 			// Record promotion values for assets that appear in any group
-			_, promVals, _ := applyCriteriaWithPromote(asset, groupCriteria)
+			_, promVals, _ := applyCriteriaWithPromote(asset, groupCriteria, nil)
 			if len(promVals) > 0 {
 				promoteData.Set(asset.ID, promVals)
 			}
 		}
 	}
+	sampler.report()
+
+	// Skip the time buckets of bulk imports before the components are built and sorted
+	matchingAssets, assetKeys = dropCrowdedGroupKeys(matchingAssets, assetKeys, config.Groups, timeBucketLimit(opts), logger)
 
 	if len(matchingAssets) == 0 {
 		logStackingResults("Advanced criteria (groups-based)", 0, len(assets), logger)
 		return nil, nil
 	}
 
+	// Strict mode keeps a single grouping key per asset, so components never bridge keys
+	componentKeys := assetKeys
+	if opts.UnionMode == utils.UnionModeStrict {
+		componentKeys = strictAssetKeys(matchingAssets, assetKeys, logger)
+	}
+
 	// Build connected components using union semantics for OR groups
-	components := buildConnectedComponents(matchingAssets, assetKeys, logger)
+	components := buildConnectedComponents(matchingAssets, componentKeys, logger)
+	logBridgedComponents(components, componentKeys, opts.UnionLogSize, logger)
 
 	// Convert components to result format and sort each component
-	result := make([][]utils.TAsset, 0, len(components))
+	sortSpan := opts.Span.Child("sort")
+	result := make([]Stack, 0, len(components))
 
 	for _, component := range components {
 		if len(component) > 1 {
-			sorted := sortStack(component, parentFilenamePromote, parentExtPromote, delimiters, groupCriteria, promoteData, promotionMaps)
-			result = append(result, sorted)
-
-			if logger.IsLevelEnabled(logrus.DebugLevel) {
-				logger.Debugf("Formed stack with %d assets in connected component", len(sorted))
-			}
+			sorted := sortStackWithOrder(component, opts.ParentFilenamePromote, opts.ParentExtPromote, delimiters, groupCriteria, promoteData, promotionMaps, opts.promoteOrder, opts.EditedSuffixes)
+			stack := newStack(sorted, componentKeys[sorted[0].ID][0])
+			stack.Branch = describeGroupBranch(stack.Key)
+			result = append(result, stack)
+			logFormedStack(stack, logger)
 		} else if logger.IsLevelEnabled(logrus.DebugLevel) {
 			logger.Debugf("Skipping component with only 1 asset")
 		}
 	}
+	sortSpan.SetInt("stacks", len(result))
+	sortSpan.End()
 
 	logStackingResults("Advanced criteria (groups-based)", len(result), len(assets), logger)
 
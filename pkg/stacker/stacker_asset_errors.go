@@ -0,0 +1,189 @@
+package stacker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+/**************************************************************************************************
+** criterionError wraps an extractor error with the criteria that raised it, so the message
+** tells which entry of the configuration to fix.
+**************************************************************************************************/
+type criterionError struct {
+	position string          // Position of the criteria in the configuration, e.g. "#2" or "group #1 criterion #2"
+	criteria utils.TCriteria // The criteria that failed
+	err      error
+}
+
+func (e *criterionError) Error() string {
+	return fmt.Sprintf("criterion %s %s: %v", e.position, criteriaSnippet(e.criteria), e.err)
+}
+
+func (e *criterionError) Unwrap() error {
+	return e.err
+}
+
+/**************************************************************************************************
+** criteriaSnippet renders a criteria as compact JSON for error messages.
+**
+** @param c - The criteria to render
+** @return string - The JSON of the criteria
+**************************************************************************************************/
+func criteriaSnippet(c utils.TCriteria) string {
+	snippet, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Sprintf("{\"key\":%q}", c.Key)
+	}
+	return string(snippet)
+}
+
+/**************************************************************************************************
+** locateExpressionError sets the position of the failing leaf on an expression error. Leaves
+** are evaluated without knowing where they sit in the expression, so the position is the one
+** of the leaf in the flattened expression criteria.
+**
+** @param err - The error raised while evaluating the expression
+** @param exprCriteria - The criteria of the expression leaves, in order
+**************************************************************************************************/
+func locateExpressionError(err error, exprCriteria []utils.TCriteria) {
+	var critErr *criterionError
+	if !errors.As(err, &critErr) {
+		return
+	}
+	for i := range exprCriteria {
+		if reflect.DeepEqual(exprCriteria[i], critErr.criteria) {
+			critErr.position = fmt.Sprintf("#%d", i+1)
+			return
+		}
+	}
+}
+
+/**************************************************************************************************
+** assetErrorSummary counts the assets that failed the same way and keeps the first of them.
+**************************************************************************************************/
+type assetErrorSummary struct {
+	label   string // What failed, e.g. "criterion #2"
+	count   int
+	example string // First failing asset and its error
+}
+
+/**************************************************************************************************
+** assetErrorTracker isolates errors raised by a single asset while grouping. The asset is
+** excluded with a warning instead of aborting the run, unless more than max assets failed,
+** which points at a systematic problem rather than a few malformed assets. Only the first
+** failure of each criteria is logged as a warning, the others are folded into a summary line.
+**************************************************************************************************/
+type assetErrorTracker struct {
+	max       int // Maximum number of errored assets before aborting, 0 for no limit
+	count     int // Number of errored assets so far
+	logger    *logrus.Logger
+	summaries []*assetErrorSummary // In order of first failure
+}
+
+/**************************************************************************************************
+** newAssetErrorTracker creates a tracker allowing up to max errored assets.
+**
+** @param max - Maximum number of errored assets before aborting, 0 for no limit
+** @param logger - Logger for the per-asset warnings
+** @return *assetErrorTracker - The tracker
+**************************************************************************************************/
+func newAssetErrorTracker(max int, logger *logrus.Logger) *assetErrorTracker {
+	return &assetErrorTracker{max: max, logger: logger}
+}
+
+/**************************************************************************************************
+** record logs an asset error and counts it. The caller excludes the asset from grouping.
+**
+** @param asset - The asset that failed
+** @param err - The error raised by the asset
+** @return error - An error once more than max assets failed, nil otherwise
+**************************************************************************************************/
+func (t *assetErrorTracker) record(asset utils.TAsset, err error) error {
+	t.count++
+
+	label := "criteria"
+	var critErr *criterionError
+	if errors.As(err, &critErr) {
+		label = "criterion " + critErr.position
+	}
+	summary := t.summary(label)
+	summary.count++
+
+	fields := logrus.Fields{"assetId": asset.ID, "fileName": asset.OriginalFileName}
+	if summary.count == 1 {
+		summary.example = fmt.Sprintf("%s: %v", asset.OriginalFileName, err)
+		t.logger.WithFields(fields).Warnf("⚠️  Skipping asset %s: %v", asset.OriginalFileName, err)
+	} else if t.logger.IsLevelEnabled(logrus.DebugLevel) {
+		t.logger.WithFields(fields).Debugf("Skipping asset %s: %v", asset.OriginalFileName, err)
+	}
+
+	if t.max > 0 && t.count > t.max {
+		return fmt.Errorf("more than %d assets failed to apply the criteria, last error on %s: %w", t.max, asset.OriginalFileName, err)
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** summary returns the summary of a label, creating it on first use.
+**************************************************************************************************/
+func (t *assetErrorTracker) summary(label string) *assetErrorSummary {
+	for _, summary := range t.summaries {
+		if summary.label == label {
+			return summary
+		}
+	}
+	summary := &assetErrorSummary{label: label}
+	t.summaries = append(t.summaries, summary)
+	return summary
+}
+
+/**************************************************************************************************
+** logSummary logs one line per criteria that failed for more than one asset, replacing the
+** warnings that were not logged for each of them.
+**************************************************************************************************/
+func (t *assetErrorTracker) logSummary() {
+	for _, summary := range t.summaries {
+		if summary.count > 1 {
+			t.logger.Warnf("⚠️  %s failed for %s assets, first example: %s", summary.label, formatCount(summary.count), summary.example)
+		}
+	}
+}
+
+/**************************************************************************************************
+** formatCount formats a count with thousands separators, e.g. 8421 as "8,421".
+**
+** @param n - The count to format
+** @return string - The formatted count
+**************************************************************************************************/
+func formatCount(n int) string {
+	digits := strconv.Itoa(n)
+	var out strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			out.WriteByte(',')
+		}
+		out.WriteRune(digit)
+	}
+	return out.String()
+}
+
+/**************************************************************************************************
+** assetErrors returns the tracker shared by the grouping modes, creating one without limit when
+** the mode is called directly.
+**
+** @param opts - Stacking options
+** @return *assetErrorTracker - The tracker
+**************************************************************************************************/
+func assetErrors(opts Options) *assetErrorTracker {
+	if opts.assetErrors != nil {
+		return opts.assetErrors
+	}
+	return newAssetErrorTracker(opts.MaxAssetErrors, opts.Logger)
+}
@@ -0,0 +1,227 @@
+package stacker
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Test cases for per-asset error isolation during grouping
+************************************************************************************************/
+
+func TestAssetErrorIsolation(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00.000Z"},
+		{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00.000Z"},
+		{ID: "3", OriginalFileName: "IMG_0002.JPG", LocalDateTime: "not a date"},
+		{ID: "4", OriginalFileName: "IMG_0002.DNG", LocalDateTime: "2024-13-45"},
+	}
+
+	modes := []struct {
+		name     string
+		criteria string
+	}{
+		{
+			name:     "legacy",
+			criteria: `[{"key":"originalFileName","split":{"delimiters":["."],"index":0}},{"key":"localDateTime"}]`,
+		},
+		{
+			name:     "advanced groups",
+			criteria: `{"mode":"advanced","groups":[{"operator":"AND","criteria":[{"key":"originalFileName","split":{"delimiters":["."],"index":0}},{"key":"localDateTime"}]}]}`,
+		},
+		{
+			name:     "advanced expression",
+			criteria: `{"mode":"advanced","expression":{"operator":"AND","children":[{"criteria":{"key":"originalFileName","split":{"delimiters":["."],"index":0}}},{"criteria":{"key":"localDateTime"}}]}}`,
+		},
+	}
+
+	for _, mode := range modes {
+		t.Run(mode.name+" skips errored assets", func(t *testing.T) {
+			s := New(Options{Criteria: mode.criteria, Logger: logger})
+			stacks, err := s.Stack(assets)
+			require.NoError(t, err)
+			require.Len(t, stacks, 1)
+			assert.ElementsMatch(t, []string{"1", "2"}, stackMemberIDs(stacks[0]))
+			assert.Equal(t, 2, s.ErroredAssets())
+		})
+
+		t.Run(mode.name+" aborts above MaxAssetErrors", func(t *testing.T) {
+			s := New(Options{Criteria: mode.criteria, MaxAssetErrors: 1, Logger: logger})
+			stacks, err := s.Stack(assets)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "more than 1 assets failed")
+			assert.Nil(t, stacks)
+		})
+
+		t.Run(mode.name+" does not abort at MaxAssetErrors", func(t *testing.T) {
+			s := New(Options{Criteria: mode.criteria, MaxAssetErrors: 2, Logger: logger})
+			stacks, err := s.Stack(assets)
+			require.NoError(t, err)
+			assert.Len(t, stacks, 1)
+		})
+	}
+}
+
+func TestCriteriaConfigErrorsAbort(t *testing.T) {
+	assets := []utils.TAsset{{ID: "1", OriginalFileName: "IMG_0001.JPG"}}
+
+	tests := []struct {
+		name      string
+		criteria  string
+		errorPart string
+	}{
+		{
+			name:      "unknown key",
+			criteria:  `[{"key":"unknownKey"}]`,
+			errorPart: "unknown criteria key: unknownKey",
+		},
+		{
+			name:      "invalid regex",
+			criteria:  `[{"key":"originalFileName","regex":{"key":"[invalid"}}]`,
+			errorPart: "failed to compile regex",
+		},
+		{
+			name:      "regex index without capture group",
+			criteria:  `[{"key":"originalFileName","regex":{"key":"IMG_\\d+","index":1}}]`,
+			errorPart: "capture group index 1 out of range",
+		},
+		{
+			name:      "regex indices without capture group",
+			criteria:  `[{"key":"originalFileName","regex":{"key":"IMG_(\\d+)","indices":[1,2]}}]`,
+			errorPart: "capture group index 2 out of range",
+		},
+		{
+			name:      "split range from after to",
+			criteria:  `[{"key":"originalPath","split":{"delimiters":["/"],"from":3,"to":1}}]`,
+			errorPart: "split range from 3 is after to 1",
+		},
+		{
+			name:      "fallback on a non time key",
+			criteria:  `[{"key":"localDateTime","fallbackKeys":["originalFileName"]}]`,
+			errorPart: "is not a time field",
+		},
+		{
+			name:      "unknown key inside an expression",
+			criteria:  `{"mode":"advanced","expression":{"operator":"OR","children":[{"criteria":{"key":"nope"}}]}}`,
+			errorPart: "unknown criteria key: nope",
+		},
+		{
+			name:      "NOT with two children",
+			criteria:  `{"mode":"advanced","expression":{"operator":"NOT","children":[{"criteria":{"key":"originalFileName"}},{"criteria":{"key":"localDateTime"}}]}}`,
+			errorPart: "NOT operator requires exactly one child",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(Options{Criteria: tt.criteria}).Stack(assets)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.errorPart)
+		})
+	}
+}
+
+func TestCriterionErrorMessages(t *testing.T) {
+	split := `{"key":"originalFileName","split":{"delimiters":["_"],"index":2}}`
+	asset := utils.TAsset{ID: "1", OriginalFileName: "IMG.jpg", LocalDateTime: "2024-01-01T10:00:00.000Z"}
+
+	tests := []struct {
+		name     string
+		criteria string
+		position string
+	}{
+		{
+			name:     "legacy",
+			criteria: `[{"key":"localDateTime"},` + split + `]`,
+			position: "criterion #2 ",
+		},
+		{
+			name:     "advanced groups",
+			criteria: `{"mode":"advanced","groups":[{"operator":"AND","criteria":[{"key":"localDateTime"},` + split + `]}]}`,
+			position: "criterion group #1 criterion #2 ",
+		},
+		{
+			name:     "advanced expression",
+			criteria: `{"mode":"advanced","expression":{"operator":"AND","children":[{"criteria":{"key":"localDateTime"}},{"criteria":` + split + `}]}}`,
+			position: "criterion #2 ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			logger := logrus.New()
+			logger.SetOutput(&out)
+			logger.SetFormatter(&logrus.TextFormatter{DisableQuote: true})
+
+			_, err := New(Options{Criteria: tt.criteria, Logger: logger}).Stack([]utils.TAsset{asset})
+			require.NoError(t, err)
+			assert.Contains(t, out.String(), tt.position+split)
+			assert.Contains(t, out.String(), `split index 2 out of range for "IMG"`)
+		})
+	}
+}
+
+func TestSplitOutOfRangeOnMiss(t *testing.T) {
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG", OriginalPath: "/photos/2023/05/IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00.000Z"},
+		{ID: "2", OriginalFileName: "IMG_0001.DNG", OriginalPath: "/photos/2023/05/IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:00.000Z"},
+		{ID: "3", OriginalFileName: "IMG_0002.JPG", OriginalPath: "/IMG_0002.JPG", LocalDateTime: "2024-01-01T11:00:00.000Z"},
+		{ID: "4", OriginalFileName: "IMG_0002.DNG", OriginalPath: "/IMG_0002.DNG", LocalDateTime: "2024-01-01T11:00:00.000Z"},
+	}
+	split := `{"key":"originalPath","split":{"delimiters":["/"],"from":2,"to":3}%s},{"key":"originalFileName","split":{"delimiters":["."],"index":0}}`
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	s := New(Options{Criteria: "[" + fmt.Sprintf(split, "") + "]", Logger: logger})
+	stacks, err := s.Stack(assets)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.Equal(t, 2, s.ErroredAssets(), "a split out of range is an error by default")
+
+	s = New(Options{Criteria: "[" + fmt.Sprintf(split, `,"onMiss":"skip"`) + "]", Logger: logger})
+	stacks, err = s.Stack(assets)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.Equal(t, 0, s.ErroredAssets(), "with onMiss skip the assets are left out")
+	assert.Contains(t, stacks[0].Key, "2023/05")
+}
+
+func TestAssetErrorSummary(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	logger.SetFormatter(&logrus.TextFormatter{DisableQuote: true})
+
+	assets := make([]utils.TAsset, 0, 1200)
+	for i := 0; i < 1200; i++ {
+		assets = append(assets, utils.TAsset{ID: fmt.Sprint(i), OriginalFileName: fmt.Sprintf("IMG%d.jpg", i)})
+	}
+	criteria := `[{"key":"originalFileName","split":{"delimiters":["_"],"index":1}}]`
+
+	s := New(Options{Criteria: criteria, Logger: logger})
+	_, err := s.Stack(assets)
+	require.NoError(t, err)
+	assert.Equal(t, 1200, s.ErroredAssets())
+
+	assert.Equal(t, 1, strings.Count(out.String(), "Skipping asset"), "only the first failure is logged as a warning")
+	assert.Contains(t, out.String(), "criterion #1 failed for 1,200 assets, first example: IMG0.jpg: ")
+}
+
+func TestFormatCount(t *testing.T) {
+	assert.Equal(t, "0", formatCount(0))
+	assert.Equal(t, "999", formatCount(999))
+	assert.Equal(t, "1,000", formatCount(1000))
+	assert.Equal(t, "8,421", formatCount(8421))
+	assert.Equal(t, "1,234,567", formatCount(1234567))
+}
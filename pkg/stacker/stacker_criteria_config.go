@@ -3,7 +3,7 @@ package stacker
 import (
 	"encoding/json"
 	"fmt"
-	"os"
+	"strings"
 
 	"github.com/majorfi/immich-stack/pkg/utils"
 )
@@ -17,24 +17,23 @@ type CriteriaConfig struct {
 	Groups     []utils.TCriteriaGroup     // Criteria groups for stacking (legacy)
 	Legacy     []utils.TCriteria          // Legacy format for backward compatibility
 	Expression *utils.TCriteriaExpression // New nested expression format
+	// Grouping key regex → parent filename regex, applied after the stacks are formed
+	ParentOverride map[string]string
+	// Promote settings replacing those of the options, nil when the criteria has none
+	Promote *utils.TPromote
 }
 
 /**************************************************************************************************
 ** getCriteriaConfig parses the provided criteria string and returns the configuration.
-** If the criteria string is empty, it falls back to the CRITERIA environment variable.
-** If both are empty, it returns the default criteria configuration.
+** If the criteria string is empty, it returns the default criteria configuration. The
+** environment is never consulted: callers resolve the CRITERIA variable themselves.
 ** It supports both legacy array format and advanced object format.
 **
-** @param criteria - The criteria string to parse (from CLI flag or other source)
+** @param criteriaOverride - The criteria string to parse (from CLI flag or other source)
 ** @return CriteriaConfig - The processed criteria configuration
 ** @return error - An error if parsing the criteria string fails, or nil otherwise.
 **************************************************************************************************/
-func getCriteriaConfig(criteria string) (CriteriaConfig, error) {
-	criteriaOverride := criteria
-	// Fall back to environment variable if criteria parameter is empty
-	if criteriaOverride == "" {
-		criteriaOverride = os.Getenv("CRITERIA")
-	}
+func getCriteriaConfig(criteriaOverride string) (CriteriaConfig, error) {
 	if criteriaOverride == "" {
 		return CriteriaConfig{
 			Mode:   "legacy",
@@ -42,34 +41,365 @@ func getCriteriaConfig(criteria string) (CriteriaConfig, error) {
 		}, nil
 	}
 
+	var config CriteriaConfig
+
 	// First, try to parse as advanced criteria format
 	var advancedCriteria utils.TAdvancedCriteria
 	if err := json.Unmarshal([]byte(criteriaOverride), &advancedCriteria); err == nil && advancedCriteria.Mode != "" {
 		// Successfully parsed as advanced format
-		return CriteriaConfig{
-			Mode:       advancedCriteria.Mode,
-			Groups:     advancedCriteria.Groups,
-			Expression: advancedCriteria.Expression,
-		}, nil
+		config = CriteriaConfig{
+			Mode:           advancedCriteria.Mode,
+			Groups:         advancedCriteria.Groups,
+			Expression:     advancedCriteria.Expression,
+			ParentOverride: advancedCriteria.ParentOverride,
+			Promote:        advancedCriteria.Promote,
+		}
+	} else {
+		// Fallback to legacy array format
+		var legacyCriteria []utils.TCriteria
+		if err := json.Unmarshal([]byte(criteriaOverride), &legacyCriteria); err != nil {
+			return CriteriaConfig{}, fmt.Errorf("failed to parse criteria as either advanced or legacy format: %w", err)
+		}
+		config = CriteriaConfig{
+			Mode:   "legacy",
+			Legacy: legacyCriteria,
+		}
+	}
+
+	if err := validateCriteriaConfig(config); err != nil {
+		return CriteriaConfig{}, err
+	}
+	return config, nil
+}
+
+/**************************************************************************************************
+** allCriteria returns every criteria of the configuration, whatever its mode.
+**************************************************************************************************/
+func allCriteria(config CriteriaConfig) []utils.TCriteria {
+	out := append([]utils.TCriteria{}, config.Legacy...)
+	out = append(out, flattenCriteriaFromGroups(config.Groups)...)
+	return append(out, flattenCriteriaFromExpression(config.Expression)...)
+}
+
+/**************************************************************************************************
+** validateCriteriaConfig checks the configuration-level errors (unknown key, invalid regex or
+** capture group, options on the wrong key, malformed expression), so that a misconfiguration
+** fails when the criteria are parsed. Whatever fails later while grouping comes from the data
+** of a single asset and only excludes that asset.
+**
+** @param config - The parsed criteria configuration
+** @return error - An error describing the first invalid criteria, or nil
+**************************************************************************************************/
+func validateCriteriaConfig(config CriteriaConfig) error {
+	if config.Expression != nil {
+		if err := validateExpression(config.Expression); err != nil {
+			return err
+		}
+	}
+	for keyPattern, parentPattern := range config.ParentOverride {
+		if _, err := utils.RegexCompile(keyPattern); err != nil {
+			return fmt.Errorf("invalid parentOverride key regex %q: %w", keyPattern, err)
+		}
+		if _, err := utils.RegexCompile(parentPattern); err != nil {
+			return fmt.Errorf("invalid parentOverride parent regex %q for %q: %w", parentPattern, keyPattern, err)
+		}
+	}
+	if err := validatePromote(config.Promote); err != nil {
+		return err
+	}
+	for _, c := range allCriteria(config) {
+		if err := validateCriteria(c); err != nil {
+			return err
+		}
+	}
+	// In groups and expression modes a criteria without value already fails its group or leaf
+	for _, c := range allCriteria(CriteriaConfig{Groups: config.Groups, Expression: config.Expression}) {
+		if c.OnMiss != "" {
+			return fmt.Errorf("onMiss is only supported in legacy criteria, got it on %q", c.Key)
+		}
+	}
+	// The groups keys have no fixed position per criteria for the fuzzy pass to compare
+	for _, c := range flattenCriteriaFromGroups(config.Groups) {
+		if c.Fuzzy != nil {
+			return fmt.Errorf("fuzzy is not supported in the groups format, use the legacy or expression format")
+		}
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** validateCriteria checks a single criteria for configuration-level errors.
+**
+** @param c - The criteria to check
+** @return error - An error describing the problem, or nil
+**************************************************************************************************/
+func validateCriteria(c utils.TCriteria) error {
+	if _, ok := getExtractor(c.Key); !ok {
+		return fmt.Errorf("unknown criteria key: %s", c.Key)
+	}
+
+	if c.Regex != nil && c.Regex.Key != "" {
+		regex, err := utils.RegexCompile(c.Regex.Key)
+		if err != nil {
+			return fmt.Errorf("failed to compile regex %q: %w", c.Regex.Key, err)
+		}
+		if err := resolveGroupNames(c.Regex, regex); err != nil {
+			return err
+		}
+		// The capture group count is fixed by the pattern, so an out of range index would fail on every match
+		if c.Key == "originalFileName" || c.Key == "originalPath" {
+			indices := c.Regex.Indices
+			if len(indices) == 0 {
+				indices = []int{c.Regex.Index}
+			}
+			for _, index := range indices {
+				if index < 0 || index > regex.NumSubexp() {
+					return fmt.Errorf("regex capture group index %d out of range for %q (found %d groups)", index, c.Regex.Key, regex.NumSubexp())
+				}
+			}
+			if p := c.Regex.PromoteIndex; p != nil && (*p < 0 || *p > regex.NumSubexp()) {
+				return fmt.Errorf("regex promote capture group index %d out of range for %q (found %d groups)", *p, c.Regex.Key, regex.NumSubexp())
+			}
+		}
+	}
+
+	switch c.OnMiss {
+	case "", utils.OnMissGroupByOthers, utils.OnMissSkip, utils.OnMissError:
+	default:
+		return fmt.Errorf("invalid onMiss %q on %q, expected skip, group-by-others or error", c.OnMiss, c.Key)
+	}
+
+	// Indices of the same sign compare without knowing the number of parts
+	if s := c.Split; s != nil && s.From != nil && s.To != nil && (*s.From < 0) == (*s.To < 0) && *s.From > *s.To {
+		return fmt.Errorf("split range from %d is after to %d for %q", *s.From, *s.To, c.Key)
 	}
 
-	// Fallback to legacy array format
-	var legacyCriteria []utils.TCriteria
-	if err := json.Unmarshal([]byte(criteriaOverride), &legacyCriteria); err != nil {
-		return CriteriaConfig{}, fmt.Errorf("failed to parse criteria as either advanced or legacy format: %w", err)
+	if len(c.FallbackKeys) > 0 || c.MinValidDate != "" {
+		if _, err := parseMinValidDate(c.MinValidDate); err != nil {
+			return err
+		}
+		for _, key := range append([]string{c.Key}, c.FallbackKeys...) {
+			if !isTimeCriteria(key) {
+				return fmt.Errorf("fallback key %q is not a time field", key)
+			}
+		}
 	}
 
-	return CriteriaConfig{
-		Mode:   "legacy",
-		Legacy: legacyCriteria,
-	}, nil
+	if c.Value != "" {
+		if c.Key != "type" {
+			return fmt.Errorf("value is only supported on the type key, got %q", c.Key)
+		}
+		valid := false
+		for _, assetType := range assetTypes {
+			valid = valid || strings.EqualFold(c.Value, assetType)
+		}
+		if !valid {
+			return fmt.Errorf("invalid type value %q, expected image, video, audio or other", c.Value)
+		}
+	}
+
+	if c.Fuzzy != nil {
+		if c.Key != "originalFileName" {
+			return fmt.Errorf("fuzzy is only supported on the originalFileName key, got %q", c.Key)
+		}
+		if c.Fuzzy.MaxDistance < 1 {
+			return fmt.Errorf("fuzzy maxDistance must be at least 1, got %d", c.Fuzzy.MaxDistance)
+		}
+		if c.Fuzzy.MaxBucketSize < 0 {
+			return fmt.Errorf("fuzzy maxBucketSize must not be negative, got %d", c.Fuzzy.MaxBucketSize)
+		}
+	}
+
+	if c.Normalize != "" {
+		if c.Normalize != utils.NormalizeStripEditedSuffix {
+			return fmt.Errorf("invalid normalize %q on %q, expected stripEditedSuffix", c.Normalize, c.Key)
+		}
+		if c.Key != "originalFileName" {
+			return fmt.Errorf("normalize is only supported on the originalFileName key, got %q", c.Key)
+		}
+	}
+
+	if c.StripExtension && c.Key != "originalFileName" {
+		return fmt.Errorf("stripExtension is only supported on the originalFileName key, got %q", c.Key)
+	}
+
+	if c.Compare != nil {
+		if !numericFields[c.Key] {
+			return fmt.Errorf("compare is only supported on numeric keys (iso, fNumber, focalLength, fileSize), got %q", c.Key)
+		}
+		if _, err := compareNumber(0, *c.Compare); err != nil {
+			return fmt.Errorf("invalid compare on %q: %w", c.Key, err)
+		}
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** validateExpression checks the structure of an expression tree: every node is either a leaf
+** with criteria or a known operator with children, NOT has exactly one child, and the key
+** contributions are known.
+**
+** @param expr - The expression to check
+** @return error - An error describing the first malformed node, or nil
+**************************************************************************************************/
+func validateExpression(expr *utils.TCriteriaExpression) error {
+	switch expr.KeyContribution {
+	case "", utils.KeyContributionValue, utils.KeyContributionNone:
+	default:
+		return fmt.Errorf("invalid keyContribution %q, expected value or none", expr.KeyContribution)
+	}
+	if expr.Criteria != nil {
+		return nil
+	}
+	if expr.Operator == nil {
+		return fmt.Errorf("expression must have either criteria or operator")
+	}
+	if len(expr.Children) == 0 {
+		return fmt.Errorf("operator expression must have children")
+	}
+	switch *expr.Operator {
+	case "AND", "OR":
+	case "NOT":
+		if len(expr.Children) != 1 {
+			return fmt.Errorf("NOT operator requires exactly one child")
+		}
+	default:
+		return fmt.Errorf("unknown operator: %s", *expr.Operator)
+	}
+	for i := range expr.Children {
+		if err := validateExpression(&expr.Children[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** RequiresExif reports whether the configuration uses EXIF metadata, through the "rating"
+** promote keyword or numeric EXIF criteria keys, so the fetch layer only requests it when
+** necessary. Invalid criteria report false; the parse error surfaces when stacking.
+**
+** @param parentFilenamePromote - Comma-separated list of filename promote entries
+** @param criteria - The criteria string
+** @return bool - True if EXIF metadata must be fetched
+**************************************************************************************************/
+func RequiresExif(parentFilenamePromote string, criteria string) bool {
+	if utils.Contains(parsePromoteList(parentFilenamePromote), "rating") {
+		return true
+	}
+	config, err := getCriteriaConfig(criteria)
+	if err != nil {
+		return false
+	}
+	for _, c := range allCriteria(config) {
+		if numericFields[c.Key] {
+			return true
+		}
+	}
+	return false
+}
+
+/**************************************************************************************************
+** validatePromote checks the promote block of the criteria. Its lists are joined into the
+** comma-separated promote settings, so an entry cannot hold a comma.
+**
+** @param promote - The promote block, or nil
+** @return error - An error describing the first invalid entry, or nil
+**************************************************************************************************/
+func validatePromote(promote *utils.TPromote) error {
+	if promote == nil {
+		return nil
+	}
+	for _, entry := range append(append([]string{}, promote.Filename...), promote.Ext...) {
+		if strings.Contains(entry, ",") {
+			return fmt.Errorf("invalid promote entry %q: it cannot hold a comma", entry)
+		}
+	}
+	if _, err := ParseExtPromote(strings.Join(promote.Ext, ",")); err != nil {
+		return fmt.Errorf("invalid promote ext: %w", err)
+	}
+	for _, delimiter := range promote.Delimiters {
+		if delimiter == "" {
+			return fmt.Errorf("invalid promote delimiters: empty delimiter")
+		}
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** withCriteriaPromote returns the options with the promote block of the criteria applied over
+** their promote settings and delimiters. The options are returned as they are when the block was
+** already resolved by the caller, such as the CLI putting its flags ahead of it.
+**
+** @param opts - Options of the run
+** @param promote - The promote block of the criteria, or nil
+** @return Options - The options with PromoteResolved set
+**************************************************************************************************/
+func withCriteriaPromote(opts Options, promote *utils.TPromote) Options {
+	if opts.PromoteResolved {
+		return opts
+	}
+	opts.PromoteResolved = true
+	if promote == nil {
+		return opts
+	}
+	if len(promote.Filename) > 0 {
+		opts.ParentFilenamePromote = strings.Join(promote.Filename, ",")
+	}
+	if len(promote.Ext) > 0 {
+		opts.ParentExtPromote = strings.Join(promote.Ext, ",")
+	}
+	if len(promote.Delimiters) > 0 {
+		opts.Delimiters = promote.Delimiters
+	}
+	return opts
 }
 
 /**************************************************************************************************
 ** ParseCriteria is a small public wrapper around getCriteriaConfig for testing and callers
-** that need to parse a criteria string directly. It honors the provided string and falls
-** back to the CRITERIA environment variable only when the string is empty.
+** that need to parse a criteria string directly. An empty string yields the default criteria.
 **************************************************************************************************/
 func ParseCriteria(criteria string) (CriteriaConfig, error) {
 	return getCriteriaConfig(criteria)
 }
+
+/**************************************************************************************************
+** ParseDelimiters parses the comma-separated DELIMITERS list. A backslash escapes a literal comma
+** or backslash, so `\,,-` is a comma and a dash. Spaces are kept, as a space can be a delimiter.
+**
+** @param value - Comma-separated delimiters
+** @return []string - The delimiters, or nil when the value is empty
+** @return error - An error for an empty delimiter or a trailing backslash
+**************************************************************************************************/
+func ParseDelimiters(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var delimiters []string
+	var current strings.Builder
+	escaped := false
+	for _, r := range value {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ',':
+			delimiters = append(delimiters, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("delimiters %q end with an escaping backslash", value)
+	}
+	delimiters = append(delimiters, current.String())
+	for i, delimiter := range delimiters {
+		if delimiter == "" {
+			return nil, fmt.Errorf("delimiter %d of %q is empty", i+1, value)
+		}
+	}
+	return delimiters, nil
+}
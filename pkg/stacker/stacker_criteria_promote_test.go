@@ -0,0 +1,107 @@
+package stacker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the promote block of the criteria
+************************************************************************************************/
+
+func TestCriteriaPromoteBlock(t *testing.T) {
+	now := time.Now().Format(time.RFC3339)
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: now},
+		{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: now},
+		{ID: "3", OriginalFileName: "IMG_0001_edit.JPG", LocalDateTime: now},
+	}
+	groups := `"groups": [{"operator": "AND", "criteria": [{"key": "originalFileName", "split": {"delimiters": ["_edit", "."], "index": 0}}]}]`
+	criteria := `{"mode": "advanced", ` + groups + `, "promote": {"filename": ["nothing"], "ext": [".dng"], "delimiters": ["-"]}}`
+
+	config, err := ParseCriteria(criteria)
+	require.NoError(t, err)
+	require.NotNil(t, config.Promote)
+	assert.Equal(t, []string{"nothing"}, config.Promote.Filename)
+	assert.Equal(t, []string{".dng"}, config.Promote.Ext)
+	assert.Equal(t, []string{"-"}, config.Promote.Delimiters)
+
+	parent := func(opts Options) string {
+		opts.Logger = logrus.New()
+		stacks, err := New(opts).Stack(assets)
+		require.NoError(t, err)
+		require.Len(t, stacks, 1)
+		return stacks[0].Parent.OriginalFileName
+	}
+	assert.Equal(t, "IMG_0001_edit.JPG", parent(Options{Criteria: `{"mode": "advanced", ` + groups + `}`, ParentFilenamePromote: "edit", ParentExtPromote: ".jpg"}))
+	assert.Equal(t, "IMG_0001.DNG", parent(Options{Criteria: criteria, ParentFilenamePromote: "edit", ParentExtPromote: ".jpg"}), "the block replaces the options")
+	assert.Equal(t, "IMG_0001_edit.JPG", parent(Options{Criteria: criteria, ParentFilenamePromote: "edit", ParentExtPromote: ".jpg", PromoteResolved: true}), "a resolved block is not applied again")
+
+	// A list left out keeps the setting of the options
+	extOnly := `{"mode": "advanced", ` + groups + `, "promote": {"ext": [".dng"]}}`
+	assert.Equal(t, "IMG_0001_edit.JPG", parent(Options{Criteria: extOnly, ParentFilenamePromote: "edit", ParentExtPromote: ".jpg"}))
+
+	stacks, err := StackBy(assets, criteria, "edit", ".jpg", logrus.New())
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.Equal(t, "IMG_0001.DNG", stacks[0][0].OriginalFileName, "StackBy goes through the block too")
+
+	_, delimiters, err := EffectiveCriteria(Options{Criteria: criteria, Delimiters: []string{"~"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-"}, delimiters)
+	_, delimiters, err = EffectiveCriteria(Options{Criteria: criteria, Delimiters: []string{"~"}, PromoteResolved: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"~"}, delimiters)
+
+	for block, message := range map[string]string{
+		`{"ext": ["@nope"]}`:         "invalid promote ext",
+		`{"filename": ["a,b"]}`:      "cannot hold a comma",
+		`{"delimiters": ["-", ""]}`:  "empty delimiter",
+		`{"ext": [".jpg", ".d,ng"]}`: "cannot hold a comma",
+	} {
+		_, err := ParseCriteria(`{"mode": "advanced", ` + groups + `, "promote": ` + block + `}`)
+		assert.ErrorContains(t, err, message, block)
+	}
+}
+
+func TestCriteriaPromoteBlockInProfiles(t *testing.T) {
+	now := time.Now().Format(time.RFC3339)
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG", OriginalPath: "/phone/IMG_0001.JPG", LocalDateTime: now},
+		{ID: "2", OriginalFileName: "IMG_0001.DNG", OriginalPath: "/phone/IMG_0001.DNG", LocalDateTime: now},
+		{ID: "3", OriginalFileName: "SCAN_0001.JPG", OriginalPath: "/scans/SCAN_0001.JPG", LocalDateTime: now},
+		{ID: "4", OriginalFileName: "SCAN_0001.TIF", OriginalPath: "/scans/SCAN_0001.TIF", LocalDateTime: now},
+		{ID: "5", OriginalFileName: "DSC_0001.JPG", OriginalPath: "/camera/DSC_0001.JPG", LocalDateTime: now},
+		{ID: "6", OriginalFileName: "DSC_0001.DNG", OriginalPath: "/camera/DSC_0001.DNG", LocalDateTime: now},
+	}
+	groups := `"groups": [{"operator": "AND", "criteria": [{"key": "originalFileName", "split": {"delimiters": ["."], "index": 0}}]}]`
+	profiles, err := ParseProfiles(`[
+		{"name": "phone", "selector": {"criteria": {"key": "originalPath", "regex": {"key": "^/phone/"}}}},
+		{"name": "scans", "selector": {"criteria": {"key": "originalPath", "regex": {"key": "^/scans/"}}},
+		 "criteria": {"mode": "advanced", ` + groups + `, "promote": {"ext": [".tif"]}}},
+		{"name": "camera", "selector": {"criteria": {"key": "originalPath", "regex": {"key": "^/camera/"}}},
+		 "criteria": {"mode": "advanced", ` + groups + `, "promote": {"ext": [".dng"]}}, "parentExtPromote": ".jpg"}
+	]`)
+	require.NoError(t, err)
+
+	stacks, err := New(Options{
+		Criteria:         `{"mode": "advanced", ` + groups + `, "promote": {"ext": [".dng"]}}`,
+		ParentExtPromote: ".jpg",
+		Profiles:         profiles,
+		Logger:           logrus.New(),
+	}).Stack(assets)
+	require.NoError(t, err)
+
+	parents := make(map[string]string)
+	for _, stack := range stacks {
+		parents[stack.Profile] = stack.Parent.OriginalFileName
+	}
+	assert.Equal(t, "IMG_0001.DNG", parents["phone"], "a profile without criteria follows the block of the run")
+	assert.Equal(t, "SCAN_0001.TIF", parents["scans"], "the block of the profile criteria applies to its assets")
+	assert.Equal(t, "DSC_0001.JPG", parents["camera"], "the settings of the profile come first")
+}
@@ -0,0 +1,93 @@
+package stacker
+
+import (
+	"sort"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+)
+
+/**************************************************************************************************
+** duplicateKey returns the value shared by the copies of a file uploaded twice: its checksum and
+** its filename. Assets without a checksum have no duplicate.
+**
+** @param asset - The asset
+** @return string - The duplicate key, or empty without a checksum
+**************************************************************************************************/
+func duplicateKey(asset utils.TAsset) string {
+	if asset.Checksum == "" {
+		return ""
+	}
+	return asset.Checksum + "\x00" + utils.PathBase(asset.OriginalFileName)
+}
+
+/**************************************************************************************************
+** IdenticalDuplicates returns the members of a stack that are the same file uploaded more than
+** once: same checksum and same filename. Each set is ordered by asset ID, and the sets follow the
+** order of their first member in the stack.
+**
+** @param members - Members of a stack
+** @return [][]utils.TAsset - The sets of identical duplicates, nil when there are none
+**************************************************************************************************/
+func IdenticalDuplicates(members []utils.TAsset) [][]utils.TAsset {
+	var keys []string
+	byKey := make(map[string][]utils.TAsset)
+	for _, member := range members {
+		key := duplicateKey(member)
+		if key == "" {
+			continue
+		}
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], member)
+	}
+
+	var duplicates [][]utils.TAsset
+	for _, key := range keys {
+		if copies := byKey[key]; len(copies) > 1 {
+			sort.SliceStable(copies, func(i, j int) bool { return copies[i].ID < copies[j].ID })
+			duplicates = append(duplicates, copies)
+		}
+	}
+	return duplicates
+}
+
+/**************************************************************************************************
+** keepDuplicatesAdjacent moves the identical duplicates of a sorted stack next to each other, at
+** the position of the first copy and ordered by asset ID. Rules such as the upload time can tell
+** the copies apart: without this, the copy chosen as parent would depend on them. Live photo
+** videos are left at the end of the stack.
+**
+** @param stack - Sorted stack, modified in place
+** @param livePhotoVideos - IDs of the live photo videos of the stack
+**************************************************************************************************/
+func keepDuplicatesAdjacent(stack []utils.TAsset, livePhotoVideos map[string]bool) {
+	candidates := make([]utils.TAsset, 0, len(stack))
+	for _, asset := range stack {
+		if !livePhotoVideos[asset.ID] {
+			candidates = append(candidates, asset)
+		}
+	}
+	duplicates := IdenticalDuplicates(candidates)
+	if len(duplicates) == 0 {
+		return
+	}
+	copiesByKey := make(map[string][]utils.TAsset, len(duplicates))
+	for _, copies := range duplicates {
+		copiesByKey[duplicateKey(copies[0])] = copies
+	}
+
+	sorted := make([]utils.TAsset, 0, len(stack))
+	for _, asset := range stack {
+		copies, ok := copiesByKey[duplicateKey(asset)]
+		if !ok || livePhotoVideos[asset.ID] {
+			sorted = append(sorted, asset)
+			continue
+		}
+		if copies != nil {
+			sorted = append(sorted, copies...)
+			copiesByKey[duplicateKey(asset)] = nil
+		}
+	}
+	copy(stack, sorted)
+}
@@ -0,0 +1,39 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+/************************************************************************************************
+** Tests for the copies of a same file within a stack
+************************************************************************************************/
+
+func TestIdenticalDuplicates(t *testing.T) {
+	members := []utils.TAsset{
+		{ID: "z", OriginalFileName: "IMG_0001.JPG", Checksum: "c1"},
+		{ID: "m", OriginalFileName: "IMG_0001.CR3", Checksum: "c2"},
+		{ID: "a", OriginalFileName: "IMG_0001.JPG", Checksum: "c1"},
+		{ID: "b", OriginalFileName: "IMG_0001-copy.JPG", Checksum: "c1"},
+		{ID: "x", OriginalFileName: "IMG_0001.DNG"},
+		{ID: "y", OriginalFileName: "IMG_0001.DNG"},
+	}
+	duplicates := IdenticalDuplicates(members)
+	assert.Len(t, duplicates, 1, "a renamed copy or a missing checksum is not a duplicate")
+	assert.Equal(t, []string{"a", "z"}, []string{duplicates[0][0].ID, duplicates[0][1].ID})
+	assert.Nil(t, IdenticalDuplicates(members[:2]))
+}
+
+func TestSortStackKeepsDuplicatesAdjacent(t *testing.T) {
+	copyNew := utils.TAsset{ID: "z", OriginalFileName: "IMG_0001.JPG", Checksum: "c1", CreatedAt: "2024-01-03T00:00:00Z"}
+	other := utils.TAsset{ID: "m", OriginalFileName: "IMG_0001.HEIC", Checksum: "c2", CreatedAt: "2024-01-02T00:00:00Z"}
+	copyOld := utils.TAsset{ID: "a", OriginalFileName: "IMG_0001.JPG", Checksum: "c1", CreatedAt: "2024-01-01T00:00:00Z"}
+
+	// The newest upload comes first, but the copies stay together and by ID, whatever the fetch order
+	for _, stack := range [][]utils.TAsset{{copyNew, other, copyOld}, {copyOld, copyNew, other}, {other, copyOld, copyNew}} {
+		sorted := sortStack(stack, "newestUpload", "", nil, nil, &safePromoteData{data: make(map[string]map[string]string)}, make(map[int]map[string]int))
+		assert.Equal(t, []string{"a", "z", "m"}, []string{sorted[0].ID, sorted[1].ID, sorted[2].ID})
+	}
+}
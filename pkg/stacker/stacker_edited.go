@@ -0,0 +1,166 @@
+package stacker
+
+import (
+	"path"
+	"strings"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+)
+
+/**************************************************************************************************
+** editedAnyKeyword is the filename promote keyword matching the names ending with any of the
+** localized edited suffixes of Options.EditedSuffixes.
+**************************************************************************************************/
+const editedAnyKeyword = "editedAny"
+
+/**************************************************************************************************
+** cutEditedSuffix removes a localized edited suffix from a filename, with its separator and the
+** counter of a duplicate: IMG_1234-bearbeitet.jpg and IMG_1234-editado(1).jpg both become
+** IMG_1234.jpg. The suffix is matched ignoring case, at the end of the name or before the
+** extension, and must follow a "-", "_", "." or space.
+**
+** @param name - The filename, with or without extension
+** @param suffixes - The edited suffixes, empty for utils.DefaultEditedSuffixes
+** @return string - The filename without the suffix
+** @return bool - True if a suffix was found
+**************************************************************************************************/
+func cutEditedSuffix(name string, suffixes []string) (string, bool) {
+	if len(suffixes) == 0 {
+		suffixes = utils.DefaultEditedSuffixes
+	}
+	if stripped, ok := cutEditedSuffixFromBase(name, suffixes); ok {
+		return stripped, true
+	}
+	ext := path.Ext(name)
+	if ext == "" {
+		return name, false
+	}
+	if stripped, ok := cutEditedSuffixFromBase(strings.TrimSuffix(name, ext), suffixes); ok {
+		return stripped + ext, true
+	}
+	return name, false
+}
+
+/**************************************************************************************************
+** cutEditedSuffixFromBase removes a localized edited suffix ending the name, ignoring a trailing
+** counter such as "(1)".
+**
+** @param base - The name, without extension
+** @param suffixes - The edited suffixes
+** @return string - The name without the suffix and the counter
+** @return bool - True if a suffix was found
+**************************************************************************************************/
+func cutEditedSuffixFromBase(base string, suffixes []string) (string, bool) {
+	trimmed := strings.TrimRight(base, " ")
+	if strings.HasSuffix(trimmed, ")") {
+		if open := strings.LastIndex(trimmed, "("); open >= 0 && isDigits(trimmed[open+1:len(trimmed)-1]) {
+			trimmed = strings.TrimRight(trimmed[:open], " ")
+		}
+	}
+
+	runes := []rune(trimmed)
+	for _, suffix := range suffixes {
+		n := len([]rune(suffix))
+		if n == 0 || len(runes) <= n+1 {
+			continue
+		}
+		if !strings.EqualFold(string(runes[len(runes)-n:]), suffix) {
+			continue
+		}
+		if separator := runes[len(runes)-n-1]; strings.ContainsRune("-_. ", separator) {
+			return string(runes[:len(runes)-n-1]), true
+		}
+	}
+	return base, false
+}
+
+/**************************************************************************************************
+** withEditedSuffixes gives the edited suffixes of the options to the criteria normalizing the
+** filename with stripEditedSuffix. The criteria lists are copied, so the shared defaults are
+** left as they are.
+**
+** @param config - The parsed criteria configuration
+** @param suffixes - The edited suffixes of the options, empty for the defaults
+** @return CriteriaConfig - The configuration with the suffixes resolved
+**************************************************************************************************/
+func withEditedSuffixes(config CriteriaConfig, suffixes []string) CriteriaConfig {
+	if len(suffixes) == 0 {
+		return config
+	}
+	config.Legacy = criteriaWithEditedSuffixes(config.Legacy, suffixes)
+	if config.Groups != nil {
+		groups := make([]utils.TCriteriaGroup, len(config.Groups))
+		for i, group := range config.Groups {
+			group.Criteria = criteriaWithEditedSuffixes(group.Criteria, suffixes)
+			groups[i] = group
+		}
+		config.Groups = groups
+	}
+	config.Expression = expressionWithEditedSuffixes(config.Expression, suffixes)
+	return config
+}
+
+/**************************************************************************************************
+** criteriaWithEditedSuffixes returns a copy of the criteria with the edited suffixes set on the
+** ones normalizing the filename.
+**
+** @param criteria - The criteria
+** @param suffixes - The edited suffixes
+** @return []utils.TCriteria - The copy, nil for nil criteria
+**************************************************************************************************/
+func criteriaWithEditedSuffixes(criteria []utils.TCriteria, suffixes []string) []utils.TCriteria {
+	if criteria == nil {
+		return nil
+	}
+	out := append([]utils.TCriteria(nil), criteria...)
+	for i := range out {
+		if out[i].Normalize == utils.NormalizeStripEditedSuffix {
+			out[i].EditedSuffixes = suffixes
+		}
+	}
+	return out
+}
+
+/**************************************************************************************************
+** expressionWithEditedSuffixes returns a copy of the expression tree with the edited suffixes
+** set on the leaves normalizing the filename.
+**
+** @param expr - The expression, or nil
+** @param suffixes - The edited suffixes
+** @return *utils.TCriteriaExpression - The copy, nil for a nil expression
+**************************************************************************************************/
+func expressionWithEditedSuffixes(expr *utils.TCriteriaExpression, suffixes []string) *utils.TCriteriaExpression {
+	if expr == nil {
+		return nil
+	}
+	out := *expr
+	if expr.Criteria != nil {
+		criteria := *expr.Criteria
+		if criteria.Normalize == utils.NormalizeStripEditedSuffix {
+			criteria.EditedSuffixes = suffixes
+		}
+		out.Criteria = &criteria
+	}
+	if expr.Children != nil {
+		out.Children = make([]utils.TCriteriaExpression, len(expr.Children))
+		for i := range expr.Children {
+			out.Children[i] = *expressionWithEditedSuffixes(&expr.Children[i], suffixes)
+		}
+	}
+	return &out
+}
+
+/**************************************************************************************************
+** isDigits reports whether a string is made of ASCII digits only, and not empty.
+**************************************************************************************************/
+func isDigits(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
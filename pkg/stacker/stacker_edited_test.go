@@ -0,0 +1,109 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCutEditedSuffix(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		edited   bool
+	}{
+		{"IMG_1234-edited.jpg", "IMG_1234.jpg", true},
+		{"IMG_1234-bearbeitet.jpg", "IMG_1234.jpg", true},      // German
+		{"IMG_1234-Bearbeitet.JPG", "IMG_1234.JPG", true},      // German, other case
+		{"IMG_1234-editado.jpg", "IMG_1234.jpg", true},         // Spanish
+		{"IMG_1234-editado(1).jpg", "IMG_1234.jpg", true},      // Spanish duplicate
+		{"PXL_20240101_modifié.jpg", "PXL_20240101.jpg", true}, // French
+		{"IMG_1234-bearbeitet", "IMG_1234", true},              // Without extension
+		{"IMG_1234.jpg", "IMG_1234.jpg", false},
+		{"unedited.jpg", "unedited.jpg", false}, // No separator
+		{"edited.jpg", "edited.jpg", false},     // Nothing left
+		{"IMG_1234 (1).jpg", "IMG_1234 (1).jpg", false},
+	}
+	for _, tt := range tests {
+		stripped, edited := cutEditedSuffix(tt.name, nil)
+		assert.Equal(t, tt.expected, stripped, tt.name)
+		assert.Equal(t, tt.edited, edited, tt.name)
+	}
+
+	t.Run("extra suffixes", func(t *testing.T) {
+		stripped, edited := cutEditedSuffix("IMG_1234-retocado.jpg", append(append([]string(nil), utils.DefaultEditedSuffixes...), "retocado"))
+		assert.True(t, edited)
+		assert.Equal(t, "IMG_1234.jpg", stripped)
+		_, edited = cutEditedSuffix("IMG_1234-retocado.jpg", nil)
+		assert.False(t, edited, "no suffixes are the defaults")
+	})
+}
+
+func TestEditedAnyPromote(t *testing.T) {
+	// The parent of the original, its edit and its RAW file
+	parent := func(edit, promote string) string {
+		stack := []utils.TAsset{
+			{ID: "original", OriginalFileName: "IMG_1234.jpg"},
+			{ID: "edit", OriginalFileName: edit},
+			{ID: "raw", OriginalFileName: "IMG_1234.dng"},
+		}
+		sorted := sortStack(stack, promote, ".jpg,.dng", nil, nil, &safePromoteData{data: make(map[string]map[string]string)}, make(map[int]map[string]int))
+		return sorted[0].ID
+	}
+
+	assert.Equal(t, "edit", parent("IMG_1234-bearbeitet.jpg", "editedAny"), "German")
+	assert.Equal(t, "edit", parent("IMG_1234-editado.jpg", "cover,editedAny"), "Spanish")
+	assert.Equal(t, "original", parent("IMG_1234_editedAny.jpg", "editedAny"), "the keyword is not matched as a substring")
+}
+
+func TestStripEditedSuffixCriteria(t *testing.T) {
+	assets := []utils.TAsset{
+		{ID: "original", OriginalFileName: "IMG_1234.jpg", LocalDateTime: "2024-05-01T10:00:00.000Z"},
+		{ID: "german", OriginalFileName: "IMG_1234-bearbeitet.jpg", LocalDateTime: "2024-05-01T10:00:00.000Z"},
+		{ID: "spanish", OriginalFileName: "IMG_1234-editado.jpg", LocalDateTime: "2024-05-01T10:00:00.000Z"},
+		{ID: "other", OriginalFileName: "IMG_1235.jpg", LocalDateTime: "2024-05-01T10:00:00.000Z"},
+	}
+
+	criteria := `[{"key": "originalFileName", "split": {"delimiters": ["."], "index": 0}, "normalize": "stripEditedSuffix"}, {"key": "localDateTime"}]`
+	stacks, err := New(Options{Criteria: criteria, ParentFilenamePromote: "editedAny"}).Stack(assets)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.ElementsMatch(t, []string{"original", "german", "spanish"}, stackMemberIDs(stacks[0]))
+	assert.NotEqual(t, "original", stacks[0].Parent.ID)
+
+	// Without the transform, the edits are not grouped with their original
+	stacks, err = New(Options{Criteria: `[{"key": "originalFileName", "split": {"delimiters": ["."], "index": 0}}, {"key": "localDateTime"}]`}).Stack(assets)
+	require.NoError(t, err)
+	assert.Empty(t, stacks)
+
+	_, err = ParseCriteria(`[{"key": "originalPath", "normalize": "stripEditedSuffix"}]`)
+	assert.ErrorContains(t, err, `normalize is only supported on the originalFileName key, got "originalPath"`)
+	_, err = ParseCriteria(`[{"key": "originalFileName", "normalize": "lowercase"}]`)
+	assert.ErrorContains(t, err, `invalid normalize "lowercase" on "originalFileName", expected stripEditedSuffix`)
+}
+
+func TestEditedSuffixesOption(t *testing.T) {
+	assets := []utils.TAsset{
+		{ID: "original", OriginalFileName: "IMG_1234.jpg", LocalDateTime: "2024-05-01T10:00:00.000Z"},
+		{ID: "edit", OriginalFileName: "IMG_1234-retocado.jpg", LocalDateTime: "2024-05-01T10:00:00.000Z"},
+	}
+	suffixes := append(append([]string(nil), utils.DefaultEditedSuffixes...), "retocado")
+	legacy := `[{"key": "originalFileName", "split": {"delimiters": ["."], "index": 0}, "normalize": "stripEditedSuffix"}, {"key": "localDateTime"}]`
+	expression := `{"mode": "advanced", "expression": {"operator": "AND", "children": [
+		{"criteria": {"key": "originalFileName", "split": {"delimiters": ["."], "index": 0}, "normalize": "stripEditedSuffix"}},
+		{"criteria": {"key": "localDateTime"}}
+	]}}`
+
+	for _, criteria := range []string{legacy, expression} {
+		stacks, err := New(Options{Criteria: criteria, ParentFilenamePromote: "editedAny", EditedSuffixes: suffixes}).Stack(assets)
+		require.NoError(t, err)
+		require.Len(t, stacks, 1, criteria)
+		assert.Equal(t, "edit", stacks[0].Parent.ID, "editedAny matches the suffix of the options")
+
+		stacks, err = New(Options{Criteria: criteria}).Stack(assets)
+		require.NoError(t, err)
+		assert.Empty(t, stacks, "the suffix is not a default one")
+	}
+}
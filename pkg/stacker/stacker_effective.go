@@ -0,0 +1,49 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+)
+
+/**************************************************************************************************
+** EffectiveCriteria returns the criteria Stack groups the assets with, as indented JSON: the
+** default criteria when none is set, split on the configured delimiters, and the onMiss of
+** SkipMatchMiss filled in on the legacy criteria. It also returns the delimiters biggestNumber
+** and the filename split use.
+**
+** @param opts - Options of the run
+** @return string - The resolved criteria, as indented JSON
+** @return []string - The resolved delimiters, nil when none apply
+** @return error - An error if the criteria cannot be parsed
+**************************************************************************************************/
+func EffectiveCriteria(opts Options) (string, []string, error) {
+	config, err := getCriteriaConfig(opts.Criteria)
+	if err != nil {
+		return "", nil, err
+	}
+	if opts.Criteria == "" && len(opts.Delimiters) > 0 {
+		config.Legacy = defaultCriteriaWithDelimiters(opts.Delimiters)
+	}
+	opts = withCriteriaPromote(opts, config.Promote)
+	delimiters := resolveDelimiters(opts, allCriteria(config))
+
+	var resolved interface{}
+	if config.Mode == "advanced" {
+		resolved = utils.TAdvancedCriteria{
+			Mode:           config.Mode,
+			Groups:         config.Groups,
+			Expression:     config.Expression,
+			ParentOverride: config.ParentOverride,
+			Promote:        config.Promote,
+		}
+	} else {
+		resolved = resolveOnMiss(opts, config.Legacy)
+	}
+	data, err := json.MarshalIndent(resolved, "", "  ")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encode the criteria: %w", err)
+	}
+	return string(data), delimiters, nil
+}
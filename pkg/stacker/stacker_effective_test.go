@@ -0,0 +1,42 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEffectiveCriteria(t *testing.T) {
+	t.Run("default criteria on the configured delimiters", func(t *testing.T) {
+		criteria, delimiters, err := EffectiveCriteria(Options{Delimiters: []string{"-"}})
+		require.NoError(t, err)
+		assert.JSONEq(t, `[
+			{"key": "originalFileName", "split": {"delimiters": ["-"], "index": 0}},
+			{"key": "localDateTime", "delta": {"milliseconds": 1000}}
+		]`, criteria)
+		assert.Equal(t, []string{"-"}, delimiters)
+	})
+
+	t.Run("onMiss of SkipMatchMiss", func(t *testing.T) {
+		criteria, delimiters, err := EffectiveCriteria(Options{Criteria: `[{"key": "originalFileName", "split": {"delimiters": ["_"], "index": 0}}, {"key": "iso", "onMiss": "error"}]`, SkipMatchMiss: true})
+		require.NoError(t, err)
+		assert.JSONEq(t, `[
+			{"key": "originalFileName", "split": {"delimiters": ["_"], "index": 0}, "onMiss": "skip"},
+			{"key": "iso", "onMiss": "error"}
+		]`, criteria)
+		assert.Equal(t, []string{"_"}, delimiters)
+	})
+
+	t.Run("advanced criteria", func(t *testing.T) {
+		criteria, delimiters, err := EffectiveCriteria(Options{Criteria: `{"mode": "advanced", "expression": {"criteria": {"key": "localDateTime"}}}`})
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"mode": "advanced", "expression": {"criteria": {"key": "localDateTime"}}}`, criteria)
+		assert.Nil(t, delimiters)
+	})
+
+	t.Run("invalid criteria", func(t *testing.T) {
+		_, _, err := EffectiveCriteria(Options{Criteria: `{`})
+		assert.Error(t, err)
+	})
+}
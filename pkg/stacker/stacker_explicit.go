@@ -0,0 +1,127 @@
+package stacker
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+)
+
+/**************************************************************************************************
+** StackAssets builds one stack from an explicit list of assets, without grouping them: the
+** criteria are not applied to decide the members, only to rank them, so the parent is picked
+** with the same promote rules as for a stack formed by the criteria.
+**
+** @param assets - Members of the stack, at least two
+** @param key - Grouping key given to the stack
+** @return Stack - The stack, parent first
+** @return error - An error if fewer than two assets are given or the options are invalid
+**************************************************************************************************/
+func (s *Stacker) StackAssets(assets []utils.TAsset, key string) (Stack, error) {
+	if len(assets) < 2 {
+		return Stack{}, fmt.Errorf("a stack needs at least 2 assets, got %d", len(assets))
+	}
+	sortMembers, err := s.memberSorter()
+	if err != nil {
+		return Stack{}, err
+	}
+	return newStack(sortMembers(assets), key), nil
+}
+
+/**************************************************************************************************
+** StackGroups builds the stacks of groups made outside of the criteria, such as the duplicate
+** groups of Immich. Like StackAssets, the members are only ranked by the promote rules. The
+** groups are then split by library, owner and visibility and held to MaxStackSize as the stacks
+** of Stack are, and the groups left with a single asset are dropped. A sidecar is never the
+** parent.
+**
+** @param groups - Members of each stack, by grouping key
+** @return []Stack - The stacks, parent first, in the order of their keys
+** @return error - An error if the options are invalid
+**************************************************************************************************/
+func (s *Stacker) StackGroups(groups map[string][]utils.TAsset) ([]Stack, error) {
+	if !IsValidOversizePolicy(s.opts.OversizePolicy) {
+		return nil, fmt.Errorf("unknown oversize policy %q, expected skip or split", s.opts.OversizePolicy)
+	}
+	sortMembers, err := s.memberSorter()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(groups))
+	var assets []utils.TAsset
+	for key, members := range groups {
+		keys = append(keys, key)
+		assets = append(assets, members...)
+	}
+	sort.Strings(keys)
+	stacks := make([]Stack, 0, len(keys))
+	for _, key := range keys {
+		if len(groups[key]) >= 2 {
+			stacks = append(stacks, newStack(sortMembers(groups[key]), key))
+		}
+	}
+
+	if !s.opts.CrossLibraryStacking {
+		stacks = splitByLibrary(stacks, s.opts.Logger)
+	}
+	if !s.opts.CrossOwnerStacking {
+		stacks = splitByOwner(stacks, s.opts.Logger)
+	}
+	stacks = splitByVisibility(stacks, assets, s.opts.Logger)
+	stacks = enforceMaxStackSize(stacks, s.opts)
+	stacks = applyParentSelector(stacks, s.opts.ParentSelector, s.opts.Logger)
+	return keepSidecarsOffParent(stacks, s.opts.Logger), nil
+}
+
+/**************************************************************************************************
+** memberSorter returns the function ranking the members of a stack given outside of the criteria
+** with the promote rules of the options.
+**
+** @return func([]utils.TAsset) []utils.TAsset - Returns a sorted copy of the members
+** @return error - An error if the promote order or the criteria are invalid
+**************************************************************************************************/
+func (s *Stacker) memberSorter() (func([]utils.TAsset) []utils.TAsset, error) {
+	promoteOrder, err := ParsePromoteOrder(s.opts.PromoteOrder)
+	if err != nil {
+		return nil, err
+	}
+	if !IsValidExtRankFallback(s.opts.ExtRankFallback) {
+		return nil, fmt.Errorf("unknown extension rank fallback %q, expected builtin, alpha or none", s.opts.ExtRankFallback)
+	}
+	promoteOrder = withExtRankFallback(promoteOrder, s.opts.ExtRankFallback)
+	config, err := getCriteriaConfig(s.opts.Criteria)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get criteria config: %w", err)
+	}
+	opts := withCriteriaPromote(s.opts, config.Promote)
+	config = withEditedSuffixes(config, s.opts.EditedSuffixes)
+
+	var criteria []utils.TCriteria
+	switch {
+	case config.Expression != nil:
+		criteria = flattenCriteriaFromExpression(config.Expression)
+	case len(config.Groups) > 0:
+		criteria = flattenCriteriaFromGroups(config.Groups)
+	case s.opts.Criteria == "" && len(s.opts.Delimiters) > 0:
+		criteria = defaultCriteriaWithDelimiters(s.opts.Delimiters)
+	default:
+		criteria = config.Legacy
+	}
+	if err := PrecompileRegexes(criteria); err != nil {
+		return nil, fmt.Errorf("failed to precompile criteria regexes: %w", err)
+	}
+	delimiters := resolveDelimiters(opts, criteria)
+	promotionMaps := buildPromotionMaps(criteria)
+
+	return func(assets []utils.TAsset) []utils.TAsset {
+		// An asset the criteria cannot be applied to is still a member, it only has no promote value
+		promoteData := &safePromoteData{data: make(map[string]map[string]string)}
+		for _, asset := range assets {
+			if _, values, err := applyCriteriaWithPromote(asset, criteria, nil); err == nil && len(values) > 0 {
+				promoteData.Set(asset.ID, values)
+			}
+		}
+		return sortStackWithOrder(append([]utils.TAsset(nil), assets...), opts.ParentFilenamePromote, opts.ParentExtPromote, delimiters, criteria, promoteData, promotionMaps, promoteOrder, opts.EditedSuffixes)
+	}, nil
+}
@@ -0,0 +1,65 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStackAssets(t *testing.T) {
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.dng"},
+		{ID: "2", OriginalFileName: "holiday.jpg"},
+		{ID: "3", OriginalFileName: "IMG_0001_edit.jpg"},
+	}
+
+	stack, err := New(Options{ParentFilenamePromote: "edit"}).StackAssets(assets, "listed")
+	require.NoError(t, err)
+	assert.Equal(t, "3", stack.Parent.ID, "the promote rules pick the parent")
+	assert.Equal(t, []string{"3 1,2,3"}, stackSignatures([]Stack{stack}))
+	assert.Equal(t, "listed", stack.Key)
+	assert.Equal(t, "1", assets[0].ID, "the given slice is left as is")
+
+	// The members are not grouped: a regex the names do not match keeps them all
+	criteria := `[{"key": "originalFileName", "regex": {"key": "^PXL_(\\d+)", "index": 1}}]`
+	stack, err = New(Options{Criteria: criteria}).StackAssets(assets, "listed")
+	require.NoError(t, err)
+	assert.Len(t, stack.Members, 3)
+
+	_, err = New(Options{}).StackAssets(assets[:1], "listed")
+	assert.ErrorContains(t, err, "a stack needs at least 2 assets, got 1")
+	_, err = New(Options{PromoteOrder: "unknown"}).StackAssets(assets, "listed")
+	assert.Error(t, err)
+}
+
+func TestStackGroups(t *testing.T) {
+	groups := map[string][]utils.TAsset{
+		"duplicate=b": {
+			{ID: "4", OriginalFileName: "IMG_0002.jpg", OwnerID: "owner"},
+			{ID: "5", OriginalFileName: "IMG_0002_edit.jpg", OwnerID: "owner"},
+			{ID: "6", OriginalFileName: "IMG_0002.jpg", OwnerID: "partner"},
+		},
+		"duplicate=a": {
+			{ID: "1", OriginalFileName: "IMG_0001.dng", OwnerID: "owner"},
+			{ID: "2", OriginalFileName: "IMG_0001_edit.jpg", OwnerID: "owner"},
+			{ID: "3", OriginalFileName: "IMG_0001.jpg", OwnerID: "owner"},
+		},
+		"duplicate=c": {{ID: "7", OriginalFileName: "IMG_0003.jpg", OwnerID: "owner"}},
+	}
+
+	stacks, err := New(Options{ParentFilenamePromote: "edit"}).StackGroups(groups)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2 1,2,3", "5 4,5"}, stackSignatures(stacks), "the partner asset is split out, the single asset dropped")
+	assert.Equal(t, "duplicate=a", stacks[0].Key)
+
+	stacks, err = New(Options{MaxStackSize: 2}).StackGroups(groups)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"4 4,5"}, stackSignatures(stacks), "a group above the size limit is skipped")
+
+	_, err = New(Options{PromoteOrder: "unknown"}).StackGroups(groups)
+	assert.Error(t, err)
+	_, err = New(Options{OversizePolicy: "unknown"}).StackGroups(groups)
+	assert.Error(t, err)
+}
@@ -103,7 +103,8 @@ func evaluateSingleCriteria(criteria utils.TCriteria, asset utils.TAsset) (bool,
 
 	value, err := extractor(asset, criteria)
 	if err != nil {
-		return false, err
+		// The position of the leaf is filled in by the caller, which knows the whole expression
+		return false, &criterionError{criteria: criteria, err: err}
 	}
 
 	// For expression evaluation, we need to validate the extracted value
@@ -163,11 +164,14 @@ func flattenCriteriaFromExpression(expr *utils.TCriteriaExpression) []utils.TCri
 }
 
 /**************************************************************************************************
-** buildExpressionGroupingKey creates a deterministic grouping key for an asset based on the
-** leaf criteria values from an expression that actually matched. This enables proper grouping
-** where assets with the same criteria values get stacked together.
+** buildExpressionGroupingKey creates a deterministic grouping key for an asset from the values
+** of the leaves that matched and contribute to the key. This enables proper grouping where
+** assets with the same criteria values get stacked together.
 **
-** The key format is "key=value|key=value" in a stable order to avoid collisions.
+** The key has one "key=value" part per leaf, in the order of the flattened criteria, and an
+** empty part for the leaves that do not contribute. The time parts are thus at the positions of
+** the time criteria, as in legacy mode, so the time-based merge finds them: an AND of leaves
+** groups exactly like the same legacy criteria.
 **
 ** @param asset - The asset to build a key for
 ** @param expr - The expression tree to evaluate
@@ -176,35 +180,53 @@ func flattenCriteriaFromExpression(expr *utils.TCriteriaExpression) []utils.TCri
 ** @return error - Error if evaluation fails
 **************************************************************************************************/
 func buildExpressionGroupingKey(asset utils.TAsset, expr *utils.TCriteriaExpression, criteria []utils.TCriteria) (string, error) {
-	matchingValues, err := collectMatchingCriteriaValues(asset, expr, criteria)
+	values, err := collectMatchingCriteriaValues(asset, expr, criteria)
 	if err != nil {
 		return "", err
 	}
+	return joinExpressionKey(values, criteria), nil
+}
 
-	if len(matchingValues) == 0 {
-		return "", nil
-	}
-
-	// Build deterministic key in the format: key=value|key=value
-	// Use a map to track keys we've already added to avoid duplicates
-	var keyParts []string
-	addedKeys := make(map[string]bool)
-
-	for _, c := range criteria {
-		if value, exists := matchingValues[c.Key]; exists && value != "" {
-			keyValue := c.Key + "=" + value
-			if !addedKeys[c.Key] {
-				keyParts = append(keyParts, keyValue)
-				addedKeys[c.Key] = true
-			}
+/**************************************************************************************************
+** joinExpressionKey joins the values of the leaves into a grouping key, one "key=value" part per
+** leaf and an empty part for the leaves without a value.
+**
+** @param values - Value of each leaf, in the order of the criteria
+** @param criteria - Flattened criteria from the expression
+** @return string - The grouping key, or empty string if no leaf has a value
+**************************************************************************************************/
+func joinExpressionKey(values []string, criteria []utils.TCriteria) string {
+	keyParts := make([]string, len(values))
+	matched := false
+	for i, value := range values {
+		if value != "" {
+			keyParts[i] = criteria[i].Key + "=" + value
+			matched = true
 		}
 	}
-
-	if len(keyParts) == 0 {
-		return "", nil
+	if !matched {
+		return ""
 	}
 
-	return strings.Join(keyParts, "|"), nil
+	return strings.Join(keyParts, "|")
+}
+
+/**************************************************************************************************
+** describeExpressionBranch names the leaves whose value is part of a grouping key, which tells
+** the branch of the expression that grouped the asset.
+**
+** @param values - Value of each leaf, in the order of the criteria
+** @param criteria - Flattened criteria from the expression
+** @return string - The leaves with a value, such as "expression leaves #1 originalFileName, #3 localDateTime"
+**************************************************************************************************/
+func describeExpressionBranch(values []string, criteria []utils.TCriteria) string {
+	var leaves []string
+	for i, value := range values {
+		if value != "" {
+			leaves = append(leaves, fmt.Sprintf("#%d %s", i+1, criteria[i].Key))
+		}
+	}
+	return "expression leaves " + strings.Join(leaves, ", ")
 }
 
 /**************************************************************************************************
@@ -214,14 +236,16 @@ func buildExpressionGroupingKey(asset utils.TAsset, expr *utils.TCriteriaExpress
 **
 ** @param asset - The asset to evaluate
 ** @param expr - The expression tree to walk
-** @param criteria - All leaf criteria for consistent key ordering
-** @return map[string]string - Map of criteria key to extracted value for matching leaves
+** @param criteria - All leaf criteria, flattened from the expression
+** @return []string - Value of each leaf, in the order of the criteria, empty for the leaves
+** that did not match or do not contribute
 ** @return error - Error if evaluation fails
 **************************************************************************************************/
-func collectMatchingCriteriaValues(asset utils.TAsset, expr *utils.TCriteriaExpression, criteria []utils.TCriteria) (map[string]string, error) {
-	values := make(map[string]string)
+func collectMatchingCriteriaValues(asset utils.TAsset, expr *utils.TCriteriaExpression, criteria []utils.TCriteria) ([]string, error) {
+	values := make([]string, len(criteria))
+	position := 0
 
-	err := walkMatchingCriteria(asset, expr, values)
+	err := walkMatchingCriteria(asset, expr, true, values, &position)
 	if err != nil {
 		return nil, err
 	}
@@ -229,38 +253,83 @@ func collectMatchingCriteriaValues(asset utils.TAsset, expr *utils.TCriteriaExpr
 	return values, nil
 }
 
+/**************************************************************************************************
+** contributesToKey reports whether the leaves under an expression node may add their value to
+** the grouping key: "none" nodes and NOT nodes without an explicit contribution only filter.
+**
+** @param expr - The expression node
+** @return bool - True if the node contributes
+**************************************************************************************************/
+func contributesToKey(expr *utils.TCriteriaExpression) bool {
+	switch expr.KeyContribution {
+	case utils.KeyContributionNone:
+		return false
+	case utils.KeyContributionValue:
+		return true
+	}
+	return expr.Operator == nil || *expr.Operator != "NOT"
+}
+
+/**************************************************************************************************
+** countLeaves returns the number of leaf criteria of an expression node.
+**************************************************************************************************/
+func countLeaves(expr *utils.TCriteriaExpression) int {
+	if expr == nil {
+		return 0
+	}
+	if expr.Criteria != nil {
+		return 1
+	}
+	count := 0
+	for i := range expr.Children {
+		count += countLeaves(&expr.Children[i])
+	}
+	return count
+}
+
 /**************************************************************************************************
 ** walkMatchingCriteria recursively walks an expression tree and collects criteria values
-** from leaf nodes that evaluate to true. For OR branches, only values from the branch
-** that actually matched are included to prevent mixing unrelated criteria.
+** from leaf nodes that evaluate to true. Every leaf of a matching AND contributes. For OR
+** branches, only values from the branch that actually matched are included to prevent mixing
+** unrelated criteria. The leaves of the other branches and of the nodes that do not contribute
+** keep their position with an empty value.
 **
 ** @param asset - The asset to evaluate
 ** @param expr - Current expression node
-** @param values - Map to collect matching criteria values (modified in-place)
+** @param contribute - Whether the parent nodes let the leaves contribute
+** @param values - Value of each leaf, by position (modified in-place)
+** @param position - Position of the first leaf of the node, advanced past its leaves
 ** @return error - Error if evaluation fails
 **************************************************************************************************/
-func walkMatchingCriteria(asset utils.TAsset, expr *utils.TCriteriaExpression, values map[string]string) error {
+func walkMatchingCriteria(asset utils.TAsset, expr *utils.TCriteriaExpression, contribute bool, values []string, position *int) error {
 	if expr == nil {
 		return nil
 	}
+	if !contribute || !contributesToKey(expr) {
+		*position += countLeaves(expr)
+		return nil
+	}
 
 	// Leaf node: evaluate criteria and collect value if it matches
 	if expr.Criteria != nil {
+		index := *position
+		*position++
+
 		matches, err := evaluateSingleCriteria(*expr.Criteria, asset)
 		if err != nil {
 			return err
 		}
 
-		if matches {
+		if matches && index < len(values) {
 			// Extract the value for grouping - use processed criteria values for consistent grouping
 			// For regex criteria, we want the matched portion, not the full filename
-			criteriaValues, _, err := applyCriteriaWithPromote(asset, []utils.TCriteria{*expr.Criteria})
+			criteriaValues, _, err := applyCriteriaWithPromote(asset, []utils.TCriteria{*expr.Criteria}, nil)
 			if err != nil {
 				return err
 			}
 
-			if len(criteriaValues) > 0 && criteriaValues[0] != "" {
-				values[expr.Criteria.Key] = criteriaValues[0]
+			if len(criteriaValues) > 0 {
+				values[index] = criteriaValues[0]
 			}
 		}
 
@@ -274,83 +343,95 @@ func walkMatchingCriteria(asset utils.TAsset, expr *utils.TCriteriaExpression, v
 
 	switch *expr.Operator {
 	case "AND":
-		// For AND: collect values from all children that evaluate to true
-		// Use a temporary map to collect all values, then only keep them if all children match
-		tempValues := make(map[string]string)
-		allMatch := true
-
-		for _, child := range expr.Children {
-			childMatches, err := EvaluateExpression(&child, asset)
-			if err != nil {
-				return err
-			}
-
-			if childMatches {
-				// Child matches, collect its values in temporary map
-				err = walkMatchingCriteria(asset, &child, tempValues)
-				if err != nil {
-					return err
-				}
-			} else {
-				allMatch = false
-			}
+		// For AND: every child contributes, provided they all match
+		allMatch, err := EvaluateExpression(expr, asset)
+		if err != nil {
+			return err
 		}
-
-		// If all children match, copy temp values to main values map
-		if allMatch {
-			for k, v := range tempValues {
-				values[k] = v
+		if !allMatch {
+			*position += countLeaves(expr)
+			return nil
+		}
+		for i := range expr.Children {
+			if err := walkMatchingCriteria(asset, &expr.Children[i], true, values, position); err != nil {
+				return err
 			}
 		}
 
 	case "OR":
 		// For OR: collect values only from the first child that matches
 		// This prevents mixing values from different OR branches in the grouping key
-		for _, child := range expr.Children {
-			childMatches, err := EvaluateExpression(&child, asset)
+		found := false
+		for i := range expr.Children {
+			child := &expr.Children[i]
+			if found {
+				*position += countLeaves(child)
+				continue
+			}
+			childMatches, err := EvaluateExpression(child, asset)
 			if err != nil {
 				return err
 			}
-
-			if childMatches {
-				// Found a matching branch, collect its values and stop
-				// Use a temporary map to collect values from this branch only
-				tempValues := make(map[string]string)
-				err = walkMatchingCriteria(asset, &child, tempValues)
-				if err != nil {
-					return err
-				}
-
-				// Copy values from the successful branch to the main values map
-				for k, v := range tempValues {
-					values[k] = v
-				}
-				break // Only collect from the first matching OR branch
+			if !childMatches {
+				*position += countLeaves(child)
+				continue
+			}
+			found = true
+			if err := walkMatchingCriteria(asset, child, true, values, position); err != nil {
+				return err
 			}
 		}
 
 	case "NOT":
-		// For NOT: if the child doesn't match, the NOT matches but contributes no values
+		// For NOT: only reached with an explicit "value" contribution. The child does not match,
+		// so its leaves add the values they extracted, such as false for NOT isArchived
 		if len(expr.Children) != 1 {
 			return fmt.Errorf("NOT operator must have exactly one child")
 		}
+		return walkExtractedValues(asset, &expr.Children[0], values, position)
+
+	default:
+		return fmt.Errorf("unknown operator: %s", *expr.Operator)
+	}
+
+	return nil
+}
 
-		childMatches, err := EvaluateExpression(&expr.Children[0], asset)
+/**************************************************************************************************
+** walkExtractedValues collects the value extracted by every leaf of an expression node, matching
+** or not, for the children of a NOT node contributing to the key. Nested "none" nodes still
+** contribute nothing.
+**
+** @param asset - The asset to evaluate
+** @param expr - Current expression node
+** @param values - Value of each leaf, by position (modified in-place)
+** @param position - Position of the first leaf of the node, advanced past its leaves
+** @return error - Error if a value cannot be extracted
+**************************************************************************************************/
+func walkExtractedValues(asset utils.TAsset, expr *utils.TCriteriaExpression, values []string, position *int) error {
+	if expr.KeyContribution == utils.KeyContributionNone {
+		*position += countLeaves(expr)
+		return nil
+	}
+	if expr.Criteria != nil {
+		index := *position
+		*position++
+		criteriaValues, _, err := applyCriteriaWithPromote(asset, []utils.TCriteria{*expr.Criteria}, nil)
+		if errors.Is(err, errMatchMiss) {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
-
-		// NOT matches when child doesn't match, but contributes no grouping values
-		// Assets grouped by NOT operations would all have the same "empty" key
-		// This is expected behavior - NOT is used for filtering, not grouping
-		if !childMatches {
-			// NOT expression matches but adds no values to grouping key
-			// This means all assets that match via NOT will be grouped together
+		if len(criteriaValues) > 0 && index < len(values) {
+			values[index] = criteriaValues[0]
+		}
+		return nil
+	}
+	for i := range expr.Children {
+		if err := walkExtractedValues(asset, &expr.Children[i], values, position); err != nil {
+			return err
 		}
-
-	default:
-		return fmt.Errorf("unknown operator: %s", *expr.Operator)
 	}
-
 	return nil
 }
@@ -1,9 +1,15 @@
 package stacker
 
 import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -13,14 +19,14 @@ func TestWalkMatchingCriteria(t *testing.T) {
 		name           string
 		asset          utils.TAsset
 		expr           *utils.TCriteriaExpression
-		expectedValues map[string]string
+		expectedValues []string
 		expectError    bool
 	}{
 		{
 			name:           "nil expression",
 			asset:          utils.TAsset{ID: "1", OriginalFileName: "test.jpg"},
 			expr:           nil,
-			expectedValues: map[string]string{},
+			expectedValues: []string{},
 			expectError:    false,
 		},
 		{
@@ -32,7 +38,7 @@ func TestWalkMatchingCriteria(t *testing.T) {
 					Split: &utils.TSplit{Delimiters: []string{"."}, Index: 0},
 				},
 			},
-			expectedValues: map[string]string{"originalFileName": "IMG_001"},
+			expectedValues: []string{"IMG_001"},
 			expectError:    false,
 		},
 		{
@@ -44,7 +50,7 @@ func TestWalkMatchingCriteria(t *testing.T) {
 					Regex: &utils.TRegex{Key: `^IMG_\d+`, Index: 0},
 				},
 			},
-			expectedValues: map[string]string{},
+			expectedValues: []string{""},
 			expectError:    false,
 		},
 		{
@@ -66,11 +72,8 @@ func TestWalkMatchingCriteria(t *testing.T) {
 					},
 				},
 			},
-			expectedValues: map[string]string{
-				"originalFileName": "IMG_001",
-				"localDateTime":    "2024-01-15T10:00:00.000000000Z",
-			},
-			expectError: false,
+			expectedValues: []string{"IMG_001", "2024-01-15T10:00:00.000000000Z"},
+			expectError:    false,
 		},
 		{
 			name:  "OR expression - first child matches",
@@ -91,7 +94,7 @@ func TestWalkMatchingCriteria(t *testing.T) {
 					},
 				},
 			},
-			expectedValues: map[string]string{"originalFileName": "IMG_001"},
+			expectedValues: []string{"IMG_001", ""},
 			expectError:    false,
 		},
 		{
@@ -101,15 +104,16 @@ func TestWalkMatchingCriteria(t *testing.T) {
 				Operator: nil,
 				Children: nil,
 			},
-			expectedValues: map[string]string{},
+			expectedValues: []string{},
 			expectError:    true,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			values := make(map[string]string)
-			err := walkMatchingCriteria(tt.asset, tt.expr, values)
+			values := make([]string, countLeaves(tt.expr))
+			position := 0
+			err := walkMatchingCriteria(tt.asset, tt.expr, true, values, &position)
 
 			if tt.expectError {
 				assert.Error(t, err)
@@ -127,15 +131,15 @@ func TestCollectMatchingCriteriaValues(t *testing.T) {
 		asset          utils.TAsset
 		expr           *utils.TCriteriaExpression
 		criteria       []utils.TCriteria
-		expectedValues map[string]string
+		expectedValues []string
 		expectError    bool
 	}{
 		{
-			name:           "nil expression returns empty map",
+			name:           "nil expression returns no value",
 			asset:          utils.TAsset{ID: "1"},
 			expr:           nil,
 			criteria:       []utils.TCriteria{},
-			expectedValues: map[string]string{},
+			expectedValues: []string{},
 			expectError:    false,
 		},
 		{
@@ -150,7 +154,7 @@ func TestCollectMatchingCriteriaValues(t *testing.T) {
 			criteria: []utils.TCriteria{
 				{Key: "originalFileName", Split: &utils.TSplit{Delimiters: []string{"."}, Index: 0}},
 			},
-			expectedValues: map[string]string{"originalFileName": "photo"},
+			expectedValues: []string{"photo"},
 			expectError:    false,
 		},
 	}
@@ -169,6 +173,143 @@ func TestCollectMatchingCriteriaValues(t *testing.T) {
 	}
 }
 
+func TestExpressionKeyContribution(t *testing.T) {
+	asset := utils.TAsset{ID: "1", OriginalFileName: "IMG_001.jpg", LocalDateTime: "2024-01-15T10:00:00.000000000Z"}
+	tests := []struct {
+		name        string
+		expression  string
+		expectedKey string
+	}{
+		{
+			name:        "every AND-ed leaf contributes",
+			expression:  `{"operator": "AND", "children": [{"criteria": {"key": "originalFileName", "split": {"delimiters": ["."], "index": 0}}}, {"criteria": {"key": "localDateTime"}}]}`,
+			expectedKey: "originalFileName=IMG_001|localDateTime=2024-01-15T10:00:00.000000000Z",
+		},
+		{
+			name:        "time leaf keeps its position after an OR",
+			expression:  `{"operator": "AND", "children": [{"operator": "OR", "children": [{"criteria": {"key": "originalFileName", "regex": {"key": "^PXL_", "index": 0}}}, {"criteria": {"key": "originalFileName", "split": {"delimiters": ["."], "index": 0}}}]}, {"criteria": {"key": "localDateTime"}}]}`,
+			expectedKey: "|originalFileName=IMG_001|localDateTime=2024-01-15T10:00:00.000000000Z",
+		},
+		{
+			name:        "none node only filters",
+			expression:  `{"operator": "AND", "children": [{"criteria": {"key": "originalFileName", "split": {"delimiters": ["."], "index": 0}}}, {"criteria": {"key": "localDateTime"}, "keyContribution": "none"}]}`,
+			expectedKey: "originalFileName=IMG_001|",
+		},
+		{
+			name:        "NOT contributes nothing by default",
+			expression:  `{"operator": "AND", "children": [{"criteria": {"key": "originalFileName", "split": {"delimiters": ["."], "index": 0}}}, {"operator": "NOT", "children": [{"criteria": {"key": "isArchived"}}]}]}`,
+			expectedKey: "originalFileName=IMG_001|",
+		},
+		{
+			name:        "NOT marked value contributes the extracted values",
+			expression:  `{"operator": "AND", "children": [{"criteria": {"key": "originalFileName", "split": {"delimiters": ["."], "index": 0}}}, {"operator": "NOT", "keyContribution": "value", "children": [{"criteria": {"key": "isArchived"}}]}]}`,
+			expectedKey: "originalFileName=IMG_001|isArchived=false",
+		},
+		{
+			name:        "children of a none node cannot contribute",
+			expression:  `{"operator": "AND", "keyContribution": "none", "children": [{"criteria": {"key": "originalFileName", "split": {"delimiters": ["."], "index": 0}}, "keyContribution": "value"}]}`,
+			expectedKey: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var expr utils.TCriteriaExpression
+			require.NoError(t, json.Unmarshal([]byte(tt.expression), &expr))
+			require.NoError(t, validateExpression(&expr))
+
+			key, err := buildExpressionGroupingKey(asset, &expr, flattenCriteriaFromExpression(&expr))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedKey, key)
+		})
+	}
+
+	invalid := utils.TCriteriaExpression{Criteria: &utils.TCriteria{Key: "originalFileName"}, KeyContribution: "all"}
+	assert.ErrorContains(t, validateExpression(&invalid), `invalid keyContribution "all"`)
+}
+
+/************************************************************************************************
+** pixelCorpus returns Pixel captures: RAW+JPEG pairs, motion photos, night shots, a pair on
+** both sides of a second boundary and names reused hours apart.
+************************************************************************************************/
+func pixelCorpus() []utils.TAsset {
+	base := time.Date(2024, 1, 15, 14, 30, 22, 0, time.UTC)
+	files := []struct {
+		name   string
+		offset time.Duration
+	}{
+		{"PXL_20240115_143022345.jpg", 345 * time.Millisecond},
+		{"PXL_20240115_143022345.MP.jpg", 345 * time.Millisecond},
+		{"PXL_20240115_143022345.dng", 400 * time.Millisecond},
+		{"PXL_20240115_143023950.jpg", 1950 * time.Millisecond},
+		{"PXL_20240115_143023950.dng", 2100 * time.Millisecond}, // Next second, within the delta
+		{"PXL_20240115_150000000.RAW-01.COVER.jpg", 30 * time.Minute},
+		{"PXL_20240115_150000000.RAW-02.ORIGINAL.dng", 30 * time.Minute},
+		{"PXL_20240115_160000000.NIGHT.jpg", 90 * time.Minute},
+		{"PXL_20240115_160000000.jpg", 90*time.Minute + 5*time.Second}, // Beyond the delta
+		{"PXL_20240115_170000000.jpg", 150 * time.Minute},
+		{"PXL_20240115_170000000.jpg", 300 * time.Minute}, // Same name, hours later
+		{"PXL_20240115_170000000.dng", 300 * time.Minute},
+		{"PXL_20240115_180000000.mp4", 210 * time.Minute},
+	}
+	assets := make([]utils.TAsset, len(files))
+	for i, file := range files {
+		assets[i] = utils.TAsset{
+			ID:               fmt.Sprintf("pxl-%02d", i),
+			OriginalFileName: file.name,
+			LocalDateTime:    base.Add(file.offset).Format(time.RFC3339Nano),
+		}
+	}
+	return assets
+}
+
+/************************************************************************************************
+** stackSignatures describes stacks as their parent and sorted member IDs, in a stable order.
+************************************************************************************************/
+func stackSignatures(stacks []Stack) []string {
+	signatures := make([]string, 0, len(stacks))
+	for _, stack := range stacks {
+		ids := make([]string, 0, len(stack.Members))
+		for _, member := range stack.Members {
+			ids = append(ids, member.ID)
+		}
+		sort.Strings(ids)
+		signatures = append(signatures, stack.Parent.ID+" "+strings.Join(ids, ","))
+	}
+	sort.Strings(signatures)
+	return signatures
+}
+
+func TestExpressionLegacyParityPixel(t *testing.T) {
+	legacy, err := New(Options{}).Stack(pixelCorpus())
+	require.NoError(t, err)
+	require.NotEmpty(t, legacy)
+
+	expressions := map[string]string{
+		"default criteria": `{"mode": "advanced", "expression": {"operator": "AND", "children": [
+			{"criteria": {"key": "originalFileName", "split": {"delimiters": ["~", "."], "index": 0}}},
+			{"criteria": {"key": "localDateTime", "delta": {"milliseconds": 1000}}}
+		]}}`,
+		"time first": `{"mode": "advanced", "expression": {"operator": "AND", "children": [
+			{"criteria": {"key": "localDateTime", "delta": {"milliseconds": 1000}}},
+			{"criteria": {"key": "originalFileName", "split": {"delimiters": ["~", "."], "index": 0}}}
+		]}}`,
+		"nested AND with a NOT filter": `{"mode": "advanced", "expression": {"operator": "AND", "children": [
+			{"operator": "AND", "children": [
+				{"criteria": {"key": "originalFileName", "split": {"delimiters": ["~", "."], "index": 0}}},
+				{"operator": "NOT", "children": [{"criteria": {"key": "isArchived"}}]}
+			]},
+			{"criteria": {"key": "localDateTime", "delta": {"milliseconds": 1000}}}
+		]}}`,
+	}
+	for name, criteria := range expressions {
+		t.Run(name, func(t *testing.T) {
+			stacks, err := New(Options{Criteria: criteria}).Stack(pixelCorpus())
+			require.NoError(t, err)
+			assert.Equal(t, stackSignatures(legacy), stackSignatures(stacks))
+		})
+	}
+}
+
 func TestEvaluateExpressionAdditional(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -373,3 +514,167 @@ func TestFlattenCriteriaFromExpression(t *testing.T) {
 func stringPtr(s string) *string {
 	return &s
 }
+
+func TestNumericCompareCriteria(t *testing.T) {
+	iso := func(value float64) utils.TAsset {
+		return utils.TAsset{ID: "1", OriginalFileName: "IMG_001.jpg", ExifInfo: &utils.TExifInfo{ISO: &value}}
+	}
+	gte1600 := &utils.TCriteriaExpression{
+		Criteria: &utils.TCriteria{Key: "iso", Compare: &utils.TCompare{Op: "gte", Value: 1600}},
+	}
+
+	tests := []struct {
+		name     string
+		asset    utils.TAsset
+		expected bool
+	}{
+		{name: "above threshold", asset: iso(3200), expected: true},
+		{name: "at threshold", asset: iso(1600), expected: true},
+		{name: "below threshold", asset: iso(400), expected: false},
+		{name: "missing exif", asset: utils.TAsset{ID: "1"}, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matches, err := EvaluateExpression(gte1600, tt.asset)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, matches)
+		})
+	}
+
+	t.Run("NOT inverts the comparison", func(t *testing.T) {
+		not := &utils.TCriteriaExpression{Operator: stringPtr("NOT"), Children: []utils.TCriteriaExpression{*gte1600}}
+		matches, err := EvaluateExpression(not, iso(400))
+		require.NoError(t, err)
+		assert.True(t, matches)
+	})
+}
+
+func TestCompareOperators(t *testing.T) {
+	tests := []struct {
+		op       string
+		value    float64
+		expected bool
+	}{
+		{op: "eq", value: 2.8, expected: true},
+		{op: "ne", value: 2.8, expected: false},
+		{op: "gt", value: 2, expected: true},
+		{op: "gte", value: 2.8, expected: true},
+		{op: "lt", value: 2.8, expected: false},
+		{op: "lte", value: 4, expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.op, func(t *testing.T) {
+			matches, err := compareNumber(2.8, utils.TCompare{Op: tt.op, Value: tt.value})
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, matches)
+		})
+	}
+
+	_, err := compareNumber(2.8, utils.TCompare{Op: "between"})
+	assert.Error(t, err)
+}
+
+func TestTypeValueCriteria(t *testing.T) {
+	image := utils.TAsset{ID: "1", Type: "IMAGE", OriginalFileName: "IMG_001.jpg"}
+	video := utils.TAsset{ID: "2", Type: "VIDEO", OriginalFileName: "IMG_001.mov"}
+	leaf := &utils.TCriteriaExpression{Criteria: &utils.TCriteria{Key: "type", Value: "image"}}
+
+	matches, err := EvaluateExpression(leaf, image)
+	require.NoError(t, err)
+	assert.True(t, matches, "the comparison ignores the casing")
+	matches, err = EvaluateExpression(leaf, video)
+	require.NoError(t, err)
+	assert.False(t, matches)
+
+	t.Run("legacy mode filters", func(t *testing.T) {
+		criteria := `[{"key": "originalFileName", "split": {"delimiters": ["."], "index": 0}}, {"key": "type", "value": "Image"}]`
+		assets := []utils.TAsset{
+			image,
+			{ID: "3", Type: "IMAGE", OriginalFileName: "IMG_001.dng"},
+			video,
+		}
+		stacks, err := New(Options{Criteria: criteria}).Stack(assets)
+		require.NoError(t, err)
+		require.Len(t, stacks, 1)
+		assert.Equal(t, []string{"1 1,3"}, stackSignatures(stacks), "the video is left out")
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		_, err := ParseCriteria(`[{"key": "type", "value": "photo"}]`)
+		assert.ErrorContains(t, err, `invalid type value "photo", expected image, video, audio or other`)
+		_, err = ParseCriteria(`[{"key": "originalFileName", "value": "image"}]`)
+		assert.ErrorContains(t, err, `value is only supported on the type key, got "originalFileName"`)
+		_, err = ParseCriteria(`[{"key": "type", "value": "OTHER"}]`)
+		assert.NoError(t, err)
+	})
+}
+
+func TestStackBranch(t *testing.T) {
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.jpg", LocalDateTime: "2024-01-01T10:00:00.000Z"},
+		{ID: "2", OriginalFileName: "IMG_0001.dng", LocalDateTime: "2024-01-01T10:00:00.000Z"},
+		{ID: "3", OriginalFileName: "PXL_0002.jpg", LocalDateTime: "2024-01-01T11:00:00.000Z"},
+		{ID: "4", OriginalFileName: "PXL_0002.dng", LocalDateTime: "2024-01-01T11:00:00.000Z"},
+	}
+
+	t.Run("expression", func(t *testing.T) {
+		criteria := `{"mode": "advanced", "expression": {"operator": "OR", "children": [
+			{"criteria": {"key": "originalFileName", "regex": {"key": "^(IMG_\\d+)", "index": 1}}},
+			{"operator": "AND", "children": [
+				{"criteria": {"key": "originalFileName", "regex": {"key": "^(PXL_\\d+)", "index": 1}}},
+				{"criteria": {"key": "localDateTime", "delta": {"milliseconds": 1000}}}
+			]}
+		]}}`
+		stacks, err := New(Options{Criteria: criteria}).Stack(assets)
+		require.NoError(t, err)
+		branches := make(map[string]string)
+		for _, stack := range stacks {
+			branches[stack.Parent.ID] = stack.Branch
+		}
+		assert.Equal(t, map[string]string{
+			"1": "expression leaves #1 originalFileName",
+			"3": "expression leaves #2 originalFileName, #3 localDateTime",
+		}, branches, "the time-based merge keeps the branch")
+	})
+
+	t.Run("groups", func(t *testing.T) {
+		criteria := `{"mode": "advanced", "groups": [
+			{"operator": "AND", "criteria": [{"key": "originalFileName", "regex": {"key": "^(PXL_\\d+)", "index": 1}}]},
+			{"operator": "OR", "criteria": [{"key": "localDateTime"}, {"key": "originalFileName", "regex": {"key": "^(IMG_\\d+)", "index": 1}}]}
+		]}`
+		stacks, err := New(Options{Criteria: criteria}).Stack(assets)
+		require.NoError(t, err)
+		require.Len(t, stacks, 2)
+		for _, stack := range stacks {
+			assert.Equal(t, describeGroupBranch(stack.Key), stack.Branch)
+			assert.NotEmpty(t, stack.Branch, stack.Key)
+		}
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		stacks, err := New(Options{}).Stack(assets)
+		require.NoError(t, err)
+		require.NotEmpty(t, stacks)
+		assert.Empty(t, stacks[0].Branch)
+	})
+
+	assert.Equal(t, "group #1 OR criterion #2", describeGroupBranch("group_0_or_1_originalFileName:IMG_0001"))
+	assert.Equal(t, "group #3 AND", describeGroupBranch("group_2_and:originalFileName=IMG_0001"))
+	assert.Empty(t, describeGroupBranch("IMG_0001|2024-01-01T10:00:00Z"))
+}
+
+func TestFormedStackLogEscapesKey(t *testing.T) {
+	var out strings.Builder
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	logger.SetLevel(logrus.DebugLevel)
+	logger.SetFormatter(&logrus.TextFormatter{DisableQuote: true, DisableTimestamp: true})
+
+	stack := newStack([]utils.TAsset{{ID: "1"}, {ID: "2"}}, "originalFileName=evil\nlevel=error msg=forged\x1b[2J")
+	stack.Branch = "expression leaves #1 originalFileName"
+	logFormedStack(stack, logger)
+	assert.Equal(t, 1, strings.Count(out.String(), "\n"), "the key stays on one line")
+	assert.Contains(t, out.String(), `from key "originalFileName=evil\nlevel=error msg=forged\x1b[2J" (expression leaves #1 originalFileName)`)
+}
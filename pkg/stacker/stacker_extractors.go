@@ -1,14 +1,24 @@
 package stacker
 
 import (
+	"errors"
 	"fmt"
-	"path/filepath"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/majorfi/immich-stack/pkg/utils"
 )
 
+// Numeric EXIF fields supporting the compare block
+var numericFields = map[string]bool{
+	"iso":         true,
+	"fNumber":     true,
+	"focalLength": true,
+	"fileSize":    true,
+}
+
 // Package-level extractor map to avoid allocation on each call
 var extractors = map[string]func(asset utils.TAsset, c utils.TCriteria) (string, error){
 	"id":            func(a utils.TAsset, _ utils.TCriteria) (string, error) { return a.ID, nil },
@@ -16,10 +26,10 @@ var extractors = map[string]func(asset utils.TAsset, c utils.TCriteria) (string,
 	"deviceId":      func(a utils.TAsset, _ utils.TCriteria) (string, error) { return a.DeviceID, nil },
 	"duration":      func(a utils.TAsset, _ utils.TCriteria) (string, error) { return a.Duration, nil },
 	"fileCreatedAt": func(a utils.TAsset, c utils.TCriteria) (string, error) {
-		return extractTimeWithDelta(a.FileCreatedAt, c.Delta)
+		return extractTimeField(a, c)
 	},
 	"fileModifiedAt": func(a utils.TAsset, c utils.TCriteria) (string, error) {
-		return extractTimeWithDelta(a.FileModifiedAt, c.Delta)
+		return extractTimeField(a, c)
 	},
 	"hasMetadata": func(a utils.TAsset, _ utils.TCriteria) (string, error) { return utils.BoolToString(a.HasMetadata), nil },
 	"isArchived":  func(a utils.TAsset, _ utils.TCriteria) (string, error) { return utils.BoolToString(a.IsArchived), nil },
@@ -27,7 +37,7 @@ var extractors = map[string]func(asset utils.TAsset, c utils.TCriteria) (string,
 	"isOffline":   func(a utils.TAsset, _ utils.TCriteria) (string, error) { return utils.BoolToString(a.IsOffline), nil },
 	"isTrashed":   func(a utils.TAsset, _ utils.TCriteria) (string, error) { return utils.BoolToString(a.IsTrashed), nil },
 	"localDateTime": func(a utils.TAsset, c utils.TCriteria) (string, error) {
-		return extractTimeWithDelta(a.LocalDateTime, c.Delta)
+		return extractTimeField(a, c)
 	},
 	"originalFileName": func(a utils.TAsset, c utils.TCriteria) (string, error) {
 		value, _, err := extractOriginalFileName(a, c)
@@ -37,12 +47,148 @@ var extractors = map[string]func(asset utils.TAsset, c utils.TCriteria) (string,
 		value, _, err := extractOriginalPath(a, c)
 		return value, err
 	},
-	"ownerId": func(a utils.TAsset, _ utils.TCriteria) (string, error) { return a.OwnerID, nil },
-	"type":    func(a utils.TAsset, _ utils.TCriteria) (string, error) { return a.Type, nil },
+	"livePhotoVideoId": func(a utils.TAsset, _ utils.TCriteria) (string, error) { return livePhotoKey(a), nil },
+	"libraryId":        func(a utils.TAsset, _ utils.TCriteria) (string, error) { return a.LibraryID, nil },
+	"ownerId":          func(a utils.TAsset, _ utils.TCriteria) (string, error) { return a.OwnerID, nil },
+	"type":             extractType,
 	"updatedAt": func(a utils.TAsset, c utils.TCriteria) (string, error) {
-		return extractTimeWithDelta(a.UpdatedAt, c.Delta)
+		return extractTimeField(a, c)
+	},
+	"checksum": func(a utils.TAsset, c utils.TCriteria) (string, error) {
+		return truncateChecksum(a.Checksum, c.Length)
 	},
-	"checksum": func(a utils.TAsset, _ utils.TCriteria) (string, error) { return a.Checksum, nil },
+	"iso":         extractNumericField,
+	"fNumber":     extractNumericField,
+	"focalLength": extractNumericField,
+	"fileSize":    extractNumericField,
+}
+
+/**************************************************************************************************
+** assetTypes are the asset types of Immich, the values accepted by the value of a type criteria.
+**************************************************************************************************/
+var assetTypes = []string{"IMAGE", "VIDEO", "AUDIO", "OTHER"}
+
+/**************************************************************************************************
+** extractType extracts the type of an asset. When the criteria has a value it acts as a filter:
+** assets of that type, whatever its casing, all get the same value so the type adds nothing to
+** the grouping, and other assets get an empty value.
+**
+** @param asset - The asset to extract the type from
+** @param c - The type criteria
+** @return string - The type, or empty if not matching the value
+** @return error - Always nil
+**************************************************************************************************/
+func extractType(asset utils.TAsset, c utils.TCriteria) (string, error) {
+	if c.Value == "" {
+		return asset.Type, nil
+	}
+	if !strings.EqualFold(asset.Type, c.Value) {
+		return "", nil
+	}
+	return strings.ToUpper(c.Value), nil
+}
+
+/**************************************************************************************************
+** getNumericField returns the value of a numeric EXIF field of an asset.
+**
+** @param asset - The asset to read the field from
+** @param key - The numeric criteria key (iso, fNumber, focalLength, fileSize)
+** @return float64 - The field value
+** @return bool - False if the asset has no value for the field
+**************************************************************************************************/
+func getNumericField(asset utils.TAsset, key string) (float64, bool) {
+	if asset.ExifInfo == nil {
+		return 0, false
+	}
+	var value *float64
+	switch key {
+	case "iso":
+		value = asset.ExifInfo.ISO
+	case "fNumber":
+		value = asset.ExifInfo.FNumber
+	case "focalLength":
+		value = asset.ExifInfo.FocalLength
+	case "fileSize":
+		value = asset.ExifInfo.FileSizeInByte
+	}
+	if value == nil {
+		return 0, false
+	}
+	return *value, true
+}
+
+/**************************************************************************************************
+** extractNumericField extracts a numeric EXIF field as a string. When the criteria has a compare
+** block it acts as a constraint: assets satisfying it all get the same value (e.g. "gte:1600")
+** so they are not split by their exact value, and other assets get an empty value.
+**
+** @param asset - The asset to extract the value from
+** @param c - The numeric criteria
+** @return string - The formatted value, or empty if missing or not matching the comparison
+** @return error - An error if the comparison operator is unknown
+**************************************************************************************************/
+func extractNumericField(asset utils.TAsset, c utils.TCriteria) (string, error) {
+	value, ok := getNumericField(asset, c.Key)
+	if !ok {
+		return "", nil
+	}
+	if c.Compare != nil {
+		matches, err := compareNumber(value, *c.Compare)
+		if err != nil {
+			return "", err
+		}
+		if !matches {
+			return "", nil
+		}
+		return c.Compare.Op + ":" + strconv.FormatFloat(c.Compare.Value, 'f', -1, 64), nil
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64), nil
+}
+
+/**************************************************************************************************
+** compareNumber applies a numeric comparison to a value.
+**
+** @param value - The value to compare
+** @param compare - The comparison operator and operand
+** @return bool - True if the comparison holds
+** @return error - An error if the operator is unknown
+**************************************************************************************************/
+func compareNumber(value float64, compare utils.TCompare) (bool, error) {
+	switch compare.Op {
+	case "eq":
+		return value == compare.Value, nil
+	case "ne":
+		return value != compare.Value, nil
+	case "gt":
+		return value > compare.Value, nil
+	case "gte":
+		return value >= compare.Value, nil
+	case "lt":
+		return value < compare.Value, nil
+	case "lte":
+		return value <= compare.Value, nil
+	default:
+		return false, fmt.Errorf("unknown compare operator: %s (expected eq, ne, gt, gte, lt or lte)", compare.Op)
+	}
+}
+
+/**************************************************************************************************
+** truncateChecksum keeps the first length characters of a checksum so near-identical uploads
+** can be grouped by checksum prefix. A length of 0 keeps the full checksum.
+**
+** @param checksum - The base64/hex checksum of the asset
+** @param length - Number of leading characters to keep (0 = full checksum)
+** @return string - The (possibly truncated) checksum
+** @return error - An error if length is negative
+**************************************************************************************************/
+func truncateChecksum(checksum string, length int) (string, error) {
+	if length < 0 {
+		return "", fmt.Errorf("checksum length must not be negative, got %d", length)
+	}
+	if length == 0 || length >= len(checksum) {
+		return checksum, nil
+	}
+	return checksum[:length], nil
 }
 
 /**************************************************************************************************
@@ -58,6 +204,86 @@ func getExtractor(key string) (func(utils.TAsset, utils.TCriteria) (string, erro
 	return extractor, exists
 }
 
+/**************************************************************************************************
+** extractTimeField resolves the time value for a time-based criteria (honoring fallbackKeys and
+** minValidDate) and applies the configured delta to it.
+**
+** @param asset - The asset to extract the time from
+** @param c - The time-based criteria
+** @return string - The formatted time string, or empty if no valid time was found
+** @return error - An error if the criteria configuration or the time value is invalid
+**************************************************************************************************/
+func extractTimeField(asset utils.TAsset, c utils.TCriteria) (string, error) {
+	timeStr, err := resolveTimeValue(asset, c)
+	if err != nil {
+		return "", err
+	}
+	return extractTimeWithDelta(timeStr, c.Delta)
+}
+
+/**************************************************************************************************
+** resolveTimeValue returns the raw time string to use for a time-based criteria. Without
+** fallbackKeys or minValidDate, the primary field is returned untouched. Otherwise the primary
+** field and then each fallback key are tried in order, skipping values that are empty,
+** unparseable or before the sanity threshold. If none is valid, an empty string is returned so
+** the asset is excluded from that criteria.
+**
+** @param asset - The asset to read the time fields from
+** @param c - The time-based criteria
+** @return string - The first valid time string, or empty if none is valid
+** @return error - An error if a fallback key is not a time field or minValidDate is invalid
+**************************************************************************************************/
+func resolveTimeValue(asset utils.TAsset, c utils.TCriteria) (string, error) {
+	if len(c.FallbackKeys) == 0 && c.MinValidDate == "" {
+		return getAssetTimeField(asset, c.Key), nil
+	}
+
+	minValidDate, err := parseMinValidDate(c.MinValidDate)
+	if err != nil {
+		return "", err
+	}
+
+	keys := append([]string{c.Key}, c.FallbackKeys...)
+	for _, key := range keys {
+		if !isTimeCriteria(key) {
+			return "", fmt.Errorf("fallback key %q is not a time field", key)
+		}
+		timeStr := getAssetTimeField(asset, key)
+		if timeStr == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, timeStr)
+		if err != nil || t.Before(minValidDate) {
+			continue
+		}
+		return timeStr, nil
+	}
+	return "", nil
+}
+
+/**************************************************************************************************
+** parseMinValidDate parses the minValidDate threshold of a time criteria. Both plain dates
+** (2006-01-02) and RFC3339 timestamps are accepted. An empty value falls back to
+** utils.DefaultMinValidDate.
+**
+** @param value - The configured threshold
+** @return time.Time - The parsed threshold
+** @return error - An error if the value cannot be parsed
+**************************************************************************************************/
+func parseMinValidDate(value string) (time.Time, error) {
+	if value == "" {
+		value = utils.DefaultMinValidDate
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid minValidDate %q (expected YYYY-MM-DD or RFC3339)", value)
+	}
+	return t, nil
+}
+
 /**************************************************************************************************
 ** extractTimeWithDelta parses a time string and applies a specified time delta if
 ** configured. The input time string is expected to be in RFC3339Nano format. If a
@@ -98,6 +324,12 @@ func extractTimeWithDelta(timeStr string, delta *utils.TDelta) (string, error) {
 	return truncatedTime.Format(utils.TimeFormat), nil
 }
 
+// errMatchMiss is returned for an asset that missed a criteria with a "skip" onMiss
+var errMatchMiss = errors.New("asset skipped, criteria yielded no value")
+
+// errSplitOutOfRange is wrapped by the split errors of an asset with too few parts
+var errSplitOutOfRange = errors.New("out of range")
+
 /**************************************************************************************************
 ** applyCriteriaWithPromote generates a list of identifying strings for a given asset based on a
 ** set of criteria, and also extracts promotion values from regex criteria if specified.
@@ -111,47 +343,55 @@ func extractTimeWithDelta(timeStr string, delta *utils.TDelta) (string, error) {
 ** @param asset - The utils.TAsset to apply criteria to.
 ** @param criteria - A slice of utils.TCriteria defining how to extract and transform
 **                   asset properties.
+** @param sampler - Sampler of the extracted values, by criteria position (nil samples nothing)
 ** @return []string - A slice of strings that collectively identify the asset based on
 **                    the applied criteria. Empty strings resulting from extractors are
 **                    omitted.
 ** @return map[string]string - A map of criteria identifier to promotion value for regex criteria
 **                              with promote_index configured. Uses format "key:index" to avoid
 **                              collisions when multiple criteria use the same key.
-** @return error - An error if an unknown criteria key is encountered or if any
-**                 extractor function returns an error.
+** @return error - An error if an unknown criteria key is encountered, if any extractor
+**                 function returns an error, or if a criteria with an "error" onMiss yields
+**                 no value. A criteria with a "skip" onMiss yielding no value returns
+**                 errMatchMiss.
 **************************************************************************************************/
-func applyCriteriaWithPromote(asset utils.TAsset, criteria []utils.TCriteria) ([]string, map[string]string, error) {
+func applyCriteriaWithPromote(asset utils.TAsset, criteria []utils.TCriteria, sampler *criteriaSampler) ([]string, map[string]string, error) {
 	result := make([]string, 0, len(criteria))
 	// Use criteria index-based keys to avoid collisions when multiple criteria use the same key
 	// Format: "key:index" where index is the position in the criteria slice
 	promoteValues := make(map[string]string)
 
 	for i, c := range criteria {
-		var value string
-		var promoteValue string
-		var err error
-
-		// Handle special cases that can return promotion values
-		switch c.Key {
-		case "originalFileName":
-			value, promoteValue, err = extractOriginalFileName(asset, c)
-		case "originalPath":
-			value, promoteValue, err = extractOriginalPath(asset, c)
-		default:
-			// For other extractors, use the shared extractor logic
-			extractor, ok := getExtractor(c.Key)
-			if !ok {
-				return nil, nil, fmt.Errorf("unknown criteria key: %s", c.Key)
-			}
-			value, err = extractor(asset, c)
+		value, promoteValue, err := extractCriterion(asset, c)
+		if errors.Is(err, errUnknownCriteriaKey) {
+			return nil, nil, err
+		}
+		if err == nil {
+			sampler.observe(i, asset, value, promoteValue)
+		} else {
+			sampler.observe(i, asset, "", "")
 		}
 
 		if err != nil {
-			return nil, nil, err
+			// Too few parts to split is a miss, the asset is left out with a "skip" onMiss
+			if c.OnMiss == utils.OnMissSkip && errors.Is(err, errSplitOutOfRange) {
+				return nil, nil, fmt.Errorf("%w: %s%s", errMatchMiss, c.Key, regexSubject(c))
+			}
+			return nil, nil, &criterionError{position: fmt.Sprintf("#%d", i+1), criteria: c, err: err}
 		}
 
 		if value != "" {
 			result = append(result, value)
+		} else if c.Value != "" {
+			// A type value is a filter, the assets of other types are always left out
+			return nil, nil, fmt.Errorf("%w: %s", errMatchMiss, c.Key)
+		} else {
+			switch c.OnMiss {
+			case utils.OnMissSkip:
+				return nil, nil, fmt.Errorf("%w: %s%s", errMatchMiss, c.Key, regexSubject(c))
+			case utils.OnMissError:
+				return nil, nil, fmt.Errorf("criteria %s yielded no value%s", c.Key, regexSubject(c))
+			}
 		}
 
 		// Store promotion value if present (including empty strings, which are valid promote values)
@@ -165,39 +405,98 @@ func applyCriteriaWithPromote(asset utils.TAsset, criteria []utils.TCriteria) ([
 	return result, promoteValues, nil
 }
 
+// errUnknownCriteriaKey is wrapped by the error of a criteria key without extractor
+var errUnknownCriteriaKey = errors.New("unknown criteria key")
+
+/**************************************************************************************************
+** extractCriterion extracts the value of a single criterion from an asset, and the promote value
+** of a regex with promote_index on the file name or the path.
+**
+** @param asset - The asset
+** @param c - The criterion
+** @return string - The extracted value, empty when the asset has none
+** @return string - The promote value, empty without promote_index
+** @return error - An error wrapping errUnknownCriteriaKey for an unknown key, or the error of
+**                 the extractor
+**************************************************************************************************/
+func extractCriterion(asset utils.TAsset, c utils.TCriteria) (string, string, error) {
+	// Handle special cases that can return promotion values
+	switch c.Key {
+	case "originalFileName":
+		return extractOriginalFileName(asset, c)
+	case "originalPath":
+		return extractOriginalPath(asset, c)
+	}
+	// For other extractors, use the shared extractor logic
+	extractor, ok := getExtractor(c.Key)
+	if !ok {
+		return "", "", fmt.Errorf("%w: %s", errUnknownCriteriaKey, c.Key)
+	}
+	value, err := extractor(asset, c)
+	return value, "", err
+}
+
 /**************************************************************************************************
 ** extractOriginalFileName extracts and processes the original file name from an asset
 ** according to the provided criteria. It uses shared helper functions for common operations.
+** A normalize transform is applied to the whole file name first. The regex is matched against
+** the full file name, or without its extension with stripExtension, as the split always is.
 **
 ** @param asset - The utils.TAsset from which to extract the original file name.
-** @param c - The utils.TCriteria containing potential split or regex parameters.
+** @param c - The utils.TCriteria containing potential normalize, split or regex parameters.
 ** @return string - The processed original file name (base name, potentially split or matched).
 ** @return string - The promotion value if regex promote_index is specified, empty otherwise.
 ** @return error - An error if the split index is out of range for the resulting parts,
 **                 if regex compilation fails, or if the regex index is out of range.
 **************************************************************************************************/
 func extractOriginalFileName(asset utils.TAsset, c utils.TCriteria) (string, string, error) {
-	// Handle regex processing if configured - use full filename including extension
-	if c.Regex != nil && c.Regex.Key != "" {
-		return applyRegexWithPromote(asset.OriginalFileName, c.Regex.Key, c.Regex.Index, c.Regex.PromoteIndex)
+	fileName := asset.OriginalFileName
+	if c.Normalize == utils.NormalizeStripEditedSuffix {
+		fileName, _ = cutEditedSuffix(fileName, c.EditedSuffixes)
 	}
 
-	// For split mode, remove extension first
-	baseName := asset.OriginalFileName
-	ext := filepath.Ext(baseName)
-	if ext != "" {
-		baseName = baseName[:len(baseName)-len(ext)]
+	// The extension is removed whatever its case, .JPG as .jpg
+	baseName := strings.TrimSuffix(fileName, path.Ext(fileName))
+
+	// Handle regex processing if configured - use full filename including extension unless stripped
+	if c.Regex != nil && c.Regex.Key != "" {
+		subject := fileName
+		if c.StripExtension {
+			subject = baseName
+		}
+		value, promoteValue, err := applyRegexWithPromote(subject, c.Regex)
+		if err != nil {
+			return "", "", fmt.Errorf("%w%s", err, regexSubject(c))
+		}
+		return value, promoteValue, nil
 	}
 
 	// Handle delimiter-based split processing if configured
 	if c.Split != nil && len(c.Split.Delimiters) > 0 {
-		result, err := splitByDelimiters(baseName, c.Split.Delimiters, c.Split.Index)
+		result, err := applySplit(baseName, c.Split)
 		return result, "", err
 	}
 
 	return baseName, "", nil
 }
 
+/**************************************************************************************************
+** regexSubject tells which form of the file name a regex criteria was matched against, for the
+** errors and the logs of an asset it did not match.
+**
+** @param c - The criteria
+** @return string - The form in parentheses, empty for a criteria without a filename regex
+**************************************************************************************************/
+func regexSubject(c utils.TCriteria) string {
+	if c.Key != "originalFileName" || c.Regex == nil || c.Regex.Key == "" {
+		return ""
+	}
+	if c.StripExtension {
+		return " (regex matched against the file name without its extension)"
+	}
+	return " (regex matched against the file name with its extension)"
+}
+
 /**************************************************************************************************
 ** extractOriginalPath extracts and processes the original path from an asset according
 ** to the provided criteria. It uses shared helper functions for common operations.
@@ -211,16 +510,22 @@ func extractOriginalFileName(asset utils.TAsset, c utils.TCriteria) (string, str
 **************************************************************************************************/
 func extractOriginalPath(asset utils.TAsset, c utils.TCriteria) (string, string, error) {
 	// Always normalize path separators to forward slashes
-	path := strings.ReplaceAll(asset.OriginalPath, "\\", "/")
+	path := utils.NormalizePathSeparators(asset.OriginalPath)
 
 	// Handle regex processing if configured
 	if c.Regex != nil && c.Regex.Key != "" {
-		return applyRegexWithPromote(path, c.Regex.Key, c.Regex.Index, c.Regex.PromoteIndex)
+		return applyRegexWithPromote(path, c.Regex)
 	}
 
 	// Handle delimiter-based split processing if configured
 	if c.Split != nil && len(c.Split.Delimiters) > 0 {
-		result, err := splitByDelimiters(path, c.Split.Delimiters, c.Split.Index)
+		// A backslash delimiter splits the normalized path on its forward slashes
+		split := *c.Split
+		split.Delimiters = make([]string, len(c.Split.Delimiters))
+		for i, delim := range c.Split.Delimiters {
+			split.Delimiters[i] = utils.NormalizePathSeparators(delim)
+		}
+		result, err := applySplit(path, &split)
 		return result, "", err
 	}
 
@@ -231,15 +536,16 @@ func extractOriginalPath(asset utils.TAsset, c utils.TCriteria) (string, string,
 ** applyRegexWithPromote applies a regex pattern to input text and extracts values at specified
 ** indices. This consolidates the common regex logic used by both filename and path extractors.
 **
+** With Indices, the main value is the capture groups at those indices joined by Joiner.
+**
 ** @param input - The input string to match against
-** @param pattern - The regex pattern to compile and apply
-** @param index - The capture group index for the main value
-** @param promoteIndex - Optional capture group index for promotion value
-** @return string - The matched value at the specified index
-** @return string - The promotion value if promoteIndex is specified, empty otherwise
+** @param r - The regex operation: pattern, capture group indices and promote index
+** @return string - The matched value at the specified index or indices
+** @return string - The promotion value if PromoteIndex is specified, empty otherwise
 ** @return error - Error if regex compilation fails or indices are out of range
 **************************************************************************************************/
-func applyRegexWithPromote(input string, pattern string, index int, promoteIndex *int) (string, string, error) {
+func applyRegexWithPromote(input string, r *utils.TRegex) (string, string, error) {
+	pattern, index, promoteIndex := r.Key, r.Index, r.PromoteIndex
 	regex, err := utils.RegexCompile(pattern)
 	if err != nil {
 		return "", "", fmt.Errorf("failed to compile regex %q: %w", pattern, err)
@@ -253,22 +559,60 @@ func applyRegexWithPromote(input string, pattern string, index int, promoteIndex
 		return "", "", nil
 	}
 
-	if index < 0 || index >= len(matches) {
-		return "", "", fmt.Errorf("regex capture group index %d out of range for %q (found %d groups)",
-			index, input, len(matches)-1)
+	indices := r.Indices
+	if len(indices) == 0 {
+		indices = []int{index}
+	}
+	values := make([]string, 0, len(indices))
+	matched := false
+	for _, i := range indices {
+		if i < 0 || i >= len(matches) {
+			return "", "", fmt.Errorf("regex %q capture group index %d out of range for %q (found %d groups)",
+				pattern, i, input, len(matches)-1)
+		}
+		values = append(values, matches[i])
+		matched = matched || matches[i] != ""
+	}
+	// Optional groups that all stayed empty yield no value, not a key made of joiners
+	value := ""
+	if matched {
+		value = strings.Join(values, r.Joiner)
 	}
 
 	// Extract promotion value if promote_index is specified
 	promoteValue := ""
 	if promoteIndex != nil {
 		if *promoteIndex < 0 || *promoteIndex >= len(matches) {
-			return "", "", fmt.Errorf("regex promote capture group index %d out of range for %q (found %d groups)",
-				*promoteIndex, input, len(matches)-1)
+			return "", "", fmt.Errorf("regex %q promote capture group index %d out of range for %q (found %d groups)",
+				pattern, *promoteIndex, input, len(matches)-1)
 		}
 		promoteValue = matches[*promoteIndex]
 	}
 
-	return matches[index], promoteValue, nil
+	return value, promoteValue, nil
+}
+
+/**************************************************************************************************
+** applySplit applies a split operation to the input text: a single part by index, or a range
+** of parts joined by the first delimiter when From or To is set.
+**
+** @param input - The input string to split
+** @param split - The split operation
+** @return string - The selected part or parts
+** @return error - Error wrapping errSplitOutOfRange if the index or range is out of range
+**************************************************************************************************/
+func applySplit(input string, split *utils.TSplit) (string, error) {
+	if split.From == nil && split.To == nil {
+		return splitByDelimiters(input, split.Delimiters, split.Index)
+	}
+	from, to := 0, -1
+	if split.From != nil {
+		from = *split.From
+	}
+	if split.To != nil {
+		to = *split.To
+	}
+	return splitRangeByDelimiters(input, split.Delimiters, from, to)
 }
 
 /**************************************************************************************************
@@ -277,19 +621,52 @@ func applyRegexWithPromote(input string, pattern string, index int, promoteIndex
 **
 ** @param input - The input string to split
 ** @param delimiters - List of delimiters to split by
-** @param index - The index of the part to return
+** @param index - The index of the part to return, negative indices counting from the end
 ** @return string - The part at the specified index
-** @return error - Error if the index is out of range
+** @return error - Error wrapping errSplitOutOfRange if the index is out of range
 **************************************************************************************************/
 func splitByDelimiters(input string, delimiters []string, index int) (string, error) {
-	// Early return if no delimiters - just validate index
-	if len(delimiters) == 0 {
-		if index == 0 {
-			return input, nil
-		}
-		return "", fmt.Errorf("split index %d out of range for %q", index, input)
+	parts := splitParts(input, delimiters)
+	i, ok := resolveSplitIndex(index, len(parts))
+	if !ok {
+		return "", fmt.Errorf("split index %d %w for %q", index, errSplitOutOfRange, input)
 	}
+	return parts[i], nil
+}
 
+/**************************************************************************************************
+** splitRangeByDelimiters splits input text by multiple delimiters and returns the parts from
+** one index to another, both included, joined by the first delimiter.
+**
+** @param input - The input string to split
+** @param delimiters - List of delimiters to split by
+** @param from - Index of the first part, negative indices counting from the end
+** @param to - Index of the last part, negative indices counting from the end
+** @return string - The parts of the range joined together
+** @return error - Error wrapping errSplitOutOfRange if the range is out of range or empty
+**************************************************************************************************/
+func splitRangeByDelimiters(input string, delimiters []string, from int, to int) (string, error) {
+	parts := splitParts(input, delimiters)
+	start, okStart := resolveSplitIndex(from, len(parts))
+	end, okEnd := resolveSplitIndex(to, len(parts))
+	if !okStart || !okEnd || start > end {
+		return "", fmt.Errorf("split range %d to %d %w for %q", from, to, errSplitOutOfRange, input)
+	}
+	joiner := ""
+	if len(delimiters) > 0 {
+		joiner = delimiters[0]
+	}
+	return strings.Join(parts[start:end+1], joiner), nil
+}
+
+/**************************************************************************************************
+** splitParts splits input text by each delimiter in turn.
+**
+** @param input - The input string to split
+** @param delimiters - List of delimiters to split by
+** @return []string - The parts after all splits
+**************************************************************************************************/
+func splitParts(input string, delimiters []string) []string {
 	parts := []string{input}
 	for _, delim := range delimiters {
 		temp := []string{}
@@ -298,8 +675,20 @@ func splitByDelimiters(input string, delimiters []string, index int) (string, er
 		}
 		parts = temp
 	}
-	if index < 0 || index >= len(parts) {
-		return "", fmt.Errorf("split index %d out of range for %q", index, input)
+	return parts
+}
+
+/**************************************************************************************************
+** resolveSplitIndex turns an index counted from the end when negative into a position.
+**
+** @param index - The index, -1 being the last part
+** @param count - Number of parts
+** @return int - The position of the part
+** @return bool - False when the index is out of range
+**************************************************************************************************/
+func resolveSplitIndex(index int, count int) (int, bool) {
+	if index < 0 {
+		index += count
 	}
-	return parts[index], nil
+	return index, index >= 0 && index < count
 }
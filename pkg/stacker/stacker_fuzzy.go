@@ -0,0 +1,213 @@
+package stacker
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+/**************************************************************************************************
+** mergeFuzzyGroups performs a pass before the time-based merge to unite groups whose filenames
+** differ slightly, like scan0001.jpg and scan_0001 (copy).jpg. Only the keys sharing every
+** other part, the time bucket included, are compared: the fuzzy parts are normalized and the
+** keys within the maximum distance of each other are merged, transitively, under the smallest
+** key. Buckets holding more keys than the limit are left exact, as the comparison is quadratic.
+**
+** @param groups - The groups created by exact key matching
+** @param criteria - The criteria the keys were built from, one key part per criteria
+** @param logger - Logger for the skipped buckets and the merges
+** @return map[string][]utils.TAsset - The merged groups
+**************************************************************************************************/
+func mergeFuzzyGroups(groups map[string][]utils.TAsset, criteria []utils.TCriteria, logger *logrus.Logger) map[string][]utils.TAsset {
+	var fuzzyIndices []int
+	limit := 0
+	for i, c := range criteria {
+		if c.Fuzzy == nil {
+			continue
+		}
+		fuzzyIndices = append(fuzzyIndices, i)
+		size := c.Fuzzy.MaxBucketSize
+		if size == 0 {
+			size = utils.DefaultFuzzyBucketSize
+		}
+		if limit == 0 || size < limit {
+			limit = size
+		}
+	}
+	if len(fuzzyIndices) == 0 || len(groups) < 2 {
+		return groups
+	}
+
+	buckets := make(map[string][]string)
+	for key := range groups {
+		parts := strings.Split(key, "|")
+		for _, idx := range fuzzyIndices {
+			if idx < len(parts) {
+				parts[idx] = ""
+			}
+		}
+		bucket := strings.Join(parts, "|")
+		buckets[bucket] = append(buckets[bucket], key)
+	}
+
+	merged := make(map[string][]utils.TAsset, len(groups))
+	for _, keys := range buckets {
+		if len(keys) == 1 {
+			merged[keys[0]] = groups[keys[0]]
+			continue
+		}
+		sort.Strings(keys)
+		if len(keys) > limit {
+			logger.Warnf("⚠️  Fuzzy matching skipped for a time bucket of %d filenames, above the limit of %d", len(keys), limit)
+			for _, key := range keys {
+				merged[key] = groups[key]
+			}
+			continue
+		}
+		for _, cluster := range clusterFuzzyKeys(keys, criteria, fuzzyIndices) {
+			for _, key := range cluster {
+				merged[cluster[0]] = append(merged[cluster[0]], groups[key]...)
+			}
+			if len(cluster) > 1 && logger.IsLevelEnabled(logrus.DebugLevel) {
+				logger.Debugf("Fuzzy matching merged %d keys into %s: %s", len(cluster), cluster[0], strings.Join(cluster[1:], ", "))
+			}
+		}
+	}
+	return merged
+}
+
+/**************************************************************************************************
+** clusterFuzzyKeys unites the keys of a bucket whose fuzzy parts are all within the maximum
+** distance of their criteria, transitively.
+**
+** @param keys - Keys of the bucket, sorted
+** @param criteria - The criteria the keys were built from
+** @param fuzzyIndices - Positions of the fuzzy criteria
+** @return [][]string - The clusters, each sorted, in the order of their smallest key
+**************************************************************************************************/
+func clusterFuzzyKeys(keys []string, criteria []utils.TCriteria, fuzzyIndices []int) [][]string {
+	normalized := make([][]string, len(keys))
+	for i, key := range keys {
+		parts := strings.Split(key, "|")
+		normalized[i] = make([]string, len(fuzzyIndices))
+		for j, idx := range fuzzyIndices {
+			if idx < len(parts) {
+				normalized[i][j] = normalizeFuzzyValue(parts[idx])
+			}
+		}
+	}
+
+	root := make([]int, len(keys))
+	for i := range root {
+		root[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if root[i] != i {
+			root[i] = find(root[i])
+		}
+		return root[i]
+	}
+
+	for i := range keys {
+		for j := i + 1; j < len(keys); j++ {
+			if find(i) == find(j) {
+				continue
+			}
+			similar := true
+			for k, idx := range fuzzyIndices {
+				if !withinDistance(normalized[i][k], normalized[j][k], criteria[idx].Fuzzy.MaxDistance) {
+					similar = false
+					break
+				}
+			}
+			if similar {
+				// The smallest key stays the root, so it names the cluster
+				a, b := find(i), find(j)
+				if b < a {
+					a, b = b, a
+				}
+				root[b] = a
+			}
+		}
+	}
+
+	clusters := make([][]string, 0, len(keys))
+	position := make(map[int]int)
+	for i, key := range keys {
+		r := find(i)
+		p, ok := position[r]
+		if !ok {
+			p = len(clusters)
+			position[r] = p
+			clusters = append(clusters, nil)
+		}
+		clusters[p] = append(clusters[p], key)
+	}
+	return clusters
+}
+
+/**************************************************************************************************
+** normalizeFuzzyValue lowercases a filename part and drops what copies and renames usually add:
+** parenthesized suffixes such as "(copy)" or "(1)", the word copy, and every character that is
+** not a letter or a digit.
+**
+** @param value - The filename part
+** @return string - The normalized value
+**************************************************************************************************/
+func normalizeFuzzyValue(value string) string {
+	var builder strings.Builder
+	depth := 0
+	for _, r := range strings.ReplaceAll(strings.ToLower(value), "copy", "") {
+		switch {
+		case r == '(':
+			depth++
+		case r == ')' && depth > 0:
+			depth--
+		case depth == 0 && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
+
+/**************************************************************************************************
+** withinDistance reports whether the Levenshtein distance between two values is at most max.
+**
+** @param a - First value
+** @param b - Second value
+** @param max - Maximum number of insertions, deletions and substitutions
+** @return bool - True if the values are within the distance
+**************************************************************************************************/
+func withinDistance(a, b string, max int) bool {
+	ra, rb := []rune(a), []rune(b)
+	if diff := len(ra) - len(rb); diff > max || -diff > max {
+		return false
+	}
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		best := current[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			best = min(best, current[j])
+		}
+		// Every later row is at least the smallest value of this one
+		if best > max {
+			return false
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)] <= max
+}
@@ -0,0 +1,114 @@
+package stacker
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeFuzzyValue(t *testing.T) {
+	assert.Equal(t, "scan0001", normalizeFuzzyValue("scan0001"))
+	assert.Equal(t, "scan0001", normalizeFuzzyValue("scan_0001 (copy)"))
+	assert.Equal(t, "scan0001", normalizeFuzzyValue("Scan-0001 (2)"))
+	assert.Equal(t, "scan0001", normalizeFuzzyValue("scan0001 copy"))
+}
+
+func TestWithinDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		max      int
+		expected bool
+	}{
+		{"scan0001", "scan0001", 1, true},
+		{"scan0001", "scan001", 1, true},
+		{"scan0001", "scam0011", 1, false},
+		{"scan0001", "scam0011", 2, true},
+		{"kitten", "sitting", 2, false},
+		{"kitten", "sitting", 3, true},
+		{"", "ab", 2, true},
+		{"été", "ete", 2, true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, withinDistance(tt.a, tt.b, tt.max), "%s / %s within %d", tt.a, tt.b, tt.max)
+	}
+}
+
+func TestFuzzyFilenameStacking(t *testing.T) {
+	at := func(id, name, dateTime string) utils.TAsset {
+		return utils.TAsset{ID: id, OriginalFileName: name, LocalDateTime: dateTime}
+	}
+	assets := []utils.TAsset{
+		at("1", "scan0001.jpg", "2024-03-01T10:00:00.000Z"),
+		at("2", "scan_0001 (copy).jpg", "2024-03-01T10:00:00.200Z"),
+		at("3", "Scan-0001.tif", "2024-03-01T10:00:00.400Z"),
+		at("4", "scan0002.jpg", "2024-03-01T11:00:00.000Z"), // Another bucket
+		at("5", "scan_0002.jpg", "2024-03-01T11:00:00.100Z"),
+		at("6", "holiday.jpg", "2024-03-01T10:00:00.300Z"), // Same bucket, too far
+	}
+
+	t.Run("legacy", func(t *testing.T) {
+		criteria := `[
+			{"key": "originalFileName", "split": {"delimiters": ["."], "index": 0}, "fuzzy": {"maxDistance": 1}},
+			{"key": "localDateTime", "delta": {"milliseconds": 1000}}
+		]`
+		stacks, err := New(Options{Criteria: criteria}).Stack(assets)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1 1,2,3", "4 4,5"}, stackSignatures(stacks))
+
+		// Without fuzzy matching, the names never meet
+		stacks, err = New(Options{}).Stack(assets)
+		require.NoError(t, err)
+		assert.Empty(t, stacks)
+	})
+
+	t.Run("expression", func(t *testing.T) {
+		criteria := `{"mode": "advanced", "expression": {"operator": "AND", "children": [
+			{"criteria": {"key": "originalFileName", "split": {"delimiters": ["."], "index": 0}, "fuzzy": {"maxDistance": 1}}},
+			{"criteria": {"key": "localDateTime", "delta": {"milliseconds": 1000}}}
+		]}}`
+		stacks, err := New(Options{Criteria: criteria}).Stack(assets)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1 1,2,3", "4 4,5"}, stackSignatures(stacks))
+	})
+}
+
+func TestFuzzyBucketLimit(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+
+	criteria := []utils.TCriteria{
+		{Key: "originalFileName", Fuzzy: &utils.TFuzzy{MaxDistance: 1, MaxBucketSize: 3}},
+		{Key: "localDateTime"},
+	}
+	groups := make(map[string][]utils.TAsset)
+	for i := 0; i < 4; i++ {
+		groups[fmt.Sprintf("scan000%d|2024-03-01T10:00:00Z", i)] = []utils.TAsset{{ID: fmt.Sprint(i)}}
+	}
+	merged := mergeFuzzyGroups(groups, criteria, logger)
+	assert.Len(t, merged, 4, "the bucket is left exact")
+	assert.Contains(t, out.String(), "Fuzzy matching skipped for a time bucket of 4 filenames, above the limit of 3")
+
+	delete(groups, "scan0003|2024-03-01T10:00:00Z")
+	merged = mergeFuzzyGroups(groups, criteria, logger)
+	require.Len(t, merged, 1)
+	assert.Len(t, merged["scan0000|2024-03-01T10:00:00Z"], 3, "the smallest key names the cluster")
+}
+
+func TestFuzzyValidation(t *testing.T) {
+	tests := map[string]string{
+		`[{"key": "originalPath", "fuzzy": {"maxDistance": 1}}]`:                                                                        `fuzzy is only supported on the originalFileName key, got "originalPath"`,
+		`[{"key": "originalFileName", "fuzzy": {"maxDistance": 0}}]`:                                                                    "fuzzy maxDistance must be at least 1, got 0",
+		`[{"key": "originalFileName", "fuzzy": {"maxDistance": 1, "maxBucketSize": -1}}]`:                                               "fuzzy maxBucketSize must not be negative, got -1",
+		`{"mode": "advanced", "groups": [{"operator": "AND", "criteria": [{"key": "originalFileName", "fuzzy": {"maxDistance": 1}}]}]}`: "fuzzy is not supported in the groups format",
+	}
+	for criteria, expected := range tests {
+		_, err := ParseCriteria(criteria)
+		assert.ErrorContains(t, err, expected, criteria)
+	}
+}
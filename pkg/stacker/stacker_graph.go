@@ -131,3 +131,98 @@ func dfsConnectedComponents(node int, adjacency [][]int, visited []bool, assets
 		}
 	}
 }
+
+/**************************************************************************************************
+** IsValidUnionMode checks if a union mode is supported. An empty value is treated as
+** "connected".
+**
+** @param mode - The union mode to check
+** @return bool - True if the mode is supported
+**************************************************************************************************/
+func IsValidUnionMode(mode string) bool {
+	switch mode {
+	case "", utils.UnionModeConnected, utils.UnionModeStrict:
+		return true
+	default:
+		return false
+	}
+}
+
+/**************************************************************************************************
+** strictAssetKeys keeps a single grouping key per asset: the first key, in the order of the
+** groups and criteria, that the asset shares with another asset. An asset matching other shared
+** keys is logged as a conflict, as connected mode would have merged their assets.
+**
+** @param assets - Assets that matched at least one group
+** @param assetKeys - Map from asset ID to its grouping keys, highest priority first
+** @param logger - Logger for the conflicts
+** @return map[string][]string - Map from asset ID to its kept grouping key
+**************************************************************************************************/
+func strictAssetKeys(assets []utils.TAsset, assetKeys map[string][]string, logger *logrus.Logger) map[string][]string {
+	keyCounts := make(map[string]int)
+	for _, keys := range assetKeys {
+		for _, key := range keys {
+			keyCounts[key]++
+		}
+	}
+
+	strict := make(map[string][]string, len(assetKeys))
+	for _, asset := range assets {
+		keys := assetKeys[asset.ID]
+		var shared []string
+		for _, key := range keys {
+			if keyCounts[key] > 1 {
+				shared = append(shared, key)
+			}
+		}
+		if len(shared) == 0 {
+			strict[asset.ID] = keys[:1]
+			continue
+		}
+		strict[asset.ID] = shared[:1]
+		if len(shared) > 1 {
+			logger.Infof("🔀 Union conflict: %s matched %d grouping keys, kept %s", asset.OriginalFileName, len(shared), shared[0])
+		}
+	}
+	return strict
+}
+
+/**************************************************************************************************
+** logBridgedComponents logs the components larger than the log size whose assets share no
+** common grouping key, i.e. components merged by union semantics across different keys.
+**
+** @param components - Connected components of the assets
+** @param assetKeys - Map from asset ID to its grouping keys
+** @param logSize - Components with more assets than this are logged, 0 for the default
+** @param logger - Logger for the bridged components
+**************************************************************************************************/
+func logBridgedComponents(components [][]utils.TAsset, assetKeys map[string][]string, logSize int, logger *logrus.Logger) {
+	if logSize <= 0 {
+		logSize = utils.DefaultUnionLogSize
+	}
+	for _, component := range components {
+		if len(component) <= logSize {
+			continue
+		}
+		keyCounts := make(map[string]int)
+		for _, asset := range component {
+			for _, key := range assetKeys[asset.ID] {
+				keyCounts[key]++
+			}
+		}
+		bridged := true
+		sharedKeys := 0
+		for _, count := range keyCounts {
+			if count == len(component) {
+				bridged = false
+				break
+			}
+			if count > 1 {
+				sharedKeys++
+			}
+		}
+		if bridged {
+			logger.Infof("🔗 %d assets starting with %s stacked together through %d different grouping keys", len(component), component[0].OriginalFileName, sharedKeys)
+		}
+	}
+}
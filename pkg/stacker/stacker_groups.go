@@ -12,14 +12,20 @@ import (
 **
 ** @param asset - The utils.TAsset to apply criteria to.
 ** @param groups - A slice of utils.TCriteriaGroup defining how to group assets.
+** @param sampler - Sampler of the extracted values, by position across the groups (nil samples
+**                  nothing). An AND group stops at its first empty value, the later criteria of
+**                  the group are not sampled for the asset.
 ** @return []string - A slice of grouping keys that the asset matches. Empty if no groups match.
 ** @return error - An error if any extractor function returns an error.
 **************************************************************************************************/
-func applyAdvancedCriteria(asset utils.TAsset, groups []utils.TCriteriaGroup) ([]string, error) {
+func applyAdvancedCriteria(asset utils.TAsset, groups []utils.TCriteriaGroup, sampler *criteriaSampler) ([]string, error) {
 	var groupingKeys []string
+	offset := 0 // Position of the first criterion of the group across the groups
 
 	// Process each criteria group
 	for groupIdx, group := range groups {
+		position := offset
+		offset += len(group.Criteria)
 		if group.Operator == "OR" {
 			// For OR groups, each matching criterion creates its own grouping opportunity
 			// This allows assets to be grouped by ANY of the criteria, creating multiple potential stacks
@@ -31,8 +37,9 @@ func applyAdvancedCriteria(asset utils.TAsset, groups []utils.TCriteriaGroup) ([
 
 				value, err := extractor(asset, criterion)
 				if err != nil {
-					return nil, err
+					return nil, &criterionError{position: fmt.Sprintf("group #%d criterion #%d", groupIdx+1, criteriaIdx+1), criteria: criterion, err: err}
 				}
+				sampler.observe(position+criteriaIdx, asset, value, "")
 
 				if value != "" {
 					// Create a unique key for this specific criterion match
@@ -46,7 +53,7 @@ func applyAdvancedCriteria(asset utils.TAsset, groups []utils.TCriteriaGroup) ([
 			var criteriaKeys []string
 			groupMatches := true
 
-			for _, criterion := range group.Criteria {
+			for criteriaIdx, criterion := range group.Criteria {
 				extractor, ok := getExtractor(criterion.Key)
 				if !ok {
 					return nil, fmt.Errorf("unknown criteria key: %s", criterion.Key)
@@ -54,8 +61,9 @@ func applyAdvancedCriteria(asset utils.TAsset, groups []utils.TCriteriaGroup) ([
 
 				value, err := extractor(asset, criterion)
 				if err != nil {
-					return nil, err
+					return nil, &criterionError{position: fmt.Sprintf("group #%d criterion #%d", groupIdx+1, criteriaIdx+1), criteria: criterion, err: err}
 				}
+				sampler.observe(position+criteriaIdx, asset, value, "")
 
 				if value == "" {
 					groupMatches = false
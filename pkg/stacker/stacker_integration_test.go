@@ -231,3 +231,40 @@ func TestStackByRAWJPEGPairs(t *testing.T) {
 		}
 	}
 }
+
+func TestStackWindowsPaths(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	// A library imported from a Windows share, partly with forward slashes
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_1.jpg", OriginalPath: `\\nas\photos\2023\IMG_1.jpg`, LocalDateTime: "2023-05-01T10:00:00.000Z"},
+		{ID: "2", OriginalFileName: "IMG_1.dng", OriginalPath: `\\nas\photos\2023\IMG_1.dng`, LocalDateTime: "2023-05-01T10:00:00.000Z"},
+		{ID: "3", OriginalFileName: "IMG_1.heic", OriginalPath: "//nas/photos/2023/IMG_1.heic", LocalDateTime: "2023-05-01T10:00:00.000Z"},
+		{ID: "4", OriginalFileName: "IMG_1.jpg", OriginalPath: `\\nas\photos\2024\IMG_1.jpg`, LocalDateTime: "2024-05-01T10:00:00.000Z"},
+		{ID: "5", OriginalFileName: "IMG_1.dng", OriginalPath: `\\nas\photos\2024\IMG_1.dng`, LocalDateTime: "2024-05-01T10:00:00.000Z"},
+	}
+
+	// The backslash delimiter is accepted as is and counts from the end of the path
+	criteria := `[{"key":"originalPath","split":{"delimiters":["\\"],"index":-2}},{"key":"originalFileName","split":{"delimiters":["."],"index":0}}]`
+	stacks, err := New(Options{Criteria: criteria, Logger: logger}).Stack(assets)
+	if err != nil {
+		t.Fatalf("Stack failed: %v", err)
+	}
+	if len(stacks) != 2 {
+		t.Fatalf("expected 2 stacks, got %d", len(stacks))
+	}
+	for _, stack := range stacks {
+		if stack.Parent.ID != "1" && stack.Parent.ID != "4" {
+			t.Errorf("expected the JPEG as parent of %s, got %s", stack.Key, stack.Parent.OriginalPath)
+		}
+	}
+	if len(stacks[0].Members)+len(stacks[1].Members) != 5 {
+		t.Errorf("expected the folders with either separator to stack together, got %v", stacks)
+	}
+
+	// A delimiter in a folder name is not a suffix of the file name
+	if n := extractLargestNumberSuffix(`\\nas\photos_2023\IMG5.jpg`, []string{"_"}); n != 0 {
+		t.Errorf("expected no numeric suffix, got %d", n)
+	}
+}
@@ -0,0 +1,144 @@
+package stacker
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+/**************************************************************************************************
+** keyTemplateData is what a stack key template is executed on: Values holds the value of each
+** legacy criterion by position, empty for a miss, as {{index .Values 0}}.
+**************************************************************************************************/
+type keyTemplateData struct {
+	Values []string
+}
+
+/**************************************************************************************************
+** CheckStackKeyTemplate parses the stack key template of the options and executes it once on
+** empty values, so a template that cannot render a key fails before any asset is fetched. The
+** template applies to legacy criteria only.
+**
+** @param opts - Options with the Criteria and the StackKeyTemplate of the run
+** @return error - An error if the template is invalid or the criteria are advanced
+**************************************************************************************************/
+func CheckStackKeyTemplate(opts Options) error {
+	if opts.StackKeyTemplate == "" {
+		return nil
+	}
+	config, err := getCriteriaConfig(opts.Criteria)
+	if err != nil {
+		return fmt.Errorf("failed to get criteria config: %w", err)
+	}
+	_, err = parseKeyTemplate(opts.StackKeyTemplate, config)
+	return err
+}
+
+/**************************************************************************************************
+** parseKeyTemplate parses a stack key template and executes it on as many empty values as there
+** are criteria, which reports an index past the last criterion.
+**
+** @param text - The template, empty for none
+** @param config - Criteria of the run
+** @return *template.Template - The template, nil when text is empty
+** @return error - An error if the template is invalid or the criteria are advanced
+**************************************************************************************************/
+func parseKeyTemplate(text string, config CriteriaConfig) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	if config.Mode == "advanced" {
+		return nil, fmt.Errorf("the stack key template applies to legacy criteria only, advanced criteria build their own keys")
+	}
+	tmpl, err := template.New("stack-key").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stack key template: %w", err)
+	}
+	if _, err := renderKeyTemplate(tmpl, make([]string, len(config.Legacy))); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+/**************************************************************************************************
+** renderKeyTemplate renders the grouping key of the criteria values.
+**
+** @param tmpl - The stack key template
+** @param values - Value of each criterion by position
+** @return string - The rendered key
+** @return error - An error if the template cannot be executed on the values
+**************************************************************************************************/
+func renderKeyTemplate(tmpl *template.Template, values []string) (string, error) {
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, keyTemplateData{Values: values}); err != nil {
+		return "", fmt.Errorf("invalid stack key template: %w", err)
+	}
+	return out.String(), nil
+}
+
+/**************************************************************************************************
+** criterionValues returns the value of each criterion for an asset by position, empty for a
+** miss, unlike applyCriteriaWithPromote which leaves the misses out of the key.
+**
+** @param asset - The asset
+** @param criteria - Legacy criteria
+** @return []string - Value of each criterion
+**************************************************************************************************/
+func criterionValues(asset utils.TAsset, criteria []utils.TCriteria) []string {
+	values := make([]string, len(criteria))
+	for i, c := range criteria {
+		if value, _, err := extractCriterion(asset, c); err == nil {
+			values[i] = value
+		}
+	}
+	return values
+}
+
+/**************************************************************************************************
+** applyKeyTemplate keys the groups of the legacy criteria by the stack key template, merging the
+** groups whose rendered keys are equal: a value the template leaves out no longer keeps assets
+** apart. The template renders the values of the first asset of each group, so a group the time
+** delta or the fuzzy match already merged keeps one key. A group rendering an empty key is left
+** out, as an asset without any criteria value.
+**
+** @param groups - Groups by raw grouping key
+** @param criteria - Legacy criteria
+** @param tmpl - The stack key template
+** @param logger - Logger of the rendered keys
+** @return map[string][]utils.TAsset - Groups by rendered key
+** @return map[string][]string - Criteria values of the first group of each rendered key
+** @return error - An error if the template cannot be executed
+**************************************************************************************************/
+func applyKeyTemplate(groups map[string][]utils.TAsset, criteria []utils.TCriteria, tmpl *template.Template, logger *logrus.Logger) (map[string][]utils.TAsset, map[string][]string, error) {
+	rawKeys := make([]string, 0, len(groups))
+	for key := range groups {
+		rawKeys = append(rawKeys, key)
+	}
+	sort.Strings(rawKeys)
+
+	rendered := make(map[string][]utils.TAsset, len(groups))
+	valuesByKey := make(map[string][]string, len(groups))
+	for _, rawKey := range rawKeys {
+		group := groups[rawKey]
+		values := criterionValues(group[0], criteria)
+		key, err := renderKeyTemplate(tmpl, values)
+		if err != nil {
+			return nil, nil, err
+		}
+		if strings.TrimSpace(key) == "" {
+			continue
+		}
+		if _, ok := valuesByKey[key]; !ok {
+			valuesByKey[key] = values
+		} else if logger.IsLevelEnabled(logrus.DebugLevel) {
+			logger.Debugf("Stack key template merged the group %q into %q", rawKey, key)
+		}
+		rendered[key] = append(rendered[key], group...)
+	}
+	return rendered, valuesByKey, nil
+}
@@ -0,0 +1,66 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Test cases for the grouping keys built by StackKeyTemplate
+************************************************************************************************/
+
+func TestStackKeyTemplate(t *testing.T) {
+	// Two JPG and RAW pairs of a same day, and a third file a minute later
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "20230503_A.jpg", LocalDateTime: "2023-05-03T15:28:00.000Z"},
+		{ID: "2", OriginalFileName: "20230503_A.dng", LocalDateTime: "2023-05-03T15:28:00.000Z"},
+		{ID: "3", OriginalFileName: "20230503_B.jpg", LocalDateTime: "2023-05-03T15:29:00.000Z"},
+		{ID: "4", OriginalFileName: "20230504_C.jpg", LocalDateTime: "2023-05-04T09:00:00.000Z"},
+	}
+	criteria := `[{"key":"originalFileName","split":{"delimiters":["_"],"index":0}},{"key":"localDateTime"}]`
+
+	t.Run("without template every value counts", func(t *testing.T) {
+		stacks, err := New(Options{Criteria: criteria}).Stack(assets)
+		require.NoError(t, err)
+		require.Len(t, stacks, 1)
+		assert.Equal(t, "20230503|2023-05-03T15:28:00.000000000Z", stacks[0].Key)
+		assert.Nil(t, stacks[0].Values)
+	})
+
+	t.Run("values left out of the template are informational", func(t *testing.T) {
+		stacks, err := New(Options{Criteria: criteria, StackKeyTemplate: "day={{index .Values 0}}"}).Stack(assets)
+		require.NoError(t, err)
+		require.Len(t, stacks, 1)
+		assert.Equal(t, "day=20230503", stacks[0].Key)
+		assert.ElementsMatch(t, []string{"1", "2", "3"}, stackMemberIDs(stacks[0]))
+		assert.Equal(t, []string{"20230503", "2023-05-03T15:28:00.000000000Z"}, stacks[0].Values)
+	})
+
+	t.Run("reordered values keep the grouping", func(t *testing.T) {
+		stacks, err := New(Options{Criteria: criteria, StackKeyTemplate: "{{index .Values 1}}/{{index .Values 0}}"}).Stack(assets)
+		require.NoError(t, err)
+		require.Len(t, stacks, 1)
+		assert.Equal(t, "2023-05-03T15:28:00.000000000Z/20230503", stacks[0].Key)
+		assert.ElementsMatch(t, []string{"1", "2"}, stackMemberIDs(stacks[0]))
+	})
+
+	t.Run("invalid templates", func(t *testing.T) {
+		_, err := New(Options{Criteria: criteria, StackKeyTemplate: "{{index .Values 0"}).Stack(assets)
+		assert.ErrorContains(t, err, "invalid stack key template")
+
+		_, err = New(Options{Criteria: criteria, StackKeyTemplate: "{{index .Values 2}}"}).Stack(assets)
+		assert.ErrorContains(t, err, "invalid stack key template")
+
+		_, err = New(Options{Criteria: `{"mode":"advanced","groups":[{"operator":"AND","criteria":[{"key":"localDateTime"}]}]}`, StackKeyTemplate: "{{index .Values 0}}"}).Stack(assets)
+		assert.ErrorContains(t, err, "legacy criteria only")
+	})
+
+	t.Run("startup check", func(t *testing.T) {
+		assert.NoError(t, CheckStackKeyTemplate(Options{}))
+		assert.NoError(t, CheckStackKeyTemplate(Options{StackKeyTemplate: "{{index .Values 1}}"}), "the default criteria have two values")
+		assert.ErrorContains(t, CheckStackKeyTemplate(Options{StackKeyTemplate: "{{.Missing}}"}), "invalid stack key template")
+	})
+}
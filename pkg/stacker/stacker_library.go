@@ -0,0 +1,99 @@
+package stacker
+
+import (
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+/**************************************************************************************************
+** splitByLibrary splits the stacks mixing assets of several libraries into one stack per
+** library, as if the library was part of the grouping key. An external library rescan can
+** otherwise break stacks shared with uploaded assets of the same name. Members keep their
+** sorted order, so the first member of each library becomes its parent. Stacks left with a
+** single asset are dropped.
+**
+** @param stacks - Stacks built from the criteria
+** @param logger - Logger for debug output
+** @return []Stack - Stacks whose members all belong to the same library
+**************************************************************************************************/
+func splitByLibrary(stacks []Stack, logger *logrus.Logger) []Stack {
+	return splitByField(stacks, "libraryId", func(asset utils.TAsset) string { return asset.LibraryID }, logger)
+}
+
+/**************************************************************************************************
+** splitByOwner splits the stacks mixing assets of several owners into one stack per owner, as if
+** the owner was part of the grouping key. Immich rejects a stack mixing owners, which happens
+** when the search returns the assets a partner shares.
+**
+** @param stacks - Stacks built from the criteria
+** @param logger - Logger for debug output
+** @return []Stack - Stacks whose members all belong to the same owner
+**************************************************************************************************/
+func splitByOwner(stacks []Stack, logger *logrus.Logger) []Stack {
+	return splitByField(stacks, "ownerId", func(asset utils.TAsset) string { return asset.OwnerID }, logger)
+}
+
+/**************************************************************************************************
+** splitByVisibility splits the stacks mixing hidden or locked assets with visible ones, as if the
+** visibility was part of the grouping key: the stack badge of a visible parent would reveal the
+** hidden members in the timeline. The live photo videos, which Immich hides, stay with their
+** image.
+**
+** @param stacks - Stacks built from the criteria
+** @param assets - All assets being stacked, for their live photo videos
+** @param logger - Logger for debug output
+** @return []Stack - Stacks whose members are all visible, all hidden or all locked
+**************************************************************************************************/
+func splitByVisibility(stacks []Stack, assets []utils.TAsset, logger *logrus.Logger) []Stack {
+	videos := livePhotoVideoIDs(assets)
+	return splitByField(stacks, "visibility", func(asset utils.TAsset) string {
+		if videos[asset.ID] || !utils.IsHiddenAsset(asset) {
+			return ""
+		}
+		return asset.Visibility
+	}, logger)
+}
+
+/**************************************************************************************************
+** splitByField splits the stacks whose members differ on a field into one stack per value, keyed
+** by the stack key followed by |name=value. Members keep their sorted order and stacks left with
+** a single asset are dropped.
+**
+** @param stacks - Stacks to split
+** @param name - Name of the field, in the keys and the logs
+** @param value - Returns the field of an asset
+** @param logger - Logger for debug output
+** @return []Stack - Stacks whose members share the field
+**************************************************************************************************/
+func splitByField(stacks []Stack, name string, value func(utils.TAsset) string, logger *logrus.Logger) []Stack {
+	result := make([]Stack, 0, len(stacks))
+	for _, stack := range stacks {
+		var values []string
+		byValue := make(map[string][]utils.TAsset)
+		for _, member := range stack.Members {
+			v := value(member)
+			if _, ok := byValue[v]; !ok {
+				values = append(values, v)
+			}
+			byValue[v] = append(byValue[v], member)
+		}
+		if len(values) == 1 {
+			result = append(result, stack)
+			continue
+		}
+
+		if logger.IsLevelEnabled(logrus.DebugLevel) {
+			logger.Debugf("Splitting stack %s across %d %s values", stack.Key, len(values), name)
+		}
+		for _, v := range values {
+			if members := byValue[v]; len(members) > 1 {
+				split := newStack(members, stack.Key+"|"+name+"="+v)
+				split.Branch = stack.Branch
+				split.Values = stack.Values
+				split.Profile = stack.Profile
+				result = append(result, split)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,167 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Test cases for the library guard
+************************************************************************************************/
+
+func TestLibraryGuard(t *testing.T) {
+	at := "2024-01-01T10:00:00.000Z"
+	assets := []utils.TAsset{
+		{ID: "upload-jpg", OriginalFileName: "IMG_0001.jpg", LocalDateTime: at},
+		{ID: "upload-dng", OriginalFileName: "IMG_0001.dng", LocalDateTime: at},
+		{ID: "nas-jpg", OriginalFileName: "IMG_0001.jpg", LocalDateTime: at, LibraryID: "nas"},
+		{ID: "nas-dng", OriginalFileName: "IMG_0001.dng", LocalDateTime: at, LibraryID: "nas"},
+		{ID: "nas-only", OriginalFileName: "IMG_0002.jpg", LocalDateTime: at, LibraryID: "nas"},
+		{ID: "upload-only", OriginalFileName: "IMG_0002.dng", LocalDateTime: at},
+	}
+
+	t.Run("stacks are split by library", func(t *testing.T) {
+		stacks, err := New(Options{}).Stack(assets)
+		require.NoError(t, err)
+
+		var got [][]string
+		for _, stack := range stacks {
+			got = append(got, stackMemberIDs(stack))
+		}
+		assert.ElementsMatch(t, [][]string{{"upload-jpg", "upload-dng"}, {"nas-jpg", "nas-dng"}}, got, "stacks left with one asset are dropped")
+		for _, stack := range stacks {
+			assert.Contains(t, stack.Key, "|libraryId=")
+		}
+	})
+
+	t.Run("CrossLibraryStacking keeps mixed stacks", func(t *testing.T) {
+		stacks, err := New(Options{CrossLibraryStacking: true}).Stack(assets)
+		require.NoError(t, err)
+		require.Len(t, stacks, 2)
+		for _, stack := range stacks {
+			assert.NotContains(t, stack.Key, "libraryId")
+		}
+	})
+
+	t.Run("stacks of a single library keep their key", func(t *testing.T) {
+		stacks, err := New(Options{}).Stack(assets[:2])
+		require.NoError(t, err)
+		require.Len(t, stacks, 1)
+		assert.NotContains(t, stacks[0].Key, "libraryId")
+	})
+
+	t.Run("libraryId criteria key", func(t *testing.T) {
+		criteria := `{"mode":"advanced","expression":{"operator":"AND","children":[
+			{"criteria":{"key":"libraryId","regex":{"key":"^nas$"}}},
+			{"criteria":{"key":"localDateTime"}}
+		]}}`
+		stacks, err := New(Options{Criteria: criteria}).Stack(assets)
+		require.NoError(t, err)
+		require.Len(t, stacks, 1)
+		assert.ElementsMatch(t, []string{"nas-jpg", "nas-dng", "nas-only"}, stackMemberIDs(stacks[0]))
+	})
+}
+
+func TestOwnerGuard(t *testing.T) {
+	at := "2024-01-01T10:00:00.000Z"
+	assets := []utils.TAsset{
+		{ID: "mine-jpg", OriginalFileName: "IMG_0001.jpg", LocalDateTime: at, OwnerID: "me"},
+		{ID: "mine-dng", OriginalFileName: "IMG_0001.dng", LocalDateTime: at, OwnerID: "me"},
+		{ID: "partner-jpg", OriginalFileName: "IMG_0001.jpg", LocalDateTime: at, OwnerID: "partner"},
+		{ID: "partner-dng", OriginalFileName: "IMG_0001.dng", LocalDateTime: at, OwnerID: "partner"},
+		{ID: "partner-only", OriginalFileName: "IMG_0002.jpg", LocalDateTime: at, OwnerID: "partner"},
+		{ID: "mine-only", OriginalFileName: "IMG_0002.dng", LocalDateTime: at, OwnerID: "me"},
+	}
+
+	t.Run("stacks are split by owner", func(t *testing.T) {
+		stacks, err := New(Options{}).Stack(assets)
+		require.NoError(t, err)
+
+		var got [][]string
+		for _, stack := range stacks {
+			got = append(got, stackMemberIDs(stack))
+			assert.Contains(t, stack.Key, "|ownerId=")
+		}
+		assert.ElementsMatch(t, [][]string{{"mine-jpg", "mine-dng"}, {"partner-jpg", "partner-dng"}}, got, "stacks left with one asset are dropped")
+	})
+
+	t.Run("stacks of a single owner keep their key", func(t *testing.T) {
+		stacks, err := New(Options{}).Stack(assets[:2])
+		require.NoError(t, err)
+		require.Len(t, stacks, 1)
+		assert.NotContains(t, stacks[0].Key, "ownerId")
+	})
+
+	t.Run("CrossOwnerStacking keeps mixed stacks", func(t *testing.T) {
+		stacks, err := New(Options{CrossOwnerStacking: true}).Stack(assets)
+		require.NoError(t, err)
+
+		var got [][]string
+		for _, stack := range stacks {
+			got = append(got, stackMemberIDs(stack))
+			assert.NotContains(t, stack.Key, "ownerId")
+		}
+		require.Len(t, got, 2)
+		for _, ids := range got {
+			if len(ids) == 4 {
+				assert.ElementsMatch(t, []string{"mine-jpg", "mine-dng", "partner-jpg", "partner-dng"}, ids)
+			} else {
+				assert.ElementsMatch(t, []string{"partner-only", "mine-only"}, ids)
+			}
+		}
+	})
+
+	t.Run("duplicate groups are split by owner", func(t *testing.T) {
+		groups := map[string][]utils.TAsset{"duplicate": assets[:4]}
+		stacks, err := New(Options{}).StackGroups(groups)
+		require.NoError(t, err)
+		require.Len(t, stacks, 2)
+
+		stacks, err = New(Options{CrossOwnerStacking: true}).StackGroups(groups)
+		require.NoError(t, err)
+		require.Len(t, stacks, 1)
+		assert.Len(t, stacks[0].Members, 4)
+	})
+}
+
+func TestVisibilityGuard(t *testing.T) {
+	at := "2024-01-01T10:00:00.000Z"
+	assets := []utils.TAsset{
+		{ID: "visible-jpg", OriginalFileName: "IMG_0001.jpg", LocalDateTime: at, Visibility: "timeline"},
+		{ID: "visible-dng", OriginalFileName: "IMG_0001.dng", LocalDateTime: at, Visibility: "timeline"},
+		{ID: "hidden-jpg", OriginalFileName: "IMG_0001.jpg", LocalDateTime: at, Visibility: utils.VisibilityHidden},
+		{ID: "hidden-dng", OriginalFileName: "IMG_0001.dng", LocalDateTime: at, Visibility: utils.VisibilityHidden},
+		{ID: "locked-jpg", OriginalFileName: "IMG_0002.jpg", LocalDateTime: at, Visibility: utils.VisibilityLocked},
+		{ID: "archived-dng", OriginalFileName: "IMG_0002.dng", LocalDateTime: at, Visibility: "archive"},
+	}
+
+	t.Run("stacks never mix visible and hidden assets", func(t *testing.T) {
+		stacks, err := New(Options{}).Stack(assets)
+		require.NoError(t, err)
+
+		var got [][]string
+		for _, stack := range stacks {
+			got = append(got, stackMemberIDs(stack))
+		}
+		assert.ElementsMatch(t, [][]string{{"visible-jpg", "visible-dng"}, {"hidden-jpg", "hidden-dng"}}, got, "stacks left with one asset are dropped")
+		for _, stack := range stacks {
+			assert.Contains(t, stack.Key, "|visibility=")
+		}
+	})
+
+	t.Run("live photo videos stay with their image", func(t *testing.T) {
+		livePhoto := []utils.TAsset{
+			{ID: "heic", OriginalFileName: "IMG_0003.heic", LocalDateTime: at, Visibility: "timeline", LivePhotoVideoID: "mov"},
+			{ID: "dng", OriginalFileName: "IMG_0003.dng", LocalDateTime: at, Visibility: "timeline"},
+			{ID: "mov", OriginalFileName: "IMG_0003.mov", LocalDateTime: at, Visibility: utils.VisibilityHidden, Type: "VIDEO"},
+		}
+		stacks, err := New(Options{}).Stack(livePhoto)
+		require.NoError(t, err)
+		require.Len(t, stacks, 1)
+		assert.NotContains(t, stacks[0].Key, "visibility")
+		assert.ElementsMatch(t, []string{"heic", "dng", "mov"}, stackMemberIDs(stacks[0]))
+	})
+}
@@ -0,0 +1,119 @@
+package stacker
+
+import (
+	"github.com/majorfi/immich-stack/pkg/utils"
+)
+
+/**************************************************************************************************
+** livePhotoKey returns the value shared by the two parts of a live photo: the ID of the video
+** referenced by the image, and the video's own ID. Other images get an empty value.
+**
+** @param asset - The asset to get the key for
+** @return string - The live photo video ID, or empty if the asset is not part of a live photo
+**************************************************************************************************/
+func livePhotoKey(asset utils.TAsset) string {
+	if asset.LivePhotoVideoID != "" {
+		return asset.LivePhotoVideoID
+	}
+	if asset.Type == "VIDEO" {
+		return asset.ID
+	}
+	return ""
+}
+
+/**************************************************************************************************
+** livePhotoVideoIDs returns the IDs of the videos referenced as live photo video by the assets
+** of a stack. These videos are demoted below the images in sortStack.
+**
+** @param stack - Assets of the stack
+** @return map[string]bool - Set of referenced video IDs
+**************************************************************************************************/
+func livePhotoVideoIDs(stack []utils.TAsset) map[string]bool {
+	videos := make(map[string]bool)
+	for _, asset := range stack {
+		if asset.LivePhotoVideoID != "" {
+			videos[asset.LivePhotoVideoID] = true
+		}
+	}
+	return videos
+}
+
+/**************************************************************************************************
+** pairLivePhotos enforces that an image and the live photo video it references always end up in
+** the same stack, whatever the criteria. The video joins the stack of its image (leaving any other
+** stack it was grouped in) and is placed last. When the image is not stacked, the pair forms a new
+** stack. Stacks left with a single asset are dropped.
+**
+** @param assets - All assets being stacked
+** @param stacks - Stacks built from the criteria
+** @return []Stack - Stacks with every live photo pair grouped
+**************************************************************************************************/
+func pairLivePhotos(assets []utils.TAsset, stacks []Stack) []Stack {
+	byID := make(map[string]utils.TAsset, len(assets))
+	for _, asset := range assets {
+		byID[asset.ID] = asset
+	}
+
+	stackOf := make(map[string]int)
+	for i, stack := range stacks {
+		for _, member := range stack.Members {
+			stackOf[member.ID] = i
+		}
+	}
+
+	for _, image := range assets {
+		video, ok := byID[image.LivePhotoVideoID]
+		if image.LivePhotoVideoID == "" || !ok || video.ID == image.ID {
+			continue
+		}
+
+		imageStack, imageStacked := stackOf[image.ID]
+		videoStack, videoStacked := stackOf[video.ID]
+		if imageStacked && videoStacked && imageStack == videoStack {
+			continue
+		}
+
+		if videoStacked {
+			stacks[videoStack] = removeStackMember(stacks[videoStack], video.ID)
+		}
+		if imageStacked {
+			stacks[imageStack].Members = append(stacks[imageStack].Members, video)
+			stackOf[video.ID] = imageStack
+			continue
+		}
+
+		stacks = append(stacks, newStack([]utils.TAsset{image, video}, "livePhotoVideoId="+video.ID))
+		stackOf[image.ID] = len(stacks) - 1
+		stackOf[video.ID] = len(stacks) - 1
+	}
+
+	result := make([]Stack, 0, len(stacks))
+	for _, stack := range stacks {
+		if len(stack.Members) > 1 {
+			result = append(result, stack)
+		}
+	}
+	return result
+}
+
+/**************************************************************************************************
+** removeStackMember removes an asset from a stack, promoting the next member when the removed
+** asset was the parent.
+**
+** @param stack - The stack to remove the asset from
+** @param assetID - ID of the asset to remove
+** @return Stack - The stack without the asset
+**************************************************************************************************/
+func removeStackMember(stack Stack, assetID string) Stack {
+	members := make([]utils.TAsset, 0, len(stack.Members))
+	for _, member := range stack.Members {
+		if member.ID != assetID {
+			members = append(members, member)
+		}
+	}
+	stack.Members = members
+	if len(members) > 0 {
+		stack.Parent = members[0]
+	}
+	return stack
+}
@@ -0,0 +1,107 @@
+package stacker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Test cases for live photo pairing
+************************************************************************************************/
+
+func stackMemberIDs(stack Stack) []string {
+	ids := make([]string, len(stack.Members))
+	for i, member := range stack.Members {
+		ids[i] = member.ID
+	}
+	return ids
+}
+
+func TestLivePhotoPairing(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) string { return now.Add(d).Format(time.RFC3339) }
+
+	tests := []struct {
+		name             string
+		criteria         string
+		parentExtPromote string
+		assets           []utils.TAsset
+		expected         [][]string
+	}{
+		{
+			name:             "video is demoted below its image even when its extension is promoted",
+			parentExtPromote: ".mov,.heic",
+			assets: []utils.TAsset{
+				{ID: "video", OriginalFileName: "IMG_0001.MOV", Type: "VIDEO", LocalDateTime: at(0)},
+				{ID: "image", OriginalFileName: "IMG_0001.HEIC", Type: "IMAGE", LivePhotoVideoID: "video", LocalDateTime: at(0)},
+			},
+			expected: [][]string{{"image", "video"}},
+		},
+		{
+			name: "pair not matched by the criteria forms its own stack",
+			assets: []utils.TAsset{
+				{ID: "image", OriginalFileName: "IMG_0001.HEIC", Type: "IMAGE", LivePhotoVideoID: "video", LocalDateTime: at(0)},
+				{ID: "video", OriginalFileName: "MVIMG_0001.MOV", Type: "VIDEO", LocalDateTime: at(time.Second)},
+			},
+			expected: [][]string{{"image", "video"}},
+		},
+		{
+			name: "video joins the stack of its image and goes last",
+			assets: []utils.TAsset{
+				{ID: "raw", OriginalFileName: "IMG_0001.DNG", Type: "IMAGE", LocalDateTime: at(0)},
+				{ID: "image", OriginalFileName: "IMG_0001.HEIC", Type: "IMAGE", LivePhotoVideoID: "video", LocalDateTime: at(0)},
+				{ID: "video", OriginalFileName: "MVIMG_0001.MOV", Type: "VIDEO", LocalDateTime: at(time.Second)},
+			},
+			expected: [][]string{{"image", "raw", "video"}},
+		},
+		{
+			name: "video leaves the stack it was grouped in by the criteria",
+			assets: []utils.TAsset{
+				{ID: "image", OriginalFileName: "IMG_0001.HEIC", Type: "IMAGE", LivePhotoVideoID: "video", LocalDateTime: at(0)},
+				{ID: "video", OriginalFileName: "IMG_0002.MOV", Type: "VIDEO", LocalDateTime: at(time.Hour)},
+				{ID: "other", OriginalFileName: "IMG_0002.JPG", Type: "IMAGE", LocalDateTime: at(time.Hour)},
+			},
+			expected: [][]string{{"image", "video"}},
+		},
+		{
+			name:     "livePhotoVideoId criteria key groups the pair",
+			criteria: `[{"key":"livePhotoVideoId"}]`,
+			assets: []utils.TAsset{
+				{ID: "image", OriginalFileName: "A.HEIC", Type: "IMAGE", LivePhotoVideoID: "video"},
+				{ID: "video", OriginalFileName: "B.MOV", Type: "VIDEO"},
+				{ID: "still", OriginalFileName: "C.JPG", Type: "IMAGE"},
+			},
+			expected: [][]string{{"image", "video"}},
+		},
+		{
+			name: "missing video is ignored",
+			assets: []utils.TAsset{
+				{ID: "image", OriginalFileName: "IMG_0001.HEIC", Type: "IMAGE", LivePhotoVideoID: "video", LocalDateTime: at(0)},
+				{ID: "jpg", OriginalFileName: "IMG_0001.JPG", Type: "IMAGE", LocalDateTime: at(0)},
+			},
+			expected: [][]string{{"jpg", "image"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stacks, err := New(Options{Criteria: tt.criteria, ParentExtPromote: tt.parentExtPromote}).Stack(tt.assets)
+			require.NoError(t, err)
+			require.Len(t, stacks, len(tt.expected))
+			for i, expected := range tt.expected {
+				assert.Equal(t, expected, stackMemberIDs(stacks[i]))
+				assert.Equal(t, expected[0], stacks[i].Parent.ID)
+			}
+		})
+	}
+}
+
+func TestLivePhotoKey(t *testing.T) {
+	assert.Equal(t, "video", livePhotoKey(utils.TAsset{ID: "image", Type: "IMAGE", LivePhotoVideoID: "video"}))
+	assert.Equal(t, "video", livePhotoKey(utils.TAsset{ID: "video", Type: "VIDEO"}))
+	assert.Equal(t, "", livePhotoKey(utils.TAsset{ID: "still", Type: "IMAGE"}))
+}
@@ -1,6 +1,11 @@
 package stacker
 
-import "github.com/sirupsen/logrus"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
 
 /**************************************************************************************************
 ** logStackingResults logs stacking results with consistent format across different stacking modes.
@@ -13,3 +18,46 @@ import "github.com/sirupsen/logrus"
 func logStackingResults(mode string, stackCount, assetCount int, logger *logrus.Logger) {
 	logger.Infof("%s formed %d stacks from %d assets", mode, stackCount, assetCount)
 }
+
+/**************************************************************************************************
+** logFormedStack logs the grouping key of a stack at debug level, with the branch of the advanced
+** criteria that produced it, or the criteria values a stack key template rendered it from. The
+** key holds filenames, it is quoted so a crafted name cannot add lines or terminal sequences to
+** the logs.
+**
+** @param stack - The formed stack
+** @param logger - Logger instance to use
+**************************************************************************************************/
+func logFormedStack(stack Stack, logger *logrus.Logger) {
+	if !logger.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
+	if stack.Branch != "" {
+		logger.Debugf("Formed stack with %d assets from key %q (%s)", len(stack.Members), stack.Key, stack.Branch)
+		return
+	}
+	if len(stack.Values) > 0 {
+		logger.Debugf("Formed stack with %d assets from key %q (values %q)", len(stack.Members), stack.Key, stack.Values)
+		return
+	}
+	logger.Debugf("Formed stack with %d assets from key %q", len(stack.Members), stack.Key)
+}
+
+/**************************************************************************************************
+** describeGroupBranch names the criteria group that produced a key of the groups format, such as
+** "group #1 OR criterion #2" for "group_0_or_1_originalFileName:IMG" or "group #2 AND" for
+** "group_1_and:...".
+**
+** @param key - Grouping key built by applyAdvancedCriteria
+** @return string - The group and criterion, or an empty string for another key
+**************************************************************************************************/
+func describeGroupBranch(key string) string {
+	var group, criterion int
+	if _, err := fmt.Sscanf(key, "group_%d_or_%d_", &group, &criterion); err == nil {
+		return fmt.Sprintf("group #%d OR criterion #%d", group+1, criterion+1)
+	}
+	if _, err := fmt.Sscanf(key, "group_%d_", &group); err == nil && strings.HasPrefix(key, fmt.Sprintf("group_%d_and:", group)) {
+		return fmt.Sprintf("group #%d AND", group+1)
+	}
+	return ""
+}
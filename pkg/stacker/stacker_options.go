@@ -0,0 +1,140 @@
+package stacker
+
+import (
+	"io"
+	"text/template"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+/**************************************************************************************************
+** Options configures the stacking engine. It is the stable entry point for programs embedding
+** the stacker as a library: every setting is passed explicitly and nothing is read from the
+** environment.
+**************************************************************************************************/
+type Options struct {
+	Criteria              string           // Criteria JSON (legacy array or advanced object). Empty uses utils.DefaultCriteria
+	ParentFilenamePromote string           // Comma-separated filename substrings to promote as parent
+	ParentExtPromote      string           // Comma-separated extensions to promote as parent
+	PromoteOrder          string           // Comma-separated parent selection rules in order. Empty uses utils.DefaultPromoteOrder
+	ExtRankFallback       string           // Order of the extensions the ext rule leaves tied: utils.ExtRankFallbackBuiltin (empty), utils.ExtRankFallbackAlpha or utils.ExtRankFallbackNone
+	Delimiters            []string         // Delimiters for biggestNumber and the default criteria split. Empty derives them from originalFileName split criteria
+	EditedSuffixes        []string         // Suffixes of the edited copies matched by editedAny and stripEditedSuffix. Empty uses utils.DefaultEditedSuffixes
+	PromoteResolved       bool             // The promote block of the criteria is already applied to the settings above, so it is not applied again
+	SkipMatchMiss         bool             // Default onMiss to "skip": leave out assets missing a criteria instead of grouping them on the others
+	MaxAssetErrors        int              // Abort when more than this many assets fail to apply the criteria. 0 means no limit
+	DebugSample           int              // At debug level, log the first values each criterion extracts and their distribution. 0 logs none
+	StackKeyTemplate      string           // Go template building the grouping key from the legacy criteria values, such as {{index .Values 0}}. Empty joins them all with "|"
+	RecordTimeGaps        bool             // Record the capture time gaps kept apart by a time delta, see TimeGaps
+	CrossLibraryStacking  bool             // Allow stacks mixing assets of different libraries (external libraries and uploads)
+	CrossOwnerStacking    bool             // Allow stacks mixing assets of different owners, as an admin API key may search
+	Profiles              []utils.TProfile // Criteria profiles, each grouping the assets it selects first. Empty groups all the assets together
+	UnionMode             string           // How OR groups merge assets: utils.UnionModeConnected (empty) or utils.UnionModeStrict
+	UnionLogSize          int              // Log the components bridged by different keys with more assets than this. 0 uses utils.DefaultUnionLogSize
+	MaxTimeBucket         int              // Skip the time buckets holding more assets than this, as left by bulk imports. 0 uses utils.DefaultMaxTimeBucket
+	MaxStackTimeSpread    time.Duration    // Maximum capture time spread of a stack, whatever the criteria. 0 means no limit
+	TimeSpreadAction      string           // Action on a stack spreading more: utils.SanityActionSplit (empty) or utils.SanityActionDrop
+	RequireSameFolder     bool             // Require the members of a stack to share the folder of their original path
+	FolderAction          string           // Action on a stack spanning folders: utils.SanityActionSplit (empty) or utils.SanityActionDrop
+	MaxStackSize          int              // Maximum number of members of a stack, as the server accepts. 0 means no limit
+	OversizePolicy        string           // Policy on a larger stack: utils.OversizePolicySkip (empty) or utils.OversizePolicySplit
+	ParentSelector        ParentSelector   // Picks the parent of each stack last, ahead of the promote rules and parentOverride. Nil keeps them
+	Span                  *utils.Span      // Parent of the group and sort spans of the run. Nil traces nothing
+	Logger                *logrus.Logger   // Logger for progress and debug output. Nil discards logs
+
+	assetErrors  *assetErrorTracker // Errored assets of the current run, set by Stack
+	timeGaps     *timeGapRecorder   // Near misses of the time delta of the current run, set by Stack with RecordTimeGaps
+	promoteOrder []string           // Parsed PromoteOrder, set by Stack
+	keyTemplate  *template.Template // Parsed StackKeyTemplate, set by Stack
+}
+
+/**************************************************************************************************
+** ParentSelector picks the parent of a stack, given its members in sorted order, and returns its
+** asset ID. An error or an ID that is not a member keeps the sorted parent.
+**************************************************************************************************/
+type ParentSelector func(members []utils.TAsset) (string, error)
+
+/**************************************************************************************************
+** Stack is a group of assets that should be stacked together in Immich.
+** Members holds every asset of the stack in order, starting with the parent.
+**************************************************************************************************/
+type Stack struct {
+	Parent  utils.TAsset   // Asset selected as the stack parent
+	Members []utils.TAsset // All assets of the stack, parent first
+	Key     string         // Grouping key shared by the members
+	Profile string         // Criteria profile that grouped the stack, empty without profiles
+	Branch  string         // Part of the advanced criteria that produced the key, empty in legacy mode
+	Values  []string       // Legacy criteria values the StackKeyTemplate rendered the key from, nil without template
+}
+
+/**************************************************************************************************
+** Stacker groups assets into stacks using a fixed set of options.
+**************************************************************************************************/
+type Stacker struct {
+	opts          Options
+	erroredAssets int
+	timeGaps      []time.Duration
+}
+
+/**************************************************************************************************
+** New creates a stacker with the given options. A nil logger is replaced by one that discards
+** all output.
+**
+** @param opts - Stacking options
+** @return *Stacker - Configured stacker
+**************************************************************************************************/
+func New(opts Options) *Stacker {
+	if opts.Logger == nil {
+		opts.Logger = logrus.New()
+		opts.Logger.SetOutput(io.Discard)
+	}
+	return &Stacker{opts: opts}
+}
+
+/**************************************************************************************************
+** ErroredAssets returns the number of assets excluded by the last call to Stack because
+** applying the criteria to them failed (e.g. a malformed date).
+**
+** @return int - Number of errored assets
+**************************************************************************************************/
+func (s *Stacker) ErroredAssets() int {
+	return s.erroredAssets
+}
+
+/**************************************************************************************************
+** TimeGaps returns, with RecordTimeGaps, the capture time gaps the last call to Stack found
+** between assets matched by their other criteria but kept apart by the time delta. Only the near
+** misses, up to a minute, are recorded, to tell a time delta too tight for clocks that drift.
+**
+** @return []time.Duration - The gaps, in no particular order
+**************************************************************************************************/
+func (s *Stacker) TimeGaps() []time.Duration {
+	return s.timeGaps
+}
+
+/**************************************************************************************************
+** newStack builds a Stack from a sorted group of assets.
+**
+** @param sorted - Assets sorted with the parent first
+** @param key - Grouping key of the group
+** @return Stack - The stack
+**************************************************************************************************/
+func newStack(sorted []utils.TAsset, key string) Stack {
+	return Stack{Parent: sorted[0], Members: sorted, Key: key}
+}
+
+/**************************************************************************************************
+** stacksToAssets converts typed stacks to the [][]utils.TAsset format returned by StackBy.
+**
+** @param stacks - Stacks to convert
+** @return [][]utils.TAsset - Members of each stack, parent first
+**************************************************************************************************/
+func stacksToAssets(stacks []Stack) [][]utils.TAsset {
+	result := make([][]utils.TAsset, 0, len(stacks))
+	for _, stack := range stacks {
+		result = append(result, stack.Members)
+	}
+	return result
+}
@@ -0,0 +1,237 @@
+package stacker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Test cases for the Options based stacker API
+************************************************************************************************/
+
+func TestStackerStackReturnsTypedStacks(t *testing.T) {
+	now := time.Now()
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.CR3", LocalDateTime: now.Format(time.RFC3339)},
+		{ID: "2", OriginalFileName: "IMG_0001.JPG", LocalDateTime: now.Format(time.RFC3339)},
+		{ID: "3", OriginalFileName: "IMG_0002.JPG", LocalDateTime: now.Add(time.Hour).Format(time.RFC3339)},
+	}
+
+	stacks, err := New(Options{ParentExtPromote: ".jpg"}).Stack(assets)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+
+	stack := stacks[0]
+	assert.Equal(t, "IMG_0001.JPG", stack.Parent.OriginalFileName)
+	require.Len(t, stack.Members, 2)
+	assert.Equal(t, stack.Parent.ID, stack.Members[0].ID)
+	assert.Equal(t, "IMG_0001.CR3", stack.Members[1].OriginalFileName)
+	assert.NotEmpty(t, stack.Key)
+}
+
+func TestStackerIgnoresCriteriaEnv(t *testing.T) {
+	t.Setenv("CRITERIA", `[{"key":"originalPath"}]`)
+
+	now := time.Now().Format(time.RFC3339)
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.CR3", OriginalPath: "/a/IMG_0001.CR3", LocalDateTime: now},
+		{ID: "2", OriginalFileName: "IMG_0001.JPG", OriginalPath: "/b/IMG_0001.JPG", LocalDateTime: now},
+	}
+
+	// Empty Criteria must use the default criteria, not the CRITERIA environment variable
+	stacks, err := New(Options{}).Stack(assets)
+	require.NoError(t, err)
+	assert.Len(t, stacks, 1)
+
+	groups, err := StackBy(assets, "", "", "", nil)
+	require.NoError(t, err)
+	assert.Len(t, groups, 1)
+}
+
+func TestStackerSkipMatchMiss(t *testing.T) {
+	criteria := `[{"key":"originalFileName","regex":{"key":"^(PXL_\\d+)","index":1}},{"key":"localDateTime"}]`
+	now := time.Now().Format(time.RFC3339)
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "PXL_001.jpg", LocalDateTime: now},
+		{ID: "2", OriginalFileName: "PXL_001.dng", LocalDateTime: now},
+		{ID: "3", OriginalFileName: "IMG_001.jpg", LocalDateTime: now},
+		{ID: "4", OriginalFileName: "IMG_002.jpg", LocalDateTime: now},
+	}
+
+	stacks, err := New(Options{Criteria: criteria}).Stack(assets)
+	require.NoError(t, err)
+	require.Len(t, stacks, 2, "non-matching assets are grouped on the remaining criteria by default")
+
+	stacks, err = New(Options{Criteria: criteria, SkipMatchMiss: true}).Stack(assets)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.Len(t, stacks[0].Members, 2)
+	assert.Equal(t, "PXL_001", stacks[0].Key[:7])
+}
+
+func TestCriteriaOnMiss(t *testing.T) {
+	regex := `{"key":"originalFileName","regex":{"key":"^(PXL_\\d+)","index":1}%s}`
+	modifiedAt := `{"key":"fileModifiedAt"%s}`
+	now := time.Now().Format(time.RFC3339)
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "PXL_001.jpg", FileModifiedAt: now},
+		{ID: "2", OriginalFileName: "PXL_001.dng", FileModifiedAt: now},
+		{ID: "3", OriginalFileName: "PXL_002.jpg"},
+		{ID: "4", OriginalFileName: "PXL_002.dng"},
+		{ID: "5", OriginalFileName: "IMG_001.jpg", FileModifiedAt: now},
+		{ID: "6", OriginalFileName: "IMG_001.dng", FileModifiedAt: now},
+	}
+
+	tests := []struct {
+		name          string
+		regexOnMiss   string
+		timeOnMiss    string
+		skipMatchMiss bool
+		expected      [][]string
+		errored       int
+	}{
+		{
+			name:     "group-by-others by default drops the missing component from the key",
+			expected: [][]string{{"1", "2"}, {"3", "4"}, {"5", "6"}},
+		},
+		{
+			name:        "skip on the regex leaves non-matching assets out",
+			regexOnMiss: `,"onMiss":"skip"`,
+			expected:    [][]string{{"1", "2"}, {"3", "4"}},
+		},
+		{
+			name:       "skip on the timestamp leaves assets without it out",
+			timeOnMiss: `,"onMiss":"skip"`,
+			expected:   [][]string{{"1", "2"}, {"5", "6"}},
+		},
+		{
+			name:       "error on the timestamp reports the assets as errored",
+			timeOnMiss: `,"onMiss":"error"`,
+			expected:   [][]string{{"1", "2"}, {"5", "6"}},
+			errored:    2,
+		},
+		{
+			name:        "skip on the regex while a missing timestamp errors",
+			regexOnMiss: `,"onMiss":"skip"`,
+			timeOnMiss:  `,"onMiss":"error"`,
+			expected:    [][]string{{"1", "2"}},
+			errored:     2,
+		},
+		{
+			name:          "SkipMatchMiss skips on every criteria without onMiss",
+			skipMatchMiss: true,
+			expected:      [][]string{{"1", "2"}},
+		},
+		{
+			name:          "onMiss overrides SkipMatchMiss",
+			timeOnMiss:    `,"onMiss":"group-by-others"`,
+			skipMatchMiss: true,
+			expected:      [][]string{{"1", "2"}, {"3", "4"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			criteria := "[" + fmt.Sprintf(regex, tt.regexOnMiss) + "," + fmt.Sprintf(modifiedAt, tt.timeOnMiss) + "]"
+			s := New(Options{Criteria: criteria, SkipMatchMiss: tt.skipMatchMiss})
+			stacks, err := s.Stack(assets)
+			require.NoError(t, err)
+
+			var got [][]string
+			for _, stack := range stacks {
+				got = append(got, stackMemberIDs(stack))
+			}
+			assert.ElementsMatch(t, tt.expected, got)
+			assert.Equal(t, tt.errored, s.ErroredAssets())
+		})
+	}
+}
+
+func TestCriteriaOnMissValidation(t *testing.T) {
+	_, err := getCriteriaConfig(`[{"key":"originalFileName","onMiss":"ignore"}]`)
+	assert.ErrorContains(t, err, `invalid onMiss "ignore"`)
+
+	_, err = getCriteriaConfig(`{"mode":"advanced","groups":[{"operator":"AND","criteria":[{"key":"originalFileName","onMiss":"skip"}]}]}`)
+	assert.ErrorContains(t, err, "onMiss is only supported in legacy criteria")
+
+	_, err = getCriteriaConfig(`[{"key":"originalFileName","onMiss":"skip"},{"key":"localDateTime","onMiss":"error"}]`)
+	assert.NoError(t, err)
+}
+
+func TestStackerDelimitersOverride(t *testing.T) {
+	criteria := `[{"key":"originalFileName","regex":{"key":"^(IMG)","index":1}}]`
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG-8.jpg"},
+		{ID: "2", OriginalFileName: "IMG-9.jpg"},
+	}
+	opts := Options{Criteria: criteria, ParentFilenamePromote: "IMG,biggestNumber"}
+
+	stacks, err := New(opts).Stack(assets)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.Equal(t, "IMG-8.jpg", stacks[0].Parent.OriginalFileName, "without delimiters no number suffix is extracted")
+
+	opts.Delimiters = []string{"-"}
+	stacks, err = New(opts).Stack(assets)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.Equal(t, "IMG-9.jpg", stacks[0].Parent.OriginalFileName, "biggest number after the configured delimiter wins")
+}
+
+func TestStackerDelimitersDefaultCriteria(t *testing.T) {
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001-2.jpg", LocalDateTime: "2024-01-01T10:00:00Z"},
+		{ID: "2", OriginalFileName: "IMG_0001-10.jpg", LocalDateTime: "2024-01-01T10:00:00Z"},
+		{ID: "3", OriginalFileName: "IMG_0001.jpg", LocalDateTime: "2024-01-01T10:00:00Z"},
+	}
+
+	stacks, err := New(Options{ParentFilenamePromote: "biggestNumber"}).Stack(assets)
+	require.NoError(t, err)
+	assert.Empty(t, stacks, "the default criteria do not split on -")
+
+	stacks, err = New(Options{ParentFilenamePromote: "biggestNumber", Delimiters: []string{"-", "."}}).Stack(assets)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1, "the default criteria split on the configured delimiters")
+	assert.Equal(t, "IMG_0001-10.jpg", stacks[0].Parent.OriginalFileName)
+	assert.Equal(t, []string{"~", "."}, utils.DefaultCriteria[0].Split.Delimiters, "the default criteria are left untouched")
+}
+
+func TestParseDelimiters(t *testing.T) {
+	delimiters, err := ParseDelimiters("")
+	require.NoError(t, err)
+	assert.Nil(t, delimiters)
+
+	delimiters, err = ParseDelimiters("-,(,), ")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-", "(", ")", " "}, delimiters)
+
+	delimiters, err = ParseDelimiters(`\,,~,\\`)
+	require.NoError(t, err)
+	assert.Equal(t, []string{",", "~", `\`}, delimiters)
+
+	_, err = ParseDelimiters("-,,~")
+	assert.ErrorContains(t, err, "delimiter 2 of")
+	_, err = ParseDelimiters(`-,\`)
+	assert.ErrorContains(t, err, "escaping backslash")
+}
+
+func TestStackByMatchesStackerMembers(t *testing.T) {
+	now := time.Now().Format(time.RFC3339)
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.CR3", LocalDateTime: now},
+		{ID: "2", OriginalFileName: "IMG_0001.JPG", LocalDateTime: now},
+	}
+
+	legacy, err := StackBy(assets, "", "", ".jpg", nil)
+	require.NoError(t, err)
+	stacks, err := New(Options{ParentExtPromote: ".jpg"}).Stack(assets)
+	require.NoError(t, err)
+	require.Len(t, legacy, 1)
+	require.Len(t, stacks, 1)
+	assert.Equal(t, legacy[0], stacks[0].Members)
+}
@@ -0,0 +1,132 @@
+package stacker
+
+import (
+	"sort"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+/**************************************************************************************************
+** applyParentOverrides forces the parent of the stacks whose grouping key matches a key regex
+** of the parentOverride map: the first member, in sorted order, whose filename matches the
+** parent regex is moved to index 0, ahead of every promote rule. The overrides are tried in key
+** regex order and the first matching one applies. The override goes through the promote step
+** like a promote rule: a live photo video is never picked, and a trashed or archived parent still
+** gives way to a visible member. A stack without a matching member is logged as a warning, and an
+** override matching no stack is logged once at debug level, as it may match the stacks of a
+** later run.
+**
+** @param stacks - Sorted stacks built from the criteria
+** @param overrides - Grouping key regex → parent filename regex, validated with the criteria
+** @param logger - Logger for the warnings
+** @return []Stack - The stacks with their parent overridden
+**************************************************************************************************/
+func applyParentOverrides(stacks []Stack, overrides map[string]string, logger *logrus.Logger) []Stack {
+	if len(overrides) == 0 {
+		return stacks
+	}
+	keyPatterns := make([]string, 0, len(overrides))
+	for keyPattern := range overrides {
+		keyPatterns = append(keyPatterns, keyPattern)
+	}
+	sort.Strings(keyPatterns)
+
+	matched := make(map[string]bool, len(keyPatterns))
+	for i, stack := range stacks {
+		for _, keyPattern := range keyPatterns {
+			keyRegex, _ := utils.RegexCompile(keyPattern)
+			if !keyRegex.MatchString(stack.Key) {
+				continue
+			}
+			matched[keyPattern] = true
+			parentRegex, _ := utils.RegexCompile(overrides[keyPattern])
+			livePhotoVideos := livePhotoVideoIDs(stack.Members)
+			parent := -1
+			for j, member := range stack.Members {
+				if !livePhotoVideos[member.ID] && parentRegex.MatchString(member.OriginalFileName) {
+					parent = j
+					break
+				}
+			}
+			if parent < 0 {
+				logger.Warnf("⚠️  parentOverride %q matched stack %s but no member matches %q", keyPattern, stack.Key, overrides[keyPattern])
+				break
+			}
+			members := make([]utils.TAsset, 0, len(stack.Members))
+			members = append(members, stack.Members[parent])
+			members = append(members, stack.Members[:parent]...)
+			members = append(members, stack.Members[parent+1:]...)
+			promoteVisibleParent(members, livePhotoVideos)
+			stacks[i].Parent = members[0]
+			stacks[i].Members = members
+			break
+		}
+	}
+
+	for _, keyPattern := range keyPatterns {
+		if !matched[keyPattern] {
+			logger.Debugf("parentOverride %q matched no stack", keyPattern)
+		}
+	}
+	return stacks
+}
+
+/**************************************************************************************************
+** applyParentSelector moves the member picked by the parent selector of the options to index 0 of
+** each stack, see SelectParent.
+**
+** @param stacks - Sorted stacks, their parent overrides applied
+** @param selector - Parent selector of the options, nil leaves the stacks unchanged
+** @param logger - Logger for the warnings
+** @return []Stack - The stacks with their selected parent
+**************************************************************************************************/
+func applyParentSelector(stacks []Stack, selector ParentSelector, logger *logrus.Logger) []Stack {
+	if selector == nil {
+		return stacks
+	}
+	for i, stack := range stacks {
+		stacks[i] = SelectParent(stack, selector, logger)
+	}
+	return stacks
+}
+
+/**************************************************************************************************
+** SelectParent moves the member picked by a parent selector to index 0 of a stack. It lets a
+** caller run the selector on the stacks it is about to apply only, instead of through the options.
+** The stack keeps its sorted parent, with a warning, when the selector fails or picks an asset
+** that is not a member.
+**
+** @param stack - Sorted stack, its parent override applied
+** @param selector - Parent selector, nil leaves the stack unchanged
+** @param logger - Logger for the warnings
+** @return Stack - The stack with its selected parent
+**************************************************************************************************/
+func SelectParent(stack Stack, selector ParentSelector, logger *logrus.Logger) Stack {
+	if selector == nil {
+		return stack
+	}
+	id, err := selector(stack.Members)
+	if err != nil {
+		logger.Warnf("⚠️  Parent selector failed on stack %s, keeping %s: %v", stack.Key, stack.Parent.OriginalFileName, err)
+		return stack
+	}
+	parent := -1
+	for j, member := range stack.Members {
+		if member.ID == id {
+			parent = j
+			break
+		}
+	}
+	if parent < 0 {
+		logger.Warnf("⚠️  Parent selector picked %q, not a member of stack %s, keeping %s", id, stack.Key, stack.Parent.OriginalFileName)
+		return stack
+	}
+	members := make([]utils.TAsset, 0, len(stack.Members))
+	members = append(members, stack.Members[parent])
+	members = append(members, stack.Members[:parent]...)
+	members = append(members, stack.Members[parent+1:]...)
+	stack.Parent = members[0]
+	stack.Members = members
+	return stack
+}
@@ -0,0 +1,136 @@
+package stacker
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the parentOverride of the criteria
+************************************************************************************************/
+
+func TestStackerParentOverride(t *testing.T) {
+	now := time.Now().Format(time.RFC3339)
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "WEDDING_0001.JPG", LocalDateTime: now},
+		{ID: "2", OriginalFileName: "WEDDING_0001-composite.JPG", LocalDateTime: now},
+		{ID: "3", OriginalFileName: "WEDDING_0001-composite-v2.JPG", LocalDateTime: now},
+		{ID: "4", OriginalFileName: "IMG_0002.JPG", LocalDateTime: now},
+		{ID: "5", OriginalFileName: "IMG_0002-edit.JPG", LocalDateTime: now},
+		{ID: "6", OriginalFileName: "DSC_0003.JPG", LocalDateTime: now},
+		{ID: "7", OriginalFileName: "DSC_0003-edit.JPG", LocalDateTime: now},
+	}
+	groups := `"groups": [{"operator": "AND", "criteria": [{"key": "originalFileName", "split": {"delimiters": ["-", "."], "index": 0}}]}]`
+	criteria := `{"mode": "advanced", ` + groups + `,
+		"parentOverride": {"WEDDING": "-composite", "IMG_": "-edit", "DSC_": "-raw", "PXL_": ".*"}}`
+
+	// Members of the normal sorting
+	sorted, err := New(Options{Criteria: `{"mode": "advanced", ` + groups + `}`, Logger: logrus.New()}).Stack(assets)
+	require.NoError(t, err)
+	sortedMembers := make(map[string][]utils.TAsset)
+	for _, stack := range sorted {
+		sortedMembers[stack.Key] = stack.Members
+	}
+
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&logs)
+	logger.SetLevel(logrus.DebugLevel)
+	stacks, err := New(Options{Criteria: criteria, Logger: logger}).Stack(assets)
+	require.NoError(t, err)
+
+	require.Len(t, stacks, 3)
+	for _, stack := range stacks {
+		assert.Equal(t, stack.Members[0].ID, stack.Parent.ID)
+		assert.Len(t, stack.Members, len(sortedMembers[stack.Key]))
+		switch stack.Parent.OriginalFileName[:3] {
+		case "WED":
+			// The first composite of the normal sorting wins
+			for _, member := range sortedMembers[stack.Key] {
+				if member.ID != "1" {
+					assert.Equal(t, member.ID, stack.Parent.ID)
+					break
+				}
+			}
+		case "IMG":
+			assert.Equal(t, "5", stack.Parent.ID)
+		default:
+			assert.Equal(t, sortedMembers[stack.Key][0].ID, stack.Parent.ID, "no member matches, the sorted parent is kept")
+		}
+	}
+	assert.Contains(t, logs.String(), `parentOverride \"DSC_\" matched stack`)
+	assert.Contains(t, logs.String(), `level=debug msg="parentOverride \"PXL_\" matched no stack"`)
+
+	_, err = New(Options{Criteria: `{"mode": "advanced", "groups": [{"operator": "AND", "criteria": [{"key": "originalFileName"}]}], "parentOverride": {"(": ".*"}}`, Logger: logger}).Stack(assets)
+	assert.ErrorContains(t, err, "invalid parentOverride key regex")
+	_, err = New(Options{Criteria: `{"mode": "advanced", "groups": [{"operator": "AND", "criteria": [{"key": "originalFileName"}]}], "parentOverride": {".*": "("}}`, Logger: logger}).Stack(assets)
+	assert.ErrorContains(t, err, "invalid parentOverride parent regex")
+}
+
+func TestStackerParentOverrideKeepsVisibleParent(t *testing.T) {
+	now := time.Now().Format(time.RFC3339)
+	groups := `"groups": [{"operator": "AND", "criteria": [{"key": "originalFileName", "split": {"delimiters": ["-", "."], "index": 0}}]}]`
+	parent := func(assets []utils.TAsset, override string) string {
+		stacks, err := New(Options{Criteria: `{"mode": "advanced", ` + groups + `, "parentOverride": {"IMG": "` + override + `"}}`, Logger: logrus.New()}).Stack(assets)
+		require.NoError(t, err)
+		require.Len(t, stacks, 1)
+		return stacks[0].Parent.ID
+	}
+
+	livePhoto := []utils.TAsset{
+		{ID: "image", OriginalFileName: "IMG_0001.HEIC", LocalDateTime: now, LivePhotoVideoID: "video"},
+		{ID: "video", OriginalFileName: "IMG_0001.MOV", LocalDateTime: now},
+	}
+	assert.Equal(t, "image", parent(livePhoto, "MOV"), "a live photo video is never the parent")
+
+	trashed := []utils.TAsset{
+		{ID: "visible", OriginalFileName: "IMG_0001.JPG", LocalDateTime: now},
+		{ID: "trashed", OriginalFileName: "IMG_0001-composite.JPG", LocalDateTime: now, IsTrashed: true},
+	}
+	assert.Equal(t, "visible", parent(trashed, "composite"), "a trashed override gives way to a visible member")
+	assert.Equal(t, "visible", parent(trashed, "IMG_0001[.]"))
+}
+
+func TestStackerParentSelector(t *testing.T) {
+	now := time.Now().Format(time.RFC3339)
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: now},
+		{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: now},
+		{ID: "3", OriginalFileName: "IMG_0001-sharp.JPG", LocalDateTime: now},
+	}
+	criteria := `[{"key": "originalFileName", "split": {"delimiters": ["-", "."], "index": 0}}]`
+	stackWith := func(selector ParentSelector, logger *logrus.Logger) Stack {
+		stacks, err := New(Options{Criteria: criteria, ParentSelector: selector, Logger: logger}).Stack(assets)
+		require.NoError(t, err)
+		require.Len(t, stacks, 1)
+		return stacks[0]
+	}
+	sorted := stackMemberIDs(stackWith(nil, nil))
+
+	t.Run("selected parent", func(t *testing.T) {
+		last := sorted[len(sorted)-1]
+		stack := stackWith(func(members []utils.TAsset) (string, error) { return last, nil }, nil)
+		assert.Equal(t, last, stack.Parent.ID)
+		assert.Equal(t, append([]string{last}, sorted[:len(sorted)-1]...), stackMemberIDs(stack), "the others keep their sorted order")
+	})
+
+	t.Run("failure or unknown ID keeps the sorted parent", func(t *testing.T) {
+		var out bytes.Buffer
+		logger := logrus.New()
+		logger.SetOutput(&out)
+
+		stack := stackWith(func(members []utils.TAsset) (string, error) { return "", assert.AnError }, logger)
+		assert.Equal(t, sorted, stackMemberIDs(stack))
+		assert.Contains(t, out.String(), "Parent selector failed")
+
+		stack = stackWith(func(members []utils.TAsset) (string, error) { return "42", nil }, logger)
+		assert.Equal(t, sorted, stackMemberIDs(stack))
+		assert.Contains(t, out.String(), `picked \"42\", not a member`)
+	})
+}
@@ -0,0 +1,38 @@
+package stacker
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/**************************************************************************************************
+** partNumberKeyword is the filename promote keyword ordering the parts of a recording split by
+** the camera, such as C0042.MP4, C0042_001.MP4 and C0042_002.MP4, first part first.
+**************************************************************************************************/
+const partNumberKeyword = "partNumber"
+
+// Three-digit part number ending the name of a split recording, without extension: C0042_001
+var partNumberRegex = regexp.MustCompile(`_(\d{3})$`)
+
+/**************************************************************************************************
+** extractPartNumber returns the part number of a split recording, from the trailing _NNN of its
+** name before the extension. The first part has no suffix and is part 0, as is a name ending
+** with another number of digits, such as IMG_1234.
+**
+** @param name - The filename
+** @return int - The part number, 0 for the first part or a name without part number
+**************************************************************************************************/
+func extractPartNumber(name string) int {
+	base := strings.TrimSuffix(name, path.Ext(name))
+	match := partNumberRegex.FindStringSubmatch(base)
+	if match == nil {
+		return 0
+	}
+	part, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0
+	}
+	return part
+}
@@ -0,0 +1,62 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractPartNumber(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected int
+	}{
+		{"C0042.MP4", 0},
+		{"C0042_001.MP4", 1},
+		{"C0042_002.mp4", 2},
+		{"C0042_010", 10},
+		{"C0042-001.MP4", 0}, // Only an underscore separates the part
+		{"C0042_001_edit.MP4", 0},
+		{"IMG_1234.JPG", 0}, // Only three digits are a part number
+		{"C0042_01.MP4", 0},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, extractPartNumber(tt.name), tt.name)
+	}
+}
+
+func TestPartNumberPromote(t *testing.T) {
+	stack := []utils.TAsset{
+		{ID: "part2", OriginalFileName: "C0042_002.MP4"},
+		{ID: "part1", OriginalFileName: "C0042_001.MP4"},
+		{ID: "first", OriginalFileName: "C0042.MP4"},
+	}
+	sorted := sortStack(stack, "partNumber", "", nil, nil, &safePromoteData{data: make(map[string]map[string]string)}, make(map[int]map[string]int))
+	assert.Equal(t, []string{"first", "part1", "part2"}, []string{sorted[0].ID, sorted[1].ID, sorted[2].ID}, "ascending, unlike biggestNumber")
+
+	stack = []utils.TAsset{
+		{ID: "part1", OriginalFileName: "C0042_001.MP4"},
+		{ID: "cover", OriginalFileName: "C0042_cover.MP4"},
+		{ID: "first", OriginalFileName: "C0042.MP4"},
+	}
+	sorted = sortStack(stack, "cover,partNumber", "", nil, nil, &safePromoteData{data: make(map[string]map[string]string)}, make(map[int]map[string]int))
+	assert.Equal(t, []string{"cover", "first", "part1"}, []string{sorted[0].ID, sorted[1].ID, sorted[2].ID}, "earlier entries still come first")
+}
+
+func TestSplitRecordingStack(t *testing.T) {
+	assets := []utils.TAsset{
+		{ID: "part2", OriginalFileName: "C0042_002.MP4", LocalDateTime: "2024-05-01T10:24:00.000Z"},
+		{ID: "first", OriginalFileName: "C0042.MP4", LocalDateTime: "2024-05-01T10:00:00.000Z"},
+		{ID: "part1", OriginalFileName: "C0042_001.MP4", LocalDateTime: "2024-05-01T10:12:00.000Z"},
+		{ID: "other", OriginalFileName: "C0043.MP4", LocalDateTime: "2024-05-01T10:40:00.000Z"},
+	}
+
+	criteria := `[{"key":"originalFileName","regex":{"key":"^(.+?)(?:_\\d{3})?\\.(?i:mp4|mov|mts|m2ts)$","index":1}},{"key":"localDateTime","delta":{"milliseconds":3600000}}]`
+	stacks, err := New(Options{Criteria: criteria, ParentFilenamePromote: "partNumber"}).Stack(assets)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1, "C0043 is another recording")
+	assert.Equal(t, []string{"first", "part1", "part2"}, stackMemberIDs(stacks[0]))
+	assert.Equal(t, "first", stacks[0].Parent.ID)
+}
@@ -0,0 +1,102 @@
+package stacker
+
+import (
+	"regexp/syntax"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+)
+
+/**************************************************************************************************
+** FilenameQuery derives a filename search term from the criteria, so the asset search can be
+** filtered server-side. Immich matches the term anywhere in the original filename, so the term
+** is a literal every stacked filename must contain: the longest literal of an originalFileName
+** regex that an asset cannot miss without being left out of the stacks. That is a legacy
+** criteria skipping on miss, a criteria of a single AND group, or an expression leaf reached
+** only through AND operators. Anything else returns an empty string and every asset is fetched.
+**
+** @param criteria - The criteria string
+** @param skipMatchMiss - Whether legacy criteria without onMiss skip the assets they miss
+** @return string - The filename search term, or an empty string
+**************************************************************************************************/
+func FilenameQuery(criteria string, skipMatchMiss bool) string {
+	config, err := getCriteriaConfig(criteria)
+	if err != nil {
+		return ""
+	}
+
+	var required []utils.TCriteria
+	switch {
+	case config.Expression != nil:
+		required = requiredExpressionCriteria(config.Expression)
+	case len(config.Groups) == 1 && config.Groups[0].Operator != "OR":
+		required = config.Groups[0].Criteria
+	case config.Mode != "advanced":
+		for _, c := range resolveOnMiss(Options{SkipMatchMiss: skipMatchMiss}, config.Legacy) {
+			if c.OnMiss == utils.OnMissSkip {
+				required = append(required, c)
+			}
+		}
+	}
+
+	query := ""
+	for _, c := range required {
+		if c.Key != "originalFileName" || c.Regex == nil || c.Regex.Key == "" {
+			continue
+		}
+		re, err := syntax.Parse(c.Regex.Key, syntax.Perl)
+		if err != nil {
+			continue
+		}
+		if literal := requiredLiteral(re); len(literal) > len(query) {
+			query = literal
+		}
+	}
+	return query
+}
+
+/**************************************************************************************************
+** requiredExpressionCriteria returns the leaves of an expression that every matching asset
+** satisfies: the root leaf and the leaves reached only through AND operators.
+**
+** @param expr - The expression to walk
+** @return []utils.TCriteria - The required leaves
+**************************************************************************************************/
+func requiredExpressionCriteria(expr *utils.TCriteriaExpression) []utils.TCriteria {
+	if expr.Criteria != nil {
+		return []utils.TCriteria{*expr.Criteria}
+	}
+	if expr.Operator == nil || *expr.Operator != "AND" {
+		return nil
+	}
+	var required []utils.TCriteria
+	for i := range expr.Children {
+		required = append(required, requiredExpressionCriteria(&expr.Children[i])...)
+	}
+	return required
+}
+
+/**************************************************************************************************
+** requiredLiteral returns the longest literal that any string matching the regex contains,
+** looking through concatenations and capture groups only.
+**
+** @param re - The parsed regex
+** @return string - The longest required literal, or an empty string
+**************************************************************************************************/
+func requiredLiteral(re *syntax.Regexp) string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return string(re.Rune)
+	case syntax.OpCapture:
+		return requiredLiteral(re.Sub[0])
+	case syntax.OpConcat:
+		longest := ""
+		for _, sub := range re.Sub {
+			if literal := requiredLiteral(sub); len(literal) > len(longest) {
+				longest = literal
+			}
+		}
+		return longest
+	default:
+		return ""
+	}
+}
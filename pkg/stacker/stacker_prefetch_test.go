@@ -0,0 +1,94 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/************************************************************************************************
+** Test cases for the server-side filename query derived from the criteria
+************************************************************************************************/
+
+func TestFilenameQuery(t *testing.T) {
+	tests := []struct {
+		name          string
+		criteria      string
+		skipMatchMiss bool
+		expected      string
+	}{
+		{
+			name:     "default criteria have no filename regex",
+			criteria: "",
+			expected: "",
+		},
+		{
+			name:     "legacy regex grouping misses on the other criteria",
+			criteria: `[{"key":"originalFileName","regex":{"key":"^(PXL_\\d+)","index":1}},{"key":"localDateTime"}]`,
+			expected: "",
+		},
+		{
+			name:     "legacy regex skipping on miss",
+			criteria: `[{"key":"originalFileName","regex":{"key":"^(PXL_\\d+)","index":1},"onMiss":"skip"},{"key":"localDateTime"}]`,
+			expected: "PXL_",
+		},
+		{
+			name:          "legacy regex with SkipMatchMiss",
+			criteria:      `[{"key":"originalFileName","regex":{"key":"^PXL_(\\d{8})_(\\d+)","index":1}}]`,
+			skipMatchMiss: true,
+			expected:      "PXL_",
+		},
+		{
+			name:          "onMiss overrides SkipMatchMiss",
+			criteria:      `[{"key":"originalFileName","regex":{"key":"^PXL_","index":0},"onMiss":"group-by-others"}]`,
+			skipMatchMiss: true,
+			expected:      "",
+		},
+		{
+			name:     "longest literal of the pattern",
+			criteria: `[{"key":"originalFileName","regex":{"key":"^IMG_(\\d+)_BURST(\\d+)","index":1},"onMiss":"skip"}]`,
+			expected: "_BURST",
+		},
+		{
+			name:     "alternation has no required literal",
+			criteria: `[{"key":"originalFileName","regex":{"key":"^(PXL|IMG)_\\d+","index":0},"onMiss":"skip"}]`,
+			expected: "_",
+		},
+		{
+			name:     "single AND group",
+			criteria: `{"mode":"advanced","groups":[{"operator":"AND","criteria":[{"key":"originalFileName","regex":{"key":"PXL_","index":0}},{"key":"localDateTime"}]}]}`,
+			expected: "PXL_",
+		},
+		{
+			name:     "several groups",
+			criteria: `{"mode":"advanced","groups":[{"operator":"AND","criteria":[{"key":"originalFileName","regex":{"key":"PXL_","index":0}}]},{"operator":"AND","criteria":[{"key":"localDateTime"}]}]}`,
+			expected: "",
+		},
+		{
+			name:     "expression leaf under AND",
+			criteria: `{"mode":"advanced","expression":{"operator":"AND","children":[{"criteria":{"key":"originalFileName","regex":{"key":"^DSC","index":0}}},{"criteria":{"key":"localDateTime"}}]}}`,
+			expected: "DSC",
+		},
+		{
+			name:     "expression leaf under OR",
+			criteria: `{"mode":"advanced","expression":{"operator":"OR","children":[{"criteria":{"key":"originalFileName","regex":{"key":"^DSC","index":0}}},{"criteria":{"key":"localDateTime"}}]}}`,
+			expected: "",
+		},
+		{
+			name:     "originalPath regex is not a filename",
+			criteria: `[{"key":"originalPath","regex":{"key":"Camera","index":0},"onMiss":"skip"}]`,
+			expected: "",
+		},
+		{
+			name:     "invalid criteria",
+			criteria: `not json`,
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, FilenameQuery(tt.criteria, tt.skipMatchMiss))
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+)
+
+/**************************************************************************************************
+** ParseProfiles parses and validates the PROFILES JSON array. Every profile needs a unique name
+** and a valid selector, and its criteria and promote order must be valid.
+**
+** @param value - JSON array of profiles, or an empty string
+** @return []utils.TProfile - The profiles in order, or nil when the value is empty
+** @return error - An error describing the first invalid profile
+**************************************************************************************************/
+func ParseProfiles(value string) ([]utils.TProfile, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var profiles []utils.TProfile
+	if err := json.Unmarshal([]byte(value), &profiles); err != nil {
+		return nil, fmt.Errorf("failed to parse profiles: %w", err)
+	}
+
+	names := make(map[string]bool, len(profiles))
+	for i, profile := range profiles {
+		switch {
+		case profile.Name == "":
+			return nil, fmt.Errorf("profile #%d has no name", i+1)
+		case profile.Name == utils.DefaultProfileName:
+			return nil, fmt.Errorf("profile name %q is reserved for the assets no profile selects", profile.Name)
+		case names[profile.Name]:
+			return nil, fmt.Errorf("profile name %q is used twice", profile.Name)
+		case profile.Selector == nil:
+			return nil, fmt.Errorf("profile %s has no selector", profile.Name)
+		}
+		names[profile.Name] = true
+
+		if err := validateCriteriaConfig(CriteriaConfig{Expression: profile.Selector}); err != nil {
+			return nil, fmt.Errorf("profile %s: invalid selector: %w", profile.Name, err)
+		}
+		if _, err := getCriteriaConfig(string(profile.Criteria)); err != nil {
+			return nil, fmt.Errorf("profile %s: invalid criteria: %w", profile.Name, err)
+		}
+		if _, err := ParsePromoteOrder(profile.PromoteOrder); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", profile.Name, err)
+		}
+		if _, err := ParseExtPromote(profile.ParentExtPromote); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", profile.Name, err)
+		}
+	}
+	return profiles, nil
+}
+
+/**************************************************************************************************
+** ProfilesRequireExif reports whether a profile uses EXIF metadata, in its selector, criteria,
+** promote list or promote order.
+**
+** @param profiles - Parsed profiles
+** @return bool - True when the assets must be fetched with their EXIF metadata
+**************************************************************************************************/
+func ProfilesRequireExif(profiles []utils.TProfile) bool {
+	for _, profile := range profiles {
+		if RequiresExif(profile.ParentFilenamePromote, string(profile.Criteria)) {
+			return true
+		}
+		if order, err := ParsePromoteOrder(profile.PromoteOrder); err == nil && utils.Contains(order, utils.PromoteRuleSize) {
+			return true
+		}
+		for _, c := range flattenCriteriaFromExpression(profile.Selector) {
+			if numericFields[c.Key] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/**************************************************************************************************
+** profileOptions returns the options of the run with the settings of the profile applied.
+**
+** @param opts - Options of the run
+** @param profile - The profile
+** @return Options - The options to group the assets of the profile with
+**************************************************************************************************/
+func profileOptions(opts Options, profile utils.TProfile) Options {
+	opts.Profiles = nil
+	if len(profile.Criteria) > 0 {
+		opts.Criteria = string(profile.Criteria)
+		// An invalid criteria fails when the profile groups its assets
+		if config, err := getCriteriaConfig(opts.Criteria); err == nil {
+			opts.PromoteResolved = false
+			opts = withCriteriaPromote(opts, config.Promote)
+		}
+	}
+	if profile.ParentFilenamePromote != "" {
+		opts.ParentFilenamePromote = profile.ParentFilenamePromote
+	}
+	if profile.ParentExtPromote != "" {
+		opts.ParentExtPromote = profile.ParentExtPromote
+	}
+	if profile.PromoteOrder != "" {
+		opts.PromoteOrder = profile.PromoteOrder
+	}
+	return opts
+}
+
+/**************************************************************************************************
+** selectProfile returns the index of the first profile whose selector matches the asset, or
+** len(profiles) when none does. An asset the selector cannot be evaluated on is not selected.
+**
+** @param asset - The asset
+** @param profiles - Profiles in order
+** @return int - Index of the profile owning the asset
+**************************************************************************************************/
+func selectProfile(asset utils.TAsset, profiles []utils.TProfile) int {
+	for i, profile := range profiles {
+		if matched, err := EvaluateExpression(profile.Selector, asset); err == nil && matched {
+			return i
+		}
+	}
+	return len(profiles)
+}
+
+/**************************************************************************************************
+** stackByProfiles splits the assets between the profiles, each asset owned by the first profile
+** selecting it, and groups the assets of each profile only with each other. The assets no
+** profile selects are grouped with the settings of the run, as the default profile. The keys of
+** the stacks of a profile are prefixed with its name, so they never collide across profiles.
+**
+** @param assets - List of assets to group into stacks
+** @return []Stack - Stacks of every profile, in profile order
+** @return error - The first error of a profile
+**************************************************************************************************/
+func (s *Stacker) stackByProfiles(assets []utils.TAsset) ([]Stack, error) {
+	profiles := s.opts.Profiles
+	owned := make([][]utils.TAsset, len(profiles)+1)
+	for _, asset := range assets {
+		idx := selectProfile(asset, profiles)
+		owned[idx] = append(owned[idx], asset)
+	}
+
+	var stacks []Stack
+	s.erroredAssets = 0
+	s.timeGaps = nil
+	for i, subset := range owned {
+		if len(subset) == 0 {
+			continue
+		}
+		profile := utils.TProfile{Name: utils.DefaultProfileName}
+		if i < len(profiles) {
+			profile = profiles[i]
+		}
+		name := profile.Name
+
+		profileStacker := New(profileOptions(s.opts, profile))
+		profileStacks, err := profileStacker.Stack(subset)
+		s.erroredAssets += profileStacker.ErroredAssets()
+		s.timeGaps = append(s.timeGaps, profileStacker.TimeGaps()...)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+		for j := range profileStacks {
+			profileStacks[j].Profile = name
+			if name != utils.DefaultProfileName {
+				profileStacks[j].Key = name + "/" + profileStacks[j].Key
+			}
+		}
+		s.opts.Logger.Infof("🗂️  Profile %s: %d assets, %d stacks", name, len(subset), len(profileStacks))
+		stacks = append(stacks, profileStacks...)
+	}
+	return stacks, nil
+}
@@ -0,0 +1,88 @@
+package stacker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Tests for the criteria profiles
+************************************************************************************************/
+
+func TestParseProfiles(t *testing.T) {
+	profiles, err := ParseProfiles(`[
+		{"name": "scans", "selector": {"criteria": {"key": "originalPath", "regex": {"key": "^/scans/"}}},
+		 "criteria": [{"key": "originalFileName", "regex": {"key": "^(.+)_\\d+\\.", "index": 1}}]},
+		{"name": "phone", "selector": {"criteria": {"key": "originalPath", "regex": {"key": "^/phone/"}}},
+		 "parentExtPromote": ".heic"}
+	]`)
+	require.NoError(t, err)
+	require.Len(t, profiles, 2)
+	assert.Equal(t, "scans", profiles[0].Name)
+	assert.Equal(t, ".heic", profiles[1].ParentExtPromote)
+
+	profiles, err = ParseProfiles("")
+	assert.NoError(t, err)
+	assert.Nil(t, profiles)
+
+	selector := `"selector": {"criteria": {"key": "originalPath"}}`
+	tests := map[string]string{
+		`not json`:             "failed to parse profiles",
+		`[{` + selector + `}]`: "has no name",
+		`[{"name": "default", ` + selector + `}]`:                            "is reserved",
+		`[{"name": "a", ` + selector + `}, {"name": "a", ` + selector + `}]`: "is used twice",
+		`[{"name": "a"}]`: "has no selector",
+		`[{"name": "a", "selector": {"criteria": {"key": "unknown"}}}]`:       "invalid selector",
+		`[{"name": "a", ` + selector + `, "criteria": [{"key": "unknown"}]}]`: "invalid criteria",
+		`[{"name": "a", ` + selector + `, "promoteOrder": "unknown"}]`:        "profile a:",
+	}
+	for value, expected := range tests {
+		_, err := ParseProfiles(value)
+		assert.ErrorContains(t, err, expected, value)
+	}
+}
+
+func TestStackerProfiles(t *testing.T) {
+	now := time.Now().Format(time.RFC3339)
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG", OriginalPath: "/phone/IMG_0001.JPG", LocalDateTime: now},
+		{ID: "2", OriginalFileName: "IMG_0001.CR3", OriginalPath: "/camera/IMG_0001.CR3", LocalDateTime: now},
+		{ID: "3", OriginalFileName: "IMG_0001.HEIC", OriginalPath: "/phone/IMG_0001.HEIC", LocalDateTime: now},
+		{ID: "4", OriginalFileName: "album_1.jpg", OriginalPath: "/scans/album_1.jpg", LocalDateTime: now},
+		{ID: "5", OriginalFileName: "album_2.jpg", OriginalPath: "/scans/album_2.jpg", LocalDateTime: now},
+		{ID: "6", OriginalFileName: "IMG_0001.DNG", OriginalPath: "/camera/IMG_0001.DNG", LocalDateTime: now},
+	}
+	profiles, err := ParseProfiles(`[
+		{"name": "scans", "selector": {"criteria": {"key": "originalPath", "regex": {"key": "^/scans/"}}},
+		 "criteria": [{"key": "originalFileName", "regex": {"key": "^(.+)_\\d+\\.", "index": 1}}]},
+		{"name": "phone", "selector": {"criteria": {"key": "originalPath", "regex": {"key": "^/phone/"}}},
+		 "parentExtPromote": ".heic"}
+	]`)
+	require.NoError(t, err)
+
+	stacks, err := New(Options{ParentExtPromote: ".jpg,.dng", Profiles: profiles}).Stack(assets)
+	require.NoError(t, err)
+	require.Len(t, stacks, 3, "assets of different profiles are never stacked together")
+
+	byProfile := make(map[string]Stack)
+	for _, stack := range stacks {
+		byProfile[stack.Profile] = stack
+	}
+
+	scans := byProfile["scans"]
+	assert.True(t, strings.HasPrefix(scans.Key, "scans/album"), scans.Key)
+	assert.Len(t, scans.Members, 2)
+
+	phone := byProfile["phone"]
+	assert.Equal(t, "IMG_0001.HEIC", phone.Parent.OriginalFileName, "the profile promote list is used")
+	assert.Len(t, phone.Members, 2)
+
+	camera := byProfile[utils.DefaultProfileName]
+	assert.Equal(t, "IMG_0001.DNG", camera.Parent.OriginalFileName, "unselected assets use the run settings")
+	assert.NotContains(t, camera.Key, "/", "the default profile keeps the plain key")
+}
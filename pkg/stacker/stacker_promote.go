@@ -2,12 +2,14 @@ package stacker
 
 import (
 	"fmt"
-	"path/filepath"
+	"math"
+	"path"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/majorfi/immich-stack/pkg/utils"
 )
@@ -27,14 +29,77 @@ func parsePromoteList(list string) []string {
 		// Preserve empty strings but trim whitespace from non-empty ones
 		if p == "" {
 			result = append(result, "")
-		} else {
-			trimmed := strings.TrimSpace(p)
-			result = append(result, trimmed)
+			continue
 		}
+		result = append(result, strings.TrimSpace(p))
 	}
 	return result
 }
 
+// Meta-extensions of the promote lists, each standing for a set of extensions
+var promoteMetaTokens = map[string][]string{
+	"@raw":   utils.RawExtensions,
+	"@image": utils.ImageExtensions,
+	"@video": utils.VideoExtensions,
+}
+
+/**************************************************************************************************
+** ParseExtPromote parses PARENT_EXT_PROMOTE, expanding the @raw, @image and @video
+** meta-extensions. An extension never starts with @, so an unknown meta-extension is an error
+** rather than an extension no file has.
+**
+** @param list - Comma-separated extensions and meta-extensions, such as ".jpg,@raw"
+** @return []string - The normalized extensions, in order
+** @return error - An error for an unknown meta-extension
+**************************************************************************************************/
+func ParseExtPromote(list string) ([]string, error) {
+	for _, p := range strings.Split(list, ",") {
+		token := strings.ToLower(strings.TrimSpace(p))
+		if _, ok := promoteMetaTokens[token]; strings.HasPrefix(token, "@") && !ok {
+			return nil, fmt.Errorf("unknown meta-extension %q, expected @raw, @image or @video", strings.TrimSpace(p))
+		}
+	}
+	return parseExtPromoteList(list), nil
+}
+
+/**************************************************************************************************
+** parseExtPromoteList parses the comma-separated extensions to promote. Each extension is
+** lowercased and given a leading dot, like the extension extracted from the filenames, so that
+** ".JPG", "jpg" and ".jpg" promote the same files. The @raw, @image and @video meta-extensions
+** are expanded to their extensions. Empty strings are preserved for negative matching.
+**
+** @param list - Comma-separated extensions, such as ".JPG,.Dng,@raw"
+** @return []string - The normalized extensions
+**************************************************************************************************/
+func parseExtPromoteList(list string) []string {
+	parts := parsePromoteList(list)
+	if parts == nil {
+		return nil
+	}
+	extensions := make([]string, 0, len(parts))
+	for _, ext := range parts {
+		if ext == "" {
+			extensions = append(extensions, "")
+			continue
+		}
+		ext = strings.ToLower(ext)
+		if meta, ok := promoteMetaTokens[ext]; ok {
+			// A meta-extension stands for its extensions not listed before it
+			for _, metaExt := range meta {
+				if !utils.Contains(extensions, metaExt) {
+					extensions = append(extensions, metaExt)
+				}
+			}
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		extensions = append(extensions, ext)
+	}
+	return extensions
+}
+
 /**************************************************************************************************
 ** isSequenceKeyword checks if a promote string is a special sequence keyword.
 ** Supports formats: "sequence", "sequence:4", "sequence:prefix_", etc.
@@ -43,6 +108,76 @@ func isSequenceKeyword(promote string) bool {
 	return promote == "sequence" || strings.HasPrefix(promote, "sequence:")
 }
 
+/**************************************************************************************************
+** isBiggestNumberKeyword checks if a promote string is a biggestNumber keyword.
+** Supports "biggestNumber" (delimiter-separated suffix) and "biggestNumber:any" (last number
+** anywhere in the filename).
+**************************************************************************************************/
+func isBiggestNumberKeyword(promote string) bool {
+	return promote == "biggestNumber" || promote == "biggestNumber:any"
+}
+
+/**************************************************************************************************
+** assetRating returns the EXIF star rating of an asset, or 0 when it has none.
+**************************************************************************************************/
+func assetRating(asset utils.TAsset) int {
+	if asset.ExifInfo == nil {
+		return 0
+	}
+	return asset.ExifInfo.Rating
+}
+
+/**************************************************************************************************
+** isUploadKeyword reports whether the promote entry orders by upload time: "newestUpload" puts
+** the latest upload first, "oldestUpload" the earliest.
+**************************************************************************************************/
+func isUploadKeyword(promote string) bool {
+	return promote == "newestUpload" || promote == "oldestUpload"
+}
+
+/**************************************************************************************************
+** assetUploadTime returns the time an asset was uploaded to Immich, from createdAt, falling back
+** to fileCreatedAt.
+**
+** @param asset - The asset
+** @return time.Time - The upload time
+** @return bool - False when the asset has no valid time
+**************************************************************************************************/
+func assetUploadTime(asset utils.TAsset) (time.Time, bool) {
+	value := asset.CreatedAt
+	if value == "" {
+		value = asset.FileCreatedAt
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	return t, err == nil
+}
+
+/**************************************************************************************************
+** compareUploads orders two assets by upload time. Assets without an upload time come last.
+**
+** @param a - First asset
+** @param b - Second asset
+** @param newest - True to put the latest upload first
+** @return int - Negative when a comes first, positive when b does, 0 on a tie
+**************************************************************************************************/
+func compareUploads(a, b utils.TAsset, newest bool) int {
+	aTime, aOk := assetUploadTime(a)
+	bTime, bOk := assetUploadTime(b)
+	switch {
+	case aOk != bOk:
+		if aOk {
+			return -1
+		}
+		return 1
+	case !aOk || aTime.Equal(bTime):
+		return 0
+	case aTime.Before(bTime) == newest:
+		return 1
+	default:
+		return -1
+	}
+}
+
 /**************************************************************************************************
 ** extractSequencePattern extracts the pattern from a sequence keyword.
 ** Examples:
@@ -66,47 +201,282 @@ func extractSequencePattern(keyword string) (prefix string, digits int) {
 }
 
 /**************************************************************************************************
-** getPromoteIndex returns the index of the first promote substring/extension found in the value.
-** If none found, returns len(promoteList) (lowest priority).
-** Special handling for empty string: acts as negative match for files without other substrings.
+** parseSequenceKeyword splits a sequence keyword into its prefix, digit width and direction.
+** A trailing ":desc" inverts the ordering, e.g. "sequence:desc", "sequence:4:desc" or
+** "sequence:IMG_:desc".
+**
+** @param keyword - The sequence keyword
+** @return prefix - Required prefix before the number, or empty
+** @return digits - Maximum digit width of the number, or 0 for any width
+** @return descending - True when higher numbers should be promoted first
 **************************************************************************************************/
-func getPromoteIndex(value string, promoteList []string) int {
-	emptyStringIndex := -1
-	hasNonEmptyStrings := false
-	loweredValue := strings.ToLower(value)
+func parseSequenceKeyword(keyword string) (prefix string, digits int, descending bool) {
+	if pattern, found := strings.CutSuffix(keyword, ":desc"); found && isSequenceKeyword(pattern) {
+		keyword = pattern
+		descending = true
+	}
+	prefix, digits = extractSequencePattern(keyword)
+	return prefix, digits, descending
+}
 
-	for idx, promote := range promoteList {
-		if promote == "" {
-			if emptyStringIndex == -1 {
-				emptyStringIndex = idx
-			}
-		} else if promote != "biggestNumber" {
-			hasNonEmptyStrings = true
-			loweredPromote := strings.ToLower(promote)
-			if strings.Contains(loweredValue, loweredPromote) {
-				return idx
+/**************************************************************************************************
+** extractSequenceNumber finds the sequence number in a filename. Numbers are compared by value,
+** so "0010" and "10" both yield 10. When digits is set, numbers up to that width are accepted;
+** if the filename only has longer numbers, their leading digits are used.
+**
+** @param base - Base filename
+** @param prefix - Required prefix before the number, or empty
+** @param digits - Maximum digit width, or 0 for any width
+** @return int - The sequence number
+** @return bool - True if a number was found
+**************************************************************************************************/
+func extractSequenceNumber(base string, prefix string, digits int) (int, bool) {
+	fits := func(numStr string) bool {
+		return digits == 0 || len(numStr) <= digits
+	}
+
+	// Strategy 1: Look for numbers after underscores (common in burst photos)
+	for _, part := range strings.Split(base, "_") {
+		if prefix != "" && !strings.HasPrefix(part, prefix) {
+			continue
+		}
+		numStr := strings.TrimPrefix(part, prefix)
+		if !fits(numStr) {
+			continue
+		}
+		if num, err := strconv.Atoi(numStr); err == nil {
+			return num, true
+		}
+	}
+
+	// Strategy 2: Use regex to find the first number run that fits the width
+	re, err := utils.RegexCompile(regexp.QuoteMeta(prefix) + `(\d+)`)
+	if err != nil {
+		return 0, false
+	}
+	for _, match := range re.FindAllStringSubmatch(base, -1) {
+		if !fits(match[1]) {
+			continue
+		}
+		if num, err := strconv.Atoi(match[1]); err == nil {
+			return num, true
+		}
+	}
+
+	// Strategy 3: Fall back to the leading digits of a longer number
+	if digits > 0 {
+		re, err := utils.RegexCompile(regexp.QuoteMeta(prefix) + fmt.Sprintf(`(\d{%d})`, digits))
+		if err != nil {
+			return 0, false
+		}
+		if match := re.FindStringSubmatch(base); match != nil {
+			if num, err := strconv.Atoi(match[1]); err == nil {
+				return num, true
 			}
 		}
 	}
 
-	// If we have an empty string, handle it based on whether there are other non-empty strings
-	if emptyStringIndex >= 0 {
-		if !hasNonEmptyStrings {
-			return emptyStringIndex
+	return 0, false
+}
+
+/**************************************************************************************************
+** sequenceDescendingRank converts a sequence number to a rank where higher numbers come first.
+** The rank is measured from the largest number the digit width can hold, capped at 9 digits.
+**
+** @param num - The sequence number
+** @param digits - Maximum digit width, or 0 for any width
+** @return int - Rank of the number, lower is higher priority
+**************************************************************************************************/
+func sequenceDescendingRank(num int, digits int) int {
+	maxNum := 999999999
+	if digits > 0 && digits < 9 {
+		maxNum = int(math.Pow10(digits)) - 1
+	}
+	if num > maxNum {
+		num = maxNum
+	}
+	return maxNum - num
+}
+
+/**************************************************************************************************
+** promoteList is a parsed parent promote list. It is the single place implementing the shared
+** promote semantics, used for both filename and extension promotion:
+** - Non-empty entries match case-insensitively when contained in the value, first match wins
+** - An empty string ("") acts as a negative match: values that match no other entry get the
+**   index of the first empty string
+** - Keywords ("biggestNumber", "biggestNumber:any", "partNumber", "rating", "newestUpload",
+**   "oldestUpload", "sequence", "sequence:...", "editedAny") are never matched as substrings
+** - "editedAny" matches the values ending with a localized edited suffix, at its position
+** - Unmatched values get the index of "biggestNumber" or "partNumber" when present, else
+**   len(items)
+** Keyword positions are computed once at construction so lookups scan the list a single time.
+**************************************************************************************************/
+type promoteList struct {
+	items              []string
+	lowered            []string
+	emptyIndex         int      // Index of the first empty string, or -1
+	biggestNumberIndex int      // Index of the first biggestNumber keyword, or -1
+	biggestNumberAny   bool     // True if that keyword is "biggestNumber:any"
+	partNumberIndex    int      // Index of the first "partNumber" keyword, or -1
+	ratingIndex        int      // Index of the first "rating" keyword, or -1
+	uploadIndex        int      // Index of the first "newestUpload" or "oldestUpload" keyword, or -1
+	sequenceIndex      int      // Index of the first sequence keyword, or -1
+	editedSuffixes     []string // Suffixes matched by the "editedAny" keyword, empty for the defaults
+}
+
+/**************************************************************************************************
+** newPromoteList builds a promoteList from already parsed promote entries.
+**
+** @param items - Promote entries, usually from parsePromoteList
+** @return promoteList - The promote list ready for lookups
+**************************************************************************************************/
+func newPromoteList(items []string) promoteList {
+	p := promoteList{
+		items:              items,
+		lowered:            make([]string, len(items)),
+		emptyIndex:         -1,
+		biggestNumberIndex: -1,
+		partNumberIndex:    -1,
+		ratingIndex:        -1,
+		uploadIndex:        -1,
+		sequenceIndex:      -1,
+	}
+	for idx, item := range items {
+		p.lowered[idx] = strings.ToLower(item)
+		switch {
+		case item == "":
+			if p.emptyIndex == -1 {
+				p.emptyIndex = idx
+			}
+		case isBiggestNumberKeyword(item):
+			if p.biggestNumberIndex == -1 {
+				p.biggestNumberIndex = idx
+				p.biggestNumberAny = item == "biggestNumber:any"
+			}
+		case item == partNumberKeyword:
+			if p.partNumberIndex == -1 {
+				p.partNumberIndex = idx
+			}
+		case item == "rating":
+			if p.ratingIndex == -1 {
+				p.ratingIndex = idx
+			}
+		case isUploadKeyword(item):
+			if p.uploadIndex == -1 {
+				p.uploadIndex = idx
+			}
+		case isSequenceKeyword(item):
+			if p.sequenceIndex == -1 {
+				p.sequenceIndex = idx
+			}
 		}
+	}
+	return p
+}
+
+/**************************************************************************************************
+** isKeyword reports whether the entry at idx is empty or a special keyword rather than a
+** substring to match.
+**************************************************************************************************/
+func (p promoteList) isKeyword(idx int) bool {
+	item := p.items[idx]
+	return item == "" || item == "rating" || item == editedAnyKeyword || item == partNumberKeyword || isUploadKeyword(item) || isBiggestNumberKeyword(item) || isSequenceKeyword(item)
+}
 
-		// If there are other non-empty strings, return empty string index
-		// since we already checked all non-empty promotes in the first loop
-		return emptyStringIndex
+/**************************************************************************************************
+** compareOrdering orders two assets by the "rating" and upload keywords, in the order they
+** appear in the list. A keyword only applies when neither asset was promoted by an earlier
+** entry, and ties fall through to the following entries.
+**
+** @param a - First asset
+** @param b - Second asset
+** @param aIdx - Promote index of a
+** @param bIdx - Promote index of b
+** @return int - Negative when a comes first, positive when b does, 0 on a tie
+**************************************************************************************************/
+func (p promoteList) compareOrdering(a, b utils.TAsset, aIdx, bIdx int) int {
+	keywords := []int{p.ratingIndex, p.uploadIndex}
+	if p.uploadIndex >= 0 && (p.ratingIndex < 0 || p.uploadIndex < p.ratingIndex) {
+		keywords = []int{p.uploadIndex, p.ratingIndex}
+	}
+	for _, idx := range keywords {
+		if idx < 0 || aIdx <= idx || bIdx <= idx {
+			continue
+		}
+		if p.items[idx] == "rating" {
+			if aRating, bRating := assetRating(a), assetRating(b); aRating != bRating {
+				return bRating - aRating
+			}
+			continue
+		}
+		if order := compareUploads(a, b, p.items[idx] == "newestUpload"); order != 0 {
+			return order
+		}
 	}
+	return 0
+}
 
-	// If 'biggestNumber' is in the promote list, assign its index to unmatched files
-	for idx, promote := range promoteList {
-		if promote == "biggestNumber" {
-			return idx
+/**************************************************************************************************
+** match returns the index of the first non-keyword entry contained in the value, or of the
+** "editedAny" keyword when the value has an edited suffix.
+**
+** @param value - The value to check
+** @return int - Index of the matching entry
+** @return bool - True if an entry matched
+**************************************************************************************************/
+func (p promoteList) match(value string) (int, bool) {
+	loweredValue := strings.ToLower(value)
+	for idx := range p.items {
+		if p.items[idx] == editedAnyKeyword {
+			if _, edited := cutEditedSuffix(value, p.editedSuffixes); edited {
+				return idx, true
+			}
+			continue
 		}
+		if !p.isKeyword(idx) && strings.Contains(loweredValue, p.lowered[idx]) {
+			return idx, true
+		}
+	}
+	return 0, false
+}
+
+/**************************************************************************************************
+** unmatchedIndex returns the index given to values that match no entry and no negative match:
+** the first "biggestNumber" or "partNumber" position when present, otherwise the lowest
+** priority len(items).
+**************************************************************************************************/
+func (p promoteList) unmatchedIndex() int {
+	switch {
+	case p.biggestNumberIndex >= 0 && (p.partNumberIndex < 0 || p.biggestNumberIndex < p.partNumberIndex):
+		return p.biggestNumberIndex
+	case p.partNumberIndex >= 0:
+		return p.partNumberIndex
 	}
-	return len(promoteList)
+	return len(p.items)
+}
+
+/**************************************************************************************************
+** index returns the promote index of the value using plain contains matching.
+**
+** @param value - The value to check
+** @return int - Index of the matched entry, lower is higher priority
+**************************************************************************************************/
+func (p promoteList) index(value string) int {
+	if idx, ok := p.match(value); ok {
+		return idx
+	}
+	if p.emptyIndex >= 0 {
+		return p.emptyIndex
+	}
+	return p.unmatchedIndex()
+}
+
+/**************************************************************************************************
+** getPromoteIndex returns the index of the first promote substring/extension found in the value.
+** If none found, returns len(promoteList) (lowest priority). See promoteList for the semantics.
+**************************************************************************************************/
+func getPromoteIndex(value string, promoteList []string) int {
+	return newPromoteList(promoteList).index(value)
 }
 
 /**************************************************************************************************
@@ -129,6 +499,49 @@ func getExtensionRank(ext string) int {
 	}
 }
 
+// Rule replacing extRank with the alpha fallback, not a PROMOTE_ORDER name
+const promoteRuleExtAlpha = "extAlpha"
+
+/**************************************************************************************************
+** IsValidExtRankFallback checks if a fallback of the extRank rule is supported. An empty value is
+** treated as utils.ExtRankFallbackBuiltin.
+**
+** @param fallback - Fallback to check
+** @return bool - True if the fallback is supported
+**************************************************************************************************/
+func IsValidExtRankFallback(fallback string) bool {
+	switch fallback {
+	case "", utils.ExtRankFallbackBuiltin, utils.ExtRankFallbackAlpha, utils.ExtRankFallbackNone:
+		return true
+	default:
+		return false
+	}
+}
+
+/**************************************************************************************************
+** withExtRankFallback applies the fallback to the extRank rule of a promote order: kept with the
+** built-in rank, replaced by the alphabetical order of the extensions, or left out.
+**
+** @param order - Promote rule names, as returned by ParsePromoteOrder
+** @param fallback - The fallback of the extRank rule, empty for the built-in rank
+** @return []string - The promote rule names to apply
+**************************************************************************************************/
+func withExtRankFallback(order []string, fallback string) []string {
+	if fallback == "" || fallback == utils.ExtRankFallbackBuiltin {
+		return order
+	}
+	rules := make([]string, 0, len(order))
+	for _, rule := range order {
+		switch {
+		case rule != utils.PromoteRuleExtRank:
+			rules = append(rules, rule)
+		case fallback == utils.ExtRankFallbackAlpha:
+			rules = append(rules, promoteRuleExtAlpha)
+		}
+	}
+	return rules
+}
+
 /**************************************************************************************************
 ** getPromoteIndexWithMode handles promote string matching with different modes.
 ** Instead of just using strings.Contains, it can match specific patterns in filenames.
@@ -156,111 +569,52 @@ func getExtensionRank(ext string) int {
 ** @return int - Index of the matched promote string, or len(promoteList) if no match
 **************************************************************************************************/
 func getPromoteIndexWithMode(value string, promoteList []string, matchMode string) int {
-	base := filepath.Base(value)
-
-	// Single loop to check for empty string and matches with non-sequence items
-	emptyStringIndex := -1
-	hasNonEmptyStrings := false
-	loweredBase := strings.ToLower(base)
-
-	for idx, promote := range promoteList {
-		if promote == "" {
-			if emptyStringIndex == -1 {
-				emptyStringIndex = idx // Only record the first empty string
-			}
-		} else if !isSequenceKeyword(promote) {
-			hasNonEmptyStrings = true
-			// Check for match while we're iterating
-			loweredPromote := strings.ToLower(promote)
-			if strings.Contains(loweredBase, loweredPromote) {
-				return idx
-			}
-		}
-	}
+	return newPromoteList(promoteList).indexWithMode(value, matchMode)
+}
 
-	// If we have an empty string, handle it based on whether there are other non-empty strings
-	if emptyStringIndex >= 0 {
-		if !hasNonEmptyStrings {
-			// If only empty string in promote list, it matches all files
-			return emptyStringIndex
-		}
+/**************************************************************************************************
+** indexWithMode returns the promote index of the value for the given match mode. Contains and
+** negative matching follow index; sequence keywords and the legacy sequence mode are only
+** consulted for values that matched neither.
+**
+** @param value - The filename to check
+** @param matchMode - How to match: "contains" (default), "sequence", "mixed"
+** @return int - Index of the matched promote string, or len(items) if no match
+**************************************************************************************************/
+func (p promoteList) indexWithMode(value string, matchMode string) int {
+	base := utils.PathBase(value)
+	promoteList := p.items
 
-		// If there are other non-empty strings, return empty string index
-		// since we already checked all non-empty promotes in the first loop
-		return emptyStringIndex
+	if idx, ok := p.match(base); ok {
+		return idx
 	}
-
-	// Check if we have a sequence keyword in the promote list
-	sequenceIndex := -1
-	var sequencePrefix string
-	var sequenceDigits int
-
-	for idx, promote := range promoteList {
-		if isSequenceKeyword(promote) {
-			sequenceIndex = idx
-			sequencePrefix, sequenceDigits = extractSequencePattern(promote)
-			break
-		}
+	if p.emptyIndex >= 0 {
+		return p.emptyIndex
 	}
 
 	// If we have a sequence keyword, try to extract sequence number from filename
-	if sequenceIndex >= 0 {
-		// Try multiple strategies to find the sequence number
-
-		// Strategy 1: Look for numbers after underscores (common in burst photos)
-		parts := strings.Split(base, "_")
-		for _, part := range parts {
-			// If we have a specific prefix requirement, check it
-			if sequencePrefix != "" && !strings.HasPrefix(part, sequencePrefix) {
-				continue
+	if sequenceIndex := p.sequenceIndex; sequenceIndex >= 0 {
+		sequencePrefix, sequenceDigits, descending := parseSequenceKeyword(promoteList[sequenceIndex])
+
+		// If we have a prefix requirement, only match filenames with that prefix
+		if sequencePrefix != "" && !strings.Contains(base, sequencePrefix) {
+			// Return a high value to put non-matching files at the end
+			if descending {
+				return sequenceIndex + sequenceDescendingRank(0, sequenceDigits) + 1
 			}
-
-			// Extract the numeric portion
-			numStr := part
-			if sequencePrefix != "" {
-				numStr = strings.TrimPrefix(part, sequencePrefix)
-			}
-
-			// Check if it matches digit requirements
-			if sequenceDigits > 0 && len(numStr) != sequenceDigits {
-				continue
-			}
-
-			// Try to parse as number
-			if num, err := strconv.Atoi(numStr); err == nil {
-				// Return the sequence index + the number
-				// This ensures sequences come after explicit promotes
-				return sequenceIndex + num
-			}
-		}
-
-		// Strategy 2: Use regex to find numbers in the filename
-		var numPattern string
-		if sequenceDigits > 0 {
-			numPattern = fmt.Sprintf(`\d{%d}`, sequenceDigits)
-		} else {
-			numPattern = `\d+`
+			return len(promoteList) + 10000
 		}
 
-		if sequencePrefix != "" {
-			// If we have a prefix requirement, only match filenames with that prefix
-			if !strings.Contains(base, sequencePrefix) {
-				// Return a high value to put non-matching files at the end
-				return len(promoteList) + 10000
+		if num, ok := extractSequenceNumber(base, sequencePrefix, sequenceDigits); ok {
+			// Offset by the sequence index so sequences come after explicit promotes
+			if descending {
+				return sequenceIndex + sequenceDescendingRank(num, sequenceDigits)
 			}
-			numPattern = regexp.QuoteMeta(sequencePrefix) + numPattern
+			return sequenceIndex + num
 		}
-
-		re := regexp.MustCompile(numPattern)
-		if matches := re.FindStringSubmatch(base); len(matches) > 0 {
-			numStr := matches[0]
-			if sequencePrefix != "" {
-				numStr = strings.TrimPrefix(numStr, sequencePrefix)
-			}
-
-			if num, err := strconv.Atoi(numStr); err == nil {
-				return sequenceIndex + num
-			}
+		// unmatchedIndex is below the descending ranks, a file without a number goes after them
+		if descending {
+			return sequenceIndex + sequenceDescendingRank(0, sequenceDigits) + 1
 		}
 	}
 
@@ -312,14 +666,7 @@ func getPromoteIndexWithMode(value string, promoteList []string, matchMode strin
 		}
 	}
 
-	// If 'biggestNumber' is in the promote list, assign its index to unmatched files
-	for idx, promote := range promoteList {
-		if promote == "biggestNumber" {
-			return idx
-		}
-	}
-
-	return len(promoteList)
+	return p.unmatchedIndex()
 }
 
 /**************************************************************************************************
@@ -356,7 +703,7 @@ func shouldUseSequenceMatching(filename string, promoteList []string) bool {
 	}
 
 	// Check if filename has similar structure (same prefix/suffix pattern)
-	base := filepath.Base(filename)
+	base := utils.PathBase(filename)
 
 	// If we have a prefix, check if it exists in the filename
 	if prefix != "" && !strings.Contains(base, prefix) {
@@ -414,7 +761,7 @@ func detectPromoteMatchMode(promoteList []string, sampleFilename string) string
 	for _, promote := range promoteList {
 		if isSequenceKeyword(promote) {
 			hasSequenceKeyword = true
-		} else if promote != "" && promote != "biggestNumber" {
+		} else if promote != "" && !isBiggestNumberKeyword(promote) {
 			hasNonSequenceItems = true
 		}
 	}
@@ -465,7 +812,7 @@ func isSequencePattern(promoteList []string) bool {
 	patternRegex := regexp.MustCompile(`^(.*?)(\d+)(.*?)$`)
 
 	for _, item := range promoteList {
-		if item == "biggestNumber" {
+		if isBiggestNumberKeyword(item) || item == "rating" || item == editedAnyKeyword || item == partNumberKeyword || isUploadKeyword(item) {
 			continue
 		}
 
@@ -623,8 +970,8 @@ func buildCriteriaIdentifier(key string, index int) string {
 ** @return int - The numeric suffix, or 0 if none found or no delimiter present
 **************************************************************************************************/
 func extractLargestNumberSuffix(filename string, delimiters []string) int {
-	base := filename
-	ext := filepath.Ext(base)
+	base := utils.PathBase(filename)
+	ext := path.Ext(base)
 	if ext != "" {
 		base = base[:len(base)-len(ext)]
 	}
@@ -655,13 +1002,114 @@ func extractLargestNumberSuffix(filename string, delimiters []string) int {
 }
 
 /**************************************************************************************************
-** sortStack sorts a stack of assets based on filename and extension priority.
-** The order is:
-** 1. Regex-based promotion (if criteria has regex with promote_index)
-** 2. Promoted filenames (PARENT_FILENAME_PROMOTE, comma-separated, order matters)
-** 3. Promoted extensions (PARENT_EXT_PROMOTE, comma-separated, order matters)
-** 4. Extension priority (jpeg > jpg > png > others)
-** 5. Alphabetical order (case-sensitive)
+** sharedNumericPrefix returns the longest prefix shared by the base filenames (without
+** extension) of the stack. The prefix never ends inside a number, so a shared base such as
+** "IMG_1234" is excluded from biggestNumber:any while "IMG_1234" vs "IMG_1235" keeps both numbers.
+**
+** @param stack - Assets of the stack
+** @return string - The shared prefix
+**************************************************************************************************/
+func sharedNumericPrefix(stack []utils.TAsset) string {
+	if len(stack) == 0 {
+		return ""
+	}
+	bases := make([]string, len(stack))
+	for i, asset := range stack {
+		name := utils.PathBase(asset.OriginalFileName)
+		bases[i] = strings.TrimSuffix(name, path.Ext(name))
+	}
+
+	prefix := bases[0]
+	for _, base := range bases[1:] {
+		n := 0
+		for n < len(prefix) && n < len(base) && prefix[n] == base[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+
+	// Back off to the start of a number that continues in any of the filenames
+	n := len(prefix)
+	if n > 0 && isDigit(prefix[n-1]) {
+		for _, base := range bases {
+			if len(base) > n && isDigit(base[n]) {
+				for n > 0 && isDigit(prefix[n-1]) {
+					n--
+				}
+				break
+			}
+		}
+	}
+	return prefix[:n]
+}
+
+/**************************************************************************************************
+** isDigit reports whether the byte is an ASCII digit.
+**************************************************************************************************/
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+/**************************************************************************************************
+** extractLastNumber returns the last numeric run of the base filename (before the extension)
+** after the shared prefix, regardless of delimiters. Used by "biggestNumber:any".
+**
+** @param filename - The filename to analyze
+** @param sharedPrefix - Prefix shared by the stack, ignored for the number search
+** @return int - The last number found, or 0 if none
+**************************************************************************************************/
+func extractLastNumber(filename string, sharedPrefix string) int {
+	base := strings.TrimSuffix(filename, path.Ext(filename))
+	base = strings.TrimPrefix(base, sharedPrefix)
+
+	end := len(base)
+	for end > 0 && !isDigit(base[end-1]) {
+		end--
+	}
+	start := end
+	for start > 0 && isDigit(base[start-1]) {
+		start--
+	}
+	if start == end {
+		return 0
+	}
+	n, err := strconv.Atoi(base[start:end])
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+/**************************************************************************************************
+** ParsePromoteOrder parses the comma-separated PROMOTE_ORDER rule names. An empty order is
+** utils.DefaultPromoteOrder, and the rules left out are not applied.
+**
+** @param order - Comma-separated rule names: regex, filename, ext, extRank, size, alpha
+** @return []string - The rule names in order
+** @return error - An error for an unknown or repeated rule name
+**************************************************************************************************/
+func ParsePromoteOrder(order string) ([]string, error) {
+	if strings.TrimSpace(order) == "" {
+		return utils.DefaultPromoteOrder, nil
+	}
+	rules := make([]string, 0, len(utils.DefaultPromoteOrder))
+	for _, rule := range strings.Split(order, ",") {
+		rule = strings.TrimSpace(rule)
+		switch rule {
+		case utils.PromoteRuleRegex, utils.PromoteRuleFilename, utils.PromoteRuleExt, utils.PromoteRuleExtRank, utils.PromoteRuleSize, utils.PromoteRuleAlpha:
+		default:
+			return nil, fmt.Errorf("unknown promote rule %q, expected regex, filename, ext, extRank, size or alpha", rule)
+		}
+		if utils.Contains(rules, rule) {
+			return nil, fmt.Errorf("promote rule %q is listed twice", rule)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+/**************************************************************************************************
+** sortStack sorts a stack of assets with the default promote order. See sortStackWithOrder.
 **
 ** @param stack - List of assets to sort
 ** @param parentFilenamePromote - Comma-separated list of filename substrings to promote
@@ -673,12 +1121,50 @@ func extractLargestNumberSuffix(filename string, delimiters []string) int {
 ** @return []utils.TAsset - Sorted list of assets
 **************************************************************************************************/
 func sortStack(stack []utils.TAsset, parentFilenamePromote string, parentExtPromote string, delimiters []string, stackCriteria []utils.TCriteria, promoteData *safePromoteData, promotionMaps map[int]map[string]int) []utils.TAsset {
+	return sortStackWithOrder(stack, parentFilenamePromote, parentExtPromote, delimiters, stackCriteria, promoteData, promotionMaps, utils.DefaultPromoteOrder, nil)
+}
+
+/**************************************************************************************************
+** sortStackWithOrder sorts a stack of assets based on filename and extension priority.
+** The order is:
+** 1. Live photo videos referenced by another asset of the stack always come last
+** 2. The promote rules, in the given order (by default regex, filename, ext, extRank, alpha):
+**    - regex: regex-based promotion (if criteria has regex with promote_index)
+**    - filename: promoted filenames (PARENT_FILENAME_PROMOTE, comma-separated, order matters),
+**      including the "rating" keyword which orders by descending EXIF star rating and the
+**      "newestUpload" and "oldestUpload" keywords which order by upload time, and the
+**      "editedAny" keyword which matches the localized edited suffixes
+**    - ext: promoted extensions (PARENT_EXT_PROMOTE, comma-separated, order matters)
+**    - extRank: extension priority (jpeg > jpg > png > others), or the alphabetical order of the
+**      extensions, or left out, with ExtRankFallback
+**    - size: largest file first, from the EXIF file size
+**    - alpha: alphabetical order (case-sensitive)
+** 3. Asset ID, so the order does not depend on the order the assets were fetched in
+** Copies of the same file (same checksum and filename) are then kept next to each other, by ID.
+** Whatever the promote rules, a trashed or archived asset is then never the parent while a
+** visible member exists.
+**
+** @param stack - List of assets to sort
+** @param parentFilenamePromote - Comma-separated list of filename substrings to promote
+** @param parentExtPromote - Comma-separated list of extensions to promote
+** @param delimiters - Delimiters to use for numeric suffix extraction
+** @param stackCriteria - The criteria used to create this stack (for regex promotion)
+** @param promoteData - Thread-safe map of asset ID to promotion values from regex criteria
+** @param promotionMaps - Pre-computed maps for O(1) promotion key lookup
+** @param promoteOrder - Promote rule names, as returned by ParsePromoteOrder. Empty is the default
+** @param editedSuffixes - Suffixes matched by the "editedAny" keyword, empty for the defaults
+** @return []utils.TAsset - Sorted list of assets
+**************************************************************************************************/
+func sortStackWithOrder(stack []utils.TAsset, parentFilenamePromote string, parentExtPromote string, delimiters []string, stackCriteria []utils.TCriteria, promoteData *safePromoteData, promotionMaps map[int]map[string]int, promoteOrder []string, editedSuffixes []string) []utils.TAsset {
+	if len(promoteOrder) == 0 {
+		promoteOrder = utils.DefaultPromoteOrder
+	}
 	promoteSubstrings := parsePromoteList(parentFilenamePromote)
 	if len(promoteSubstrings) == 0 && parentFilenamePromote != "" {
 		promoteSubstrings = utils.DefaultParentFilenamePromote
 	}
 
-	promoteExtensions := parsePromoteList(parentExtPromote)
+	promoteExtensions := parseExtPromoteList(parentExtPromote)
 	if len(promoteExtensions) == 0 {
 		promoteExtensions = utils.DefaultParentExtPromote
 	}
@@ -688,59 +1174,192 @@ func sortStack(stack []utils.TAsset, parentFilenamePromote string, parentExtProm
 	if len(stack) > 0 {
 		matchMode = detectPromoteMatchMode(promoteSubstrings, stack[0].OriginalFileName)
 	}
+	filenamePromote := newPromoteList(promoteSubstrings)
+	filenamePromote.editedSuffixes = editedSuffixes
+	extPromote := newPromoteList(promoteExtensions)
+
+	// biggestNumber:any ignores the part of the filename shared by the whole stack
+	sharedPrefix := ""
+	if filenamePromote.biggestNumberAny {
+		sharedPrefix = sharedNumericPrefix(stack)
+	}
 
-	sort.SliceStable(stack, func(i, j int) bool {
-		// First, check regex-based promotion
-		iRegexPromoteIdx := getRegexPromoteIndex(stack[i].ID, promoteData, stackCriteria, promotionMaps)
-		jRegexPromoteIdx := getRegexPromoteIndex(stack[j].ID, promoteData, stackCriteria, promotionMaps)
-
-		// If both have regex promotion values, compare them
-		if iRegexPromoteIdx >= 0 && jRegexPromoteIdx >= 0 {
-			if iRegexPromoteIdx != jRegexPromoteIdx {
-				return iRegexPromoteIdx < jRegexPromoteIdx
+	livePhotoVideos := livePhotoVideoIDs(stack)
+
+	/**********************************************************************************************
+	** Each rule compares two assets: negative puts a first, positive puts b first, zero is a
+	** tie left to the next rule.
+	**********************************************************************************************/
+	rules := map[string]func(a, b utils.TAsset) int{
+		utils.PromoteRuleRegex: func(a, b utils.TAsset) int {
+			aRegexPromoteIdx := getRegexPromoteIndex(a.ID, promoteData, stackCriteria, promotionMaps)
+			bRegexPromoteIdx := getRegexPromoteIndex(b.ID, promoteData, stackCriteria, promotionMaps)
+			switch {
+			case aRegexPromoteIdx >= 0 && bRegexPromoteIdx >= 0:
+				return aRegexPromoteIdx - bRegexPromoteIdx
+			case aRegexPromoteIdx >= 0:
+				// a has regex promotion, b doesn't - a comes first
+				return -1
+			case bRegexPromoteIdx >= 0:
+				return 1
+			}
+			return 0
+		},
+		utils.PromoteRuleFilename: func(a, b utils.TAsset) int {
+			aName := utils.PathBase(a.OriginalFileName)
+			bName := utils.PathBase(b.OriginalFileName)
+			aPromoteIdx := filenamePromote.indexWithMode(aName, matchMode)
+			bPromoteIdx := filenamePromote.indexWithMode(bName, matchMode)
+
+			// At the position of 'rating' or an upload keyword, assets not promoted by an earlier
+			// entry are ordered by it; ties fall through to the following rules
+			if order := filenamePromote.compareOrdering(a, b, aPromoteIdx, bPromoteIdx); order != 0 {
+				return order
 			}
-		} else if iRegexPromoteIdx >= 0 {
-			// i has regex promotion, j doesn't - i comes first
-			return true
-		} else if jRegexPromoteIdx >= 0 {
-			// j has regex promotion, i doesn't - j comes first
-			return false
-		}
 
-		// Fall back to filename promotion
-		iOriginalFileNameNoExt := filepath.Base(stack[i].OriginalFileName)
-		jOriginalFileNameNoExt := filepath.Base(stack[j].OriginalFileName)
-		iPromoteIdx := getPromoteIndexWithMode(iOriginalFileNameNoExt, promoteSubstrings, matchMode)
-		jPromoteIdx := getPromoteIndexWithMode(jOriginalFileNameNoExt, promoteSubstrings, matchMode)
-		if iPromoteIdx != jPromoteIdx {
-			return iPromoteIdx < jPromoteIdx
-		}
+			if aPromoteIdx != bPromoteIdx {
+				return aPromoteIdx - bPromoteIdx
+			}
 
-		// If both have the same promote index and 'biggestNumber' is in promoteSubstrings, use largest number as priority
-		if utils.Contains(promoteSubstrings, "biggestNumber") && iPromoteIdx < len(promoteSubstrings) {
-			iNum := extractLargestNumberSuffix(iOriginalFileNameNoExt, delimiters)
-			jNum := extractLargestNumberSuffix(jOriginalFileNameNoExt, delimiters)
-			if iNum != jNum {
-				return iNum > jNum // highest number first
+			// If both have the same promote index and 'partNumber' is in promoteSubstrings, the first part comes first
+			if filenamePromote.partNumberIndex >= 0 && aPromoteIdx < len(promoteSubstrings) {
+				if aPart, bPart := extractPartNumber(aName), extractPartNumber(bName); aPart != bPart {
+					return compareInts(aPart, bPart)
+				}
 			}
-		}
 
-		extI := strings.ToLower(filepath.Ext(iOriginalFileNameNoExt))
-		extJ := strings.ToLower(filepath.Ext(jOriginalFileNameNoExt))
-		iExtPromoteIdx := getPromoteIndex(extI, promoteExtensions)
-		jExtPromoteIdx := getPromoteIndex(extJ, promoteExtensions)
-		if iExtPromoteIdx != jExtPromoteIdx {
-			return iExtPromoteIdx < jExtPromoteIdx
+			// If both have the same promote index and 'biggestNumber' is in promoteSubstrings, use largest number as priority
+			if filenamePromote.biggestNumberIndex >= 0 && aPromoteIdx < len(promoteSubstrings) {
+				var aNum, bNum int
+				if filenamePromote.biggestNumberAny {
+					aNum = extractLastNumber(aName, sharedPrefix)
+					bNum = extractLastNumber(bName, sharedPrefix)
+				} else {
+					aNum = extractLargestNumberSuffix(aName, delimiters)
+					bNum = extractLargestNumberSuffix(bName, delimiters)
+				}
+				if aNum != bNum {
+					return compareInts(bNum, aNum) // highest number first
+				}
+			}
+			return 0
+		},
+		utils.PromoteRuleExt: func(a, b utils.TAsset) int {
+			return extPromote.index(assetExt(a)) - extPromote.index(assetExt(b))
+		},
+		utils.PromoteRuleExtRank: func(a, b utils.TAsset) int {
+			return getExtensionRank(assetExt(b)) - getExtensionRank(assetExt(a))
+		},
+		promoteRuleExtAlpha: func(a, b utils.TAsset) int {
+			return strings.Compare(assetExt(a), assetExt(b))
+		},
+		utils.PromoteRuleSize: func(a, b utils.TAsset) int {
+			return compareInts(assetFileSize(b), assetFileSize(a)) // largest file first
+		},
+		utils.PromoteRuleAlpha: func(a, b utils.TAsset) int {
+			return strings.Compare(utils.PathBase(a.OriginalFileName), utils.PathBase(b.OriginalFileName))
+		},
+	}
+
+	sort.SliceStable(stack, func(i, j int) bool {
+		// The motion part of a live photo is never promoted above its image
+		iLiveVideo := livePhotoVideos[stack[i].ID]
+		jLiveVideo := livePhotoVideos[stack[j].ID]
+		if iLiveVideo != jLiveVideo {
+			return jLiveVideo
 		}
 
-		rankI := getExtensionRank(extI)
-		rankJ := getExtensionRank(extJ)
-		if rankI != rankJ {
-			return rankI > rankJ
+		for _, rule := range promoteOrder {
+			if cmp := rules[rule](stack[i], stack[j]); cmp != 0 {
+				return cmp < 0
+			}
 		}
 
-		return iOriginalFileNameNoExt < jOriginalFileNameNoExt
+		// Ties on every rule, such as identical filenames from different folders, keep the same
+		// order in every run
+		return stack[i].ID < stack[j].ID
 	})
 
+	keepDuplicatesAdjacent(stack, livePhotoVideos)
+	promoteVisibleParent(stack, livePhotoVideos)
 	return stack
 }
+
+/**************************************************************************************************
+** assetExt returns the lowercase extension of the asset filename.
+**
+** @param asset - The asset
+** @return string - The extension with its dot, or an empty string
+**************************************************************************************************/
+func assetExt(asset utils.TAsset) string {
+	return strings.ToLower(path.Ext(utils.PathBase(asset.OriginalFileName)))
+}
+
+/**************************************************************************************************
+** assetFileSize returns the file size of the asset from its EXIF metadata.
+**
+** @param asset - The asset
+** @return int - The size in bytes, 0 when unknown
+**************************************************************************************************/
+func assetFileSize(asset utils.TAsset) int {
+	if asset.ExifInfo == nil || asset.ExifInfo.FileSizeInByte == nil {
+		return 0
+	}
+	return int(*asset.ExifInfo.FileSizeInByte)
+}
+
+/**************************************************************************************************
+** compareInts compares two integers without the overflow of a subtraction.
+**
+** @param a - First integer
+** @param b - Second integer
+** @return int - Negative when a < b, positive when a > b, zero when equal
+**************************************************************************************************/
+func compareInts(a int, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+/**************************************************************************************************
+** promoteVisibleParent moves the most visible member to the front of a sorted stack, so a
+** trashed or archived parent never hides the stack from the timeline. The other members keep
+** their order, and live photo videos are never promoted.
+**
+** @param stack - Sorted stack, modified in place
+** @param livePhotoVideos - IDs of the live photo videos of the stack
+**************************************************************************************************/
+func promoteVisibleParent(stack []utils.TAsset, livePhotoVideos map[string]bool) {
+	best := 0
+	for i, asset := range stack {
+		if !livePhotoVideos[asset.ID] && visibilityRank(asset) < visibilityRank(stack[best]) {
+			best = i
+		}
+	}
+	if best == 0 {
+		return
+	}
+	parent := stack[best]
+	copy(stack[1:best+1], stack[:best])
+	stack[0] = parent
+}
+
+/**************************************************************************************************
+** visibilityRank ranks an asset by how visible it is in the timeline.
+**
+** @param asset - The asset to rank
+** @return int - 0 for a visible asset, 1 for an archived one, 2 for a trashed one
+**************************************************************************************************/
+func visibilityRank(asset utils.TAsset) int {
+	switch {
+	case asset.IsTrashed:
+		return 2
+	case asset.IsArchived:
+		return 1
+	}
+	return 0
+}
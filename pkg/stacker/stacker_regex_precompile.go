@@ -2,6 +2,7 @@ package stacker
 
 import (
 	"fmt"
+	"regexp"
 
 	"github.com/majorfi/immich-stack/pkg/utils"
 )
@@ -60,9 +61,37 @@ func precompileExpressionRegexes(expr *utils.TCriteriaExpression) error {
 
 func precompileCriteriaRegex(c utils.TCriteria) error {
 	if c.Regex != nil && c.Regex.Key != "" {
-		if _, err := utils.RegexCompile(c.Regex.Key); err != nil {
+		regex, err := utils.RegexCompile(c.Regex.Key)
+		if err != nil {
 			return fmt.Errorf("failed to compile regex %q: %w", c.Regex.Key, err)
 		}
+		return resolveGroupNames(c.Regex, regex)
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** resolveGroupNames sets Index and PromoteIndex from the capture group names of the regex, so a
+** criteria naming its groups keeps selecting them when the pattern gains or loses a group.
+**
+** @param r - The regex operation, updated in place
+** @param regex - Its compiled pattern
+** @return error - An error if the pattern has no group of a given name
+**************************************************************************************************/
+func resolveGroupNames(r *utils.TRegex, regex *regexp.Regexp) error {
+	if r.IndexName != "" {
+		index := regex.SubexpIndex(r.IndexName)
+		if index < 0 {
+			return fmt.Errorf("regex %q has no capture group named %q", r.Key, r.IndexName)
+		}
+		r.Index = index
+	}
+	if r.PromoteName != "" {
+		index := regex.SubexpIndex(r.PromoteName)
+		if index < 0 {
+			return fmt.Errorf("regex %q has no capture group named %q for promote_index", r.Key, r.PromoteName)
+		}
+		r.PromoteIndex = &index
 	}
 	return nil
 }
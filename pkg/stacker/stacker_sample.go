@@ -0,0 +1,110 @@
+package stacker
+
+import (
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+/**************************************************************************************************
+** criteriaSampler logs, at debug level, the first values each criterion extracts, with the
+** filename they came from, then only counts them: the distinct and the empty values of each
+** criterion are reported once the assets are grouped. A nil sampler records nothing, so the
+** grouping modes call it without checking the DebugSample option.
+**************************************************************************************************/
+type criteriaSampler struct {
+	limit    int
+	criteria []utils.TCriteria
+	logger   *logrus.Logger
+	seen     []int                 // Values observed, by criterion position
+	empty    []int                 // Empty values observed, by criterion position
+	distinct []map[string]struct{} // Distinct values observed, by criterion position
+}
+
+/**************************************************************************************************
+** Creates the sampler of a grouping mode.
+**
+** @param limit - Number of values logged per criterion, DebugSample
+** @param criteria - Criteria of the mode, by position
+** @param logger - Logger of the samples
+** @return *criteriaSampler - The sampler, or nil when the limit is 0 or debug logs are disabled
+**************************************************************************************************/
+func newCriteriaSampler(limit int, criteria []utils.TCriteria, logger *logrus.Logger) *criteriaSampler {
+	if limit <= 0 || len(criteria) == 0 || !logger.IsLevelEnabled(logrus.DebugLevel) {
+		return nil
+	}
+	s := &criteriaSampler{
+		limit:    limit,
+		criteria: criteria,
+		logger:   logger,
+		seen:     make([]int, len(criteria)),
+		empty:    make([]int, len(criteria)),
+		distinct: make([]map[string]struct{}, len(criteria)),
+	}
+	for i := range s.distinct {
+		s.distinct[i] = make(map[string]struct{})
+	}
+	return s
+}
+
+/**************************************************************************************************
+** Records the value a criterion extracted from an asset, logging it while the criterion has
+** logged fewer than the limit. The filename and the values are quoted, as they come from the
+** library.
+**
+** @param position - Position of the criterion
+** @param asset - The asset
+** @param value - The extracted value, empty for a miss
+** @param promote - The promote value of a regex with promote_index, empty otherwise
+**************************************************************************************************/
+func (s *criteriaSampler) observe(position int, asset utils.TAsset, value, promote string) {
+	if s == nil || position >= len(s.criteria) {
+		return
+	}
+	s.seen[position]++
+	if value == "" {
+		s.empty[position]++
+	} else {
+		s.distinct[position][value] = struct{}{}
+	}
+	if s.seen[position] > s.limit {
+		return
+	}
+	c := s.criteria[position]
+	if promote != "" {
+		s.logger.Debugf("Sample criterion #%d %s: %q -> %q, promote %q", position+1, c.Key, asset.OriginalFileName, value, promote)
+		return
+	}
+	s.logger.Debugf("Sample criterion #%d %s: %q -> %q", position+1, c.Key, asset.OriginalFileName, value)
+}
+
+/**************************************************************************************************
+** Records the value of every criterion for an asset, for the expression mode, whose evaluation
+** stops at the first branch deciding the match. Errors are recorded as empty values.
+**
+** @param asset - The asset
+**************************************************************************************************/
+func (s *criteriaSampler) extract(asset utils.TAsset) {
+	if s == nil {
+		return
+	}
+	for i, c := range s.criteria {
+		value, promote, err := extractCriterion(asset, c)
+		if err != nil {
+			value, promote = "", ""
+		}
+		s.observe(i, asset, value, promote)
+	}
+}
+
+/**************************************************************************************************
+** Logs the distribution of the values of each criterion, such as "criterion #1 produced 8,214
+** distinct values, 3,911 empty".
+**************************************************************************************************/
+func (s *criteriaSampler) report() {
+	if s == nil {
+		return
+	}
+	for i, c := range s.criteria {
+		s.logger.Debugf("Sample criterion #%d %s produced %s distinct values, %s empty, from %s assets", i+1, c.Key, formatCount(len(s.distinct[i])), formatCount(s.empty[i]), formatCount(s.seen[i]))
+	}
+}
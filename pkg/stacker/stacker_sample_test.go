@@ -0,0 +1,80 @@
+package stacker
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+/************************************************************************************************
+** Test cases for the per-criterion debug sampling of DebugSample
+************************************************************************************************/
+
+func TestDebugSample(t *testing.T) {
+	assets := []utils.TAsset{}
+	for i := 1; i <= 5; i++ {
+		assets = append(assets,
+			utils.TAsset{ID: fmt.Sprintf("%d-jpg", i), OriginalFileName: fmt.Sprintf("IMG_%04d.JPG", i), LocalDateTime: "2024-01-01T10:00:00.000Z"},
+			utils.TAsset{ID: fmt.Sprintf("%d-dng", i), OriginalFileName: fmt.Sprintf("IMG_%04d.DNG", i), LocalDateTime: "2024-01-01T10:00:00.000Z"},
+		)
+	}
+	assets = append(assets, utils.TAsset{ID: "other", OriginalFileName: "notes.JPG", LocalDateTime: "2024-01-01T10:00:00.000Z"})
+
+	modes := []struct {
+		name     string
+		criteria string
+	}{
+		{
+			name:     "legacy",
+			criteria: `[{"key":"originalFileName","regex":{"key":"^IMG_(\\d+)"}},{"key":"localDateTime"}]`,
+		},
+		{
+			name:     "advanced groups",
+			criteria: `{"mode":"advanced","groups":[{"operator":"AND","criteria":[{"key":"originalFileName","regex":{"key":"^IMG_(\\d+)"}},{"key":"localDateTime"}]}]}`,
+		},
+		{
+			name:     "advanced expression",
+			criteria: `{"mode":"advanced","expression":{"operator":"AND","children":[{"criteria":{"key":"originalFileName","regex":{"key":"^IMG_(\\d+)"}}},{"criteria":{"key":"localDateTime"}}]}}`,
+		},
+	}
+
+	for _, mode := range modes {
+		t.Run(mode.name+" logs the first values and the distribution", func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := logrus.New()
+			logger.SetOutput(&buf)
+			logger.SetLevel(logrus.DebugLevel)
+
+			_, err := New(Options{Criteria: mode.criteria, DebugSample: 3, Logger: logger}).Stack(assets)
+			require.NoError(t, err)
+
+			out := buf.String()
+			assert.Equal(t, 3, strings.Count(out, "Sample criterion #1 originalFileName: "), "sampling stops after DebugSample values")
+			assert.Equal(t, 3, strings.Count(out, "Sample criterion #2 localDateTime: "))
+			assert.Contains(t, out, `Sample criterion #1 originalFileName: \"IMG_0001.JPG\" -> \"IMG_0001\"`)
+			assert.Contains(t, out, "Sample criterion #1 originalFileName produced 5 distinct values, 1 empty, from 11 assets")
+		})
+	}
+
+	t.Run("disabled without debug logs or DebugSample", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := logrus.New()
+		logger.SetOutput(&buf)
+		logger.SetLevel(logrus.InfoLevel)
+		_, err := New(Options{Criteria: modes[0].criteria, DebugSample: 3, Logger: logger}).Stack(assets)
+		require.NoError(t, err)
+		assert.NotContains(t, buf.String(), "Sample criterion")
+
+		buf.Reset()
+		logger.SetLevel(logrus.DebugLevel)
+		_, err = New(Options{Criteria: modes[0].criteria, Logger: logger}).Stack(assets)
+		require.NoError(t, err)
+		assert.NotContains(t, buf.String(), "Sample criterion")
+	})
+}
@@ -0,0 +1,183 @@
+package stacker
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+/**************************************************************************************************
+** IsValidSanityAction checks if an action of the sanity rules is supported. An empty value is
+** treated as utils.SanityActionSplit.
+**
+** @param action - Action to check
+** @return bool - True if the action is supported
+**************************************************************************************************/
+func IsValidSanityAction(action string) bool {
+	switch action {
+	case "", utils.SanityActionSplit, utils.SanityActionDrop:
+		return true
+	default:
+		return false
+	}
+}
+
+/**************************************************************************************************
+** applySanityRules checks the formed stacks against the rules that hold whatever the criteria:
+** the members share a folder with RequireSameFolder, and their capture times spread over at most
+** MaxStackTimeSpread. A stack breaking a rule is split or dropped, as the rule is set to.
+**
+** @param stacks - Stacks built from the criteria
+** @param opts - Options of the run
+** @return []Stack - Stacks following the rules
+**************************************************************************************************/
+func applySanityRules(stacks []Stack, opts Options) []Stack {
+	if opts.RequireSameFolder {
+		stacks = enforceSanityRule(stacks, "folder", opts.FolderAction, opts.Logger, memberFolders, func(_ []utils.TAsset, parts int) string {
+			return fmt.Sprintf("its members are in %d folders and REQUIRE_SAME_FOLDER is set", parts)
+		})
+	}
+	if opts.MaxStackTimeSpread > 0 {
+		spread := opts.MaxStackTimeSpread
+		stacks = enforceSanityRule(stacks, "timeSpread", opts.TimeSpreadAction, opts.Logger, func(members []utils.TAsset) []string {
+			return memberTimeSpans(members, spread)
+		}, func(members []utils.TAsset, _ int) string {
+			return fmt.Sprintf("its members were taken %s apart, above MAX_STACK_TIME_SPREAD (%s)", memberTimeSpread(members), spread)
+		})
+	}
+	return stacks
+}
+
+/**************************************************************************************************
+** enforceSanityRule splits or drops the stacks whose members fall in several parts of a rule.
+** Split stacks keep the sorted order of their members, so the first member of each part becomes
+** its parent, and the part is added to their key. Parts left with a single asset are dropped.
+**
+** @param stacks - Stacks to check
+** @param rule - Name of the rule, added to the key of split stacks
+** @param action - utils.SanityActionSplit (empty) or utils.SanityActionDrop
+** @param logger - Logger for the split and dropped stacks
+** @param partsOf - Part of each member, in the order of the members
+** @param describe - Reason a stack breaks the rule, given its members and number of parts
+** @return []Stack - Stacks whose members all fall in the same part
+**************************************************************************************************/
+func enforceSanityRule(stacks []Stack, rule, action string, logger *logrus.Logger, partsOf func([]utils.TAsset) []string, describe func([]utils.TAsset, int) string) []Stack {
+	result := make([]Stack, 0, len(stacks))
+	for _, stack := range stacks {
+		var parts []string
+		byPart := make(map[string][]utils.TAsset)
+		for i, part := range partsOf(stack.Members) {
+			if _, ok := byPart[part]; !ok {
+				parts = append(parts, part)
+			}
+			byPart[part] = append(byPart[part], stack.Members[i])
+		}
+		if len(parts) == 1 {
+			result = append(result, stack)
+			continue
+		}
+
+		if action == utils.SanityActionDrop {
+			logger.Warnf("⚠️  Dropped the stack of %d assets with key %q: %s", len(stack.Members), stack.Key, describe(stack.Members, len(parts)))
+			continue
+		}
+		logger.Infof("Splitting the stack of %d assets with key %q: %s", len(stack.Members), stack.Key, describe(stack.Members, len(parts)))
+		for _, part := range parts {
+			if members := byPart[part]; len(members) > 1 {
+				split := newStack(members, stack.Key+"|"+rule+"="+part)
+				split.Branch = stack.Branch
+				split.Values = stack.Values
+				result = append(result, split)
+			}
+		}
+	}
+	return result
+}
+
+/**************************************************************************************************
+** memberFolders returns the folder of the original path of each member, a Windows path read
+** with forward slashes like the others.
+**
+** @param members - Members of a stack
+** @return []string - Folder of each member
+**************************************************************************************************/
+func memberFolders(members []utils.TAsset) []string {
+	folders := make([]string, len(members))
+	for i, member := range members {
+		folders[i] = path.Dir(utils.NormalizePathSeparators(member.OriginalPath))
+	}
+	return folders
+}
+
+/**************************************************************************************************
+** memberTimeSpans cuts the capture times of the members into spans of at most spread each: the
+** members are taken by time, and a span starts at the first member past the spread of the
+** previous start. Members without a valid localDateTime are not checked, they stay with the
+** first dated member in the order of the stack.
+**
+** @param members - Members of a stack
+** @param spread - Maximum spread of a span
+** @return []string - Start of the span of each member
+**************************************************************************************************/
+func memberTimeSpans(members []utils.TAsset, spread time.Duration) []string {
+	times := make([]time.Time, len(members))
+	var dated []int
+	for i, member := range members {
+		if t, err := time.Parse(time.RFC3339Nano, member.LocalDateTime); err == nil {
+			times[i] = t
+			dated = append(dated, i)
+		}
+	}
+	sort.SliceStable(dated, func(a, b int) bool { return times[dated[a]].Before(times[dated[b]]) })
+
+	spans := make([]string, len(members))
+	var start time.Time
+	for n, i := range dated {
+		if n == 0 || times[i].Sub(start) > spread {
+			start = times[i]
+		}
+		spans[i] = start.UTC().Format(utils.TimeFormat)
+	}
+	if len(dated) > 0 && len(dated) < len(members) {
+		first := ""
+		for _, span := range spans {
+			if span != "" {
+				first = span
+				break
+			}
+		}
+		for i := range spans {
+			if spans[i] == "" {
+				spans[i] = first
+			}
+		}
+	}
+	return spans
+}
+
+/**************************************************************************************************
+** memberTimeSpread returns the time between the first and the last capture of the members.
+**
+** @param members - Members of a stack
+** @return time.Duration - The spread, 0 if fewer than two members have a valid localDateTime
+**************************************************************************************************/
+func memberTimeSpread(members []utils.TAsset) time.Duration {
+	var first, last time.Time
+	for _, member := range members {
+		t, err := time.Parse(time.RFC3339Nano, member.LocalDateTime)
+		if err != nil {
+			continue
+		}
+		if first.IsZero() || t.Before(first) {
+			first = t
+		}
+		if last.IsZero() || t.After(last) {
+			last = t
+		}
+	}
+	return last.Sub(first)
+}
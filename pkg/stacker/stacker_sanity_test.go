@@ -0,0 +1,88 @@
+package stacker
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanityRules(t *testing.T) {
+	// A criteria on the filename alone groups IMG_0001 of two trips and two folders
+	assets := []utils.TAsset{
+		{ID: "a-jpg", OriginalFileName: "IMG_0001.jpg", OriginalPath: "/upload/2023/IMG_0001.jpg", LocalDateTime: "2023-05-01T10:00:00.000Z"},
+		{ID: "a-dng", OriginalFileName: "IMG_0001.dng", OriginalPath: "/upload/2023/IMG_0001.dng", LocalDateTime: "2023-05-01T10:00:01.000Z"},
+		{ID: "b-jpg", OriginalFileName: "IMG_0001.jpg", OriginalPath: "/upload/2024/IMG_0001.jpg", LocalDateTime: "2024-08-12T18:00:00.000Z"},
+		{ID: "b-dng", OriginalFileName: "IMG_0001.dng", OriginalPath: "/upload/2024/IMG_0001.dng"},
+	}
+	criteria := `[{"key": "originalFileName", "split": {"delimiters": ["."], "index": 0}}]`
+
+	signatures := func(stacks []Stack) [][]string {
+		var got [][]string
+		for _, stack := range stacks {
+			got = append(got, stackMemberIDs(stack))
+		}
+		return got
+	}
+
+	t.Run("no rule", func(t *testing.T) {
+		stacks, err := New(Options{Criteria: criteria}).Stack(assets)
+		require.NoError(t, err)
+		assert.Len(t, stacks, 1)
+	})
+
+	t.Run("same folder split", func(t *testing.T) {
+		stacks, err := New(Options{Criteria: criteria, RequireSameFolder: true}).Stack(assets)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, [][]string{{"a-jpg", "a-dng"}, {"b-jpg", "b-dng"}}, signatures(stacks))
+		for _, stack := range stacks {
+			assert.Contains(t, stack.Key, "|folder=/upload/")
+		}
+	})
+
+	t.Run("same folder split of Windows paths", func(t *testing.T) {
+		windows := []utils.TAsset{
+			{ID: "a-jpg", OriginalFileName: "IMG_0001.jpg", OriginalPath: `D:\Photos\2023\IMG_0001.jpg`},
+			{ID: "a-dng", OriginalFileName: "IMG_0001.dng", OriginalPath: `D:\Photos\2023\IMG_0001.dng`},
+			{ID: "b-jpg", OriginalFileName: "IMG_0001.jpg", OriginalPath: `D:\Photos\2024\IMG_0001.jpg`},
+		}
+		stacks, err := New(Options{Criteria: criteria, RequireSameFolder: true}).Stack(windows)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, [][]string{{"a-jpg", "a-dng"}}, signatures(stacks))
+	})
+
+	t.Run("time spread split", func(t *testing.T) {
+		stacks, err := New(Options{Criteria: criteria, MaxStackTimeSpread: 24 * time.Hour}).Stack(assets)
+		require.NoError(t, err)
+		// The undated asset stays with the first dated member of the stack
+		assert.ElementsMatch(t, [][]string{{"a-jpg", "a-dng", "b-dng"}}, signatures(stacks))
+		assert.Contains(t, stacks[0].Key, "|timeSpread=2023-05-01T10:00:00")
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		var out bytes.Buffer
+		logger := logrus.New()
+		logger.SetOutput(&out)
+
+		stacks, err := New(Options{Criteria: criteria, MaxStackTimeSpread: 24 * time.Hour, TimeSpreadAction: utils.SanityActionDrop, Logger: logger}).Stack(assets)
+		require.NoError(t, err)
+		assert.Empty(t, stacks)
+		assert.Contains(t, out.String(), "Dropped the stack of 4 assets with key \\\"IMG_0001\\\": its members were taken 11264h0m0s apart, above MAX_STACK_TIME_SPREAD (24h0m0s)")
+	})
+
+	t.Run("rules within the limits keep the stacks", func(t *testing.T) {
+		stacks, err := New(Options{Criteria: criteria, RequireSameFolder: true, MaxStackTimeSpread: time.Hour, FolderAction: utils.SanityActionDrop}).Stack(assets[:2])
+		require.NoError(t, err)
+		require.Len(t, stacks, 1)
+		assert.Equal(t, "IMG_0001", stacks[0].Key)
+	})
+
+	t.Run("unknown action", func(t *testing.T) {
+		_, err := New(Options{Criteria: criteria, FolderAction: "merge"}).Stack(assets)
+		assert.ErrorContains(t, err, `unknown sanity action "merge", expected split or drop`)
+	})
+}
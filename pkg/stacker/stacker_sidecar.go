@@ -0,0 +1,45 @@
+package stacker
+
+import (
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+/**************************************************************************************************
+** keepSidecarsOffParent makes sure a sidecar, such as IMG_1234.jpg.json, is never the parent of a
+** stack, whatever the promote rules, the parent overrides and the parent selector picked: the
+** first other member becomes the parent, the others keep their order. A stack of sidecars only is
+** dropped, as it has no member to show.
+**
+** @param stacks - Stacks with their selected parent
+** @param logger - Logger for the dropped stacks
+** @return []Stack - The stacks, none with a sidecar as parent
+**************************************************************************************************/
+func keepSidecarsOffParent(stacks []Stack, logger *logrus.Logger) []Stack {
+	kept := stacks[:0]
+	for _, stack := range stacks {
+		if !utils.IsSidecar(stack.Parent.OriginalFileName) {
+			kept = append(kept, stack)
+			continue
+		}
+		parent := -1
+		for i, member := range stack.Members {
+			if !utils.IsSidecar(member.OriginalFileName) {
+				parent = i
+				break
+			}
+		}
+		if parent < 0 {
+			logger.Debugf("Stack %s only holds sidecar files, not stacked", stack.Key)
+			continue
+		}
+		members := make([]utils.TAsset, 0, len(stack.Members))
+		members = append(members, stack.Members[parent])
+		members = append(members, stack.Members[:parent]...)
+		members = append(members, stack.Members[parent+1:]...)
+		stack.Parent = members[0]
+		stack.Members = members
+		kept = append(kept, stack)
+	}
+	return kept
+}
@@ -0,0 +1,44 @@
+package stacker
+
+import (
+	"io"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeepSidecarsOffParent(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	stacks := []Stack{
+		newStack([]utils.TAsset{{ID: "json", OriginalFileName: "IMG_1234.jpg.json"}, {ID: "xmp", OriginalFileName: "IMG_1234.XMP"}, {ID: "jpg", OriginalFileName: "IMG_1234.jpg"}, {ID: "dng", OriginalFileName: "IMG_1234.dng"}}, "a"),
+		newStack([]utils.TAsset{{ID: "json", OriginalFileName: "IMG_1235.jpg.json"}, {ID: "aae", OriginalFileName: "IMG_1235.AAE"}}, "b"),
+		newStack([]utils.TAsset{{ID: "heic", OriginalFileName: "IMG_1236.heic"}, {ID: "aae", OriginalFileName: "IMG_1236.aae"}}, "c"),
+	}
+
+	kept := keepSidecarsOffParent(stacks, logger)
+	require.Len(t, kept, 2, "a stack of sidecars only is dropped")
+	assert.Equal(t, "jpg", kept[0].Parent.ID)
+	assert.Equal(t, []string{"jpg", "json", "xmp", "dng"}, stackMemberIDs(kept[0]), "the others keep their order")
+	assert.Equal(t, "heic", kept[1].Parent.ID)
+}
+
+func TestSidecarNeverParent(t *testing.T) {
+	assets := []utils.TAsset{
+		{ID: "json", OriginalFileName: "IMG_1234.jpg.json", LocalDateTime: "2024-05-01T10:00:00.000Z"},
+		{ID: "jpg", OriginalFileName: "IMG_1234.jpg", LocalDateTime: "2024-05-01T10:00:00.000Z"},
+	}
+	// The sidecar comes first with the promote rules
+	stacks, err := New(Options{ParentExtPromote: ".json,.jpg"}).Stack(assets)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.Equal(t, "jpg", stacks[0].Parent.ID)
+
+	stacks, err = New(Options{}).StackGroups(map[string][]utils.TAsset{"dup": {assets[0], assets[1]}})
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.Equal(t, "jpg", stacks[0].Parent.ID)
+}
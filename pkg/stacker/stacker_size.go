@@ -0,0 +1,94 @@
+package stacker
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+)
+
+/**************************************************************************************************
+** IsValidOversizePolicy checks if a policy on the stacks above MaxStackSize is supported. An empty
+** value is treated as utils.OversizePolicySkip.
+**
+** @param policy - Policy to check
+** @return bool - True if the policy is supported
+**************************************************************************************************/
+func IsValidOversizePolicy(policy string) bool {
+	switch policy {
+	case "", utils.OversizePolicySkip, utils.OversizePolicySplit:
+		return true
+	default:
+		return false
+	}
+}
+
+/**************************************************************************************************
+** enforceMaxStackSize skips the stacks of more than MaxStackSize members with a warning, or splits
+** them into chronological chunks with OversizePolicySplit, the chunk being added to their key.
+**
+** @param stacks - Stacks to check
+** @param opts - Options of the run
+** @return []Stack - Stacks of at most MaxStackSize members
+**************************************************************************************************/
+func enforceMaxStackSize(stacks []Stack, opts Options) []Stack {
+	if opts.MaxStackSize <= 0 {
+		return stacks
+	}
+	action := utils.SanityActionDrop
+	if opts.OversizePolicy == utils.OversizePolicySplit {
+		action = utils.SanityActionSplit
+	}
+	limit := opts.MaxStackSize
+	return enforceSanityRule(stacks, "chunk", action, opts.Logger, func(members []utils.TAsset) []string {
+		return memberChunks(members, limit)
+	}, func(members []utils.TAsset, _ int) string {
+		return fmt.Sprintf("it has %d members, above SERVER_MAX_STACK_SIZE (%d)", len(members), limit)
+	})
+}
+
+/**************************************************************************************************
+** memberChunks cuts the members into chunks of limit members, the last one holding the rest. The
+** members are taken by capture time then ID, undated ones last, so the same members always give
+** the same chunks, whatever the order of the stack, and a new member taken after the others
+** only changes the last chunk.
+**
+** @param members - Members of a stack
+** @param limit - Maximum members of a chunk
+** @return []string - Chunk of each member, numbered from 1
+**************************************************************************************************/
+func memberChunks(members []utils.TAsset, limit int) []string {
+	chunks := make([]string, len(members))
+	if len(members) <= limit {
+		for i := range chunks {
+			chunks[i] = "1"
+		}
+		return chunks
+	}
+
+	times := make([]time.Time, len(members))
+	order := make([]int, len(members))
+	for i, member := range members {
+		if t, err := time.Parse(time.RFC3339Nano, member.LocalDateTime); err == nil {
+			times[i] = t
+		}
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		ta, tb := times[order[a]], times[order[b]]
+		if ta.IsZero() != tb.IsZero() {
+			return tb.IsZero()
+		}
+		if !ta.Equal(tb) {
+			return ta.Before(tb)
+		}
+		return members[order[a]].ID < members[order[b]].ID
+	})
+
+	for rank, i := range order {
+		chunks[i] = strconv.Itoa(rank/limit + 1)
+	}
+	return chunks
+}
@@ -0,0 +1,89 @@
+package stacker
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxStackSize(t *testing.T) {
+	// A timelapse of 7 frames, one second apart, grouped on the time alone
+	var assets []utils.TAsset
+	for i := 0; i < 7; i++ {
+		assets = append(assets, utils.TAsset{
+			ID:               fmt.Sprintf("frame-%d", i),
+			OriginalFileName: fmt.Sprintf("TL_%04d.jpg", i),
+			LocalDateTime:    fmt.Sprintf("2024-01-01T10:00:%02d.000Z", i),
+		})
+	}
+	criteria := `[{"key": "localDateTime", "delta": {"milliseconds": 60000}}]`
+
+	t.Run("skip by default", func(t *testing.T) {
+		var out bytes.Buffer
+		logger := logrus.New()
+		logger.SetOutput(&out)
+
+		stacks, err := New(Options{Criteria: criteria, MaxStackSize: 3, Logger: logger}).Stack(assets)
+		require.NoError(t, err)
+		assert.Empty(t, stacks)
+		assert.Contains(t, out.String(), "it has 7 members, above SERVER_MAX_STACK_SIZE (3)")
+	})
+
+	t.Run("split into chronological chunks", func(t *testing.T) {
+		stacks, err := New(Options{Criteria: criteria, MaxStackSize: 3, OversizePolicy: utils.OversizePolicySplit}).Stack(assets)
+		require.NoError(t, err)
+		require.Len(t, stacks, 2, "the last chunk of a single frame is no stack")
+		var got [][]string
+		for _, stack := range stacks {
+			assert.LessOrEqual(t, len(stack.Members), 3)
+			assert.Contains(t, stack.Key, "|chunk=")
+			got = append(got, stackMemberIDs(stack))
+		}
+		assert.ElementsMatch(t, [][]string{{"frame-0", "frame-1", "frame-2"}, {"frame-3", "frame-4", "frame-5"}}, got)
+	})
+
+	t.Run("a new member only changes the last chunk", func(t *testing.T) {
+		before := memberChunks(assets, 3)
+		grown := append(append([]utils.TAsset(nil), assets...), utils.TAsset{ID: "frame-7", LocalDateTime: "2024-01-01T10:00:07.000Z"})
+		after := memberChunks(grown, 3)
+		for i := range before {
+			if before[i] != "3" {
+				assert.Equal(t, before[i], after[i], assets[i].ID)
+			}
+		}
+		assert.Equal(t, "3", after[len(after)-1])
+	})
+
+	t.Run("chunks do not depend on the order of the assets", func(t *testing.T) {
+		reversed := make([]utils.TAsset, len(assets))
+		for i, asset := range assets {
+			reversed[len(assets)-1-i] = asset
+		}
+		assert.Equal(t, memberChunks(assets, 3), reverseStrings(memberChunks(reversed, 3)))
+	})
+
+	t.Run("stacks within the limit are kept", func(t *testing.T) {
+		stacks, err := New(Options{Criteria: criteria, MaxStackSize: 7}).Stack(assets)
+		require.NoError(t, err)
+		require.Len(t, stacks, 1)
+		assert.NotContains(t, stacks[0].Key, "chunk")
+	})
+
+	t.Run("unknown policy", func(t *testing.T) {
+		_, err := New(Options{Criteria: criteria, OversizePolicy: "truncate"}).Stack(assets)
+		assert.ErrorContains(t, err, "unknown oversize policy")
+	})
+}
+
+func reverseStrings(values []string) []string {
+	reversed := make([]string, len(values))
+	for i, value := range values {
+		reversed[len(values)-1-i] = value
+	}
+	return reversed
+}
@@ -1,7 +1,6 @@
 package stacker
 
 import (
-	"os"
 	"strings"
 	"testing"
 	"time"
@@ -313,15 +312,6 @@ func TestSortStack(t *testing.T) {
 				assets[i] = assetFactory(f, time.Now())
 			}
 
-			if tt.promoteStr != "" {
-				os.Setenv("PARENT_FILENAME_PROMOTE", tt.promoteStr)
-				defer os.Unsetenv("PARENT_FILENAME_PROMOTE")
-			}
-			if tt.promoteExt != "" {
-				os.Setenv("PARENT_EXT_PROMOTE", tt.promoteExt)
-				defer os.Unsetenv("PARENT_EXT_PROMOTE")
-			}
-
 			result := sortStack(assets, tt.promoteStr, tt.promoteExt, []string{"~", "."}, utils.DefaultCriteria, &safePromoteData{data: make(map[string]map[string]string)}, make(map[int]map[string]int))
 
 			expectedAssets := make([]utils.TAsset, len(tt.expectedOrder))
@@ -373,13 +363,8 @@ func TestStackBy(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-
-			if tt.skipMatchMiss {
-				os.Setenv("SKIP_MATCH_MISS", "true")
-				defer os.Unsetenv("SKIP_MATCH_MISS")
-			}
-
-			groups, err := StackBy(tt.assets, "", "", "", logrus.New())
+			stacks, err := New(Options{SkipMatchMiss: tt.skipMatchMiss, Logger: logrus.New()}).Stack(tt.assets)
+			groups := stacksToAssets(stacks)
 
 			if tt.skipMatchMiss {
 				require.NoError(t, err)
@@ -465,12 +450,10 @@ func TestStackBy_SonyBurstWithRegex(t *testing.T) {
 		},
 	}
 
-	t.Setenv("CRITERIA", `[{"key":"originalFileName","regex":{"key":"DSCPDC_(\\d{4})_(BURST\\d{17})(_COVER)?.JPG","index":2}}]`)
-
 	parentFilenamePromote := "0000,0001,0002,0003"
 	parentExtPromote := ""
 
-	stacks, err := StackBy(assets, "", parentFilenamePromote, parentExtPromote, logger)
+	stacks, err := StackBy(assets, `[{"key":"originalFileName","regex":{"key":"DSCPDC_(\\d{4})_(BURST\\d{17})(_COVER)?.JPG","index":2}}]`, parentFilenamePromote, parentExtPromote, logger)
 	assert.NoError(t, err)
 	assert.Len(t, stacks, 1)
 
@@ -523,6 +506,40 @@ func TestSortStack_BurstPhotoWithShuffledInput(t *testing.T) {
 	assert.Equal(t, "DSCPDC_0003_BURST20180828114700954_COVER.JPG", sorted[3].OriginalFileName)
 }
 
+func TestSortStack_IdenticalFilenamesAreStable(t *testing.T) {
+	// The same filename in two folders ties on every rule but the asset ID
+	first := utils.TAsset{ID: "a1", OriginalFileName: "IMG_0001.JPG", OriginalPath: "/2024/trip/IMG_0001.JPG"}
+	second := utils.TAsset{ID: "b2", OriginalFileName: "IMG_0001.JPG", OriginalPath: "/backup/IMG_0001.JPG"}
+	raw := utils.TAsset{ID: "0", OriginalFileName: "IMG_0001.CR3", OriginalPath: "/2024/trip/IMG_0001.CR3"}
+
+	for _, stack := range [][]utils.TAsset{
+		{first, second, raw},
+		{second, first, raw},
+		{raw, second, first},
+	} {
+		sorted := sortStack(stack, "", "", nil, utils.DefaultCriteria, &safePromoteData{data: make(map[string]map[string]string)}, make(map[int]map[string]int))
+		ids := []string{sorted[0].ID, sorted[1].ID, sorted[2].ID}
+		assert.Equal(t, []string{"a1", "b2", "0"}, ids, "the order must not depend on the input order")
+	}
+}
+
+func TestSortStack_TrashedNeverParent(t *testing.T) {
+	edit := utils.TAsset{ID: "1", OriginalFileName: "IMG_1234_edit.jpg", IsTrashed: true}
+	original := utils.TAsset{ID: "2", OriginalFileName: "IMG_1234.jpg"}
+	raw := utils.TAsset{ID: "3", OriginalFileName: "IMG_1234.dng", IsArchived: true}
+
+	sorted := sortStack([]utils.TAsset{edit, original, raw}, utils.DefaultParentFilenamePromoteString, "", nil, utils.DefaultCriteria, &safePromoteData{data: make(map[string]map[string]string)}, make(map[int]map[string]int))
+	assert.Equal(t, []string{"2", "1", "3"}, []string{sorted[0].ID, sorted[1].ID, sorted[2].ID}, "the live JPEG is the parent, the others keep their order")
+
+	// The archived RAW is preferred over the trashed edit when no member is visible
+	sorted = sortStack([]utils.TAsset{edit, raw}, utils.DefaultParentFilenamePromoteString, "", nil, utils.DefaultCriteria, &safePromoteData{data: make(map[string]map[string]string)}, make(map[int]map[string]int))
+	assert.Equal(t, "3", sorted[0].ID)
+
+	// When every member is visible the promote rules decide
+	sorted = sortStack([]utils.TAsset{original, {ID: "4", OriginalFileName: "IMG_1234_edit.jpg"}}, utils.DefaultParentFilenamePromoteString, "", nil, utils.DefaultCriteria, &safePromoteData{data: make(map[string]map[string]string)}, make(map[int]map[string]int))
+	assert.Equal(t, "4", sorted[0].ID)
+}
+
 func TestDetectPromoteMatchMode(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -964,12 +981,10 @@ func TestStackBy_SonyBurstPhotosFullWorkflow(t *testing.T) {
 		},
 	}
 
-	t.Setenv("CRITERIA", `[{"key":"originalFileName","regex":{"key":"DSCPDC_(\\d{4})_(BURST\\d{17})(_COVER)?.JPG","index":2}}]`)
-
 	parentFilenamePromote := "sequence:4"
 	parentExtPromote := ".jpg,.png,.jpeg,.dng"
 
-	stacks, err := StackBy(assets, "", parentFilenamePromote, parentExtPromote, logger)
+	stacks, err := StackBy(assets, `[{"key":"originalFileName","regex":{"key":"DSCPDC_(\\d{4})_(BURST\\d{17})(_COVER)?.JPG","index":2}}]`, parentFilenamePromote, parentExtPromote, logger)
 	assert.NoError(t, err)
 	assert.Len(t, stacks, 2, "Should have 2 stacks")
 
@@ -1009,8 +1024,8 @@ func TestSequenceKeywordVariations(t *testing.T) {
 			},
 			expected: []string{
 				"IMG_001.jpg",
-				"IMG_10.jpg",
 				"IMG_010.jpg",
+				"IMG_10.jpg",
 				"IMG_100.jpg",
 				"IMG_1000.jpg",
 			},
@@ -1131,6 +1146,80 @@ func TestSequenceKeywordVariations(t *testing.T) {
 				"OTHER_0001.jpg",
 			},
 		},
+		{
+			name:        "Padded and unpadded numbers compare by value",
+			promoteList: []string{"sequence:4"},
+			filenames: []string{
+				"IMG_0011.jpg",
+				"IMG_10.jpg",
+				"IMG_9.jpg",
+				"IMG_0002.jpg",
+			},
+			expected: []string{
+				"IMG_0002.jpg",
+				"IMG_9.jpg",
+				"IMG_10.jpg",
+				"IMG_0011.jpg",
+			},
+		},
+		{
+			name:        "Descending sequence",
+			promoteList: []string{"sequence:desc"},
+			filenames: []string{
+				"DSC_0001.jpg",
+				"DSC_0003.jpg",
+				"DSC_0002.jpg",
+			},
+			expected: []string{
+				"DSC_0003.jpg",
+				"DSC_0002.jpg",
+				"DSC_0001.jpg",
+			},
+		},
+		{
+			name:        "Descending 4-digit sequence after COVER",
+			promoteList: []string{"COVER", "sequence:4:desc"},
+			filenames: []string{
+				"DSCPDC_0000_BURST20180828114700954.JPG",
+				"DSCPDC_0002_BURST20180828114700954.JPG",
+				"DSCPDC_0001_BURST20180828114700954_COVER.JPG",
+				"DSCPDC_3_BURST20180828114700954.JPG",
+			},
+			expected: []string{
+				"DSCPDC_0001_BURST20180828114700954_COVER.JPG",
+				"DSCPDC_3_BURST20180828114700954.JPG",
+				"DSCPDC_0002_BURST20180828114700954.JPG",
+				"DSCPDC_0000_BURST20180828114700954.JPG",
+			},
+		},
+		{
+			name:        "Descending sequence with prefix",
+			promoteList: []string{"sequence:IMG_:desc"},
+			filenames: []string{
+				"IMG_1.jpg",
+				"PHOTO_9.jpg",
+				"IMG_2.jpg",
+			},
+			expected: []string{
+				"IMG_2.jpg",
+				"IMG_1.jpg",
+				"PHOTO_9.jpg",
+			},
+		},
+		{
+			name:        "Descending sequence with a file without number",
+			promoteList: []string{"sequence:desc"},
+			filenames: []string{
+				"IMG_0001.jpg",
+				"cover.jpg",
+				"IMG_0002.jpg",
+			},
+			expected: []string{
+				"IMG_0002.jpg",
+				"IMG_0001.jpg",
+				"cover.jpg",
+			},
+		},
 		{
 			name:        "Multiple sequences with priority mixing",
 			promoteList: []string{"COVER", "sequence:4", "EDIT", "sequence"},
@@ -1325,9 +1414,7 @@ func TestPixelPhoneStacking(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 
-			t.Setenv("CRITERIA", mustMarshalJSON(t, tt.criteria))
-
-			groups, err := StackBy(tt.assets, "", "", "", logrus.New())
+			groups, err := StackBy(tt.assets, mustMarshalJSON(t, tt.criteria), "", "", logrus.New())
 			require.NoError(t, err)
 			assert.Equal(t, tt.want, len(groups), "%s: Expected %d groups but got %d", tt.desc, tt.want, len(groups))
 
@@ -1342,6 +1429,197 @@ func TestPixelPhoneStacking(t *testing.T) {
 	}
 }
 
+func TestBiggestNumberAnyPromotion(t *testing.T) {
+	tests := []struct {
+		name          string
+		promote       string
+		inputOrder    []string
+		expectedOrder []string
+	}{
+		{
+			name:          "trailing number embedded in a word wins over the shared base",
+			promote:       "biggestNumber:any",
+			inputOrder:    []string{"IMG_1234.jpg", "IMG_1234edit2.jpg"},
+			expectedOrder: []string{"IMG_1234edit2.jpg", "IMG_1234.jpg"},
+		},
+		{
+			name:          "plain biggestNumber keeps the strict suffix behavior",
+			promote:       "biggestNumber",
+			inputOrder:    []string{"IMG_1234.jpg", "IMG_1234edit2.jpg"},
+			expectedOrder: []string{"IMG_1234.jpg", "IMG_1234edit2.jpg"},
+		},
+		{
+			name:          "last of multiple numeric runs is used",
+			promote:       "biggestNumber:any",
+			inputOrder:    []string{"IMG_1234v9copy1.jpg", "IMG_1234v1copy3.jpg", "IMG_1234.jpg"},
+			expectedOrder: []string{"IMG_1234v1copy3.jpg", "IMG_1234v9copy1.jpg", "IMG_1234.jpg"},
+		},
+		{
+			name:          "shared base number does not influence ordering",
+			promote:       "biggestNumber:any",
+			inputOrder:    []string{"PXL_20230101_999edit1.jpg", "PXL_20230101_999edit10.jpg", "PXL_20230101_999edit2.jpg"},
+			expectedOrder: []string{"PXL_20230101_999edit10.jpg", "PXL_20230101_999edit2.jpg", "PXL_20230101_999edit1.jpg"},
+		},
+		{
+			name:          "number continuing past the shared prefix is compared whole",
+			promote:       "biggestNumber:any",
+			inputOrder:    []string{"IMG_12.jpg", "IMG_19.jpg", "IMG_1.jpg"},
+			expectedOrder: []string{"IMG_19.jpg", "IMG_12.jpg", "IMG_1.jpg"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assets := make([]utils.TAsset, len(tt.inputOrder))
+			for i, f := range tt.inputOrder {
+				assets[i] = assetFactory(f, time.Now())
+			}
+
+			result := sortStack(assets, tt.promote, "", []string{"_"}, utils.DefaultCriteria, &safePromoteData{data: make(map[string]map[string]string)}, make(map[int]map[string]int))
+
+			actual := make([]string, len(result))
+			for i, asset := range result {
+				actual[i] = asset.OriginalFileName
+			}
+			assert.Equal(t, tt.expectedOrder, actual)
+		})
+	}
+}
+
+func TestSharedNumericPrefix(t *testing.T) {
+	stack := func(names ...string) []utils.TAsset {
+		assets := make([]utils.TAsset, len(names))
+		for i, name := range names {
+			assets[i] = utils.TAsset{OriginalFileName: name}
+		}
+		return assets
+	}
+
+	assert.Equal(t, "IMG_1234", sharedNumericPrefix(stack("IMG_1234.jpg", "IMG_1234edit2.jpg")))
+	assert.Equal(t, "IMG_", sharedNumericPrefix(stack("IMG_1234.jpg", "IMG_1235.jpg")))
+	assert.Equal(t, "IMG_", sharedNumericPrefix(stack("IMG_1.jpg", "IMG_12.jpg")))
+	assert.Equal(t, "", sharedNumericPrefix(nil))
+}
+
+func TestRatingPromotion(t *testing.T) {
+	rated := func(name string, rating int) utils.TAsset {
+		asset := utils.TAsset{ID: name, OriginalFileName: name}
+		if rating > 0 {
+			asset.ExifInfo = &utils.TExifInfo{Rating: rating}
+		}
+		return asset
+	}
+
+	tests := []struct {
+		name          string
+		promote       string
+		assets        []utils.TAsset
+		expectedOrder []string
+	}{
+		{
+			name:          "highest rating first, missing rating counts as 0",
+			promote:       "rating",
+			assets:        []utils.TAsset{rated("IMG_1.jpg", 0), rated("IMG_2.jpg", 3), rated("IMG_3.jpg", 5)},
+			expectedOrder: []string{"IMG_3.jpg", "IMG_2.jpg", "IMG_1.jpg"},
+		},
+		{
+			name:          "earlier entries win over rating",
+			promote:       "cover,rating",
+			assets:        []utils.TAsset{rated("IMG_1.jpg", 5), rated("IMG_2_cover.jpg", 1)},
+			expectedOrder: []string{"IMG_2_cover.jpg", "IMG_1.jpg"},
+		},
+		{
+			name:          "rating wins over later entries",
+			promote:       "rating,edit",
+			assets:        []utils.TAsset{rated("IMG_1_edit.jpg", 2), rated("IMG_1.jpg", 4)},
+			expectedOrder: []string{"IMG_1.jpg", "IMG_1_edit.jpg"},
+		},
+		{
+			name:          "ties fall through to later entries",
+			promote:       "rating,edit",
+			assets:        []utils.TAsset{rated("IMG_1.jpg", 4), rated("IMG_1_edit.jpg", 4)},
+			expectedOrder: []string{"IMG_1_edit.jpg", "IMG_1.jpg"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := sortStack(tt.assets, tt.promote, "", nil, utils.DefaultCriteria, &safePromoteData{data: make(map[string]map[string]string)}, make(map[int]map[string]int))
+
+			actual := make([]string, len(result))
+			for i, asset := range result {
+				actual[i] = asset.OriginalFileName
+			}
+			assert.Equal(t, tt.expectedOrder, actual)
+		})
+	}
+}
+
+func TestUploadPromotion(t *testing.T) {
+	uploaded := func(id string, name string, createdAt string) utils.TAsset {
+		return utils.TAsset{ID: id, OriginalFileName: name, CreatedAt: createdAt}
+	}
+	first := uploaded("1", "IMG_1.jpg", "2024-01-01T10:00:00.000Z")
+	reexport := uploaded("2", "IMG_1.jpg", "2024-03-01T10:00:00.000Z")
+	unknown := uploaded("3", "IMG_1.jpg", "")
+	legacy := utils.TAsset{ID: "4", OriginalFileName: "IMG_1.jpg", FileCreatedAt: "2024-02-01T10:00:00.000Z"}
+	cover := uploaded("5", "IMG_1_cover.jpg", "2023-01-01T10:00:00.000Z")
+
+	tests := []struct {
+		name          string
+		promote       string
+		assets        []utils.TAsset
+		expectedOrder []string
+	}{
+		{
+			name:          "newest upload first, without upload time last",
+			promote:       "newestUpload",
+			assets:        []utils.TAsset{unknown, first, reexport, legacy},
+			expectedOrder: []string{"2", "4", "1", "3"},
+		},
+		{
+			name:          "oldest upload first",
+			promote:       "oldestUpload",
+			assets:        []utils.TAsset{unknown, reexport, first},
+			expectedOrder: []string{"1", "2", "3"},
+		},
+		{
+			name:          "earlier entries win over the upload order",
+			promote:       "cover,newestUpload",
+			assets:        []utils.TAsset{reexport, cover},
+			expectedOrder: []string{"5", "2"},
+		},
+		{
+			name:          "ties fall through to the rating",
+			promote:       "newestUpload,rating",
+			assets:        []utils.TAsset{uploaded("6", "IMG_1.jpg", "2024-01-01T10:00:00Z"), {ID: "7", OriginalFileName: "IMG_1.jpg", CreatedAt: "2024-01-01T10:00:00.000Z", ExifInfo: &utils.TExifInfo{Rating: 3}}},
+			expectedOrder: []string{"7", "6"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := sortStack(tt.assets, tt.promote, "", nil, utils.DefaultCriteria, &safePromoteData{data: make(map[string]map[string]string)}, make(map[int]map[string]int))
+
+			actual := make([]string, len(result))
+			for i, asset := range result {
+				actual[i] = asset.ID
+			}
+			assert.Equal(t, tt.expectedOrder, actual)
+		})
+	}
+}
+
+func TestRequiresExif(t *testing.T) {
+	assert.True(t, RequiresExif("cover,rating,edit", ""))
+	assert.True(t, RequiresExif("rating", ""))
+	assert.False(t, RequiresExif("cover,edit,biggestNumber", ""))
+	assert.False(t, RequiresExif("", ""))
+	assert.True(t, RequiresExif("", `[{"key":"iso","compare":{"op":"gte","value":1600}}]`))
+	assert.True(t, RequiresExif("", `{"mode":"advanced","expression":{"criteria":{"key":"focalLength"}}}`))
+	assert.False(t, RequiresExif("", `[{"key":"originalFileName"}]`))
+}
+
 func TestEditedPhotoPromotion(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -1734,6 +2012,64 @@ func TestGetPromoteIndex(t *testing.T) {
 	}
 }
 
+/************************************************************************************************
+** Test cases pinning the shared promote semantics: plain and mode-aware lookups must agree for
+** every list without sequence keywords.
+************************************************************************************************/
+
+func TestPromoteListSemantics(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		promoteList []string
+		expected    int
+	}{
+		{
+			name:        "empty string negative match for unmatched value",
+			value:       "PXL_20230101_123456789.jpg",
+			promoteList: []string{"", "~2", "~3"},
+			expected:    0,
+		},
+		{
+			name:        "pixel tilde suffix matches after empty string",
+			value:       "PXL_20230101_123456789~2.jpg",
+			promoteList: []string{"", "~2", "~3"},
+			expected:    1,
+		},
+		{
+			name:        "empty string wins over biggestNumber for unmatched value",
+			value:       "photo.jpg",
+			promoteList: []string{"_edited", "biggestNumber", ""},
+			expected:    2,
+		},
+		{
+			name:        "biggestNumber index for unmatched value",
+			value:       "photo~5.jpg",
+			promoteList: []string{"_edited", "biggestNumber"},
+			expected:    1,
+		},
+		{
+			name:        "biggestNumber is never matched as a substring",
+			value:       "biggestNumber.jpg",
+			promoteList: []string{"_edited", "biggestNumber", "biggest"},
+			expected:    2,
+		},
+		{
+			name:        "first biggestNumber wins when repeated",
+			value:       "photo.jpg",
+			promoteList: []string{"biggestNumber", "_edited", "biggestNumber"},
+			expected:    0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, getPromoteIndex(tt.value, tt.promoteList), "getPromoteIndex")
+			assert.Equal(t, tt.expected, getPromoteIndexWithMode(tt.value, tt.promoteList, "contains"), "getPromoteIndexWithMode")
+		})
+	}
+}
+
 func TestIsSequencePattern(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -1890,3 +2226,154 @@ func TestExtractSequencePattern(t *testing.T) {
 		})
 	}
 }
+
+func TestParseSequenceKeyword(t *testing.T) {
+	tests := []struct {
+		keyword            string
+		expectedPrefix     string
+		expectedDigits     int
+		expectedDescending bool
+	}{
+		{keyword: "sequence", expectedPrefix: "", expectedDigits: 0, expectedDescending: false},
+		{keyword: "sequence:desc", expectedPrefix: "", expectedDigits: 0, expectedDescending: true},
+		{keyword: "sequence:4:desc", expectedPrefix: "", expectedDigits: 4, expectedDescending: true},
+		{keyword: "sequence:IMG_:desc", expectedPrefix: "IMG_", expectedDigits: 0, expectedDescending: true},
+		{keyword: "sequence:4", expectedPrefix: "", expectedDigits: 4, expectedDescending: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.keyword, func(t *testing.T) {
+			prefix, digits, descending := parseSequenceKeyword(tt.keyword)
+			assert.Equal(t, tt.expectedPrefix, prefix)
+			assert.Equal(t, tt.expectedDigits, digits)
+			assert.Equal(t, tt.expectedDescending, descending)
+		})
+	}
+}
+
+func TestParsePromoteOrder(t *testing.T) {
+	order, err := ParsePromoteOrder("")
+	require.NoError(t, err)
+	assert.Equal(t, utils.DefaultPromoteOrder, order)
+
+	order, err = ParsePromoteOrder(" ext , size,alpha ")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ext", "size", "alpha"}, order)
+
+	_, err = ParsePromoteOrder("ext,weight")
+	assert.ErrorContains(t, err, `unknown promote rule "weight"`)
+	_, err = ParsePromoteOrder("ext,alpha,ext")
+	assert.ErrorContains(t, err, `promote rule "ext" is listed twice`)
+}
+
+func TestSortStackWithOrder(t *testing.T) {
+	size := func(bytes float64) *utils.TExifInfo { return &utils.TExifInfo{FileSizeInByte: &bytes} }
+	edit := utils.TAsset{ID: "1", OriginalFileName: "IMG_1234_edit.jpg", ExifInfo: size(1000)}
+	raw := utils.TAsset{ID: "2", OriginalFileName: "IMG_1234.dng", ExifInfo: size(3000)}
+	jpeg := utils.TAsset{ID: "3", OriginalFileName: "IMG_1234.jpg", ExifInfo: size(2000)}
+	sortWith := func(order string) []string {
+		rules, err := ParsePromoteOrder(order)
+		require.NoError(t, err)
+		sorted := sortStackWithOrder([]utils.TAsset{edit, raw, jpeg}, utils.DefaultParentFilenamePromoteString, "dng,jpg", nil, utils.DefaultCriteria, &safePromoteData{data: make(map[string]map[string]string)}, make(map[int]map[string]int), rules, nil)
+		return []string{sorted[0].ID, sorted[1].ID, sorted[2].ID}
+	}
+
+	assert.Equal(t, []string{"1", "2", "3"}, sortWith(""), "the filename rule comes first by default")
+	assert.Equal(t, []string{"2", "1", "3"}, sortWith("ext,filename"), "the extension rule comes before the filename rule")
+	assert.Equal(t, []string{"2", "3", "1"}, sortWith("size"), "the largest file first")
+}
+
+func TestExtRankFallback(t *testing.T) {
+	webp := utils.TAsset{ID: "1", OriginalFileName: "a.webp"}
+	avif := utils.TAsset{ID: "2", OriginalFileName: "b.avif"}
+	heic := utils.TAsset{ID: "3", OriginalFileName: "c.heic"}
+	png := utils.TAsset{ID: "4", OriginalFileName: "d.png"}
+	sortWith := func(fallback string, assets ...utils.TAsset) []string {
+		rules := withExtRankFallback(utils.DefaultPromoteOrder, fallback)
+		sorted := sortStackWithOrder(assets, "", ".dng", nil, utils.DefaultCriteria, &safePromoteData{data: make(map[string]map[string]string)}, make(map[int]map[string]int), rules, nil)
+		names := make([]string, 0, len(sorted))
+		for _, asset := range sorted {
+			names = append(names, asset.OriginalFileName)
+		}
+		return names
+	}
+
+	// The extensions PARENT_EXT_PROMOTE does not list
+	assert.Equal(t, []string{"a.webp", "b.avif", "c.heic"}, sortWith("", heic, avif, webp), "the built-in rank ties, the filenames decide")
+	assert.Equal(t, []string{"a.webp", "b.avif", "c.heic"}, sortWith(utils.ExtRankFallbackBuiltin, heic, avif, webp))
+	assert.Equal(t, []string{"b.avif", "c.heic", "a.webp"}, sortWith(utils.ExtRankFallbackAlpha, heic, avif, webp), "the extensions in alphabetical order")
+	assert.Equal(t, []string{"a.webp", "b.avif", "c.heic"}, sortWith(utils.ExtRankFallbackNone, heic, avif, webp), "the filenames decide")
+
+	// Only the built-in rank puts png ahead of the others
+	assert.Equal(t, []string{"d.png", "a.webp", "b.avif", "c.heic"}, sortWith(utils.ExtRankFallbackBuiltin, heic, png, avif, webp))
+	assert.Equal(t, []string{"b.avif", "c.heic", "d.png", "a.webp"}, sortWith(utils.ExtRankFallbackAlpha, heic, png, avif, webp))
+	assert.Equal(t, []string{"a.webp", "b.avif", "c.heic", "d.png"}, sortWith(utils.ExtRankFallbackNone, heic, png, avif, webp))
+
+	assert.Equal(t, []string{"regex", "filename", "ext", "alpha"}, withExtRankFallback(utils.DefaultPromoteOrder, utils.ExtRankFallbackNone))
+	assert.Contains(t, utils.DefaultPromoteOrder, utils.PromoteRuleExtRank, "the default order is left untouched")
+
+	_, err := New(Options{ExtRankFallback: "size"}).Stack([]utils.TAsset{webp})
+	assert.ErrorContains(t, err, `unknown extension rank fallback "size", expected builtin, alpha or none`)
+}
+
+func TestParseExtPromoteList(t *testing.T) {
+	assert.Equal(t, []string{".jpg", ".dng", "", ".raf"}, parseExtPromoteList(".JPG, .Dng,,RAF"))
+	assert.Nil(t, parseExtPromoteList(""))
+	assert.Equal(t, []string{"edit", "@raw"}, parsePromoteList("edit, @raw"), "the meta-extensions only stand for extensions in the ext list")
+}
+
+func TestParseExtPromote(t *testing.T) {
+	extensions, err := ParseExtPromote(".jpg,@raw")
+	require.NoError(t, err)
+	assert.Equal(t, append([]string{".jpg"}, utils.RawExtensions...), extensions)
+	assert.Contains(t, extensions, ".gpr")
+	assert.Contains(t, extensions, ".fff")
+
+	extensions, err = ParseExtPromote(".dng, @RAW ,@video")
+	require.NoError(t, err)
+	assert.Equal(t, ".dng", extensions[0])
+	assert.Equal(t, ".3fr", extensions[1], "the extensions listed before the meta-extension keep their place")
+	assert.Len(t, extensions, len(utils.RawExtensions)+len(utils.VideoExtensions))
+
+	extensions, err = ParseExtPromote(utils.DefaultParentExtPromoteString)
+	require.NoError(t, err)
+	assert.Equal(t, utils.DefaultParentExtPromote, extensions)
+
+	_, err = ParseExtPromote(".jpg,@photo")
+	assert.EqualError(t, err, `unknown meta-extension "@photo", expected @raw, @image or @video`)
+	_, err = New(Options{ParentExtPromote: "@raws"}).Stack([]utils.TAsset{{ID: "1", OriginalFileName: "a.jpg"}})
+	assert.ErrorContains(t, err, `unknown meta-extension "@raws"`)
+
+	// Substrings of filenames may start with @, they are left as they are
+	assert.Equal(t, []string{"@2x", "cover"}, parsePromoteList("@2x,cover"))
+}
+
+func TestSortStackMetaExtensions(t *testing.T) {
+	jpeg := utils.TAsset{ID: "1", OriginalFileName: "GOPR0001.jpg"}
+	gpr := utils.TAsset{ID: "2", OriginalFileName: "GOPR0001.gpr"}
+	mp4 := utils.TAsset{ID: "3", OriginalFileName: "GOPR0001.mp4"}
+	rules, err := ParsePromoteOrder("ext,alpha")
+	require.NoError(t, err)
+
+	for promote, want := range map[string][]string{
+		"@raw,@image,@video": {"2", "1", "3"},
+		"@video,@raw":        {"3", "2", "1"},
+		"":                   {"1", "2", "3"},
+	} {
+		sorted := sortStackWithOrder([]utils.TAsset{mp4, jpeg, gpr}, "", promote, nil, utils.DefaultCriteria, &safePromoteData{data: make(map[string]map[string]string)}, make(map[int]map[string]int), rules, nil)
+		assert.Equal(t, want, []string{sorted[0].ID, sorted[1].ID, sorted[2].ID}, promote)
+	}
+}
+
+func TestSortStackMixedCaseExtensions(t *testing.T) {
+	jpeg := utils.TAsset{ID: "1", OriginalFileName: "DSCF1234.jpg"}
+	raf := utils.TAsset{ID: "2", OriginalFileName: "DSCF1234.raf"}
+	dng := utils.TAsset{ID: "3", OriginalFileName: "DSCF1234.DNG"}
+	rules, err := ParsePromoteOrder("ext,alpha")
+	require.NoError(t, err)
+
+	for _, promote := range []string{".RAF,.Dng,.JPG", "raf,DNG,jpg", ".raf,.dng,.jpg"} {
+		sorted := sortStackWithOrder([]utils.TAsset{jpeg, raf, dng}, "", promote, nil, utils.DefaultCriteria, &safePromoteData{data: make(map[string]map[string]string)}, make(map[int]map[string]int), rules, nil)
+		assert.Equal(t, []string{"2", "3", "1"}, []string{sorted[0].ID, sorted[1].ID, sorted[2].ID}, promote)
+	}
+}
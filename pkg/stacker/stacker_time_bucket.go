@@ -0,0 +1,169 @@
+package stacker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+)
+
+/**************************************************************************************************
+** timeBucketLimit returns the maximum number of assets of a time bucket, the configured one or
+** utils.DefaultMaxTimeBucket.
+**
+** @param opts - Options of the run
+** @return int - The limit
+**************************************************************************************************/
+func timeBucketLimit(opts Options) int {
+	if opts.MaxTimeBucket > 0 {
+		return opts.MaxTimeBucket
+	}
+	return utils.DefaultMaxTimeBucket
+}
+
+/**************************************************************************************************
+** dropCrowdedTimeBuckets removes the groups built on a time criterion that hold more assets than
+** the limit, before they are merged and sorted. Such a bucket comes from a bulk import giving
+** the same timestamp to thousands of files: sorting it is slow and the resulting stack would be
+** rejected anyway.
+**
+** @param groups - The groups created by exact key matching
+** @param criteria - The criteria the keys were built from, one key part per criteria
+** @param limit - Maximum number of assets of a time bucket
+** @param logger - Logger for the skipped buckets
+** @return map[string][]utils.TAsset - The groups left
+**************************************************************************************************/
+func dropCrowdedTimeBuckets(groups map[string][]utils.TAsset, criteria []utils.TCriteria, limit int, logger *logrus.Logger) map[string][]utils.TAsset {
+	var crowded []string
+	for key, group := range groups {
+		if len(group) > limit && keyTimestamp(key, criteria) != "" {
+			crowded = append(crowded, key)
+		}
+	}
+	sort.Strings(crowded)
+	for _, key := range crowded {
+		warnCrowdedTimeBucket(len(groups[key]), keyTimestamp(key, criteria), limit, logger)
+		delete(groups, key)
+	}
+	return groups
+}
+
+/**************************************************************************************************
+** dropCrowdedGroupKeys is dropCrowdedTimeBuckets for the groups format, where an asset holds a
+** key per criteria group: the crowded time keys are removed from every asset, and an asset left
+** without a key is no longer grouped.
+**
+** @param assets - Assets matching a criteria group
+** @param assetKeys - Grouping keys of each asset, by asset ID
+** @param groups - The criteria groups the keys were built from
+** @param limit - Maximum number of assets of a time bucket
+** @param logger - Logger for the skipped buckets
+** @return []utils.TAsset - The assets left with a key
+** @return map[string][]string - Their keys
+**************************************************************************************************/
+func dropCrowdedGroupKeys(assets []utils.TAsset, assetKeys map[string][]string, groups []utils.TCriteriaGroup, limit int, logger *logrus.Logger) ([]utils.TAsset, map[string][]string) {
+	counts := make(map[string]int)
+	for _, keys := range assetKeys {
+		for _, key := range keys {
+			counts[key]++
+		}
+	}
+
+	crowded := make(map[string]bool)
+	var names []string
+	for key, count := range counts {
+		if count > limit && groupKeyTimestamp(key, groups) != "" {
+			crowded[key] = true
+			names = append(names, key)
+		}
+	}
+	if len(crowded) == 0 {
+		return assets, assetKeys
+	}
+	sort.Strings(names)
+	for _, key := range names {
+		warnCrowdedTimeBucket(counts[key], groupKeyTimestamp(key, groups), limit, logger)
+	}
+
+	kept := make([]utils.TAsset, 0, len(assets))
+	keptKeys := make(map[string][]string, len(assetKeys))
+	for _, asset := range assets {
+		var keys []string
+		for _, key := range assetKeys[asset.ID] {
+			if !crowded[key] {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) > 0 {
+			kept = append(kept, asset)
+			keptKeys[asset.ID] = keys
+		}
+	}
+	return kept, keptKeys
+}
+
+/**************************************************************************************************
+** warnCrowdedTimeBucket logs a skipped time bucket, with the criteria change that avoids it.
+**
+** @param count - Number of assets of the bucket
+** @param timestamp - Timestamp shared by the assets, after the delta is applied
+** @param limit - Maximum number of assets of a time bucket
+** @param logger - Logger instance to use
+**************************************************************************************************/
+func warnCrowdedTimeBucket(count int, timestamp string, limit int, logger *logrus.Logger) {
+	logger.Warnf("⚠️  Skipped %d assets sharing the timestamp %s, above the time bucket limit of %d (MAX_TIME_BUCKET). A bulk import likely gave them the same date: add an originalFileName criterion to tell them apart", count, timestamp, limit)
+}
+
+/**************************************************************************************************
+** keyTimestamp returns the value of the first time criteria in a legacy or expression grouping
+** key, whose parts follow the order of the criteria.
+**
+** @param key - The grouping key
+** @param criteria - The criteria the key was built from
+** @return string - The timestamp, or an empty string if no time criteria is part of the key
+**************************************************************************************************/
+func keyTimestamp(key string, criteria []utils.TCriteria) string {
+	for i, part := range strings.Split(key, "|") {
+		if i < len(criteria) && part != "" && isTimeCriteria(criteria[i].Key) {
+			return strings.TrimPrefix(part, criteria[i].Key+"=")
+		}
+	}
+	return ""
+}
+
+/**************************************************************************************************
+** groupKeyTimestamp returns the value of the first time criteria in a key of the groups format,
+** "group_0_or_1_localDateTime:..." or "group_1_and:originalFileName=...|localDateTime=...".
+**
+** @param key - Grouping key built by applyAdvancedCriteria
+** @param groups - The criteria groups the key was built from
+** @return string - The timestamp, or an empty string if no time criteria is part of the key
+**************************************************************************************************/
+func groupKeyTimestamp(key string, groups []utils.TCriteriaGroup) string {
+	var group, criterion int
+	if _, err := fmt.Sscanf(key, "group_%d_or_%d_", &group, &criterion); err == nil {
+		if group >= len(groups) || criterion >= len(groups[group].Criteria) {
+			return ""
+		}
+		c := groups[group].Criteria[criterion]
+		prefix := fmt.Sprintf("group_%d_or_%d_%s:", group, criterion, c.Key)
+		if !isTimeCriteria(c.Key) || !strings.HasPrefix(key, prefix) {
+			return ""
+		}
+		return strings.TrimPrefix(key, prefix)
+	}
+	if _, err := fmt.Sscanf(key, "group_%d_", &group); err == nil {
+		prefix := fmt.Sprintf("group_%d_and:", group)
+		if !strings.HasPrefix(key, prefix) {
+			return ""
+		}
+		for _, part := range strings.Split(strings.TrimPrefix(key, prefix), "|") {
+			if name, value, ok := strings.Cut(part, "="); ok && isTimeCriteria(name) {
+				return value
+			}
+		}
+	}
+	return ""
+}
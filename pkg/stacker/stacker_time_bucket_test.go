@@ -0,0 +1,66 @@
+package stacker
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/majorfi/immich-stack/pkg/utils"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCrowdedTimeBuckets(t *testing.T) {
+	// A bulk import dating 6 files the same, next to a regular burst of 2
+	var assets []utils.TAsset
+	for i := 0; i < 6; i++ {
+		assets = append(assets, utils.TAsset{ID: fmt.Sprintf("import%d", i), OriginalFileName: fmt.Sprintf("takeout%d.jpg", i), LocalDateTime: "2019-01-01T00:00:00.000Z"})
+	}
+	assets = append(assets,
+		utils.TAsset{ID: "burst1", OriginalFileName: "burst1.jpg", LocalDateTime: "2024-03-01T10:00:00.000Z"},
+		utils.TAsset{ID: "burst2", OriginalFileName: "burst2.jpg", LocalDateTime: "2024-03-01T10:00:00.300Z"},
+	)
+
+	modes := map[string]string{
+		"legacy":     `[{"key": "localDateTime", "delta": {"milliseconds": 1000}}]`,
+		"expression": `{"mode": "advanced", "expression": {"operator": "AND", "children": [{"criteria": {"key": "localDateTime", "delta": {"milliseconds": 1000}}}]}}`,
+		"groups":     `{"mode": "advanced", "groups": [{"operator": "AND", "criteria": [{"key": "localDateTime", "delta": {"milliseconds": 1000}}]}]}`,
+	}
+	for name, criteria := range modes {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			logger := logrus.New()
+			logger.SetOutput(&out)
+
+			stacks, err := New(Options{Criteria: criteria, MaxTimeBucket: 5, Logger: logger}).Stack(assets)
+			require.NoError(t, err)
+			require.Len(t, stacks, 1)
+			assert.Len(t, stacks[0].Members, 2)
+			assert.Equal(t, "burst1", stacks[0].Parent.ID)
+			assert.Contains(t, out.String(), "Skipped 6 assets sharing the timestamp 2019-01-01T00:00:00.000000000Z, above the time bucket limit of 5 (MAX_TIME_BUCKET)")
+
+			// Under the default limit, the import is stacked
+			stacks, err = New(Options{Criteria: criteria}).Stack(assets)
+			require.NoError(t, err)
+			assert.Len(t, stacks, 2)
+		})
+	}
+
+	t.Run("buckets without time criteria are kept", func(t *testing.T) {
+		stacks, err := New(Options{Criteria: `[{"key": "originalFileName", "regex": {"key": "^(\\D+)"}}]`, MaxTimeBucket: 5}).Stack(assets)
+		require.NoError(t, err)
+		assert.Len(t, stacks, 2)
+	})
+}
+
+func TestGroupKeyTimestamp(t *testing.T) {
+	groups := []utils.TCriteriaGroup{
+		{Operator: "OR", Criteria: []utils.TCriteria{{Key: "originalFileName"}, {Key: "localDateTime"}}},
+		{Operator: "AND", Criteria: []utils.TCriteria{{Key: "originalFileName"}, {Key: "fileCreatedAt"}}},
+	}
+	assert.Equal(t, "2019-01-01T00:00:00.000Z", groupKeyTimestamp("group_0_or_1_localDateTime:2019-01-01T00:00:00.000Z", groups))
+	assert.Equal(t, "", groupKeyTimestamp("group_0_or_0_originalFileName:IMG", groups))
+	assert.Equal(t, "2019-01-01T00:00:00.000Z", groupKeyTimestamp("group_1_and:originalFileName=IMG|fileCreatedAt=2019-01-01T00:00:00.000Z", groups))
+	assert.Equal(t, "", groupKeyTimestamp("group_1_and:originalFileName=IMG", groups))
+}
@@ -0,0 +1,41 @@
+package stacker
+
+import (
+	"time"
+)
+
+// Longest capture time gap recorded as a near miss of the time delta. Assets further apart are
+// different shots sharing a filename, such as a camera counter that wrapped around
+const timeGapWindow = time.Minute
+
+/**************************************************************************************************
+** timeGapRecorder collects the capture time gaps of the assets matched by their other criteria
+** but kept apart by the time delta, for RecordTimeGaps. A nil recorder records nothing.
+**************************************************************************************************/
+type timeGapRecorder struct {
+	gaps []time.Duration
+}
+
+/**************************************************************************************************
+** record adds the gap between two assets kept apart by the time delta, when it is a near miss.
+**
+** @param gap - Capture time gap between the assets
+**************************************************************************************************/
+func (r *timeGapRecorder) record(gap time.Duration) {
+	if r == nil || gap > timeGapWindow {
+		return
+	}
+	r.gaps = append(r.gaps, gap)
+}
+
+/**************************************************************************************************
+** list returns the recorded gaps.
+**
+** @return []time.Duration - The gaps, nil on a nil recorder
+**************************************************************************************************/
+func (r *timeGapRecorder) list() []time.Duration {
+	if r == nil {
+		return nil
+	}
+	return r.gaps
+}
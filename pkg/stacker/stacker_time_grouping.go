@@ -29,9 +29,10 @@ type AssetWithTime struct {
 **
 ** @param groups - The initial groups created by exact key matching
 ** @param criteria - The criteria used for grouping
+** @param gaps - Records the gaps between the groups left apart (may be nil)
 ** @return map[string][]utils.TAsset - The merged groups
 **************************************************************************************************/
-func mergeTimeBasedGroups(groups map[string][]utils.TAsset, criteria []utils.TCriteria) (map[string][]utils.TAsset, error) {
+func mergeTimeBasedGroups(groups map[string][]utils.TAsset, criteria []utils.TCriteria, gaps *timeGapRecorder) (map[string][]utils.TAsset, error) {
 	var timeCriteriaIndices []int
 	var timeDeltas []int
 	hasTimeDelta := false
@@ -66,7 +67,10 @@ func mergeTimeBasedGroups(groups map[string][]utils.TAsset, criteria []utils.TCr
 		for _, key := range keys {
 			for _, asset := range groups[key] {
 				for _, idx := range timeCriteriaIndices {
-					timeStr := getAssetTimeField(asset, criteria[idx].Key)
+					timeStr, err := resolveTimeValue(asset, criteria[idx])
+					if err != nil {
+						return nil, err
+					}
 					if timeStr != "" {
 						if parsedTime, err := time.Parse(time.RFC3339Nano, timeStr); err == nil {
 							allAssetsWithTime = append(allAssetsWithTime, AssetWithTime{
@@ -101,6 +105,11 @@ func mergeTimeBasedGroups(groups map[string][]utils.TAsset, criteria []utils.TCr
 		slidingGroups := performSlidingWindowGrouping(allAssetsWithTime, maxDelta)
 
 		for i, group := range slidingGroups {
+			// The assets around each break share the other criteria, the time delta alone split them
+			if i > 0 {
+				previous := slidingGroups[i-1]
+				gaps.record(group[0].ParsedTime.Sub(previous[len(previous)-1].ParsedTime))
+			}
 			if len(group) > 0 {
 				newKey := fmt.Sprintf("%s|timegroup_%d", nonTimeKey, i)
 				assets := make([]utils.TAsset, len(group))
@@ -111,7 +111,7 @@ func TestMergeTimeBasedGroups(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mergedGroups, err := mergeTimeBasedGroups(tt.groups, tt.criteria)
+			mergedGroups, err := mergeTimeBasedGroups(tt.groups, tt.criteria, nil)
 			if err != nil {
 				t.Fatalf("mergeTimeBasedGroups failed: %v", err)
 			}
@@ -294,3 +294,138 @@ func TestGetAssetTimeFieldWithEmptyAsset(t *testing.T) {
 		})
 	}
 }
+
+func TestResolveTimeValueWithFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		asset    utils.TAsset
+		criteria utils.TCriteria
+		expected string
+		wantErr  bool
+	}{
+		{
+			name:     "no fallback keeps epoch value",
+			asset:    utils.TAsset{LocalDateTime: "1970-01-01T00:00:00.000Z", FileCreatedAt: "2023-05-01T10:00:00.000Z"},
+			criteria: utils.TCriteria{Key: "localDateTime"},
+			expected: "1970-01-01T00:00:00.000Z",
+		},
+		{
+			name:     "valid primary value is used",
+			asset:    utils.TAsset{LocalDateTime: "2023-05-01T09:00:00.000Z", FileCreatedAt: "2023-05-01T10:00:00.000Z"},
+			criteria: utils.TCriteria{Key: "localDateTime", FallbackKeys: []string{"fileCreatedAt"}},
+			expected: "2023-05-01T09:00:00.000Z",
+		},
+		{
+			name:     "epoch primary falls back",
+			asset:    utils.TAsset{LocalDateTime: "1970-01-01T00:00:00.000Z", FileCreatedAt: "2023-05-01T10:00:00.000Z"},
+			criteria: utils.TCriteria{Key: "localDateTime", FallbackKeys: []string{"fileCreatedAt", "fileModifiedAt"}},
+			expected: "2023-05-01T10:00:00.000Z",
+		},
+		{
+			name:     "empty primary falls back to second key",
+			asset:    utils.TAsset{FileCreatedAt: "1980-01-01T00:00:00.000Z", FileModifiedAt: "2023-05-02T10:00:00.000Z"},
+			criteria: utils.TCriteria{Key: "localDateTime", FallbackKeys: []string{"fileCreatedAt", "fileModifiedAt"}},
+			expected: "2023-05-02T10:00:00.000Z",
+		},
+		{
+			name:     "all invalid excludes asset",
+			asset:    utils.TAsset{LocalDateTime: "1970-01-01T00:00:00.000Z", FileCreatedAt: "1970-01-01T00:00:00.000Z"},
+			criteria: utils.TCriteria{Key: "localDateTime", FallbackKeys: []string{"fileCreatedAt"}},
+			expected: "",
+		},
+		{
+			name:     "custom threshold",
+			asset:    utils.TAsset{LocalDateTime: "2005-06-01T00:00:00.000Z", FileCreatedAt: "2023-05-01T10:00:00.000Z"},
+			criteria: utils.TCriteria{Key: "localDateTime", FallbackKeys: []string{"fileCreatedAt"}, MinValidDate: "2010-01-01"},
+			expected: "2023-05-01T10:00:00.000Z",
+		},
+		{
+			name:     "threshold without fallback excludes old values",
+			asset:    utils.TAsset{LocalDateTime: "1970-01-01T00:00:00.000Z"},
+			criteria: utils.TCriteria{Key: "localDateTime", MinValidDate: "1990-01-01T00:00:00Z"},
+			expected: "",
+		},
+		{
+			name:     "non-time fallback key",
+			asset:    utils.TAsset{LocalDateTime: "1970-01-01T00:00:00.000Z"},
+			criteria: utils.TCriteria{Key: "localDateTime", FallbackKeys: []string{"originalFileName"}},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid threshold",
+			asset:    utils.TAsset{LocalDateTime: "2023-05-01T09:00:00.000Z"},
+			criteria: utils.TCriteria{Key: "localDateTime", FallbackKeys: []string{"fileCreatedAt"}, MinValidDate: "yesterday"},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := resolveTimeValue(tt.asset, tt.criteria)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("resolveTimeValue() expected error, got %q", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveTimeValue() unexpected error: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("resolveTimeValue() = %q, want %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMergeTimeBasedGroupsUsesFallbackTime(t *testing.T) {
+	criteria := []utils.TCriteria{
+		{Key: "originalFileName"},
+		{Key: "localDateTime", Delta: &utils.TDelta{Milliseconds: 1000}, FallbackKeys: []string{"fileCreatedAt"}},
+	}
+	groups := map[string][]utils.TAsset{
+		"scan|a": {{ID: "1", OriginalFileName: "scan", LocalDateTime: "1970-01-01T00:00:00.000Z", FileCreatedAt: "2023-05-01T10:00:00.000Z"}},
+		"scan|b": {{ID: "2", OriginalFileName: "scan", LocalDateTime: "1970-01-01T00:00:00.000Z", FileCreatedAt: "2023-09-01T10:00:00.000Z"}},
+	}
+
+	merged, err := mergeTimeBasedGroups(groups, criteria, nil)
+	if err != nil {
+		t.Fatalf("mergeTimeBasedGroups() unexpected error: %v", err)
+	}
+	if len(merged) != 2 {
+		t.Errorf("Expected scans with distinct fallback times to stay apart, got %d groups", len(merged))
+	}
+}
+
+func TestStackRecordsTimeGaps(t *testing.T) {
+	assets := []utils.TAsset{
+		{ID: "1", OriginalFileName: "IMG_0001.JPG", LocalDateTime: "2024-01-01T10:00:00.000Z"},
+		{ID: "2", OriginalFileName: "IMG_0001.DNG", LocalDateTime: "2024-01-01T10:00:02.500Z"},
+		{ID: "3", OriginalFileName: "IMG_0002.JPG", LocalDateTime: "2024-01-01T11:00:00.000Z"},
+		{ID: "4", OriginalFileName: "IMG_0002.DNG", LocalDateTime: "2024-01-01T11:00:00.500Z"},
+		{ID: "5", OriginalFileName: "IMG_0003.JPG", LocalDateTime: "2024-01-01T12:00:00.000Z"},
+		{ID: "6", OriginalFileName: "IMG_0003.DNG", LocalDateTime: "2024-01-01T14:00:00.000Z"},
+	}
+
+	s := New(Options{RecordTimeGaps: true})
+	stacks, err := s.Stack(assets)
+	if err != nil {
+		t.Fatalf("Stack() unexpected error: %v", err)
+	}
+	if len(stacks) != 1 {
+		t.Errorf("Expected only IMG_0002 to be stacked, got %d stacks", len(stacks))
+	}
+	// The two hours apart are different shots, not a near miss
+	gaps := s.TimeGaps()
+	if len(gaps) != 1 || gaps[0] != 2500*time.Millisecond {
+		t.Errorf("Expected the near miss of IMG_0001 only, got %v", gaps)
+	}
+
+	s = New(Options{})
+	if _, err := s.Stack(assets); err != nil {
+		t.Fatalf("Stack() unexpected error: %v", err)
+	}
+	if gaps := s.TimeGaps(); gaps != nil {
+		t.Errorf("Expected no gaps recorded without RecordTimeGaps, got %v", gaps)
+	}
+}
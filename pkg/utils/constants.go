@@ -29,6 +29,25 @@ var DefaultCriteria = []TCriteria{
 	},
 }
 
+/**************************************************************************************************
+** DefaultMinValidDate is the sanity threshold applied to time criteria using fallbackKeys.
+** Timestamps before this date (e.g. scans landing on 1970-01-01) are treated as invalid and
+** the next fallback key is tried instead.
+**************************************************************************************************/
+const DefaultMinValidDate = "1990-01-01"
+
+/**************************************************************************************************
+** DefaultFuzzyBucketSize caps the distinct values compared pairwise in one time bucket by a fuzzy
+** criteria, as the comparison grows with the square of their number.
+**************************************************************************************************/
+const DefaultFuzzyBucketSize = 500
+
+/**************************************************************************************************
+** DefaultMaxTimeBucket caps the assets sharing the timestamp of a time criteria in one grouping
+** key. A larger bucket is skipped, as it comes from a bulk import dating every file the same.
+**************************************************************************************************/
+const DefaultMaxTimeBucket = 500
+
 /**************************************************************************************************
 ** DefaultParentFilenamePromote is the default parent filename promote for grouping photos.
 ** It promotes the filename of the original filename.
@@ -36,12 +55,129 @@ var DefaultCriteria = []TCriteria{
 var DefaultParentFilenamePromote = []string{"cover", "edit", "crop", "hdr", "biggestNumber"}
 var DefaultParentFilenamePromoteString = strings.Join(DefaultParentFilenamePromote, ",")
 
+/**************************************************************************************************
+** DefaultEditedSuffixes are the suffixes photo apps add to the name of an edited copy, in the
+** languages of the phone: IMG_1234-edited.jpg, IMG_1234-bearbeitet.jpg, IMG_1234-editado.jpg.
+** The stacker uses them when its options list no suffixes.
+**************************************************************************************************/
+var DefaultEditedSuffixes = []string{
+	"edited",       // English
+	"bearbeitet",   // German
+	"modifié",      // French
+	"editado",      // Spanish, Portuguese
+	"modificato",   // Italian
+	"bewerkt",      // Dutch
+	"redigerad",    // Swedish
+	"redigeret",    // Danish
+	"redigert",     // Norwegian
+	"muokattu",     // Finnish
+	"edytowane",    // Polish
+	"upraveno",     // Czech
+	"szerkesztett", // Hungarian
+	"düzenlendi",   // Turkish
+}
+
+/**************************************************************************************************
+** Known extensions of RAW files, of processed images and of videos, the sets the @raw, @image and
+** @video meta-extensions of PARENT_EXT_PROMOTE stand for. DNG comes first, the other RAW formats
+** follow in alphabetical order.
+**************************************************************************************************/
+var RawExtensions = []string{
+	".dng", ".3fr", ".arw", ".cr2", ".cr3", ".crw", ".dcr", ".erf", ".fff", ".gpr", ".iiq", ".k25", ".kdc",
+	".mef", ".mos", ".mrw", ".nef", ".nrw", ".orf", ".pef", ".raf", ".raw", ".rw2", ".rwl", ".sr2", ".srf",
+	".srw", ".x3f",
+}
+var ImageExtensions = []string{
+	".jpg", ".jpeg", ".png", ".heic", ".heif", ".avif", ".webp", ".jxl", ".gif", ".tif", ".tiff", ".bmp",
+}
+var VideoExtensions = []string{
+	".mp4", ".mov", ".m4v", ".mts", ".m2ts", ".avi", ".mkv", ".webm", ".3gp", ".mpg", ".mpeg", ".wmv",
+}
+
 /**************************************************************************************************
 ** DefaultParentExtPromote is the default parent extension promote for grouping photos.
-** It promotes the extension of the filename.
+** It promotes the extension of the filename: the processed images first, then the RAW files.
+**************************************************************************************************/
+var DefaultParentExtPromote = append([]string{".jpg", ".png", ".jpeg", ".heic", ".heif", ".avif", ".webp"}, RawExtensions...)
+var DefaultParentExtPromoteString = ".jpg,.png,.jpeg,.heic,.heif,.avif,.webp,@raw"
+
+/**************************************************************************************************
+** SidecarExtensions are the extensions of the metadata files written next to a photo, such as
+** the IMG_1234.jpg.json of Google Takeout, the .xmp of Lightroom and the .aae of iOS edits.
+**************************************************************************************************/
+var SidecarExtensions = []string{".json", ".xmp", ".aae"}
+
+/**************************************************************************************************
+** Parent selection rules, applied in the order PROMOTE_ORDER lists them. DefaultPromoteOrder is
+** the built-in order; the size rule is only applied when listed.
+**************************************************************************************************/
+const (
+	PromoteRuleRegex    = "regex"    // Regex promote_index values
+	PromoteRuleFilename = "filename" // PARENT_FILENAME_PROMOTE
+	PromoteRuleExt      = "ext"      // PARENT_EXT_PROMOTE
+	PromoteRuleExtRank  = "extRank"  // Built-in extension rank
+	PromoteRuleSize     = "size"     // Largest file first
+	PromoteRuleAlpha    = "alpha"    // Alphabetical filename
+)
+
+var DefaultPromoteOrder = []string{PromoteRuleRegex, PromoteRuleFilename, PromoteRuleExt, PromoteRuleExtRank, PromoteRuleAlpha}
+var DefaultPromoteOrderString = strings.Join(DefaultPromoteOrder, ",")
+
+/**************************************************************************************************
+** Fallbacks of the extRank rule for the extensions PARENT_EXT_PROMOTE leaves out: the built-in
+** rank (jpeg > jpg > png > others), the alphabetical order of the extensions, or none, leaving
+** the tie to the following rules.
+**************************************************************************************************/
+const (
+	ExtRankFallbackBuiltin = "builtin"
+	ExtRankFallbackAlpha   = "alpha"
+	ExtRankFallbackNone    = "none"
+)
+
+/**************************************************************************************************
+** DefaultProfileName is the profile of the assets no criteria profile selects, grouped with the
+** settings of the run.
+**************************************************************************************************/
+const DefaultProfileName = "default"
+
+/**************************************************************************************************
+** Union modes of the OR groups. In connected mode, assets sharing any grouping key are stacked
+** together, even when the keys differ across the stack. In strict mode, each asset keeps only
+** the grouping key of its highest-priority criterion. DefaultUnionLogSize is the component size
+** above which a component bridged by different keys is logged.
+**************************************************************************************************/
+const (
+	UnionModeConnected  = "connected"
+	UnionModeStrict     = "strict"
+	DefaultUnionLogSize = 2
+)
+
+/**************************************************************************************************
+** Actions of the sanity rules on a stack breaking them: split it along the rule, as if the
+** checked value was part of the grouping key, or drop it with a warning.
+**************************************************************************************************/
+const (
+	SanityActionSplit = "split"
+	SanityActionDrop  = "drop"
+)
+
+/**************************************************************************************************
+** Visibilities of an asset on newer Immich that keep it out of the timeline: the motion part of a
+** live photo and the assets hidden by hand are hidden, the assets of the locked folder are locked.
+**************************************************************************************************/
+const (
+	VisibilityHidden = "hidden"
+	VisibilityLocked = "locked"
+)
+
+/**************************************************************************************************
+** Policies on a stack of more members than the server accepts: skip it with a warning, or split
+** it into chronological chunks within the limit.
 **************************************************************************************************/
-var DefaultParentExtPromote = []string{".jpg", ".png", ".jpeg", ".heic", ".dng"}
-var DefaultParentExtPromoteString = strings.Join(DefaultParentExtPromote, ",")
+const (
+	OversizePolicySkip  = "skip"
+	OversizePolicySplit = "split"
+)
 
 /**************************************************************************************************
 ** Reason messages
@@ -49,3 +185,5 @@ var DefaultParentExtPromoteString = strings.Join(DefaultParentExtPromote, ",")
 var REASON_DELETE_STACK_WITH_ONE_ASSET = "deleting stack with only one asset"
 var REASON_REPLACE_CHILD_STACK_WITH_NEW_ONE = "replacing child stack with new one"
 var REASON_RESET_STACK = "resetting stack"
+var REASON_REJECT_STACK = "rejected by the user"
+var REASON_REMOVE_EXCLUDED_EXTENSION = "holding an excluded extension"
@@ -1,7 +1,9 @@
 package utils
 
 import (
+	"path"
 	"path/filepath"
+	"strings"
 )
 
 /**************************************************************************************************
@@ -120,3 +122,57 @@ func BoolToString(b bool) string {
 func GetDir(filePath string) string {
 	return filepath.Dir(filePath)
 }
+
+/**************************************************************************************************
+** NormalizePathSeparators turns the backslashes of a Windows or UNC path into forward slashes,
+** so paths from a Windows share compare, split and display like the others.
+**
+** @param p - The path to normalize
+** @return string - The path with forward slashes only
+**************************************************************************************************/
+func NormalizePathSeparators(p string) string {
+	return strings.ReplaceAll(p, "\\", "/")
+}
+
+/**************************************************************************************************
+** PathBase returns the last element of a path, whatever its separators.
+**
+** @param p - The path or file name
+** @return string - The last element of the path
+**************************************************************************************************/
+func PathBase(p string) string {
+	return path.Base(NormalizePathSeparators(p))
+}
+
+/**************************************************************************************************
+** IsSidecar tells whether a file is a sidecar holding the metadata of a photo rather than a
+** photo or a video, from its extension, ignoring case: IMG_1234.jpg.json, IMG_1234.XMP.
+**
+** @param name - The path or file name
+** @return bool - True for a sidecar
+**************************************************************************************************/
+func IsSidecar(name string) bool {
+	return Contains(SidecarExtensions, strings.ToLower(path.Ext(PathBase(name))))
+}
+
+/**************************************************************************************************
+** IsHiddenAsset tells whether an asset is kept out of the timeline by its visibility, hidden or
+** in the locked folder. A stack badge on a visible asset would reveal it.
+**
+** @param asset - The asset
+** @return bool - True for a hidden or locked asset
+**************************************************************************************************/
+func IsHiddenAsset(asset TAsset) bool {
+	return asset.Visibility == VisibilityHidden || asset.Visibility == VisibilityLocked
+}
+
+/**************************************************************************************************
+** IsIncompleteAsset tells whether an asset is still uploading: the search can list it before
+** Immich stored its checksum and detected its type, without checksum or with the type OTHER.
+**
+** @param asset - The asset
+** @return bool - True for an asset not fully uploaded yet
+**************************************************************************************************/
+func IsIncompleteAsset(asset TAsset) bool {
+	return asset.Checksum == "" || asset.Type == "OTHER"
+}
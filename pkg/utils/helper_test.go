@@ -283,3 +283,85 @@ func TestGetDir(t *testing.T) {
 		})
 	}
 }
+
+func TestNormalizePathSeparators(t *testing.T) {
+	tests := []struct {
+		input        string
+		expected     string
+		expectedBase string
+	}{
+		{input: `\\nas\photos\2023\IMG_1.jpg`, expected: "//nas/photos/2023/IMG_1.jpg", expectedBase: "IMG_1.jpg"},
+		{input: `C:\Users\me\Pictures\IMG_2.dng`, expected: "C:/Users/me/Pictures/IMG_2.dng", expectedBase: "IMG_2.dng"},
+		{input: "/photos/2023/IMG_3.jpg", expected: "/photos/2023/IMG_3.jpg", expectedBase: "IMG_3.jpg"},
+		{input: "IMG_4.jpg", expected: "IMG_4.jpg", expectedBase: "IMG_4.jpg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if result := NormalizePathSeparators(tt.input); result != tt.expected {
+				t.Errorf("NormalizePathSeparators(%q) = %q, expected %q", tt.input, result, tt.expected)
+			}
+			if result := PathBase(tt.input); result != tt.expectedBase {
+				t.Errorf("PathBase(%q) = %q, expected %q", tt.input, result, tt.expectedBase)
+			}
+		})
+	}
+}
+
+func TestIsSidecar(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{input: "IMG_1234.jpg.json", expected: true},
+		{input: "IMG_1234.XMP", expected: true},
+		{input: "/photos/2024/IMG_1234.aae", expected: true},
+		{input: `C:\photos\IMG_1234.xmp`, expected: true},
+		{input: "IMG_1234.jpg", expected: false},
+		{input: "json", expected: false},
+		{input: "IMG_1234.json.jpg", expected: false},
+	}
+
+	for _, tt := range tests {
+		if result := IsSidecar(tt.input); result != tt.expected {
+			t.Errorf("IsSidecar(%q) = %v, expected %v", tt.input, result, tt.expected)
+		}
+	}
+}
+
+func TestIsHiddenAsset(t *testing.T) {
+	tests := []struct {
+		visibility string
+		expected   bool
+	}{
+		{visibility: "", expected: false},
+		{visibility: "timeline", expected: false},
+		{visibility: "archive", expected: false},
+		{visibility: VisibilityHidden, expected: true},
+		{visibility: VisibilityLocked, expected: true},
+	}
+
+	for _, tt := range tests {
+		if result := IsHiddenAsset(TAsset{Visibility: tt.visibility}); result != tt.expected {
+			t.Errorf("IsHiddenAsset(%q) = %v, expected %v", tt.visibility, result, tt.expected)
+		}
+	}
+}
+
+func TestIsIncompleteAsset(t *testing.T) {
+	tests := []struct {
+		asset    TAsset
+		expected bool
+	}{
+		{asset: TAsset{Type: "IMAGE", Checksum: "c1"}, expected: false},
+		{asset: TAsset{Type: "VIDEO", Checksum: "c2"}, expected: false},
+		{asset: TAsset{Type: "IMAGE"}, expected: true},
+		{asset: TAsset{Type: "OTHER", Checksum: "c3"}, expected: true},
+	}
+
+	for _, tt := range tests {
+		if result := IsIncompleteAsset(tt.asset); result != tt.expected {
+			t.Errorf("IsIncompleteAsset(%+v) = %v, expected %v", tt.asset, result, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+/**************************************************************************************************
+** Defaults of the log file rotation: the file is rotated once it reaches DefaultLogFileMaxSizeMB
+** and DefaultLogFileMaxBackups rotated files are kept.
+**************************************************************************************************/
+const (
+	DefaultLogFileMaxSizeMB  = 10
+	DefaultLogFileMaxBackups = 5
+)
+
+/**************************************************************************************************
+** RotatingFile is a log file rotated by size. Before a write would make the file larger than its
+** maximum size, the file is renamed to path.1, the previous path.1 to path.2 and so on, the
+** oldest backup beyond the maximum count is removed, and a new file is started. It is safe for
+** concurrent use.
+**************************************************************************************************/
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+/**************************************************************************************************
+** NewRotatingFile opens the log file for appending, creating it if needed.
+**
+** @param path - Path of the log file
+** @param maxSizeMB - Size in megabytes at which the file is rotated, DefaultLogFileMaxSizeMB when 0
+** @param maxBackups - Number of rotated files to keep, 0 keeps none
+** @return *RotatingFile - The opened file
+** @return error - An error if the file cannot be opened
+**************************************************************************************************/
+func NewRotatingFile(path string, maxSizeMB int, maxBackups int) (*RotatingFile, error) {
+	if maxSizeMB <= 0 {
+		maxSizeMB = DefaultLogFileMaxSizeMB
+	}
+	r := &RotatingFile{path: path, maxSize: int64(maxSizeMB) * 1024 * 1024, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+/**************************************************************************************************
+** Write writes to the log file, rotating it first when the write would exceed the maximum size.
+** A single write larger than the maximum size is written to a new file whole.
+**
+** @param p - Bytes to write
+** @return int - Number of bytes written
+** @return error - An error if the file cannot be rotated or written
+**************************************************************************************************/
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+/**************************************************************************************************
+** Close closes the log file.
+**
+** @return error - An error if the file cannot be closed
+**************************************************************************************************/
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+/**************************************************************************************************
+** open opens the log file for appending and records its current size.
+**
+** @return error - An error if the file cannot be opened
+**************************************************************************************************/
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+/**************************************************************************************************
+** rotate shifts the backups, moves the current file to the first backup and opens a new file.
+**
+** @return error - An error if a file cannot be renamed or opened
+**************************************************************************************************/
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	if r.maxBackups <= 0 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return r.open()
+	}
+	if err := os.Remove(r.backupPath(r.maxBackups)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(r.backupPath(i), r.backupPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(r.path, r.backupPath(1)); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+/**************************************************************************************************
+** backupPath returns the path of the nth rotated file.
+**
+** @param n - Number of the backup, 1 being the most recent
+** @return string - The path of the backup
+**************************************************************************************************/
+func (r *RotatingFile) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", r.path, n)
+}
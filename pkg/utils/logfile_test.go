@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "immich-stack.log")
+	file, err := NewRotatingFile(path, 1, 2)
+	require.NoError(t, err)
+	defer file.Close()
+
+	// Each line is a bit more than a third of a megabyte: two fit in a file, not three
+	line := strings.Repeat("x", 400*1024) + "\n"
+	for i := 0; i < 7; i++ {
+		n, err := file.Write([]byte(line))
+		require.NoError(t, err)
+		assert.Equal(t, len(line), n)
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		require.NoError(t, err, name)
+		assert.LessOrEqual(t, info.Size(), int64(1024*1024), name)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "only two backups are kept")
+
+	current, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, line, string(current), "the seventh line starts a new file")
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "immich-stack.log")
+	require.NoError(t, os.WriteFile(path, []byte("previous run\n"), 0644))
+
+	file, err := NewRotatingFile(path, 1, 0)
+	require.NoError(t, err)
+	_, err = file.Write([]byte("this run\n"))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "previous run\nthis run\n", string(content))
+
+	_, err = NewRotatingFile(filepath.Join(path, "not-a-dir.log"), 1, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+/**************************************************************************************************
+** Stack marker modes. The marker identifies stacks created by the tool so later operations
+** (like resetting stacks) can target them reliably instead of relying on heuristics.
+**************************************************************************************************/
+const (
+	StackMarkerNone        = "none"
+	StackMarkerDescription = "description"
+	StackMarkerTag         = "tag"
+)
+
+/**************************************************************************************************
+** StackMarkerTagName is the Immich tag attached to stack parents in "tag" marker mode.
+** StackMarkerPrefix is the prefix of the marker written into descriptions in "description" mode.
+**************************************************************************************************/
+const StackMarkerTagName = "immich-stack"
+const StackMarkerPrefix = "[immich-stack "
+
+/**************************************************************************************************
+** IsValidStackMarker checks if a marker mode is supported. An empty value is treated as "none".
+**
+** @param mode - The marker mode to check
+** @return bool - True if the mode is supported
+**************************************************************************************************/
+func IsValidStackMarker(mode string) bool {
+	switch mode {
+	case "", StackMarkerNone, StackMarkerDescription, StackMarkerTag:
+		return true
+	default:
+		return false
+	}
+}
+
+/**************************************************************************************************
+** BuildStackMarker builds the description marker written onto a stack parent, for example
+** "[immich-stack v1.2 key=IMG_1234]". A version that is not a release number, such as "dev",
+** is written as is.
+**
+** @param version - Version of the tool creating the stack
+** @param key - Grouping key of the stack
+** @return string - The marker text
+**************************************************************************************************/
+func BuildStackMarker(version string, key string) string {
+	version = strings.TrimPrefix(version, "v")
+	if version != "" && version[0] >= '0' && version[0] <= '9' {
+		version = "v" + version
+	}
+	return fmt.Sprintf("%s%s key=%s]", StackMarkerPrefix, version, key)
+}
+
+/**************************************************************************************************
+** HasStackMarker checks if an asset carries a stack marker, either in its description or as
+** the immich-stack tag. The assets of a search or of the stacks come without their tags, the
+** client searches the assets of the tag instead.
+**
+** @param asset - The asset to check
+** @return bool - True if the asset was marked by the tool
+**************************************************************************************************/
+func HasStackMarker(asset TAsset) bool {
+	if asset.ExifInfo != nil && strings.Contains(asset.ExifInfo.Description, StackMarkerPrefix) {
+		return true
+	}
+	for _, tag := range asset.Tags {
+		if tag.Value == StackMarkerTagName || tag.Name == StackMarkerTagName {
+			return true
+		}
+	}
+	return false
+}
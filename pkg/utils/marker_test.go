@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildStackMarker(t *testing.T) {
+	assert.Equal(t, "[immich-stack v1.2 key=IMG_1234]", BuildStackMarker("1.2", "IMG_1234"))
+	assert.Equal(t, "[immich-stack v1.2 key=IMG_1234]", BuildStackMarker("v1.2", "IMG_1234"))
+	assert.Equal(t, "[immich-stack dev key=IMG_1234]", BuildStackMarker("dev", "IMG_1234"))
+}
+
+func TestIsValidStackMarker(t *testing.T) {
+	for _, mode := range []string{"", "none", "description", "tag"} {
+		assert.True(t, IsValidStackMarker(mode), mode)
+	}
+	assert.False(t, IsValidStackMarker("album"))
+}
+
+func TestHasStackMarker(t *testing.T) {
+	tests := []struct {
+		name     string
+		asset    TAsset
+		expected bool
+	}{
+		{name: "no metadata", asset: TAsset{}, expected: false},
+		{name: "plain description", asset: TAsset{ExifInfo: &TExifInfo{Description: "Holidays"}}, expected: false},
+		{name: "description marker", asset: TAsset{ExifInfo: &TExifInfo{Description: "Holidays [immich-stack v1.2 key=IMG_1]"}}, expected: true},
+		{name: "marker tag", asset: TAsset{Tags: []TTag{{Name: "immich-stack", Value: "immich-stack"}}}, expected: true},
+		{name: "other tag", asset: TAsset{Tags: []TTag{{Name: "family", Value: "family"}}}, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, HasStackMarker(tt.asset))
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Timeout of the export of the finished spans to the collector
+const traceExportTimeout = 5 * time.Second
+
+/**************************************************************************************************
+** Tracer records the spans of the runs with the OpenTelemetry SDK and exports them to a collector
+** with OTLP/HTTP. A nil tracer records nothing: every method of Tracer and Span is safe to call on
+** nil, so tracing costs a nil check when it is disabled. It is safe for concurrent use.
+**************************************************************************************************/
+type Tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+/**************************************************************************************************
+** Span is a timed operation of a trace, with its attributes. The spans of a trace share the trace
+** ID of its root.
+**************************************************************************************************/
+type Span struct {
+	tracer *Tracer
+	ctx    context.Context
+	span   trace.Span
+}
+
+/**************************************************************************************************
+** NewTracer creates the tracer exporting to an OTLP/HTTP collector.
+**
+** @param endpoint - Base URL of the collector, as OTEL_EXPORTER_OTLP_ENDPOINT. /v1/traces is appended
+** @param service - Name of the service reported with the spans
+** @param version - Version of the service
+** @return *Tracer - The tracer, or nil when the endpoint is empty or the exporter cannot be set up
+**************************************************************************************************/
+func NewTracer(endpoint, service, version string) *Tracer {
+	if endpoint == "" {
+		return nil
+	}
+	// The export is not retried, an unreachable collector must not hold up a run
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(strings.TrimSuffix(endpoint, "/")+"/v1/traces"),
+		otlptracehttp.WithTimeout(traceExportTimeout),
+		otlptracehttp.WithRetry(otlptracehttp.RetryConfig{Enabled: false}),
+	)
+	if err != nil {
+		return nil
+	}
+	return newTracer(exporter, service, version)
+}
+
+/**************************************************************************************************
+** newTracer creates the tracer batching its spans to an exporter, until the next Flush.
+**
+** @param exporter - Exporter of the finished spans
+** @param service - Name of the service reported with the spans
+** @param version - Version of the service
+** @return *Tracer - The tracer
+**************************************************************************************************/
+func newTracer(exporter sdktrace.SpanExporter, service, version string) *Tracer {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(service), semconv.ServiceVersion(version))),
+	)
+	return &Tracer{provider: provider, tracer: provider.Tracer(service)}
+}
+
+/**************************************************************************************************
+** Start begins the root span of a new trace.
+**
+** @param name - Name of the span
+** @return *Span - The span, or nil on a nil tracer
+**************************************************************************************************/
+func (t *Tracer) Start(name string) *Span {
+	if t == nil {
+		return nil
+	}
+	ctx, span := t.tracer.Start(context.Background(), name, trace.WithNewRoot())
+	return &Span{tracer: t, ctx: ctx, span: span}
+}
+
+/**************************************************************************************************
+** Child begins a span of the same trace, nested in this one.
+**
+** @param name - Name of the span
+** @return *Span - The span, or nil on a nil span
+**************************************************************************************************/
+func (s *Span) Child(name string) *Span {
+	return s.child(name, trace.SpanKindInternal)
+}
+
+/**************************************************************************************************
+** ClientChild begins a span of the same trace, nested in this one, for a request sent to another
+** service, which may record its own spans under it.
+**
+** @param name - Name of the span
+** @return *Span - The span, or nil on a nil span
+**************************************************************************************************/
+func (s *Span) ClientChild(name string) *Span {
+	return s.child(name, trace.SpanKindClient)
+}
+
+/**************************************************************************************************
+** child begins a span of the given kind nested in this one.
+**
+** @param name - Name of the span
+** @param kind - Kind of the span
+** @return *Span - The span, or nil on a nil span
+**************************************************************************************************/
+func (s *Span) child(name string, kind trace.SpanKind) *Span {
+	if s == nil {
+		return nil
+	}
+	ctx, span := s.tracer.tracer.Start(s.ctx, name, trace.WithSpanKind(kind))
+	return &Span{tracer: s.tracer, ctx: ctx, span: span}
+}
+
+/**************************************************************************************************
+** SetString sets a string attribute of the span.
+**
+** @param key - Name of the attribute
+** @param value - Value of the attribute
+**************************************************************************************************/
+func (s *Span) SetString(key, value string) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(attribute.String(key, value))
+}
+
+/**************************************************************************************************
+** SetInt sets an integer attribute of the span.
+**
+** @param key - Name of the attribute
+** @param value - Value of the attribute
+**************************************************************************************************/
+func (s *Span) SetInt(key string, value int) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(attribute.Int(key, value))
+}
+
+/**************************************************************************************************
+** SetBool sets a boolean attribute of the span.
+**
+** @param key - Name of the attribute
+** @param value - Value of the attribute
+**************************************************************************************************/
+func (s *Span) SetBool(key string, value bool) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(attribute.Bool(key, value))
+}
+
+/**************************************************************************************************
+** SetError marks the span as failed. A nil error leaves it as is.
+**
+** @param err - Error of the operation
+**************************************************************************************************/
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+/**************************************************************************************************
+** TraceParent returns the W3C traceparent header of the span, so the requests it sends can be
+** correlated with the traces of the server.
+**
+** @return string - The header value, empty on a nil span
+**************************************************************************************************/
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(s.ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+/**************************************************************************************************
+** End ends the span, which is exported with the next Flush.
+**************************************************************************************************/
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.span.End()
+}
+
+/**************************************************************************************************
+** Flush exports the finished spans to the collector. The spans are dropped even when the export
+** fails, so an unreachable collector does not grow the memory of a cron run.
+**
+** @return error - An error if the collector could not be reached or rejected the spans
+**************************************************************************************************/
+func (t *Tracer) Flush() error {
+	if t == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*traceExportTimeout)
+	defer cancel()
+	if err := t.provider.ForceFlush(ctx); err != nil {
+		return fmt.Errorf("error exporting the spans: %w", err)
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** HashKey hashes a grouping key for a span attribute, so the traces do not carry the filenames.
+**
+** @param key - Grouping key
+** @return string - The first 16 hex digits of its SHA-256
+**************************************************************************************************/
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracer(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tracer := newTracer(exporter, "immich-stack", "test")
+	run := tracer.Start("run")
+	page := run.Child("fetch_page")
+	page.SetInt("assets", 42)
+	page.SetString("key", HashKey("IMG_0001"))
+	page.SetError(errors.New("timeout"))
+	page.End()
+	request := run.ClientChild("immich.request")
+	request.End()
+	run.End()
+	assert.Regexp(t, `^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`, run.TraceParent())
+
+	require.NoError(t, tracer.Flush())
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+	assert.Equal(t, "fetch_page", spans[0].Name)
+	assert.Equal(t, spans[2].SpanContext.TraceID(), spans[0].SpanContext.TraceID(), "a child shares the trace of its root")
+	assert.Equal(t, spans[2].SpanContext.SpanID(), spans[0].Parent.SpanID())
+	assert.False(t, spans[2].Parent.IsValid())
+	assert.Equal(t, codes.Error, spans[0].Status.Code)
+	assert.Contains(t, spans[0].Attributes, attribute.Int("assets", 42))
+	assert.Len(t, spans[0].Attributes[1].Value.AsString(), 16, "the key is hashed")
+	assert.Equal(t, trace.SpanKindInternal, spans[0].SpanKind)
+	assert.Equal(t, trace.SpanKindClient, spans[1].SpanKind, "a request is a client span")
+	assert.Equal(t, "immich-stack", spans[2].InstrumentationLibrary.Name)
+
+	exporter.Reset()
+	require.NoError(t, tracer.Flush())
+	assert.Empty(t, exporter.GetSpans(), "nothing left to export")
+	assert.NotEqual(t, run.TraceParent()[3:35], tracer.Start("run").TraceParent()[3:35], "each root starts a trace")
+}
+
+func TestTracerDisabled(t *testing.T) {
+	tracer := NewTracer("", "immich-stack", "test")
+	assert.Nil(t, tracer)
+	span := tracer.Start("run")
+	assert.Nil(t, span)
+	child := span.Child("group")
+	child.SetInt("assets", 1)
+	child.SetBool("dryRun", true)
+	child.SetError(errors.New("failed"))
+	child.End()
+	assert.Nil(t, span.ClientChild("immich.request"))
+	assert.Empty(t, child.TraceParent())
+	assert.NoError(t, tracer.Flush())
+}
+
+func TestTracerExport(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+	}))
+	defer server.Close()
+
+	tracer := NewTracer(server.URL+"/", "immich-stack", "test")
+	require.NotNil(t, tracer)
+	tracer.Start("run").End()
+	require.NoError(t, tracer.Flush())
+	assert.Equal(t, []string{"/v1/traces"}, paths)
+}
+
+func TestTracerExportError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	tracer := NewTracer(server.URL, "immich-stack", "test")
+	tracer.Start("run").End()
+	assert.ErrorContains(t, tracer.Flush(), "400 Bad Request")
+	assert.NoError(t, tracer.Flush(), "the failed spans are dropped")
+}
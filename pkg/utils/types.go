@@ -1,5 +1,14 @@
 package utils
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
 /**************************************************************************************************
 ** TDelta represents a time delta configuration for comparing time-based values.
 ** It allows for a buffer when comparing timestamps.
@@ -13,23 +22,76 @@ type TDelta struct {
 ** and process values from assets for comparison and grouping.
 **************************************************************************************************/
 type TCriteria struct {
-	Key   string  `json:"key"`             // Field name to extract from asset
-	Split *TSplit `json:"split,omitempty"` // Optional split operation
-	Regex *TRegex `json:"regex,omitempty"` // Optional regex operation
-	Delta *TDelta `json:"delta,omitempty"` // Optional time delta for time-based fields
+	Key            string    `json:"key"`                      // Field name to extract from asset
+	Split          *TSplit   `json:"split,omitempty"`          // Optional split operation
+	Regex          *TRegex   `json:"regex,omitempty"`          // Optional regex operation
+	Delta          *TDelta   `json:"delta,omitempty"`          // Optional time delta for time-based fields
+	FallbackKeys   []string  `json:"fallbackKeys,omitempty"`   // Optional time fields to try when the primary one is missing or invalid
+	MinValidDate   string    `json:"minValidDate,omitempty"`   // Optional sanity threshold for time fields (defaults to DefaultMinValidDate)
+	Length         int       `json:"length,omitempty"`         // Optional prefix length for checksum values (0 = full value)
+	Compare        *TCompare `json:"compare,omitempty"`        // Optional numeric comparison for numeric fields
+	OnMiss         string    `json:"onMiss,omitempty"`         // Optional behavior when the criteria yields no value (legacy criteria only)
+	Value          string    `json:"value,omitempty"`          // Optional asset type to match (type key only), case-insensitive
+	Fuzzy          *TFuzzy   `json:"fuzzy,omitempty"`          // Optional approximate matching of filenames (experimental)
+	Normalize      string    `json:"normalize,omitempty"`      // Optional transform of the filename before split and regex (originalFileName key only)
+	StripExtension bool      `json:"stripExtension,omitempty"` // Optional match of the regex against the filename without its extension (originalFileName key only)
+	EditedSuffixes []string  `json:"-"`                        // Suffixes removed by the stripEditedSuffix normalize, resolved from the stacker options. Empty uses DefaultEditedSuffixes
+}
+
+/**************************************************************************************************
+** Normalize transforms of an originalFileName criteria, applied to the filename before the split
+** or the regex.
+**************************************************************************************************/
+const (
+	NormalizeStripEditedSuffix = "stripEditedSuffix" // Remove a localized edited suffix, see DefaultEditedSuffixes
+)
+
+/**************************************************************************************************
+** OnMiss behaviors of a legacy criteria whose value is empty for an asset (e.g. a regex that
+** did not match or a missing timestamp). An empty OnMiss means OnMissGroupByOthers.
+**************************************************************************************************/
+const (
+	OnMissGroupByOthers = "group-by-others" // Drop the criteria from the key and group on the others
+	OnMissSkip          = "skip"            // Leave the asset out of any stack
+	OnMissError         = "error"           // Report the asset as errored
+)
+
+/**************************************************************************************************
+** TFuzzy represents the approximate matching of an originalFileName criteria: the values of a
+** time bucket whose normalized forms are within MaxDistance edits of each other are grouped
+** together. Buckets holding more than MaxBucketSize distinct values are left exact.
+**************************************************************************************************/
+type TFuzzy struct {
+	MaxDistance   int `json:"maxDistance"`             // Maximum Levenshtein distance between two values
+	MaxBucketSize int `json:"maxBucketSize,omitempty"` // Maximum number of values compared per bucket (0 = DefaultFuzzyBucketSize)
+}
+
+/**************************************************************************************************
+** TCompare represents a numeric comparison applied to a numeric criteria value (e.g. iso).
+** Assets whose value does not satisfy the comparison get an empty value: they do not match
+** the leaf in expression mode and are left out of that criteria in legacy mode.
+**************************************************************************************************/
+type TCompare struct {
+	Op    string  `json:"op"`    // Comparison operator: eq, ne, gt, gte, lt or lte
+	Value float64 `json:"value"` // Value to compare against
 }
 
 /**************************************************************************************************
 ** TSplit represents a split operation on a key value. It splits the value by a delimiter
-** and selects a specific part by index.
+** and selects a specific part by index, or a range of parts joined back together.
 **************************************************************************************************/
 type TSplit struct {
 	/**********************************************************************************************
 	** Delimiters is a list of delimiters to split the string sequentially (e.g., ["~", "."]).
-	** Index is the part to select after all splits.
+	** Index is the part to select after all splits, negative indices counting from the end.
+	** From and To select the parts from From to To included instead, joined by the first
+	** delimiter (e.g., from 1 to 2 of "photos/2023/05/a" is "2023/05"). A missing From starts at
+	** the first part and a missing To ends at the last one.
 	**********************************************************************************************/
 	Delimiters []string `json:"delimiters"`
 	Index      int      `json:"index"`
+	From       *int     `json:"from,omitempty"`
+	To         *int     `json:"to,omitempty"`
 }
 
 /**************************************************************************************************
@@ -40,42 +102,232 @@ type TSplit struct {
 ** Field Design Notes:
 ** - Index: Not a pointer, defaults to 0 (full match) when not specified. This maintains
 **   backward compatibility as existing configs expect index 0 as the default behavior.
+** - Indices/Joiner: When Indices is set, the value is the capture groups at those indices joined
+**   by Joiner (e.g. indices [2, 4] with joiner "_" gives matches[2] + "_" + matches[4]), and
+**   Index is ignored.
 ** - PromoteIndex: Pointer to distinguish between explicit 0 (capture group 0) and unset
 **   (nil). This allows optional promotion behavior without affecting grouping logic.
 **   When nil, no regex-based promotion occurs. When set (even to 0), promotion uses
 **   the specified capture group.
+** - IndexName/PromoteName: In JSON, index and promote_index also take the name of a named
+**   group, as "index": "date" for (?P<date>...). The name is kept apart and resolved into
+**   Index or PromoteIndex when the criteria are precompiled, failing if the pattern has no
+**   group of that name, so renumbering the groups of a pattern does not break the criteria.
 **************************************************************************************************/
 type TRegex struct {
 	Key          string   `json:"key"`                     // Regular expression pattern to match against the value
 	Index        int      `json:"index"`                   // Index of capture group to select (0 = full match, 1+ = capture groups). Defaults to 0.
+	IndexName    string   `json:"-"`                       // Optional: name of the capture group to select, resolved into Index
+	Indices      []int    `json:"indices,omitempty"`       // Optional: capture groups combined into the value, replacing Index
+	Joiner       string   `json:"joiner,omitempty"`        // Optional: string between the capture groups of Indices
 	PromoteIndex *int     `json:"promote_index,omitempty"` // Optional: capture group index to use for promotion ordering (nil = no promotion)
+	PromoteName  string   `json:"-"`                       // Optional: name of the capture group to use for promotion, resolved into PromoteIndex
 	PromoteKeys  []string `json:"promote_keys,omitempty"`  // Optional: ordered list of values for promotion (first = highest priority)
 }
 
+// regexFields is TRegex without its JSON methods, to decode the other fields with the default decoder
+type regexFields TRegex
+
+/**************************************************************************************************
+** captureGroup is a capture group of a regex as written in JSON: its index, or the name of a
+** named group.
+**************************************************************************************************/
+type captureGroup struct {
+	index int
+	name  string
+}
+
+/**************************************************************************************************
+** UnmarshalJSON reads a capture group given as an integer or as a group name.
+**
+** @param data - JSON number or string
+** @return error - An error if the value is neither an integer nor a non-empty string
+**************************************************************************************************/
+func (g *captureGroup) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &g.name); err == nil {
+		if g.name == "" {
+			return fmt.Errorf("capture group name is empty")
+		}
+		return nil
+	}
+	if err := json.Unmarshal(data, &g.index); err != nil {
+		return fmt.Errorf("capture group must be an index or a group name, got %s", data)
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** UnmarshalJSON reads a regex whose index and promote_index are a capture group index or name.
+**
+** @param data - JSON object of the regex
+** @return error - An error if a field does not fit its type
+**************************************************************************************************/
+func (r *TRegex) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		regexFields
+		Index        *captureGroup `json:"index"`
+		PromoteIndex *captureGroup `json:"promote_index"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*r = TRegex(raw.regexFields)
+	if raw.Index != nil {
+		r.Index, r.IndexName = raw.Index.index, raw.Index.name
+	}
+	if group := raw.PromoteIndex; group != nil && group.name != "" {
+		r.PromoteName = group.name
+	} else if group != nil {
+		r.PromoteIndex = &group.index
+	}
+	return nil
+}
+
+/**************************************************************************************************
+** MarshalJSON writes a regex back with the capture group names it was given, in the order of
+** the fields of TRegex.
+**
+** @return []byte - JSON object of the regex
+** @return error - Never set, the fields always encode
+**************************************************************************************************/
+func (r TRegex) MarshalJSON() ([]byte, error) {
+	raw := struct {
+		Key          string      `json:"key"`
+		Index        interface{} `json:"index"`
+		Indices      []int       `json:"indices,omitempty"`
+		Joiner       string      `json:"joiner,omitempty"`
+		PromoteIndex interface{} `json:"promote_index,omitempty"`
+		PromoteKeys  []string    `json:"promote_keys,omitempty"`
+	}{Key: r.Key, Index: r.Index, Indices: r.Indices, Joiner: r.Joiner, PromoteKeys: r.PromoteKeys}
+	if r.IndexName != "" {
+		raw.Index = r.IndexName
+	}
+	switch {
+	case r.PromoteName != "":
+		raw.PromoteIndex = r.PromoteName
+	case r.PromoteIndex != nil:
+		raw.PromoteIndex = *r.PromoteIndex
+	}
+	return json.Marshal(raw)
+}
+
 /**************************************************************************************************
 ** TAsset represents an Immich asset with all its metadata and properties.
 ** This structure matches the Immich API response format.
 **************************************************************************************************/
 type TAsset struct {
-	ID               string  `json:"id"`               // Unique identifier
-	DeviceAssetID    string  `json:"deviceAssetId"`    // Original device asset ID
-	DeviceID         string  `json:"deviceId"`         // Device identifier
-	OriginalFileName string  `json:"originalFileName"` // Original file name
-	OriginalPath     string  `json:"originalPath"`     // Original file path
-	LocalDateTime    string  `json:"localDateTime"`    // Local capture time
-	FileCreatedAt    string  `json:"fileCreatedAt"`    // File creation time
-	FileModifiedAt   string  `json:"fileModifiedAt"`   // File modification time
-	HasMetadata      bool    `json:"hasMetadata"`      // Whether asset has metadata
-	IsArchived       bool    `json:"isArchived"`       // Whether asset is archived
-	IsFavorite       bool    `json:"isFavorite"`       // Whether asset is favorited
-	IsOffline        bool    `json:"isOffline"`        // Whether asset is offline
-	IsTrashed        bool    `json:"isTrashed"`        // Whether asset is trashed
-	OwnerID          string  `json:"ownerId"`          // Owner identifier
-	Type             string  `json:"type"`             // Asset type
-	UpdatedAt        string  `json:"updatedAt"`        // Last update time
-	Checksum         string  `json:"checksum"`         // File checksum
-	Duration         string  `json:"duration"`         // Duration (for videos)
-	Stack            *TStack `json:"stack,omitempty"`  // Associated stack if any
+	ID               string     `json:"id"`                 // Unique identifier
+	DeviceAssetID    string     `json:"deviceAssetId"`      // Original device asset ID
+	DeviceID         string     `json:"deviceId"`           // Device identifier
+	OriginalFileName string     `json:"originalFileName"`   // Original file name
+	OriginalPath     string     `json:"originalPath"`       // Original file path
+	LocalDateTime    string     `json:"localDateTime"`      // Local capture time
+	FileCreatedAt    string     `json:"fileCreatedAt"`      // File creation time
+	FileModifiedAt   string     `json:"fileModifiedAt"`     // File modification time
+	HasMetadata      bool       `json:"hasMetadata"`        // Whether asset has metadata
+	IsArchived       bool       `json:"isArchived"`         // Whether asset is archived
+	IsFavorite       bool       `json:"isFavorite"`         // Whether asset is favorited
+	IsOffline        bool       `json:"isOffline"`          // Whether asset is offline
+	IsTrashed        bool       `json:"isTrashed"`          // Whether asset is trashed
+	OwnerID          string     `json:"ownerId"`            // Owner identifier
+	Type             string     `json:"type"`               // Asset type
+	UpdatedAt        string     `json:"updatedAt"`          // Last update time
+	CreatedAt        string     `json:"createdAt"`          // Upload time
+	Checksum         string     `json:"checksum"`           // File checksum
+	Duration         string     `json:"duration"`           // Duration (for videos)
+	LivePhotoVideoID string     `json:"livePhotoVideoId"`   // Motion part of a live photo, if any
+	LibraryID        string     `json:"libraryId"`          // External library the asset was imported from, empty for uploads
+	Visibility       string     `json:"visibility"`         // Timeline visibility on newer Immich: timeline, archive, hidden or locked
+	ExifInfo         *TExifInfo `json:"exifInfo,omitempty"` // EXIF metadata, when requested
+	Tags             []TTag     `json:"tags,omitempty"`     // Tags attached to the asset, when requested
+	Stack            *TStack    `json:"stack,omitempty"`    // Associated stack if any
+	DecodeErrors     []string   `json:"-"`                  // Fields that failed to decode, left empty
+}
+
+// assetFields is TAsset without its UnmarshalJSON, to decode the fields with the default decoder
+type assetFields TAsset
+
+/**************************************************************************************************
+** UnmarshalJSON reads an asset without failing on the fields a newer Immich changed. Unknown
+** fields are ignored and null or missing timestamps are empty strings, as with the default
+** decoder. A field whose value does not fit its type is left empty and named in DecodeErrors,
+** instead of failing the whole page of assets.
+**
+** @param data - JSON object of the asset
+** @return error - An error if the asset is not a JSON object
+**************************************************************************************************/
+func (a *TAsset) UnmarshalJSON(data []byte) error {
+	var fields assetFields
+	err := json.Unmarshal(data, &fields)
+	if err == nil {
+		*a = TAsset(fields)
+		return nil
+	}
+	var raw map[string]json.RawMessage
+	if json.Unmarshal(data, &raw) != nil {
+		return err
+	}
+
+	// Decode the fields one by one, so a failed field does not hide the others
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fields = assetFields{}
+	var failed []string
+	for _, key := range keys {
+		single, _ := json.Marshal(map[string]json.RawMessage{key: raw[key]})
+		if err := json.Unmarshal(single, &fields); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) && typeErr.Field != "" {
+				key = fieldPath(typeErr.Field)
+			}
+			failed = append(failed, key)
+		}
+	}
+	*a = TAsset(fields)
+	a.DecodeErrors = failed
+	return nil
+}
+
+/**************************************************************************************************
+** fieldPath drops the array indexes from the path of a field that failed to decode, so the tags
+** of every asset report tags.id and not tags.0.id, tags.1.id...
+**
+** @param path - Dotted path of the field
+** @return string - The path without indexes
+**************************************************************************************************/
+func fieldPath(path string) string {
+	parts := strings.Split(path, ".")
+	kept := parts[:0]
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err != nil {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, ".")
+}
+
+/**************************************************************************************************
+** TExifInfo represents the subset of Immich EXIF metadata (ExifResponseDto) used by the tool.
+**************************************************************************************************/
+type TExifInfo struct {
+	Description    string   `json:"description"`              // User-editable asset description
+	Rating         int      `json:"rating,omitempty"`         // Star rating, 0 when unrated
+	ISO            *float64 `json:"iso,omitempty"`            // ISO sensitivity
+	FNumber        *float64 `json:"fNumber,omitempty"`        // Aperture f-number
+	FocalLength    *float64 `json:"focalLength,omitempty"`    // Focal length in millimeters
+	FileSizeInByte *float64 `json:"fileSizeInByte,omitempty"` // File size in bytes
+}
+
+/**************************************************************************************************
+** TTag represents an Immich tag as defined in the Immich OpenAPI spec (TagResponseDto).
+**************************************************************************************************/
+type TTag struct {
+	ID    string `json:"id"`    // Tag identifier
+	Name  string `json:"name"`  // Tag name (last path segment)
+	Value string `json:"value"` // Full tag value including parents
 }
 
 /**************************************************************************************************
@@ -94,11 +346,37 @@ type TStack struct {
 **************************************************************************************************/
 type TSearchResponse struct {
 	Assets struct {
-		Items    []TAsset `json:"items"`    // List of assets in current page
-		NextPage string   `json:"nextPage"` // Next page token or empty if last page
+		Items    []TAsset   `json:"items"`    // List of assets in current page
+		NextPage TPageToken `json:"nextPage"` // Next page token or empty if last page
 	} `json:"assets"`
 }
 
+/**************************************************************************************************
+** TPageToken is the next page of a search: a page number sent as a string by Immich, as a number
+** by older builds, or an opaque cursor. Null is the last page, like an empty string.
+**************************************************************************************************/
+type TPageToken string
+
+/**************************************************************************************************
+** UnmarshalJSON reads a page token from a string, a number or null.
+**
+** @param data - JSON value of the token
+** @return error - An error if the value is neither a string, a number nor null
+**************************************************************************************************/
+func (t *TPageToken) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*t = TPageToken(text)
+		return nil
+	}
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return fmt.Errorf("invalid page token %s", data)
+	}
+	*t = TPageToken(number.String())
+	return nil
+}
+
 /**************************************************************************************************
 ** TAlbum represents an Immich album with its metadata.
 **************************************************************************************************/
@@ -117,6 +395,39 @@ type TAlbum struct {
 	AlbumThumbnailID string   `json:"albumThumbnailAssetId,omitempty"` // Thumbnail asset ID
 }
 
+/**************************************************************************************************
+** TDuplicateGroup represents a group of assets the duplicate detection of Immich found alike, as
+** returned by the Immich API (GET /duplicates).
+**************************************************************************************************/
+type TDuplicateGroup struct {
+	DuplicateID string   `json:"duplicateId"` // Group identifier
+	Assets      []TAsset `json:"assets"`      // Assets of the group
+}
+
+/**************************************************************************************************
+** TJobStatus represents a job queue as returned by the Immich API (GET /jobs), keyed by queue
+** name (metadataExtraction, library...).
+**************************************************************************************************/
+type TJobStatus struct {
+	JobCounts   TJobCounts `json:"jobCounts"`
+	QueueStatus struct {
+		IsActive bool `json:"isActive"`
+		IsPaused bool `json:"isPaused"`
+	} `json:"queueStatus"`
+}
+
+/**************************************************************************************************
+** TJobCounts holds the number of jobs of a queue in each state.
+**************************************************************************************************/
+type TJobCounts struct {
+	Active    int `json:"active"`
+	Completed int `json:"completed"`
+	Delayed   int `json:"delayed"`
+	Failed    int `json:"failed"`
+	Paused    int `json:"paused"`
+	Waiting   int `json:"waiting"`
+}
+
 /**************************************************************************************************
 ** TUserResponse represents a user as returned by the Immich API (UserResponseDto).
 ** This structure matches the Immich API response format for /users/me.
@@ -150,11 +461,23 @@ type TCriteriaGroup struct {
 ** - Operator + Children: for logical operations (AND, OR, NOT)
 **************************************************************************************************/
 type TCriteriaExpression struct {
-	Operator *string               `json:"operator,omitempty"` // "AND", "OR", "NOT" - logical operator
-	Criteria *TCriteria            `json:"criteria,omitempty"` // Leaf criteria for evaluation
-	Children []TCriteriaExpression `json:"children,omitempty"` // Child expressions for logical operations
+	Operator        *string               `json:"operator,omitempty"`        // "AND", "OR", "NOT" - logical operator
+	Criteria        *TCriteria            `json:"criteria,omitempty"`        // Leaf criteria for evaluation
+	Children        []TCriteriaExpression `json:"children,omitempty"`        // Child expressions for logical operations
+	KeyContribution string                `json:"keyContribution,omitempty"` // "value" or "none", see KeyContributionValue
 }
 
+/**************************************************************************************************
+** Contributions of an expression node to the grouping key. The matching leaves under a "value"
+** node add their value to the key, those under a "none" node only filter. An empty contribution
+** is "none" for NOT nodes and "value" for the others; a node under a "none" node contributes
+** nothing whatever its own setting.
+**************************************************************************************************/
+const (
+	KeyContributionValue = "value" // The matching leaves add their value to the grouping key
+	KeyContributionNone  = "none"  // The node only filters the assets
+)
+
 /**************************************************************************************************
 ** TAdvancedCriteria represents the advanced criteria configuration that supports
 ** flexible grouping logic with OR/AND operations.
@@ -163,4 +486,31 @@ type TAdvancedCriteria struct {
 	Mode       string               `json:"mode"`                 // "legacy", "advanced"
 	Groups     []TCriteriaGroup     `json:"groups,omitempty"`     // Legacy: Criteria groups (deprecated)
 	Expression *TCriteriaExpression `json:"expression,omitempty"` // New: Nested criteria expression
+	// Grouping key regex → parent filename regex, forcing the parent of the matching stacks
+	ParentOverride map[string]string `json:"parentOverride,omitempty"`
+	// Promote settings of the run, replacing PARENT_FILENAME_PROMOTE, PARENT_EXT_PROMOTE and DELIMITERS
+	Promote *TPromote `json:"promote,omitempty"`
+}
+
+/**************************************************************************************************
+** TPromote holds the promote settings given with the advanced criteria, so a whole configuration
+** can live in one document. A list left out or empty keeps the setting of the run.
+**************************************************************************************************/
+type TPromote struct {
+	Filename   []string `json:"filename,omitempty"`   // Filename substrings to promote as parent
+	Ext        []string `json:"ext,omitempty"`        // Extensions to promote as parent
+	Delimiters []string `json:"delimiters,omitempty"` // Delimiters for the number suffix of biggestNumber
+}
+
+/**************************************************************************************************
+** TProfile is a criteria profile: the assets matching its selector are grouped only with each
+** other, using its own criteria and promote settings. Settings left empty are those of the run.
+**************************************************************************************************/
+type TProfile struct {
+	Name                  string               `json:"name"`                            // Name of the profile, shown in the logs
+	Selector              *TCriteriaExpression `json:"selector"`                        // Expression deciding which assets the profile owns
+	Criteria              json.RawMessage      `json:"criteria,omitempty"`              // Criteria, in any CRITERIA format
+	ParentFilenamePromote string               `json:"parentFilenamePromote,omitempty"` // Filename substrings to promote as parent
+	ParentExtPromote      string               `json:"parentExtPromote,omitempty"`      // Extensions to promote as parent
+	PromoteOrder          string               `json:"promoteOrder,omitempty"`          // Parent selection rules in order
 }
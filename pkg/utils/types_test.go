@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPageTokenUnmarshal(t *testing.T) {
+	tests := map[string]TPageToken{
+		`{"assets": {"nextPage": "2"}}`:              "2",
+		`{"assets": {"nextPage": 3}}`:                "3",
+		`{"assets": {"nextPage": "eyJpZCI6IjEifQ"}}`: "eyJpZCI6IjEifQ",
+		`{"assets": {"nextPage": null}}`:             "",
+		`{"assets": {}}`:                             "",
+	}
+	for data, want := range tests {
+		var response TSearchResponse
+		require.NoError(t, json.Unmarshal([]byte(data), &response), data)
+		assert.Equal(t, want, response.Assets.NextPage, data)
+	}
+
+	var response TSearchResponse
+	assert.Error(t, json.Unmarshal([]byte(`{"assets": {"nextPage": {"page": 2}}}`), &response))
+}
+
+func TestAssetUnmarshal(t *testing.T) {
+	var asset TAsset
+	require.NoError(t, json.Unmarshal([]byte(`{"id": "1", "localDateTime": null, "newField": {"nested": [1, 2]}}`), &asset))
+	assert.Equal(t, TAsset{ID: "1"}, asset, "null timestamps and unknown fields are tolerated")
+
+	asset = TAsset{}
+	require.NoError(t, json.Unmarshal([]byte(`{"id": "2", "isFavorite": "yes", "originalFileName": "IMG_0002.jpg", "tags": [{"id": 3}]}`), &asset))
+	assert.Equal(t, "2", asset.ID)
+	assert.Equal(t, "IMG_0002.jpg", asset.OriginalFileName)
+	assert.False(t, asset.IsFavorite)
+	assert.Equal(t, []string{"isFavorite", "tags.id"}, asset.DecodeErrors)
+
+	assert.Error(t, json.Unmarshal([]byte(`"not an asset"`), &asset))
+}
+
+func TestRegexUnmarshal(t *testing.T) {
+	var regex TRegex
+	require.NoError(t, json.Unmarshal([]byte(`{"key": "(?P<date>\\d{8})_(\\d+)", "index": "date", "promote_index": 2, "promote_keys": ["1"]}`), &regex))
+	assert.Equal(t, "date", regex.IndexName)
+	assert.Equal(t, 0, regex.Index)
+	require.NotNil(t, regex.PromoteIndex)
+	assert.Equal(t, 2, *regex.PromoteIndex)
+	assert.Empty(t, regex.PromoteName)
+	assert.Equal(t, []string{"1"}, regex.PromoteKeys)
+
+	regex = TRegex{}
+	require.NoError(t, json.Unmarshal([]byte(`{"key": "(\\d+)_(?P<suffix>\\w+)", "index": 1, "promote_index": "suffix"}`), &regex))
+	assert.Equal(t, 1, regex.Index)
+	assert.Empty(t, regex.IndexName)
+	assert.Nil(t, regex.PromoteIndex)
+	assert.Equal(t, "suffix", regex.PromoteName)
+
+	// The names are written back as given
+	encoded, err := json.Marshal(regex)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"key": "(\\d+)_(?P<suffix>\\w+)", "index": 1, "promote_index": "suffix"}`, string(encoded))
+	encoded, err = json.Marshal(TRegex{Key: "(\\d+)"})
+	require.NoError(t, err)
+	assert.Equal(t, `{"key":"(\\d+)","index":0}`, string(encoded))
+
+	for _, invalid := range []string{`{"index": ""}`, `{"index": true}`, `{"promote_index": 1.5}`} {
+		assert.Error(t, json.Unmarshal([]byte(invalid), &TRegex{}), invalid)
+	}
+}